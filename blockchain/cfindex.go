@@ -0,0 +1,271 @@
+package blockchain
+
+import (
+	"fmt"
+	"obsidian-core/wire"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// cfilterBucket maps block hash -> serialized basic block filter
+	cfilterBucket = []byte("cfilters")
+
+	// cfheaderBucket maps block hash -> filter header
+	cfheaderBucket = []byte("cfheaders")
+)
+
+// filterIndex maintains BIP158-style basic block filters and the chain of
+// filter headers committing to them. Entries are keyed by block hash, and a
+// block's filter header depends only on its ancestors, so entries stay valid
+// whichever branch is the main chain.
+type filterIndex struct {
+	chain *BlockChain
+
+	mu       sync.Mutex
+	height   int32 // Highest main chain height indexed, -1 if none
+	building bool  // Set while a background pass is catching up
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// EnableFilterIndex turns on the compact filter index and starts indexing,
+// in the background, any main chain blocks that have no filter yet. With
+// rebuild set the stored filters are discarded first.
+func (b *BlockChain) EnableFilterIndex(rebuild bool) error {
+	if b.cfIndex != nil {
+		return fmt.Errorf("filter index already enabled")
+	}
+	idx := &filterIndex{chain: b, height: -1, quit: make(chan struct{})}
+	if rebuild {
+		if err := idx.drop(); err != nil {
+			return err
+		}
+	}
+	b.cfIndex = idx
+	idx.startCatchUp()
+	return nil
+}
+
+// RebuildFilterIndex discards the stored filters and rebuilds them from the
+// main chain in the background.
+func (b *BlockChain) RebuildFilterIndex() error {
+	idx := b.cfIndex
+	if idx == nil {
+		return fmt.Errorf("filter index is not enabled")
+	}
+
+	idx.mu.Lock()
+	if idx.building {
+		idx.mu.Unlock()
+		return fmt.Errorf("filter index is already being built")
+	}
+	if err := idx.drop(); err != nil {
+		idx.mu.Unlock()
+		return err
+	}
+	idx.height = -1
+	idx.mu.Unlock()
+
+	idx.startCatchUp()
+	return nil
+}
+
+// FilterIndexEnabled reports whether compact block filters are indexed.
+func (b *BlockChain) FilterIndexEnabled() bool {
+	return b.cfIndex != nil
+}
+
+// FilterIndexHeight returns the highest main chain height with a filter, or
+// -1 if the index is disabled or empty.
+func (b *BlockChain) FilterIndexHeight() int32 {
+	if b.cfIndex == nil {
+		return -1
+	}
+	b.cfIndex.mu.Lock()
+	defer b.cfIndex.mu.Unlock()
+	return b.cfIndex.height
+}
+
+// BlockFilter returns the serialized basic filter of a block.
+func (b *BlockChain) BlockFilter(hash wire.Hash) ([]byte, error) {
+	if b.cfIndex == nil {
+		return nil, fmt.Errorf("filter index is not enabled")
+	}
+	return b.cfIndex.get(cfilterBucket, hash)
+}
+
+// FilterHeader returns the filter header of a block.
+func (b *BlockChain) FilterHeader(hash wire.Hash) (wire.Hash, error) {
+	if b.cfIndex == nil {
+		return wire.Hash{}, fmt.Errorf("filter index is not enabled")
+	}
+	data, err := b.cfIndex.get(cfheaderBucket, hash)
+	if err != nil {
+		return wire.Hash{}, err
+	}
+	var header wire.Hash
+	copy(header[:], data)
+	return header, nil
+}
+
+// stopFilterIndex waits for a background pass to finish before the
+// database is closed.
+func (b *BlockChain) stopFilterIndex() {
+	if b.cfIndex != nil {
+		close(b.cfIndex.quit)
+		b.cfIndex.wg.Wait()
+	}
+}
+
+// blockConnected indexes a block just added to the main chain at height.
+// While a background pass is running it picks the block up instead, and if
+// blocks below height were missed a pass is started to index them.
+func (idx *filterIndex) blockConnected(block *wire.MsgBlock, height int32) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.building {
+		return
+	}
+	if idx.height != height-1 {
+		idx.startCatchUpLocked()
+		return
+	}
+	if err := idx.indexBlock(block, height); err != nil {
+		fmt.Printf("[CFINDEX] Failed to index block %d: %v\n", height, err)
+		return
+	}
+	idx.height = height
+}
+
+// blockDisconnected removes the main chain block at height from the indexed
+// range. Its filter stays stored, since entries are keyed by block hash.
+func (idx *filterIndex) blockDisconnected(height int32) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.height >= height {
+		idx.height = height - 1
+	}
+}
+
+// startCatchUp starts a background pass unless one is running.
+func (idx *filterIndex) startCatchUp() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.startCatchUpLocked()
+}
+
+// startCatchUpLocked is startCatchUp with idx.mu held.
+func (idx *filterIndex) startCatchUpLocked() {
+	if idx.building {
+		return
+	}
+	idx.building = true
+	idx.wg.Add(1)
+	go idx.catchUp()
+}
+
+// catchUp indexes main chain blocks one at a time until it reaches the tip.
+func (idx *filterIndex) catchUp() {
+	defer idx.wg.Done()
+	for {
+		select {
+		case <-idx.quit:
+			idx.mu.Lock()
+			idx.building = false
+			idx.mu.Unlock()
+			return
+		default:
+		}
+
+		idx.mu.Lock()
+		next := idx.height + 1
+		hash, err := idx.chain.BlockHashByHeight(next)
+		if err != nil {
+			// Caught up; newly connected blocks are indexed as they arrive
+			idx.building = false
+			fmt.Printf("[CFINDEX] Filter index synced to height %d\n", idx.height)
+			idx.mu.Unlock()
+			return
+		}
+		if _, err = idx.get(cfheaderBucket, hash); err != nil {
+			var block *wire.MsgBlock
+			if block, err = idx.chain.db.GetBlock(hash[:]); err == nil {
+				err = idx.indexBlock(block, next)
+			}
+		}
+		if err != nil {
+			idx.building = false
+			fmt.Printf("[CFINDEX] Stopped indexing at height %d: %v\n", next, err)
+			idx.mu.Unlock()
+			return
+		}
+		idx.height = next
+		idx.mu.Unlock()
+	}
+}
+
+// indexBlock stores a block's filter and filter header. The previous
+// block's header must already be indexed, except for genesis which chains
+// onto the zero hash.
+func (idx *filterIndex) indexBlock(block *wire.MsgBlock, height int32) error {
+	var prevHeader wire.Hash
+	if height > 0 {
+		data, err := idx.get(cfheaderBucket, block.Header.PrevBlock)
+		if err != nil {
+			return fmt.Errorf("previous filter header: %v", err)
+		}
+		copy(prevHeader[:], data)
+	}
+
+	filter := wire.BuildBasicFilter(block)
+	header := wire.FilterHeader(filter.Hash(), prevHeader)
+	hash := block.BlockHash()
+
+	return idx.chain.db.DB().Update(func(tx *bolt.Tx) error {
+		filters, err := tx.CreateBucketIfNotExists(cfilterBucket)
+		if err != nil {
+			return err
+		}
+		headers, err := tx.CreateBucketIfNotExists(cfheaderBucket)
+		if err != nil {
+			return err
+		}
+		if err := filters.Put(hash[:], filter.Bytes()); err != nil {
+			return err
+		}
+		return headers.Put(hash[:], header[:])
+	})
+}
+
+// get returns a copy of the entry for hash in bucket
+func (idx *filterIndex) get(bucket []byte, hash wire.Hash) ([]byte, error) {
+	var data []byte
+	err := idx.chain.db.DB().View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return fmt.Errorf("no filter for block %s", hash)
+		}
+		v := b.Get(hash[:])
+		if v == nil {
+			return fmt.Errorf("no filter for block %s", hash)
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+// drop deletes the stored filters and headers
+func (idx *filterIndex) drop() error {
+	return idx.chain.db.DB().Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{cfilterBucket, cfheaderBucket} {
+			if err := tx.DeleteBucket(bucket); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
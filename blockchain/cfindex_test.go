@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"obsidian-core/chaincfg"
+	"obsidian-core/wire"
+	"testing"
+	"time"
+)
+
+// waitFilterIndex waits for the filter index to reach height
+func waitFilterIndex(t *testing.T, chain *BlockChain, height int32) {
+	deadline := time.Now().Add(10 * time.Second)
+	for chain.FilterIndexHeight() < height {
+		if time.Now().After(deadline) {
+			t.Fatalf("Filter index stuck at height %d, expected %d", chain.FilterIndexHeight(), height)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+	blocks := mineTestBlocks(t, params, params.GenesisBlock, 1, 6, "obs1miner")
+	for _, block := range blocks[:4] {
+		if err := chain.ProcessBlock(block, nil); err != nil {
+			t.Fatalf("ProcessBlock failed: %v", err)
+		}
+	}
+	if _, err := chain.BlockFilter(blocks[0].BlockHash()); err == nil {
+		t.Error("Served a filter with the index disabled")
+	}
+
+	// Existing blocks are indexed in the background, new ones on connect
+	if err := chain.EnableFilterIndex(false); err != nil {
+		t.Fatalf("EnableFilterIndex failed: %v", err)
+	}
+	waitFilterIndex(t, chain, 4)
+	for _, block := range blocks[4:] {
+		if err := chain.ProcessBlock(block, nil); err != nil {
+			t.Fatalf("ProcessBlock failed: %v", err)
+		}
+	}
+	if height := chain.FilterIndexHeight(); height != 6 {
+		t.Fatalf("Filter index at height %d, expected 6", height)
+	}
+
+	// Each header chains the block's filter hash onto its parent's header
+	var prev wire.Hash
+	headers := make([]wire.Hash, 0, 7)
+	for _, block := range append([]*wire.MsgBlock{params.GenesisBlock}, blocks...) {
+		hash := block.BlockHash()
+		filter, err := chain.BlockFilter(hash)
+		if err != nil {
+			t.Fatalf("BlockFilter failed: %v", err)
+		}
+		header, err := chain.FilterHeader(hash)
+		if err != nil {
+			t.Fatalf("FilterHeader failed: %v", err)
+		}
+		if header != wire.FilterHeader(wire.DoubleHashH(filter), prev) {
+			t.Fatalf("Filter header of %s does not chain onto its parent", hash)
+		}
+		parsed, err := wire.ParseGCSFilter(filter)
+		script := block.Transactions[0].TxOut[0].PkScript
+		if err != nil || (len(script) > 0 && !parsed.Match(wire.BlockFilterKey(hash), script)) {
+			t.Fatalf("Filter of %s does not match the coinbase output", hash)
+		}
+		headers = append(headers, header)
+		prev = header
+	}
+
+	// A rebuild reproduces the same headers
+	if err := chain.RebuildFilterIndex(); err != nil {
+		t.Fatalf("RebuildFilterIndex failed: %v", err)
+	}
+	waitFilterIndex(t, chain, 6)
+	for i, header := range headers {
+		hash, _ := chain.BlockHashByHeight(int32(i))
+		if rebuilt, err := chain.FilterHeader(hash); err != nil || rebuilt != header {
+			t.Errorf("Rebuilt header %d differs: %v", i, err)
+		}
+	}
+}
+
+func TestFilterIndexReorg(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+	if err := chain.EnableFilterIndex(false); err != nil {
+		t.Fatalf("EnableFilterIndex failed: %v", err)
+	}
+	waitFilterIndex(t, chain, 0)
+	main := mineTestBlocks(t, params, params.GenesisBlock, 1, 3, "obs1miner")
+	for _, block := range main {
+		if err := chain.ProcessBlock(block, nil); err != nil {
+			t.Fatalf("ProcessBlock failed: %v", err)
+		}
+	}
+	waitFilterIndex(t, chain, 3)
+
+	// The index follows the reorganization onto the fork
+	fork := mineTestBlocks(t, params, main[0], 2, 3, "obs1fork")
+	for _, block := range fork {
+		if err := chain.db.SaveBlock(block); err != nil {
+			t.Fatalf("Failed to save fork block: %v", err)
+		}
+	}
+	if result, err := chain.MaybeReorg(fork[2], chain.pow); err != nil || result == nil {
+		t.Fatalf("MaybeReorg = %v, %v; expected a reorganization", result, err)
+	}
+	waitFilterIndex(t, chain, 4)
+	if height := chain.FilterIndexHeight(); height != 4 {
+		t.Fatalf("Filter index at height %d, expected 4", height)
+	}
+	prev, err := chain.FilterHeader(main[0].BlockHash())
+	if err != nil {
+		t.Fatalf("FilterHeader failed: %v", err)
+	}
+	for _, block := range fork {
+		filter, err := chain.BlockFilter(block.BlockHash())
+		if err != nil {
+			t.Fatalf("Fork block %s not indexed: %v", block.BlockHash(), err)
+		}
+		header, _ := chain.FilterHeader(block.BlockHash())
+		if header != wire.FilterHeader(wire.DoubleHashH(filter), prev) {
+			t.Fatalf("Filter header of %s does not chain onto its parent", block.BlockHash())
+		}
+		prev = header
+	}
+
+	// Blocks connected after the reorganization are indexed on connect
+	next := mineTestBlocks(t, params, fork[2], 5, 1, "obs1miner")[0]
+	if err := chain.ProcessBlock(next, nil); err != nil {
+		t.Fatalf("ProcessBlock failed: %v", err)
+	}
+	if height := chain.FilterIndexHeight(); height != 5 {
+		t.Errorf("Filter index at height %d, expected 5", height)
+	}
+}
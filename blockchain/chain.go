@@ -3,13 +3,16 @@ package blockchain
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/big"
 	"obsidian-core/chaincfg"
 	"obsidian-core/consensus"
 	"obsidian-core/database"
+	"obsidian-core/smartcontract"
 	"obsidian-core/wire"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // BlockChain provides functions for working with the bitcoin block chain.
@@ -20,13 +23,20 @@ type BlockChain struct {
 	params       *chaincfg.Params
 	db           *database.Storage
 	pow          consensus.PowEngine
+	connectMu    sync.Mutex   // Serializes block connection and reorganizations
+	chainMu      sync.RWMutex // Guards bestHash, height, mainChain and mainIndex
 	bestHash     wire.Hash
 	height       int32
+	mainChain    []wire.Hash         // Main chain block hashes by height
+	mainIndex    map[wire.Hash]int32 // Main chain block heights by hash
 	shieldedPool *ShieldedPool
 	utxoSet      *UTXOSet
 	mempool      *Mempool
 	feeEstimator *FeeEstimator
 	tokenStore   *TokenStore
+	cfIndex      *filterIndex // nil unless compact filters are indexed
+
+	contractStorage *smartcontract.ContractStorage
 }
 
 // TokenStore manages token operations
@@ -82,13 +92,23 @@ func (ts *TokenStore) GetTokenBySymbol(symbol string) (*Token, error) {
 
 // GetBalance gets the balance for an address and token
 func (ts *TokenStore) GetBalance(address string, tokenID wire.Hash) int64 {
-	// Simplified: return 0 for now
-	return 0
+	return ts.balances[address][tokenID]
 }
 
 // TransferToken transfers tokens between addresses
 func (ts *TokenStore) TransferToken(tokenID wire.Hash, from, to string, amount int64) error {
-	// Simplified: no-op
+	if amount <= 0 {
+		return fmt.Errorf("transfer amount must be positive")
+	}
+	if balance := ts.GetBalance(from, tokenID); balance < amount {
+		return fmt.Errorf("insufficient token balance: has %d, need %d", balance, amount)
+	}
+
+	ts.balances[from][tokenID] -= amount
+	if ts.balances[to] == nil {
+		ts.balances[to] = make(map[wire.Hash]int64)
+	}
+	ts.balances[to][tokenID] += amount
 	return nil
 }
 
@@ -130,6 +150,12 @@ func NewBlockchain(params *chaincfg.Params, pow consensus.PowEngine) (*BlockChai
 		mempool:      NewMempool(),
 		feeEstimator: NewFeeEstimator(),
 		tokenStore:   NewTokenStore(),
+
+		contractStorage: smartcontract.NewContractStorage(db),
+	}
+	bc.shieldedPool.SetNullifierSet(NewNullifierSet(boltDB))
+	if err := bc.shieldedPool.LoadSupplyHistory(); err != nil {
+		return nil, fmt.Errorf("failed to load shielded supply: %v", err)
 	}
 
 	// Save genesis block if it doesn't exist
@@ -142,22 +168,33 @@ func NewBlockchain(params *chaincfg.Params, pow consensus.PowEngine) (*BlockChai
 		}
 	}
 	bc.bestHash = genesisHash
+	bc.extendMainChain(genesisHash)
 
 	return bc, nil
 }
 
 // BestBlock returns the block at the tip of the chain.
 func (b *BlockChain) BestBlock() (*wire.MsgBlock, error) {
-	return b.db.GetBlock(b.bestHash[:])
+	bestHash, _ := b.tip()
+	return b.db.GetBlock(bestHash[:])
 }
 
 // Height returns the height of the best block.
 func (b *BlockChain) Height() int32 {
-	return b.height
+	_, height := b.tip()
+	return height
+}
+
+// tip returns the hash and height of the best block.
+func (b *BlockChain) tip() (wire.Hash, int32) {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+	return b.bestHash, b.height
 }
 
 // Close closes the database.
 func (b *BlockChain) Close() {
+	b.stopFilterIndex()
 	b.db.Close()
 }
 
@@ -166,6 +203,38 @@ func (b *BlockChain) GetBlock(hash []byte) (*wire.MsgBlock, error) {
 	return b.db.GetBlock(hash)
 }
 
+// FindTransaction looks up a transaction in the mempool and then in the main
+// chain, walking back from the tip. It returns the height of the block
+// containing it, or -1 for a mempool transaction.
+func (b *BlockChain) FindTransaction(txHash wire.Hash) (*wire.MsgTx, int32, error) {
+	if tx, err := b.mempool.GetTransaction(txHash); err == nil {
+		return tx, -1, nil
+	}
+
+	bestHash, tipHeight := b.tip()
+	block, err := b.db.GetBlock(bestHash[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	for height := tipHeight; ; height-- {
+		for _, tx := range block.Transactions {
+			if tx.TxHash() == txHash {
+				return tx, height, nil
+			}
+		}
+		if height == 0 {
+			break
+		}
+		prevHash := block.Header.PrevBlock
+		block, err = b.db.GetBlock(prevHash[:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("block at height %d not found: %v", height-1, err)
+		}
+	}
+
+	return nil, 0, fmt.Errorf("transaction %s not found", txHash)
+}
+
 // Params returns the chain parameters.
 func (b *BlockChain) Params() *chaincfg.Params {
 	return b.params
@@ -196,6 +265,9 @@ func (b *BlockChain) GetTokenStore() *TokenStore {
 // blocks, ensuring blocks follow all rules, orphan handling, and best chain
 // selection.
 func (b *BlockChain) ProcessBlock(block *wire.MsgBlock, pow consensus.PowEngine) error {
+	b.connectMu.Lock()
+	defer b.connectMu.Unlock()
+
 	// Use provided PoW engine if given, otherwise use chain's default
 	if pow == nil {
 		pow = b.pow
@@ -248,36 +320,123 @@ func (b *BlockChain) ProcessBlock(block *wire.MsgBlock, pow consensus.PowEngine)
 		}
 	}
 
-	// 5. Validate block reward
-	if err := b.validateBlockReward(block); err != nil {
-		return fmt.Errorf("invalid block reward: %v", err)
+	// 4b. Shielded pool turnstile: value can't leave the pool unless it entered
+	if err := b.shieldedPool.CheckTurnstile(block.Transactions); err != nil {
+		return fmt.Errorf("invalid shielded value flow: %v", err)
+	}
+
+	// 4c. Contract gas must fit within the block gas limit
+	if err := b.validateBlockGas(block); err != nil {
+		return fmt.Errorf("invalid contract gas: %v", err)
 	}
 
-	// 5a. Process shielded transactions
+	// 4d. Contract transactions run with their sender's authority, so they
+	// are fully validated, signatures included, before they execute
 	for _, tx := range block.Transactions {
-		if tx.IsShielded() {
-			if err := b.shieldedPool.ProcessShieldedTransaction(tx); err != nil {
-				return fmt.Errorf("failed to process shielded transaction: %v", err)
-			}
+		if tx.TxType != wire.TxTypeSmartContractDeploy && tx.TxType != wire.TxTypeSmartContractCall {
+			continue
+		}
+		if err := b.ValidateTransaction(tx, b.utxoSet); err != nil {
+			return fmt.Errorf("invalid contract transaction %s: %v", tx.TxHash(), err)
 		}
 	}
 
-	// 6. Save block
-	if err := b.db.SaveBlock(block); err != nil {
-		return fmt.Errorf("failed to save block: %v", err)
+	// 5. Validate block reward
+	if err := b.validateBlockReward(block); err != nil {
+		return fmt.Errorf("invalid block reward: %v", err)
+	}
+
+	// 6. Apply the block's state changes and save it
+	if err := b.applyBlockState(block, currentHeight); err != nil {
+		return err
 	}
 
 	// 7. Update chain state
+	b.chainMu.Lock()
 	b.bestHash = blockHash
 	b.height++
+	b.extendMainChain(blockHash)
+	b.chainMu.Unlock()
+
+	// 7b. Index the block's compact filter
+	if b.cfIndex != nil {
+		b.cfIndex.blockConnected(block, b.height)
+	}
 
 	// 8. Update fee estimator
 	b.feeEstimator.AddBlock(block, b.height)
 
+	// 9. Remove mined and conflicting transactions from mempool
+	for _, tx := range block.Transactions {
+		b.mempool.RemoveTransaction(tx.TxHash())
+		b.mempool.RemoveDoubleSpends(tx)
+	}
+
 	fmt.Printf("Block accepted! Height: %d, Hash: %s\n", b.height, blockHash.String())
 	return nil
 }
 
+// applyBlockState applies the UTXO, contract and shielded changes of a
+// validated block connected at height and saves the block. If a step fails,
+// the steps before it are undone so a rejected block leaves no state behind.
+func (b *BlockChain) applyBlockState(block *wire.MsgBlock, height int32) error {
+	blockHash := block.BlockHash()
+	var undo []func() error
+	fail := func(err error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				return fmt.Errorf("%v (undo failed: %v)", err, undoErr)
+			}
+		}
+		return err
+	}
+
+	// Contract senders are verified against the outputs they spend, so
+	// they are read before the UTXO changes remove them
+	senders := b.contractSenders(block)
+
+	// Apply UTXO changes, remembering the spent outputs to restore them
+	spent, err := b.utxoSet.SpentOutputs(block)
+	if err != nil {
+		return fmt.Errorf("failed to load spent outputs: %v", err)
+	}
+	if err := b.utxoSet.ApplyBlock(block, height); err != nil {
+		return fmt.Errorf("failed to apply UTXO changes: %v", err)
+	}
+	undo = append(undo, func() error { return b.utxoSet.UndoBlock(block, spent) })
+
+	// Execute contracts within their gas limits
+	if err := b.executeBlockContracts(block, height, senders); err != nil {
+		return fail(fmt.Errorf("failed to execute contracts: %v", err))
+	}
+	undo = append(undo, func() error { return b.disconnectBlockContracts(block) })
+
+	// Process shielded transactions
+	if err := b.shieldedPool.ProcessBlockTransactions(block.Transactions); err != nil {
+		return fail(fmt.Errorf("failed to process shielded transaction: %v", err))
+	}
+	undo = append(undo, func() error {
+		b.shieldedPool.RollbackBlockTransactions(block.Transactions)
+		return nil
+	})
+
+	// Persist nullifiers and the shielded supply
+	if err := b.shieldedPool.ConnectBlockNullifiers(blockHash, height, block.Transactions); err != nil {
+		return fail(fmt.Errorf("failed to store nullifiers: %v", err))
+	}
+	undo = append(undo, func() error { return b.shieldedPool.DisconnectBlockNullifiers(blockHash) })
+	if _, err := b.shieldedPool.RecordBlockSupply(height, blockHash, block.Transactions); err != nil {
+		return fail(fmt.Errorf("failed to record shielded supply: %v", err))
+	}
+	undo = append(undo, func() error { return b.shieldedPool.RemoveBlockSupply(blockHash) })
+
+	// Save block
+	if err := b.db.SaveBlock(block); err != nil {
+		return fail(fmt.Errorf("failed to save block: %v", err))
+	}
+	return nil
+}
+
 // validateBlockHeader performs header validation
 func (b *BlockChain) validateBlockHeader(header *wire.BlockHeader) error {
 	// Check block size limit via DarkMatterSolution size
@@ -432,32 +591,8 @@ func (b *BlockChain) CalcNextRequiredDifficulty(lastBlock *wire.MsgBlock, newBlo
 
 	// Calculate actual timespan between first and last block of this period
 	actualTimespan := lastBlock.Header.Timestamp.Unix() - firstBlock.Header.Timestamp.Unix()
-
-	// Bitcoin limits adjustment to prevent extreme changes
-	// Min: 1/4 of target (if blocks found 4x faster)
-	// Max: 4x of target (if blocks found 4x slower)
 	targetTimespan := int64(b.params.TargetTimespan.Seconds())
-	minTimespan := targetTimespan / b.params.RetargetAdjustmentFactor
-	maxTimespan := targetTimespan * b.params.RetargetAdjustmentFactor
-
-	adjustedTimespan := actualTimespan
-	if adjustedTimespan < minTimespan {
-		adjustedTimespan = minTimespan
-	} else if adjustedTimespan > maxTimespan {
-		adjustedTimespan = maxTimespan
-	}
-
-	// Bitcoin formula: new_target = old_target * (actual_time / target_time)
-	lastTarget := CompactToBig(lastBlock.Header.Bits)
-	newTarget := new(big.Int).Mul(lastTarget, big.NewInt(adjustedTimespan))
-	newTarget.Div(newTarget, big.NewInt(targetTimespan))
-
-	// Never allow difficulty to go below the minimum (PowLimit)
-	if newTarget.Cmp(b.params.PowLimit) > 0 {
-		newTarget.Set(b.params.PowLimit)
-	}
-
-	newDifficulty := BigToCompact(newTarget)
+	newDifficulty, adjustedTimespan := calcRetargetBits(b.params, lastBlock.Header.Bits, actualTimespan)
 
 	fmt.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
 	fmt.Printf("Difficulty Retarget at Height %d\n", b.height+1)
@@ -482,6 +617,37 @@ func (b *BlockChain) CalcNextRequiredDifficulty(lastBlock *wire.MsgBlock, newBlo
 	return newDifficulty, nil
 }
 
+// calcRetargetBits returns the difficulty for the first block of a new period
+// given the previous period's bits and how long it took, along with the
+// timespan after clamping it to the allowed adjustment.
+func calcRetargetBits(params *chaincfg.Params, lastBits uint32, actualTimespan int64) (uint32, int64) {
+	// Bitcoin limits adjustment to prevent extreme changes
+	// Min: 1/4 of target (if blocks found 4x faster)
+	// Max: 4x of target (if blocks found 4x slower)
+	targetTimespan := int64(params.TargetTimespan.Seconds())
+	minTimespan := targetTimespan / params.RetargetAdjustmentFactor
+	maxTimespan := targetTimespan * params.RetargetAdjustmentFactor
+
+	adjustedTimespan := actualTimespan
+	if adjustedTimespan < minTimespan {
+		adjustedTimespan = minTimespan
+	} else if adjustedTimespan > maxTimespan {
+		adjustedTimespan = maxTimespan
+	}
+
+	// Bitcoin formula: new_target = old_target * (actual_time / target_time)
+	lastTarget := CompactToBig(lastBits)
+	newTarget := new(big.Int).Mul(lastTarget, big.NewInt(adjustedTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+
+	// Never allow difficulty to go below the minimum (PowLimit)
+	if newTarget.Cmp(params.PowLimit) > 0 {
+		newTarget.Set(params.PowLimit)
+	}
+
+	return BigToCompact(newTarget), adjustedTimespan
+}
+
 // calcEasierDifficulty calculates an easier difficulty if too much time has passed
 func (b *BlockChain) calcEasierDifficulty(lastBlock *wire.MsgBlock) (uint32, error) {
 	// Get the minimum difficulty
@@ -580,21 +746,89 @@ func (b *BlockChain) processTokenTransferOwnership(tx *wire.MsgTx) error {
 	return nil
 }
 
-// validateSmartContractDeploy validates a smart contract deployment
-func (b *BlockChain) validateSmartContractDeploy(tx *wire.MsgTx) error {
-	// Basic validation: check memo contains contract code
+// validateSmartContractDeploy validates a smart contract deployment. The
+// deployer signs the first input; inputs and fee are checked like any
+// transparent transaction.
+func (b *BlockChain) validateSmartContractDeploy(tx *wire.MsgTx, utxoSet *UTXOSet) error {
+	// Basic validation: check memo contains verifiable bytecode
 	if len(tx.Memo) == 0 {
-		return fmt.Errorf("smart contract deployment requires code in memo")
+		return fmt.Errorf("smart contract deployment requires bytecode in memo")
 	}
-	return nil
+	if _, err := b.contractSender(tx, utxoSet); err != nil {
+		return err
+	}
+	if _, err := decodeDeployCode(tx.Memo); err != nil {
+		return err
+	}
+	return b.validateContractGas(tx)
 }
 
 // validateSmartContractCall validates a smart contract call
-func (b *BlockChain) validateSmartContractCall(tx *wire.MsgTx) error {
+func (b *BlockChain) validateSmartContractCall(tx *wire.MsgTx, utxoSet *UTXOSet) error {
 	// Basic validation: check memo contains call data
 	if len(tx.Memo) == 0 {
 		return fmt.Errorf("smart contract call requires data in memo")
 	}
+	if _, err := b.contractSender(tx, utxoSet); err != nil {
+		return err
+	}
+	call, err := smartcontract.DecodeCallData(tx.Memo)
+	if err != nil {
+		return err
+	}
+
+	// The function must exist with the right arity
+	record, err := b.GetContract(call.Contract)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, fn := range record.ABI {
+		if fn.Name == call.Function {
+			if len(fn.Params) != len(call.Args) {
+				return fmt.Errorf("%s() takes %d arguments, got %d", fn.Name, len(fn.Params), len(call.Args))
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("contract %s has no function %s", call.Contract, call.Function)
+	}
+	return b.validateContractGas(tx)
+}
+
+// validateContractGas checks the gas limit and price of a contract
+// transaction
+func (b *BlockChain) validateContractGas(tx *wire.MsgTx) error {
+	if err := tx.ValidateGas(); err != nil {
+		return err
+	}
+	if tx.GasLimit > b.params.BlockGasLimit {
+		return fmt.Errorf("gas limit %d exceeds block gas limit %d", tx.GasLimit, b.params.BlockGasLimit)
+	}
+	if tx.GasPrice > math.MaxInt64/int64(tx.GasLimit) {
+		return fmt.Errorf("gas price %d too high", tx.GasPrice)
+	}
+	return nil
+}
+
+// validateBlockGas checks the gas of every contract transaction in a block.
+// Together their gas limits must fit within the block gas limit.
+func (b *BlockChain) validateBlockGas(block *wire.MsgBlock) error {
+	total := uint64(0)
+	for _, tx := range block.Transactions {
+		if tx.TxType != wire.TxTypeSmartContractDeploy && tx.TxType != wire.TxTypeSmartContractCall {
+			continue
+		}
+		if err := b.validateContractGas(tx); err != nil {
+			return fmt.Errorf("transaction %s: %v", tx.TxHash(), err)
+		}
+		total += tx.GasLimit
+		if total > b.params.BlockGasLimit {
+			return fmt.Errorf("contract gas limits exceed block gas limit %d", b.params.BlockGasLimit)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,576 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"obsidian-core/crypto"
+	"obsidian-core/smartcontract"
+	"obsidian-core/wire"
+)
+
+// ContractStatus is the outcome of a contract execution
+type ContractStatus int
+
+const (
+	ContractStatusSuccess  ContractStatus = iota // Execution completed
+	ContractStatusReverted                       // Execution failed; state reverted
+	ContractStatusOutOfGas                       // Gas limit exceeded; state reverted
+)
+
+// String returns the status name
+func (s ContractStatus) String() string {
+	switch s {
+	case ContractStatusSuccess:
+		return "success"
+	case ContractStatusReverted:
+		return "reverted"
+	case ContractStatusOutOfGas:
+		return "out of gas"
+	default:
+		return "unknown"
+	}
+}
+
+// ContractExecution records the result of running a contract transaction.
+// Confirmed executions are stored as the transaction's receipt.
+type ContractExecution struct {
+	TxHash    wire.Hash
+	Height    int32
+	Contract  string // Address of the contract deployed or called
+	Sender    string // Deployer or caller
+	Function  string // Function called; empty for deployments
+	Value     int64  // OBS attached to a call
+	Status    ContractStatus
+	GasLimit  uint64
+	GasUsed   uint64 // Including intrinsic gas
+	Result    smartcontract.Value
+	Error     string
+	Logs      []ContractLog                 // Events emitted, if successful
+	Transfers []smartcontract.Transfer      // OBS and tokens sent, if successful
+	Payouts   []UTXO                        // Outputs created by OBS transfers
+	Spent     []UTXO                        // Contract outputs spent by OBS transfers
+	Changes   []smartcontract.StorageChange // Committed storage writes, for undo
+}
+
+// parseContractSource lexes and parses OCL source
+func parseContractSource(source string) (*smartcontract.Program, error) {
+	tokens, err := smartcontract.NewLexer(source).Tokenize()
+	if err != nil {
+		return nil, fmt.Errorf("lexer error: %v", err)
+	}
+	ast, err := smartcontract.NewParser(tokens).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("parser error: %v", err)
+	}
+	return ast, nil
+}
+
+// CheckContractSource parses and statically analyzes OCL source. The
+// diagnostics are returned with an error if any of them are errors.
+func CheckContractSource(source string) ([]smartcontract.Diagnostic, error) {
+	ast, err := parseContractSource(source)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics, err := smartcontract.Check(ast)
+	if err != nil {
+		return diagnostics, fmt.Errorf("analysis error: %v", err)
+	}
+	return diagnostics, nil
+}
+
+// CompileContractSource lexes, parses, analyzes and compiles OCL source.
+// Sources with analysis errors are rejected; warnings are not reported.
+func CompileContractSource(source string) (*smartcontract.CompiledContract, error) {
+	ast, err := parseContractSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := smartcontract.Check(ast); err != nil {
+		return nil, fmt.Errorf("analysis error: %v", err)
+	}
+	contract, err := smartcontract.NewCompiler().CompileContract(ast)
+	if err != nil {
+		return nil, fmt.Errorf("compile error: %v", err)
+	}
+	return contract, nil
+}
+
+// CompileContractBytecode compiles OCL source to the bytecode carried by
+// deployment transactions
+func CompileContractBytecode(source string) ([]byte, error) {
+	contract, err := CompileContractSource(source)
+	if err != nil {
+		return nil, err
+	}
+	return smartcontract.EncodeBytecode(contract)
+}
+
+// decodeDeployCode decodes and verifies the bytecode of a deployment
+func decodeDeployCode(code []byte) (*smartcontract.CompiledContract, error) {
+	contract, err := smartcontract.DecodeBytecode(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := smartcontract.VerifyBytecode(contract); err != nil {
+		return nil, fmt.Errorf("bytecode verification failed: %v", err)
+	}
+	return contract, nil
+}
+
+// ExecuteContract runs a contract for tx within the transaction's gas limit.
+// Top-level code runs first, then function if one is named. self.<field>
+// accesses the storage of address through a write set that is committed,
+// and transfers are settled, only if execution succeeds. A nil ctx runs at
+// the chain tip with no sender. The gas used, including intrinsic gas, is
+// stored in tx.GasUsed.
+func (b *BlockChain) ExecuteContract(tx *wire.MsgTx, ctx *smartcontract.Context, address string,
+	contract *smartcontract.CompiledContract, function string, args []smartcontract.Value) (*ContractExecution, error) {
+
+	if ctx == nil {
+		ctx = &smartcontract.Context{Height: b.Height(), Ledger: &contractLedger{b: b}}
+	}
+	ledger, ok := ctx.Ledger.(*contractLedger)
+	if !ok {
+		return nil, fmt.Errorf("contract ledger is not backed by the chain")
+	}
+	exec := &ContractExecution{
+		TxHash:   tx.TxHash(),
+		Height:   ctx.Height,
+		Sender:   ctx.Sender,
+		Value:    ctx.Value,
+		GasLimit: tx.GasLimit,
+	}
+
+	intrinsic := tx.CalculateIntrinsicGas()
+	if tx.GasLimit < intrinsic {
+		exec.Status = ContractStatusOutOfGas
+		exec.GasUsed = tx.GasLimit
+		exec.Error = fmt.Sprintf("gas limit %d is less than intrinsic gas %d", tx.GasLimit, intrinsic)
+		tx.GasUsed = exec.GasUsed
+		return exec, nil
+	}
+
+	writes := smartcontract.NewWriteSet(b.contractStorage)
+	vm, result, err := runContract(writes, ctx, address, contract, function, args, tx.GasLimit-intrinsic)
+	exec.GasUsed = intrinsic + vm.GasUsed()
+	tx.GasUsed = exec.GasUsed
+	if !exec.setOutcome(vm, result, err) {
+		return exec, nil
+	}
+
+	if b.contractStorage != nil && writes.Len() > 0 {
+		changes, err := b.contractStorage.Commit(writes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to commit contract storage: %v", err)
+		}
+		exec.Changes = changes
+	}
+	if err := b.settleTransfers(tx, ledger, address, ctx.Height, exec); err != nil {
+		return nil, fmt.Errorf("failed to settle contract transfers: %v", err)
+	}
+	return exec, nil
+}
+
+// runContract runs top-level code and then function, if one is named, with
+// self bound to address in state. Top-level code is the constructor: calls
+// rerun it to set up globals, but only a deployment keeps its storage
+// writes, events and transfers.
+func runContract(state *smartcontract.WriteSet, ctx *smartcontract.Context, address string,
+	contract *smartcontract.CompiledContract, function string, args []smartcontract.Value,
+	gasLimit uint64) (*smartcontract.VM, smartcontract.Value, error) {
+
+	vm := smartcontract.NewContractVM(contract)
+	vm.SetGasLimit(gasLimit)
+	vm.SetContext(ctx)
+	if function == "" {
+		vm.SetStorage(state, address)
+		result, err := vm.Execute()
+		return vm, result, err
+	}
+
+	vm.SetStorage(state.Child(), address)
+	if _, err := vm.Execute(); err != nil {
+		return vm, smartcontract.Value{}, err
+	}
+	vm.DiscardEffects()
+	vm.SetStorage(state, address)
+	result, err := vm.Call(function, args)
+	return vm, result, err
+}
+
+// setOutcome records how an execution on vm ended and reports whether it
+// succeeded
+func (exec *ContractExecution) setOutcome(vm *smartcontract.VM, result smartcontract.Value, err error) bool {
+	switch {
+	case errors.Is(err, smartcontract.ErrOutOfGas):
+		exec.Status = ContractStatusOutOfGas
+		exec.Error = err.Error()
+		return false
+	case err != nil:
+		exec.Status = ContractStatusReverted
+		exec.Error = err.Error()
+		return false
+	}
+
+	exec.Status = ContractStatusSuccess
+	exec.Result = result
+	for _, log := range vm.Logs() {
+		exec.Logs = append(exec.Logs, ContractLog{Contract: log.Contract, Topic: log.Topic, Data: log.Data})
+	}
+	exec.Transfers = append(exec.Transfers, vm.Transfers()...)
+	return true
+}
+
+// ContractStorage returns the committed contract state
+func (b *BlockChain) ContractStorage() *smartcontract.ContractStorage {
+	return b.contractStorage
+}
+
+// contractSender returns the address that signed the first input of a
+// contract transaction: the deployer of a deployment, the caller of a call.
+// The input's signature is checked against the output it spends in utxoSet,
+// so the sender can't be claimed by just naming someone else's public key.
+func (b *BlockChain) contractSender(tx *wire.MsgTx, utxoSet *UTXOSet) (string, error) {
+	if len(tx.TxIn) == 0 {
+		return "", fmt.Errorf("smart contract transaction requires a transparent input")
+	}
+	txIn := tx.TxIn[0]
+	utxo, err := utxoSet.GetUTXO(txIn.PreviousOutPoint.Hash, txIn.PreviousOutPoint.Index)
+	if err != nil {
+		return "", fmt.Errorf("sender input not found: %v", err)
+	}
+	sigHash := b.calculateSignatureHash(tx, 0, utxo.PkScript)
+	if err := b.verifyInputSignature(txIn, utxo.PkScript, sigHash); err != nil {
+		return "", fmt.Errorf("invalid sender signature: %v", err)
+	}
+	_, pubKey, err := parseSignatureScript(txIn.SignatureScript)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender signature: %v", err)
+	}
+	return crypto.KeyToAddress(pubKey), nil
+}
+
+// contractSenders returns the verified senders of the contract transactions
+// of block. It must run before the block's UTXO changes are applied, while
+// the outputs the senders spend still exist. Transactions without a valid
+// sender are left out and revert when executed.
+func (b *BlockChain) contractSenders(block *wire.MsgBlock) map[wire.Hash]string {
+	senders := make(map[wire.Hash]string)
+	for _, tx := range block.Transactions {
+		if tx.TxType != wire.TxTypeSmartContractDeploy && tx.TxType != wire.TxTypeSmartContractCall {
+			continue
+		}
+		if sender, err := b.contractSender(tx, b.utxoSet); err == nil {
+			senders[tx.TxHash()] = sender
+		}
+	}
+	return senders
+}
+
+// GetContract returns the contract deployed at address
+func (b *BlockChain) GetContract(address string) (*smartcontract.ContractRecord, error) {
+	if b.contractStorage == nil {
+		return nil, fmt.Errorf("contract %s not found", address)
+	}
+	return b.contractStorage.LoadContract(address)
+}
+
+// NextContractAddress returns the address deployer's next deployment will
+// get, counting deployments waiting in the mempool
+func (b *BlockChain) NextContractAddress(deployer string) (string, error) {
+	nonce, err := b.contractStorage.DeployNonce(deployer)
+	if err != nil {
+		return "", err
+	}
+	for _, tx := range b.mempool.GetTransactions() {
+		if tx.TxType != wire.TxTypeSmartContractDeploy {
+			continue
+		}
+		if from, err := b.contractSender(tx, b.utxoSet); err == nil && from == deployer {
+			nonce++
+		}
+	}
+	return crypto.ContractAddress(deployer, nonce), nil
+}
+
+// deployContract creates the contract of a deployment transaction: it
+// assigns the address, runs the top-level code and stores the bytecode. A
+// failed deployment still uses up the deployer's nonce; one without a valid
+// deployer reverts without using any.
+func (b *BlockChain) deployContract(tx *wire.MsgTx, ctx *smartcontract.Context, deployer string) (*ContractExecution, error) {
+	height := ctx.Height
+	if deployer == "" {
+		return revertedExecution(tx, height, "", fmt.Errorf("smart contract transaction has no verified sender")), nil
+	}
+	nonce, err := b.contractStorage.DeployNonce(deployer)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.contractStorage.SetDeployNonce(deployer, nonce+1); err != nil {
+		return nil, err
+	}
+	address := crypto.ContractAddress(deployer, nonce)
+
+	contract, err := decodeDeployCode(tx.Memo)
+	if err != nil {
+		return revertedExecution(tx, height, deployer, err), nil
+	}
+
+	ctx.Sender = deployer
+	exec, err := b.ExecuteContract(tx, ctx, address, contract, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if exec.Status != ContractStatusSuccess {
+		return exec, nil
+	}
+
+	record := &smartcontract.ContractRecord{
+		Address:  address,
+		Deployer: deployer,
+		Nonce:    nonce,
+		TxHash:   tx.TxHash(),
+		Height:   height,
+		Code:     tx.Memo,
+		ABI:      contract.ABI(),
+	}
+	if err := b.contractStorage.SaveContract(record); err != nil {
+		return nil, err
+	}
+	exec.Contract = address
+	return exec, nil
+}
+
+// callContract executes a call transaction. OBS attached to the call, the
+// outputs paying the contract, is returned to the caller if the call fails.
+// A call without a valid caller reverts with nobody to refund.
+func (b *BlockChain) callContract(tx *wire.MsgTx, ctx *smartcontract.Context, caller string) (*ContractExecution, error) {
+	height := ctx.Height
+	if caller == "" {
+		return revertedExecution(tx, height, "", fmt.Errorf("smart contract transaction has no verified sender")), nil
+	}
+
+	// Validation rejects malformed calls, so these only fail for calls to a
+	// contract whose deployment was disconnected
+	call, err := smartcontract.DecodeCallData(tx.Memo)
+	if err != nil {
+		return revertedExecution(tx, height, caller, err), nil
+	}
+	record, err := b.contractStorage.LoadContract(call.Contract)
+	if err != nil {
+		exec := revertedExecution(tx, height, caller, err)
+		exec.Contract, exec.Function = call.Contract, call.Function
+		return exec, b.refundCallValue(tx, call.Contract, caller, height)
+	}
+	contract, err := record.Contract()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Sender = caller
+	ctx.Value = callValue(tx, call.Contract)
+	exec, err := b.ExecuteContract(tx, ctx, call.Contract, contract, call.Function, call.Args)
+	if err != nil {
+		return nil, err
+	}
+	exec.Contract = call.Contract
+	exec.Function = call.Function
+	if exec.Status != ContractStatusSuccess {
+		return exec, b.refundCallValue(tx, call.Contract, caller, height)
+	}
+	return exec, nil
+}
+
+// callValue returns the OBS a transaction pays to contract
+func callValue(tx *wire.MsgTx, contract string) int64 {
+	value := int64(0)
+	for _, txOut := range tx.TxOut {
+		if string(txOut.PkScript) == contract {
+			value += txOut.Value
+		}
+	}
+	return value
+}
+
+// isCallTo reports whether tx is a call to contract
+func isCallTo(tx *wire.MsgTx, contract string) bool {
+	if tx.TxType != wire.TxTypeSmartContractCall {
+		return false
+	}
+	call, err := smartcontract.DecodeCallData(tx.Memo)
+	return err == nil && call.Contract == contract
+}
+
+// refundCallValue hands the outputs paying contract back to the caller.
+// They keep their outpoints, so disconnecting the block removes them as
+// usual.
+func (b *BlockChain) refundCallValue(tx *wire.MsgTx, contract, caller string, height int32) error {
+	pkScript, err := payToAddressScript(caller)
+	if err != nil {
+		return err
+	}
+	txHash := tx.TxHash()
+	for i, txOut := range tx.TxOut {
+		if string(txOut.PkScript) != contract {
+			continue
+		}
+		if err := b.utxoSet.AddUTXO(txHash, uint32(i), txOut.Value, pkScript, height); err != nil {
+			return fmt.Errorf("failed to refund call value: %v", err)
+		}
+	}
+	return nil
+}
+
+// revertedExecution records a contract transaction that could not run at
+// all. It is charged its whole gas limit.
+func revertedExecution(tx *wire.MsgTx, height int32, sender string, err error) *ContractExecution {
+	tx.GasUsed = tx.GasLimit
+	return &ContractExecution{
+		TxHash:   tx.TxHash(),
+		Height:   height,
+		Sender:   sender,
+		Status:   ContractStatusReverted,
+		GasLimit: tx.GasLimit,
+		GasUsed:  tx.GasLimit,
+		Error:    err.Error(),
+	}
+}
+
+// executeBlockContracts runs the contract transactions of a block being
+// connected at height and records their results. A failed execution does
+// not invalidate the block; its gas is still charged. The storage changes of
+// the block are saved so disconnectBlockContracts can undo them. If the
+// block cannot be executed, the transactions that already ran are undone.
+// senders holds the verified senders from contractSenders.
+func (b *BlockChain) executeBlockContracts(block *wire.MsgBlock, height int32, senders map[wire.Hash]string) error {
+	if b.contractStorage == nil {
+		return nil
+	}
+
+	var changes []smartcontract.StorageChange
+	var executed []*wire.MsgTx
+	ledger := b.newBlockLedger(block)
+	for _, tx := range block.Transactions {
+		ctx := &smartcontract.Context{
+			Height:    height,
+			Timestamp: block.Header.Timestamp.Unix(),
+			Ledger:    ledger,
+		}
+		var exec *ContractExecution
+		var err error
+		switch tx.TxType {
+		case wire.TxTypeSmartContractDeploy:
+			exec, err = b.deployContract(tx, ctx, senders[tx.TxHash()])
+		case wire.TxTypeSmartContractCall:
+			delete(ledger.pending, tx.TxHash())
+			exec, err = b.callContract(tx, ctx, senders[tx.TxHash()])
+		default:
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to execute contract transaction %s: %v", tx.TxHash(), err)
+			return b.abortBlockContracts(block, executed, changes, senders, err)
+		}
+
+		changes = append(changes, exec.Changes...)
+		executed = append(executed, tx)
+		if err := b.saveReceipt(exec); err != nil {
+			return b.abortBlockContracts(block, executed, changes, senders, err)
+		}
+	}
+
+	blockHash := block.BlockHash()
+	if err := b.contractStorage.SaveBlockUndo(blockHash[:], changes); err != nil {
+		return b.abortBlockContracts(block, executed, changes, senders, err)
+	}
+	return nil
+}
+
+// abortBlockContracts undoes the executed transactions of a block whose
+// contracts failed with err, and returns err
+func (b *BlockChain) abortBlockContracts(block *wire.MsgBlock, executed []*wire.MsgTx,
+	changes []smartcontract.StorageChange, senders map[wire.Hash]string, err error) error {
+
+	blockHash := block.BlockHash()
+	partial := &wire.MsgBlock{Header: block.Header, Transactions: executed}
+	undoErr := b.contractStorage.SaveBlockUndo(blockHash[:], changes)
+	if undoErr == nil {
+		undoErr = b.undoBlockContracts(partial, senders)
+	}
+	if undoErr != nil {
+		return fmt.Errorf("%v (undo failed: %v)", err, undoErr)
+	}
+	return err
+}
+
+// disconnectBlockContracts undoes the transfers of a block, deletes its
+// receipts, reverts its storage changes and removes the contracts it
+// deployed. It runs before the block's UTXO changes are rolled back, since
+// transfers may spend outputs the block created.
+func (b *BlockChain) disconnectBlockContracts(block *wire.MsgBlock) error {
+	if b.contractStorage == nil {
+		return nil
+	}
+
+	// The receipts name the senders whose deployments used a nonce
+	senders := make(map[wire.Hash]string)
+	for _, tx := range block.Transactions {
+		if tx.TxType != wire.TxTypeSmartContractDeploy {
+			continue
+		}
+		if exec, err := b.GetContractExecution(tx.TxHash()); err == nil && exec.Sender != "" {
+			senders[tx.TxHash()] = exec.Sender
+		}
+	}
+	return b.undoBlockContracts(block, senders)
+}
+
+// undoBlockContracts undoes the contract changes of block, releasing the
+// deploy nonces of the deployments senders names
+func (b *BlockChain) undoBlockContracts(block *wire.MsgBlock, senders map[wire.Hash]string) error {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		if tx.TxType != wire.TxTypeSmartContractDeploy && tx.TxType != wire.TxTypeSmartContractCall {
+			continue
+		}
+		if exec, err := b.GetContractExecution(tx.TxHash()); err == nil {
+			if err := b.undoTransfers(exec); err != nil {
+				return fmt.Errorf("failed to undo transfers of %s: %v", tx.TxHash(), err)
+			}
+		}
+		if err := b.deleteReceipt(tx.TxHash()); err != nil {
+			return err
+		}
+	}
+	blockHash := block.BlockHash()
+	if err := b.contractStorage.DisconnectBlock(blockHash[:]); err != nil {
+		return err
+	}
+
+	// Deployments are undone newest first, releasing their nonces
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		if tx.TxType != wire.TxTypeSmartContractDeploy {
+			continue
+		}
+		deployer, ok := senders[tx.TxHash()]
+		if !ok {
+			continue // Reverted without using a nonce
+		}
+		nonce, err := b.contractStorage.DeployNonce(deployer)
+		if err != nil {
+			return err
+		}
+		if nonce == 0 {
+			return fmt.Errorf("no deployment by %s to undo", deployer)
+		}
+		if err := b.contractStorage.DeleteContract(crypto.ContractAddress(deployer, nonce-1)); err != nil {
+			return err
+		}
+		if err := b.contractStorage.SetDeployNonce(deployer, nonce-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
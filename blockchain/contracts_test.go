@@ -0,0 +1,682 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"obsidian-core/chaincfg"
+	"obsidian-core/crypto"
+	"obsidian-core/smartcontract"
+	"obsidian-core/wire"
+	"strings"
+	"testing"
+)
+
+func TestExecuteContractGasLimit(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	source := "def loop(n):\n    return loop(n + 1)\n\ndef double(n):\n    return n * 2\n"
+	contract, err := CompileContractSource(source)
+	if err != nil {
+		t.Fatalf("CompileContractSource failed: %v", err)
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.TxType = wire.TxTypeSmartContractCall
+	tx.Memo = []byte("double")
+	intrinsic := tx.CalculateIntrinsicGas()
+
+	// A successful call records intrinsic plus execution gas
+	tx.GasLimit = intrinsic + 10000
+	exec, err := chain.ExecuteContract(tx, nil, "gas", contract, "double", []smartcontract.Value{{Type: smartcontract.ValueInt, Int: 21}})
+	if err != nil {
+		t.Fatalf("ExecuteContract failed: %v", err)
+	}
+	if exec.Status != ContractStatusSuccess || exec.Result.Int != 42 {
+		t.Fatalf("Unexpected execution %+v", exec)
+	}
+	if tx.GasUsed <= intrinsic || tx.GasUsed != exec.GasUsed || tx.GasUsed > tx.GasLimit {
+		t.Errorf("GasUsed = %d, intrinsic %d, limit %d", tx.GasUsed, intrinsic, tx.GasLimit)
+	}
+
+	// Unbounded recursion uses the whole limit
+	tx.GasLimit = intrinsic + 500
+	exec, _ = chain.ExecuteContract(tx, nil, "gas", contract, "loop", []smartcontract.Value{{Type: smartcontract.ValueInt, Int: 0}})
+	if exec.Status != ContractStatusOutOfGas || tx.GasUsed != tx.GasLimit {
+		t.Errorf("Expected out of gas using the whole limit, got %s using %d of %d", exec.Status, tx.GasUsed, tx.GasLimit)
+	}
+
+	// Below intrinsic gas nothing runs
+	tx.GasLimit = intrinsic - 1
+	if exec, _ := chain.ExecuteContract(tx, nil, "gas", contract, "double", nil); exec.Status != ContractStatusOutOfGas {
+		t.Errorf("Expected out of gas below intrinsic gas, got %s", exec.Status)
+	}
+}
+
+func TestContractStoragePersistence(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	source := "def increment(n):\n    if self.count == None:\n        self.count = 0\n    self.count = self.count + n\n    return self.count\n\ndef fail():\n    self.count = 1000\n    return self.missing + 1\n"
+	contract, err := CompileContractSource(source)
+	if err != nil {
+		t.Fatalf("CompileContractSource failed: %v", err)
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.TxType = wire.TxTypeSmartContractCall
+	tx.Memo = []byte("increment")
+	tx.GasLimit = tx.CalculateIntrinsicGas() + 100000
+
+	call := func(function string, args ...smartcontract.Value) *ContractExecution {
+		exec, err := chain.ExecuteContract(tx, nil, "counter", contract, function, args)
+		if err != nil {
+			t.Fatalf("ExecuteContract failed: %v", err)
+		}
+		return exec
+	}
+	five := smartcontract.Value{Type: smartcontract.ValueInt, Int: 5}
+
+	// State persists across transactions
+	call("increment", five)
+	if exec := call("increment", five); exec.Status != ContractStatusSuccess || exec.Result.Int != 10 {
+		t.Fatalf("Second increment returned %+v", exec)
+	}
+
+	// A failed transaction's writes are discarded
+	if exec := call("fail"); exec.Status != ContractStatusReverted || len(exec.Changes) != 0 {
+		t.Fatalf("Expected revert without changes, got %+v", exec)
+	}
+	value, _, err := chain.contractStorage.LoadValue("counter", "count")
+	if err != nil || value.Int != 10 {
+		t.Fatalf("count = %+v (%v), want 10", value, err)
+	}
+
+	// Disconnecting a block undoes its changes
+	blockHash := []byte("block")
+	exec := call("increment", five)
+	if err := chain.contractStorage.SaveBlockUndo(blockHash, exec.Changes); err != nil {
+		t.Fatalf("SaveBlockUndo failed: %v", err)
+	}
+	if err := chain.contractStorage.DisconnectBlock(blockHash); err != nil {
+		t.Fatalf("DisconnectBlock failed: %v", err)
+	}
+	if value, _, _ := chain.contractStorage.LoadValue("counter", "count"); value.Int != 10 {
+		t.Errorf("count after disconnect = %d, want 10", value.Int)
+	}
+}
+
+func TestDeployContract(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	deployerKey, deployerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, deployerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+
+	code, err := CompileContractBytecode("self.owner = \"alice\"\n\ndef owner():\n    return self.owner\n")
+	if err != nil {
+		t.Fatalf("CompileContractBytecode failed: %v", err)
+	}
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(deployerKey)
+	if err := builder.SetContractPayload(wire.TxTypeSmartContractDeploy, code, 200000, 1); err != nil {
+		t.Fatalf("SetContractPayload failed: %v", err)
+	}
+	tx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build deployment: %v", err)
+	}
+
+	predicted, err := chain.NextContractAddress(deployerAddr)
+	if err != nil {
+		t.Fatalf("NextContractAddress failed: %v", err)
+	}
+	if predicted != crypto.ContractAddress(deployerAddr, 0) || !crypto.IsContractAddress(predicted) {
+		t.Fatalf("Unexpected predicted address %s", predicted)
+	}
+	if _, err := chain.AcceptTransaction(tx); err != nil {
+		t.Fatalf("Deployment rejected: %v", err)
+	}
+	if next, _ := chain.NextContractAddress(deployerAddr); next != crypto.ContractAddress(deployerAddr, 1) {
+		t.Errorf("Pending deployment not counted, next address %s", next)
+	}
+
+	block := &wire.MsgBlock{Transactions: []*wire.MsgTx{tx}}
+	if err := chain.executeBlockContracts(block, 2, chain.contractSenders(block)); err != nil {
+		t.Fatalf("executeBlockContracts failed: %v", err)
+	}
+
+	record, err := chain.GetContract(predicted)
+	if err != nil {
+		t.Fatalf("GetContract failed: %v", err)
+	}
+	if record.Deployer != deployerAddr || record.Nonce != 0 || record.TxHash != tx.TxHash() {
+		t.Errorf("Unexpected record %+v", record)
+	}
+	if len(record.ABI) != 1 || record.ABI[0].Name != "owner" {
+		t.Errorf("Unexpected ABI %+v", record.ABI)
+	}
+	if value, _, _ := chain.contractStorage.LoadValue(predicted, "owner"); value.Str != "alice" {
+		t.Errorf("Constructor state = %+v, want alice", value)
+	}
+
+	// Disconnecting removes the contract and releases the nonce
+	if err := chain.disconnectBlockContracts(block); err != nil {
+		t.Fatalf("disconnectBlockContracts failed: %v", err)
+	}
+	if _, err := chain.GetContract(predicted); err == nil {
+		t.Error("Contract still present after disconnect")
+	}
+	if nonce, _ := chain.contractStorage.DeployNonce(deployerAddr); nonce != 0 {
+		t.Errorf("Nonce after disconnect = %d, want 0", nonce)
+	}
+	if _, ok, _ := chain.contractStorage.LoadValue(predicted, "owner"); ok {
+		t.Error("Constructor state survived disconnect")
+	}
+}
+
+// connectContractTx accepts tx and connects it alone in a block at the next
+// height on top of the best block, running its contract
+func connectContractTx(t *testing.T, chain *BlockChain, tx *wire.MsgTx) *wire.MsgBlock {
+	if _, err := chain.AcceptTransaction(tx); err != nil {
+		t.Fatalf("Transaction rejected: %v", err)
+	}
+
+	chain.height++
+	block := &wire.MsgBlock{Transactions: []*wire.MsgTx{tx}}
+	block.Header.PrevBlock = chain.bestHash
+	block.Header.Nonce = uint32(chain.height) // Distinct block hashes
+	if err := chain.db.SaveBlock(block); err != nil {
+		t.Fatalf("Failed to save block: %v", err)
+	}
+	chain.bestHash = block.BlockHash()
+	senders := chain.contractSenders(block)
+	if err := chain.utxoSet.ApplyBlock(block, chain.height); err != nil {
+		t.Fatalf("Failed to apply block: %v", err)
+	}
+	if err := chain.executeBlockContracts(block, chain.height, senders); err != nil {
+		t.Fatalf("executeBlockContracts failed: %v", err)
+	}
+	chain.mempool.RemoveTransaction(tx.TxHash())
+	return block
+}
+
+func TestContractCallReceipts(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	callerKey, callerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, callerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+	chain.height = 1
+
+	source := "def deposit(note):\n    self.deposits = 1\n    emit(\"Deposit\", note)\n    return note\n\ndef fail():\n    emit(\"Lost\")\n    return self.missing + 1\n"
+	code, err := CompileContractBytecode(source)
+	if err != nil {
+		t.Fatalf("CompileContractBytecode failed: %v", err)
+	}
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(callerKey)
+	builder.SetContractPayload(wire.TxTypeSmartContractDeploy, code, 200000, 1)
+	deployTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build deployment: %v", err)
+	}
+	connectContractTx(t, chain, deployTx)
+	contract := crypto.ContractAddress(callerAddr, 0)
+
+	call := func(function string, value int64, args ...smartcontract.Value) *wire.MsgTx {
+		data, err := smartcontract.EncodeCallData(&smartcontract.CallData{Contract: contract, Function: function, Args: args})
+		if err != nil {
+			t.Fatalf("EncodeCallData failed: %v", err)
+		}
+		builder := NewShieldedTxBuilder(chain)
+		builder.AddTransparentSource(callerKey)
+		if err := builder.SetContractPayload(wire.TxTypeSmartContractCall, data, 200000, 1); err != nil {
+			t.Fatalf("SetContractPayload failed: %v", err)
+		}
+		if err := builder.AddOutput(contract, value, nil); err != nil {
+			t.Fatalf("AddOutput failed: %v", err)
+		}
+		tx, err := builder.Build()
+		if err != nil {
+			t.Fatalf("Failed to build call: %v", err)
+		}
+		return tx
+	}
+
+	// A successful call keeps the attached value and records its events
+	note := smartcontract.Value{Type: smartcontract.ValueStr, Str: "hi"}
+	okTx := call("deposit", 100000, note)
+	okBlock := connectContractTx(t, chain, okTx)
+
+	receipt, err := chain.GetContractExecution(okTx.TxHash())
+	if err != nil {
+		t.Fatalf("GetContractExecution failed: %v", err)
+	}
+	if receipt.Status != ContractStatusSuccess || receipt.Result.Str != "hi" || receipt.Sender != callerAddr ||
+		receipt.Function != "deposit" || receipt.Value != 100000 || receipt.Height != chain.height {
+		t.Fatalf("Unexpected receipt %+v", receipt)
+	}
+	if len(receipt.Logs) != 1 || receipt.Logs[0].Topic != "Deposit" || receipt.Logs[0].TxHash != okTx.TxHash() {
+		t.Fatalf("Unexpected receipt logs %+v", receipt.Logs)
+	}
+	if balance, _ := chain.utxoSet.GetBalance(contract); balance != 100000 {
+		t.Errorf("Contract balance = %d, want 100000", balance)
+	}
+
+	// A failed call drops its events and returns the value to the caller
+	failTx := call("fail", 50000)
+	connectContractTx(t, chain, failTx)
+	receipt, _ = chain.GetContractExecution(failTx.TxHash())
+	if receipt.Status != ContractStatusReverted || len(receipt.Logs) != 0 || receipt.Error == "" {
+		t.Fatalf("Unexpected failed receipt %+v", receipt)
+	}
+	if balance, _ := chain.utxoSet.GetBalance(contract); balance != 100000 {
+		t.Errorf("Contract balance after failed call = %d, want 100000", balance)
+	}
+
+	// Logs filter by contract and topic
+	if logs, _ := chain.FilterLogs(&LogFilter{Contract: contract, Topic: "Deposit"}); len(logs) != 1 || logs[0].Data.Str != "hi" {
+		t.Errorf("FilterLogs = %+v, want the deposit", logs)
+	}
+	if logs, _ := chain.FilterLogs(&LogFilter{Topic: "Lost"}); len(logs) != 0 {
+		t.Errorf("Reverted call left logs %+v", logs)
+	}
+	if logs, _ := chain.FilterLogs(&LogFilter{FromHeight: chain.height}); len(logs) != 0 {
+		t.Errorf("Height filter returned %+v", logs)
+	}
+
+	// Calls must name an existing function with the right arity
+	if _, err := chain.AcceptTransaction(call("deposit", 1000)); err == nil {
+		t.Error("Accepted call with missing argument")
+	}
+	if _, err := chain.AcceptTransaction(call("withdraw", 1000)); err == nil {
+		t.Error("Accepted call to undefined function")
+	}
+
+	// Disconnecting removes the receipt and its logs
+	if err := chain.disconnectBlockContracts(okBlock); err != nil {
+		t.Fatalf("disconnectBlockContracts failed: %v", err)
+	}
+	if _, err := chain.GetContractExecution(okTx.TxHash()); err == nil {
+		t.Error("Receipt survived disconnect")
+	}
+	if logs, _ := chain.FilterLogs(&LogFilter{Contract: contract}); len(logs) != 0 {
+		t.Errorf("Logs survived disconnect: %+v", logs)
+	}
+}
+
+func TestSimulateContract(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	callerKey, callerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, callerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+	chain.height = 1
+
+	source := "def add(n):\n    if self.total == None:\n        self.total = 0\n    self.total = self.total + n\n    emit(\"Added\", n)\n    return self.total\n"
+	code, err := CompileContractBytecode(source)
+	if err != nil {
+		t.Fatalf("CompileContractBytecode failed: %v", err)
+	}
+	send := func(txType wire.TxType, payload []byte, gasLimit uint64) *wire.MsgTx {
+		builder := NewShieldedTxBuilder(chain)
+		builder.AddTransparentSource(callerKey)
+		if err := builder.SetContractPayload(txType, payload, gasLimit, 1); err != nil {
+			t.Fatalf("SetContractPayload failed: %v", err)
+		}
+		tx, err := builder.Build()
+		if err != nil {
+			t.Fatalf("Failed to build transaction: %v", err)
+		}
+		connectContractTx(t, chain, tx)
+		return tx
+	}
+	send(wire.TxTypeSmartContractDeploy, code, 200000)
+	deployHeight := chain.height
+	contract := crypto.ContractAddress(callerAddr, 0)
+
+	five := smartcontract.Value{Type: smartcontract.ValueInt, Int: 5}
+	call := &smartcontract.CallData{Contract: contract, Function: "add", Args: []smartcontract.Value{five}}
+	data, err := smartcontract.EncodeCallData(call)
+	if err != nil {
+		t.Fatalf("EncodeCallData failed: %v", err)
+	}
+	send(wire.TxTypeSmartContractCall, data, 200000)
+
+	// Simulation reports the diff and events without changing state
+	sim, err := chain.SimulateContract(call, "", 0, -1, 0)
+	if err != nil {
+		t.Fatalf("SimulateContract failed: %v", err)
+	}
+	if sim.Status != ContractStatusSuccess || sim.Result.Int != 10 || len(sim.Logs) != 1 || sim.Logs[0].Topic != "Added" {
+		t.Fatalf("Unexpected simulation %+v", sim)
+	}
+	if len(sim.Diffs) != 1 || sim.Diffs[0].Key != "total" || sim.Diffs[0].Before.Int != 5 || sim.Diffs[0].After.Int != 10 {
+		t.Errorf("Unexpected diffs %+v", sim.Diffs)
+	}
+	if value, _, _ := chain.contractStorage.LoadValue(contract, "total"); value.Int != 5 {
+		t.Errorf("Simulation changed storage to %+v", value)
+	}
+
+	// At the deployment height the first call has not happened yet
+	sim, err = chain.SimulateContract(call, "", 0, deployHeight, 0)
+	if err != nil {
+		t.Fatalf("SimulateContract at height %d failed: %v", deployHeight, err)
+	}
+	if sim.Result.Int != 5 || sim.Diffs[0].Before.Type != smartcontract.ValueNone {
+		t.Errorf("Historical simulation = %+v, diffs %+v", sim.Result, sim.Diffs)
+	}
+	if _, err := chain.SimulateContract(call, "", 0, deployHeight-1, 0); err == nil {
+		t.Error("Simulated call before deployment")
+	}
+
+	// The estimate is exactly enough gas
+	estimate, err := chain.EstimateGas(call, "", 0)
+	if err != nil {
+		t.Fatalf("EstimateGas failed: %v", err)
+	}
+	if sim, _ := chain.SimulateContract(call, "", 0, -1, estimate); sim.Status != ContractStatusSuccess {
+		t.Errorf("Call with estimated gas %d: %s", estimate, sim.Error)
+	}
+	if sim, _ := chain.SimulateContract(call, "", 0, -1, estimate-1); sim.Status != ContractStatusOutOfGas {
+		t.Errorf("Call with gas %d below estimate: %s", estimate-1, sim.Status)
+	}
+}
+
+func TestContractTransfers(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	callerKey, callerAddr := newTestKey(t)
+	_, recipient := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, callerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+	chain.height = 1
+
+	source := "def deposit():\n    return balance_of(self)\n\n" +
+		"def withdraw(to, amount):\n    transfer(to, amount)\n    return balance_of(self)\n\n" +
+		"def withdraw_then_fail(to, amount):\n    transfer(to, amount)\n    return self.missing + 1\n\n" +
+		"def pay_token(token, to, amount):\n    token_transfer(token, to, amount)\n    return balance_of(self, token)\n"
+	code, err := CompileContractBytecode(source)
+	if err != nil {
+		t.Fatalf("CompileContractBytecode failed: %v", err)
+	}
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(callerKey)
+	builder.SetContractPayload(wire.TxTypeSmartContractDeploy, code, 200000, 1)
+	deployTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build deployment: %v", err)
+	}
+	connectContractTx(t, chain, deployTx)
+	contract := crypto.ContractAddress(callerAddr, 0)
+
+	str := func(s string) smartcontract.Value { return smartcontract.Value{Type: smartcontract.ValueStr, Str: s} }
+	num := func(n int64) smartcontract.Value { return smartcontract.Value{Type: smartcontract.ValueInt, Int: n} }
+	call := func(function string, value int64, args ...smartcontract.Value) (*ContractExecution, *wire.MsgBlock) {
+		data, err := smartcontract.EncodeCallData(&smartcontract.CallData{Contract: contract, Function: function, Args: args})
+		if err != nil {
+			t.Fatalf("EncodeCallData failed: %v", err)
+		}
+		builder := NewShieldedTxBuilder(chain)
+		builder.AddTransparentSource(callerKey)
+		if err := builder.SetContractPayload(wire.TxTypeSmartContractCall, data, 200000, 1); err != nil {
+			t.Fatalf("SetContractPayload failed: %v", err)
+		}
+		if value > 0 {
+			if err := builder.AddOutput(contract, value, nil); err != nil {
+				t.Fatalf("AddOutput failed: %v", err)
+			}
+		}
+		tx, err := builder.Build()
+		if err != nil {
+			t.Fatalf("Failed to build call: %v", err)
+		}
+		block := connectContractTx(t, chain, tx)
+		exec, err := chain.GetContractExecution(tx.TxHash())
+		if err != nil {
+			t.Fatalf("GetContractExecution failed: %v", err)
+		}
+		return exec, block
+	}
+	balance := func(address string) int64 {
+		balance, _ := chain.utxoSet.GetBalance(address)
+		return balance
+	}
+
+	if exec, _ := call("deposit", 100000); exec.Result.Int != 100000 {
+		t.Fatalf("deposit saw balance %+v, want 100000", exec.Result)
+	}
+
+	// OBS is paid from the contract's outputs with change back to it
+	exec, withdrawBlock := call("withdraw", 0, str(recipient), num(30000))
+	if exec.Status != ContractStatusSuccess || exec.Result.Int != 70000 {
+		t.Fatalf("Unexpected withdrawal %+v", exec)
+	}
+	if len(exec.Transfers) != 1 || len(exec.Spent) != 1 || len(exec.Payouts) != 2 {
+		t.Errorf("Transfers %+v, spent %+v, payouts %+v", exec.Transfers, exec.Spent, exec.Payouts)
+	}
+	if balance(recipient) != 30000 || balance(contract) != 70000 {
+		t.Errorf("Balances after withdrawal: recipient %d, contract %d", balance(recipient), balance(contract))
+	}
+
+	// A failed call settles nothing
+	if exec, _ := call("withdraw_then_fail", 0, str(recipient), num(10000)); exec.Status != ContractStatusReverted || len(exec.Transfers) != 0 {
+		t.Errorf("Unexpected failed withdrawal %+v", exec)
+	}
+	if exec, _ := call("withdraw", 0, str(recipient), num(70001)); exec.Status != ContractStatusReverted {
+		t.Errorf("Overdraft status %s", exec.Status)
+	}
+	if balance(recipient) != 30000 || balance(contract) != 70000 {
+		t.Errorf("Failed calls moved value: recipient %d, contract %d", balance(recipient), balance(contract))
+	}
+
+	// Tokens move on the token ledger
+	tokenID := wire.Hash{1}
+	chain.tokenStore.tokens[tokenID] = &Token{ID: tokenID, Symbol: "TOK"}
+	chain.tokenStore.balances[contract] = map[wire.Hash]int64{tokenID: 500}
+	exec, tokenBlock := call("pay_token", 0, str(tokenID.String()), str(recipient), num(200))
+	if exec.Status != ContractStatusSuccess || exec.Result.Int != 300 {
+		t.Fatalf("Unexpected token transfer %+v", exec)
+	}
+	if got := chain.tokenStore.GetBalance(recipient, tokenID); got != 200 {
+		t.Errorf("Recipient token balance = %d, want 200", got)
+	}
+
+	// Disconnecting returns tokens and OBS to the contract
+	for _, block := range []*wire.MsgBlock{tokenBlock, withdrawBlock} {
+		if err := chain.disconnectBlockContracts(block); err != nil {
+			t.Fatalf("disconnectBlockContracts failed: %v", err)
+		}
+		if err := chain.utxoSet.RollbackBlock(block); err != nil {
+			t.Fatalf("RollbackBlock failed: %v", err)
+		}
+	}
+	if got := chain.tokenStore.GetBalance(contract, tokenID); got != 500 {
+		t.Errorf("Contract token balance after disconnect = %d, want 500", got)
+	}
+	if balance(recipient) != 0 || balance(contract) != 100000 {
+		t.Errorf("Balances after disconnect: recipient %d, contract %d", balance(recipient), balance(contract))
+	}
+}
+
+func TestBlockGasLimit(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+
+	contractTx := func(gasLimit uint64) *wire.MsgTx {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.TxType = wire.TxTypeSmartContractDeploy
+		tx.Memo = []byte{1}
+		tx.GasLimit, tx.GasPrice = gasLimit, 1
+		return tx
+	}
+	half := params.BlockGasLimit/2 + 1
+
+	// Each transaction fits on its own, but not both together
+	block := mineTestBlocks(t, params, params.GenesisBlock, 1, 1, "obs1miner")[0]
+	block.AddTransaction(contractTx(half))
+	if err := chain.validateBlockGas(block); err != nil {
+		t.Fatalf("validateBlockGas rejected a single transaction: %v", err)
+	}
+	block.AddTransaction(contractTx(half))
+	err := chain.ProcessBlock(block, nil)
+	if err == nil || !strings.Contains(err.Error(), "block gas limit") {
+		t.Fatalf("ProcessBlock = %v, expected the block gas limit to be exceeded", err)
+	}
+	if chain.Height() != 0 {
+		t.Errorf("Rejected block connected, height %d", chain.Height())
+	}
+}
+
+func TestContractSenderVerified(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+
+	deployerKey, deployerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, deployerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+	code, err := CompileContractBytecode("self.owner = \"alice\"\n")
+	if err != nil {
+		t.Fatalf("CompileContractBytecode failed: %v", err)
+	}
+
+	// A deployment without a signed input rejects the block
+	unsigned := wire.NewMsgTx(wire.TxVersion)
+	unsigned.TxType = wire.TxTypeSmartContractDeploy
+	unsigned.Memo = code
+	unsigned.GasLimit, unsigned.GasPrice = 200000, 1
+
+	block := mineTestBlocks(t, params, params.GenesisBlock, 1, 1, "obs1miner")[0]
+	block.AddTransaction(unsigned)
+	err = chain.ProcessBlock(block, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid contract transaction") {
+		t.Fatalf("ProcessBlock = %v, expected the deployment to be rejected", err)
+	}
+	if chain.Height() != 0 {
+		t.Fatalf("Rejected block connected, height %d", chain.Height())
+	}
+	if _, err := chain.GetContractExecution(unsigned.TxHash()); err == nil {
+		t.Error("Rejected deployment left a receipt")
+	}
+
+	// Signed by the key it names, the sender is accepted
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(deployerKey)
+	builder.SetContractPayload(wire.TxTypeSmartContractDeploy, code, 200000, 1)
+	deploy, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build deployment: %v", err)
+	}
+	block = mineTestBlocks(t, params, params.GenesisBlock, 1, 1, "obs1miner")[0]
+	block.AddTransaction(deploy)
+	if err := chain.ProcessBlock(block, nil); err != nil {
+		t.Fatalf("ProcessBlock failed: %v", err)
+	}
+	if exec, err := chain.GetContractExecution(deploy.TxHash()); err != nil || exec.Sender != deployerAddr {
+		t.Errorf("Receipt = %+v, %v; expected sender %s", exec, err, deployerAddr)
+	}
+}
+
+func TestForgedContractCallerRejected(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+
+	ownerKey, ownerAddr := newTestKey(t)
+	attackerKey, attackerAddr := newTestKey(t)
+	funding := &wire.MsgBlock{Transactions: []*wire.MsgTx{
+		wire.NewCoinbaseTx(1, 10*100000000, ownerAddr),
+		wire.NewCoinbaseTx(1, 10*100000000, attackerAddr),
+	}}
+	if err := chain.utxoSet.ApplyBlock(funding, 1); err != nil {
+		t.Fatalf("Failed to apply coinbases: %v", err)
+	}
+
+	source := "self.owner = msg.sender\n\n" +
+		"def deposit():\n    return balance_of(self)\n\n" +
+		"def withdraw(to, amount):\n    if msg.sender == self.owner:\n        transfer(to, amount)\n    return balance_of(self)\n"
+	code, err := CompileContractBytecode(source)
+	if err != nil {
+		t.Fatalf("CompileContractBytecode failed: %v", err)
+	}
+	contract := crypto.ContractAddress(ownerAddr, 0)
+
+	build := func(key *ecdsa.PrivateKey, txType wire.TxType, payload []byte, value int64) *wire.MsgTx {
+		builder := NewShieldedTxBuilder(chain)
+		builder.AddTransparentSource(key)
+		if err := builder.SetContractPayload(txType, payload, 200000, 1); err != nil {
+			t.Fatalf("SetContractPayload failed: %v", err)
+		}
+		if value > 0 {
+			if err := builder.AddOutput(contract, value, nil); err != nil {
+				t.Fatalf("AddOutput failed: %v", err)
+			}
+		}
+		tx, err := builder.Build()
+		if err != nil {
+			t.Fatalf("Failed to build transaction: %v", err)
+		}
+		return tx
+	}
+	callData := func(function string, args ...smartcontract.Value) []byte {
+		data, err := smartcontract.EncodeCallData(&smartcontract.CallData{Contract: contract, Function: function, Args: args})
+		if err != nil {
+			t.Fatalf("EncodeCallData failed: %v", err)
+		}
+		return data
+	}
+	prev := params.GenesisBlock
+	connect := func(tx *wire.MsgTx) error {
+		block := mineTestBlocks(t, params, prev, chain.Height()+1, 1, "obs1miner")[0]
+		block.AddTransaction(tx)
+		if err := chain.ProcessBlock(block, nil); err != nil {
+			return err
+		}
+		prev = block
+		return nil
+	}
+
+	// The owner deploys the vault and funds it
+	if err := connect(build(ownerKey, wire.TxTypeSmartContractDeploy, code, 0)); err != nil {
+		t.Fatalf("Deployment rejected: %v", err)
+	}
+	if err := connect(build(ownerKey, wire.TxTypeSmartContractCall, callData("deposit"), 100000)); err != nil {
+		t.Fatalf("Deposit rejected: %v", err)
+	}
+
+	// The attacker spends their own output, signed with their own key, but
+	// puts the owner's public key in the script to call as the owner
+	amount := smartcontract.Value{Type: smartcontract.ValueInt, Int: 100000}
+	to := smartcontract.Value{Type: smartcontract.ValueStr, Str: attackerAddr}
+	forged := build(attackerKey, wire.TxTypeSmartContractCall, callData("withdraw", to, amount), 0)
+	sig, _, err := parseSignatureScript(forged.TxIn[0].SignatureScript)
+	if err != nil {
+		t.Fatalf("parseSignatureScript failed: %v", err)
+	}
+	ownerPub := crypto.PublicKeyToBytes(&ownerKey.PublicKey)
+	script := append([]byte{byte(len(sig))}, sig...)
+	script = append(script, byte(len(ownerPub)))
+	forged.TxIn[0].SignatureScript = append(script, ownerPub...)
+
+	height := chain.Height()
+	err = connect(forged)
+	if err == nil || !strings.Contains(err.Error(), "sender signature") {
+		t.Fatalf("ProcessBlock = %v, expected the forged caller to be rejected", err)
+	}
+	if chain.Height() != height {
+		t.Errorf("Block with forged caller connected, height %d", chain.Height())
+	}
+	if _, err := chain.GetContractExecution(forged.TxHash()); err == nil {
+		t.Error("Forged call left a receipt")
+	}
+	if balance, _ := chain.utxoSet.GetBalance(contract); balance != 100000 {
+		t.Errorf("Vault balance = %d, want 100000", balance)
+	}
+}
@@ -3,21 +3,15 @@ package blockchain
 import (
 	"math/big"
 	"obsidian-core/chaincfg"
-	"obsidian-core/consensus"
 	"testing"
 	"time"
 )
 
 func TestDifficultyAdjustment(t *testing.T) {
 	params := &chaincfg.MainNetParams
-	pow := consensus.NewDarkMatter()
 
 	// Create a test blockchain
-	chain, err := NewBlockchain(params, pow)
-	if err != nil {
-		t.Fatalf("Failed to create blockchain: %v", err)
-	}
-	defer chain.Close()
+	chain := newTestChain(t, params)
 
 	// Test 1: No adjustment for blocks before retarget interval
 	genesisBlock := params.GenesisBlock
@@ -0,0 +1,257 @@
+package blockchain
+
+import (
+	"fmt"
+	"obsidian-core/consensus"
+	"obsidian-core/wire"
+)
+
+// extendMainChain records hash as the block at the next main chain height.
+// The caller must hold b.chainMu.
+func (b *BlockChain) extendMainChain(hash wire.Hash) {
+	if b.mainIndex == nil {
+		b.mainIndex = make(map[wire.Hash]int32)
+	}
+	b.mainIndex[hash] = int32(len(b.mainChain))
+	b.mainChain = append(b.mainChain, hash)
+}
+
+// popMainChain removes the tip from the main chain index. The caller must
+// hold b.chainMu.
+func (b *BlockChain) popMainChain() {
+	tip := len(b.mainChain) - 1
+	delete(b.mainIndex, b.mainChain[tip])
+	b.mainChain = b.mainChain[:tip]
+}
+
+// BlockHashByHeight returns the hash of the main chain block at height.
+func (b *BlockChain) BlockHashByHeight(height int32) (wire.Hash, error) {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	if height < 0 || int(height) >= len(b.mainChain) {
+		return wire.Hash{}, fmt.Errorf("no main chain block at height %d", height)
+	}
+	return b.mainChain[height], nil
+}
+
+// MainChainHeight returns the height of hash if it is on the main chain.
+func (b *BlockChain) MainChainHeight(hash wire.Hash) (int32, bool) {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	height, ok := b.mainIndex[hash]
+	return height, ok
+}
+
+// BlockLocator returns main chain hashes from the tip back to genesis, one
+// per block for the most recent ten and then doubling the step each time.
+func (b *BlockChain) BlockLocator() []wire.Hash {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	return buildLocator(int32(len(b.mainChain))-1, 0, func(height int32) wire.Hash {
+		return b.mainChain[height]
+	})
+}
+
+// LocateHeaders returns up to max main chain headers following the most
+// recent locator hash on the main chain, or following genesis if none is. It
+// stops early after the header whose hash is stop.
+func (b *BlockChain) LocateHeaders(locator []wire.Hash, stop wire.Hash, max int) ([]*wire.BlockHeader, error) {
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	start := int32(0)
+	for _, hash := range locator {
+		if height, ok := b.mainIndex[hash]; ok {
+			start = height
+			break
+		}
+	}
+
+	var headers []*wire.BlockHeader
+	for height := start + 1; int(height) < len(b.mainChain) && len(headers) < max; height++ {
+		hash := b.mainChain[height]
+		block, err := b.db.GetBlock(hash[:])
+		if err != nil {
+			return nil, fmt.Errorf("block at height %d not found: %v", height, err)
+		}
+		headers = append(headers, &block.Header)
+		if hash == stop {
+			break
+		}
+	}
+	return headers, nil
+}
+
+// buildLocator returns the hashes of a chain from tip down to base, dense
+// near the tip and exponentially sparser further back, always ending at base.
+func buildLocator(tip, base int32, hashAt func(int32) wire.Hash) []wire.Hash {
+	var locator []wire.Hash
+	step := int32(1)
+	for height := tip; height > base; height -= step {
+		locator = append(locator, hashAt(height))
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if tip >= base {
+		locator = append(locator, hashAt(base))
+	}
+	return locator
+}
+
+// retargetInterval returns the number of blocks in a difficulty period.
+func (b *BlockChain) retargetInterval() int32 {
+	return int32(b.params.TargetTimespan / b.params.TargetTimePerBlock)
+}
+
+// HeaderChain is a chain of validated headers extending the main chain.
+// Headers-first sync builds it before fetching block bodies, so blocks are
+// only downloaded once their proof of work, difficulty and checkpoints have
+// been checked. It follows a single chain; headers forking from it are
+// rejected.
+type HeaderChain struct {
+	chain   *BlockChain
+	pow     consensus.PowEngine
+	base    int32 // Height of headers[0]
+	headers []*wire.BlockHeader
+	hashes  []wire.Hash
+	heights map[wire.Hash]int32
+}
+
+// NewHeaderChain returns a header chain ending at the best block. It keeps
+// the last difficulty period of main chain headers so the first retarget
+// after the tip can be checked. A nil pow uses the chain's engine.
+func (b *BlockChain) NewHeaderChain(pow consensus.PowEngine) (*HeaderChain, error) {
+	if pow == nil {
+		pow = b.pow
+	}
+	b.chainMu.RLock()
+	defer b.chainMu.RUnlock()
+
+	tip := int32(len(b.mainChain)) - 1
+	if tip < 0 {
+		return nil, fmt.Errorf("main chain index is empty")
+	}
+
+	base := tip - b.retargetInterval()
+	if base < 0 {
+		base = 0
+	}
+	hc := &HeaderChain{
+		chain:   b,
+		pow:     pow,
+		base:    base,
+		heights: make(map[wire.Hash]int32),
+	}
+	for height := base; height <= tip; height++ {
+		hash := b.mainChain[height]
+		block, err := b.db.GetBlock(hash[:])
+		if err != nil {
+			return nil, fmt.Errorf("block at height %d not found: %v", height, err)
+		}
+		hc.append(&block.Header, hash)
+	}
+	return hc, nil
+}
+
+// append adds a header at the next height without validating it.
+func (hc *HeaderChain) append(header *wire.BlockHeader, hash wire.Hash) {
+	hc.heights[hash] = hc.base + int32(len(hc.headers))
+	hc.headers = append(hc.headers, header)
+	hc.hashes = append(hc.hashes, hash)
+}
+
+// Height returns the height of the last header.
+func (hc *HeaderChain) Height() int32 {
+	return hc.base + int32(len(hc.headers)) - 1
+}
+
+// TipHash returns the hash of the last header.
+func (hc *HeaderChain) TipHash() wire.Hash {
+	return hc.hashes[len(hc.hashes)-1]
+}
+
+// HashAtHeight returns the hash of the header at height.
+func (hc *HeaderChain) HashAtHeight(height int32) (wire.Hash, bool) {
+	if height < hc.base || height > hc.Height() {
+		return wire.Hash{}, false
+	}
+	return hc.hashes[height-hc.base], true
+}
+
+// HeightOf returns the height of the header with the given hash.
+func (hc *HeaderChain) HeightOf(hash wire.Hash) (int32, bool) {
+	height, ok := hc.heights[hash]
+	return height, ok
+}
+
+// Locator returns a block locator for the header chain tip, ending with
+// genesis so that any peer on the same network finds a common block.
+func (hc *HeaderChain) Locator() []wire.Hash {
+	locator := buildLocator(hc.Height(), hc.base, func(height int32) wire.Hash {
+		return hc.hashes[height-hc.base]
+	})
+	if hc.base > 0 {
+		locator = append(locator, hc.chain.params.GenesisBlock.BlockHash())
+	}
+	return locator
+}
+
+// Connect validates headers in order and appends them to the chain. Headers
+// already in the chain are skipped. It returns how many were added before
+// the first invalid header, if any.
+func (hc *HeaderChain) Connect(headers []*wire.BlockHeader) (int, error) {
+	added := 0
+	for _, header := range headers {
+		hash := header.BlockHash()
+		if _, ok := hc.heights[hash]; ok {
+			continue
+		}
+
+		height := hc.Height() + 1
+		if err := hc.checkHeader(header, hash, height); err != nil {
+			return added, fmt.Errorf("invalid header %s at height %d: %v", hash, height, err)
+		}
+		hc.append(header, hash)
+		added++
+	}
+	return added, nil
+}
+
+// checkHeader validates header as the next header at height.
+func (hc *HeaderChain) checkHeader(header *wire.BlockHeader, hash wire.Hash, height int32) error {
+	if header.PrevBlock != hc.TipHash() {
+		return fmt.Errorf("previous block %s is not the header chain tip", header.PrevBlock)
+	}
+	if err := hc.chain.validateBlockHeader(header); err != nil {
+		return err
+	}
+	if bits := hc.requiredBits(height); header.Bits != bits {
+		return fmt.Errorf("difficulty bits %08x, expected %08x", header.Bits, bits)
+	}
+	if !hc.pow.Verify(header) {
+		return fmt.Errorf("invalid proof of work")
+	}
+	return hc.chain.validateCheckpoint(height, hash)
+}
+
+// requiredBits returns the difficulty for the header at height, following
+// the same retarget rules ProcessBlock applies to blocks.
+func (hc *HeaderChain) requiredBits(height int32) uint32 {
+	prev := hc.headers[height-1-hc.base]
+	interval := hc.chain.retargetInterval()
+	if height%interval != 0 {
+		return prev.Bits
+	}
+
+	firstHeight := height - interval
+	if firstHeight < hc.base {
+		return prev.Bits
+	}
+	first := hc.headers[firstHeight-hc.base]
+	bits, _ := calcRetargetBits(hc.chain.params, prev.Bits, prev.Timestamp.Unix()-first.Timestamp.Unix())
+	return bits
+}
@@ -0,0 +1,209 @@
+package blockchain
+
+import (
+	"obsidian-core/chaincfg"
+	"obsidian-core/consensus"
+	"obsidian-core/wire"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mineTestBlocks returns n solved blocks extending prev, one minute apart,
+// whose coinbases pay payTo
+func mineTestBlocks(t *testing.T, params *chaincfg.Params, prev *wire.MsgBlock, startHeight int32, n int, payTo string) []*wire.MsgBlock {
+	pow := consensus.NewDarkMatter()
+	var blocks []*wire.MsgBlock
+	for i := 0; i < n; i++ {
+		height := startHeight + int32(i)
+		block := wire.NewMsgBlock(&wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Header.Timestamp.Add(time.Minute),
+			Bits:      prev.Header.Bits,
+		})
+		block.AddTransaction(wire.NewCoinbaseTx(height, params.CalcBlockSubsidy(height), payTo))
+		block.Header.MerkleRoot = wire.BlockMerkleRoot(block)
+		nonce, solution, found := pow.Solve(&block.Header)
+		if !found {
+			t.Fatalf("Failed to solve block at height %d", height)
+		}
+		block.Header.Nonce, block.Header.DarkMatterSolution = nonce, solution
+		blocks = append(blocks, block)
+		prev = block
+	}
+	return blocks
+}
+
+func blockHeaders(blocks []*wire.MsgBlock) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, len(blocks))
+	for i, block := range blocks {
+		headers[i] = &block.Header
+	}
+	return headers
+}
+
+// newTestChain returns a chain at genesis in its own data directory
+func newTestChain(t *testing.T, params *chaincfg.Params) *BlockChain {
+	t.Setenv("DATA_DIR", t.TempDir())
+	chain, err := NewBlockchain(params, consensus.NewDarkMatter())
+	if err != nil {
+		t.Fatalf("Failed to create blockchain: %v", err)
+	}
+	t.Cleanup(chain.Close)
+	return chain
+}
+
+func TestHeaderChainConnect(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+	blocks := mineTestBlocks(t, params, params.GenesisBlock, 1, 12, "obs1miner")
+
+	hc, err := chain.NewHeaderChain(nil)
+	if err != nil {
+		t.Fatalf("NewHeaderChain failed: %v", err)
+	}
+	added, err := hc.Connect(blockHeaders(blocks))
+	if err != nil || added != 12 {
+		t.Fatalf("Connect = %d, %v; expected 12 headers", added, err)
+	}
+	if hc.Height() != 12 || hc.TipHash() != blocks[11].BlockHash() {
+		t.Errorf("Header tip at height %d, expected 12", hc.Height())
+	}
+	if height, ok := hc.HeightOf(blocks[4].BlockHash()); !ok || height != 5 {
+		t.Errorf("HeightOf = %d, %v; expected 5", height, ok)
+	}
+
+	// Known headers are skipped
+	if added, err := hc.Connect(blockHeaders(blocks[:3])); err != nil || added != 0 {
+		t.Errorf("Reconnecting known headers = %d, %v", added, err)
+	}
+
+	// The locator is dense near the tip and ends at genesis
+	locator := hc.Locator()
+	if locator[0] != blocks[11].BlockHash() || locator[len(locator)-1] != params.GenesisBlock.BlockHash() {
+		t.Errorf("Unexpected locator endpoints")
+	}
+	if len(locator) != 12 {
+		t.Errorf("Expected 12 locator hashes, got %d", len(locator))
+	}
+}
+
+func TestHeaderChainRejects(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+	blocks := mineTestBlocks(t, params, params.GenesisBlock, 1, 2, "obs1miner")
+
+	unsolved := blocks[1].Header
+	pow := consensus.NewDarkMatter()
+	for pow.Verify(&unsolved) {
+		unsolved.Nonce++
+	}
+	wrongBits := blocks[0].Header
+	wrongBits.Bits = 0x1f00ffff
+
+	tests := []struct {
+		name    string
+		headers []*wire.BlockHeader
+		want    string
+	}{
+		{"gap", []*wire.BlockHeader{&blocks[1].Header}, "is not the header chain tip"},
+		{"proof of work", []*wire.BlockHeader{&blocks[0].Header, &unsolved}, "invalid proof of work"},
+		{"difficulty", []*wire.BlockHeader{&wrongBits}, "difficulty bits 1f00ffff"},
+	}
+	for _, tt := range tests {
+		hc, err := chain.NewHeaderChain(nil)
+		if err != nil {
+			t.Fatalf("NewHeaderChain failed: %v", err)
+		}
+		if _, err := hc.Connect(tt.headers); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// Headers conflicting with a checkpoint are rejected
+	checkpointed := *params
+	checkpointed.Checkpoints = []chaincfg.Checkpoint{{Height: 2, Hash: wire.Hash{1}}}
+	chain = newTestChain(t, &checkpointed)
+	hc, err := chain.NewHeaderChain(nil)
+	if err != nil {
+		t.Fatalf("NewHeaderChain failed: %v", err)
+	}
+	added, err := hc.Connect(blockHeaders(blocks))
+	if added != 1 || err == nil || !strings.Contains(err.Error(), "checkpoint mismatch") {
+		t.Errorf("Connect past a bad checkpoint = %d, %v", added, err)
+	}
+}
+
+func TestLocateHeaders(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+	blocks := mineTestBlocks(t, params, params.GenesisBlock, 1, 5, "obs1miner")
+	for _, block := range blocks {
+		if err := chain.ProcessBlock(block, nil); err != nil {
+			t.Fatalf("ProcessBlock failed: %v", err)
+		}
+	}
+
+	if hash, err := chain.BlockHashByHeight(3); err != nil || hash != blocks[2].BlockHash() {
+		t.Errorf("BlockHashByHeight(3) = %s, %v", hash, err)
+	}
+
+	// A locator from a peer at height 2 on an unknown fork still finds genesis
+	locator := []wire.Hash{{0xff}, blocks[1].BlockHash()}
+	headers, err := chain.LocateHeaders(locator, wire.Hash{}, 10)
+	if err != nil || len(headers) != 3 || headers[0].BlockHash() != blocks[2].BlockHash() {
+		t.Fatalf("LocateHeaders = %d headers, %v; expected 3 from height 3", len(headers), err)
+	}
+	headers, _ = chain.LocateHeaders([]wire.Hash{{0xff}}, blocks[1].BlockHash(), 10)
+	if len(headers) != 2 {
+		t.Errorf("Expected headers up to the stop hash, got %d", len(headers))
+	}
+	headers, _ = chain.LocateHeaders(chain.BlockLocator(), wire.Hash{}, 10)
+	if len(headers) != 0 {
+		t.Errorf("Expected no headers past our own tip, got %d", len(headers))
+	}
+}
+
+func TestReorgUpdatesMainChain(t *testing.T) {
+	params := &chaincfg.MainNetParams
+	chain := newTestChain(t, params)
+	main := mineTestBlocks(t, params, params.GenesisBlock, 1, 3, "obs1miner")
+	for _, block := range main {
+		if err := chain.ProcessBlock(block, nil); err != nil {
+			t.Fatalf("ProcessBlock failed: %v", err)
+		}
+	}
+
+	// A longer fork from height 1
+	fork := mineTestBlocks(t, params, main[0], 2, 3, "obs1fork")
+	for _, block := range fork {
+		if err := chain.db.SaveBlock(block); err != nil {
+			t.Fatalf("Failed to save fork block: %v", err)
+		}
+	}
+
+	result, err := chain.MaybeReorg(fork[2], chain.pow)
+	if err != nil || result == nil {
+		t.Fatalf("MaybeReorg = %v, %v; expected a reorganization", result, err)
+	}
+	if len(result.Disconnected) != 2 || len(result.Connected) != 3 {
+		t.Errorf("Disconnected %d and connected %d blocks", len(result.Disconnected), len(result.Connected))
+	}
+	if chain.Height() != 4 {
+		t.Fatalf("Height after reorg = %d, expected 4", chain.Height())
+	}
+	for i, block := range append([]*wire.MsgBlock{main[0]}, fork...) {
+		if hash, err := chain.BlockHashByHeight(int32(i + 1)); err != nil || hash != block.BlockHash() {
+			t.Errorf("BlockHashByHeight(%d) = %s, %v", i+1, hash, err)
+		}
+	}
+	for _, block := range main[1:] {
+		if _, ok := chain.MainChainHeight(block.BlockHash()); ok {
+			t.Errorf("Disconnected block %s still on the main chain", block.BlockHash())
+		}
+	}
+	if locator := chain.BlockLocator(); locator[0] != fork[2].BlockHash() {
+		t.Errorf("Locator starts at %s, expected the new tip", locator[0])
+	}
+}
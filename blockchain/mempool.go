@@ -1,6 +1,7 @@
 package blockchain
 
 import (
+	"bytes"
 	"fmt"
 	"obsidian-core/wire"
 	"sync"
@@ -16,6 +17,9 @@ const (
 
 	// OrphanTxExpiry is the time after which orphan txs are removed
 	OrphanTxExpiry = 20 * time.Minute
+
+	// MaxStemPoolSize is the maximum number of Dandelion stem transactions
+	MaxStemPoolSize = 1000
 )
 
 // TxDesc represents a transaction in the mempool
@@ -40,6 +44,13 @@ type Mempool struct {
 	// Index of transactions by address
 	outpoints map[wire.OutPoint]wire.Hash
 
+	// Index of transactions by revealed shielded nullifier
+	nullifiers map[string]wire.Hash
+
+	// Dandelion stem transactions, relayed privately and kept out of the
+	// public pool until they are fluffed
+	stem map[wire.Hash]*TxDesc
+
 	// Maximum size
 	maxSize int
 }
@@ -47,18 +58,40 @@ type Mempool struct {
 // NewMempool creates a new mempool
 func NewMempool() *Mempool {
 	return &Mempool{
-		pool:      make(map[wire.Hash]*TxDesc),
-		orphans:   make(map[wire.Hash]*TxDesc),
-		outpoints: make(map[wire.OutPoint]wire.Hash),
-		maxSize:   MaxMempoolSize,
+		pool:       make(map[wire.Hash]*TxDesc),
+		orphans:    make(map[wire.Hash]*TxDesc),
+		outpoints:  make(map[wire.OutPoint]wire.Hash),
+		nullifiers: make(map[string]wire.Hash),
+		stem:       make(map[wire.Hash]*TxDesc),
+		maxSize:    MaxMempoolSize,
 	}
 }
 
-// AddTransaction adds a transaction to the mempool
+// AddTransaction adds a transaction to the mempool. A stem transaction
+// with the same hash has been fluffed and leaves the stem pool.
 func (m *Mempool) AddTransaction(tx *wire.MsgTx, height int32, fee int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	desc := &TxDesc{
+		Tx:       tx,
+		Added:    time.Now(),
+		Height:   height,
+		Fee:      fee,
+		FeePerKB: calculateFeePerKB(tx, fee),
+	}
+	if err := m.addTransactionLocked(desc); err != nil {
+		return err
+	}
+	delete(m.stem, tx.TxHash())
+	return nil
+}
+
+// addTransactionLocked adds a transaction to the public pool without
+// acquiring the lock
+func (m *Mempool) addTransactionLocked(txDesc *TxDesc) error {
+	tx := txDesc.Tx
+
 	// Check if mempool is full
 	if len(m.pool) >= m.maxSize {
 		return fmt.Errorf("mempool is full")
@@ -71,13 +104,9 @@ func (m *Mempool) AddTransaction(tx *wire.MsgTx, height int32, fee int64) error
 		return fmt.Errorf("transaction already in mempool")
 	}
 
-	// Create transaction descriptor
-	txDesc := &TxDesc{
-		Tx:       tx,
-		Added:    time.Now(),
-		Height:   height,
-		Fee:      fee,
-		FeePerKB: calculateFeePerKB(tx, fee),
+	// Check that no other unconfirmed transaction spends the same notes
+	if err := m.checkNullifiersLocked(tx); err != nil {
+		return err
 	}
 
 	// Add to pool
@@ -88,14 +117,125 @@ func (m *Mempool) AddTransaction(tx *wire.MsgTx, height int32, fee int64) error
 		m.outpoints[txIn.PreviousOutPoint] = txHash
 	}
 
+	// Index nullifiers
+	for _, spend := range tx.ShieldedSpends {
+		m.nullifiers[string(spend.Nullifier)] = txHash
+	}
+
+	return nil
+}
+
+// checkNullifiersLocked rejects a transaction revealing a nullifier twice
+// or one already revealed by the public pool
+func (m *Mempool) checkNullifiersLocked(tx *wire.MsgTx) error {
+	seen := make(map[string]bool)
+	for _, spend := range tx.ShieldedSpends {
+		key := string(spend.Nullifier)
+		if seen[key] {
+			return fmt.Errorf("transaction reveals the same nullifier twice")
+		}
+		seen[key] = true
+
+		if conflictHash, exists := m.nullifiers[key]; exists {
+			return fmt.Errorf("nullifier already spent by mempool transaction %s", conflictHash.String())
+		}
+	}
 	return nil
 }
 
+// AddStemTransaction adds a transaction to the Dandelion stem pool. Stem
+// transactions are not served to peers or mined until FluffTransaction
+// moves them to the public pool, and must not conflict with either pool.
+func (m *Mempool) AddStemTransaction(tx *wire.MsgTx, height int32, fee int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.stem) >= MaxStemPoolSize {
+		return fmt.Errorf("stem pool is full")
+	}
+
+	txHash := tx.TxHash()
+	if _, exists := m.pool[txHash]; exists {
+		return fmt.Errorf("transaction already in mempool")
+	}
+	if _, exists := m.stem[txHash]; exists {
+		return fmt.Errorf("transaction already in stem pool")
+	}
+
+	if err := m.checkNullifiersLocked(tx); err != nil {
+		return err
+	}
+	for _, txIn := range tx.TxIn {
+		if conflictHash, exists := m.outpoints[txIn.PreviousOutPoint]; exists {
+			return fmt.Errorf("input already spent by mempool transaction %s", conflictHash.String())
+		}
+	}
+	for hash, desc := range m.stem {
+		if conflicts(tx, desc.Tx) {
+			return fmt.Errorf("conflicts with stem transaction %s", hash.String())
+		}
+	}
+
+	m.stem[txHash] = &TxDesc{
+		Tx:       tx,
+		Added:    time.Now(),
+		Height:   height,
+		Fee:      fee,
+		FeePerKB: calculateFeePerKB(tx, fee),
+	}
+	return nil
+}
+
+// FluffTransaction moves a stem transaction into the public pool.
+func (m *Mempool) FluffTransaction(txHash wire.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	txDesc, exists := m.stem[txHash]
+	if !exists {
+		return fmt.Errorf("transaction not found in stem pool")
+	}
+	delete(m.stem, txHash)
+	return m.addTransactionLocked(txDesc)
+}
+
+// GetStemTransaction retrieves a transaction from the stem pool
+func (m *Mempool) GetStemTransaction(txHash wire.Hash) (*wire.MsgTx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	txDesc, exists := m.stem[txHash]
+	if !exists {
+		return nil, fmt.Errorf("transaction not found in stem pool")
+	}
+
+	return txDesc.Tx, nil
+}
+
+// HasStemTransaction checks if a transaction exists in the stem pool
+func (m *Mempool) HasStemTransaction(txHash wire.Hash) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, exists := m.stem[txHash]
+	return exists
+}
+
+// StemCount returns the number of transactions in the stem pool
+func (m *Mempool) StemCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.stem)
+}
+
 // RemoveTransaction removes a transaction from the mempool
 func (m *Mempool) RemoveTransaction(txHash wire.Hash) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	delete(m.stem, txHash)
+
 	txDesc, exists := m.pool[txHash]
 	if !exists {
 		return
@@ -106,6 +246,11 @@ func (m *Mempool) RemoveTransaction(txHash wire.Hash) {
 		delete(m.outpoints, txIn.PreviousOutPoint)
 	}
 
+	// Remove nullifier indexes
+	for _, spend := range txDesc.Tx.ShieldedSpends {
+		delete(m.nullifiers, string(spend.Nullifier))
+	}
+
 	// Remove from pool
 	delete(m.pool, txHash)
 }
@@ -188,7 +333,17 @@ func (m *Mempool) IsSpent(outpoint wire.OutPoint) bool {
 	return exists
 }
 
-// RemoveDoubleSpends removes transactions that spend the same inputs
+// HasNullifier checks if a nullifier is revealed by a transaction in the mempool
+func (m *Mempool) HasNullifier(nf []byte) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, exists := m.nullifiers[string(nf)]
+	return exists
+}
+
+// RemoveDoubleSpends removes transactions that spend the same inputs or
+// reveal the same nullifiers
 func (m *Mempool) RemoveDoubleSpends(tx *wire.MsgTx) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -198,6 +353,18 @@ func (m *Mempool) RemoveDoubleSpends(tx *wire.MsgTx) {
 			m.removeTransactionLocked(conflictHash)
 		}
 	}
+
+	for _, spend := range tx.ShieldedSpends {
+		if conflictHash, exists := m.nullifiers[string(spend.Nullifier)]; exists {
+			m.removeTransactionLocked(conflictHash)
+		}
+	}
+
+	for hash, desc := range m.stem {
+		if conflicts(tx, desc.Tx) {
+			delete(m.stem, hash)
+		}
+	}
 }
 
 // removeTransactionLocked removes a transaction without acquiring the lock
@@ -212,6 +379,11 @@ func (m *Mempool) removeTransactionLocked(txHash wire.Hash) {
 		delete(m.outpoints, txIn.PreviousOutPoint)
 	}
 
+	// Remove nullifier indexes
+	for _, spend := range txDesc.Tx.ShieldedSpends {
+		delete(m.nullifiers, string(spend.Nullifier))
+	}
+
 	// Remove from pool
 	delete(m.pool, txHash)
 }
@@ -307,10 +479,32 @@ func (m *Mempool) Reset() {
 	m.pool = make(map[wire.Hash]*TxDesc)
 	m.orphans = make(map[wire.Hash]*TxDesc)
 	m.outpoints = make(map[wire.OutPoint]wire.Hash)
+	m.nullifiers = make(map[string]wire.Hash)
+	m.stem = make(map[wire.Hash]*TxDesc)
 }
 
 // Helper functions
 
+// conflicts reports whether two transactions spend a common outpoint or
+// reveal a common nullifier
+func conflicts(a, b *wire.MsgTx) bool {
+	for _, inA := range a.TxIn {
+		for _, inB := range b.TxIn {
+			if inA.PreviousOutPoint == inB.PreviousOutPoint {
+				return true
+			}
+		}
+	}
+	for _, spendA := range a.ShieldedSpends {
+		for _, spendB := range b.ShieldedSpends {
+			if bytes.Equal(spendA.Nullifier, spendB.Nullifier) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func calculateFeePerKB(tx *wire.MsgTx, fee int64) int64 {
 	// Estimate transaction size (simplified)
 	size := estimateTxSize(tx)
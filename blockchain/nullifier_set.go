@@ -0,0 +1,248 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+	"obsidian-core/wire"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// nullifierBucketName maps nullifier -> revealing block hash (32) + height (4)
+	nullifierBucketName = []byte("nullifiers")
+
+	// blockNullifierBucketName maps block hash -> concatenated nullifiers
+	// revealed by that block, so they can be removed on disconnect
+	blockNullifierBucketName = []byte("blocknullifiers")
+
+	// supplyBucketName maps height (4, big-endian so entries sort by
+	// height) + block hash -> the block's shielded supply delta, so the
+	// turnstile survives restarts
+	supplyBucketName = []byte("shieldedsupply")
+)
+
+// NullifierSet is the persistent set of spent shielded note nullifiers,
+// indexed by the block that revealed them
+type NullifierSet struct {
+	db *bolt.DB
+	mu sync.RWMutex
+}
+
+// NewNullifierSet creates a new nullifier set
+func NewNullifierSet(db *bolt.DB) *NullifierSet {
+	return &NullifierSet{
+		db: db,
+	}
+}
+
+// HasNullifier checks if a nullifier has been revealed on chain
+func (n *NullifierSet) HasNullifier(nf []byte) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	exists := false
+	n.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nullifierBucketName)
+		if bucket == nil {
+			return nil
+		}
+		exists = bucket.Get(nf) != nil
+		return nil
+	})
+
+	return exists
+}
+
+// GetNullifierBlock returns the hash and height of the block that revealed
+// a nullifier
+func (n *NullifierSet) GetNullifierBlock(nf []byte) (wire.Hash, int32, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var blockHash wire.Hash
+	var height int32
+	err := n.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nullifierBucketName)
+		if bucket == nil {
+			return fmt.Errorf("nullifier bucket not found")
+		}
+
+		data := bucket.Get(nf)
+		if data == nil {
+			return fmt.Errorf("nullifier not found")
+		}
+		if len(data) != 32+4 {
+			return fmt.Errorf("invalid nullifier entry")
+		}
+
+		copy(blockHash[:], data[:32])
+		height = int32(binary.LittleEndian.Uint32(data[32:]))
+		return nil
+	})
+
+	return blockHash, height, err
+}
+
+// ConnectBlock adds every nullifier revealed by a block. The update is
+// atomic: if any nullifier is already spent, nothing is written.
+func (n *NullifierSet) ConnectBlock(blockHash wire.Hash, height int32, txs []*wire.MsgTx) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(nullifierBucketName)
+		if err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists(blockNullifierBucketName)
+		if err != nil {
+			return err
+		}
+
+		entry := make([]byte, 32+4)
+		copy(entry[:32], blockHash[:])
+		binary.LittleEndian.PutUint32(entry[32:], uint32(height))
+
+		revealed := make([]byte, 0)
+		for _, msgTx := range txs {
+			for _, spend := range msgTx.ShieldedSpends {
+				if len(spend.Nullifier) != wire.NullifierSize {
+					return fmt.Errorf("invalid nullifier size")
+				}
+				if bucket.Get(spend.Nullifier) != nil {
+					return wire.ErrInvalidNullifier
+				}
+				if err := bucket.Put(spend.Nullifier, entry); err != nil {
+					return err
+				}
+				revealed = append(revealed, spend.Nullifier...)
+			}
+		}
+
+		if len(revealed) == 0 {
+			return nil
+		}
+
+		return index.Put(blockHash[:], revealed)
+	})
+}
+
+// DisconnectBlock removes every nullifier revealed by a block, making the
+// notes they spent unspent again
+func (n *NullifierSet) DisconnectBlock(blockHash wire.Hash) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(blockNullifierBucketName)
+		if index == nil {
+			return nil // Nothing was ever connected
+		}
+
+		revealed := index.Get(blockHash[:])
+		if revealed == nil {
+			return nil // Block had no shielded spends
+		}
+
+		bucket := tx.Bucket(nullifierBucketName)
+		if bucket == nil {
+			return fmt.Errorf("nullifier bucket not found")
+		}
+
+		for offset := 0; offset+wire.NullifierSize <= len(revealed); offset += wire.NullifierSize {
+			if err := bucket.Delete(revealed[offset : offset+wire.NullifierSize]); err != nil {
+				return err
+			}
+		}
+
+		return index.Delete(blockHash[:])
+	})
+}
+
+// Count returns the number of spent nullifiers
+func (n *NullifierSet) Count() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	count := 0
+	n.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nullifierBucketName)
+		if bucket == nil {
+			return nil
+		}
+		count = bucket.Stats().KeyN
+		return nil
+	})
+
+	return count
+}
+
+// supplyKey returns the supply bucket key of a block
+func supplyKey(height int32, hash wire.Hash) []byte {
+	key := binary.BigEndian.AppendUint32(nil, uint32(height))
+	return append(key, hash[:]...)
+}
+
+// PutSupplyDelta stores the shielded supply delta of a connected block
+func (n *NullifierSet) PutSupplyDelta(delta *ShieldedSupplyDelta) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	data := make([]byte, 0, 4*8)
+	for _, v := range []int64{delta.Shielded, delta.Unshielded, delta.Net, delta.TotalShielded} {
+		data = binary.LittleEndian.AppendUint64(data, uint64(v))
+	}
+	return n.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(supplyBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(supplyKey(delta.Height, delta.Hash), data)
+	})
+}
+
+// DeleteSupplyDelta removes the shielded supply delta of a disconnected block
+func (n *NullifierSet) DeleteSupplyDelta(height int32, hash wire.Hash) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(supplyBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(supplyKey(height, hash))
+	})
+}
+
+// SupplyHistory returns the stored shielded supply deltas by height
+func (n *NullifierSet) SupplyHistory() ([]*ShieldedSupplyDelta, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	history := make([]*ShieldedSupplyDelta, 0)
+	err := n.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(supplyBucketName)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, data []byte) error {
+			if len(key) != 4+32 || len(data) != 4*8 {
+				return fmt.Errorf("invalid shielded supply entry")
+			}
+			delta := &ShieldedSupplyDelta{
+				Height:        int32(binary.BigEndian.Uint32(key)),
+				Shielded:      int64(binary.LittleEndian.Uint64(data)),
+				Unshielded:    int64(binary.LittleEndian.Uint64(data[8:])),
+				Net:           int64(binary.LittleEndian.Uint64(data[16:])),
+				TotalShielded: int64(binary.LittleEndian.Uint64(data[24:])),
+			}
+			copy(delta.Hash[:], key[4:])
+			history = append(history, delta)
+			return nil
+		})
+	})
+	return history, err
+}
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"obsidian-core/smartcontract"
+	"obsidian-core/wire"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// contractReceiptBucket maps transaction hash -> ContractExecution
+	contractReceiptBucket = []byte("contractreceipts")
+
+	// contractLogBucket maps height || transaction hash || log index ->
+	// ContractLog, so logs can be scanned by height range
+	contractLogBucket = []byte("contractlogs")
+)
+
+// ContractLog is an event emitted by a confirmed contract transaction
+type ContractLog struct {
+	TxHash   wire.Hash
+	Height   int32
+	Index    int // Position among the transaction's logs
+	Contract string
+	Topic    string
+	Data     smartcontract.Value
+}
+
+// LogFilter selects logs by height range, contract and topic. Empty
+// fields match everything.
+type LogFilter struct {
+	FromHeight int32
+	ToHeight   int32 // Inclusive; 0 means the chain tip
+	Contract   string
+	Topic      string
+}
+
+// Matches reports whether log passes the contract and topic filters
+func (f *LogFilter) Matches(log *ContractLog) bool {
+	return (f.Contract == "" || log.Contract == f.Contract) &&
+		(f.Topic == "" || log.Topic == f.Topic)
+}
+
+// logKey is the index key of a log
+func logKey(height int32, txHash wire.Hash, index int) []byte {
+	key := binary.BigEndian.AppendUint32(nil, uint32(height))
+	key = append(key, txHash[:]...)
+	return binary.BigEndian.AppendUint32(key, uint32(index))
+}
+
+// saveReceipt stores the receipt of a confirmed contract transaction and
+// indexes its logs
+func (b *BlockChain) saveReceipt(exec *ContractExecution) error {
+	receipt := *exec
+	receipt.Changes = nil // Undo data is kept per block
+	for i := range receipt.Logs {
+		receipt.Logs[i].TxHash = exec.TxHash
+		receipt.Logs[i].Height = exec.Height
+		receipt.Logs[i].Index = i
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&receipt); err != nil {
+		return fmt.Errorf("failed to encode receipt: %v", err)
+	}
+
+	return b.db.DB().Update(func(tx *bolt.Tx) error {
+		receipts, err := tx.CreateBucketIfNotExists(contractReceiptBucket)
+		if err != nil {
+			return err
+		}
+		if err := receipts.Put(exec.TxHash[:], buf.Bytes()); err != nil {
+			return err
+		}
+
+		logs, err := tx.CreateBucketIfNotExists(contractLogBucket)
+		if err != nil {
+			return err
+		}
+		for i := range receipt.Logs {
+			log := &receipt.Logs[i]
+			var data bytes.Buffer
+			if err := gob.NewEncoder(&data).Encode(log); err != nil {
+				return fmt.Errorf("failed to encode log: %v", err)
+			}
+			if err := logs.Put(logKey(log.Height, log.TxHash, log.Index), data.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteReceipt removes the receipt and logs of a disconnected transaction
+func (b *BlockChain) deleteReceipt(txHash wire.Hash) error {
+	exec, err := b.GetContractExecution(txHash)
+	if err != nil {
+		return nil // Never executed
+	}
+
+	return b.db.DB().Update(func(tx *bolt.Tx) error {
+		if logs := tx.Bucket(contractLogBucket); logs != nil {
+			for i := range exec.Logs {
+				if err := logs.Delete(logKey(exec.Height, txHash, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(contractReceiptBucket).Delete(txHash[:])
+	})
+}
+
+// GetContractExecution returns the receipt of a confirmed contract
+// transaction
+func (b *BlockChain) GetContractExecution(txHash wire.Hash) (*ContractExecution, error) {
+	var exec *ContractExecution
+	err := b.db.DB().View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(contractReceiptBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get(txHash[:])
+		if data == nil {
+			return nil
+		}
+
+		exec = &ContractExecution{}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(exec)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt for transaction %s: %v", txHash, err)
+	}
+	if exec == nil {
+		return nil, fmt.Errorf("no contract execution for transaction %s", txHash)
+	}
+	return exec, nil
+}
+
+// FilterLogs returns the logs matching filter in chain order
+func (b *BlockChain) FilterLogs(filter *LogFilter) ([]*ContractLog, error) {
+	to := filter.ToHeight
+	if to == 0 {
+		to = b.Height()
+	}
+	if filter.FromHeight < 0 || to < filter.FromHeight {
+		return nil, fmt.Errorf("invalid height range %d to %d", filter.FromHeight, to)
+	}
+
+	var matches []*ContractLog
+	err := b.db.DB().View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(contractLogBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		start := binary.BigEndian.AppendUint32(nil, uint32(filter.FromHeight))
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			if int32(binary.BigEndian.Uint32(k[:4])) > to {
+				break
+			}
+
+			log := &ContractLog{}
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(log); err != nil {
+				return fmt.Errorf("invalid log: %v", err)
+			}
+			if filter.Matches(log) {
+				matches = append(matches, log)
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
@@ -17,6 +17,9 @@ type ChainReorgResult struct {
 
 // MaybeReorg checks if a new block causes a chain reorganization
 func (b *BlockChain) MaybeReorg(newBlock *wire.MsgBlock, pow consensus.PowEngine) (*ChainReorgResult, error) {
+	b.connectMu.Lock()
+	defer b.connectMu.Unlock()
+
 	newBlockHash := newBlock.BlockHash()
 
 	// Calculate work for the new block's chain
@@ -85,10 +88,6 @@ func (b *BlockChain) reorganizeChain(newTip wire.Hash, pow consensus.PowEngine)
 		}
 	}
 
-	// Update chain tip
-	b.bestHash = newTip
-	b.height = b.height - int32(len(disconnectBlocks)) + int32(len(connectBlocks))
-
 	fmt.Printf("✅ Chain reorganization complete: new height %d, tip %s\n", b.height, newTip.String())
 
 	return result, nil
@@ -146,6 +145,17 @@ func (b *BlockChain) getBlocksBetween(start, end wire.Hash) ([]*wire.MsgBlock, e
 func (b *BlockChain) disconnectBlock(block *wire.MsgBlock) error {
 	fmt.Printf("⬅️  Disconnecting block at height %d\n", b.height)
 
+	// Only the tip can be disconnected
+	if tip, err := b.BlockHashByHeight(b.height); err != nil || tip != block.BlockHash() {
+		return fmt.Errorf("block %s is not the main chain tip", block.BlockHash())
+	}
+
+	// Contract transfers are undone first, as they may spend outputs of
+	// the block
+	if err := b.disconnectBlockContracts(block); err != nil {
+		return fmt.Errorf("failed to revert contract storage: %v", err)
+	}
+
 	// Rollback UTXO set
 	if err := b.utxoSet.RollbackBlock(block); err != nil {
 		return fmt.Errorf("failed to rollback UTXO set: %v", err)
@@ -167,8 +177,22 @@ func (b *BlockChain) disconnectBlock(block *wire.MsgBlock) error {
 			}
 		}
 	}
+	if err := b.shieldedPool.DisconnectBlockNullifiers(block.BlockHash()); err != nil {
+		return fmt.Errorf("failed to remove nullifiers: %v", err)
+	}
+	if err := b.shieldedPool.RemoveBlockSupply(block.BlockHash()); err != nil {
+		return fmt.Errorf("failed to remove shielded supply: %v", err)
+	}
 
+	b.chainMu.Lock()
+	b.bestHash = block.Header.PrevBlock
 	b.height--
+	b.popMainChain()
+	b.chainMu.Unlock()
+
+	if b.cfIndex != nil {
+		b.cfIndex.blockDisconnected(b.height + 1)
+	}
 
 	return nil
 }
@@ -197,32 +221,37 @@ func (b *BlockChain) connectBlock(block *wire.MsgBlock, pow consensus.PowEngine)
 		}
 	}
 
-	// Apply UTXO changes
-	if err := b.utxoSet.ApplyBlock(block, b.height+1); err != nil {
-		return fmt.Errorf("failed to apply UTXO changes: %v", err)
+	// Check the shielded pool turnstile
+	if err := b.shieldedPool.CheckTurnstile(block.Transactions); err != nil {
+		return fmt.Errorf("invalid shielded value flow: %v", err)
 	}
 
-	// Remove transactions from mempool
-	for _, tx := range block.Transactions {
-		txHash := tx.TxHash()
-		b.mempool.RemoveTransaction(txHash)
+	// Contract gas must fit within the block gas limit
+	if err := b.validateBlockGas(block); err != nil {
+		return fmt.Errorf("invalid contract gas: %v", err)
 	}
 
-	// Process shielded transactions
-	for _, tx := range block.Transactions {
-		if tx.IsShielded() {
-			if err := b.shieldedPool.ProcessShieldedTransaction(tx); err != nil {
-				return fmt.Errorf("failed to process shielded transaction: %v", err)
-			}
-		}
+	// Apply the block's state changes and save it
+	if err := b.applyBlockState(block, b.height+1); err != nil {
+		return err
 	}
 
-	// Save block
-	if err := b.db.SaveBlock(block); err != nil {
-		return fmt.Errorf("failed to save block: %v", err)
+	// Remove transactions and conflicting spends from mempool
+	for _, tx := range block.Transactions {
+		txHash := tx.TxHash()
+		b.mempool.RemoveTransaction(txHash)
+		b.mempool.RemoveDoubleSpends(tx)
 	}
 
+	b.chainMu.Lock()
+	b.bestHash = blockHash
 	b.height++
+	b.extendMainChain(blockHash)
+	b.chainMu.Unlock()
+
+	if b.cfIndex != nil {
+		b.cfIndex.blockConnected(block, b.height)
+	}
 
 	return nil
 }
@@ -245,9 +274,6 @@ func (b *BlockChain) rollbackReorg(result *ChainReorgResult) {
 			fmt.Printf("❌ Failed to reconnect block: %v\n", err)
 		}
 	}
-
-	// Restore original chain tip
-	b.bestHash = result.OldChainTip
 }
 
 // calculateChainWork calculates the total work for a chain ending at the given block
@@ -0,0 +1,627 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math"
+	"obsidian-core/crypto"
+	"obsidian-core/wire"
+	"sort"
+)
+
+// ShieldedTxBuilder assembles and signs transactions between transparent and
+// shielded addresses, covering the four flows t->t, t->z, z->z and z->t.
+//
+// Funds are selected from the UTXOs of the added transparent keys and the
+// unspent notes of the added spending keys. Shielded outputs carry notes
+// and memos encrypted to the recipient, and change goes to the change
+// address or, by default, back to the first source that was spent from.
+type ShieldedTxBuilder struct {
+	chain *BlockChain
+
+	fee          int64
+	expiryHeight uint32
+	coinbaseOnly bool
+
+	// Sources of funds
+	transparentKeys []*ecdsa.PrivateKey
+	spendingKeys    []*wire.ShieldedSpendingKey
+
+	// Destinations
+	transparentOutputs []*wire.TxOut
+	shieldedOutputs    []*shieldedRecipient
+	sweepAddress       string
+	sweepMemo          []byte
+	changeAddress      string
+
+	// Contract deployment or call carried in the memo
+	contractType wire.TxType
+	contractData []byte
+	gasLimit     uint64
+	gasPrice     int64
+
+	// Keys of the last built transaction, for payment disclosures
+	disclosureKeys *PaymentDisclosureKeys
+}
+
+// PaymentDisclosureKeys are the secrets needed to disclose the shielded
+// outputs of a built transaction: the binding signing key and the outgoing
+// cipher key of each shielded output
+type PaymentDisclosureKeys struct {
+	Bsk  []byte
+	Ocks [][]byte
+}
+
+// shieldedRecipient is a shielded output waiting to be built
+type shieldedRecipient struct {
+	addr    *wire.ShieldedAddress
+	value   int64
+	memo    []byte
+	tokenID wire.Hash // Zero hash for OB
+}
+
+// builderUTXO is a transparent output selected for spending
+type builderUTXO struct {
+	utxo *UTXO
+	key  *ecdsa.PrivateKey
+}
+
+// builderNote is a shielded note selected for spending
+type builderNote struct {
+	note *ShieldedNote
+	key  *wire.ShieldedSpendingKey
+}
+
+// NewShieldedTxBuilder creates a builder paying the chain's minimum fee
+func NewShieldedTxBuilder(chain *BlockChain) *ShieldedTxBuilder {
+	return &ShieldedTxBuilder{
+		chain: chain,
+		fee:   chain.params.MinTxFee,
+	}
+}
+
+// SetFee sets the transaction fee in satoshis
+func (tb *ShieldedTxBuilder) SetFee(fee int64) {
+	tb.fee = fee
+}
+
+// SetExpiryHeight sets the height after which the transaction expires
+func (tb *ShieldedTxBuilder) SetExpiryHeight(height uint32) {
+	tb.expiryHeight = height
+}
+
+// SetCoinbaseOnly restricts transparent inputs to coinbase outputs
+func (tb *ShieldedTxBuilder) SetCoinbaseOnly(coinbaseOnly bool) {
+	tb.coinbaseOnly = coinbaseOnly
+}
+
+// AddTransparentSource adds a key whose UTXOs may fund the transaction
+func (tb *ShieldedTxBuilder) AddTransparentSource(key *ecdsa.PrivateKey) {
+	tb.transparentKeys = append(tb.transparentKeys, key)
+}
+
+// AddShieldedSource adds a spending key whose notes may fund the transaction
+func (tb *ShieldedTxBuilder) AddShieldedSource(key *wire.ShieldedSpendingKey) {
+	tb.spendingKeys = append(tb.spendingKeys, key)
+}
+
+// AddressType classifies address like crypto.GetAddressType, recognizing
+// shielded addresses by parsing them since they carry no string prefix
+func AddressType(address string) crypto.AddressType {
+	if wire.IsShieldedAddress(address) {
+		return crypto.AddressTypeShielded
+	}
+	if addrType := crypto.GetAddressType(address); addrType != crypto.AddressTypeShielded {
+		return addrType
+	}
+	return crypto.AddressTypeUnknown
+}
+
+// AddOutput pays value to a transparent or shielded address. Memos can only
+// be attached to shielded outputs.
+func (tb *ShieldedTxBuilder) AddOutput(address string, value int64, memo []byte) error {
+	if value <= 0 {
+		return fmt.Errorf("output amount must be positive")
+	}
+
+	switch AddressType(address) {
+	case crypto.AddressTypeTransparent:
+		if len(memo) > 0 {
+			return fmt.Errorf("memos can only be sent to shielded addresses")
+		}
+		pkScript, err := payToAddressScript(address)
+		if err != nil {
+			return err
+		}
+		tb.transparentOutputs = append(tb.transparentOutputs, &wire.TxOut{
+			Value:    value,
+			PkScript: pkScript,
+		})
+
+	case crypto.AddressTypeContract:
+		// Value attached to a contract call
+		if len(memo) > 0 {
+			return fmt.Errorf("memos can only be sent to shielded addresses")
+		}
+		tb.transparentOutputs = append(tb.transparentOutputs, &wire.TxOut{
+			Value:    value,
+			PkScript: []byte(address),
+		})
+
+	case crypto.AddressTypeShielded:
+		if len(memo) > 512 {
+			return wire.ErrMemoTooLarge
+		}
+		addr, err := wire.ParseShieldedAddress(address)
+		if err != nil {
+			return err
+		}
+		tb.shieldedOutputs = append(tb.shieldedOutputs, &shieldedRecipient{
+			addr:  addr,
+			value: value,
+			memo:  memo,
+		})
+
+	default:
+		return fmt.Errorf("invalid address: %s", address)
+	}
+
+	return nil
+}
+
+// AddTokenOutput pays value of a token to a shielded address. Token outputs
+// are funded by notes of the same token, and token change goes back to the
+// shielded change address or the first note spent.
+func (tb *ShieldedTxBuilder) AddTokenOutput(address string, tokenID wire.Hash, value int64, memo []byte) error {
+	if tokenID == (wire.Hash{}) {
+		return tb.AddOutput(address, value, memo)
+	}
+	if value <= 0 {
+		return fmt.Errorf("output amount must be positive")
+	}
+	if !wire.IsShieldedAddress(address) {
+		return fmt.Errorf("tokens can only be sent to shielded addresses")
+	}
+	if len(memo) > 512 {
+		return wire.ErrMemoTooLarge
+	}
+	addr, err := wire.ParseShieldedAddress(address)
+	if err != nil {
+		return err
+	}
+
+	tb.shieldedOutputs = append(tb.shieldedOutputs, &shieldedRecipient{
+		addr:    addr,
+		value:   value,
+		memo:    memo,
+		tokenID: tokenID,
+	})
+	return nil
+}
+
+// SweepTo spends every eligible UTXO and OB note of the sources and sends
+// the total, less outputs and fee, to address
+func (tb *ShieldedTxBuilder) SweepTo(address string, memo []byte) error {
+	if AddressType(address) == crypto.AddressTypeUnknown {
+		return fmt.Errorf("invalid address: %s", address)
+	}
+	if crypto.IsTransparentAddress(address) && len(memo) > 0 {
+		return fmt.Errorf("memos can only be sent to shielded addresses")
+	}
+
+	tb.sweepAddress = address
+	tb.sweepMemo = memo
+	return nil
+}
+
+// SetChangeAddress sets where change is sent
+func (tb *ShieldedTxBuilder) SetChangeAddress(address string) error {
+	if AddressType(address) == crypto.AddressTypeUnknown {
+		return fmt.Errorf("invalid change address: %s", address)
+	}
+
+	tb.changeAddress = address
+	return nil
+}
+
+// SetContractPayload makes the transaction a contract deployment or call
+// carrying data in its memo. The fee becomes the prepaid gas, gasLimit times
+// gasPrice. Contract transactions are funded by transparent sources only, and
+// the deployer is the owner of the first input.
+func (tb *ShieldedTxBuilder) SetContractPayload(txType wire.TxType, data []byte, gasLimit uint64, gasPrice int64) error {
+	if txType != wire.TxTypeSmartContractDeploy && txType != wire.TxTypeSmartContractCall {
+		return fmt.Errorf("transaction type %d is not a contract transaction", txType)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("contract transaction requires data")
+	}
+	if gasPrice <= 0 {
+		return fmt.Errorf("gas price must be positive, got %d", gasPrice)
+	}
+	if gasLimit > uint64(math.MaxInt64/gasPrice) {
+		return fmt.Errorf("gas limit %d at price %d overflows the fee", gasLimit, gasPrice)
+	}
+
+	tb.contractType = txType
+	tb.contractData = data
+	tb.gasLimit = gasLimit
+	tb.gasPrice = gasPrice
+	tb.fee = int64(gasLimit) * gasPrice
+	return nil
+}
+
+// DisclosureKeys returns the payment disclosure keys of the last transaction
+// built, or nil if it had no shielded outputs
+func (tb *ShieldedTxBuilder) DisclosureKeys() *PaymentDisclosureKeys {
+	return tb.disclosureKeys
+}
+
+// Build selects inputs, creates the outputs and change, and returns the
+// fully signed transaction
+func (tb *ShieldedTxBuilder) Build() (*wire.MsgTx, error) {
+	if len(tb.transparentOutputs) == 0 && len(tb.shieldedOutputs) == 0 && tb.sweepAddress == "" &&
+		tb.contractData == nil {
+		return nil, fmt.Errorf("transaction has no outputs")
+	}
+	if tb.contractData != nil && (len(tb.spendingKeys) > 0 || len(tb.shieldedOutputs) > 0 ||
+		wire.IsShieldedAddress(tb.sweepAddress) || wire.IsShieldedAddress(tb.changeAddress)) {
+		return nil, fmt.Errorf("contract transactions must be fully transparent")
+	}
+	for _, out := range tb.transparentOutputs {
+		if crypto.IsContractAddress(string(out.PkScript)) && tb.contractType != wire.TxTypeSmartContractCall {
+			return nil, fmt.Errorf("only contract calls can pay contract %s", out.PkScript)
+		}
+	}
+	if tb.fee < 0 {
+		return nil, fmt.Errorf("negative fee")
+	}
+
+	// OB covers the fee and OB outputs; each token is balanced on its own
+	target := tb.fee
+	for _, out := range tb.transparentOutputs {
+		target += out.Value
+	}
+	var tokens []wire.Hash
+	tokenTargets := make(map[wire.Hash]int64)
+	for _, out := range tb.shieldedOutputs {
+		if out.tokenID == (wire.Hash{}) {
+			target += out.value
+			continue
+		}
+		if _, ok := tokenTargets[out.tokenID]; !ok {
+			tokens = append(tokens, out.tokenID)
+		}
+		tokenTargets[out.tokenID] += out.value
+	}
+
+	utxos, notes, err := tb.candidates()
+	if err != nil {
+		return nil, err
+	}
+
+	// Select inputs: everything when sweeping, otherwise notes before UTXOs,
+	// largest first, until the target is covered
+	var selectedUTXOs []*builderUTXO
+	var selectedNotes []*builderNote
+	var total int64
+	for _, n := range notes {
+		if n.note.Note.TokenID != (wire.Hash{}) {
+			continue
+		}
+		if tb.sweepAddress == "" && total >= target {
+			break
+		}
+		selectedNotes = append(selectedNotes, n)
+		total += n.note.Note.Value
+	}
+	for _, u := range utxos {
+		if tb.sweepAddress == "" && total >= target {
+			break
+		}
+		selectedUTXOs = append(selectedUTXOs, u)
+		total += u.utxo.Value
+	}
+
+	if total < target || (tb.sweepAddress != "" && total == target) {
+		return nil, fmt.Errorf("insufficient funds: have %d, need %d", total, target)
+	}
+
+	// Leftover value goes to the sweep destination or back as change
+	transparentOutputs := append([]*wire.TxOut(nil), tb.transparentOutputs...)
+	shieldedOutputs := append([]*shieldedRecipient(nil), tb.shieldedOutputs...)
+	if remainder := total - target; remainder > 0 {
+		address, memo := tb.sweepAddress, tb.sweepMemo
+		if address == "" {
+			address, memo = tb.changeAddress, nil
+			if address == "" {
+				address = defaultChangeAddress(selectedUTXOs, selectedNotes)
+			}
+		}
+
+		if wire.IsShieldedAddress(address) {
+			addr, err := wire.ParseShieldedAddress(address)
+			if err != nil {
+				return nil, err
+			}
+			shieldedOutputs = append(shieldedOutputs, &shieldedRecipient{addr: addr, value: remainder, memo: memo})
+		} else {
+			pkScript, err := payToAddressScript(address)
+			if err != nil {
+				return nil, err
+			}
+			transparentOutputs = append(transparentOutputs, &wire.TxOut{Value: remainder, PkScript: pkScript})
+		}
+	}
+
+	for _, tokenID := range tokens {
+		spent, change, err := tb.selectTokenNotes(notes, tokenID, tokenTargets[tokenID])
+		if err != nil {
+			return nil, err
+		}
+		selectedNotes = append(selectedNotes, spent...)
+		if change != nil {
+			shieldedOutputs = append(shieldedOutputs, change)
+		}
+	}
+
+	return tb.assemble(selectedUTXOs, selectedNotes, transparentOutputs, shieldedOutputs)
+}
+
+// selectTokenNotes selects notes of a token, largest first, until they cover
+// target, and returns them with the change output for any excess
+func (tb *ShieldedTxBuilder) selectTokenNotes(notes []*builderNote, tokenID wire.Hash, target int64) ([]*builderNote, *shieldedRecipient, error) {
+	var selected []*builderNote
+	var total int64
+	for _, n := range notes {
+		if total >= target {
+			break
+		}
+		if n.note.Note.TokenID == tokenID {
+			selected = append(selected, n)
+			total += n.note.Note.Value
+		}
+	}
+	if total < target {
+		return nil, nil, fmt.Errorf("insufficient funds of token %s: have %d, need %d", tokenID, total, target)
+	}
+	if total == target {
+		return selected, nil, nil
+	}
+
+	addr := selected[0].key.Address()
+	if wire.IsShieldedAddress(tb.changeAddress) {
+		var err error
+		if addr, err = wire.ParseShieldedAddress(tb.changeAddress); err != nil {
+			return nil, nil, err
+		}
+	}
+	return selected, &shieldedRecipient{addr: addr, value: total - target, tokenID: tokenID}, nil
+}
+
+// candidates returns the spendable UTXOs and notes of the sources, largest
+// first, skipping any already spent by a mempool transaction
+func (tb *ShieldedTxBuilder) candidates() ([]*builderUTXO, []*builderNote, error) {
+	mempool := tb.chain.mempool
+
+	utxos := make([]*builderUTXO, 0)
+	for _, key := range tb.transparentKeys {
+		address := crypto.KeyToAddress(&key.PublicKey)
+		found, err := tb.chain.utxoSet.GetUTXOsForAddress(address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load UTXOs for %s: %v", address, err)
+		}
+
+		for _, utxo := range found {
+			if tb.coinbaseOnly && !utxo.Coinbase {
+				continue
+			}
+			if mempool.IsSpent(wire.OutPoint{Hash: utxo.TxHash, Index: utxo.Index}) {
+				continue
+			}
+			utxos = append(utxos, &builderUTXO{utxo: utxo, key: key})
+		}
+	}
+
+	notes := make([]*builderNote, 0)
+	for _, key := range tb.spendingKeys {
+		for _, note := range tb.chain.shieldedPool.ScanNotes(key) {
+			if mempool.HasNullifier(note.Nullifier) {
+				continue
+			}
+			notes = append(notes, &builderNote{note: note, key: key})
+		}
+	}
+
+	sort.SliceStable(utxos, func(i, j int) bool { return utxos[i].utxo.Value > utxos[j].utxo.Value })
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].note.Note.Value > notes[j].note.Note.Value })
+
+	return utxos, notes, nil
+}
+
+// assemble builds the shielded parts and signs the transaction
+func (tb *ShieldedTxBuilder) assemble(utxos []*builderUTXO, notes []*builderNote,
+	transparentOutputs []*wire.TxOut, shieldedOutputs []*shieldedRecipient) (*wire.MsgTx, error) {
+
+	tb.disclosureKeys = nil
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.ExpiryHeight = tb.expiryHeight
+
+	for _, u := range utxos {
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Hash: u.utxo.TxHash, Index: u.utxo.Index},
+			Sequence:         0xffffffff,
+		})
+	}
+	for _, out := range transparentOutputs {
+		tx.AddTxOut(out)
+	}
+
+	var spendTrapdoors, outputTrapdoors, alphas, ocks [][]byte
+	var valueBalance int64
+
+	// Shielded spends
+	anchor := tb.chain.shieldedPool.GetMerkleRoot()
+	for _, n := range notes {
+		rcv, err := wire.GenerateValueCommitTrapdoor()
+		if err != nil {
+			return nil, err
+		}
+		cv, err := wire.CommitValue(n.note.Note.Value, n.note.Note.TokenID, rcv)
+		if err != nil {
+			return nil, err
+		}
+		alpha, err := wire.GenerateSpendAuthRandomizer()
+		if err != nil {
+			return nil, err
+		}
+		rk, err := n.key.RandomizedKey(alpha)
+		if err != nil {
+			return nil, err
+		}
+		proof, err := wire.GenerateProof(n.note.Note, n.key.NullifierKey())
+		if err != nil {
+			return nil, err
+		}
+
+		tx.AddShieldedSpend(&wire.ShieldedSpend{
+			Cv:        cv,
+			Anchor:    anchor,
+			Nullifier: n.note.Nullifier,
+			Rk:        rk,
+			Proof:     proof,
+			TokenID:   n.note.Note.TokenID,
+		})
+		spendTrapdoors = append(spendTrapdoors, rcv)
+		alphas = append(alphas, alpha)
+		if n.note.Note.TokenID == (wire.Hash{}) {
+			valueBalance += n.note.Note.Value
+		}
+	}
+
+	// Shielded outputs, recoverable by the sender through its outgoing
+	// viewing key. Outputs funded only by transparent inputs have no
+	// sender ovk and use a random one.
+	var ovk []byte
+	if len(notes) > 0 {
+		ovk = notes[0].key.OutgoingViewingKey()
+	} else {
+		random, err := wire.GenerateValueCommitTrapdoor()
+		if err != nil {
+			return nil, err
+		}
+		ovk = random
+	}
+
+	for _, out := range shieldedOutputs {
+		output, rcv, err := buildShieldedOutput(out, ovk)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddShieldedOutput(output)
+		outputTrapdoors = append(outputTrapdoors, rcv)
+		ocks = append(ocks, wire.OutgoingCipherKey(ovk, output.Cv, output.Cmu, output.EphemeralKey))
+		if out.tokenID == (wire.Hash{}) {
+			valueBalance -= out.value
+		}
+	}
+	tx.ValueBalance = valueBalance
+
+	switch {
+	case len(tx.ShieldedSpends) == 0 && len(tx.ShieldedOutputs) == 0:
+		tx.TxType = wire.TxTypeTransparent
+	case len(tx.TxIn) == 0 && len(tx.TxOut) == 0:
+		tx.TxType = wire.TxTypeShielded
+	default:
+		tx.TxType = wire.TxTypeMixed
+	}
+	if tb.contractData != nil {
+		tx.TxType = tb.contractType
+		tx.Memo = tb.contractData
+		tx.GasLimit = tb.gasLimit
+		tx.GasPrice = tb.gasPrice
+	}
+
+	// Shielded signatures cover every field except signature scripts, so
+	// they can be made before or after the transparent inputs are signed
+	if tx.IsShielded() {
+		bsk, err := wire.DeriveBindingKey(spendTrapdoors, outputTrapdoors)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SignBinding(bsk); err != nil {
+			return nil, fmt.Errorf("failed to create binding signature: %v", err)
+		}
+		if len(ocks) > 0 {
+			tb.disclosureKeys = &PaymentDisclosureKeys{Bsk: bsk, Ocks: ocks}
+		}
+		for i, n := range notes {
+			if err := tx.SignSpendAuth(i, n.key, alphas[i]); err != nil {
+				return nil, fmt.Errorf("failed to authorize spend %d: %v", i, err)
+			}
+		}
+	}
+
+	for i, u := range utxos {
+		if err := tb.chain.signInput(tx, i, u.utxo.PkScript, u.key); err != nil {
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
+
+// buildShieldedOutput creates an output carrying a note encrypted to the
+// recipient and returns it with its value commitment trapdoor
+func buildShieldedOutput(out *shieldedRecipient, ovk []byte) (*wire.ShieldedOutput, []byte, error) {
+	note, err := wire.CreateNote(out.value, out.addr.PublicKey, out.memo)
+	if err != nil {
+		return nil, nil, err
+	}
+	note.TokenID = out.tokenID
+	cv := note.ValueCommitment()
+	cmu := note.Commit().Cm
+
+	enc, err := wire.EncryptNoteToAddress(note, out.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outCiphertext, err := wire.EncryptOutgoing(ovk, cv, cmu, enc.EphemeralKey, out.addr.ViewingKey, enc.Esk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proof, err := wire.GenerateOutputProof(note)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &wire.ShieldedOutput{
+		Cv:            cv,
+		Cmu:           cmu,
+		EphemeralKey:  enc.EphemeralKey,
+		EncCiphertext: enc.EncCiphertext,
+		OutCiphertext: outCiphertext,
+		Proof:         proof,
+		TokenID:       out.tokenID,
+	}, note.ValueCommitTrapdoor(), nil
+}
+
+// defaultChangeAddress returns the address of the first source spent from,
+// preferring shielded so that change from a private spend stays private
+func defaultChangeAddress(utxos []*builderUTXO, notes []*builderNote) string {
+	if len(notes) > 0 {
+		return notes[0].key.Address().String()
+	}
+	return crypto.KeyToAddress(&utxos[0].key.PublicKey)
+}
+
+// payToAddressScript returns the P2PKH script paying to a transparent address
+func payToAddressScript(address string) ([]byte, error) {
+	pubKeyHash, err := crypto.AddressToPubKeyHash(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transparent address %s: %v", address, err)
+	}
+	return CreateP2PKHScript(pubKeyHash), nil
+}
@@ -0,0 +1,381 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"obsidian-core/chaincfg"
+	"obsidian-core/crypto"
+	"obsidian-core/wire"
+	"testing"
+)
+
+// confirmTx accepts tx into the mempool and then connects it in a block
+func confirmTx(t *testing.T, chain *BlockChain, tx *wire.MsgTx) {
+	if _, err := chain.AcceptTransaction(tx); err != nil {
+		t.Fatalf("Transaction rejected: %v", err)
+	}
+
+	chain.height++
+	block := &wire.MsgBlock{Transactions: []*wire.MsgTx{tx}}
+	if err := chain.shieldedPool.ProcessShieldedTransaction(tx); err != nil {
+		t.Fatalf("Failed to process shielded transaction: %v", err)
+	}
+	if err := chain.shieldedPool.ConnectBlockNullifiers(wire.Hash{byte(chain.height)}, chain.height, block.Transactions); err != nil {
+		t.Fatalf("Failed to connect nullifiers: %v", err)
+	}
+	if err := chain.utxoSet.ApplyBlock(block, chain.height); err != nil {
+		t.Fatalf("Failed to apply block: %v", err)
+	}
+	chain.mempool.RemoveTransaction(tx.TxHash())
+}
+
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, _, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return key, crypto.KeyToAddress(&key.PublicKey)
+}
+
+func shieldedBalance(chain *BlockChain, key *wire.ShieldedSpendingKey) int64 {
+	total := int64(0)
+	for _, note := range chain.shieldedPool.ScanNotes(key) {
+		total += note.Note.Value
+	}
+	return total
+}
+
+func TestShieldedTxBuilderFlows(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+	fee := chain.params.MinTxFee
+
+	minerKey, minerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, minerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+
+	alice, err := wire.GenerateShieldedSpendingKey()
+	if err != nil {
+		t.Fatalf("Failed to generate spending key: %v", err)
+	}
+	bob, _ := wire.GenerateShieldedSpendingKey()
+
+	// t -> z: shield 4 OB from the coinbase, change back to the miner
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(minerKey)
+	if err := builder.AddOutput(alice.Address().String(), 4*100000000, []byte("hello alice")); err != nil {
+		t.Fatalf("AddOutput failed: %v", err)
+	}
+	shieldTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build t->z transaction: %v", err)
+	}
+	if shieldTx.TxType != wire.TxTypeMixed || shieldTx.ValueBalance != -4*100000000 {
+		t.Errorf("Unexpected t->z type %d / value balance %d", shieldTx.TxType, shieldTx.ValueBalance)
+	}
+	confirmTx(t, chain, shieldTx)
+
+	if balance := shieldedBalance(chain, alice); balance != 4*100000000 {
+		t.Fatalf("Alice shielded balance = %d, want %d", balance, 4*100000000)
+	}
+	if minerBalance, _ := chain.utxoSet.GetBalance(minerAddr); minerBalance != 6*100000000-fee {
+		t.Errorf("Miner change = %d, want %d", minerBalance, 6*100000000-fee)
+	}
+
+	notes := chain.shieldedPool.ScanNotes(alice)
+	if !bytes.HasPrefix(notes[0].Note.Memo, []byte("hello alice")) {
+		t.Errorf("Memo not recovered: %q", notes[0].Note.Memo[:16])
+	}
+
+	// z -> z: Alice pays Bob 1 OB with a memo, change stays shielded
+	builder = NewShieldedTxBuilder(chain)
+	builder.AddShieldedSource(alice)
+	if err := builder.AddOutput(bob.Address().String(), 100000000, []byte("for bob")); err != nil {
+		t.Fatalf("AddOutput failed: %v", err)
+	}
+	privateTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build z->z transaction: %v", err)
+	}
+	if privateTx.TxType != wire.TxTypeShielded || privateTx.ValueBalance != fee {
+		t.Errorf("Unexpected z->z type %d / value balance %d", privateTx.TxType, privateTx.ValueBalance)
+	}
+	confirmTx(t, chain, privateTx)
+
+	// Alice can prove the payment to Bob from the builder's disclosure keys
+	keys := builder.DisclosureKeys()
+	if keys == nil || len(keys.Ocks) != len(privateTx.ShieldedOutputs) {
+		t.Fatal("Builder did not record disclosure keys")
+	}
+	pd, err := wire.NewPaymentDisclosure(privateTx, 0, keys.Ocks[0], keys.Bsk, "")
+	if err != nil {
+		t.Fatalf("NewPaymentDisclosure failed: %v", err)
+	}
+	if payment, err := pd.Verify(privateTx); err != nil || payment.Address.String() != bob.Address().String() {
+		t.Errorf("Payment disclosure to Bob not verified: %v", err)
+	}
+
+	if balance := shieldedBalance(chain, bob); balance != 100000000 {
+		t.Errorf("Bob shielded balance = %d, want %d", balance, 100000000)
+	}
+	if balance := shieldedBalance(chain, alice); balance != 3*100000000-fee {
+		t.Errorf("Alice shielded change = %d, want %d", balance, 3*100000000-fee)
+	}
+
+	// z -> t: Bob unshields to a fresh transparent address
+	_, bobTransparent := newTestKey(t)
+	builder = NewShieldedTxBuilder(chain)
+	builder.AddShieldedSource(bob)
+	if err := builder.AddOutput(bobTransparent, 50000000, nil); err != nil {
+		t.Fatalf("AddOutput failed: %v", err)
+	}
+	unshieldTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build z->t transaction: %v", err)
+	}
+	confirmTx(t, chain, unshieldTx)
+
+	if balance, _ := chain.utxoSet.GetBalance(bobTransparent); balance != 50000000 {
+		t.Errorf("Unshielded balance = %d, want %d", balance, 50000000)
+	}
+
+	// t -> t: the miner pays the unshielded address
+	builder = NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(minerKey)
+	if err := builder.AddOutput(bobTransparent, 100000000, nil); err != nil {
+		t.Fatalf("AddOutput failed: %v", err)
+	}
+	transparentTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build t->t transaction: %v", err)
+	}
+	if transparentTx.IsShielded() {
+		t.Error("t->t transaction should have no shielded components")
+	}
+	confirmTx(t, chain, transparentTx)
+
+	// Every satoshi that entered the pool is accounted for
+	inPool := shieldedBalance(chain, alice) + shieldedBalance(chain, bob)
+	if inPool != chain.shieldedPool.GetTotalShieldedValue() {
+		t.Errorf("Pool total %d does not match notes %d", chain.shieldedPool.GetTotalShieldedValue(), inPool)
+	}
+}
+
+func TestShieldedTxBuilderTokens(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	minerKey, minerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 100000000, minerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+
+	// Tokens cannot be shielded yet, so place a token note in the pool
+	alice, _ := wire.GenerateShieldedSpendingKey()
+	bob, _ := wire.GenerateShieldedSpendingKey()
+	tokenID := wire.Hash{0x70}
+	ovk, _ := wire.GenerateValueCommitTrapdoor()
+	output, _, err := buildShieldedOutput(&shieldedRecipient{addr: alice.Address(), value: 50, tokenID: tokenID}, ovk)
+	if err != nil {
+		t.Fatalf("Failed to build token output: %v", err)
+	}
+	if !wire.VerifyOutputProof(output) {
+		t.Fatal("Token output proof rejected")
+	}
+	if err := chain.shieldedPool.AddCommitment(&wire.NoteCommitment{Cm: output.Cmu}, 0); err != nil {
+		t.Fatalf("Failed to add token note: %v", err)
+	}
+	chain.shieldedPool.outputs[string(output.Cmu)] = output
+
+	// Token notes do not fund OB payments
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddShieldedSource(alice)
+	builder.AddOutput(minerAddr, 10, nil)
+	if _, err := builder.Build(); err == nil {
+		t.Error("Token note spent as OB")
+	}
+
+	// Alice sends Bob 30 tokens, the miner pays the fee
+	builder = NewShieldedTxBuilder(chain)
+	builder.AddShieldedSource(alice)
+	builder.AddTransparentSource(minerKey)
+	if err := builder.AddTokenOutput(bob.Address().String(), tokenID, 30, []byte("tokens")); err != nil {
+		t.Fatalf("AddTokenOutput failed: %v", err)
+	}
+	tx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build token transaction: %v", err)
+	}
+	if tx.ValueBalance != 0 || tx.ShieldedSpends[0].TokenID != tokenID {
+		t.Errorf("Token spend has value balance %d and token %s", tx.ValueBalance, tx.ShieldedSpends[0].TokenID)
+	}
+	confirmTx(t, chain, tx)
+
+	for _, check := range []struct {
+		key   *wire.ShieldedSpendingKey
+		value int64
+	}{{bob, 30}, {alice, 20}} {
+		notes := chain.shieldedPool.ScanNotes(check.key)
+		if len(notes) != 1 || notes[0].Note.TokenID != tokenID || notes[0].Note.Value != check.value {
+			t.Errorf("Expected one note of %d tokens, got %d notes", check.value, len(notes))
+		}
+	}
+	if total := chain.shieldedPool.GetTotalShieldedValue(); total != 0 {
+		t.Errorf("Token transfer moved %d OB into the pool", total)
+	}
+}
+
+func TestShieldedTxBuilderRejects(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	key, addr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 100000000, addr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+
+	// Overspending fails
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(key)
+	builder.AddOutput(addr, 100000000, nil)
+	if _, err := builder.Build(); err == nil {
+		t.Error("Expected insufficient funds error")
+	}
+
+	// Memos cannot be sent to transparent addresses
+	if err := builder.AddOutput(addr, 1000, []byte("memo")); err == nil {
+		t.Error("Expected memo on transparent output to be rejected")
+	}
+
+	// A tampered shielded output breaks the binding signature
+	sk, _ := wire.GenerateShieldedSpendingKey()
+	builder = NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(key)
+	builder.AddOutput(sk.Address().String(), 1000000, nil)
+	tx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	tx.ValueBalance--
+	if _, err := chain.AcceptTransaction(tx); err == nil {
+		t.Error("Expected tampered transaction to be rejected")
+	}
+}
+
+func TestShieldedTxBuilderSweepCoinbase(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	key, addr := newTestKey(t)
+	block := &wire.MsgBlock{Transactions: []*wire.MsgTx{
+		wire.NewCoinbaseTx(1, 200000000, addr),
+	}}
+	if err := chain.utxoSet.ApplyBlock(block, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+
+	// A non-coinbase output to the same key must be left alone
+	payment := wire.NewMsgTx(wire.TxVersion)
+	payment.AddTxOut(&wire.TxOut{Value: 50000000, PkScript: []byte(addr)})
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{payment}}, 2); err != nil {
+		t.Fatalf("Failed to apply payment: %v", err)
+	}
+
+	sk, _ := wire.GenerateShieldedSpendingKey()
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(key)
+	builder.SetCoinbaseOnly(true)
+	if err := builder.SweepTo(sk.Address().String(), nil); err != nil {
+		t.Fatalf("SweepTo failed: %v", err)
+	}
+
+	tx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if len(tx.TxIn) != 1 || len(tx.TxOut) != 0 {
+		t.Errorf("Expected 1 coinbase input and no transparent outputs, got %d/%d", len(tx.TxIn), len(tx.TxOut))
+	}
+	confirmTx(t, chain, tx)
+
+	if balance := shieldedBalance(chain, sk); balance != 200000000-chain.params.MinTxFee {
+		t.Errorf("Shielded coinbase = %d, want %d", balance, 200000000-chain.params.MinTxFee)
+	}
+}
+
+func TestRejectedBlockLeavesNoState(t *testing.T) {
+	chain := newTestChain(t, &chaincfg.MainNetParams)
+
+	minerKey, minerAddr := newTestKey(t)
+	coinbase := wire.NewCoinbaseTx(1, 10*100000000, minerAddr)
+	if err := chain.utxoSet.ApplyBlock(&wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}, 1); err != nil {
+		t.Fatalf("Failed to apply coinbase: %v", err)
+	}
+	alice, _ := wire.GenerateShieldedSpendingKey()
+	builder := NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(minerKey)
+	if err := builder.AddOutput(alice.Address().String(), 4*100000000, nil); err != nil {
+		t.Fatalf("AddOutput failed: %v", err)
+	}
+	shieldTx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build t->z transaction: %v", err)
+	}
+	confirmTx(t, chain, shieldTx)
+
+	// A payment from the miner, then two spends of Alice's only note
+	_, payee := newTestKey(t)
+	builder = NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(minerKey)
+	builder.AddOutput(payee, 100000000, nil)
+	payment, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build payment: %v", err)
+	}
+	var spends []*wire.MsgTx
+	for i := 0; i < 2; i++ {
+		bob, _ := wire.GenerateShieldedSpendingKey()
+		builder = NewShieldedTxBuilder(chain)
+		builder.AddShieldedSource(alice)
+		builder.AddOutput(bob.Address().String(), 100000000, nil)
+		spend, err := builder.Build()
+		if err != nil {
+			t.Fatalf("Failed to build z->z transaction: %v", err)
+		}
+		spends = append(spends, spend)
+	}
+
+	minerBalance, _ := chain.utxoSet.GetBalance(minerAddr)
+	poolValue := chain.shieldedPool.GetTotalShieldedValue()
+	block := &wire.MsgBlock{Transactions: []*wire.MsgTx{payment, spends[0], spends[1]}}
+	if err := chain.applyBlockState(block, 3); err == nil {
+		t.Fatal("Block spending a note twice was applied")
+	}
+
+	// Every change made before the double spend was found is undone
+	if balance, _ := chain.utxoSet.GetBalance(minerAddr); balance != minerBalance {
+		t.Errorf("Miner balance = %d after rejection, want %d", balance, minerBalance)
+	}
+	if balance, _ := chain.utxoSet.GetBalance(payee); balance != 0 {
+		t.Errorf("Payee kept %d from a rejected block", balance)
+	}
+	if chain.shieldedPool.HasNullifier(spends[0].ShieldedSpends[0].Nullifier) {
+		t.Error("Nullifier of the rejected block still spent")
+	}
+	if chain.shieldedPool.HasCommitment(spends[0].ShieldedOutputs[0].Cmu) {
+		t.Error("Commitment of the rejected block still in the pool")
+	}
+	if value := chain.shieldedPool.GetTotalShieldedValue(); value != poolValue {
+		t.Errorf("Shielded value = %d after rejection, want %d", value, poolValue)
+	}
+	hash := block.BlockHash()
+	if _, err := chain.db.GetBlock(hash[:]); err == nil {
+		t.Error("Rejected block was saved")
+	}
+
+	// The first spend alone still connects
+	block.Transactions = block.Transactions[:2]
+	if err := chain.applyBlockState(block, 3); err != nil {
+		t.Errorf("Valid block rejected after undo: %v", err)
+	}
+}
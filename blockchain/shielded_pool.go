@@ -19,11 +19,45 @@ type ShieldedPool struct {
 	// Set of all nullifiers (spent shielded outputs)
 	nullifiers map[string]*wire.Nullifier
 
+	// Persistent nullifier set (survives restarts), optional
+	nullifierSet *NullifierSet
+
 	// Merkle tree of commitments (simplified)
 	commitmentTree [][]byte
 
+	// Encrypted outputs by note commitment, scanned by wallets to find
+	// the notes they own
+	outputs map[string]*wire.ShieldedOutput
+
 	// Total shielded value in pool
 	totalShieldedValue int64
+
+	// Per-block record of transparent <-> shielded value flow
+	supplyHistory []*ShieldedSupplyDelta
+}
+
+// ShieldedSupplyDelta records how much value entered and left the shielded
+// pool in a single block
+type ShieldedSupplyDelta struct {
+	Height        int32
+	Hash          wire.Hash
+	Shielded      int64 // Value moved from transparent into shielded
+	Unshielded    int64 // Value moved from shielded into transparent
+	Net           int64 // Change in total shielded value
+	TotalShielded int64 // Total shielded value after the block
+}
+
+// maxValueBalance bounds the value a single transaction can move across the
+// shielded pool boundary (the 100M OBS supply cap in satoshis)
+const maxValueBalance = 100000000 * 100000000
+
+// ShieldedNote is an unspent note found by scanning the pool with a
+// spending key
+type ShieldedNote struct {
+	Note      *wire.Note
+	Cmu       []byte
+	Nullifier []byte
+	Position  int // Index of the commitment in the tree
 }
 
 // NewShieldedPool creates a new shielded pool
@@ -32,9 +66,45 @@ func NewShieldedPool() *ShieldedPool {
 		commitments:    make(map[string]*wire.NoteCommitment),
 		nullifiers:     make(map[string]*wire.Nullifier),
 		commitmentTree: make([][]byte, 0),
+		outputs:        make(map[string]*wire.ShieldedOutput),
+		supplyHistory:  make([]*ShieldedSupplyDelta, 0),
 	}
 }
 
+// SetNullifierSet attaches a persistent nullifier set to the pool. Once set,
+// nullifiers revealed by connected blocks are written to the database and
+// double-spend checks consult it.
+func (sp *ShieldedPool) SetNullifierSet(ns *NullifierSet) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.nullifierSet = ns
+}
+
+// ConnectBlockNullifiers persists the nullifiers revealed by a block
+func (sp *ShieldedPool) ConnectBlockNullifiers(blockHash wire.Hash, height int32, txs []*wire.MsgTx) error {
+	sp.mu.RLock()
+	ns := sp.nullifierSet
+	sp.mu.RUnlock()
+
+	if ns == nil {
+		return nil
+	}
+	return ns.ConnectBlock(blockHash, height, txs)
+}
+
+// DisconnectBlockNullifiers removes the persisted nullifiers of a block
+func (sp *ShieldedPool) DisconnectBlockNullifiers(blockHash wire.Hash) error {
+	sp.mu.RLock()
+	ns := sp.nullifierSet
+	sp.mu.RUnlock()
+
+	if ns == nil {
+		return nil
+	}
+	return ns.DisconnectBlock(blockHash)
+}
+
 // AddCommitment adds a note commitment to the pool
 func (sp *ShieldedPool) AddCommitment(cm *wire.NoteCommitment, value int64) error {
 	sp.mu.Lock()
@@ -114,6 +184,9 @@ func (sp *ShieldedPool) AddNullifier(nf *wire.Nullifier) error {
 	if _, exists := sp.nullifiers[key]; exists {
 		return wire.ErrInvalidNullifier
 	}
+	if sp.nullifierSet != nil && sp.nullifierSet.HasNullifier(nf.Nf) {
+		return wire.ErrInvalidNullifier
+	}
 
 	// Add to nullifier map
 	sp.nullifiers[key] = nf
@@ -126,8 +199,16 @@ func (sp *ShieldedPool) HasNullifier(nf []byte) bool {
 	sp.mu.RLock()
 	defer sp.mu.RUnlock()
 
-	_, exists := sp.nullifiers[string(nf)]
-	return exists
+	return sp.hasNullifierLocked(nf)
+}
+
+// hasNullifierLocked checks the nullifier sets. The caller must hold the lock.
+func (sp *ShieldedPool) hasNullifierLocked(nf []byte) bool {
+	if _, exists := sp.nullifiers[string(nf)]; exists {
+		return true
+	}
+
+	return sp.nullifierSet != nil && sp.nullifierSet.HasNullifier(nf)
 }
 
 // HasCommitment checks if a commitment exists
@@ -192,26 +273,34 @@ func (sp *ShieldedPool) RollbackTransaction(tx *wire.MsgTx) error {
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 
+	// Value that left the pool returns to it, value that entered leaves
+	sp.totalShieldedValue += tx.ValueBalance
+	sp.removeEntries(tx, len(tx.ShieldedSpends), len(tx.ShieldedOutputs))
+
+	return nil
+}
+
+// removeEntries removes the nullifiers of the first spends and the
+// commitments of the first outputs of tx. The caller must hold sp.mu.
+func (sp *ShieldedPool) removeEntries(tx *wire.MsgTx, spends, outputs int) {
 	// Remove commitments from shielded outputs
-	for _, output := range tx.ShieldedOutputs {
+	for _, output := range tx.ShieldedOutputs[:outputs] {
 		cmKey := string(output.Cmu) // Note commitment
 		delete(sp.commitments, cmKey)
-		sp.totalShieldedValue -= output.TokenAmount // Use TokenAmount as value
+		delete(sp.outputs, cmKey)
 	}
 
 	// Remove nullifiers from shielded spends (they become unspent)
-	for _, spend := range tx.ShieldedSpends {
+	for _, spend := range tx.ShieldedSpends[:spends] {
 		nfKey := string(spend.Nullifier)
 		delete(sp.nullifiers, nfKey)
 	}
 
 	// Rebuild commitment tree (simplified - remove last commitments)
 	// In production, this would need proper tree reconstruction
-	if len(tx.ShieldedOutputs) > 0 && len(sp.commitmentTree) >= len(tx.ShieldedOutputs) {
-		sp.commitmentTree = sp.commitmentTree[:len(sp.commitmentTree)-len(tx.ShieldedOutputs)]
+	if outputs > 0 && len(sp.commitmentTree) >= outputs {
+		sp.commitmentTree = sp.commitmentTree[:len(sp.commitmentTree)-outputs]
 	}
-
-	return nil
 }
 
 // GetTotalShieldedValue returns the total value in the shielded pool
@@ -243,11 +332,16 @@ func (sp *ShieldedPool) ValidateShieldedTransaction(tx *wire.MsgTx) error {
 	}
 
 	for _, output := range tx.ShieldedOutputs {
-		if !wire.VerifyProof(output.Proof, output.Cmu, nil) {
+		if !wire.VerifyOutputProof(output) {
 			return wire.ErrInvalidProof
 		}
 	}
 
+	// Every spend must be authorized by the owner of the note
+	if err := tx.VerifySpendAuthSigs(); err != nil {
+		return err
+	}
+
 	// 3. Verify value balance
 	if err := sp.validateValueBalance(tx); err != nil {
 		return err
@@ -258,22 +352,31 @@ func (sp *ShieldedPool) ValidateShieldedTransaction(tx *wire.MsgTx) error {
 
 // validateValueBalance ensures the value balance equation holds
 func (sp *ShieldedPool) validateValueBalance(tx *wire.MsgTx) error {
-	// Calculate transparent outputs
-	transparentOut := int64(0)
-	for _, txOut := range tx.TxOut {
-		transparentOut += txOut.Value
-	}
-
 	// Value balance equation:
-	// transparent_in - transparent_out = value_balance + fees
-	// Where value_balance = shielded_out - shielded_in
+	// sum(shielded_in) - sum(shielded_out) = value_balance
+	// Where value_balance flows into the transparent side:
+	// transparent_in + value_balance = transparent_out + fees
 
-	// For now, just check that value balance is within reasonable bounds
-	if tx.ValueBalance < -1e8 || tx.ValueBalance > 1e8 {
+	// Check that value balance is within reasonable bounds
+	if tx.ValueBalance < -maxValueBalance || tx.ValueBalance > maxValueBalance {
 		return wire.ErrValueBalance
 	}
 
-	return nil
+	// Every spend and output must carry a well-formed value commitment
+	for _, spend := range tx.ShieldedSpends {
+		if len(spend.Cv) != wire.ValueCommitmentSize {
+			return wire.ErrInvalidCommitment
+		}
+	}
+	for _, output := range tx.ShieldedOutputs {
+		if len(output.Cv) != wire.ValueCommitmentSize {
+			return wire.ErrInvalidCommitment
+		}
+	}
+
+	// The binding signature proves the commitments balance against
+	// ValueBalance for OB and to zero for every other token
+	return tx.VerifyBindingSig()
 }
 
 // ProcessShieldedTransaction processes a shielded transaction
@@ -287,27 +390,195 @@ func (sp *ShieldedPool) ProcessShieldedTransaction(tx *wire.MsgTx) error {
 		return err
 	}
 
-	// Add nullifiers (mark inputs as spent)
-	for _, spend := range tx.ShieldedSpends {
+	// Add nullifiers (mark inputs as spent). A failure removes what this
+	// transaction already added.
+	for i, spend := range tx.ShieldedSpends {
 		nf := &wire.Nullifier{Nf: spend.Nullifier}
 		if err := sp.AddNullifier(nf); err != nil {
+			sp.mu.Lock()
+			sp.removeEntries(tx, i, 0)
+			sp.mu.Unlock()
 			return err
 		}
 	}
 
 	// Add commitments (create new shielded outputs)
-	for _, output := range tx.ShieldedOutputs {
+	for i, output := range tx.ShieldedOutputs {
 		cm := &wire.NoteCommitment{Cm: output.Cmu}
-		// Value is encrypted, so we can't know it directly
-		// In production, this would be tracked differently
+		// Individual note values are hidden; the pool total is tracked
+		// through ValueBalance below
 		if err := sp.AddCommitment(cm, 0); err != nil {
+			sp.mu.Lock()
+			sp.removeEntries(tx, len(tx.ShieldedSpends), i)
+			sp.mu.Unlock()
 			return err
 		}
+
+		sp.mu.Lock()
+		sp.outputs[string(output.Cmu)] = output
+		sp.mu.Unlock()
+	}
+
+	// Apply the transparent <-> shielded value flow
+	sp.mu.Lock()
+	sp.totalShieldedValue -= tx.ValueBalance
+	sp.mu.Unlock()
+
+	return nil
+}
+
+// ProcessBlockTransactions processes the shielded transactions of a block
+// in order. If one fails, those already processed are rolled back.
+func (sp *ShieldedPool) ProcessBlockTransactions(txs []*wire.MsgTx) error {
+	for i, tx := range txs {
+		if err := sp.ProcessShieldedTransaction(tx); err != nil {
+			sp.RollbackBlockTransactions(txs[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// RollbackBlockTransactions removes the shielded transactions of a block
+// from the pool, newest first
+func (sp *ShieldedPool) RollbackBlockTransactions(txs []*wire.MsgTx) {
+	for i := len(txs) - 1; i >= 0; i-- {
+		if txs[i].IsShielded() {
+			sp.RollbackTransaction(txs[i])
+		}
+	}
+}
+
+// CheckTurnstile verifies that applying the transactions in order never
+// drives the total shielded value below zero. A negative pool would mean
+// more value was unshielded than was ever shielded, i.e. counterfeit notes.
+func (sp *ShieldedPool) CheckTurnstile(txs []*wire.MsgTx) error {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	total := sp.totalShieldedValue
+	for _, tx := range txs {
+		if !tx.IsShielded() {
+			continue
+		}
+
+		// Check for overflow when shielding
+		if tx.ValueBalance < 0 && total > (int64(^uint64(0)>>1)+tx.ValueBalance) {
+			return fmt.Errorf("total shielded value would overflow")
+		}
+
+		total -= tx.ValueBalance
+		if total < 0 {
+			txHash := tx.TxHash()
+			return fmt.Errorf("shielded pool turnstile violation: tx %s would make shielded value %d", txHash.String(), total)
+		}
 	}
 
 	return nil
 }
 
+// RecordBlockSupply appends the shielded value flow of a connected block to
+// the supply history, persisting it if a nullifier set is attached. It must
+// be called after the block's shielded transactions have been processed.
+func (sp *ShieldedPool) RecordBlockSupply(height int32, hash wire.Hash, txs []*wire.MsgTx) (*ShieldedSupplyDelta, error) {
+	delta := &ShieldedSupplyDelta{
+		Height: height,
+		Hash:   hash,
+	}
+
+	for _, tx := range txs {
+		if tx.ValueBalance < 0 {
+			delta.Shielded += -tx.ValueBalance
+		} else {
+			delta.Unshielded += tx.ValueBalance
+		}
+	}
+	delta.Net = delta.Shielded - delta.Unshielded
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	delta.TotalShielded = sp.totalShieldedValue
+	if sp.nullifierSet != nil {
+		if err := sp.nullifierSet.PutSupplyDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+	sp.supplyHistory = append(sp.supplyHistory, delta)
+
+	return delta, nil
+}
+
+// RemoveBlockSupply drops the supply record of a disconnected block
+func (sp *ShieldedPool) RemoveBlockSupply(hash wire.Hash) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	for i := len(sp.supplyHistory) - 1; i >= 0; i-- {
+		delta := sp.supplyHistory[i]
+		if delta.Hash != hash {
+			continue
+		}
+		if sp.nullifierSet != nil {
+			if err := sp.nullifierSet.DeleteSupplyDelta(delta.Height, hash); err != nil {
+				return err
+			}
+		}
+		sp.supplyHistory = append(sp.supplyHistory[:i], sp.supplyHistory[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+// LoadSupplyHistory restores the supply history and total shielded value
+// stored by the attached nullifier set
+func (sp *ShieldedPool) LoadSupplyHistory() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.nullifierSet == nil {
+		return nil
+	}
+	history, err := sp.nullifierSet.SupplyHistory()
+	if err != nil {
+		return err
+	}
+	sp.supplyHistory = history
+	if len(history) > 0 {
+		sp.totalShieldedValue = history[len(history)-1].TotalShielded
+	}
+	return nil
+}
+
+// GetSupplyHistory returns the per-block shielded supply records between
+// the given heights (inclusive)
+func (sp *ShieldedPool) GetSupplyHistory(fromHeight, toHeight int32) []*ShieldedSupplyDelta {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	history := make([]*ShieldedSupplyDelta, 0)
+	for _, delta := range sp.supplyHistory {
+		if delta.Height >= fromHeight && delta.Height <= toHeight {
+			history = append(history, delta)
+		}
+	}
+
+	return history
+}
+
+// SumSupplyHistory re-sums the net flow of every recorded block
+func (sp *ShieldedPool) SumSupplyHistory() int64 {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	total := int64(0)
+	for _, delta := range sp.supplyHistory {
+		total += delta.Net
+	}
+
+	return total
+}
+
 // GetShieldedBalance calculates the shielded balance for a viewing key
 // This requires scanning all commitments and trying to decrypt them
 func (sp *ShieldedPool) GetShieldedBalance(viewingKey []byte) (int64, error) {
@@ -344,14 +615,63 @@ func (sp *ShieldedPool) GetShieldedBalance(viewingKey []byte) (int64, error) {
 	return balance, nil
 }
 
+// ScanNotes trial-decrypts every output in the pool with the key's incoming
+// viewing key and returns the unspent notes it owns, in tree order
+func (sp *ShieldedPool) ScanNotes(key *wire.ShieldedSpendingKey) []*ShieldedNote {
+	ivk := key.IncomingViewingKey()
+	nsk := key.NullifierKey()
+
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	notes := make([]*ShieldedNote, 0)
+	for pos, cm := range sp.commitmentTree {
+		output, ok := sp.outputs[string(cm)]
+		if !ok {
+			continue
+		}
+
+		note, err := wire.TryDecryptNote(ivk, output.EphemeralKey, output.EncCiphertext)
+		if err != nil || !key.OwnsNote(note) {
+			continue
+		}
+		note.TokenID = output.TokenID
+
+		// The note must open the commitment it was found under, which
+		// also checks its value against the output's value commitment
+		if !bytes.Equal(note.Commit().Cm, cm) {
+			continue
+		}
+
+		nf := note.ComputeNullifier(nsk)
+		if sp.hasNullifierLocked(nf.Nf) {
+			continue
+		}
+
+		notes = append(notes, &ShieldedNote{
+			Note:      note,
+			Cmu:       cm,
+			Nullifier: nf.Nf,
+			Position:  pos,
+		})
+	}
+
+	return notes
+}
+
 // Stats returns statistics about the shielded pool
 func (sp *ShieldedPool) Stats() map[string]interface{} {
 	sp.mu.RLock()
 	defer sp.mu.RUnlock()
 
+	totalNullifiers := len(sp.nullifiers)
+	if sp.nullifierSet != nil {
+		totalNullifiers = sp.nullifierSet.Count()
+	}
+
 	return map[string]interface{}{
 		"total_commitments":    len(sp.commitments),
-		"total_nullifiers":     len(sp.nullifiers),
+		"total_nullifiers":     totalNullifiers,
 		"total_shielded_value": sp.totalShieldedValue,
 		"merkle_tree_size":     len(sp.commitmentTree),
 	}
@@ -0,0 +1,205 @@
+package blockchain
+
+import (
+	"bytes"
+	"obsidian-core/wire"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestShieldedTurnstile(t *testing.T) {
+	pool := NewShieldedPool()
+
+	// Shield 10 OB into the pool
+	shield := wire.NewShieldedTx(wire.TxVersion)
+	shield.ValueBalance = -10
+
+	if err := pool.CheckTurnstile([]*wire.MsgTx{shield}); err != nil {
+		t.Fatalf("Shielding rejected by turnstile: %v", err)
+	}
+
+	pool.totalShieldedValue -= shield.ValueBalance
+	if _, err := pool.RecordBlockSupply(1, wire.Hash{0x01}, []*wire.MsgTx{shield}); err != nil {
+		t.Fatalf("RecordBlockSupply failed: %v", err)
+	}
+
+	// Unshielding more than the pool holds must fail
+	unshield := wire.NewShieldedTx(wire.TxVersion)
+	unshield.ValueBalance = 11
+
+	if err := pool.CheckTurnstile([]*wire.MsgTx{unshield}); err == nil {
+		t.Error("Expected turnstile violation when unshielding more than the pool holds")
+	}
+
+	// Ordering within a block matters: unshield before shield is invalid
+	unshield.ValueBalance = 15
+	reshield := wire.NewShieldedTx(wire.TxVersion)
+	reshield.ValueBalance = -10
+	if err := pool.CheckTurnstile([]*wire.MsgTx{unshield, reshield}); err == nil {
+		t.Error("Expected turnstile violation for out-of-order unshield")
+	}
+	if err := pool.CheckTurnstile([]*wire.MsgTx{reshield, unshield}); err != nil {
+		t.Errorf("Valid block ordering rejected: %v", err)
+	}
+
+	t.Logf("✓ Shielded pool turnstile enforced")
+}
+
+func TestShieldedSupplyHistory(t *testing.T) {
+	pool := NewShieldedPool()
+
+	shield := wire.NewShieldedTx(wire.TxVersion)
+	shield.ValueBalance = -25
+	unshield := wire.NewShieldedTx(wire.TxVersion)
+	unshield.ValueBalance = 5
+
+	pool.totalShieldedValue = 20
+	delta, err := pool.RecordBlockSupply(7, wire.Hash{0x07}, []*wire.MsgTx{shield, unshield})
+	if err != nil {
+		t.Fatalf("RecordBlockSupply failed: %v", err)
+	}
+
+	if delta.Shielded != 25 || delta.Unshielded != 5 || delta.Net != 20 {
+		t.Errorf("Unexpected delta: shielded=%d unshielded=%d net=%d", delta.Shielded, delta.Unshielded, delta.Net)
+	}
+
+	if sum := pool.SumSupplyHistory(); sum != pool.GetTotalShieldedValue() {
+		t.Errorf("History sum %d does not match pool total %d", sum, pool.GetTotalShieldedValue())
+	}
+
+	if history := pool.GetSupplyHistory(0, 6); len(history) != 0 {
+		t.Errorf("Expected no history before height 7, got %d entries", len(history))
+	}
+
+	pool.RemoveBlockSupply(wire.Hash{0x07})
+	if history := pool.GetSupplyHistory(0, 100); len(history) != 0 {
+		t.Errorf("Expected history to be empty after removal, got %d entries", len(history))
+	}
+}
+
+func TestShieldedSupplyPersistence(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "supply.db")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	pool := NewShieldedPool()
+	pool.SetNullifierSet(NewNullifierSet(db))
+	shield := wire.NewShieldedTx(wire.TxVersion)
+	shield.ValueBalance = -10
+	pool.totalShieldedValue -= shield.ValueBalance
+	if _, err := pool.RecordBlockSupply(3, wire.Hash{0x03}, []*wire.MsgTx{shield}); err != nil {
+		t.Fatalf("RecordBlockSupply failed: %v", err)
+	}
+	db.Close()
+
+	// After a restart the pool still holds the shielded value
+	db, err = bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	pool = NewShieldedPool()
+	pool.SetNullifierSet(NewNullifierSet(db))
+	if err := pool.LoadSupplyHistory(); err != nil {
+		t.Fatalf("LoadSupplyHistory failed: %v", err)
+	}
+	if pool.GetTotalShieldedValue() != 10 || len(pool.GetSupplyHistory(0, 100)) != 1 {
+		t.Fatalf("Restored total %d with %d history entries", pool.GetTotalShieldedValue(), len(pool.GetSupplyHistory(0, 100)))
+	}
+	unshield := wire.NewShieldedTx(wire.TxVersion)
+	unshield.ValueBalance = 10
+	if err := pool.CheckTurnstile([]*wire.MsgTx{unshield}); err != nil {
+		t.Errorf("Unshielding rejected after restart: %v", err)
+	}
+
+	// Disconnected blocks are removed from storage too
+	if err := pool.RemoveBlockSupply(wire.Hash{0x03}); err != nil {
+		t.Fatalf("RemoveBlockSupply failed: %v", err)
+	}
+	if history, err := NewNullifierSet(db).SupplyHistory(); err != nil || len(history) != 0 {
+		t.Errorf("Stored history = %d entries, %v after removal", len(history), err)
+	}
+}
+
+func TestNullifierSetPersistence(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "nullifiers.db")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	nf := bytes.Repeat([]byte{0x42}, wire.NullifierSize)
+	tx := wire.NewShieldedTx(wire.TxVersion)
+	tx.AddShieldedSpend(&wire.ShieldedSpend{Nullifier: nf})
+	blockHash := wire.Hash{0x10}
+
+	ns := NewNullifierSet(db)
+	if err := ns.ConnectBlock(blockHash, 5, []*wire.MsgTx{tx}); err != nil {
+		t.Fatalf("Failed to connect block: %v", err)
+	}
+
+	// Revealing the same nullifier again must fail
+	if err := ns.ConnectBlock(wire.Hash{0x11}, 6, []*wire.MsgTx{tx}); err != wire.ErrInvalidNullifier {
+		t.Errorf("Expected ErrInvalidNullifier for double-spend, got %v", err)
+	}
+	db.Close()
+
+	// Nullifiers survive a restart
+	db, err = bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	pool := NewShieldedPool()
+	pool.SetNullifierSet(NewNullifierSet(db))
+	if !pool.HasNullifier(nf) {
+		t.Fatal("Nullifier lost after restart")
+	}
+
+	hash, height, err := NewNullifierSet(db).GetNullifierBlock(nf)
+	if err != nil || hash != blockHash || height != 5 {
+		t.Errorf("Unexpected nullifier block: hash=%s height=%d err=%v", hash.String(), height, err)
+	}
+
+	// Disconnecting the block makes the note spendable again
+	if err := pool.DisconnectBlockNullifiers(blockHash); err != nil {
+		t.Fatalf("Failed to disconnect block: %v", err)
+	}
+	if pool.HasNullifier(nf) {
+		t.Error("Nullifier still present after disconnect")
+	}
+}
+
+func TestMempoolNullifierConflict(t *testing.T) {
+	mempool := NewMempool()
+	nf := bytes.Repeat([]byte{0x24}, wire.NullifierSize)
+
+	tx1 := wire.NewShieldedTx(wire.TxVersion)
+	tx1.AddShieldedSpend(&wire.ShieldedSpend{Nullifier: nf})
+	tx1.Memo = []byte("first")
+
+	tx2 := wire.NewShieldedTx(wire.TxVersion)
+	tx2.AddShieldedSpend(&wire.ShieldedSpend{Nullifier: nf})
+	tx2.AddTxOut(&wire.TxOut{Value: 1, PkScript: []byte("other")})
+
+	if err := mempool.AddTransaction(tx1, 1, 0); err != nil {
+		t.Fatalf("Failed to add first transaction: %v", err)
+	}
+	if err := mempool.AddTransaction(tx2, 1, 0); err == nil {
+		t.Error("Expected nullifier conflict for second transaction")
+	}
+
+	mempool.RemoveTransaction(tx1.TxHash())
+	if mempool.HasNullifier(nf) {
+		t.Error("Nullifier index not cleared on removal")
+	}
+	if err := mempool.AddTransaction(tx2, 1, 0); err != nil {
+		t.Errorf("Transaction rejected after conflict was removed: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	"fmt"
+	"obsidian-core/smartcontract"
+	"obsidian-core/wire"
+)
+
+// StorageDiff is a storage slot changed by a simulated call
+type StorageDiff struct {
+	Contract string
+	Key      string
+	Before   smartcontract.Value // None if the slot did not exist
+	After    smartcontract.Value // None if the call deleted the slot
+}
+
+// ContractSimulation is the outcome of a call run without a transaction
+type ContractSimulation struct {
+	ContractExecution
+	GasRequired uint64        // Smallest gas limit a call carrying only the call data succeeds with
+	Diffs       []StorageDiff // Storage the call would change
+}
+
+// SimulateContract runs a contract call from sender attaching value against
+// the contract state as of height, or the tip if height is negative, and
+// discards its effects. Balances are those at the tip. gasLimit includes
+// intrinsic gas; 0 means the block gas limit.
+func (b *BlockChain) SimulateContract(call *smartcontract.CallData, sender string, value int64,
+	height int32, gasLimit uint64) (*ContractSimulation, error) {
+	tipHeight := b.Height()
+	if height < 0 {
+		height = tipHeight
+	}
+	if height > tipHeight {
+		return nil, fmt.Errorf("height %d is above the chain tip %d", height, tipHeight)
+	}
+
+	record, err := b.GetContract(call.Contract)
+	if err != nil {
+		return nil, err
+	}
+	if record.Height > height {
+		return nil, fmt.Errorf("contract %s was deployed at height %d, after %d", call.Contract, record.Height, height)
+	}
+	contract, err := record.Contract()
+	if err != nil {
+		return nil, err
+	}
+
+	// Charge the intrinsic gas of the equivalent call transaction
+	skeleton := wire.NewMsgTx(wire.TxVersion)
+	skeleton.TxType = wire.TxTypeSmartContractCall
+	if skeleton.Memo, err = smartcontract.EncodeCallData(call); err != nil {
+		return nil, err
+	}
+	intrinsic := skeleton.CalculateIntrinsicGas()
+	if gasLimit == 0 {
+		gasLimit = b.params.BlockGasLimit
+	}
+
+	sim := &ContractSimulation{
+		ContractExecution: ContractExecution{
+			Height:   height,
+			Contract: call.Contract,
+			Sender:   sender,
+			Function: call.Function,
+			Value:    value,
+			GasLimit: gasLimit,
+		},
+	}
+	if gasLimit < intrinsic {
+		sim.Status = ContractStatusOutOfGas
+		sim.GasUsed = gasLimit
+		sim.GasRequired = intrinsic
+		sim.Error = fmt.Sprintf("gas limit %d is less than intrinsic gas %d", gasLimit, intrinsic)
+		return sim, nil
+	}
+
+	state, block, err := b.contractStateAt(height)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &smartcontract.Context{
+		Sender:    sender,
+		Value:     value,
+		Height:    height,
+		Timestamp: block.Header.Timestamp.Unix(),
+		Ledger:    &contractLedger{b: b, credit: value, creditTo: call.Contract},
+	}
+	writes := state.Child()
+	vm, result, err := runContract(writes, ctx, call.Contract, contract, call.Function, call.Args, gasLimit-intrinsic)
+
+	// Refunds are paid after execution, so the limit must cover the gas
+	// used before them
+	sim.GasUsed = intrinsic + vm.GasUsed()
+	sim.GasRequired = intrinsic + vm.GasMeter().Used()
+	if !sim.setOutcome(vm, result, err) {
+		return sim, nil
+	}
+
+	for _, slot := range writes.Slots() {
+		diff := StorageDiff{Contract: slot.Contract, Key: slot.Key}
+		if diff.Before, err = slotValue(state, slot); err != nil {
+			return nil, err
+		}
+		if diff.After, err = slotValue(writes, slot); err != nil {
+			return nil, err
+		}
+		sim.Diffs = append(sim.Diffs, diff)
+	}
+	return sim, nil
+}
+
+// slotValue returns the value of a slot in ws, or None if it is unset
+func slotValue(ws *smartcontract.WriteSet, slot smartcontract.StorageSlot) (smartcontract.Value, error) {
+	value, ok, err := ws.Get(slot.Contract, slot.Key)
+	if err != nil || !ok {
+		return smartcontract.Value{Type: smartcontract.ValueNone}, err
+	}
+	return value, nil
+}
+
+// EstimateGas returns the gas limit a call transaction from sender
+// attaching value needs to succeed at the chain tip. Inputs and outputs add
+// intrinsic gas for their scripts on top of the estimate.
+func (b *BlockChain) EstimateGas(call *smartcontract.CallData, sender string, value int64) (uint64, error) {
+	sim, err := b.SimulateContract(call, sender, value, -1, 0)
+	if err != nil {
+		return 0, err
+	}
+	if sim.Status != ContractStatusSuccess {
+		return 0, fmt.Errorf("call fails: %s", sim.Error)
+	}
+	return sim.GasRequired, nil
+}
+
+// contractStateAt returns the block at height and a read-only view of
+// contract storage as of that block, rebuilt by reverting the storage
+// changes of the blocks above it
+func (b *BlockChain) contractStateAt(height int32) (*smartcontract.WriteSet, *wire.MsgBlock, error) {
+	state := smartcontract.NewWriteSet(b.contractStorage)
+	bestHash, tipHeight := b.tip()
+	block, err := b.db.GetBlock(bestHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	for h := tipHeight; h > height; h-- {
+		hash := block.BlockHash()
+		undo, err := b.contractStorage.BlockUndo(hash[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := state.Revert(undo); err != nil {
+			return nil, nil, err
+		}
+
+		prevHash := block.Header.PrevBlock
+		if block, err = b.db.GetBlock(prevHash[:]); err != nil {
+			return nil, nil, fmt.Errorf("block at height %d not found: %v", h-1, err)
+		}
+	}
+	return state, block, nil
+}
@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"obsidian-core/crypto"
+	"obsidian-core/smartcontract"
+	"obsidian-core/wire"
+	"sort"
+)
+
+// contractLedger exposes the UTXO set and token ledger to contracts. While
+// a block is connected, the outputs of calls later in the block are hidden
+// until those calls run, so a contract cannot spend value attached to a
+// call that may still fail and be refunded.
+type contractLedger struct {
+	b       *BlockChain
+	pending map[wire.Hash]bool // Calls not yet executed
+
+	// Simulations credit the value a call would attach
+	credit   int64
+	creditTo string
+}
+
+// newBlockLedger returns the ledger seen by the contract transactions of
+// block
+func (b *BlockChain) newBlockLedger(block *wire.MsgBlock) *contractLedger {
+	ledger := &contractLedger{b: b, pending: make(map[wire.Hash]bool)}
+	for _, tx := range block.Transactions {
+		if tx.TxType == wire.TxTypeSmartContractCall {
+			ledger.pending[tx.TxHash()] = true
+		}
+	}
+	return ledger
+}
+
+// outputs returns the visible outputs paying address, oldest first
+func (l *contractLedger) outputs(address string) ([]*UTXO, error) {
+	utxos, err := l.b.utxoSet.GetUTXOsForAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := utxos[:0]
+	for _, utxo := range utxos {
+		if !l.pending[utxo.TxHash] {
+			visible = append(visible, utxo)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		if visible[i].Height != visible[j].Height {
+			return visible[i].Height < visible[j].Height
+		}
+		if c := bytes.Compare(visible[i].TxHash[:], visible[j].TxHash[:]); c != 0 {
+			return c < 0
+		}
+		return visible[i].Index < visible[j].Index
+	})
+	return visible, nil
+}
+
+// Balance returns the OBS held by address
+func (l *contractLedger) Balance(address string) (int64, error) {
+	utxos, err := l.outputs(address)
+	if err != nil {
+		return 0, err
+	}
+	balance := int64(0)
+	for _, utxo := range utxos {
+		balance += utxo.Value
+	}
+	if address == l.creditTo {
+		balance += l.credit
+	}
+	return balance, nil
+}
+
+// TokenBalance returns the amount of token held by address
+func (l *contractLedger) TokenBalance(token, address string) (int64, error) {
+	id, err := parseTokenID(token)
+	if err != nil {
+		return 0, err
+	}
+	return l.b.tokenStore.GetBalance(address, id), nil
+}
+
+// CheckTransfer checks that the recipient can be paid and that the token
+// exists
+func (l *contractLedger) CheckTransfer(transfer *smartcontract.Transfer) error {
+	if !crypto.IsTransparentAddress(transfer.To) && !crypto.IsContractAddress(transfer.To) {
+		return fmt.Errorf("cannot transfer to %s: not a transparent or contract address", transfer.To)
+	}
+	if transfer.Token == "" {
+		return nil
+	}
+	id, err := parseTokenID(transfer.Token)
+	if err != nil {
+		return err
+	}
+	if _, err := l.b.tokenStore.GetToken(id); err != nil {
+		return fmt.Errorf("token %s does not exist", transfer.Token)
+	}
+	return nil
+}
+
+// parseTokenID parses a token ID as written by Hash.String. Only the
+// canonical form is accepted, so each token has one ID.
+func parseTokenID(token string) (wire.Hash, error) {
+	id, err := wire.NewHashFromStr(token)
+	if err != nil || id.String() != token {
+		return wire.Hash{}, fmt.Errorf("invalid token ID %q", token)
+	}
+	return *id, nil
+}
+
+// recipientScript returns the output script paying address. Contracts are
+// paid to their raw address, as by call transactions.
+func recipientScript(address string) ([]byte, error) {
+	if crypto.IsContractAddress(address) {
+		return []byte(address), nil
+	}
+	return payToAddressScript(address)
+}
+
+// settleTransfers carries out the transfers of a successful execution of
+// contract. Tokens move on the token ledger. OBS is paid from the
+// contract's outputs, oldest first, into new outputs of tx numbered after
+// its own, with any change returned to the contract. The outputs spent and
+// created are recorded in exec so the block can be disconnected.
+func (b *BlockChain) settleTransfers(tx *wire.MsgTx, ledger *contractLedger, contract string, height int32, exec *ContractExecution) error {
+	total := int64(0)
+	for _, transfer := range exec.Transfers {
+		if transfer.Token == "" {
+			total += transfer.Amount
+			continue
+		}
+		id, err := parseTokenID(transfer.Token)
+		if err != nil {
+			return err
+		}
+		if err := b.tokenStore.TransferToken(id, contract, transfer.To, transfer.Amount); err != nil {
+			return fmt.Errorf("failed to transfer token %s: %v", transfer.Token, err)
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	utxos, err := ledger.outputs(contract)
+	if err != nil {
+		return err
+	}
+	funds := int64(0)
+	for _, utxo := range utxos {
+		if funds >= total {
+			break
+		}
+		if err := b.utxoSet.RemoveUTXO(utxo.TxHash, utxo.Index); err != nil {
+			return err
+		}
+		exec.Spent = append(exec.Spent, *utxo)
+		funds += utxo.Value
+	}
+	if funds < total {
+		return fmt.Errorf("contract %s cannot cover transfers of %d with %d", contract, total, funds)
+	}
+
+	txHash := tx.TxHash()
+	pay := func(to string, amount int64) error {
+		pkScript, err := recipientScript(to)
+		if err != nil {
+			return err
+		}
+		index := uint32(len(tx.TxOut) + len(exec.Payouts))
+		if err := b.utxoSet.AddUTXO(txHash, index, amount, pkScript, height); err != nil {
+			return err
+		}
+		exec.Payouts = append(exec.Payouts, UTXO{TxHash: txHash, Index: index, Value: amount, PkScript: pkScript, Height: height})
+		return nil
+	}
+	for _, transfer := range exec.Transfers {
+		if transfer.Token == "" {
+			if err := pay(transfer.To, transfer.Amount); err != nil {
+				return err
+			}
+		}
+	}
+	if change := funds - total; change > 0 {
+		return pay(contract, change)
+	}
+	return nil
+}
+
+// undoTransfers reverses the transfers settled for exec: payouts are
+// removed, the contract outputs they spent restored and token transfers
+// moved back, newest first
+func (b *BlockChain) undoTransfers(exec *ContractExecution) error {
+	for _, payout := range exec.Payouts {
+		if err := b.utxoSet.RemoveUTXO(payout.TxHash, payout.Index); err != nil {
+			return err
+		}
+	}
+	for _, utxo := range exec.Spent {
+		if err := b.utxoSet.AddUTXO(utxo.TxHash, utxo.Index, utxo.Value, utxo.PkScript, utxo.Height); err != nil {
+			return err
+		}
+	}
+
+	for i := len(exec.Transfers) - 1; i >= 0; i-- {
+		transfer := exec.Transfers[i]
+		if transfer.Token == "" {
+			continue
+		}
+		id, err := parseTokenID(transfer.Token)
+		if err != nil {
+			return err
+		}
+		if err := b.tokenStore.TransferToken(id, transfer.To, exec.Contract, transfer.Amount); err != nil {
+			return fmt.Errorf("failed to return token %s: %v", transfer.Token, err)
+		}
+	}
+	return nil
+}
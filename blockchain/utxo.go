@@ -1,8 +1,10 @@
 package blockchain
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"obsidian-core/crypto"
 	"obsidian-core/wire"
 	"sync"
 
@@ -13,6 +15,11 @@ var (
 	utxoBucketName = []byte("utxo")
 )
 
+// UTXO entry flags
+const (
+	utxoFlagCoinbase = 1 << 0
+)
+
 // UTXO represents an unspent transaction output
 type UTXO struct {
 	TxHash   wire.Hash
@@ -20,6 +27,7 @@ type UTXO struct {
 	Value    int64
 	PkScript []byte
 	Height   int32
+	Coinbase bool // Created by a coinbase transaction
 }
 
 // UTXOSet represents the UTXO set
@@ -113,6 +121,12 @@ func (u *UTXOSet) GetUTXOsForAddress(address string) ([]*UTXO, error) {
 
 	var utxos []*UTXO
 
+	// Outputs pay either to the raw address or to its P2PKH script
+	var p2pkhScript []byte
+	if pubKeyHash, err := crypto.AddressToPubKeyHash(address); err == nil {
+		p2pkhScript = CreateP2PKHScript(pubKeyHash)
+	}
+
 	err := u.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(utxoBucketName)
 		if bucket == nil {
@@ -127,7 +141,8 @@ func (u *UTXOSet) GetUTXOsForAddress(address string) ([]*UTXO, error) {
 
 			// Check if this UTXO belongs to the address
 			// This is simplified - in production you'd properly decode the script
-			if string(utxo.PkScript) == address {
+			if string(utxo.PkScript) == address ||
+				(p2pkhScript != nil && bytes.Equal(utxo.PkScript, p2pkhScript)) {
 				utxos = append(utxos, utxo)
 			}
 
@@ -153,6 +168,37 @@ func (u *UTXOSet) GetBalance(address string) (int64, error) {
 	return balance, nil
 }
 
+// TotalValue sums the value of every UTXO, separating outputs locked to the
+// given burn script
+func (u *UTXOSet) TotalValue(burnScript []byte) (total int64, burned int64, err error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	err = u.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(utxoBucketName)
+		if bucket == nil {
+			return nil // No UTXOs yet
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			utxo, err := deserializeUTXO(v)
+			if err != nil {
+				return err
+			}
+
+			if bytes.Equal(utxo.PkScript, burnScript) {
+				burned += utxo.Value
+			} else {
+				total += utxo.Value
+			}
+
+			return nil
+		})
+	})
+
+	return total, burned, err
+}
+
 // ApplyBlock applies a block's transactions to the UTXO set
 func (u *UTXOSet) ApplyBlock(block *wire.MsgBlock, height int32) error {
 	u.mu.Lock()
@@ -186,6 +232,7 @@ func (u *UTXOSet) ApplyBlock(block *wire.MsgBlock, height int32) error {
 					Value:    txOut.Value,
 					PkScript: txOut.PkScript,
 					Height:   height,
+					Coinbase: msgTx.IsCoinbase(),
 				}
 
 				data, err := serializeUTXO(&utxo)
@@ -239,6 +286,71 @@ func (u *UTXOSet) RollbackBlock(block *wire.MsgBlock) error {
 	})
 }
 
+// SpentOutputs returns the outputs of the set that a block's transactions
+// spend. Outputs created earlier in the same block are not included.
+func (u *UTXOSet) SpentOutputs(block *wire.MsgBlock) ([]*UTXO, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	var spent []*UTXO
+	err := u.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(utxoBucketName)
+		if bucket == nil {
+			return nil
+		}
+		for _, msgTx := range block.Transactions {
+			if msgTx.IsCoinbase() {
+				continue
+			}
+			for _, txIn := range msgTx.TxIn {
+				data := bucket.Get(makeUTXOKey(txIn.PreviousOutPoint.Hash, txIn.PreviousOutPoint.Index))
+				if data == nil {
+					continue
+				}
+				utxo, err := deserializeUTXO(data)
+				if err != nil {
+					return err
+				}
+				spent = append(spent, utxo)
+			}
+		}
+		return nil
+	})
+	return spent, err
+}
+
+// UndoBlock removes the outputs a block created and restores the outputs it
+// spent, as returned by SpentOutputs before the block was applied
+func (u *UTXOSet) UndoBlock(block *wire.MsgBlock, spent []*UTXO) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(utxoBucketName)
+		if err != nil {
+			return err
+		}
+		for _, msgTx := range block.Transactions {
+			txHash := msgTx.TxHash()
+			for i := range msgTx.TxOut {
+				if err := bucket.Delete(makeUTXOKey(txHash, uint32(i))); err != nil {
+					return err
+				}
+			}
+		}
+		for _, utxo := range spent {
+			data, err := serializeUTXO(utxo)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(makeUTXOKey(utxo.TxHash, utxo.Index), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Helper functions
 
 func makeUTXOKey(txHash wire.Hash, index uint32) []byte {
@@ -249,9 +361,9 @@ func makeUTXOKey(txHash wire.Hash, index uint32) []byte {
 }
 
 func serializeUTXO(utxo *UTXO) ([]byte, error) {
-	// Simple serialization: txHash(32) + index(4) + value(8) + height(4) + scriptLen(2) + script
+	// Simple serialization: txHash(32) + index(4) + value(8) + height(4) + scriptLen(2) + script + flags(1)
 	scriptLen := len(utxo.PkScript)
-	data := make([]byte, 32+4+8+4+2+scriptLen)
+	data := make([]byte, 32+4+8+4+2+scriptLen+1)
 
 	offset := 0
 	copy(data[offset:], utxo.TxHash[:])
@@ -270,6 +382,11 @@ func serializeUTXO(utxo *UTXO) ([]byte, error) {
 	offset += 2
 
 	copy(data[offset:], utxo.PkScript)
+	offset += scriptLen
+
+	if utxo.Coinbase {
+		data[offset] |= utxoFlagCoinbase
+	}
 
 	return data, nil
 }
@@ -299,6 +416,12 @@ func deserializeUTXO(data []byte) (*UTXO, error) {
 
 	utxo.PkScript = make([]byte, scriptLen)
 	copy(utxo.PkScript, data[offset:])
+	offset += int(scriptLen)
+
+	// Entries written before the flags byte was added have no flags
+	if len(data) > offset {
+		utxo.Coinbase = data[offset]&utxoFlagCoinbase != 0
+	}
 
 	return utxo, nil
 }
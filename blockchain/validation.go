@@ -1,7 +1,9 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"fmt"
 	"obsidian-core/crypto"
 	"obsidian-core/wire"
@@ -31,9 +33,13 @@ func (b *BlockChain) ValidateTransaction(tx *wire.MsgTx, utxoSet *UTXOSet) error
 	case wire.TxTypeTokenShielded:
 		return b.validateTokenShieldedTransaction(tx, utxoSet)
 	case wire.TxTypeSmartContractDeploy:
-		return b.validateSmartContractDeploy(tx)
+		if err := b.validateSmartContractDeploy(tx, utxoSet); err != nil {
+			return err
+		}
 	case wire.TxTypeSmartContractCall:
-		return b.validateSmartContractCall(tx)
+		if err := b.validateSmartContractCall(tx, utxoSet); err != nil {
+			return err
+		}
 	}
 
 	// 1. Check inputs exist and are unspent
@@ -56,6 +62,10 @@ func (b *BlockChain) ValidateTransaction(tx *wire.MsgTx, utxoSet *UTXOSet) error
 		if txOut.Value < 0 {
 			return fmt.Errorf("negative output value")
 		}
+		// Only a call can pay a contract, and only the one it calls
+		if crypto.IsContractAddress(string(txOut.PkScript)) && !isCallTo(tx, string(txOut.PkScript)) {
+			return fmt.Errorf("output pays contract %s outside a call to it", txOut.PkScript)
+		}
 		// Check for overflow
 		if totalOutput > 0 && txOut.Value > (int64(^uint64(0)>>1)-totalOutput) {
 			return fmt.Errorf("output value overflow")
@@ -63,6 +73,13 @@ func (b *BlockChain) ValidateTransaction(tx *wire.MsgTx, utxoSet *UTXOSet) error
 		totalOutput += txOut.Value
 	}
 
+	// Value leaving the shielded pool funds transparent outputs and fees,
+	// value entering it is paid for by transparent inputs
+	if tx.ValueBalance > 0 && totalInput > (int64(^uint64(0)>>1)-tx.ValueBalance) {
+		return fmt.Errorf("input value overflow")
+	}
+	totalInput += tx.ValueBalance
+
 	// 3. Check input >= output (difference is fee)
 	if totalInput < totalOutput {
 		return fmt.Errorf("input value less than output value")
@@ -85,6 +102,17 @@ func (b *BlockChain) ValidateTransaction(tx *wire.MsgTx, utxoSet *UTXOSet) error
 	if maxFee < 100000 {       // At least 0.001 OB max fee
 		maxFee = 100000
 	}
+
+	// Contract transactions prepay their whole gas limit
+	if tx.TxType == wire.TxTypeSmartContractDeploy || tx.TxType == wire.TxTypeSmartContractCall {
+		gasFee := int64(tx.GasLimit) * tx.GasPrice
+		if fee < gasFee {
+			return fmt.Errorf("fee %d does not cover gas limit %d at price %d", fee, tx.GasLimit, tx.GasPrice)
+		}
+		if maxFee < gasFee {
+			maxFee = gasFee
+		}
+	}
 	if fee > maxFee {
 		return fmt.Errorf("fee too high: %d (max: %d)", fee, maxFee)
 	}
@@ -147,6 +175,15 @@ func (b *BlockChain) calculateSignatureHash(tx *wire.MsgTx, inputIndex int, prev
 	// LockTime
 	data = append(data, byte(tx.LockTime), byte(tx.LockTime>>8), byte(tx.LockTime>>16), byte(tx.LockTime>>24))
 
+	// Contract transactions also commit to their payload and gas terms, so a
+	// call cannot be redirected after signing
+	if tx.TxType == wire.TxTypeSmartContractDeploy || tx.TxType == wire.TxTypeSmartContractCall {
+		data = append(data, byte(tx.TxType))
+		data = binary.LittleEndian.AppendUint64(data, tx.GasLimit)
+		data = binary.LittleEndian.AppendUint64(data, uint64(tx.GasPrice))
+		data = append(data, crypto.Hash256(tx.Memo)...)
+	}
+
 	// SIGHASH type (SIGHASH_ALL = 1)
 	data = append(data, 0x01, 0x00, 0x00, 0x00)
 
@@ -219,6 +256,18 @@ func verifyPubKeyHash(script []byte, pubKeyHash []byte) error {
 	// Simplified P2PKH verification
 	// Format: OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
 
+	// Coinbase and legacy outputs pay to the raw address string
+	if crypto.IsTransparentAddress(string(script)) {
+		addrHash, err := crypto.AddressToPubKeyHash(string(script))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(addrHash, pubKeyHash) {
+			return fmt.Errorf("public key hash mismatch")
+		}
+		return nil
+	}
+
 	if len(script) < 25 {
 		return fmt.Errorf("invalid script length")
 	}
@@ -262,31 +311,39 @@ func (b *BlockChain) SignTransaction(tx *wire.MsgTx, privateKey *ecdsa.PrivateKe
 			return fmt.Errorf("UTXO not found for input %d: %v", i, err)
 		}
 
-		// Calculate signature hash
-		sigHash := b.calculateSignatureHash(tx, i, utxo.PkScript)
-
-		// Sign the hash
-		signature, err := crypto.Sign(privateKey, sigHash)
-		if err != nil {
-			return fmt.Errorf("failed to sign input %d: %v", i, err)
+		if err := b.signInput(tx, i, utxo.PkScript, privateKey); err != nil {
+			return err
 		}
+	}
 
-		// Append SIGHASH type
-		signature = append(signature, 0x01) // SIGHASH_ALL
-
-		// Create signature script: <signature> <pubkey>
-		pubKey := &privateKey.PublicKey
-		pubKeyBytes := crypto.PublicKeyToBytes(pubKey)
+	return nil
+}
 
-		sigScript := make([]byte, 0, len(signature)+len(pubKeyBytes)+2)
-		sigScript = append(sigScript, byte(len(signature)))
-		sigScript = append(sigScript, signature...)
-		sigScript = append(sigScript, byte(len(pubKeyBytes)))
-		sigScript = append(sigScript, pubKeyBytes...)
+// signInput signs a single input spending an output locked by prevPkScript
+func (b *BlockChain) signInput(tx *wire.MsgTx, i int, prevPkScript []byte, privateKey *ecdsa.PrivateKey) error {
+	// Calculate signature hash
+	sigHash := b.calculateSignatureHash(tx, i, prevPkScript)
 
-		txIn.SignatureScript = sigScript
+	// Sign the hash
+	signature, err := crypto.Sign(privateKey, sigHash)
+	if err != nil {
+		return fmt.Errorf("failed to sign input %d: %v", i, err)
 	}
 
+	// Append SIGHASH type
+	signature = append(signature, 0x01) // SIGHASH_ALL
+
+	// Create signature script: <signature> <pubkey>
+	pubKey := &privateKey.PublicKey
+	pubKeyBytes := crypto.PublicKeyToBytes(pubKey)
+
+	sigScript := make([]byte, 0, len(signature)+len(pubKeyBytes)+2)
+	sigScript = append(sigScript, byte(len(signature)))
+	sigScript = append(sigScript, signature...)
+	sigScript = append(sigScript, byte(len(pubKeyBytes)))
+	sigScript = append(sigScript, pubKeyBytes...)
+
+	tx.TxIn[i].SignatureScript = sigScript
 	return nil
 }
 
@@ -310,7 +367,61 @@ func (b *BlockChain) CalculateTransactionFee(tx *wire.MsgTx, utxoSet *UTXOSet) (
 		totalOutput += txOut.Value
 	}
 
-	return totalInput - totalOutput, nil
+	return totalInput + tx.ValueBalance - totalOutput, nil
+}
+
+// AcceptTransaction validates a loose transaction against the current chain
+// state and adds it to the mempool. It returns the fee paid.
+func (b *BlockChain) AcceptTransaction(tx *wire.MsgTx) (int64, error) {
+	fee, err := b.checkLooseTransaction(tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.mempool.AddTransaction(tx, b.Height(), fee); err != nil {
+		return 0, err
+	}
+	return fee, nil
+}
+
+// AcceptStemTransaction validates a loose transaction like
+// AcceptTransaction but adds it to the mempool's Dandelion stem pool, where
+// it stays private until fluffed.
+func (b *BlockChain) AcceptStemTransaction(tx *wire.MsgTx) (int64, error) {
+	fee, err := b.checkLooseTransaction(tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.mempool.AddStemTransaction(tx, b.Height(), fee); err != nil {
+		return 0, err
+	}
+	return fee, nil
+}
+
+// checkLooseTransaction validates a transaction for the mempool and returns
+// its fee
+func (b *BlockChain) checkLooseTransaction(tx *wire.MsgTx) (int64, error) {
+	if tx.IsCoinbase() {
+		return 0, fmt.Errorf("coinbase transactions are only valid in blocks")
+	}
+
+	for _, txIn := range tx.TxIn {
+		if b.mempool.IsSpent(txIn.PreviousOutPoint) {
+			return 0, fmt.Errorf("input %s:%d already spent by a mempool transaction",
+				txIn.PreviousOutPoint.Hash.String(), txIn.PreviousOutPoint.Index)
+		}
+	}
+
+	if tx.IsShielded() {
+		if err := b.shieldedPool.ValidateShieldedTransaction(tx); err != nil {
+			return 0, fmt.Errorf("invalid shielded transaction: %v", err)
+		}
+	}
+
+	if err := b.ValidateTransaction(tx, b.utxoSet); err != nil {
+		return 0, err
+	}
+
+	return b.CalculateTransactionFee(tx, b.utxoSet)
 }
 
 // validateTokenIssueTransaction validates a token issuance transaction
@@ -2,6 +2,9 @@ package chaincfg
 
 import "obsidian-core/wire"
 
+// BurnAddress is the provably unspendable address that burned OBS is sent to.
+const BurnAddress = "obsBURNXXXXXXXXXXXXXXXXXXXXXXXXXXXXX"
+
 // CalcBlockSubsidy calculates the block reward based on block height.
 // The reward halves every HalvingInterval blocks until it reaches MinimumBlockReward.
 // Additionally adds redistribution of burned coins.
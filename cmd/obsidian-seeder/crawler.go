@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"obsidian-core/chaincfg"
+	"obsidian-core/network"
+	"sync"
+	"time"
+)
+
+const (
+	seederUserAgent = "Obsidian-Seeder/1.0.0"
+	crawlTimeout    = 15 * time.Second // Handshake and getaddr, per node
+	recrawlInterval = 15 * time.Minute // How often good nodes are checked
+	healthyWindow   = time.Hour        // Nodes checked since are served
+	maxFailures     = 8                // Consecutive failures before forgetting a node
+	crawlWorkers    = 32
+	maxKnownNodes   = 20000
+)
+
+// node is a peer known to the seeder.
+type node struct {
+	addr        string
+	services    network.ServiceFlag
+	height      int32
+	userAgent   string
+	lastTry     time.Time
+	lastSuccess time.Time
+	failures    int
+}
+
+// due reports whether the node should be crawled. Failing nodes back off
+// by one recrawl interval per failure.
+func (n *node) due(now time.Time) bool {
+	return now.Sub(n.lastTry) >= recrawlInterval*time.Duration(n.failures+1)
+}
+
+// healthy reports whether the node answered its last crawl recently and
+// offers services.
+func (n *node) healthy(now time.Time, services network.ServiceFlag) bool {
+	return n.failures == 0 && now.Sub(n.lastSuccess) < healthyWindow && n.services&services == services
+}
+
+// Seeder crawls the network for reachable nodes.
+type Seeder struct {
+	params *chaincfg.Params
+	dial   func(addr string) (net.Conn, error)
+
+	mu    sync.RWMutex
+	nodes map[string]*node
+}
+
+// NewSeeder returns a seeder crawling from the given nodes.
+func NewSeeder(params *chaincfg.Params, seeds []string) *Seeder {
+	s := &Seeder{
+		params: params,
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, crawlTimeout)
+		},
+		nodes: make(map[string]*node),
+	}
+	s.addNodes(seeds)
+	return s
+}
+
+// addNodes adds addresses not yet known.
+func (s *Seeder) addNodes(addrs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			continue
+		}
+		if _, ok := s.nodes[addr]; !ok && len(s.nodes) < maxKnownNodes {
+			s.nodes[addr] = &node{addr: addr}
+		}
+	}
+}
+
+// Run crawls the network until quit is closed.
+func (s *Seeder) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		s.CrawlOnce()
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CrawlOnce crawls every node that is due, in parallel.
+func (s *Seeder) CrawlOnce() {
+	now := time.Now()
+	s.mu.RLock()
+	var due []string
+	for addr, n := range s.nodes {
+		if n.due(now) {
+			due = append(due, addr)
+		}
+	}
+	s.mu.RUnlock()
+
+	sem := make(chan struct{}, crawlWorkers)
+	var wg sync.WaitGroup
+	for _, addr := range due {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			version, addrs, err := s.crawlNode(addr)
+			s.record(addr, version, err)
+			s.addNodes(addrs)
+		}(addr)
+	}
+	wg.Wait()
+
+	good, total := s.Counts()
+	fmt.Printf("[SEEDER] Crawled %d nodes, %d of %d known are healthy\n", len(due), good, total)
+}
+
+// record stores the outcome of crawling addr.
+func (s *Seeder) record(addr string, version *network.VersionMessage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[addr]
+	if !ok {
+		return
+	}
+	n.lastTry = time.Now()
+	if err != nil {
+		n.failures++
+		if n.failures >= maxFailures {
+			delete(s.nodes, addr)
+		}
+		return
+	}
+	n.failures = 0
+	n.lastSuccess = n.lastTry
+	n.services = version.Services
+	n.height = version.Height
+	n.userAgent = version.UserAgent
+}
+
+// crawlNode performs a handshake with addr and asks for its addresses. A
+// node that completes the handshake counts as reachable even if it sends
+// no addresses.
+func (s *Seeder) crawlNode(addr string) (*network.VersionMessage, []string, error) {
+	conn, err := s.dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer := network.NewPeer(conn, addr, false, s.params.Net)
+	defer peer.Disconnect()
+
+	err = peer.SendMessage(network.MsgTypeVersion, &network.VersionMessage{
+		Version:   network.ProtocolVersion,
+		Timestamp: time.Now().Unix(),
+		UserAgent: seederUserAgent,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var version *network.VersionMessage
+	verAcked := false
+	deadline := time.Now().Add(crawlTimeout)
+	for time.Now().Before(deadline) {
+		msg, err := peer.ReceiveMessageWithTimeout(time.Until(deadline))
+		if err != nil {
+			break
+		}
+		switch msg.Type {
+		case network.MsgTypeVersion:
+			version = &network.VersionMessage{}
+			if err := network.DecodePayload(msg, version, network.ProtocolVersion); err != nil {
+				return nil, nil, err
+			}
+			if version.Version < network.MinProtocolVersion {
+				return nil, nil, fmt.Errorf("protocol version %d too old", version.Version)
+			}
+			peer.SendMessage(network.MsgTypeVerAck, &network.VerAckMessage{})
+		case network.MsgTypeVerAck:
+			verAcked = true
+			peer.SendMessage(network.MsgTypeGetAddr, &network.GetAddrMessage{})
+		case network.MsgTypePing:
+			ping := &network.PingMessage{}
+			if network.DecodePayload(msg, ping, network.ProtocolVersion) == nil {
+				peer.SendMessage(network.MsgTypePong, &network.PongMessage{Nonce: ping.Nonce})
+			}
+		case network.MsgTypeAddr:
+			addrMsg := &network.AddrMessage{}
+			if err := network.DecodePayload(msg, addrMsg, network.ProtocolVersion); err != nil {
+				return nil, nil, err
+			}
+			if version != nil && verAcked {
+				return version, addrMsg.Addresses, nil
+			}
+		}
+	}
+
+	if version == nil || !verAcked {
+		return nil, nil, fmt.Errorf("handshake with %s did not complete", addr)
+	}
+	return version, nil, nil
+}
+
+// HealthyIPs returns the addresses of up to max healthy nodes offering
+// services, of the IPv4 or IPv6 family, in random order. Only nodes on
+// the default port are returned since DNS answers cannot carry ports.
+func (s *Seeder) HealthyIPs(services network.ServiceFlag, ipv6 bool, max int) []net.IP {
+	now := time.Now()
+	s.mu.RLock()
+	var ips []net.IP
+	for addr, n := range s.nodes {
+		if !n.healthy(now, services) {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || port != s.params.DefaultPort || (ip.To4() == nil) != ipv6 {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	s.mu.RUnlock()
+
+	shuffleIPs(ips)
+	if len(ips) > max {
+		ips = ips[:max]
+	}
+	return ips
+}
+
+// Counts returns the number of healthy full nodes and of known nodes.
+func (s *Seeder) Counts() (int, int) {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	good := 0
+	for _, n := range s.nodes {
+		if n.healthy(now, network.SFNodeNetwork) {
+			good++
+		}
+	}
+	return good, len(s.nodes)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"obsidian-core/network"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTTL         = 60
+	maxIPv4Answers = 25 // Keeps answers within a 512 byte UDP response
+	maxIPv6Answers = 12
+)
+
+// DNSServer answers A and AAAA queries for a zone with healthy nodes from
+// the seeder. Names of the form x<hex>.zone ask for nodes offering those
+// service bits.
+type DNSServer struct {
+	zone   string
+	seeder *Seeder
+}
+
+// NewDNSServer returns a server for zone.
+func NewDNSServer(zone string, seeder *Seeder) *DNSServer {
+	return &DNSServer{zone: zone, seeder: seeder}
+}
+
+// Serve answers queries on conn until it is closed.
+func (d *DNSServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp, err := d.handle(buf[:n])
+		if err != nil {
+			fmt.Printf("[SEEDER] Dropping query from %s: %v\n", addr, err)
+			continue
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+// handle builds the response to a query.
+func (d *DNSServer) handle(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, fmt.Errorf("not a query")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	respHeader := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+		RCode:            dnsmessage.RCodeSuccess,
+	}
+
+	var ips []net.IP
+	services, ok := network.ParseSeedQueryHost(q.Name.String(), d.zone)
+	switch {
+	case !ok:
+		respHeader.RCode = dnsmessage.RCodeNameError
+	case q.Class != dnsmessage.ClassINET:
+	case q.Type == dnsmessage.TypeA:
+		ips = d.seeder.HealthyIPs(services, false, maxIPv4Answers)
+	case q.Type == dnsmessage.TypeAAAA:
+		ips = d.seeder.HealthyIPs(services, true, maxIPv6Answers)
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), respHeader)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			err = b.AResource(rh, a)
+		} else {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			err = b.AAAAResource(rh, aaaa)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// shuffleIPs puts ips in random order so clients spread over the nodes
+func shuffleIPs(ips []net.IP) {
+	rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+}
@@ -0,0 +1,56 @@
+// Command obsidian-seeder crawls the Obsidian network and serves the
+// addresses of healthy nodes over DNS, for use as a chaincfg DNS seed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"obsidian-core/chaincfg"
+)
+
+func main() {
+	zone := flag.String("zone", "", "DNS zone to answer for, e.g. seed.example.com")
+	listen := flag.String("listen", ":53", "UDP address to serve DNS on")
+	seeds := flag.String("seeds", os.Getenv("SEED_NODES"), "Comma-separated host:port nodes to start crawling from")
+	flag.Parse()
+
+	if *zone == "" || *seeds == "" {
+		fmt.Fprintln(os.Stderr, "obsidian-seeder: -zone and -seeds are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var initial []string
+	for _, seed := range strings.Split(*seeds, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			initial = append(initial, seed)
+		}
+	}
+
+	params := chaincfg.MainNetParams
+	seeder := NewSeeder(&params, initial)
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "obsidian-seeder: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	quit := make(chan struct{})
+	go seeder.Run(quit)
+	go NewDNSServer(*zone, seeder).Serve(conn)
+	fmt.Printf("[SEEDER] Serving %s on %s, crawling from %d nodes\n", *zone, conn.LocalAddr(), len(initial))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	close(quit)
+	fmt.Println("[SEEDER] Shutting down")
+}
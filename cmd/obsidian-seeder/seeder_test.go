@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"obsidian-core/chaincfg"
+	"obsidian-core/network"
+	"testing"
+)
+
+// startFakeNode runs a node that completes one handshake per connection
+// and answers getaddr with addrs, returning its address
+func startFakeNode(t *testing.T, magic uint32, services network.ServiceFlag, addrs []string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				peer := network.NewPeer(conn, conn.RemoteAddr().String(), true, magic)
+				defer peer.Disconnect()
+				for {
+					msg, err := peer.ReceiveMessage()
+					if err != nil {
+						return
+					}
+					switch msg.Type {
+					case network.MsgTypeVersion:
+						peer.SendMessage(network.MsgTypeVersion, &network.VersionMessage{
+							Version: network.ProtocolVersion, Height: 10, Services: services, UserAgent: "fake",
+						})
+						peer.SendMessage(network.MsgTypeVerAck, &network.VerAckMessage{})
+					case network.MsgTypeGetAddr:
+						peer.SendMessage(network.MsgTypeAddr, &network.AddrMessage{Addresses: addrs})
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startDNS serves the seeder's zone on a local UDP port and returns a
+// resolver that queries it
+func startDNS(t *testing.T, zone string, seeder *Seeder) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go NewDNSServer(zone, seeder).Serve(conn)
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestSeederCrawlAndServe(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	params := chaincfg.MainNetParams
+	nodeAddr := startFakeNode(t, params.Net, network.SFNodeNetwork|network.SFNodeBloom, []string{"8.8.8.8:8333"})
+	_, port, _ := net.SplitHostPort(nodeAddr)
+	params.DefaultPort = port
+
+	// An unreachable node is counted as a failure
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := closed.Addr().String()
+	closed.Close()
+
+	seeder := NewSeeder(&params, []string{nodeAddr, deadAddr})
+	seeder.CrawlOnce()
+	if good, total := seeder.Counts(); good != 1 || total != 3 {
+		t.Fatalf("Expected 1 healthy of 3 known nodes, got %d of %d", good, total)
+	}
+	if seeder.nodes[deadAddr].failures != 1 {
+		t.Error("Unreachable node not recorded as failing")
+	}
+	if n := seeder.nodes[nodeAddr]; n.height != 10 || n.userAgent != "fake" {
+		t.Errorf("Unexpected node info %+v", n)
+	}
+
+	// A node resolves the seed through the in-process DNS server
+	zone := "seed.obsidian.test"
+	resolver := startDNS(t, zone, seeder)
+	params.DNSSeeds = []string{zone}
+	pm := network.NewPeerManager(&params, nil)
+	pm.SetResolver(resolver)
+	peers := pm.DiscoverPeers()
+	if len(peers) != 1 || peers[0] != nodeAddr {
+		t.Fatalf("Discovered %v, expected %s", peers, nodeAddr)
+	}
+
+	// Service bits in the subdomain filter the answer
+	ips, err := resolver.LookupIP(context.Background(), "ip4", network.SeedQueryHost(zone, network.SFNodeNetwork|network.SFNodeBloom))
+	if err != nil || len(ips) != 1 {
+		t.Errorf("Bloom nodes lookup = %v, %v", ips, err)
+	}
+	pm.SetRequiredServices(network.SFNodeNetwork | network.SFNodeCF)
+	if peers := pm.DiscoverPeers(); len(peers) != 0 {
+		t.Errorf("Compact filter nodes lookup returned %v", peers)
+	}
+	if _, err := resolver.LookupIP(context.Background(), "ip4", "other.test"); err == nil {
+		t.Error("Answered for a name outside the zone")
+	}
+}
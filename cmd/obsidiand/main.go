@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"os/signal"
@@ -114,8 +115,33 @@ func main() {
 	}
 	defer chain.Close()
 
+	// Build compact block filters in the background
+	if cfg.CFIndex {
+		if err := chain.EnableFilterIndex(cfg.CFIndexRebuild); err != nil {
+			logrus.Fatalf("Failed to enable compact filter index: %v", err)
+		}
+	}
+
 	// Initialize P2P Sync Manager
 	syncManager := network.NewSyncManager(chain, peerManager, pow)
+
+	// Encrypt connections with the v2 transport, proving a persistent key
+	// only to peers that trust it
+	identity, err := network.LoadIdentityKey(network.IdentityKeyPath())
+	if err != nil {
+		logrus.Fatalf("Failed to load P2P identity key: %v", err)
+	}
+	trustedKeys, err := network.ParseTrustedKeys(cfg.TrustedKeys)
+	if err != nil {
+		logrus.Fatalf("Invalid P2P_TRUSTED_KEYS: %v", err)
+	}
+	syncManager.SetTransport(network.TransportConfig{
+		V2:          cfg.V2Transport,
+		Identity:    identity,
+		TrustedKeys: trustedKeys,
+		TrustedOnly: cfg.TrustedOnly,
+	})
+	logrus.Infof("P2P identity key: %x", []byte(identity.Public().(ed25519.PublicKey)))
 	if err := syncManager.Start(); err != nil {
 		logrus.Errorf("Failed to start sync manager: %v", err)
 	}
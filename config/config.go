@@ -22,6 +22,9 @@ type Config struct {
 	ConnectTimeout time.Duration
 	MessageTimeout time.Duration
 	MaxMessageSize int
+	V2Transport    bool   // Offer encrypted v2 connections
+	TrustedKeys    string // Comma-separated hex identity keys of trusted peers
+	TrustedOnly    bool   // Only connect to peers proving a trusted key
 
 	// RPC
 	RPCAddr string
@@ -35,6 +38,10 @@ type Config struct {
 	// Database
 	DataDir string
 
+	// Indexes
+	CFIndex        bool // Index and serve compact block filters
+	CFIndexRebuild bool // Rebuild the compact filter index at startup
+
 	// Tor
 	TorEnabled   bool
 	TorProxyAddr string
@@ -57,6 +64,9 @@ func Load() *Config {
 		ConnectTimeout: getEnvDuration("CONNECT_TIMEOUT", 30*time.Second),
 		MessageTimeout: getEnvDuration("MESSAGE_TIMEOUT", 300*time.Second),
 		MaxMessageSize: getEnvInt("MAX_MESSAGE_SIZE", 10*1024*1024), // 10MB
+		V2Transport:    getEnvBool("P2P_V2_TRANSPORT", true),
+		TrustedKeys:    getEnv("P2P_TRUSTED_KEYS", ""),
+		TrustedOnly:    getEnvBool("P2P_TRUSTED_ONLY", false),
 
 		RPCAddr: getEnv("RPC_ADDR", "0.0.0.0:8545"),
 
@@ -67,6 +77,9 @@ func Load() *Config {
 
 		DataDir: getEnv("DATA_DIR", "."),
 
+		CFIndex:        getEnvBool("CF_INDEX", false),
+		CFIndexRebuild: getEnvBool("CF_INDEX_REBUILD", false),
+
 		TorEnabled:   getEnvBool("TOR_ENABLED", false),
 		TorProxyAddr: getEnv("TOR_PROXY_ADDR", "127.0.0.1:9050"),
 
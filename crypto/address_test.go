@@ -122,3 +122,34 @@ func TestAddressTypeConstants(t *testing.T) {
 		t.Error("AddressTypeTransparent should not equal AddressTypeShielded")
 	}
 }
+
+func TestAddressToPubKeyHash(t *testing.T) {
+	_, pubKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+
+	address := KeyToAddress(pubKey)
+	hash, err := AddressToPubKeyHash(address)
+	if err != nil {
+		t.Fatalf("AddressToPubKeyHash(%s) failed: %v", address, err)
+	}
+
+	expected := Hash160(PublicKeyToBytes(pubKey))
+	if string(hash) != string(expected) {
+		t.Errorf("AddressToPubKeyHash = %x, want %x", hash, expected)
+	}
+
+	// Corrupt the last character to break the checksum
+	corrupted := address[:len(address)-1] + "1"
+	if corrupted == address {
+		corrupted = address[:len(address)-1] + "2"
+	}
+	if _, err := AddressToPubKeyHash(corrupted); err == nil {
+		t.Error("expected checksum error for corrupted address")
+	}
+
+	if _, err := AddressToPubKeyHash("zobs1abc123"); err == nil {
+		t.Error("expected error for shielded address")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/asn1"
+	"encoding/binary"
 	"fmt"
 	"math/big"
 
@@ -126,6 +127,44 @@ func KeyToAddress(pubKey *ecdsa.PublicKey) string {
 	return "obs" + base58.Encode(fullHash)
 }
 
+// AddressToPubKeyHash decodes an address created by KeyToAddress back into
+// its public key hash, verifying the checksum
+func AddressToPubKeyHash(address string) ([]byte, error) {
+	if len(address) < 3 || address[:3] != "obs" {
+		return nil, fmt.Errorf("not a transparent address")
+	}
+
+	decoded := base58.Decode(address[3:])
+	if len(decoded) != 1+20+4 {
+		return nil, fmt.Errorf("invalid address length")
+	}
+
+	versionedHash := decoded[:21]
+	checksum := Hash256(versionedHash)[:4]
+	for i := 0; i < 4; i++ {
+		if decoded[21+i] != checksum[i] {
+			return nil, fmt.Errorf("invalid address checksum")
+		}
+	}
+
+	return versionedHash[1:], nil
+}
+
+// ContractAddress derives the address of the contract deployed by deployer
+// with the given deployment nonce
+func ContractAddress(deployer string, nonce uint64) string {
+	data := make([]byte, 0, len(deployer)+8)
+	data = append(data, deployer...)
+	data = binary.BigEndian.AppendUint64(data, nonce)
+	hash := Hash160(data)
+
+	// Add version byte (0x08 for contracts)
+	versionedHash := append([]byte{0x08}, hash...)
+	checksum := Hash256(versionedHash)[:4]
+	fullHash := append(versionedHash, checksum...)
+	return "obc" + base58.Encode(fullHash)
+}
+
 // GenerateShieldedAddress generates a shielded address (simplified as zobs prefix)
 func GenerateShieldedAddress(pubKey *ecdsa.PublicKey) string {
 	transparentAddr := KeyToAddress(pubKey)
@@ -438,6 +477,7 @@ const (
 	AddressTypeUnknown AddressType = iota
 	AddressTypeTransparent
 	AddressTypeShielded
+	AddressTypeContract
 )
 
 // GetAddressType determines if an address is transparent or shielded
@@ -454,6 +494,10 @@ func GetAddressType(address string) AddressType {
 		return AddressTypeShielded
 	}
 
+	if address[:3] == "obc" {
+		return AddressTypeContract
+	}
+
 	return AddressTypeUnknown
 }
 
@@ -462,6 +506,11 @@ func IsTransparentAddress(address string) bool {
 	return GetAddressType(address) == AddressTypeTransparent
 }
 
+// IsContractAddress checks if an address is a contract address
+func IsContractAddress(address string) bool {
+	return GetAddressType(address) == AddressTypeContract
+}
+
 // IsShieldedAddress checks if an address is shielded
 func IsShieldedAddress(address string) bool {
 	return GetAddressType(address) == AddressTypeShielded
@@ -132,3 +132,8 @@ func (s *Storage) Delete(bucket, key []byte) error {
 		return b.Delete(key)
 	})
 }
+
+// NewStorageWithDB wraps an already open bolt database
+func NewStorageWithDB(db *bbolt.DB) *Storage {
+	return &Storage{db: db}
+}
@@ -13,6 +13,7 @@ import (
 type BlockBroadcaster interface {
 	BroadcastBlock(block *wire.MsgBlock)
 	GetPeerCount() int
+	IsSyncing() bool
 }
 
 type CPUMiner struct {
@@ -88,6 +89,13 @@ func (m *CPUMiner) Start() {
 			return
 		default:
 		}
+
+		// Blocks mined on a stale tip during initial sync would be orphaned
+		if m.syncManager != nil && m.syncManager.IsSyncing() {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
 		// 1. Get Best Block
 		best, err := m.chain.BestBlock()
 		if err != nil {
@@ -119,11 +127,20 @@ func (m *CPUMiner) Start() {
 		if mempool != nil {
 			// Get transactions by priority (fee per KB)
 			pendingTxs := mempool.GetTransactionsByPriority(100) // Max 100 txs per block
+			blockGas := uint64(0)
 			for _, tx := range pendingTxs {
 				// Skip coinbase transactions
-				if !tx.IsCoinbase() {
-					newBlock.AddTransaction(tx)
+				if tx.IsCoinbase() {
+					continue
+				}
+				// Leave out contracts that would overflow the block gas limit
+				if tx.TxType == wire.TxTypeSmartContractDeploy || tx.TxType == wire.TxTypeSmartContractCall {
+					if blockGas+tx.GasLimit > m.params.BlockGasLimit {
+						continue
+					}
+					blockGas += tx.GasLimit
 				}
+				newBlock.AddTransaction(tx)
 			}
 		}
 
@@ -138,6 +155,9 @@ func (m *CPUMiner) Start() {
 		coinbaseTx := wire.NewCoinbaseTx(currentHeight, totalReward, m.minerAddr)
 		newBlock.AddTransaction(coinbaseTx)
 
+		// Commit to the transactions so SPV clients can verify merkle proofs
+		newBlock.Header.MerkleRoot = wire.BlockMerkleRoot(newBlock)
+
 		// 3. Solve PoW
 		fmt.Printf("Mining block at height %d...\n", currentHeight)
 
@@ -0,0 +1,553 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address manager sizing and policy. Addresses are spread over buckets by
+// netgroup using a secret key, so a peer cannot choose which slots its
+// addresses land in, and a single netgroup can only fill a few buckets.
+const (
+	NewBucketCount       = 1024 // Buckets of addresses heard about
+	TriedBucketCount     = 256  // Buckets of addresses we have connected to
+	BucketSize           = 64   // Addresses per bucket
+	newBucketsPerGroup   = 64   // New buckets one source group can reach
+	triedBucketsPerGroup = 8    // Tried buckets one netgroup can reach
+
+	PeersFileName    = "peers.json"
+	MaxAnchors       = 2 // Outbound peers reconnected first after a restart
+	FeelerInterval   = 2 * time.Minute
+	AddrSaveInterval = 15 * time.Minute
+
+	addrHorizon       = 30 * 24 * time.Hour // Addresses unseen for longer are stale
+	addrRetries       = 3                   // Failures before a never-tried address is dropped
+	addrMaxFailures   = 10                  // Failures before a tried address is dropped
+	addrMinFailPeriod = 7 * 24 * time.Hour  // Without a success, for at least this long
+	getAddrMaxPct     = 23                  // Percent of known addresses in a getaddr reply
+)
+
+// KnownAddress is a peer address tracked by the address manager.
+type KnownAddress struct {
+	Addr        string    `json:"addr"`
+	Source      string    `json:"source"` // Peer or seed we heard it from
+	Tried       bool      `json:"tried"`
+	LastSeen    time.Time `json:"lastseen"`
+	LastAttempt time.Time `json:"lastattempt"`
+	LastSuccess time.Time `json:"lastsuccess"`
+	Attempts    int       `json:"attempts"` // Failed attempts since the last success
+
+	bucket, slot int // Position in its table
+}
+
+// isTerrible reports whether the address is not worth keeping: stale,
+// or repeatedly unreachable.
+func (ka *KnownAddress) isTerrible(now time.Time) bool {
+	if now.Sub(ka.LastAttempt) < time.Minute {
+		return false // Never evict what we are connecting to
+	}
+	if now.Sub(ka.LastSeen) > addrHorizon {
+		return true
+	}
+	if ka.LastSuccess.IsZero() && ka.Attempts >= addrRetries {
+		return true
+	}
+	return now.Sub(ka.LastSuccess) > addrMinFailPeriod && ka.Attempts >= addrMaxFailures
+}
+
+// chance returns the relative odds of selecting the address, lowered by
+// recent attempts and repeated failures.
+func (ka *KnownAddress) chance(now time.Time) float64 {
+	c := 1.0
+	if now.Sub(ka.LastAttempt) < 10*time.Minute {
+		c *= 0.01
+	}
+	for i := 0; i < ka.Attempts && i < 8; i++ {
+		c *= 0.66
+	}
+	return c
+}
+
+// AddrManager keeps the addresses of potential peers in a "new" table of
+// addresses heard about and a "tried" table of addresses we have connected
+// to, persisted in the peers file. Each address occupies one slot; when a
+// slot is contended the established or better address keeps it.
+type AddrManager struct {
+	mu      sync.Mutex
+	path    string
+	key     [32]byte
+	addrs   map[string]*KnownAddress
+	newTbl  [NewBucketCount][BucketSize]*KnownAddress
+	tried   [TriedBucketCount][BucketSize]*KnownAddress
+	nNew    int
+	nTried  int
+	anchors []string
+	rand    *mrand.Rand
+}
+
+// NewAddrManager returns an empty address manager saved at path.
+func NewAddrManager(path string) *AddrManager {
+	am := &AddrManager{
+		path:  path,
+		addrs: make(map[string]*KnownAddress),
+		rand:  mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}
+	rand.Read(am.key[:])
+	return am
+}
+
+// netGroup returns the group an address is bucketed by: the /16 of IPv4
+// addresses, the /32 of IPv6 addresses, and the host itself for names.
+func netGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if strings.HasSuffix(host, ".onion") {
+		return "onion:" + host[:1]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "host:" + host
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() {
+		return "local"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d", ip4[0], ip4[1])
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// keyedHash hashes parts under the secret key
+func (am *AddrManager) keyedHash(parts ...string) uint64 {
+	h := sha256.New()
+	h.Write(am.key[:])
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// newPosition returns the new table slot of addr heard about from source.
+// Addresses from one source group map to a limited set of buckets.
+func (am *AddrManager) newPosition(addr, source string) (int, int) {
+	srcGroup := netGroup(source)
+	n := am.keyedHash(netGroup(addr), srcGroup) % newBucketsPerGroup
+	bucket := int(am.keyedHash(srcGroup, fmt.Sprint(n)) % NewBucketCount)
+	slot := int(am.keyedHash("new", fmt.Sprint(bucket), addr) % BucketSize)
+	return bucket, slot
+}
+
+// triedPosition returns the tried table slot of addr. Addresses from one
+// netgroup map to a limited set of buckets.
+func (am *AddrManager) triedPosition(addr string) (int, int) {
+	n := am.keyedHash(addr) % triedBucketsPerGroup
+	bucket := int(am.keyedHash(netGroup(addr), fmt.Sprint(n)) % TriedBucketCount)
+	slot := int(am.keyedHash("tried", fmt.Sprint(bucket), addr) % BucketSize)
+	return bucket, slot
+}
+
+// AddAddresses adds addresses heard about from source to the new table.
+// It returns how many were not known before.
+func (am *AddrManager) AddAddresses(addrs []string, source string) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := time.Now()
+	added := 0
+	for _, addr := range addrs {
+		if addr == "" || addr == source {
+			continue
+		}
+		if ka, ok := am.addrs[addr]; ok {
+			ka.LastSeen = now
+			continue
+		}
+		if am.placeNew(&KnownAddress{Addr: addr, Source: source, LastSeen: now}, now) {
+			added++
+		}
+	}
+	return added
+}
+
+// placeNew puts ka in its new table slot, evicting a terrible occupant.
+// It reports whether ka was placed.
+func (am *AddrManager) placeNew(ka *KnownAddress, now time.Time) bool {
+	bucket, slot := am.newPosition(ka.Addr, ka.Source)
+	if old := am.newTbl[bucket][slot]; old != nil {
+		if !old.isTerrible(now) {
+			return false
+		}
+		delete(am.addrs, old.Addr)
+		am.nNew--
+	}
+	ka.Tried, ka.bucket, ka.slot = false, bucket, slot
+	am.newTbl[bucket][slot] = ka
+	am.addrs[ka.Addr] = ka
+	am.nNew++
+	return true
+}
+
+// Attempt records a connection attempt to addr.
+func (am *AddrManager) Attempt(addr string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if ka, ok := am.addrs[addr]; ok {
+		ka.LastAttempt = time.Now()
+		ka.Attempts++
+	}
+}
+
+// Good records a successful connection to addr, moving it to the tried
+// table. An address already in its tried slot is moved back to the new
+// table to make room.
+func (am *AddrManager) Good(addr string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := time.Now()
+	ka, ok := am.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr, Source: addr, LastSeen: now}
+		am.addrs[addr] = ka
+	} else if !ka.Tried {
+		am.newTbl[ka.bucket][ka.slot] = nil
+		am.nNew--
+	}
+	ka.LastSeen, ka.LastSuccess, ka.Attempts = now, now, 0
+	if ka.Tried {
+		return
+	}
+
+	bucket, slot := am.triedPosition(addr)
+	if old := am.tried[bucket][slot]; old != nil {
+		am.nTried--
+		delete(am.addrs, old.Addr)
+		am.placeNew(old, now)
+	}
+	ka.Tried, ka.bucket, ka.slot = true, bucket, slot
+	am.tried[bucket][slot] = ka
+	am.nTried++
+}
+
+// Select returns a random address to connect to, favoring addresses that
+// have not failed recently, or nil if none are known. With newOnly set it
+// only picks addresses we have never connected to, for feelers.
+func (am *AddrManager) Select(newOnly bool, exclude func(string) bool) *KnownAddress {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := time.Now()
+
+	var candidates []*KnownAddress
+	for _, ka := range am.addrs {
+		if newOnly && ka.Tried {
+			continue
+		}
+		if exclude != nil && exclude(ka.Addr) {
+			continue
+		}
+		candidates = append(candidates, ka)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Pick tried and new addresses with equal odds when both are available
+	useTried := !newOnly && am.rand.Intn(2) == 0
+	var table []*KnownAddress
+	for _, ka := range candidates {
+		if ka.Tried == useTried {
+			table = append(table, ka)
+		}
+	}
+	if len(table) == 0 {
+		table = candidates
+	}
+
+	factor := 1.0
+	for {
+		ka := table[am.rand.Intn(len(table))]
+		if am.rand.Float64() < factor*ka.chance(now) {
+			copied := *ka
+			return &copied
+		}
+		factor *= 1.2
+	}
+}
+
+// GetAddresses returns a random sample of known addresses for a getaddr
+// reply, leaving out terrible ones.
+func (am *AddrManager) GetAddresses() []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := time.Now()
+
+	addrs := make([]string, 0, len(am.addrs))
+	for addr, ka := range am.addrs {
+		if !ka.isTerrible(now) {
+			addrs = append(addrs, addr)
+		}
+	}
+	am.rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+
+	n := len(addrs) * getAddrMaxPct / 100
+	if n == 0 {
+		n = len(addrs)
+	}
+	if n > MaxAddrPerMessage {
+		n = MaxAddrPerMessage
+	}
+	return addrs[:n]
+}
+
+// Counts returns the sizes of the new and tried tables.
+func (am *AddrManager) Counts() (int, int) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	return am.nNew, am.nTried
+}
+
+// SetAnchors records the outbound peers to reconnect to first on restart.
+func (am *AddrManager) SetAnchors(addrs []string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if len(addrs) > MaxAnchors {
+		addrs = addrs[:MaxAnchors]
+	}
+	am.anchors = append([]string(nil), addrs...)
+}
+
+// TakeAnchors returns the saved anchors and forgets them, so a bad anchor
+// is not retried on every restart.
+func (am *AddrManager) TakeAnchors() []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	anchors := am.anchors
+	am.anchors = nil
+	return anchors
+}
+
+// peersFile is the on-disk form of the address manager
+type peersFile struct {
+	Version   int             `json:"version"`
+	Key       string          `json:"key"`
+	Addresses []*KnownAddress `json:"addresses"`
+	Anchors   []string        `json:"anchors"`
+}
+
+// Save writes the address manager to its peers file.
+func (am *AddrManager) Save() error {
+	am.mu.Lock()
+	file := peersFile{Version: 1, Key: hex.EncodeToString(am.key[:]), Anchors: am.anchors}
+	for _, ka := range am.addrs {
+		copied := *ka
+		file.Addresses = append(file.Addresses, &copied)
+	}
+	am.mu.Unlock()
+
+	data, err := json.Marshal(&file)
+	if err != nil {
+		return err
+	}
+	tmp := am.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write peers file: %v", err)
+	}
+	return os.Rename(tmp, am.path)
+}
+
+// Load replaces the address manager's contents with its peers file. A
+// missing file leaves it empty.
+func (am *AddrManager) Load() error {
+	data, err := os.ReadFile(am.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read peers file: %v", err)
+	}
+	var file peersFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid peers file: %v", err)
+	}
+	key, err := hex.DecodeString(file.Key)
+	if err != nil || len(key) != len(am.key) {
+		return fmt.Errorf("invalid peers file key")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	copy(am.key[:], key)
+	am.addrs = make(map[string]*KnownAddress)
+	am.newTbl = [NewBucketCount][BucketSize]*KnownAddress{}
+	am.tried = [TriedBucketCount][BucketSize]*KnownAddress{}
+	am.nNew, am.nTried = 0, 0
+	am.anchors = file.Anchors
+
+	// Place tried addresses first so they keep their slots
+	now := time.Now()
+	for _, tried := range []bool{true, false} {
+		for _, ka := range file.Addresses {
+			if ka == nil || ka.Tried != tried || am.addrs[ka.Addr] != nil {
+				continue
+			}
+			if !tried {
+				am.placeNew(ka, now)
+				continue
+			}
+			bucket, slot := am.triedPosition(ka.Addr)
+			if am.tried[bucket][slot] != nil {
+				am.placeNew(ka, now)
+				continue
+			}
+			ka.bucket, ka.slot = bucket, slot
+			am.tried[bucket][slot] = ka
+			am.addrs[ka.Addr] = ka
+			am.nTried++
+		}
+	}
+	return nil
+}
+
+// peersFilePath returns the peers file under DATA_DIR
+func peersFilePath() string {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, PeersFileName)
+}
+
+// fillOutbound connects to addresses from the address manager until the
+// outbound slots are full, taking at most one address per netgroup so no
+// single network can surround us.
+func (sm *SyncManager) fillOutbound() {
+	sm.mu.RLock()
+	need := MaxOutboundPeers - sm.outboundCount
+	skip := make(map[string]bool)
+	groups := make(map[string]bool)
+	for addr, peer := range sm.peers {
+		skip[addr] = true
+		if !peer.inbound {
+			groups[netGroup(addr)] = true
+		}
+	}
+	for addr, until := range sm.bannedPeers {
+		if time.Now().Before(until) {
+			skip[addr] = true
+		}
+	}
+	sm.mu.RUnlock()
+
+	am := sm.peerManager.AddrManager()
+	for i := 0; i < need; i++ {
+		ka := am.Select(false, func(addr string) bool {
+			return skip[addr] || groups[netGroup(addr)]
+		})
+		if ka == nil {
+			return
+		}
+		skip[ka.Addr], groups[netGroup(ka.Addr)] = true, true
+		go sm.connectAndSync(ka.Addr)
+	}
+}
+
+// anchorCandidates returns the outbound peers connected longest.
+func (sm *SyncManager) anchorCandidates() []string {
+	sm.mu.RLock()
+	var outbound []*Peer
+	for _, peer := range sm.peers {
+		if !peer.inbound {
+			outbound = append(outbound, peer)
+		}
+	}
+	sm.mu.RUnlock()
+
+	sort.Slice(outbound, func(i, j int) bool {
+		return outbound[i].connectedAt.Before(outbound[j].connectedAt)
+	})
+	var anchors []string
+	for _, peer := range outbound {
+		if len(anchors) == MaxAnchors {
+			break
+		}
+		anchors = append(anchors, peer.addr)
+	}
+	return anchors
+}
+
+// addrManagerLoop keeps the outbound slots filled, makes feeler
+// connections once they are, and periodically saves the peers file.
+func (sm *SyncManager) addrManagerLoop() {
+	feeler := time.NewTicker(FeelerInterval)
+	defer feeler.Stop()
+	save := time.NewTicker(AddrSaveInterval)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-sm.stopChan:
+			return
+		case <-feeler.C:
+			sm.mu.RLock()
+			full := sm.outboundCount >= MaxOutboundPeers
+			sm.mu.RUnlock()
+			if full {
+				go sm.feelerConnect()
+			} else {
+				sm.fillOutbound()
+			}
+		case <-save.C:
+			if err := sm.peerManager.AddrManager().Save(); err != nil {
+				fmt.Printf("[ADDR] Failed to save peers: %v\n", err)
+			}
+		}
+	}
+}
+
+// feelerConnect briefly connects to an address we have never connected to,
+// moving it to the tried table if it completes the handshake. Feelers keep
+// the tried table fresh without using an outbound slot.
+func (sm *SyncManager) feelerConnect() {
+	sm.mu.RLock()
+	connected := make(map[string]bool, len(sm.peers))
+	for addr := range sm.peers {
+		connected[addr] = true
+	}
+	sm.mu.RUnlock()
+
+	am := sm.peerManager.AddrManager()
+	ka := am.Select(true, func(addr string) bool { return connected[addr] })
+	if ka == nil {
+		return
+	}
+
+	am.Attempt(ka.Addr)
+	conn, err := sm.dialPeer(ka.Addr)
+	if err != nil {
+		fmt.Printf("[ADDR] Feeler connection to %s failed: %v\n", ka.Addr, err)
+		return
+	}
+	peer := NewPeer(conn, ka.Addr, false, sm.peerManager.params.Net)
+	err = sm.performHandshake(peer)
+	peer.Disconnect()
+	sm.peerManager.DisconnectPeer(ka.Addr)
+	if err != nil {
+		fmt.Printf("[ADDR] Feeler handshake with %s failed: %v\n", ka.Addr, err)
+		return
+	}
+	am.Good(ka.Addr)
+	fmt.Printf("[ADDR] Feeler connection to %s succeeded\n", ka.Addr)
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetGroup(t *testing.T) {
+	for _, tt := range []struct {
+		addr, group string
+	}{
+		{"8.8.4.4:8333", "8.8"},
+		{"8.8.200.1:8333", "8.8"},
+		{"[2001:db8:1234::1]:8333", "2001:db8::"},
+		{"127.0.0.1:8333", "local"},
+		{"192.168.1.5:8333", "local"},
+		{"seed1.example.com", "host:seed1.example.com"},
+		{"abcdef.onion:8333", "onion:a"},
+	} {
+		if got := netGroup(tt.addr); got != tt.group {
+			t.Errorf("netGroup(%s) = %s, expected %s", tt.addr, got, tt.group)
+		}
+	}
+}
+
+func TestAddrManagerTables(t *testing.T) {
+	am := NewAddrManager(filepath.Join(t.TempDir(), PeersFileName))
+
+	// One source flooding addresses only reaches a limited set of buckets
+	var flood []string
+	for i := 0; i < 5000; i++ {
+		flood = append(flood, fmt.Sprintf("%d.%d.%d.1:8333", 1+i%200, i/200, i%7))
+	}
+	am.AddAddresses(flood, "6.6.6.6:8333")
+	buckets := make(map[int]bool)
+	for _, ka := range am.addrs {
+		buckets[ka.bucket] = true
+	}
+	if len(buckets) > newBucketsPerGroup {
+		t.Errorf("One source group reached %d new buckets, limit %d", len(buckets), newBucketsPerGroup)
+	}
+	newCount, _ := am.Counts()
+	if newCount > newBucketsPerGroup*BucketSize {
+		t.Errorf("One source group placed %d addresses", newCount)
+	}
+
+	// A successful connection moves the address to the tried table
+	am.AddAddresses([]string{"9.9.9.9:8333"}, "5.5.5.5:8333")
+	am.Attempt("9.9.9.9:8333")
+	am.Good("9.9.9.9:8333")
+	if ka := am.addrs["9.9.9.9:8333"]; ka == nil || !ka.Tried || ka.Attempts != 0 {
+		t.Fatalf("Address not moved to tried: %+v", ka)
+	}
+	if _, tried := am.Counts(); tried != 1 {
+		t.Errorf("Expected 1 tried address, got %d", tried)
+	}
+
+	// Feelers only pick addresses never connected to
+	for i := 0; i < 50; i++ {
+		if ka := am.Select(true, nil); ka == nil || ka.Tried {
+			t.Fatalf("Select for a feeler returned %+v", ka)
+		}
+	}
+	only := am.Select(false, func(addr string) bool { return addr != "9.9.9.9:8333" })
+	if only == nil || only.Addr != "9.9.9.9:8333" {
+		t.Errorf("Select ignored the exclusion filter: %+v", only)
+	}
+	if len(am.GetAddresses()) == 0 || len(am.GetAddresses()) > MaxAddrPerMessage {
+		t.Errorf("getaddr sample has %d addresses", len(am.GetAddresses()))
+	}
+}
+
+func TestAddrManagerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PeersFileName)
+	am := NewAddrManager(path)
+	am.AddAddresses([]string{"1.2.3.4:8333", "5.6.7.8:8333", "9.10.11.12:8333"}, "seed")
+	am.Good("5.6.7.8:8333")
+	am.SetAnchors([]string{"5.6.7.8:8333", "1.2.3.4:8333", "9.10.11.12:8333"})
+	if err := am.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded := NewAddrManager(path)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.key != am.key {
+		t.Error("Bucketing key not restored")
+	}
+	newCount, tried := loaded.Counts()
+	if newCount != 2 || tried != 1 || !loaded.addrs["5.6.7.8:8333"].Tried {
+		t.Errorf("Loaded %d new and %d tried addresses", newCount, tried)
+	}
+	anchors := loaded.TakeAnchors()
+	if len(anchors) != MaxAnchors || anchors[0] != "5.6.7.8:8333" {
+		t.Errorf("Unexpected anchors %v", anchors)
+	}
+	if len(loaded.TakeAnchors()) != 0 {
+		t.Error("Anchors returned twice")
+	}
+
+	// A missing file leaves the manager empty
+	empty := NewAddrManager(filepath.Join(t.TempDir(), PeersFileName))
+	if err := empty.Load(); err != nil {
+		t.Errorf("Load of a missing file failed: %v", err)
+	}
+}
+
+func TestAddrMessageNotConnected(t *testing.T) {
+	sm := newTestSyncManager(t, newSyncTestChain(t, 0))
+	peer, _, _ := connectRemotePeer(sm, "7.7.7.7:8333")
+
+	addrs := []string{"11.0.0.1:8333", "12.0.0.1:8333"}
+	msg := encodeTestMessage(t, MsgTypeAddr, &AddrMessage{Addresses: addrs})
+	if err := sm.handleAddr(peer, msg); err != nil {
+		t.Fatalf("handleAddr failed: %v", err)
+	}
+	sm.mu.RLock()
+	peers := len(sm.peers)
+	sm.mu.RUnlock()
+	if peers != 1 {
+		t.Errorf("Addresses from a peer were connected to: %d peers", peers)
+	}
+	if newCount, _ := sm.peerManager.AddrManager().Counts(); newCount != 2 {
+		t.Errorf("Expected 2 new addresses, got %d", newCount)
+	}
+
+	// Stopping saves the outbound anchors with the table
+	sm.Stop()
+	loaded := NewAddrManager(peersFilePath())
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if newCount, _ := loaded.Counts(); newCount != 2 {
+		t.Errorf("Peers file holds %d new addresses", newCount)
+	}
+}
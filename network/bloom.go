@@ -0,0 +1,108 @@
+package network
+
+import (
+	"fmt"
+	"obsidian-core/wire"
+)
+
+// relaysTx reports whether a transaction should be relayed to the peer,
+// which is always unless the peer's bloom filter rejects it. A match adds
+// the transaction's outputs to the filter as its flags allow.
+func (p *Peer) relaysTx(tx *wire.MsgTx) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filter == nil || p.filter.MatchTxAndUpdate(tx)
+}
+
+// checkBloomService rejects filter messages if we do not serve SPV peers
+func (sm *SyncManager) checkBloomService(peer *Peer, msgType string) error {
+	if sm.services&SFNodeBloom == 0 {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return fmt.Errorf("%s received but bloom filters are not offered", msgType)
+	}
+	return nil
+}
+
+// handleFilterLoad replaces the peer's bloom filter.
+func (sm *SyncManager) handleFilterLoad(peer *Peer, msg *P2PMessage) error {
+	if err := sm.checkBloomService(peer, msg.Type); err != nil {
+		return err
+	}
+
+	loadMsg := &FilterLoadMessage{}
+	if err := peer.decodePayload(msg, loadMsg); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	filter, err := wire.LoadBloomFilter((*wire.FilterLoadMsg)(loadMsg))
+	if err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return fmt.Errorf("invalid filterload: %v", err)
+	}
+
+	peer.mu.Lock()
+	peer.filter = filter
+	peer.mu.Unlock()
+
+	fmt.Printf("[SPV] Loaded %d byte bloom filter from %s\n", len(loadMsg.Filter), peer.addr)
+	return nil
+}
+
+// handleFilterAdd adds an element to the peer's bloom filter.
+func (sm *SyncManager) handleFilterAdd(peer *Peer, msg *P2PMessage) error {
+	if err := sm.checkBloomService(peer, msg.Type); err != nil {
+		return err
+	}
+
+	addMsg := &FilterAddMessage{}
+	if err := peer.decodePayload(msg, addMsg); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+
+	peer.mu.Lock()
+	loaded := peer.filter != nil
+	if loaded {
+		peer.filter.Add(addMsg.Data)
+	}
+	peer.mu.Unlock()
+
+	if !loaded {
+		peer.AdjustScore(ScoreMisbehavior)
+		return fmt.Errorf("filteradd without a loaded filter")
+	}
+	return nil
+}
+
+// handleFilterClear removes the peer's bloom filter, so it is relayed all
+// transactions again.
+func (sm *SyncManager) handleFilterClear(peer *Peer, msg *P2PMessage) error {
+	if err := sm.checkBloomService(peer, msg.Type); err != nil {
+		return err
+	}
+	if err := peer.decodePayload(msg, &FilterClearMessage{}); err != nil {
+		return err
+	}
+
+	peer.mu.Lock()
+	peer.filter = nil
+	peer.mu.Unlock()
+	return nil
+}
+
+// sendMerkleBlock sends a block filtered through the peer's bloom filter,
+// followed by the matched transactions. Peers without a filter get nothing.
+func (sm *SyncManager) sendMerkleBlock(peer *Peer, block *wire.MsgBlock) {
+	peer.mu.Lock()
+	if peer.filter == nil {
+		peer.mu.Unlock()
+		return
+	}
+	merkleBlock := wire.NewMerkleBlock(block, peer.filter)
+	peer.mu.Unlock()
+
+	peer.queueReply(MsgTypeMerkleBlock, &MerkleBlockMessage{Block: merkleBlock})
+	for _, tx := range merkleBlock.Transactions {
+		peer.queueReply(MsgTypeTx, &TxMessage{Tx: tx})
+	}
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"bytes"
+	"obsidian-core/wire"
+	"testing"
+)
+
+// payToPubKeyHashTx returns a transaction paying a P2PKH script
+func payToPubKeyHashTx(seed byte, pubKeyHash []byte) *wire.MsgTx {
+	tx := compactTestTx(seed)
+	tx.TxOut[0].PkScript = append([]byte{0x76, 0xa9, 0x14}, append(pubKeyHash, 0x88, 0xac)...)
+	return tx
+}
+
+func TestSPVFilteredRelay(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	peer, spv, received := connectRemotePeer(sm, "spv")
+
+	pubKeyHash := bytes.Repeat([]byte{0x22}, 20)
+	filter := wire.NewBloomFilter(10, 0.0001, 0, wire.BloomUpdateAll)
+	filter.Add(pubKeyHash)
+	spv.SendMessage(MsgTypeFilterLoad, (*FilterLoadMessage)(filter.MsgFilterLoad()))
+	waitFor(t, "filter", func() bool {
+		peer.mu.RLock()
+		defer peer.mu.RUnlock()
+		return peer.filter != nil
+	})
+
+	// Only the payment to the wallet is announced
+	payment, unrelated := payToPubKeyHashTx(1, pubKeyHash), compactTestTx(2)
+	sm.announceTx(unrelated, "")
+	sm.announceTx(payment, "")
+	inv := &InvMessage{}
+	spv.decodePayload(expectMessage(t, received, MsgTypeInv), inv)
+	if len(inv.Hashes) != 1 || inv.Hashes[0] != payment.TxHash() {
+		t.Fatalf("Expected an inv for the payment only, got %v", inv.Hashes)
+	}
+
+	// The filter picked up the payment's output, so spending it matches
+	spend := compactTestTx(3)
+	spend.TxIn[0].PreviousOutPoint = wire.OutPoint{Hash: payment.TxHash(), Index: 0}
+	sm.announceTx(spend, "")
+	spv.decodePayload(expectMessage(t, received, MsgTypeInv), inv)
+	if inv.Hashes[0] != spend.TxHash() {
+		t.Errorf("Expected an inv for the spend, got %v", inv.Hashes)
+	}
+
+	// A filtered block proves the payment against the header's merkle root
+	block := mineOnTip(t, chain, "obs1miner", unrelated, payment)
+	if err := chain.ProcessBlock(block, sm.pow); err != nil {
+		t.Fatalf("ProcessBlock failed: %v", err)
+	}
+	spv.SendMessage(MsgTypeGetData, &GetDataMessage{Type: "merkleblock", Hashes: []wire.Hash{block.BlockHash()}})
+	merkleMsg := &MerkleBlockMessage{}
+	if err := spv.decodePayload(expectMessage(t, received, MsgTypeMerkleBlock), merkleMsg); err != nil {
+		t.Fatalf("Failed to decode merkleblock: %v", err)
+	}
+	root, matches, err := merkleMsg.Block.ExtractMatches()
+	if err != nil || root != block.Header.MerkleRoot {
+		t.Fatalf("Merkle proof does not verify: %v", err)
+	}
+	if len(matches) != 1 || matches[0] != payment.TxHash() {
+		t.Errorf("Expected the payment to match, got %v", matches)
+	}
+	txMsg := &TxMessage{}
+	spv.decodePayload(expectMessage(t, received, MsgTypeTx), txMsg)
+	if txMsg.Tx.TxHash() != payment.TxHash() {
+		t.Error("Expected the matched transaction after the merkleblock")
+	}
+
+	// Without a filter everything is relayed again
+	spv.SendMessage(MsgTypeFilterClear, &FilterClearMessage{})
+	waitFor(t, "filter to clear", func() bool { return peer.relaysTx(unrelated) })
+}
+
+func TestFilterMessagesRejected(t *testing.T) {
+	sm := newTestSyncManager(t, newSyncTestChain(t, 0))
+	peer, spv, _ := connectRemotePeer(sm, "spv")
+
+	// filteradd needs a loaded filter
+	spv.SendMessage(MsgTypeFilterAdd, &FilterAddMessage{Data: []byte{1}})
+	waitFor(t, "penalty", func() bool { return peer.GetScore() < 0 })
+
+	// Nodes not offering bloom filters refuse them
+	sm.services = SFNodeNetwork
+	filter := wire.NewBloomFilter(10, 0.01, 0, wire.BloomUpdateNone)
+	if err := sm.handleFilterLoad(peer, encodeTestMessage(t, MsgTypeFilterLoad, (*FilterLoadMessage)(filter.MsgFilterLoad()))); err == nil {
+		t.Error("Accepted filterload without advertising bloom filters")
+	}
+}
+
+func encodeTestMessage(t *testing.T, msgType string, payload Message) *P2PMessage {
+	framed, err := EncodeMessage(testMagic, msgType, payload, ProtocolVersion)
+	if err != nil {
+		t.Fatalf("EncodeMessage failed: %v", err)
+	}
+	msg, err := ReadMessage(bytes.NewReader(framed), testMagic)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	return msg
+}
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"fmt"
+	"obsidian-core/wire"
+)
+
+const (
+	// FilterTypeBasic is the BIP158 basic filter type, the only one served
+	FilterTypeBasic uint8 = 0
+
+	// CFCheckptInterval is the spacing of filter headers in cfcheckpt
+	CFCheckptInterval = 1000
+)
+
+// checkCFService rejects filter requests if we do not serve compact block
+// filters or do not know the filter type.
+func (sm *SyncManager) checkCFService(peer *Peer, msgType string, filterType uint8) error {
+	if sm.services&SFNodeCF == 0 {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return fmt.Errorf("%s received but compact filters are not offered", msgType)
+	}
+	if filterType != FilterTypeBasic {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return fmt.Errorf("%s for unknown filter type %d", msgType, filterType)
+	}
+	return nil
+}
+
+// filterRange resolves a request for main chain blocks from startHeight up
+// to stopHash, of at most max blocks. It returns false without an error if
+// the range cannot be served yet: the stop hash is not on our main chain or
+// its filters are not indexed.
+func (sm *SyncManager) filterRange(peer *Peer, msgType string, filterType uint8, startHeight uint32, stopHash wire.Hash, max int) (int32, int32, bool, error) {
+	if err := sm.checkCFService(peer, msgType, filterType); err != nil {
+		return 0, 0, false, err
+	}
+	stop, ok := sm.blockchain.MainChainHeight(stopHash)
+	if !ok {
+		fmt.Printf("[CF] Ignoring %s from %s for unknown stop block %s\n", msgType, peer.addr, stopHash)
+		return 0, 0, false, nil
+	}
+	if int64(startHeight) > int64(stop) || int64(stop)-int64(startHeight) >= int64(max) {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return 0, 0, false, fmt.Errorf("%s for invalid range %d-%d", msgType, startHeight, stop)
+	}
+	if stop > sm.blockchain.FilterIndexHeight() {
+		fmt.Printf("[CF] Ignoring %s from %s: filters up to height %d not indexed yet\n", msgType, peer.addr, stop)
+		return 0, 0, false, nil
+	}
+	return int32(startHeight), stop, true, nil
+}
+
+// handleGetCFilters sends the filter of each requested block.
+func (sm *SyncManager) handleGetCFilters(peer *Peer, msg *P2PMessage) error {
+	req := &GetCFiltersMessage{}
+	if err := peer.decodePayload(msg, req); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	start, stop, ok, err := sm.filterRange(peer, msg.Type, req.FilterType, req.StartHeight, req.StopHash, MaxGetCFilters)
+	if !ok {
+		return err
+	}
+
+	for height := start; height <= stop; height++ {
+		hash, err := sm.blockchain.BlockHashByHeight(height)
+		if err != nil {
+			return err
+		}
+		filter, err := sm.blockchain.BlockFilter(hash)
+		if err != nil {
+			return err
+		}
+		reply := &CFilterMessage{FilterType: req.FilterType, BlockHash: hash, Filter: filter}
+		peer.queueReply(MsgTypeCFilter, reply)
+	}
+	return nil
+}
+
+// handleGetCFHeaders sends the filter hashes of the requested blocks along
+// with the filter header preceding them.
+func (sm *SyncManager) handleGetCFHeaders(peer *Peer, msg *P2PMessage) error {
+	req := &GetCFHeadersMessage{}
+	if err := peer.decodePayload(msg, req); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	start, stop, ok, err := sm.filterRange(peer, msg.Type, req.FilterType, req.StartHeight, req.StopHash, MaxCFHeaders)
+	if !ok {
+		return err
+	}
+
+	reply := &CFHeadersMessage{FilterType: req.FilterType, StopHash: req.StopHash}
+	if start > 0 {
+		prev, err := sm.blockchain.BlockHashByHeight(start - 1)
+		if err != nil {
+			return err
+		}
+		if reply.PrevFilterHeader, err = sm.blockchain.FilterHeader(prev); err != nil {
+			return err
+		}
+	}
+	for height := start; height <= stop; height++ {
+		hash, err := sm.blockchain.BlockHashByHeight(height)
+		if err != nil {
+			return err
+		}
+		filter, err := sm.blockchain.BlockFilter(hash)
+		if err != nil {
+			return err
+		}
+		reply.FilterHashes = append(reply.FilterHashes, wire.DoubleHashH(filter))
+	}
+	peer.queueReply(MsgTypeCFHeaders, reply)
+	return nil
+}
+
+// handleGetCFCheckpt sends the filter header at every CFCheckptInterval
+// blocks up to the stop block, letting clients fetch headers in parallel.
+func (sm *SyncManager) handleGetCFCheckpt(peer *Peer, msg *P2PMessage) error {
+	req := &GetCFCheckptMessage{}
+	if err := peer.decodePayload(msg, req); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	_, stop, ok, err := sm.filterRange(peer, msg.Type, req.FilterType, 0, req.StopHash, MaxCFCheckpoints*CFCheckptInterval)
+	if !ok {
+		return err
+	}
+
+	reply := &CFCheckptMessage{FilterType: req.FilterType, StopHash: req.StopHash}
+	for height := int32(CFCheckptInterval); height <= stop; height += CFCheckptInterval {
+		hash, err := sm.blockchain.BlockHashByHeight(height)
+		if err != nil {
+			return err
+		}
+		header, err := sm.blockchain.FilterHeader(hash)
+		if err != nil {
+			return err
+		}
+		reply.FilterHeaders = append(reply.FilterHeaders, header)
+	}
+	peer.queueReply(MsgTypeCFCheckpt, reply)
+	return nil
+}
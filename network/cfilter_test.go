@@ -0,0 +1,96 @@
+package network
+
+import (
+	"obsidian-core/blockchain"
+	"obsidian-core/wire"
+	"testing"
+)
+
+// indexTestChain builds the compact filter index of chain
+func indexTestChain(t *testing.T, chain *blockchain.BlockChain) {
+	if err := chain.EnableFilterIndex(false); err != nil {
+		t.Fatalf("EnableFilterIndex failed: %v", err)
+	}
+	height := chain.Height()
+	waitFor(t, "filter index", func() bool { return chain.FilterIndexHeight() == height })
+}
+
+func TestCompactFilterServing(t *testing.T) {
+	chain := newSyncTestChain(t, 5)
+	indexTestChain(t, chain)
+	sm := newTestSyncManager(t, chain)
+	if sm.services&SFNodeCF == 0 {
+		t.Fatal("Compact filter service not advertised")
+	}
+	_, client, received := connectRemotePeer(sm, "light")
+	stop, _ := chain.BlockHashByHeight(4)
+
+	// Filter headers derive from the previous header and the filter hashes
+	client.SendMessage(MsgTypeGetCFHeaders, &GetCFHeadersMessage{StartHeight: 2, StopHash: stop})
+	headers := &CFHeadersMessage{}
+	if err := client.decodePayload(expectMessage(t, received, MsgTypeCFHeaders), headers); err != nil {
+		t.Fatalf("Failed to decode cfheaders: %v", err)
+	}
+	if len(headers.FilterHashes) != 3 || headers.StopHash != stop {
+		t.Fatalf("Expected 3 filter hashes up to the stop block, got %d", len(headers.FilterHashes))
+	}
+	header := headers.PrevFilterHeader
+	for _, filterHash := range headers.FilterHashes {
+		header = wire.FilterHeader(filterHash, header)
+	}
+	if expected, _ := chain.FilterHeader(stop); header != expected {
+		t.Error("Filter hashes do not lead to the stop block's filter header")
+	}
+
+	// Each filter in the range arrives in height order
+	client.SendMessage(MsgTypeGetCFilters, &GetCFiltersMessage{StartHeight: 3, StopHash: stop})
+	for height := int32(3); height <= 4; height++ {
+		filter := &CFilterMessage{}
+		client.decodePayload(expectMessage(t, received, MsgTypeCFilter), filter)
+		hash, _ := chain.BlockHashByHeight(height)
+		if filter.BlockHash != hash || wire.DoubleHashH(filter.Filter) != headers.FilterHashes[height-2] {
+			t.Errorf("Unexpected filter for height %d", height)
+		}
+	}
+
+	// Checkpoints are spaced CFCheckptInterval apart, so none exist yet
+	client.SendMessage(MsgTypeGetCFCheckpt, &GetCFCheckptMessage{StopHash: stop})
+	checkpt := &CFCheckptMessage{}
+	client.decodePayload(expectMessage(t, received, MsgTypeCFCheckpt), checkpt)
+	if checkpt.StopHash != stop || len(checkpt.FilterHeaders) != 0 {
+		t.Errorf("Unexpected checkpoints %v", checkpt.FilterHeaders)
+	}
+}
+
+func TestCompactFilterRequestsRejected(t *testing.T) {
+	sm := newTestSyncManager(t, newSyncTestChain(t, 0))
+	peer, _, _ := connectRemotePeer(sm, "light")
+	genesis, _ := sm.blockchain.BlockHashByHeight(0)
+
+	// Without the index the service is not offered
+	msg := encodeTestMessage(t, MsgTypeGetCFilters, &GetCFiltersMessage{StopHash: genesis})
+	if err := sm.handleGetCFilters(peer, msg); err == nil {
+		t.Error("Served filters with the index disabled")
+	}
+
+	chain := newSyncTestChain(t, 2)
+	indexTestChain(t, chain)
+	sm = newTestSyncManager(t, chain)
+	peer, _, _ = connectRemotePeer(sm, "light")
+	tip, _ := sm.blockchain.BlockHashByHeight(2)
+	for _, req := range []*GetCFiltersMessage{
+		{FilterType: 1, StopHash: tip},  // Unknown filter type
+		{StartHeight: 3, StopHash: tip}, // Start past the stop block
+	} {
+		if err := sm.handleGetCFilters(peer, encodeTestMessage(t, MsgTypeGetCFilters, req)); err == nil {
+			t.Errorf("Accepted getcfilters %+v", req)
+		}
+	}
+
+	// An unknown stop block is ignored rather than penalized
+	score := peer.GetScore()
+	unknown := encodeTestMessage(t, MsgTypeGetCFilters, &GetCFiltersMessage{StopHash: wire.Hash{0xff}})
+	if err := sm.handleGetCFilters(peer, unknown); err != nil || peer.GetScore() != score {
+		t.Errorf("Unknown stop block = %v, score %d -> %d", err, score, peer.GetScore())
+	}
+}
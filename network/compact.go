@@ -0,0 +1,355 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"obsidian-core/wire"
+	"sync"
+	"time"
+)
+
+// Compact block relay
+const (
+	// CompactBlockVersion is the only compact block version we speak
+	CompactBlockVersion uint64 = 1
+
+	// MaxHighBandwidthPeers is how many peers we ask to push new blocks to
+	// us as compact blocks without announcing them first
+	MaxHighBandwidthPeers = 3
+
+	// CompactBlockTimeout is how long we wait for missing transactions
+	// before fetching the full block instead
+	CompactBlockTimeout = 5 * time.Second
+)
+
+// CompactBlockStats reports how well compact blocks are reconstructed.
+type CompactBlockStats struct {
+	Received           uint64  `json:"received"`           // Compact blocks extending our tip
+	Reconstructed      uint64  `json:"reconstructed"`      // Rebuilt from the mempool alone
+	RoundTrips         uint64  `json:"roundtrips"`         // Needed a getblocktxn round trip
+	Fallbacks          uint64  `json:"fallbacks"`          // Fetched as a full block instead
+	TxsFromMempool     uint64  `json:"txsfrommempool"`     // Transactions found in the mempool
+	TxsRequested       uint64  `json:"txsrequested"`       // Transactions fetched from peers
+	HitRate            float64 `json:"hitrate"`            // Reconstructed / Received
+	HighBandwidthPeers int     `json:"highbandwidthpeers"` // Peers pushing compact blocks to us
+}
+
+// partialBlock is a compact block waiting for its missing transactions
+type partialBlock struct {
+	peer      *Peer
+	compact   *wire.CompactBlock
+	block     *wire.MsgBlock
+	missing   []int
+	requested time.Time
+}
+
+// compactRelay tracks compact block state shared by all peers.
+type compactRelay struct {
+	mu            sync.Mutex
+	pending       map[wire.Hash]*partialBlock
+	highBandwidth []*Peer // Oldest first
+	stats         CompactBlockStats
+}
+
+func newCompactRelay() *compactRelay {
+	return &compactRelay{
+		pending: make(map[wire.Hash]*partialBlock),
+	}
+}
+
+// promote makes peer, which just gave us a new block first, a
+// high-bandwidth peer. It returns the sendcmpct messages switching the
+// peer to high-bandwidth mode and any peer it replaces back to low.
+func (cr *compactRelay) promote(peer *Peer) []outgoingMessage {
+	if peer.compactVersion() == 0 {
+		return nil
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for i, p := range cr.highBandwidth {
+		if p == peer {
+			// Already high-bandwidth; it is now the most recent
+			cr.highBandwidth = append(append(cr.highBandwidth[:i:i], cr.highBandwidth[i+1:]...), peer)
+			return nil
+		}
+	}
+
+	out := []outgoingMessage{{peer, MsgTypeSendCmpct, &SendCmpctMessage{Announce: true, Version: CompactBlockVersion}}}
+	cr.highBandwidth = append(cr.highBandwidth, peer)
+	if len(cr.highBandwidth) > MaxHighBandwidthPeers {
+		oldest := cr.highBandwidth[0]
+		cr.highBandwidth = cr.highBandwidth[1:]
+		out = append(out, outgoingMessage{oldest, MsgTypeSendCmpct, &SendCmpctMessage{Announce: false, Version: CompactBlockVersion}})
+	}
+	return out
+}
+
+// removePeer forgets a disconnected peer and the partial blocks it owed
+// us transactions for. Those blocks arrive again by inv or headers.
+func (cr *compactRelay) removePeer(peer *Peer) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for i, p := range cr.highBandwidth {
+		if p == peer {
+			cr.highBandwidth = append(cr.highBandwidth[:i:i], cr.highBandwidth[i+1:]...)
+			break
+		}
+	}
+	for hash, pb := range cr.pending {
+		if pb.peer == peer {
+			delete(cr.pending, hash)
+		}
+	}
+}
+
+// expired removes and returns partial blocks whose transactions did not
+// arrive in time.
+func (cr *compactRelay) expired(now time.Time) []*partialBlock {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	var out []*partialBlock
+	for hash, pb := range cr.pending {
+		if now.Sub(pb.requested) > CompactBlockTimeout {
+			delete(cr.pending, hash)
+			out = append(out, pb)
+		}
+	}
+	return out
+}
+
+// snapshot returns a copy of the statistics with derived fields filled in
+func (cr *compactRelay) snapshot() CompactBlockStats {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	stats := cr.stats
+	if stats.Received > 0 {
+		stats.HitRate = float64(stats.Reconstructed) / float64(stats.Received)
+	}
+	stats.HighBandwidthPeers = len(cr.highBandwidth)
+	return stats
+}
+
+// compactVersion returns the compact block version negotiated with the
+// peer, or 0 if it does not relay compact blocks.
+func (p *Peer) compactVersion() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cmpctVersion
+}
+
+// wantsCompactBlocks reports whether the peer asked us to push new blocks
+// as compact blocks.
+func (p *Peer) wantsCompactBlocks() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cmpctVersion != 0 && p.cmpctAnnounce
+}
+
+// CompactBlockStats returns compact block reconstruction statistics.
+func (sm *SyncManager) CompactBlockStats() CompactBlockStats {
+	return sm.compact.snapshot()
+}
+
+// negotiateCompactBlocks offers compact block relay in low-bandwidth mode.
+// Peers are switched to high-bandwidth mode once they relay blocks to us
+// first.
+func (sm *SyncManager) negotiateCompactBlocks(peer *Peer) {
+	sendCmpctMsg := &SendCmpctMessage{Announce: false, Version: CompactBlockVersion}
+	peer.QueueMessage(MsgTypeSendCmpct, sendCmpctMsg)
+}
+
+// handleCompactBlock reconstructs a compact block from the mempool,
+// requesting any transactions we lack from the peer.
+func (sm *SyncManager) handleCompactBlock(peer *Peer, msg *P2PMessage) error {
+	cmpctMsg := &CompactBlockMessage{}
+	if err := peer.decodePayload(msg, cmpctMsg); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	cb := cmpctMsg.Block
+	blockHash := cb.Header.BlockHash()
+	peer.addKnownInventory(blockHash)
+
+	// High-bandwidth peers race to deliver the same block
+	sm.mu.RLock()
+	alreadyKnown := sm.knownBlocks[blockHash]
+	sm.mu.RUnlock()
+	sm.compact.mu.Lock()
+	_, pending := sm.compact.pending[blockHash]
+	sm.compact.mu.Unlock()
+	if alreadyKnown || pending {
+		return nil
+	}
+
+	if !sm.pow.Verify(&cb.Header) {
+		peer.AdjustScore(ScoreInvalidBlock)
+		return fmt.Errorf("compact block %s has invalid proof of work", blockHash.String())
+	}
+
+	// The block downloader fetches full blocks during initial sync
+	if sm.downloader.isSyncing() {
+		return nil
+	}
+
+	// A block that does not extend our tip needs its headers first
+	bestBlock, err := sm.blockchain.BestBlock()
+	if err != nil {
+		return fmt.Errorf("failed to get best block: %v", err)
+	}
+	if cb.Header.PrevBlock != bestBlock.BlockHash() {
+		out, err := sm.downloader.handleHeaders(peer, []*wire.BlockHeader{&cb.Header})
+		sm.sendAll(out)
+		return err
+	}
+
+	pool := make(map[wire.Hash]*wire.MsgTx)
+	for _, tx := range sm.blockchain.Mempool().GetTransactions() {
+		pool[tx.TxHash()] = tx
+	}
+	block, missing, err := cb.ReconstructBlock(pool)
+	if err != nil {
+		peer.AdjustScore(ScoreInvalidBlock)
+		return fmt.Errorf("invalid compact block %s: %v", blockHash.String(), err)
+	}
+
+	sm.compact.mu.Lock()
+	sm.compact.stats.Received++
+	sm.compact.stats.TxsFromMempool += uint64(len(cb.ShortIDs) - len(missing))
+	if len(missing) == 0 {
+		sm.compact.stats.Reconstructed++
+		sm.compact.mu.Unlock()
+		return sm.acceptCompactBlock(peer, block)
+	}
+	sm.compact.stats.RoundTrips++
+	sm.compact.stats.TxsRequested += uint64(len(missing))
+	sm.compact.pending[blockHash] = &partialBlock{
+		peer:      peer,
+		compact:   cb,
+		block:     block,
+		missing:   missing,
+		requested: time.Now(),
+	}
+	sm.compact.mu.Unlock()
+
+	fmt.Printf("[CMPCT] Block %s missing %d of %d transactions, requesting from %s\n",
+		blockHash.String(), len(missing), cb.TxCount(), peer.addr)
+
+	req := &wire.BlockTxRequest{BlockHash: blockHash, Indices: missing}
+	peer.queueReply(MsgTypeGetBlockTxn, &GetBlockTxnMessage{Request: req})
+	return nil
+}
+
+// handleGetBlockTxn sends the requested transactions of a block.
+func (sm *SyncManager) handleGetBlockTxn(peer *Peer, msg *P2PMessage) error {
+	getMsg := &GetBlockTxnMessage{}
+	if err := peer.decodePayload(msg, getMsg); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	req := getMsg.Request
+
+	block, err := sm.blockchain.GetBlock(req.BlockHash[:])
+	if err != nil {
+		notFound := &NotFoundMessage{Type: "block", Hashes: []wire.Hash{req.BlockHash}}
+		peer.queueReply(MsgTypeNotFound, notFound)
+		return nil
+	}
+
+	resp := &wire.BlockTxResponse{BlockHash: req.BlockHash}
+	for _, index := range req.Indices {
+		if index >= len(block.Transactions) {
+			peer.AdjustScore(ScoreProtocolViolation)
+			return fmt.Errorf("getblocktxn index %d out of range for block %s", index, req.BlockHash.String())
+		}
+		resp.Transactions = append(resp.Transactions, block.Transactions[index])
+	}
+
+	peer.queueReply(MsgTypeBlockTxn, &BlockTxnMessage{Response: resp})
+	return nil
+}
+
+// handleBlockTxn completes a partial block with the transactions we
+// requested, falling back to the full block if they do not fit.
+func (sm *SyncManager) handleBlockTxn(peer *Peer, msg *P2PMessage) error {
+	txnMsg := &BlockTxnMessage{}
+	if err := peer.decodePayload(msg, txnMsg); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	resp := txnMsg.Response
+
+	sm.compact.mu.Lock()
+	pb, ok := sm.compact.pending[resp.BlockHash]
+	if ok && pb.peer == peer {
+		delete(sm.compact.pending, resp.BlockHash)
+	}
+	sm.compact.mu.Unlock()
+	if !ok || pb.peer != peer {
+		// Unrequested, or answered after we fell back to the full block
+		return nil
+	}
+
+	if err := pb.compact.FillMissing(pb.block, pb.missing, resp.Transactions); err != nil {
+		peer.AdjustScore(ScoreMisbehavior)
+		sm.requestFullBlock(peer, resp.BlockHash)
+		return fmt.Errorf("bad blocktxn for %s: %v", resp.BlockHash.String(), err)
+	}
+
+	return sm.acceptCompactBlock(peer, pb.block)
+}
+
+// acceptCompactBlock connects a reconstructed block. A block that fails
+// validation is fetched in full, since a short ID collision with a mempool
+// transaction can make a valid block reconstruct wrongly.
+func (sm *SyncManager) acceptCompactBlock(peer *Peer, block *wire.MsgBlock) error {
+	blockHash := block.BlockHash()
+
+	sm.mu.Lock()
+	if sm.knownBlocks[blockHash] {
+		sm.mu.Unlock()
+		return nil
+	}
+	sm.knownBlocks[blockHash] = true
+	sm.mu.Unlock()
+
+	if err := sm.connectNewBlock(peer, block, block.SerializeSize()); err != nil {
+		fmt.Printf("[CMPCT] Reconstructed block %s rejected (%v), fetching full block\n", blockHash.String(), err)
+		sm.requestFullBlock(peer, blockHash)
+	}
+	return nil
+}
+
+// requestFullBlock falls back to fetching a block the compact way failed
+// for.
+func (sm *SyncManager) requestFullBlock(peer *Peer, blockHash wire.Hash) {
+	sm.mu.Lock()
+	delete(sm.knownBlocks, blockHash)
+	sm.mu.Unlock()
+
+	sm.compact.mu.Lock()
+	sm.compact.stats.Fallbacks++
+	sm.compact.mu.Unlock()
+
+	getData := &GetDataMessage{Type: "block", Hashes: []wire.Hash{blockHash}}
+	sm.sendAll([]outgoingMessage{{peer, MsgTypeGetData, getData}})
+}
+
+// expireCompactBlocks fetches in full the blocks whose missing
+// transactions did not arrive in time.
+func (sm *SyncManager) expireCompactBlocks(now time.Time) {
+	for _, pb := range sm.compact.expired(now) {
+		pb.peer.AdjustScore(ScoreTimeout)
+		sm.requestFullBlock(pb.peer, pb.block.BlockHash())
+	}
+}
+
+// newCompactBlock builds the compact form of a block with a fresh short ID
+// nonce, so that collisions differ between relays.
+func newCompactBlock(block *wire.MsgBlock) *CompactBlockMessage {
+	return &CompactBlockMessage{Block: wire.NewCompactBlock(block, rand.Uint64())}
+}
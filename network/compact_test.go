@@ -0,0 +1,169 @@
+package network
+
+import (
+	"net"
+	"obsidian-core/blockchain"
+	"obsidian-core/consensus"
+	"obsidian-core/wire"
+	"testing"
+	"time"
+)
+
+// mineOnTip returns a solved block extending the chain's tip with txs,
+// whose coinbase pays payTo
+func mineOnTip(t *testing.T, chain *blockchain.BlockChain, payTo string, txs ...*wire.MsgTx) *wire.MsgBlock {
+	prev, err := chain.BestBlock()
+	if err != nil {
+		t.Fatalf("BestBlock failed: %v", err)
+	}
+	height := chain.Height() + 1
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   1,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Header.Timestamp.Add(time.Minute),
+		Bits:      prev.Header.Bits,
+	})
+	block.AddTransaction(wire.NewCoinbaseTx(height, chain.Params().CalcBlockSubsidy(height), payTo))
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	block.Header.MerkleRoot = wire.BlockMerkleRoot(block)
+	nonce, solution, found := consensus.NewDarkMatter().Solve(&block.Header)
+	if !found {
+		t.Fatalf("Failed to solve block at height %d", height)
+	}
+	block.Header.Nonce, block.Header.DarkMatterSolution = nonce, solution
+	return block
+}
+
+func compactTestTx(seed byte) *wire.MsgTx {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{Hash: wire.Hash{seed}}, Sequence: 0xffffffff})
+	tx.AddTxOut(&wire.TxOut{Value: 1000, PkScript: []byte("obs1recipient")})
+	return tx
+}
+
+// connectRemotePeer connects a remote peer to sm, returning sm's side of
+// the connection, the remote side, and a channel of the messages sm sends
+// the remote
+func connectRemotePeer(sm *SyncManager, addr string) (*Peer, *Peer, <-chan *P2PMessage) {
+	local, remote := net.Pipe()
+	peer := NewPeer(local, addr, true, testMagic)
+	sm.mu.Lock()
+	sm.peers[peer.addr] = peer
+	sm.inboundCount++
+	sm.mu.Unlock()
+	go sm.handlePeerMessages(peer)
+
+	relay := NewPeer(remote, "local", false, testMagic)
+	received := make(chan *P2PMessage, 16)
+	go func() {
+		for {
+			msg, err := relay.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	return peer, relay, received
+}
+
+// connectCompactPeer connects a remote peer that relays compact blocks to
+// sm, returning it with a channel of the messages sm sends it
+func connectCompactPeer(t *testing.T, sm *SyncManager) (*Peer, <-chan *P2PMessage) {
+	peer, relay, received := connectRemotePeer(sm, "relay")
+	if err := relay.SendMessage(MsgTypeSendCmpct, &SendCmpctMessage{Version: CompactBlockVersion}); err != nil {
+		t.Fatalf("Failed to send sendcmpct: %v", err)
+	}
+	waitFor(t, "compact block negotiation", func() bool { return peer.compactVersion() == CompactBlockVersion })
+	return relay, received
+}
+
+// expectMessage returns the next message of the given type sent to the
+// relay, skipping others
+func expectMessage(t *testing.T, received <-chan *P2PMessage, msgType string) *P2PMessage {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-received:
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s", msgType)
+		}
+	}
+}
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	relay, received := connectCompactPeer(t, sm)
+
+	known, unknown := compactTestTx(1), compactTestTx(2)
+	if err := chain.Mempool().AddTransaction(known, 0, 0); err != nil {
+		t.Fatalf("AddTransaction failed: %v", err)
+	}
+
+	// The transaction missing from the mempool takes a round trip
+	block := mineOnTip(t, chain, "obs1miner", known, unknown)
+	relay.SendMessage(MsgTypeCompactBlock, &CompactBlockMessage{Block: wire.NewCompactBlock(block, 99)})
+	req := &GetBlockTxnMessage{}
+	if err := relay.decodePayload(expectMessage(t, received, MsgTypeGetBlockTxn), req); err != nil {
+		t.Fatalf("Failed to decode getblocktxn: %v", err)
+	}
+	if req.Request.BlockHash != block.BlockHash() || len(req.Request.Indices) != 1 || req.Request.Indices[0] != 2 {
+		t.Fatalf("Unexpected getblocktxn for indices %v", req.Request.Indices)
+	}
+	resp := &wire.BlockTxResponse{BlockHash: block.BlockHash(), Transactions: []*wire.MsgTx{unknown}}
+	relay.SendMessage(MsgTypeBlockTxn, &BlockTxnMessage{Response: resp})
+	waitFor(t, "block 1", func() bool { return chain.Height() == 1 })
+
+	// Delivering a new block first promotes the peer to high-bandwidth
+	promote := &SendCmpctMessage{}
+	relay.decodePayload(expectMessage(t, received, MsgTypeSendCmpct), promote)
+	if !promote.Announce {
+		t.Error("Expected the relaying peer to be switched to high-bandwidth mode")
+	}
+
+	// A block made only of mempool transactions needs no round trip
+	next := compactTestTx(3)
+	chain.Mempool().AddTransaction(next, 1, 0)
+	block = mineOnTip(t, chain, "obs1miner", next)
+	relay.SendMessage(MsgTypeCompactBlock, &CompactBlockMessage{Block: wire.NewCompactBlock(block, 100)})
+	waitFor(t, "block 2", func() bool { return chain.Height() == 2 })
+
+	stats := sm.CompactBlockStats()
+	if stats.Received != 2 || stats.Reconstructed != 1 || stats.RoundTrips != 1 || stats.Fallbacks != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.TxsFromMempool != 2 || stats.TxsRequested != 1 || stats.HitRate != 0.5 || stats.HighBandwidthPeers != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCompactBlockFallback(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	relay, received := connectCompactPeer(t, sm)
+
+	block := mineOnTip(t, chain, "obs1miner", compactTestTx(1))
+	relay.SendMessage(MsgTypeCompactBlock, &CompactBlockMessage{Block: wire.NewCompactBlock(block, 7)})
+	expectMessage(t, received, MsgTypeGetBlockTxn)
+
+	// Transactions that do not match the short IDs make us fetch the block
+	resp := &wire.BlockTxResponse{BlockHash: block.BlockHash(), Transactions: []*wire.MsgTx{compactTestTx(2)}}
+	relay.SendMessage(MsgTypeBlockTxn, &BlockTxnMessage{Response: resp})
+	getData := &GetDataMessage{}
+	relay.decodePayload(expectMessage(t, received, MsgTypeGetData), getData)
+	if getData.Type != "block" || len(getData.Hashes) != 1 || getData.Hashes[0] != block.BlockHash() {
+		t.Fatalf("Expected a getdata for the full block, got %s %v", getData.Type, getData.Hashes)
+	}
+
+	relay.SendMessage(MsgTypeBlock, &BlockMessage{Block: block})
+	waitFor(t, "block 1", func() bool { return chain.Height() == 1 })
+	if stats := sm.CompactBlockStats(); stats.Fallbacks != 1 {
+		t.Errorf("Expected 1 fallback, got %+v", stats)
+	}
+}
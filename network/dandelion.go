@@ -0,0 +1,258 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"obsidian-core/wire"
+	"sync"
+	"time"
+)
+
+// Dandelion++ transaction relay. New transactions first travel a stem of
+// single hops between outbound peers, then are fluffed: announced to
+// everyone like any other transaction. Seen from one node, the fluff point
+// is unlikely to be the origin.
+const (
+	// DandelionEpoch is how long stem routes are kept before new ones are
+	// drawn
+	DandelionEpoch = 10 * time.Minute
+
+	// DandelionDestinations is the number of outbound peers stem
+	// transactions are routed to in an epoch
+	DandelionDestinations = 2
+
+	// DandelionFluffProbability is the chance of fluffing every relayed
+	// stem transaction for an epoch instead of passing it on
+	DandelionFluffProbability = 0.1
+
+	// DandelionEmbargoBase is the shortest wait for a stem transaction to
+	// come back fluffed before we fluff it ourselves
+	DandelionEmbargoBase = 30 * time.Second
+
+	// DandelionEmbargoMean is the mean of the random time added to the
+	// embargo, so nodes on the stem do not time out together
+	DandelionEmbargoMean = 15 * time.Second
+
+	dandelionCheckInterval = time.Second
+)
+
+// dandelionRouter holds the stem routes of the current epoch and the
+// embargo timers of stem transactions we passed on.
+type dandelionRouter struct {
+	mu           sync.Mutex
+	epochEnd     time.Time
+	diffuser     bool              // Fluff relayed stem transactions this epoch
+	destinations []string          // Outbound peers stem transactions go to
+	routes       map[string]string // Source peer, "" for our own, -> destination
+	embargoes    map[wire.Hash]time.Time
+}
+
+func newDandelionRouter() *dandelionRouter {
+	return &dandelionRouter{
+		routes:    make(map[string]string),
+		embargoes: make(map[wire.Hash]time.Time),
+	}
+}
+
+// route returns where to send a stem transaction received from source, or
+// "" to fluff it. Each source keeps one destination for the whole epoch, so
+// a peer cannot learn more by sending many transactions. Our own
+// transactions are always stemmed. candidates are the connected outbound
+// peers relaying stem transactions.
+func (r *dandelionRouter) route(source string, candidates []string, now time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !now.Before(r.epochEnd) {
+		r.epochEnd = now.Add(DandelionEpoch)
+		r.diffuser = rand.Float64() < DandelionFluffProbability
+		r.destinations = nil
+		r.routes = make(map[string]string)
+	}
+	if r.diffuser && source != "" {
+		return ""
+	}
+
+	// Replace destinations that disconnected
+	connected := make(map[string]bool, len(candidates))
+	for _, addr := range candidates {
+		connected[addr] = true
+	}
+	kept := r.destinations[:0]
+	for _, addr := range r.destinations {
+		if connected[addr] {
+			kept = append(kept, addr)
+			delete(connected, addr)
+		}
+	}
+	r.destinations = kept
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(r.destinations) >= DandelionDestinations {
+			break
+		}
+		if connected[candidates[i]] {
+			r.destinations = append(r.destinations, candidates[i])
+		}
+	}
+	if len(r.destinations) == 0 {
+		return ""
+	}
+
+	for _, addr := range r.destinations {
+		if r.routes[source] == addr {
+			return addr
+		}
+	}
+	dest := r.destinations[rand.Intn(len(r.destinations))]
+	r.routes[source] = dest
+	return dest
+}
+
+// embargo starts the timer after which we fluff a stem transaction that
+// has not come back to us fluffed.
+func (r *dandelionRouter) embargo(hash wire.Hash, now time.Time) {
+	wait := DandelionEmbargoBase + time.Duration(rand.ExpFloat64()*float64(DandelionEmbargoMean))
+	r.mu.Lock()
+	r.embargoes[hash] = now.Add(wait)
+	r.mu.Unlock()
+}
+
+// clearEmbargo stops the embargo timer of a transaction.
+func (r *dandelionRouter) clearEmbargo(hash wire.Hash) {
+	r.mu.Lock()
+	delete(r.embargoes, hash)
+	r.mu.Unlock()
+}
+
+// expired removes and returns the transactions whose embargo has passed.
+func (r *dandelionRouter) expired(now time.Time) []wire.Hash {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var hashes []wire.Hash
+	for hash, end := range r.embargoes {
+		if !now.Before(end) {
+			hashes = append(hashes, hash)
+			delete(r.embargoes, hash)
+		}
+	}
+	return hashes
+}
+
+// stemCandidates returns the connected outbound peers that relay stem
+// transactions.
+func (sm *SyncManager) stemCandidates() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var candidates []string
+	for addr, peer := range sm.peers {
+		peer.mu.RLock()
+		ok := !peer.inbound && peer.connected && peer.version != nil && peer.version.Services&SFNodeDandelion != 0
+		peer.mu.RUnlock()
+		if ok {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+// SubmitTransaction accepts a transaction created by this node and relays
+// it along the Dandelion stem, hiding that it originated here.
+func (sm *SyncManager) SubmitTransaction(tx *wire.MsgTx) error {
+	if _, err := sm.blockchain.AcceptStemTransaction(tx); err != nil {
+		return err
+	}
+	sm.relayStemTx(tx, "")
+	return nil
+}
+
+// relayStemTx passes a stem pool transaction from source to the next hop,
+// or fluffs it if there is none.
+func (sm *SyncManager) relayStemTx(tx *wire.MsgTx, source string) {
+	hash := tx.TxHash()
+	if dest := sm.dandelion.route(source, sm.stemCandidates(), time.Now()); dest != "" {
+		sm.mu.RLock()
+		peer := sm.peers[dest]
+		sm.mu.RUnlock()
+
+		// A stem lost with a dropped peer is fluffed when its embargo expires
+		if peer != nil && peer.IsConnected() {
+			sm.dandelion.embargo(hash, time.Now())
+			peer.QueueMessage(MsgTypeDandelionTx, &TxMessage{Tx: tx})
+			fmt.Printf("[DANDELION] Stemmed transaction %s to %s\n", hash, dest)
+			return
+		}
+	}
+	sm.fluffTx(hash)
+}
+
+// fluffTx moves a stem transaction into the public mempool and announces
+// it to all peers.
+func (sm *SyncManager) fluffTx(hash wire.Hash) {
+	sm.dandelion.clearEmbargo(hash)
+
+	mempool := sm.blockchain.Mempool()
+	tx, err := mempool.GetStemTransaction(hash)
+	if err != nil {
+		return // Fluffed by someone else or mined meanwhile
+	}
+	if err := mempool.FluffTransaction(hash); err != nil {
+		fmt.Printf("[DANDELION] Failed to fluff transaction %s: %v\n", hash, err)
+		return
+	}
+
+	sm.mu.Lock()
+	sm.knownTxs[hash] = true
+	sm.mu.Unlock()
+
+	fmt.Printf("[DANDELION] Fluffing transaction %s\n", hash)
+	sm.announceTx(tx, "")
+}
+
+// handleDandelionTx processes a stem transaction from a peer.
+func (sm *SyncManager) handleDandelionTx(peer *Peer, msg *P2PMessage) error {
+	txMsg := &TxMessage{}
+	if err := peer.decodePayload(msg, txMsg); err != nil {
+		peer.AdjustScore(ScoreProtocolViolation)
+		return err
+	}
+	tx := txMsg.Tx
+	txHash := tx.TxHash()
+	peer.addKnownInventory(txHash)
+
+	// Stems may loop back to us; the first copy has been handled
+	mempool := sm.blockchain.Mempool()
+	if mempool.HasTransaction(txHash) || mempool.HasStemTransaction(txHash) {
+		return nil
+	}
+
+	if _, err := sm.blockchain.AcceptStemTransaction(tx); err != nil {
+		fmt.Printf("[DANDELION] Rejected stem transaction %s: %v\n", txHash, err)
+		peer.AdjustScore(ScoreInvalidTx)
+		return nil
+	}
+	peer.AdjustScore(ScoreValidTx)
+
+	sm.relayStemTx(tx, peer.addr)
+	return nil
+}
+
+// dandelionLoop fluffs stem transactions whose embargo expired, which
+// happens when a node further down the stem dropped them.
+func (sm *SyncManager) dandelionLoop() {
+	ticker := time.NewTicker(dandelionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.stopChan:
+			return
+		case now := <-ticker.C:
+			for _, hash := range sm.dandelion.expired(now) {
+				fmt.Printf("[DANDELION] Embargo expired for transaction %s\n", hash)
+				sm.fluffTx(hash)
+			}
+		}
+	}
+}
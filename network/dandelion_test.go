@@ -0,0 +1,166 @@
+package network
+
+import (
+	"obsidian-core/blockchain"
+	"obsidian-core/crypto"
+	"obsidian-core/wire"
+	"testing"
+	"time"
+)
+
+// fundedTestTx connects a block paying a fresh key and returns a signed
+// transaction spending its coinbase
+func fundedTestTx(t *testing.T, chain *blockchain.BlockChain) *wire.MsgTx {
+	key, _, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	address := crypto.KeyToAddress(&key.PublicKey)
+	if err := chain.ProcessBlock(mineOnTip(t, chain, address), nil); err != nil {
+		t.Fatalf("ProcessBlock failed: %v", err)
+	}
+
+	builder := blockchain.NewShieldedTxBuilder(chain)
+	builder.AddTransparentSource(key)
+	if err := builder.AddOutput(address, 1000, nil); err != nil {
+		t.Fatalf("AddOutput failed: %v", err)
+	}
+	tx, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Failed to build transaction: %v", err)
+	}
+	return tx
+}
+
+// connectStemPeer connects an outbound peer relaying stem transactions
+func connectStemPeer(sm *SyncManager, addr string) (*Peer, <-chan *P2PMessage) {
+	peer, _, received := connectRemotePeer(sm, addr)
+	peer.mu.Lock()
+	peer.inbound = false
+	peer.version = &VersionMessage{Version: ProtocolVersion, Services: SFNodeNetwork | SFNodeDandelion}
+	peer.mu.Unlock()
+	return peer, received
+}
+
+func TestDandelionRoutes(t *testing.T) {
+	r := newDandelionRouter()
+	now := time.Now()
+	candidates := []string{"a", "b", "c"}
+
+	r.route("", candidates, now)
+	r.diffuser = false
+	own := r.route("", candidates, now)
+	if own == "" || len(r.destinations) != DandelionDestinations {
+		t.Fatalf("route = %q with destinations %v", own, r.destinations)
+	}
+	for i := 0; i < 10; i++ {
+		if got := r.route("", candidates, now); got != own {
+			t.Fatalf("own transactions routed to %s, then %s", own, got)
+		}
+	}
+
+	// A destination that disconnected is replaced
+	var remaining []string
+	for _, addr := range candidates {
+		if addr != own {
+			remaining = append(remaining, addr)
+		}
+	}
+	if got := r.route("", remaining, now); got == own || got == "" {
+		t.Errorf("route = %q after %s disconnected", got, own)
+	}
+
+	// Diffusers fluff relayed transactions but still stem their own
+	r.diffuser = true
+	if got := r.route("peer", remaining, now); got != "" {
+		t.Errorf("diffuser routed a relayed transaction to %s", got)
+	}
+	if got := r.route("", remaining, now); got == "" {
+		t.Error("diffuser fluffed its own transaction")
+	}
+
+	// Routes are redrawn each epoch
+	r.route("", remaining, now.Add(DandelionEpoch))
+	if !r.epochEnd.After(now.Add(DandelionEpoch)) {
+		t.Error("epoch did not advance")
+	}
+
+	// Without candidates everything is fluffed
+	if got := newDandelionRouter().route("", nil, now); got != "" {
+		t.Errorf("routed to %s without candidates", got)
+	}
+}
+
+func TestDandelionStemAndFluff(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	_, stemReceived := connectStemPeer(sm, "stem")
+	_, source, sourceReceived := connectRemotePeer(sm, "source")
+	_, watcher, watcherReceived := connectRemotePeer(sm, "watcher")
+
+	// Force a relaying epoch
+	sm.dandelion.route("", nil, time.Now())
+	sm.dandelion.diffuser = false
+
+	// A stem spending an unknown output is dropped, the valid one relayed
+	invalid := compactTestTx(1)
+	tx := fundedTestTx(t, chain)
+	source.SendMessage(MsgTypeDandelionTx, &TxMessage{Tx: invalid})
+	source.SendMessage(MsgTypeDandelionTx, &TxMessage{Tx: tx})
+	relayed := &TxMessage{}
+	source.decodePayload(expectMessage(t, stemReceived, MsgTypeDandelionTx), relayed)
+	if relayed.Tx.TxHash() != tx.TxHash() {
+		t.Fatalf("stemmed %s, want %s", relayed.Tx.TxHash(), tx.TxHash())
+	}
+	if chain.Mempool().HasStemTransaction(invalid.TxHash()) {
+		t.Error("invalid stem transaction accepted")
+	}
+
+	// Stem transactions stay out of the public pool and are not served
+	mempool := chain.Mempool()
+	if !mempool.HasStemTransaction(tx.TxHash()) || mempool.HasTransaction(tx.TxHash()) {
+		t.Fatal("stem transaction not kept in the stem pool")
+	}
+	source.SendMessage(MsgTypeGetData, &GetDataMessage{Type: "tx", Hashes: []wire.Hash{tx.TxHash()}})
+	expectMessage(t, sourceReceived, MsgTypeNotFound)
+
+	// Conflicting stem transactions are refused
+	conflict := compactTestTx(1)
+	conflict.TxIn[0].PreviousOutPoint = tx.TxIn[0].PreviousOutPoint
+	conflict.TxOut[0].Value = 999
+	if err := mempool.AddStemTransaction(conflict, 0, 0); err == nil {
+		t.Error("conflicting stem transaction accepted")
+	}
+
+	// With the embargo passed we fluff the transaction ourselves, announcing
+	// it to peers that do not know it yet
+	for _, hash := range sm.dandelion.expired(time.Now().Add(time.Hour)) {
+		sm.fluffTx(hash)
+	}
+	if !mempool.HasTransaction(tx.TxHash()) || mempool.HasStemTransaction(tx.TxHash()) {
+		t.Fatal("transaction not fluffed into the public pool")
+	}
+	inv := &InvMessage{}
+	watcher.decodePayload(expectMessage(t, watcherReceived, MsgTypeInv), inv)
+	if len(inv.Hashes) != 1 || inv.Hashes[0] != tx.TxHash() {
+		t.Errorf("fluff announced %v", inv.Hashes)
+	}
+}
+
+func TestDandelionFluffsWithoutStemPeers(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	_, watcher, received := connectRemotePeer(sm, "watcher")
+
+	tx := compactTestTx(2)
+	if err := chain.Mempool().AddStemTransaction(tx, 0, 0); err != nil {
+		t.Fatalf("AddStemTransaction failed: %v", err)
+	}
+	sm.relayStemTx(tx, "")
+
+	inv := &InvMessage{}
+	watcher.decodePayload(expectMessage(t, received, MsgTypeInv), inv)
+	if inv.Hashes[0] != tx.TxHash() || !chain.Mempool().HasTransaction(tx.TxHash()) {
+		t.Error("transaction not fluffed without stem peers")
+	}
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSeedTimeout bounds the lookup of each DNS seed
+const DNSSeedTimeout = 10 * time.Second
+
+// SeedQueryHost returns the name to query a DNS seed for nodes offering
+// services. Seeds return full nodes for their bare name; other service
+// sets are asked for with the "x<hex services>." subdomain convention.
+func SeedQueryHost(seed string, services ServiceFlag) string {
+	if services == SFNodeNetwork {
+		return seed
+	}
+	return fmt.Sprintf("x%x.%s", uint64(services), seed)
+}
+
+// ParseSeedQueryHost splits a name queried from a DNS seed into the zone
+// and the services asked for, defaulting to full nodes.
+func ParseSeedQueryHost(name, zone string) (ServiceFlag, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	if name == zone {
+		return SFNodeNetwork, true
+	}
+	label := strings.TrimSuffix(name, "."+zone)
+	if label == name || !strings.HasPrefix(label, "x") || strings.Contains(label, ".") {
+		return 0, false
+	}
+	var services uint64
+	if _, err := fmt.Sscanf(label[1:], "%x", &services); err != nil || fmt.Sprintf("%x", services) != label[1:] {
+		return 0, false
+	}
+	return ServiceFlag(services), true
+}
+
+// SetResolver makes DNS seed lookups use resolver, such as one pointed at
+// a local seeder.
+func (pm *PeerManager) SetResolver(resolver *net.Resolver) {
+	pm.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return resolver.LookupIP(ctx, "ip", host)
+	}
+}
+
+// SetRequiredServices sets the services asked of DNS seeds.
+func (pm *PeerManager) SetRequiredServices(services ServiceFlag) {
+	pm.services = services
+}
+
+// seedLookup returns the function resolving seed names: the configured
+// resolver, Tor's SOCKS5 resolve when Tor is enabled, or the system's
+// A and AAAA lookups.
+func (pm *PeerManager) seedLookup() func(context.Context, string) ([]net.IP, error) {
+	if pm.lookupIP != nil {
+		return pm.lookupIP
+	}
+	if pm.torEnabled() {
+		return pm.torClient.Resolve
+	}
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+}
+
+// resolveSeeds looks up the DNS seeds in parallel, returning the nodes
+// found with the seed each came from. A seed may carry its own port;
+// otherwise the network's default port is used.
+func (pm *PeerManager) resolveSeeds(seeds []string) map[string][]string {
+	lookup := pm.seedLookup()
+	found := make(map[string][]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, seed := range seeds {
+		wg.Add(1)
+		go func(seed string) {
+			defer wg.Done()
+			host, port, err := net.SplitHostPort(seed)
+			if err != nil {
+				host, port = seed, pm.params.DefaultPort
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), DNSSeedTimeout)
+			defer cancel()
+			ips, err := lookup(ctx, SeedQueryHost(host, pm.services))
+			if err != nil {
+				fmt.Printf("[SEED] Failed to resolve DNS seed %s: %v\n", host, err)
+				return
+			}
+
+			addrs := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+			fmt.Printf("[SEED] DNS seed %s returned %d addresses\n", host, len(addrs))
+			mu.Lock()
+			found[seed] = addrs
+			mu.Unlock()
+		}(seed)
+	}
+	wg.Wait()
+	return found
+}
@@ -0,0 +1,484 @@
+package network
+
+import (
+	"fmt"
+	"obsidian-core/blockchain"
+	"obsidian-core/consensus"
+	"obsidian-core/wire"
+	"sync"
+	"time"
+)
+
+// Headers-first block download
+const (
+	BlockDownloadWindow      = 1024             // Blocks past the tip that may be requested
+	MaxBlocksInFlightPerPeer = 16               // Outstanding block requests per peer
+	BlockStallTimeout        = 10 * time.Second // Requests older than this are reassigned
+	HeadersTimeout           = 30 * time.Second // Time a peer has to answer getheaders
+	blockDownloadTick        = time.Second
+)
+
+// ibdState is the stage of headers-first sync.
+type ibdState int
+
+const (
+	ibdIdle    ibdState = iota // Caught up with the best known header
+	ibdHeaders                 // Downloading and validating headers from one peer
+	ibdBlocks                  // Downloading blocks for validated headers
+)
+
+// blockRequest is an outstanding getdata for one block.
+type blockRequest struct {
+	peer      *Peer
+	height    int32
+	requested time.Time
+}
+
+// bufferedBlock is a downloaded block waiting for its parent to connect.
+type bufferedBlock struct {
+	block *wire.MsgBlock
+	peer  *Peer
+}
+
+// outgoingMessage is a message queued while the downloader is locked and
+// sent once it is released, so a slow peer never blocks the downloader.
+type outgoingMessage struct {
+	peer    *Peer
+	msgType string
+	payload Message
+}
+
+// blockDownloader drives headers-first sync. It first builds a validated
+// header chain from a single peer, then requests the blocks for it within a
+// window past the tip, spread over every peer known to have them. Requests
+// that stall are reassigned, and blocks are connected in height order from a
+// reorder buffer as their parents arrive.
+type blockDownloader struct {
+	chain *blockchain.BlockChain
+	pow   consensus.PowEngine
+
+	mu          sync.Mutex
+	state       ibdState
+	headers     *blockchain.HeaderChain
+	headerPeer  *Peer
+	headersSent time.Time
+	peers       map[*Peer]int32 // Best height each peer is known to have
+	inFlight    map[wire.Hash]*blockRequest
+	peerLoad    map[*Peer]int
+	stalled     map[*Peer]time.Time // Peers left out of scheduling until then
+	buffer      map[int32]*bufferedBlock
+}
+
+// newBlockDownloader creates an idle downloader for chain.
+func newBlockDownloader(chain *blockchain.BlockChain, pow consensus.PowEngine) *blockDownloader {
+	return &blockDownloader{
+		chain:    chain,
+		pow:      pow,
+		peers:    make(map[*Peer]int32),
+		inFlight: make(map[wire.Hash]*blockRequest),
+		peerLoad: make(map[*Peer]int),
+		stalled:  make(map[*Peer]time.Time),
+		buffer:   make(map[int32]*bufferedBlock),
+	}
+}
+
+// addPeer registers a peer that has completed the handshake, starting a
+// sync from it if it claims a longer chain and none is running.
+func (d *blockDownloader) addPeer(peer *Peer, height int32) []outgoingMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if known, ok := d.peers[peer]; !ok || height > known {
+		d.peers[peer] = height
+	}
+	if d.state == ibdIdle && height > d.chain.Height() {
+		return d.requestHeaders(peer)
+	}
+	return d.schedule()
+}
+
+// removePeer forgets a disconnected peer and hands its work to others.
+func (d *blockDownloader) removePeer(peer *Peer) []outgoingMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.release(peer)
+	delete(d.peers, peer)
+	delete(d.stalled, peer)
+	delete(d.peerLoad, peer)
+
+	var out []outgoingMessage
+	if d.state == ibdHeaders && d.headerPeer == peer {
+		out = d.switchHeaderPeer(peer)
+	}
+	return append(out, d.schedule()...)
+}
+
+// isSyncing reports whether headers or blocks are being downloaded.
+func (d *blockDownloader) isSyncing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state != ibdIdle
+}
+
+// progress returns the height of the best validated header and whether
+// initial block download is under way.
+func (d *blockDownloader) progress() (int32, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	headers := d.chain.Height()
+	if d.headers != nil && d.headers.Height() > headers {
+		headers = d.headers.Height()
+	}
+	return headers, d.state != ibdIdle
+}
+
+// syncHeaders makes sure the header chain extends the current best block,
+// rebuilding it if blocks were connected outside the downloader.
+func (d *blockDownloader) syncHeaders() error {
+	tip := d.chain.Height()
+	if d.headers != nil {
+		best, err := d.chain.BlockHashByHeight(tip)
+		if hash, ok := d.headers.HashAtHeight(tip); ok && err == nil && hash == best {
+			return nil
+		}
+	}
+
+	headers, err := d.chain.NewHeaderChain(d.pow)
+	if err != nil {
+		return fmt.Errorf("failed to build header chain: %v", err)
+	}
+	d.headers = headers
+	return nil
+}
+
+// requestHeaders asks peer for the headers following our best header.
+func (d *blockDownloader) requestHeaders(peer *Peer) []outgoingMessage {
+	if err := d.syncHeaders(); err != nil {
+		fmt.Printf("Cannot sync headers: %v\n", err)
+		return nil
+	}
+	if d.state == ibdIdle {
+		d.state = ibdHeaders
+		fmt.Printf("[SYNC] Downloading headers from %s (height %d, peer claims %d)\n",
+			peer.addr, d.headers.Height(), d.peers[peer])
+	}
+	d.headerPeer = peer
+	d.headersSent = time.Now()
+	return []outgoingMessage{{peer, MsgTypeGetHeaders, &GetHeadersMessage{Locator: d.headers.Locator()}}}
+}
+
+// switchHeaderPeer moves header download from a failed peer to the best
+// other peer, or gives up on headers when there is none.
+func (d *blockDownloader) switchHeaderPeer(failed *Peer) []outgoingMessage {
+	var best *Peer
+	for peer, height := range d.peers {
+		if peer == failed || !peer.IsConnected() || peer.IsBanned() {
+			continue
+		}
+		if best == nil || height > d.peers[best] {
+			best = peer
+		}
+	}
+	if best == nil || d.peers[best] <= d.headers.Height() {
+		d.headerPeer = nil
+		d.beginBlocks()
+		return nil
+	}
+	return d.requestHeaders(best)
+}
+
+// beginBlocks moves to block download if there are validated headers past
+// the tip, or back to idle otherwise.
+func (d *blockDownloader) beginBlocks() {
+	if d.headers != nil && d.headers.Height() > d.chain.Height() {
+		if d.state != ibdBlocks {
+			fmt.Printf("[SYNC] Headers synced to height %d, downloading blocks from height %d\n",
+				d.headers.Height(), d.chain.Height()+1)
+		}
+		d.state = ibdBlocks
+		return
+	}
+	d.state = ibdIdle
+}
+
+// handleHeaders validates headers received from peer and extends the
+// header chain with them. Headers that do not connect to it, such as an
+// announcement from a peer on a longer chain, start a sync from that peer.
+func (d *blockDownloader) handleHeaders(peer *Peer, headers []*wire.BlockHeader) ([]outgoingMessage, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.syncHeaders(); err != nil {
+		return nil, err
+	}
+	fromHeaderPeer := d.state == ibdHeaders && peer == d.headerPeer
+
+	if len(headers) > 0 {
+		if _, ok := d.headers.HeightOf(headers[0].PrevBlock); !ok {
+			if d.state == ibdIdle {
+				return d.requestHeaders(peer), nil
+			}
+			return nil, nil
+		}
+		for _, header := range headers {
+			if _, ok := d.headers.HeightOf(header.BlockHash()); ok {
+				continue
+			}
+			if header.PrevBlock != d.headers.TipHash() {
+				// A competing branch is not misbehavior, but only one
+				// header chain is followed
+				fmt.Printf("[SYNC] Ignoring headers from %s forking from the header chain\n", peer.addr)
+				return nil, nil
+			}
+			break
+		}
+
+		added, err := d.headers.Connect(headers)
+		if err != nil {
+			peer.AdjustScore(ScoreInvalidBlock)
+			if fromHeaderPeer {
+				return d.switchHeaderPeer(peer), err
+			}
+			return nil, err
+		}
+		last, _ := d.headers.HeightOf(headers[len(headers)-1].BlockHash())
+		if last > d.peers[peer] {
+			d.peers[peer] = last
+		}
+		if added > 0 {
+			fmt.Printf("[SYNC] Validated %d headers from %s, best header %d\n", added, peer.addr, d.headers.Height())
+		}
+	}
+
+	if fromHeaderPeer && len(headers) == MaxHeadersPerMessage {
+		return d.requestHeaders(peer), nil
+	}
+	if fromHeaderPeer {
+		// A short reply means the peer has nothing past our best header
+		d.peers[peer] = d.headers.Height()
+	}
+	if fromHeaderPeer || d.state == ibdIdle {
+		d.beginBlocks()
+	}
+	return d.schedule(), nil
+}
+
+// nextRequests fills any free download slots.
+func (d *blockDownloader) nextRequests() []outgoingMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.schedule()
+}
+
+// schedule requests blocks for validated headers within the download
+// window, giving each to the least loaded peer that has it.
+func (d *blockDownloader) schedule() []outgoingMessage {
+	if d.state != ibdBlocks {
+		return nil
+	}
+
+	now := time.Now()
+	batches := make(map[*Peer][]wire.Hash)
+	tip := d.chain.Height()
+	end := tip + BlockDownloadWindow
+	if end > d.headers.Height() {
+		end = d.headers.Height()
+	}
+	for height := tip + 1; height <= end; height++ {
+		hash, _ := d.headers.HashAtHeight(height)
+		if _, ok := d.buffer[height]; ok {
+			continue
+		}
+		if _, ok := d.inFlight[hash]; ok {
+			continue
+		}
+
+		peer := d.pickPeer(height, now)
+		if peer == nil {
+			break
+		}
+		d.inFlight[hash] = &blockRequest{peer: peer, height: height, requested: now}
+		d.peerLoad[peer]++
+		batches[peer] = append(batches[peer], hash)
+	}
+
+	var out []outgoingMessage
+	for peer, hashes := range batches {
+		out = append(out, outgoingMessage{peer, MsgTypeGetData, &GetDataMessage{Type: "block", Hashes: hashes}})
+	}
+	return out
+}
+
+// pickPeer returns the least loaded usable peer known to have the block at
+// height, or nil if every such peer is busy.
+func (d *blockDownloader) pickPeer(height int32, now time.Time) *Peer {
+	var best *Peer
+	for peer, peerHeight := range d.peers {
+		if peerHeight < height || d.peerLoad[peer] >= MaxBlocksInFlightPerPeer {
+			continue
+		}
+		if until, ok := d.stalled[peer]; ok && now.Before(until) {
+			continue
+		}
+		if !peer.IsConnected() || peer.IsBanned() {
+			continue
+		}
+		if best == nil || d.peerLoad[peer] < d.peerLoad[best] {
+			best = peer
+		}
+	}
+	return best
+}
+
+// release drops every request assigned to peer so they can be reassigned.
+func (d *blockDownloader) release(peer *Peer) {
+	for hash, req := range d.inFlight {
+		if req.peer == peer {
+			delete(d.inFlight, hash)
+		}
+	}
+	d.peerLoad[peer] = 0
+}
+
+// reset abandons the current sync, keeping the connected peers.
+func (d *blockDownloader) reset() {
+	d.state = ibdIdle
+	d.headers = nil
+	d.headerPeer = nil
+	d.inFlight = make(map[wire.Hash]*blockRequest)
+	d.peerLoad = make(map[*Peer]int)
+	d.buffer = make(map[int32]*bufferedBlock)
+}
+
+// handleBlock takes a block if it was requested by the downloader and
+// connects every buffered block that now follows the tip. It reports whether
+// the block was taken, along with the blocks connected.
+func (d *blockDownloader) handleBlock(peer *Peer, block *wire.MsgBlock) (bool, []*wire.MsgBlock, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	req, ok := d.inFlight[block.BlockHash()]
+	if !ok {
+		return false, nil, nil
+	}
+	delete(d.inFlight, block.BlockHash())
+	if d.peerLoad[req.peer] > 0 {
+		d.peerLoad[req.peer]--
+	}
+	d.buffer[req.height] = &bufferedBlock{block: block, peer: peer}
+
+	connected, err := d.connectBuffered()
+	if err != nil {
+		return true, connected, err
+	}
+	d.checkDone()
+	return true, connected, nil
+}
+
+// checkDone returns to idle once every validated header has its block
+// connected.
+func (d *blockDownloader) checkDone() {
+	if d.state == ibdBlocks && d.chain.Height() >= d.headers.Height() && len(d.inFlight) == 0 {
+		d.state = ibdIdle
+		fmt.Printf("[SYNC] Block download complete at height %d\n", d.chain.Height())
+	}
+}
+
+// connectBuffered connects buffered blocks in height order from the tip.
+// A block that fails validation means its header chain cannot be trusted, so
+// the sync is abandoned and its sender penalized.
+func (d *blockDownloader) connectBuffered() ([]*wire.MsgBlock, error) {
+	var connected []*wire.MsgBlock
+	for {
+		next := d.chain.Height() + 1
+		buffered, ok := d.buffer[next]
+		if !ok {
+			return connected, nil
+		}
+		delete(d.buffer, next)
+
+		best, err := d.chain.BlockHashByHeight(next - 1)
+		if err != nil || buffered.block.Header.PrevBlock != best {
+			// The chain moved on without us, so start over from the new tip
+			d.reset()
+			return connected, fmt.Errorf("block %d no longer extends the best chain", next)
+		}
+		if err := d.chain.ProcessBlock(buffered.block, d.pow); err != nil {
+			buffered.peer.AdjustScore(ScoreInvalidBlock)
+			d.reset()
+			return connected, fmt.Errorf("failed to connect block %d: %v", next, err)
+		}
+		buffered.peer.AdjustScore(ScoreValidBlock)
+		connected = append(connected, buffered.block)
+	}
+}
+
+// handleNotFound releases requests peer could not serve and stops asking
+// it for blocks at or above the lowest of them.
+func (d *blockDownloader) handleNotFound(peer *Peer, hashes []wire.Hash) []outgoingMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, hash := range hashes {
+		req, ok := d.inFlight[hash]
+		if !ok || req.peer != peer {
+			continue
+		}
+		delete(d.inFlight, hash)
+		d.peerLoad[peer]--
+		if req.height <= d.peers[peer] {
+			d.peers[peer] = req.height - 1
+		}
+	}
+	return d.schedule()
+}
+
+// tick times out stalled requests, reassigning them to other peers, and
+// starts a sync when a peer is known to be ahead.
+func (d *blockDownloader) tick(now time.Time) []outgoingMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var out []outgoingMessage
+	switch d.state {
+	case ibdHeaders:
+		if now.Sub(d.headersSent) > HeadersTimeout {
+			fmt.Printf("[SYNC] Header request to %s timed out\n", d.headerPeer.addr)
+			d.headerPeer.AdjustScore(ScoreTimeout)
+			out = d.switchHeaderPeer(d.headerPeer)
+		}
+	case ibdIdle:
+		for peer, height := range d.peers {
+			if height > d.chain.Height() && peer.IsConnected() && !peer.IsBanned() {
+				return d.requestHeaders(peer)
+			}
+		}
+	}
+
+	// A peer holding up a request holds up the window behind it, so all of
+	// its requests go to other peers and it is left out for a while
+	stalling := make(map[*Peer]bool)
+	for _, req := range d.inFlight {
+		if now.Sub(req.requested) > BlockStallTimeout {
+			stalling[req.peer] = true
+		}
+	}
+	for peer := range stalling {
+		fmt.Printf("[SYNC] Peer %s stalled block download, reassigning %d blocks\n", peer.addr, d.peerLoad[peer])
+		peer.AdjustScore(ScoreTimeout)
+		d.release(peer)
+		d.stalled[peer] = now.Add(BlockStallTimeout)
+	}
+	for peer, until := range d.stalled {
+		if !now.Before(until) {
+			delete(d.stalled, peer)
+		}
+	}
+	if d.state == ibdBlocks {
+		d.checkDone()
+	}
+
+	return append(out, d.schedule()...)
+}
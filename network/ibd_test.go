@@ -0,0 +1,201 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"obsidian-core/blockchain"
+	"obsidian-core/chaincfg"
+	"obsidian-core/consensus"
+	"obsidian-core/wire"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSyncTestChain returns a chain in its own data directory with n mined
+// blocks on top of genesis
+func newSyncTestChain(t *testing.T, n int) *blockchain.BlockChain {
+	t.Setenv("DATA_DIR", t.TempDir())
+	chain, err := blockchain.NewBlockchain(&chaincfg.MainNetParams, consensus.NewDarkMatter())
+	if err != nil {
+		t.Fatalf("Failed to create blockchain: %v", err)
+	}
+	t.Cleanup(chain.Close)
+
+	for i := 0; i < n; i++ {
+		if err := chain.ProcessBlock(mineOnTip(t, chain, "obs1miner"), nil); err != nil {
+			t.Fatalf("ProcessBlock failed: %v", err)
+		}
+	}
+	return chain
+}
+
+// servingPeer answers getheaders and getdata from a chain, optionally
+// ignoring block requests, and counts the blocks it served
+type servingPeer struct {
+	chain      *blockchain.BlockChain
+	peer       *Peer
+	withhold   bool
+	mu         sync.Mutex
+	blocksSent int
+}
+
+func (s *servingPeer) served() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blocksSent
+}
+
+func (s *servingPeer) serve() {
+	for {
+		msg, err := s.peer.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case MsgTypeGetHeaders:
+			req := &GetHeadersMessage{}
+			s.peer.decodePayload(msg, req)
+			headers, _ := s.chain.LocateHeaders(req.Locator, req.StopHash, MaxHeadersPerMessage)
+			s.peer.SendMessage(MsgTypeHeaders, &HeadersMessage{Headers: headers})
+		case MsgTypeGetData:
+			req := &GetDataMessage{}
+			s.peer.decodePayload(msg, req)
+			if s.withhold {
+				continue
+			}
+			for _, hash := range req.Hashes {
+				block, err := s.chain.GetBlock(hash[:])
+				if err != nil {
+					continue
+				}
+				s.peer.SendMessage(MsgTypeBlock, &BlockMessage{Block: block})
+				s.mu.Lock()
+				s.blocksSent++
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// connectServingPeer connects sm to a peer serving source
+func connectServingPeer(sm *SyncManager, source *blockchain.BlockChain, addr string, withhold bool) (*Peer, *servingPeer) {
+	local, remote := net.Pipe()
+	peer := NewPeer(local, addr, true, testMagic)
+	peer.version = &VersionMessage{Version: ProtocolVersion, Height: source.Height()}
+	server := &servingPeer{chain: source, peer: NewPeer(remote, "local", false, testMagic), withhold: withhold}
+	go server.serve()
+
+	sm.mu.Lock()
+	sm.peers[addr] = peer
+	sm.inboundCount++
+	sm.mu.Unlock()
+	go sm.handlePeerMessages(peer)
+	return peer, server
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestSyncManager returns a running sync manager for chain that
+// announces inventory on every trickle check
+func newTestSyncManager(t *testing.T, chain *blockchain.BlockChain) *SyncManager {
+	params := chaincfg.MainNetParams
+	params.Net = testMagic
+	sm := NewSyncManager(chain, NewPeerManager(&params, nil), consensus.NewDarkMatter())
+	sm.running = true
+	sm.inboundTrickle, sm.outboundTrickle = 0, 0 // Announce on every trickle check
+	t.Cleanup(sm.Stop)
+	return sm
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	source := newSyncTestChain(t, 40)
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+
+	var servers []*servingPeer
+	for i := 0; i < 2; i++ {
+		peer, server := connectServingPeer(sm, source, fmt.Sprintf("peer-%d", i), false)
+		servers = append(servers, server)
+		sm.requestHeaderSync(peer)
+	}
+
+	waitFor(t, "sync to height 40", func() bool { return chain.Height() == 40 })
+	best, _ := chain.BestBlock()
+	sourceBest, _ := source.BestBlock()
+	if best.BlockHash() != sourceBest.BlockHash() {
+		t.Error("Synced to a different tip")
+	}
+	for i, server := range servers {
+		if server.served() == 0 {
+			t.Errorf("Peer %d served no blocks; downloads were not spread", i)
+		}
+	}
+
+	waitFor(t, "download to finish", func() bool { return !sm.IsSyncing() })
+	headers, ibd, progress := sm.SyncProgress()
+	if headers != 40 || ibd || progress != 1 {
+		t.Errorf("SyncProgress = %d, %v, %.2f; expected 40, false, 1", headers, ibd, progress)
+	}
+}
+
+func TestStalledPeerReassigned(t *testing.T) {
+	source := newSyncTestChain(t, 40)
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+
+	slow, slowServer := connectServingPeer(sm, source, "slow", true)
+	sm.requestHeaderSync(slow)
+	waitFor(t, "headers", func() bool {
+		headers, _ := sm.downloader.progress()
+		return headers == 40
+	})
+	fast, _ := connectServingPeer(sm, source, "fast", false)
+	sm.requestHeaderSync(fast)
+
+	// The slow peer holds up the window after the fast peer's blocks are
+	// buffered
+	waitFor(t, "fast peer's blocks", func() bool {
+		sm.downloader.mu.Lock()
+		defer sm.downloader.mu.Unlock()
+		return len(sm.downloader.buffer) > 0 && sm.downloader.peerLoad[fast] == 0
+	})
+	if chain.Height() != 0 {
+		t.Fatalf("Connected blocks out of order, height %d", chain.Height())
+	}
+
+	sm.sendAll(sm.downloader.tick(time.Now().Add(BlockStallTimeout + time.Second)))
+	waitFor(t, "sync to height 40", func() bool { return chain.Height() == 40 })
+	if slowServer.served() != 0 {
+		t.Error("Withholding peer served blocks")
+	}
+	if slow.GetScore() >= 0 {
+		t.Errorf("Expected the stalling peer to be penalized, score %d", slow.GetScore())
+	}
+}
+
+func TestInvalidHeadersPenalized(t *testing.T) {
+	source := newSyncTestChain(t, 3)
+	sm := newTestSyncManager(t, newSyncTestChain(t, 0))
+
+	headers, _ := source.LocateHeaders(nil, wire.Hash{}, MaxHeadersPerMessage)
+	bad := *headers[1]
+	bad.Bits = 0x1f00ffff
+
+	local, _ := net.Pipe()
+	peer := NewPeer(local, "liar", true, testMagic)
+	if _, err := sm.downloader.handleHeaders(peer, []*wire.BlockHeader{headers[0], &bad}); err == nil {
+		t.Fatal("Accepted headers with the wrong difficulty")
+	}
+	if peer.GetScore() != ScoreInvalidBlock {
+		t.Errorf("Expected score %d, got %d", ScoreInvalidBlock, peer.GetScore())
+	}
+}
@@ -0,0 +1,844 @@
+// P2P wire protocol. Every message is framed by a fixed 24-byte header,
+// with integers little-endian:
+//
+//	magic     uint32    chaincfg.Params.Net of the network
+//	command   [12]byte  ASCII message type, NUL padded
+//	length    uint32    payload length in bytes
+//	checksum  [4]byte   first 4 bytes of DoubleHashH(payload)
+//
+// followed by the payload in the binary encoding of its message type.
+// Variable lengths and counts are Bitcoin CompactSize integers, and strings
+// and byte slices are prefixed by their length.
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"obsidian-core/wire"
+)
+
+// Protocol versions, negotiated in the version handshake as the lower of
+// the two peers' versions. Message encodings may depend on the version.
+const (
+	// ProtocolVersion is the version this node speaks. Version 1 was the
+	// unframed gob protocol.
+	ProtocolVersion uint32 = 3
+
+	// ServicesVersion is the first version whose version message carries
+	// service flags
+	ServicesVersion uint32 = 3
+
+	// MinProtocolVersion is the oldest version this node accepts
+	MinProtocolVersion uint32 = 2
+)
+
+// ServiceFlag identifies services a node offers, advertised in its
+// version message.
+type ServiceFlag uint64
+
+const (
+	// SFNodeNetwork nodes serve full blocks
+	SFNodeNetwork ServiceFlag = 1 << 0
+
+	// SFNodeBloom nodes serve bloom filtered connections to SPV clients
+	// (BIP 37)
+	SFNodeBloom ServiceFlag = 1 << 2
+
+	// SFNodeCF nodes serve compact block filters (BIP 157)
+	SFNodeCF ServiceFlag = 1 << 6
+
+	// SFNodeDandelion nodes relay Dandelion++ stem transactions
+	SFNodeDandelion ServiceFlag = 1 << 7
+)
+
+// Framing
+const (
+	MessageHeaderSize = 24
+	CommandSize       = 12
+)
+
+// Message limits
+const (
+	MaxInvPerMessage     = 50000
+	MaxHeadersPerMessage = 2000
+	MaxLocatorHashes     = 101
+	MaxAddrPerMessage    = 1000
+	MaxUserAgentLen      = 256
+	MaxAddrLen           = 256  // host:port, including onion addresses
+	maxRejectStringLen   = 256  // Reject reasons and codes
+	maxRejectDataLen     = 1024 // Reject data, such as a hash
+	MaxGetCFilters       = 1000 // Filters per getcfilters request
+	MaxCFHeaders         = 2000 // Filter hashes per cfheaders message
+	MaxCFCheckpoints     = 100000
+)
+
+// Message types for P2P communication
+const (
+	MsgTypeVersion      = "version"
+	MsgTypeVerAck       = "verack"
+	MsgTypeGetHeaders   = "getheaders"
+	MsgTypeHeaders      = "headers"
+	MsgTypeGetBlocks    = "getblocks"
+	MsgTypeBlock        = "block"
+	MsgTypeInv          = "inv"
+	MsgTypeGetData      = "getdata"
+	MsgTypeTx           = "tx"
+	MsgTypePing         = "ping"
+	MsgTypePong         = "pong"
+	MsgTypeAddr         = "addr"
+	MsgTypeGetAddr      = "getaddr"
+	MsgTypeCompactBlock = "cmpctblock"
+	MsgTypeGetBlockTxn  = "getblocktxn"
+	MsgTypeBlockTxn     = "blocktxn"
+	MsgTypeSendCmpct    = "sendcmpct"
+	MsgTypeReject       = "reject"
+	MsgTypeFeeFilter    = "feefilter"
+	MsgTypeSendHeaders  = "sendheaders"
+	MsgTypeNotFound     = "notfound"
+	MsgTypeMemPool      = "mempool"
+	MsgTypeFilterLoad   = "filterload"
+	MsgTypeFilterAdd    = "filteradd"
+	MsgTypeFilterClear  = "filterclear"
+	MsgTypeMerkleBlock  = "merkleblock"
+	MsgTypeGetCFilters  = "getcfilters"
+	MsgTypeCFilter      = "cfilter"
+	MsgTypeGetCFHeaders = "getcfheaders"
+	MsgTypeCFHeaders    = "cfheaders"
+	MsgTypeGetCFCheckpt = "getcfcheckpt"
+	MsgTypeCFCheckpt    = "cfcheckpt"
+	MsgTypeDandelionTx  = "dandeliontx" // Stem phase transaction, a TxMessage
+)
+
+// knownMessageTypes are the commands accepted from peers
+var knownMessageTypes = map[string]bool{
+	MsgTypeVersion:      true,
+	MsgTypeVerAck:       true,
+	MsgTypeGetHeaders:   true,
+	MsgTypeHeaders:      true,
+	MsgTypeGetBlocks:    true,
+	MsgTypeBlock:        true,
+	MsgTypeInv:          true,
+	MsgTypeGetData:      true,
+	MsgTypeTx:           true,
+	MsgTypePing:         true,
+	MsgTypePong:         true,
+	MsgTypeAddr:         true,
+	MsgTypeGetAddr:      true,
+	MsgTypeCompactBlock: true,
+	MsgTypeGetBlockTxn:  true,
+	MsgTypeBlockTxn:     true,
+	MsgTypeSendCmpct:    true,
+	MsgTypeReject:       true,
+	MsgTypeFeeFilter:    true,
+	MsgTypeSendHeaders:  true,
+	MsgTypeNotFound:     true,
+	MsgTypeMemPool:      true,
+	MsgTypeFilterLoad:   true,
+	MsgTypeFilterAdd:    true,
+	MsgTypeFilterClear:  true,
+	MsgTypeMerkleBlock:  true,
+	MsgTypeGetCFilters:  true,
+	MsgTypeCFilter:      true,
+	MsgTypeGetCFHeaders: true,
+	MsgTypeCFHeaders:    true,
+	MsgTypeGetCFCheckpt: true,
+	MsgTypeCFCheckpt:    true,
+	MsgTypeDandelionTx:  true,
+}
+
+// P2PMessage is a framed message: its type and undecoded payload.
+type P2PMessage struct {
+	Type    string
+	Payload []byte
+}
+
+// Message is a message payload with an explicit binary encoding. pver is
+// the protocol version negotiated with the peer.
+type Message interface {
+	Encode(w io.Writer, pver uint32) error
+	Decode(r io.Reader, pver uint32) error
+}
+
+// MessageError reports a message that violates the framing or encoding
+// rules, as opposed to a failure of the connection.
+type MessageError struct {
+	Description string
+}
+
+func (e *MessageError) Error() string {
+	return e.Description
+}
+
+func messageErrorf(format string, args ...interface{}) error {
+	return &MessageError{Description: fmt.Sprintf(format, args...)}
+}
+
+// IsMessageError reports whether err is a protocol violation by the peer
+func IsMessageError(err error) bool {
+	var msgErr *MessageError
+	return errors.As(err, &msgErr)
+}
+
+// checksum returns the first 4 bytes of the payload's double SHA-256
+func checksum(payload []byte) [4]byte {
+	var sum [4]byte
+	hash := wire.DoubleHashH(payload)
+	copy(sum[:], hash[:4])
+	return sum
+}
+
+// EncodeMessage returns the framed encoding of a message. A nil payload is
+// sent as an empty one.
+func EncodeMessage(magic uint32, msgType string, payload Message, pver uint32) ([]byte, error) {
+	if len(msgType) == 0 || len(msgType) > CommandSize {
+		return nil, fmt.Errorf("invalid message type %q", msgType)
+	}
+
+	var body bytes.Buffer
+	if payload != nil {
+		if err := payload.Encode(&body, pver); err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %v", msgType, err)
+		}
+	}
+	if body.Len() > MaxMessageSize {
+		return nil, fmt.Errorf("%s payload too large: %d bytes (max: %d)", msgType, body.Len(), MaxMessageSize)
+	}
+
+	var command [CommandSize]byte
+	copy(command[:], msgType)
+	sum := checksum(body.Bytes())
+
+	framed := bytes.NewBuffer(make([]byte, 0, MessageHeaderSize+body.Len()))
+	if err := writeElements(framed, magic, command, uint32(body.Len()), sum); err != nil {
+		return nil, err
+	}
+	framed.Write(body.Bytes())
+	return framed.Bytes(), nil
+}
+
+// ReadMessage reads one framed message for the network magic. The payload
+// is checked against the header but not decoded.
+func ReadMessage(r io.Reader, magic uint32) (*P2PMessage, error) {
+	var header [MessageHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if got := binary.LittleEndian.Uint32(header[0:4]); got != magic {
+		return nil, messageErrorf("wrong network magic %08x (expected %08x)", got, magic)
+	}
+
+	command := header[4 : 4+CommandSize]
+	end := bytes.IndexByte(command, 0)
+	if end < 0 {
+		end = CommandSize
+	}
+	if end == 0 {
+		return nil, messageErrorf("empty message type")
+	}
+	for i, c := range command {
+		if (i < end && (c < 0x20 || c > 0x7e)) || (i >= end && c != 0) {
+			return nil, messageErrorf("malformed message type %q", command)
+		}
+	}
+	msgType := string(command[:end])
+
+	length := binary.LittleEndian.Uint32(header[16:20])
+	if length > MaxMessageSize {
+		return nil, messageErrorf("message payload too large: %d bytes (max: %d)", length, MaxMessageSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if sum := checksum(payload); !bytes.Equal(sum[:], header[20:24]) {
+		return nil, messageErrorf("checksum mismatch for %s message", msgType)
+	}
+
+	if !knownMessageTypes[msgType] {
+		return nil, messageErrorf("unknown message type: %s", msgType)
+	}
+	return &P2PMessage{Type: msgType, Payload: payload}, nil
+}
+
+// DecodePayload decodes the payload of msg into payload. The payload must
+// be consumed exactly.
+func DecodePayload(msg *P2PMessage, payload Message, pver uint32) error {
+	r := bytes.NewReader(msg.Payload)
+	if err := payload.Decode(r, pver); err != nil {
+		return messageErrorf("failed to decode %s: %v", msg.Type, err)
+	}
+	if r.Len() != 0 {
+		return messageErrorf("%d trailing bytes in %s message", r.Len(), msg.Type)
+	}
+	return nil
+}
+
+// writeElements writes fixed-size values in little-endian order
+func writeElements(w io.Writer, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := binary.Write(w, binary.LittleEndian, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readElements reads fixed-size values written by writeElements
+func readElements(r io.Reader, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := binary.Read(r, binary.LittleEndian, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHashes writes a count-prefixed list of hashes
+func writeHashes(w io.Writer, hashes []wire.Hash) error {
+	if err := wire.WriteVarInt(w, uint64(len(hashes))); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := w.Write(hash[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHashes reads a list of at most max hashes written by writeHashes
+func readHashes(r io.Reader, max uint64, field string) ([]wire.Hash, error) {
+	count, err := wire.ReadCount(r, max, field)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]wire.Hash, count)
+	for i := range hashes {
+		if _, err := io.ReadFull(r, hashes[i][:]); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// VersionMessage contains information about a peer.
+type VersionMessage struct {
+	Version   uint32 // Highest protocol version the peer speaks
+	Height    int32
+	Timestamp int64
+	Services  ServiceFlag // Sent from ServicesVersion on
+	UserAgent string
+}
+
+// The version message is sent before a version is negotiated, so its own
+// Version field decides its layout.
+func (m *VersionMessage) Encode(w io.Writer, pver uint32) error {
+	if err := writeElements(w, m.Version, m.Height, m.Timestamp); err != nil {
+		return err
+	}
+	if m.Version >= ServicesVersion {
+		if err := writeElements(w, uint64(m.Services)); err != nil {
+			return err
+		}
+	}
+	return wire.WriteVarString(w, m.UserAgent)
+}
+
+func (m *VersionMessage) Decode(r io.Reader, pver uint32) error {
+	if err := readElements(r, &m.Version, &m.Height, &m.Timestamp); err != nil {
+		return err
+	}
+	if m.Version >= ServicesVersion {
+		var services uint64
+		if err := readElements(r, &services); err != nil {
+			return err
+		}
+		m.Services = ServiceFlag(services)
+	}
+	var err error
+	m.UserAgent, err = wire.ReadVarString(r, MaxUserAgentLen, "user agent")
+	return err
+}
+
+// emptyMessage is the encoding of messages without a payload
+type emptyMessage struct{}
+
+func (emptyMessage) Encode(w io.Writer, pver uint32) error { return nil }
+func (emptyMessage) Decode(r io.Reader, pver uint32) error { return nil }
+
+// VerAckMessage acknowledges a version message.
+type VerAckMessage struct{ emptyMessage }
+
+// GetAddrMessage requests known peer addresses.
+type GetAddrMessage struct{ emptyMessage }
+
+// SendHeadersMessage requests headers-first block relay.
+type SendHeadersMessage struct{ emptyMessage }
+
+// MemPoolMessage requests mempool contents.
+type MemPoolMessage struct{ emptyMessage }
+
+// PingMessage checks that a peer is alive; it is answered by a pong with
+// the same nonce.
+type PingMessage struct {
+	Nonce uint64
+}
+
+func (m *PingMessage) Encode(w io.Writer, pver uint32) error { return writeElements(w, m.Nonce) }
+func (m *PingMessage) Decode(r io.Reader, pver uint32) error { return readElements(r, &m.Nonce) }
+
+// PongMessage answers a ping.
+type PongMessage struct {
+	Nonce uint64
+}
+
+func (m *PongMessage) Encode(w io.Writer, pver uint32) error { return writeElements(w, m.Nonce) }
+func (m *PongMessage) Decode(r io.Reader, pver uint32) error { return readElements(r, &m.Nonce) }
+
+// HeadersMessage contains block headers.
+type HeadersMessage struct {
+	Headers []*wire.BlockHeader
+}
+
+func (m *HeadersMessage) Encode(w io.Writer, pver uint32) error {
+	if err := wire.WriteVarInt(w, uint64(len(m.Headers))); err != nil {
+		return err
+	}
+	for _, header := range m.Headers {
+		if err := header.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *HeadersMessage) Decode(r io.Reader, pver uint32) error {
+	count, err := wire.ReadCount(r, MaxHeadersPerMessage, "header")
+	if err != nil {
+		return err
+	}
+	m.Headers = make([]*wire.BlockHeader, count)
+	for i := range m.Headers {
+		header := &wire.BlockHeader{}
+		if err := header.Deserialize(r); err != nil {
+			return err
+		}
+		m.Headers[i] = header
+	}
+	return nil
+}
+
+// inventory is the encoding shared by inv, getdata and notfound
+type inventory struct {
+	Type   string // "block" or "tx"
+	Hashes []wire.Hash
+}
+
+func (m *inventory) Encode(w io.Writer, pver uint32) error {
+	if err := wire.WriteVarString(w, m.Type); err != nil {
+		return err
+	}
+	return writeHashes(w, m.Hashes)
+}
+
+func (m *inventory) Decode(r io.Reader, pver uint32) error {
+	var err error
+	if m.Type, err = wire.ReadVarString(r, CommandSize, "inventory type"); err != nil {
+		return err
+	}
+	m.Hashes, err = readHashes(r, MaxInvPerMessage, "inventory")
+	return err
+}
+
+// InvMessage announces known inventory (blocks or transactions).
+type InvMessage inventory
+
+func (m *InvMessage) Encode(w io.Writer, pver uint32) error {
+	return (*inventory)(m).Encode(w, pver)
+}
+
+func (m *InvMessage) Decode(r io.Reader, pver uint32) error {
+	return (*inventory)(m).Decode(r, pver)
+}
+
+// GetDataMessage requests specific inventory items.
+type GetDataMessage inventory
+
+func (m *GetDataMessage) Encode(w io.Writer, pver uint32) error {
+	return (*inventory)(m).Encode(w, pver)
+}
+
+func (m *GetDataMessage) Decode(r io.Reader, pver uint32) error {
+	return (*inventory)(m).Decode(r, pver)
+}
+
+// NotFoundMessage contains inventory that was not found.
+type NotFoundMessage inventory
+
+func (m *NotFoundMessage) Encode(w io.Writer, pver uint32) error {
+	return (*inventory)(m).Encode(w, pver)
+}
+
+func (m *NotFoundMessage) Decode(r io.Reader, pver uint32) error {
+	return (*inventory)(m).Decode(r, pver)
+}
+
+// GetHeadersMessage requests block headers.
+type GetHeadersMessage struct {
+	Locator  []wire.Hash // Block locator of the requester's best chain, newest first
+	StopHash wire.Hash   // Zero hash means get as many as fit in one message
+}
+
+func (m *GetHeadersMessage) Encode(w io.Writer, pver uint32) error {
+	if err := writeHashes(w, m.Locator); err != nil {
+		return err
+	}
+	return writeElements(w, m.StopHash)
+}
+
+func (m *GetHeadersMessage) Decode(r io.Reader, pver uint32) error {
+	locator, err := readHashes(r, MaxLocatorHashes, "locator hash")
+	if err != nil {
+		return err
+	}
+	m.Locator = locator
+	return readElements(r, &m.StopHash)
+}
+
+// GetBlocksMessage requests block hashes.
+type GetBlocksMessage struct {
+	StartHash wire.Hash
+	StopHash  wire.Hash
+}
+
+func (m *GetBlocksMessage) Encode(w io.Writer, pver uint32) error {
+	return writeElements(w, m.StartHash, m.StopHash)
+}
+
+func (m *GetBlocksMessage) Decode(r io.Reader, pver uint32) error {
+	return readElements(r, &m.StartHash, &m.StopHash)
+}
+
+// BlockMessage carries a full block.
+type BlockMessage struct {
+	Block *wire.MsgBlock
+}
+
+func (m *BlockMessage) Encode(w io.Writer, pver uint32) error {
+	return m.Block.Serialize(w)
+}
+
+func (m *BlockMessage) Decode(r io.Reader, pver uint32) error {
+	m.Block = &wire.MsgBlock{}
+	return m.Block.Deserialize(r)
+}
+
+// TxMessage carries a transaction.
+type TxMessage struct {
+	Tx *wire.MsgTx
+}
+
+func (m *TxMessage) Encode(w io.Writer, pver uint32) error {
+	return m.Tx.Serialize(w)
+}
+
+func (m *TxMessage) Decode(r io.Reader, pver uint32) error {
+	m.Tx = &wire.MsgTx{}
+	return m.Tx.Deserialize(r)
+}
+
+// AddrMessage contains peer addresses.
+type AddrMessage struct {
+	Addresses []string
+}
+
+func (m *AddrMessage) Encode(w io.Writer, pver uint32) error {
+	if err := wire.WriteVarInt(w, uint64(len(m.Addresses))); err != nil {
+		return err
+	}
+	for _, addr := range m.Addresses {
+		if err := wire.WriteVarString(w, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *AddrMessage) Decode(r io.Reader, pver uint32) error {
+	count, err := wire.ReadCount(r, MaxAddrPerMessage, "address")
+	if err != nil {
+		return err
+	}
+	m.Addresses = make([]string, count)
+	for i := range m.Addresses {
+		if m.Addresses[i], err = wire.ReadVarString(r, MaxAddrLen, "address"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RejectMessage contains rejection information for invalid messages.
+type RejectMessage struct {
+	Message string // The command that was rejected
+	CCode   string // Rejection code (e.g., "malformed", "invalid", "obsolete", "duplicate", "nonstandard", "dust", "insufficientfee", "checkpoint")
+	Reason  string // Human-readable reason for rejection
+	Data    []byte // Extra data (e.g., the hash of the rejected object)
+}
+
+func (m *RejectMessage) Encode(w io.Writer, pver uint32) error {
+	for _, s := range []string{m.Message, m.CCode, m.Reason} {
+		if err := wire.WriteVarString(w, s); err != nil {
+			return err
+		}
+	}
+	return wire.WriteVarBytes(w, m.Data)
+}
+
+func (m *RejectMessage) Decode(r io.Reader, pver uint32) error {
+	var err error
+	for _, s := range []*string{&m.Message, &m.CCode, &m.Reason} {
+		if *s, err = wire.ReadVarString(r, maxRejectStringLen, "reject field"); err != nil {
+			return err
+		}
+	}
+	m.Data, err = wire.ReadVarBytes(r, maxRejectDataLen, "reject data")
+	return err
+}
+
+// FeeFilterMessage contains the minimum fee rate.
+type FeeFilterMessage struct {
+	FeeRate int64 // Minimum fee rate in satoshis per kilobyte
+}
+
+func (m *FeeFilterMessage) Encode(w io.Writer, pver uint32) error {
+	return writeElements(w, m.FeeRate)
+}
+
+func (m *FeeFilterMessage) Decode(r io.Reader, pver uint32) error {
+	return readElements(r, &m.FeeRate)
+}
+
+// SendCmpctMessage negotiates compact block relay.
+type SendCmpctMessage struct {
+	Announce bool   // Announce new blocks as compact blocks
+	Version  uint64 // Compact block version
+}
+
+func (m *SendCmpctMessage) Encode(w io.Writer, pver uint32) error {
+	return writeElements(w, m.Announce, m.Version)
+}
+
+func (m *SendCmpctMessage) Decode(r io.Reader, pver uint32) error {
+	return readElements(r, &m.Announce, &m.Version)
+}
+
+// CompactBlockMessage carries a block as short transaction IDs.
+type CompactBlockMessage struct {
+	Block *wire.CompactBlock
+}
+
+func (m *CompactBlockMessage) Encode(w io.Writer, pver uint32) error {
+	return m.Block.Serialize(w)
+}
+
+func (m *CompactBlockMessage) Decode(r io.Reader, pver uint32) error {
+	m.Block = &wire.CompactBlock{}
+	return m.Block.Deserialize(r)
+}
+
+// GetBlockTxnMessage requests the transactions a compact block could not
+// be reconstructed without.
+type GetBlockTxnMessage struct {
+	Request *wire.BlockTxRequest
+}
+
+func (m *GetBlockTxnMessage) Encode(w io.Writer, pver uint32) error {
+	return m.Request.Serialize(w)
+}
+
+func (m *GetBlockTxnMessage) Decode(r io.Reader, pver uint32) error {
+	m.Request = &wire.BlockTxRequest{}
+	return m.Request.Deserialize(r)
+}
+
+// BlockTxnMessage answers a getblocktxn request.
+type BlockTxnMessage struct {
+	Response *wire.BlockTxResponse
+}
+
+func (m *BlockTxnMessage) Encode(w io.Writer, pver uint32) error {
+	return m.Response.Serialize(w)
+}
+
+func (m *BlockTxnMessage) Decode(r io.Reader, pver uint32) error {
+	m.Response = &wire.BlockTxResponse{}
+	return m.Response.Deserialize(r)
+}
+
+// FilterLoadMessage loads a bloom filter restricting the transactions and
+// merkle blocks relayed to an SPV peer.
+type FilterLoadMessage wire.FilterLoadMsg
+
+func (m *FilterLoadMessage) Encode(w io.Writer, pver uint32) error {
+	return (*wire.FilterLoadMsg)(m).Serialize(w)
+}
+
+func (m *FilterLoadMessage) Decode(r io.Reader, pver uint32) error {
+	return (*wire.FilterLoadMsg)(m).Deserialize(r)
+}
+
+// FilterAddMessage adds an element to the loaded bloom filter.
+type FilterAddMessage wire.FilterAddMsg
+
+func (m *FilterAddMessage) Encode(w io.Writer, pver uint32) error {
+	return (*wire.FilterAddMsg)(m).Serialize(w)
+}
+
+func (m *FilterAddMessage) Decode(r io.Reader, pver uint32) error {
+	return (*wire.FilterAddMsg)(m).Deserialize(r)
+}
+
+// FilterClearMessage removes the loaded bloom filter.
+type FilterClearMessage wire.FilterClearMsg
+
+func (m *FilterClearMessage) Encode(w io.Writer, pver uint32) error { return nil }
+func (m *FilterClearMessage) Decode(r io.Reader, pver uint32) error { return nil }
+
+// MerkleBlockMessage carries a filtered block. The matched transactions
+// follow it as tx messages.
+type MerkleBlockMessage struct {
+	Block *wire.MerkleBlock
+}
+
+func (m *MerkleBlockMessage) Encode(w io.Writer, pver uint32) error {
+	return m.Block.Serialize(w)
+}
+
+func (m *MerkleBlockMessage) Decode(r io.Reader, pver uint32) error {
+	m.Block = &wire.MerkleBlock{}
+	return m.Block.Deserialize(r)
+}
+
+// GetCFiltersMessage requests the filters of main chain blocks from
+// StartHeight up to and including StopHash.
+type GetCFiltersMessage struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    wire.Hash
+}
+
+func (m *GetCFiltersMessage) Encode(w io.Writer, pver uint32) error {
+	return writeElements(w, m.FilterType, m.StartHeight, m.StopHash)
+}
+
+func (m *GetCFiltersMessage) Decode(r io.Reader, pver uint32) error {
+	return readElements(r, &m.FilterType, &m.StartHeight, &m.StopHash)
+}
+
+// CFilterMessage carries one block's filter in reply to getcfilters.
+type CFilterMessage struct {
+	FilterType uint8
+	BlockHash  wire.Hash
+	Filter     []byte // Serialized wire.GCSFilter
+}
+
+func (m *CFilterMessage) Encode(w io.Writer, pver uint32) error {
+	if err := writeElements(w, m.FilterType, m.BlockHash); err != nil {
+		return err
+	}
+	return wire.WriteVarBytes(w, m.Filter)
+}
+
+func (m *CFilterMessage) Decode(r io.Reader, pver uint32) error {
+	if err := readElements(r, &m.FilterType, &m.BlockHash); err != nil {
+		return err
+	}
+	var err error
+	m.Filter, err = wire.ReadVarBytes(r, wire.MaxGCSFilterSize, "block filter")
+	return err
+}
+
+// GetCFHeadersMessage requests the filter hashes of main chain blocks from
+// StartHeight up to and including StopHash.
+type GetCFHeadersMessage struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    wire.Hash
+}
+
+func (m *GetCFHeadersMessage) Encode(w io.Writer, pver uint32) error {
+	return writeElements(w, m.FilterType, m.StartHeight, m.StopHash)
+}
+
+func (m *GetCFHeadersMessage) Decode(r io.Reader, pver uint32) error {
+	return readElements(r, &m.FilterType, &m.StartHeight, &m.StopHash)
+}
+
+// CFHeadersMessage answers getcfheaders with the filter header preceding
+// the range and the filter hashes in it, from which the requester derives
+// the range's filter headers.
+type CFHeadersMessage struct {
+	FilterType       uint8
+	StopHash         wire.Hash
+	PrevFilterHeader wire.Hash
+	FilterHashes     []wire.Hash
+}
+
+func (m *CFHeadersMessage) Encode(w io.Writer, pver uint32) error {
+	if err := writeElements(w, m.FilterType, m.StopHash, m.PrevFilterHeader); err != nil {
+		return err
+	}
+	return writeHashes(w, m.FilterHashes)
+}
+
+func (m *CFHeadersMessage) Decode(r io.Reader, pver uint32) error {
+	if err := readElements(r, &m.FilterType, &m.StopHash, &m.PrevFilterHeader); err != nil {
+		return err
+	}
+	var err error
+	m.FilterHashes, err = readHashes(r, MaxCFHeaders, "filter hash")
+	return err
+}
+
+// GetCFCheckptMessage requests filter headers at every checkpoint interval
+// up to StopHash.
+type GetCFCheckptMessage struct {
+	FilterType uint8
+	StopHash   wire.Hash
+}
+
+func (m *GetCFCheckptMessage) Encode(w io.Writer, pver uint32) error {
+	return writeElements(w, m.FilterType, m.StopHash)
+}
+
+func (m *GetCFCheckptMessage) Decode(r io.Reader, pver uint32) error {
+	return readElements(r, &m.FilterType, &m.StopHash)
+}
+
+// CFCheckptMessage answers getcfcheckpt with evenly spaced filter headers.
+type CFCheckptMessage struct {
+	FilterType    uint8
+	StopHash      wire.Hash
+	FilterHeaders []wire.Hash
+}
+
+func (m *CFCheckptMessage) Encode(w io.Writer, pver uint32) error {
+	if err := writeElements(w, m.FilterType, m.StopHash); err != nil {
+		return err
+	}
+	return writeHashes(w, m.FilterHeaders)
+}
+
+func (m *CFCheckptMessage) Decode(r io.Reader, pver uint32) error {
+	if err := readElements(r, &m.FilterType, &m.StopHash); err != nil {
+		return err
+	}
+	var err error
+	m.FilterHeaders, err = readHashes(r, MaxCFCheckpoints, "checkpoint filter header")
+	return err
+}
@@ -0,0 +1,170 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"obsidian-core/wire"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testMagic = 0x0b51d1a5
+
+func TestMessageRoundTrip(t *testing.T) {
+	header := &wire.BlockHeader{
+		Version:   1,
+		PrevBlock: wire.Hash{1},
+		Timestamp: time.Unix(1700000000, 0),
+		Bits:      0x1d00ffff,
+	}
+	block := wire.NewMsgBlock(header)
+	block.AddTransaction(wire.NewCoinbaseTx(1, 5000, "obs1miner"))
+
+	tests := []struct {
+		msgType string
+		payload Message
+		decoded Message
+	}{
+		{MsgTypeVersion, &VersionMessage{Version: ProtocolVersion, Height: 42, Timestamp: 1700000000, Services: SFNodeNetwork | SFNodeBloom, UserAgent: "Obsidian/2.0.0"}, &VersionMessage{}},
+		{MsgTypeVersion, &VersionMessage{Version: MinProtocolVersion, Height: 42, Timestamp: 1700000000, UserAgent: "Obsidian/2.0.0"}, &VersionMessage{}},
+		{MsgTypeVerAck, &VerAckMessage{}, &VerAckMessage{}},
+		{MsgTypePing, &PingMessage{Nonce: 7}, &PingMessage{}},
+		{MsgTypeGetHeaders, &GetHeadersMessage{Locator: []wire.Hash{{2}, {1}}, StopHash: wire.Hash{3}}, &GetHeadersMessage{}},
+		{MsgTypeInv, &InvMessage{Type: "tx", Hashes: []wire.Hash{{3}, {4}}}, &InvMessage{}},
+		{MsgTypeAddr, &AddrMessage{Addresses: []string{"127.0.0.1:8333", "example.onion:8333"}}, &AddrMessage{}},
+		{MsgTypeReject, &RejectMessage{Message: "tx", CCode: "invalid", Reason: "bad", Data: []byte{5}}, &RejectMessage{}},
+		{MsgTypeFeeFilter, &FeeFilterMessage{FeeRate: 1000}, &FeeFilterMessage{}},
+		{MsgTypeSendCmpct, &SendCmpctMessage{Announce: true, Version: 1}, &SendCmpctMessage{}},
+		{MsgTypeFilterLoad, &FilterLoadMessage{Filter: []byte{1, 2}, HashFuncs: 3, Tweak: 4, Flags: 1}, &FilterLoadMessage{}},
+		{MsgTypeFilterAdd, &FilterAddMessage{Data: []byte{5}}, &FilterAddMessage{}},
+		{MsgTypeFilterClear, &FilterClearMessage{}, &FilterClearMessage{}},
+		{MsgTypeGetCFilters, &GetCFiltersMessage{StartHeight: 5, StopHash: wire.Hash{6}}, &GetCFiltersMessage{}},
+		{MsgTypeCFilter, &CFilterMessage{BlockHash: wire.Hash{6}, Filter: []byte{1, 0xab}}, &CFilterMessage{}},
+		{MsgTypeCFHeaders, &CFHeadersMessage{StopHash: wire.Hash{6}, PrevFilterHeader: wire.Hash{7}, FilterHashes: []wire.Hash{{8}, {9}}}, &CFHeadersMessage{}},
+		{MsgTypeCFCheckpt, &CFCheckptMessage{StopHash: wire.Hash{6}, FilterHeaders: []wire.Hash{{10}}}, &CFCheckptMessage{}},
+	}
+
+	for _, tt := range tests {
+		framed, err := EncodeMessage(testMagic, tt.msgType, tt.payload, ProtocolVersion)
+		if err != nil {
+			t.Fatalf("EncodeMessage(%s) failed: %v", tt.msgType, err)
+		}
+		msg, err := ReadMessage(bytes.NewReader(framed), testMagic)
+		if err != nil {
+			t.Fatalf("ReadMessage(%s) failed: %v", tt.msgType, err)
+		}
+		if msg.Type != tt.msgType {
+			t.Errorf("Expected type %s, got %s", tt.msgType, msg.Type)
+		}
+		if err := DecodePayload(msg, tt.decoded, ProtocolVersion); err != nil {
+			t.Fatalf("DecodePayload(%s) failed: %v", tt.msgType, err)
+		}
+		if !reflect.DeepEqual(tt.decoded, tt.payload) {
+			t.Errorf("%s decoded as %+v, expected %+v", tt.msgType, tt.decoded, tt.payload)
+		}
+	}
+
+	// Blocks and headers keep their hashes
+	framed, err := EncodeMessage(testMagic, MsgTypeBlock, &BlockMessage{Block: block}, ProtocolVersion)
+	if err != nil {
+		t.Fatalf("EncodeMessage(block) failed: %v", err)
+	}
+	msg, err := ReadMessage(bytes.NewReader(framed), testMagic)
+	if err != nil {
+		t.Fatalf("ReadMessage(block) failed: %v", err)
+	}
+	decoded := &BlockMessage{}
+	if err := DecodePayload(msg, decoded, ProtocolVersion); err != nil {
+		t.Fatalf("DecodePayload(block) failed: %v", err)
+	}
+	if decoded.Block.BlockHash() != block.BlockHash() {
+		t.Error("Block hash changed in transit")
+	}
+}
+
+func TestReadMessageRejects(t *testing.T) {
+	framed, err := EncodeMessage(testMagic, MsgTypePing, &PingMessage{Nonce: 1}, ProtocolVersion)
+	if err != nil {
+		t.Fatalf("EncodeMessage failed: %v", err)
+	}
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), framed...))
+	}
+
+	tests := []struct {
+		name  string
+		bytes []byte
+	}{
+		{"wrong magic", corrupt(func(b []byte) []byte { b[0] ^= 0xff; return b })},
+		{"bad checksum", corrupt(func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b })},
+		{"unknown command", corrupt(func(b []byte) []byte { copy(b[4:16], "bogus\x00\x00\x00\x00\x00\x00\x00"); return b })},
+		{"unpadded command", corrupt(func(b []byte) []byte { b[15] = 'x'; return b })},
+		{"oversized", corrupt(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[16:20], MaxMessageSize+1)
+			return b
+		})},
+	}
+	for _, tt := range tests {
+		if _, err := ReadMessage(bytes.NewReader(tt.bytes), testMagic); !IsMessageError(err) {
+			t.Errorf("%s: expected a message error, got %v", tt.name, err)
+		}
+	}
+
+	// A payload with trailing bytes does not decode
+	msg := &P2PMessage{Type: MsgTypePing, Payload: make([]byte, 9)}
+	if err := DecodePayload(msg, &PingMessage{}, ProtocolVersion); !IsMessageError(err) {
+		t.Errorf("Expected trailing bytes to be rejected, got %v", err)
+	}
+}
+
+func TestPeerFraming(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sender := NewPeer(a, "a", false, testMagic)
+	receiver := NewPeer(b, "b", true, testMagic)
+
+	// Several messages in a row stay framed on one stream
+	go func() {
+		for i := uint64(0); i < 3; i++ {
+			sender.SendMessage(MsgTypePing, &PingMessage{Nonce: i})
+		}
+		sender.SendMessage(MsgTypeVerAck, nil)
+	}()
+
+	for i := uint64(0); i < 3; i++ {
+		msg, err := receiver.ReceiveMessageWithTimeout(time.Second)
+		if err != nil {
+			t.Fatalf("ReceiveMessage failed: %v", err)
+		}
+		ping := &PingMessage{}
+		if err := receiver.decodePayload(msg, ping); err != nil || ping.Nonce != i {
+			t.Fatalf("Expected ping %d, got %+v (%v)", i, ping, err)
+		}
+	}
+	msg, err := receiver.ReceiveMessageWithTimeout(time.Second)
+	if err != nil || msg.Type != MsgTypeVerAck || len(msg.Payload) != 0 {
+		t.Fatalf("Expected empty verack, got %+v (%v)", msg, err)
+	}
+
+	// A peer on another network is a protocol violation
+	other := NewPeer(a, "a", false, testMagic+1)
+	go other.SendMessage(MsgTypeVerAck, nil)
+	if _, err := receiver.ReceiveMessageWithTimeout(time.Second); !IsMessageError(err) {
+		t.Fatalf("Expected wrong magic to be rejected, got %v", err)
+	}
+	if receiver.GetScore() != ScoreProtocolViolation {
+		t.Errorf("Expected score %d, got %d", ScoreProtocolViolation, receiver.GetScore())
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if v := negotiateVersion(ProtocolVersion + 5); v != ProtocolVersion {
+		t.Errorf("Newer peer negotiated %d", v)
+	}
+	if v := negotiateVersion(MinProtocolVersion); v != MinProtocolVersion {
+		t.Errorf("Older peer negotiated %d", v)
+	}
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"obsidian-core/chaincfg"
@@ -12,26 +13,43 @@ import (
 type PeerManager struct {
 	params          *chaincfg.Params
 	torClient       *tor.Client
-	peers           []string
+	peers           []string // Manually added seed nodes
+	addrManager     *AddrManager
+	services        ServiceFlag // Services asked of DNS seeds
 	connectionCount int
+
+	// lookupIP resolves DNS seeds, overriding the system or Tor resolver
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
 }
 
 // NewPeerManager creates a new peer manager.
+// Known addresses are loaded from the peers file under DATA_DIR.
 func NewPeerManager(params *chaincfg.Params, torClient *tor.Client) *PeerManager {
+	addrManager := NewAddrManager(peersFilePath())
+	if err := addrManager.Load(); err != nil {
+		fmt.Printf("Ignoring peers file: %v\n", err)
+	}
 	return &PeerManager{
 		params:          params,
 		torClient:       torClient,
 		peers:           make([]string, 0),
+		addrManager:     addrManager,
+		services:        SFNodeNetwork,
 		connectionCount: 0,
 	}
 }
 
+// AddrManager returns the manager of known peer addresses.
+func (pm *PeerManager) AddrManager() *AddrManager {
+	return pm.addrManager
+}
+
 // ConnectToPeer establishes a connection to a peer.
 func (pm *PeerManager) ConnectToPeer(address string) (net.Conn, error) {
 	// Use Tor for .onion addresses or if Tor is enabled
 	var conn net.Conn
 	var err error
-	if pm.torClient.IsEnabled() || isOnionAddress(address) {
+	if pm.torEnabled() || isOnionAddress(address) {
 		fmt.Printf("Connecting to %s via Tor...\n", address)
 		conn, err = pm.torClient.DialTimeout("tcp", address, 30*time.Second)
 	} else {
@@ -47,7 +65,8 @@ func (pm *PeerManager) ConnectToPeer(address string) (net.Conn, error) {
 	return conn, err
 }
 
-// DiscoverPeers attempts to discover peers from DNS seeds, onion seeds, or manually added seeds.
+// DiscoverPeers attempts to discover peers from DNS seeds, onion seeds, or
+// manually added seeds, adding them to the address manager.
 func (pm *PeerManager) DiscoverPeers() []string {
 	peers := make([]string, 0)
 
@@ -58,25 +77,29 @@ func (pm *PeerManager) DiscoverPeers() []string {
 	}
 
 	// Add Tor onion seeds if available
-	if pm.torClient.IsEnabled() && len(pm.params.TorOnionSeeds) > 0 {
+	if pm.torEnabled() && len(pm.params.TorOnionSeeds) > 0 {
 		peers = append(peers, pm.params.TorOnionSeeds...)
 		fmt.Printf("Discovered %d Tor onion peers\n", len(pm.params.TorOnionSeeds))
 	}
-
-	// Add DNS seeds
-	if len(pm.params.DNSSeeds) > 0 {
-		peers = append(peers, pm.params.DNSSeeds...)
-		fmt.Printf("Discovered %d DNS peers\n", len(pm.params.DNSSeeds))
+	pm.addrManager.AddAddresses(peers, "seed")
+
+	// Resolve DNS seeds, each a separate source so no single seed can fill
+	// the address manager
+	found := pm.resolveSeeds(pm.params.DNSSeeds)
+	for _, seed := range pm.params.DNSSeeds {
+		addrs := found[seed]
+		if len(addrs) == 0 {
+			continue
+		}
+		peers = append(peers, addrs...)
+		pm.addrManager.AddAddresses(addrs, seed)
 	}
-
-	// Update peers list with all discovered peers
-	pm.peers = peers
 	return peers
 }
 
-// GetPeers returns the list of discovered peers.
+// GetPeers returns a sample of known peer addresses.
 func (pm *PeerManager) GetPeers() []string {
-	return pm.peers
+	return pm.addrManager.GetAddresses()
 }
 
 // AddSeedNodes manually adds seed nodes to the peer list.
@@ -84,6 +107,11 @@ func (pm *PeerManager) AddSeedNodes(seeds []string) {
 	pm.peers = append(pm.peers, seeds...)
 }
 
+// torEnabled reports whether connections and lookups go through Tor.
+func (pm *PeerManager) torEnabled() bool {
+	return pm.torClient != nil && pm.torClient.IsEnabled()
+}
+
 // isOnionAddress checks if an address is a Tor onion address.
 func isOnionAddress(address string) bool {
 	host, _, err := net.SplitHostPort(address)
@@ -1,9 +1,12 @@
 package network
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"obsidian-core/chaincfg"
 	"obsidian-core/tor"
+	"sync"
 	"testing"
 	"time"
 )
@@ -32,8 +35,10 @@ func TestNewPeerManager(t *testing.T) {
 }
 
 func TestDiscoverPeers(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
 	params := &chaincfg.Params{
-		DNSSeeds:      []string{"seed1.example.com", "seed2.example.com"},
+		DefaultPort:   "8333",
+		DNSSeeds:      []string{"seed1.example.com", "seed2.example.com:9000", "dead.example.com"},
 		TorOnionSeeds: []string{"onion1.onion", "onion2.onion"},
 	}
 	torClient, err := tor.NewClient(tor.Config{Enabled: false})
@@ -41,18 +46,55 @@ func TestDiscoverPeers(t *testing.T) {
 		t.Fatalf("Failed to create tor client: %v", err)
 	}
 	pm := NewPeerManager(params, torClient)
+	pm.SetRequiredServices(SFNodeNetwork | SFNodeCF)
+	var queried []string
+	var mu sync.Mutex
+	pm.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		mu.Lock()
+		queried = append(queried, host)
+		mu.Unlock()
+		switch host {
+		case "x41.seed1.example.com":
+			return []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")}, nil
+		case "x41.seed2.example.com":
+			return []net.IP{net.ParseIP("5.6.7.8")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
 
+	// Seeds are resolved with the default port unless they carry one, and
+	// onion seeds are skipped without Tor
 	peers := pm.DiscoverPeers()
 
-	expectedPeers := []string{"seed1.example.com", "seed2.example.com"}
+	expectedPeers := []string{"1.2.3.4:8333", "[2001:db8::1]:8333", "5.6.7.8:9000"}
 	if len(peers) != len(expectedPeers) {
-		t.Errorf("Expected %d peers, got %d", len(expectedPeers), len(peers))
+		t.Fatalf("Expected %d peers, got %v", len(expectedPeers), peers)
 	}
 	for i, peer := range peers {
 		if peer != expectedPeers[i] {
 			t.Errorf("Expected peer %s, got %s", expectedPeers[i], peer)
 		}
 	}
+	if len(queried) != 3 {
+		t.Errorf("Expected 3 seed lookups, got %v", queried)
+	}
+	if newCount, _ := pm.AddrManager().Counts(); newCount != 3 {
+		t.Errorf("Expected 3 addresses in the address manager, got %d", newCount)
+	}
+}
+
+func TestSeedQueryHost(t *testing.T) {
+	for _, services := range []ServiceFlag{SFNodeNetwork, SFNodeNetwork | SFNodeBloom, SFNodeCF} {
+		host := SeedQueryHost("seed.example.com", services)
+		if got, ok := ParseSeedQueryHost(host+".", "seed.example.com"); !ok || got != services {
+			t.Errorf("%s parsed as %d, %v; expected %d", host, got, ok, services)
+		}
+	}
+	for _, name := range []string{"other.com", "xzz.seed.example.com", "a.x1.seed.example.com", "x01.seed.example.com"} {
+		if _, ok := ParseSeedQueryHost(name, "seed.example.com"); ok {
+			t.Errorf("Accepted query name %s", name)
+		}
+	}
 }
 
 func TestConnectToPeer(t *testing.T) {
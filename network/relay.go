@@ -0,0 +1,290 @@
+package network
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"math/rand"
+	"obsidian-core/wire"
+	"time"
+)
+
+// Inventory relay
+const (
+	// KnownInventorySize is roughly how many announced hashes are
+	// remembered per peer, so nothing is announced to a peer twice
+	KnownInventorySize = 50000
+
+	// knownInventoryFPRate is the false positive rate of the known
+	// inventory filter; a false positive only skips one announcement
+	knownInventoryFPRate = 0.000001
+
+	// InboundTrickleInterval is the mean time between transaction
+	// announcements to inbound peers. They share one timer, so connecting
+	// many times does not reveal transactions sooner.
+	InboundTrickleInterval = 5 * time.Second
+
+	// OutboundTrickleInterval is the mean time between transaction
+	// announcements to an outbound peer
+	OutboundTrickleInterval = 2 * time.Second
+
+	// MaxTrickleInv is the most transactions announced in one trickle
+	MaxTrickleInv = 1000
+
+	// MaxInvQueue bounds the transactions waiting to be announced to a
+	// peer; beyond it new transactions are not announced to that peer
+	MaxInvQueue = 10 * MaxTrickleInv
+
+	// SendQueueSize bounds the messages queued for a peer. A peer that
+	// lets its queue fill is too slow to keep up and is disconnected.
+	SendQueueSize = 1000
+
+	// SendTimeout bounds a single message write
+	SendTimeout = 2 * time.Minute
+
+	trickleCheckInterval = 100 * time.Millisecond
+)
+
+// rollingBloom remembers about the last n entries added, forgetting older
+// ones. Entries go into the current of two bloom filter generations; when
+// it holds n/2 entries the older generation is cleared and takes over.
+type rollingBloom struct {
+	gens   [2][]uint64
+	cur    int
+	count  int // Entries in the current generation
+	perGen int
+	bits   uint64
+	k      int
+	seeds  [2]maphash.Seed
+}
+
+func newRollingBloom(n int, fpRate float64) *rollingBloom {
+	perGen := (n + 1) / 2
+	bits := uint64(math.Ceil(-float64(perGen) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(bits) / float64(perGen) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	words := (bits + 63) / 64
+	return &rollingBloom{
+		gens:   [2][]uint64{make([]uint64, words), make([]uint64, words)},
+		perGen: perGen,
+		bits:   words * 64,
+		k:      k,
+		seeds:  [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+	}
+}
+
+// positions returns the bits of data by double hashing
+func (r *rollingBloom) positions(data []byte) []uint64 {
+	h1 := maphash.Bytes(r.seeds[0], data)
+	h2 := maphash.Bytes(r.seeds[1], data) | 1
+	pos := make([]uint64, r.k)
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % r.bits
+	}
+	return pos
+}
+
+func (r *rollingBloom) add(data []byte) {
+	if r.count >= r.perGen {
+		r.cur ^= 1
+		clear(r.gens[r.cur])
+		r.count = 0
+	}
+	gen := r.gens[r.cur]
+	for _, p := range r.positions(data) {
+		gen[p/64] |= 1 << (p % 64)
+	}
+	r.count++
+}
+
+func (r *rollingBloom) contains(data []byte) bool {
+	pos := r.positions(data)
+	for _, gen := range r.gens {
+		found := true
+		for _, p := range pos {
+			if gen[p/64]&(1<<(p%64)) == 0 {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// queuedMessage is a message waiting in a peer's send queue
+type queuedMessage struct {
+	msgType string
+	payload Message
+}
+
+// knowsInventory reports whether the peer has or was told of hash.
+func (p *Peer) knowsInventory(hash wire.Hash) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.knownInv.contains(hash[:])
+}
+
+// addKnownInventory records hashes the peer has or was told of.
+func (p *Peer) addKnownInventory(hashes ...wire.Hash) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, hash := range hashes {
+		p.knownInv.add(hash[:])
+	}
+}
+
+// wantsHeaders reports whether the peer asked for new blocks to be
+// announced with headers.
+func (p *Peer) wantsHeaders() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.sendHeaders
+}
+
+// QueueMessage queues a message for the peer without waiting for it to be
+// sent. Messages are written in order by the peer's send goroutine.
+func (p *Peer) QueueMessage(msgType string, payload Message) {
+	select {
+	case p.sendQueue <- queuedMessage{msgType, payload}:
+	case <-p.quit:
+	default:
+		fmt.Printf("[RELAY] Send queue of %s is full, disconnecting\n", p.addr)
+		p.Disconnect()
+	}
+}
+
+// queueReply queues a reply to the peer's own request. Unlike QueueMessage
+// it waits for room in the queue, so a request answered with many messages
+// slows down only the peer that made it.
+func (p *Peer) queueReply(msgType string, payload Message) {
+	select {
+	case p.sendQueue <- queuedMessage{msgType, payload}:
+	case <-p.quit:
+	}
+}
+
+// sendHandler writes queued messages until the peer disconnects. A write
+// that fails or times out disconnects the peer.
+func (p *Peer) sendHandler() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case msg := <-p.sendQueue:
+			if err := p.SendMessage(msg.msgType, msg.payload); err != nil {
+				fmt.Printf("[RELAY] Failed to send %s to %s: %v\n", msg.msgType, p.addr, err)
+				p.Disconnect()
+				return
+			}
+		}
+	}
+}
+
+// queueTx adds a transaction to the next inventory trickle to the peer,
+// unless MaxInvQueue transactions are already waiting.
+func (p *Peer) queueTx(hash wire.Hash) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.invQueue) < MaxInvQueue {
+		p.invQueue = append(p.invQueue, hash)
+	}
+}
+
+// nextTrickleTime draws the time of the next trickle after now. Timers are
+// drawn from a Poisson process so announcement times reveal little about
+// when we learned of a transaction.
+func nextTrickleTime(now time.Time, mean time.Duration) time.Time {
+	return now.Add(time.Duration(rand.ExpFloat64() * float64(mean)))
+}
+
+// trickle returns the transactions to announce to the peer if its own
+// trickle timer has fired, and schedules the next one.
+func (p *Peer) trickle(now time.Time, mean time.Duration) []wire.Hash {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now.Before(p.nextTrickle) {
+		return nil
+	}
+	p.nextTrickle = nextTrickleTime(now, mean)
+	return p.releaseInvLocked()
+}
+
+// releaseInv returns the queued transactions to announce to the peer now.
+func (p *Peer) releaseInv() []wire.Hash {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.releaseInvLocked()
+}
+
+// releaseInvLocked is releaseInv with p.mu held.
+func (p *Peer) releaseInvLocked() []wire.Hash {
+	var hashes []wire.Hash
+	n := 0
+	for ; n < len(p.invQueue) && len(hashes) < MaxTrickleInv; n++ {
+		hash := p.invQueue[n]
+		if !p.knownInv.contains(hash[:]) {
+			p.knownInv.add(hash[:])
+			hashes = append(hashes, hash)
+		}
+	}
+	p.invQueue = p.invQueue[n:]
+	if len(p.invQueue) == 0 {
+		p.invQueue = nil
+	}
+	return hashes
+}
+
+// trickleLoop announces queued transactions to each outbound peer on its
+// own timer and to all inbound peers on a shared one.
+func (sm *SyncManager) trickleLoop() {
+	ticker := time.NewTicker(trickleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.stopChan:
+			return
+		case now := <-ticker.C:
+			sm.trickleInventory(now)
+		}
+	}
+}
+
+// trickleInventory sends the transaction announcements that are due. Inbound
+// peers are released together, as an attacker can open any number of
+// inbound connections and would otherwise learn of transactions at the
+// earliest of their timers.
+func (sm *SyncManager) trickleInventory(now time.Time) {
+	sm.mu.Lock()
+	peers := make([]*Peer, 0, len(sm.peers))
+	for _, peer := range sm.peers {
+		peers = append(peers, peer)
+	}
+	outbound := sm.outboundTrickle
+	inboundDue := !now.Before(sm.nextInbound)
+	if inboundDue {
+		sm.nextInbound = nextTrickleTime(now, sm.inboundTrickle)
+	}
+	sm.mu.Unlock()
+
+	for _, peer := range peers {
+		if !peer.IsConnected() {
+			continue
+		}
+		var hashes []wire.Hash
+		if !peer.inbound {
+			hashes = peer.trickle(now, outbound)
+		} else if inboundDue {
+			hashes = peer.releaseInv()
+		}
+		if len(hashes) > 0 {
+			peer.QueueMessage(MsgTypeInv, &InvMessage{Type: "tx", Hashes: hashes})
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"obsidian-core/wire"
+	"testing"
+	"time"
+)
+
+func TestRollingBloom(t *testing.T) {
+	r := newRollingBloom(100, knownInventoryFPRate)
+	entry := func(i int) []byte {
+		return binary.LittleEndian.AppendUint32(nil, uint32(i))
+	}
+
+	for i := 0; i < 100; i++ {
+		r.add(entry(i))
+	}
+	for i := 50; i < 100; i++ {
+		if !r.contains(entry(i)) {
+			t.Fatalf("recent entry %d forgotten", i)
+		}
+	}
+	if r.contains(entry(1000)) {
+		t.Errorf("unknown entry reported")
+	}
+
+	// Old entries roll out
+	for i := 100; i < 200; i++ {
+		r.add(entry(i))
+	}
+	if r.contains(entry(0)) {
+		t.Errorf("entry 0 still remembered after %d newer ones", 200)
+	}
+}
+
+func TestTrickleBatchesKnownInventory(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := NewPeer(local, "peer", true, testMagic)
+	defer peer.Disconnect()
+
+	known := wire.Hash{1}
+	peer.addKnownInventory(known)
+	for i := byte(1); i <= 3; i++ {
+		peer.queueTx(wire.Hash{i})
+	}
+
+	now := time.Now()
+	hashes := peer.trickle(now, time.Hour)
+	if len(hashes) != 2 || hashes[0] != (wire.Hash{2}) || hashes[1] != (wire.Hash{3}) {
+		t.Fatalf("trickle = %v, want the two unknown hashes", hashes)
+	}
+	if !peer.knowsInventory(wire.Hash{2}) {
+		t.Errorf("announced hash not marked known")
+	}
+
+	// Nothing more until the timer fires again
+	peer.queueTx(wire.Hash{4})
+	if hashes := peer.trickle(now.Add(time.Millisecond), time.Hour); hashes != nil {
+		t.Errorf("trickled %v before the timer fired", hashes)
+	}
+	if hashes := peer.trickle(now.Add(1000*time.Hour), time.Hour); len(hashes) != 1 {
+		t.Errorf("trickle = %v, want the queued hash", hashes)
+	}
+}
+
+func TestInboundTrickleShared(t *testing.T) {
+	sm := newTestSyncManager(t, newSyncTestChain(t, 0))
+	sm.inboundTrickle = time.Hour
+	var peers, relays []*Peer
+	var received []<-chan *P2PMessage
+	for _, addr := range []string{"inbound-1", "inbound-2"} {
+		peer, relay, recv := connectRemotePeer(sm, addr)
+		peers, relays, received = append(peers, peer), append(relays, relay), append(received, recv)
+	}
+	queued := func(peer *Peer) int {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return len(peer.invQueue)
+	}
+
+	// Inbound peers are all released by the same timer
+	now := time.Now()
+	sm.nextInbound = now
+	for i, peer := range peers {
+		peer.queueTx(wire.Hash{byte(i + 1)})
+	}
+	sm.trickleInventory(now)
+	for i, relay := range relays {
+		inv := &InvMessage{}
+		relay.decodePayload(expectMessage(t, received[i], MsgTypeInv), inv)
+		if len(inv.Hashes) != 1 || inv.Hashes[0] != (wire.Hash{byte(i + 1)}) {
+			t.Errorf("inbound peer %d got inv %v, want its queued hash", i, inv.Hashes)
+		}
+	}
+
+	for _, peer := range peers {
+		peer.queueTx(wire.Hash{9})
+	}
+	sm.trickleInventory(now.Add(time.Millisecond))
+	for _, peer := range peers {
+		if queued(peer) != 1 {
+			t.Fatalf("inbound peer %s trickled before the shared timer fired", peer.addr)
+		}
+	}
+	sm.trickleInventory(sm.nextInbound)
+	for _, peer := range peers {
+		if queued(peer) != 0 {
+			t.Errorf("inbound peer %s not released with the others", peer.addr)
+		}
+	}
+
+	// The queue of transactions waiting for a trickle is bounded
+	for i := 0; i < MaxInvQueue+10; i++ {
+		peers[0].queueTx(wire.Hash{byte(i), byte(i >> 8)})
+	}
+	if n := queued(peers[0]); n != MaxInvQueue {
+		t.Errorf("%d transactions queued, want at most %d", n, MaxInvQueue)
+	}
+}
+
+func TestRelayedTxValidated(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	_, relay, _ := connectRemotePeer(sm, "relay")
+
+	// A transaction spending an unknown output is dropped, a valid one kept
+	invalid := compactTestTx(1)
+	tx := fundedTestTx(t, chain)
+	relay.SendMessage(MsgTypeTx, &TxMessage{Tx: invalid})
+	relay.SendMessage(MsgTypeTx, &TxMessage{Tx: tx})
+	waitFor(t, "the valid transaction", func() bool { return chain.Mempool().HasTransaction(tx.TxHash()) })
+	if chain.Mempool().HasTransaction(invalid.TxHash()) {
+		t.Error("invalid relayed transaction accepted")
+	}
+}
+
+func TestAnnounceBlockWithHeaders(t *testing.T) {
+	chain := newSyncTestChain(t, 0)
+	sm := newTestSyncManager(t, chain)
+	peer, relay, received := connectRemotePeer(sm, "headers")
+	if err := relay.SendMessage(MsgTypeSendHeaders, &SendHeadersMessage{}); err != nil {
+		t.Fatalf("Failed to send sendheaders: %v", err)
+	}
+	waitFor(t, "sendheaders", peer.wantsHeaders)
+
+	block := mineOnTip(t, chain, "obs1miner")
+	sm.announceBlock(block, "")
+	headers := &HeadersMessage{}
+	relay.decodePayload(expectMessage(t, received, MsgTypeHeaders), headers)
+	if len(headers.Headers) != 1 || headers.Headers[0].BlockHash() != block.BlockHash() {
+		t.Fatalf("announced %d headers", len(headers.Headers))
+	}
+
+	// A block the peer knows is not announced again
+	sm.announceBlock(block, "")
+	select {
+	case msg := <-received:
+		t.Errorf("announced a known block again with %s", msg.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestFullSendQueueDisconnects(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := NewPeer(local, "slow", true, testMagic)
+
+	// The remote end never reads, so the queue fills up
+	for i := 0; i <= SendQueueSize+1 && peer.IsConnected(); i++ {
+		peer.QueueMessage(MsgTypePing, &PingMessage{Nonce: uint64(i)})
+	}
+	if peer.IsConnected() {
+		t.Fatalf("slow peer still connected with a full send queue")
+	}
+}
+
+func TestRepliesWaitForSendQueue(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := NewPeer(local, "requester", true, testMagic)
+	defer peer.Disconnect()
+
+	// Answer with more messages than the queue holds while the remote
+	// end reads them
+	const replies = 2*SendQueueSize + 1
+	go func() {
+		for i := 0; i < replies; i++ {
+			peer.queueReply(MsgTypePong, &PongMessage{Nonce: uint64(i)})
+		}
+	}()
+
+	reader := NewPeer(remote, "local", false, testMagic)
+	for i := 0; i < replies; i++ {
+		if _, err := reader.ReceiveMessageWithTimeout(10 * time.Second); err != nil {
+			t.Fatalf("reply %d not received: %v", i, err)
+		}
+	}
+	if !peer.IsConnected() {
+		t.Errorf("requester disconnected for a large reply")
+	}
+}
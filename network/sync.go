@@ -1,8 +1,8 @@
 package network
 
 import (
-	"bytes"
-	"encoding/gob"
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math/rand"
@@ -55,132 +55,64 @@ const (
 	ScoreStaleBlock        = -3 // Penalty for stale blocks
 )
 
-// Message types for P2P communication
-const (
-	MsgTypeVersion      = "version"
-	MsgTypeVerAck       = "verack"
-	MsgTypeGetHeaders   = "getheaders"
-	MsgTypeHeaders      = "headers"
-	MsgTypeGetBlocks    = "getblocks"
-	MsgTypeBlock        = "block"
-	MsgTypeInv          = "inv"
-	MsgTypeGetData      = "getdata"
-	MsgTypeTx           = "tx"
-	MsgTypePing         = "ping"
-	MsgTypePong         = "pong"
-	MsgTypeAddr         = "addr"
-	MsgTypeGetAddr      = "getaddr"
-	MsgTypeCompactBlock = "cmpctblock"
-	MsgTypeGetBlockTxn  = "getblocktxn"
-	MsgTypeBlockTxn     = "blocktxn"
-	MsgTypeSendCmpct    = "sendcmpct"
-	MsgTypeReject       = "reject"
-	MsgTypeFeeFilter    = "feefilter"
-	MsgTypeSendHeaders  = "sendheaders"
-	MsgTypeNotFound     = "notfound"
-	MsgTypeMemPool      = "mempool"
-)
-
-// P2PMessage represents a message sent between peers.
-type P2PMessage struct {
-	Type    string
-	Payload []byte
-}
-
-// VersionMessage contains information about a peer.
-type VersionMessage struct {
-	Version   int32
-	Height    int32
-	Timestamp int64
-	UserAgent string
-}
-
-// HeadersMessage contains block headers.
-type HeadersMessage struct {
-	Headers []*wire.BlockHeader
-}
-
-// InvMessage announces known inventory (blocks or transactions).
-type InvMessage struct {
-	Type   string // "block" or "tx"
-	Hashes []wire.Hash
-}
-
-// GetDataMessage requests specific inventory items.
-type GetDataMessage struct {
-	Type   string // "block" or "tx"
-	Hashes []wire.Hash
-}
-
-// GetHeadersMessage requests block headers.
-type GetHeadersMessage struct {
-	StartHash wire.Hash
-	StopHash  wire.Hash // Zero hash means get all after start
-}
-
-// GetBlocksMessage requests block hashes.
-type GetBlocksMessage struct {
-	StartHash wire.Hash
-	StopHash  wire.Hash
-}
-
-// AddrMessage contains peer addresses.
-type AddrMessage struct {
-	Addresses []string
-}
-
-// RejectMessage contains rejection information for invalid messages.
-type RejectMessage struct {
-	Message string // The command that was rejected
-	CCode   string // Rejection code (e.g., "malformed", "invalid", "obsolete", "duplicate", "nonstandard", "dust", "insufficientfee", "checkpoint")
-	Reason  string // Human-readable reason for rejection
-	Data    []byte // Extra data (e.g., the hash of the rejected object)
-}
-
-// FeeFilterMessage contains the minimum fee rate.
-type FeeFilterMessage struct {
-	FeeRate int64 // Minimum fee rate in satoshis per kilobyte
-}
-
-// SendHeadersMessage requests headers-first block relay.
-type SendHeadersMessage struct{}
-
-// NotFoundMessage contains inventory that was not found.
-type NotFoundMessage struct {
-	Type   string // "block" or "tx"
-	Hashes []wire.Hash
-}
-
-// MemPoolMessage requests mempool contents.
-type MemPoolMessage struct{}
-
 // Peer represents a connected peer.
 type Peer struct {
-	conn          net.Conn
-	version       *VersionMessage
-	connected     bool
-	lastSeen      time.Time
-	addr          string
-	inbound       bool // true if peer connected to us, false if we connected to peer
-	score         int
-	messageCount  int
-	lastRateReset time.Time
-	bannedUntil   time.Time
-	feeFilter     int64 // Minimum fee rate in sat/kB
-	mu            sync.RWMutex
-}
-
-// NewPeer creates a new peer from a connection.
-func NewPeer(conn net.Conn, addr string, inbound bool) *Peer {
-	return &Peer{
-		conn:          conn,
-		connected:     true,
-		lastSeen:      time.Now(),
-		addr:          addr,
-		inbound:       inbound,
-		score:         InitialPeerScore,
-		lastRateReset: time.Now(),
-	}
+	conn            net.Conn
+	magic           uint32 // Network magic framing every message
+	version         *VersionMessage
+	protocolVersion uint32 // Negotiated in the handshake
+	connected       bool
+	lastSeen        time.Time
+	connectedAt     time.Time
+	addr            string
+	inbound         bool // true if peer connected to us, false if we connected to peer
+	score           int
+	messageCount    int
+	lastRateReset   time.Time
+	bannedUntil     time.Time
+	feeFilter       int64             // Minimum fee rate in sat/kB
+	cmpctVersion    uint64            // Compact block version from its sendcmpct, 0 if none
+	cmpctAnnounce   bool              // Peer wants new blocks pushed as compact blocks
+	filter          *wire.BloomFilter // SPV filter restricting relay, nil if none
+	transport       string            // TransportV1 or TransportV2
+	peerKey         ed25519.PublicKey // Identity proven over the v2 transport, nil if none
+	trusted         bool              // peerKey is one of our trusted keys
+	knownInv        *rollingBloom     // Inventory the peer has or was told of
+	invQueue        []wire.Hash       // Transactions waiting for the next trickle
+	nextTrickle     time.Time
+	sendHeaders     bool // Peer wants new blocks announced with headers
+	sendQueue       chan queuedMessage
+	quit            chan struct{} // Closed on disconnect
+	mu              sync.RWMutex
+	writeMu         sync.Mutex // Serializes writes of whole messages
+}
+
+// NewPeer creates a new peer from a connection on the network with the
+// given magic.
+func NewPeer(conn net.Conn, addr string, inbound bool, magic uint32) *Peer {
+	peer := &Peer{
+		conn:            conn,
+		magic:           magic,
+		protocolVersion: ProtocolVersion,
+		connected:       true,
+		lastSeen:        time.Now(),
+		connectedAt:     time.Now(),
+		addr:            addr,
+		inbound:         inbound,
+		score:           InitialPeerScore,
+		lastRateReset:   time.Now(),
+		transport:       TransportV1,
+		knownInv:        newRollingBloom(KnownInventorySize, knownInventoryFPRate),
+		sendQueue:       make(chan queuedMessage, SendQueueSize),
+		quit:            make(chan struct{}),
+	}
+	if v2, ok := conn.(*v2Conn); ok {
+		peer.transport = TransportV2
+		peer.peerKey = v2.peerKey
+		peer.trusted = v2.trusted
+	}
+	go peer.sendHandler()
+	return peer
 }
 
 // AdjustScore adjusts the peer's score by the given amount.
@@ -234,111 +166,60 @@ func (p *Peer) CheckRateLimit() bool {
 	return p.messageCount > MaxMessagesPerSecond
 }
 
-// SendMessage sends a P2P message to the peer.
-func (p *Peer) SendMessage(msgType string, payload interface{}) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	if !p.connected {
+// SendMessage sends a P2P message to the peer. payload may be nil for
+// messages without one.
+func (p *Peer) SendMessage(msgType string, payload Message) error {
+	p.mu.RLock()
+	connected, pver := p.connected, p.protocolVersion
+	p.mu.RUnlock()
+	if !connected {
 		return fmt.Errorf("peer not connected")
 	}
 
-	// Encode payload
-	var payloadBytes []byte
-	if payload != nil {
-		buf := new(bytes.Buffer)
-		encoder := gob.NewEncoder(buf)
-		if err := encoder.Encode(payload); err != nil {
-			return fmt.Errorf("failed to encode payload: %v", err)
-		}
-		payloadBytes = buf.Bytes()
-	}
-
-	// Create message
-	msg := &P2PMessage{
-		Type:    msgType,
-		Payload: payloadBytes,
+	framed, err := EncodeMessage(p.magic, msgType, payload, pver)
+	if err != nil {
+		return err
 	}
 
-	// Send message
-	encoder := gob.NewEncoder(p.conn)
-	if err := encoder.Encode(msg); err != nil {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(SendTimeout))
+	if _, err := p.conn.Write(framed); err != nil {
 		return fmt.Errorf("failed to send message: %v", err)
 	}
-
 	return nil
 }
 
 // ReceiveMessageWithTimeout receives a P2P message with a custom timeout.
+// Messages that break the framing rules count against the peer's score.
 func (p *Peer) ReceiveMessageWithTimeout(timeout time.Duration) (*P2PMessage, error) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-
-	if !p.connected {
+	if !p.IsConnected() {
 		return nil, fmt.Errorf("peer not connected")
 	}
 
-	// Set read deadline
 	p.conn.SetReadDeadline(time.Now().Add(timeout))
-
-	// Create fresh decoder for each message to avoid gob type conflicts
-	decoder := gob.NewDecoder(p.conn)
-	msg := &P2PMessage{}
-	if err := decoder.Decode(msg); err != nil {
-		// Check for specific gob errors
-		if strings.Contains(err.Error(), "duplicate type received") {
+	msg, err := ReadMessage(p.conn, p.magic)
+	if err != nil {
+		if IsMessageError(err) {
 			p.AdjustScore(ScoreProtocolViolation)
-			return nil, fmt.Errorf("gob type conflict: %v", err)
+			return nil, err
+		}
+		if err == io.EOF {
+			return nil, err
 		}
 		return nil, fmt.Errorf("failed to receive message: %v", err)
 	}
-
-	// Enhanced security checks
-	if len(msg.Payload) > MaxMessageSize {
-		p.AdjustScore(ScoreMisbehavior)
-		return nil, fmt.Errorf("message payload too large: %d bytes (max: %d)", len(msg.Payload), MaxMessageSize)
-	}
-
-	// Check for empty or invalid message types
-	if msg.Type == "" {
-		p.AdjustScore(ScoreProtocolViolation)
-		return nil, fmt.Errorf("empty message type")
-	}
-
-	// Validate message type
-	validTypes := map[string]bool{
-		MsgTypeVersion:      true,
-		MsgTypeVerAck:       true,
-		MsgTypeGetHeaders:   true,
-		MsgTypeHeaders:      true,
-		MsgTypeGetBlocks:    true,
-		MsgTypeBlock:        true,
-		MsgTypeInv:          true,
-		MsgTypeGetData:      true,
-		MsgTypeTx:           true,
-		MsgTypePing:         true,
-		MsgTypePong:         true,
-		MsgTypeAddr:         true,
-		MsgTypeGetAddr:      true,
-		MsgTypeCompactBlock: true,
-		MsgTypeGetBlockTxn:  true,
-		MsgTypeBlockTxn:     true,
-		MsgTypeSendCmpct:    true,
-		MsgTypeReject:       true,
-		MsgTypeFeeFilter:    true,
-		MsgTypeSendHeaders:  true,
-		MsgTypeNotFound:     true,
-		MsgTypeMemPool:      true,
-	}
-
-	if !validTypes[msg.Type] {
-		p.AdjustScore(ScoreProtocolViolation)
-		return nil, fmt.Errorf("unknown message type: %s", msg.Type)
-	}
-
 	return msg, nil
 }
 
+// decodePayload decodes the payload of msg in the peer's protocol version
+func (p *Peer) decodePayload(msg *P2PMessage, payload Message) error {
+	p.mu.RLock()
+	pver := p.protocolVersion
+	p.mu.RUnlock()
+	return DecodePayload(msg, payload, pver)
+}
+
 // ReceiveMessage receives a P2P message from the peer.
 func (p *Peer) ReceiveMessage() (*P2PMessage, error) {
 	return p.ReceiveMessageWithTimeout(300 * time.Second)
@@ -352,6 +233,7 @@ func (p *Peer) Disconnect() {
 	if p.connected {
 		p.conn.Close()
 		p.connected = false
+		close(p.quit)
 	}
 }
 
@@ -364,17 +246,25 @@ func (p *Peer) IsConnected() bool {
 
 // SyncManager manages P2P synchronization.
 type SyncManager struct {
-	blockchain     *blockchain.BlockChain
-	peerManager    *PeerManager
-	pow            consensus.PowEngine
-	peers          map[string]*Peer
-	bannedPeers    map[string]time.Time
-	knownBlocks    map[wire.Hash]bool
-	knownTxs       map[wire.Hash]bool
-	syncInProgress bool
-	outboundCount  int
-	inboundCount   int
-	mu             sync.RWMutex
+	blockchain      *blockchain.BlockChain
+	peerManager     *PeerManager
+	pow             consensus.PowEngine
+	peers           map[string]*Peer
+	bannedPeers     map[string]time.Time
+	knownBlocks     map[wire.Hash]bool
+	knownTxs        map[wire.Hash]bool
+	downloader      *blockDownloader
+	compact         *compactRelay
+	dandelion       *dandelionRouter
+	inboundTrickle  time.Duration // Mean time between tx announcements to inbound peers
+	outboundTrickle time.Duration // And to outbound peers
+	nextInbound     time.Time     // When inbound peers next get tx announcements
+	services        ServiceFlag   // Advertised in our version message
+	transport       TransportConfig
+	v1Only          map[string]time.Time // Addresses that answered v2 as v1 nodes, until when to use v1
+	outboundCount   int
+	inboundCount    int
+	mu              sync.RWMutex
 
 	// Control
 	stopChan chan struct{}
@@ -383,20 +273,35 @@ type SyncManager struct {
 
 // NewSyncManager creates a new sync manager.
 func NewSyncManager(bc *blockchain.BlockChain, pm *PeerManager, pow consensus.PowEngine) *SyncManager {
+	services := SFNodeNetwork | SFNodeBloom | SFNodeDandelion
+	if bc.FilterIndexEnabled() {
+		services |= SFNodeCF
+	}
+
 	sm := &SyncManager{
-		blockchain:  bc,
-		peerManager: pm,
-		pow:         pow,
-		peers:       make(map[string]*Peer),
-		bannedPeers: make(map[string]time.Time),
-		knownBlocks: make(map[wire.Hash]bool),
-		knownTxs:    make(map[wire.Hash]bool),
-		stopChan:    make(chan struct{}),
-		running:     false,
+		blockchain:      bc,
+		peerManager:     pm,
+		pow:             pow,
+		peers:           make(map[string]*Peer),
+		bannedPeers:     make(map[string]time.Time),
+		knownBlocks:     make(map[wire.Hash]bool),
+		knownTxs:        make(map[wire.Hash]bool),
+		downloader:      newBlockDownloader(bc, pow),
+		compact:         newCompactRelay(),
+		dandelion:       newDandelionRouter(),
+		inboundTrickle:  InboundTrickleInterval,
+		outboundTrickle: OutboundTrickleInterval,
+		services:        services,
+		transport:       defaultTransport(),
+		v1Only:          make(map[string]time.Time),
+		stopChan:        make(chan struct{}),
+		running:         false,
 	}
 
 	// Start background tasks
 	go sm.peerMaintenanceLoop()
+	go sm.blockDownloadLoop()
+	go sm.trickleLoop()
 
 	return sm
 }
@@ -407,6 +312,13 @@ func (sm *SyncManager) Stop() {
 		close(sm.stopChan)
 		sm.running = false
 
+		// Remember the longest-lived outbound peers to reconnect to first
+		am := sm.peerManager.AddrManager()
+		am.SetAnchors(sm.anchorCandidates())
+		if err := am.Save(); err != nil {
+			fmt.Printf("[ADDR] Failed to save peers: %v\n", err)
+		}
+
 		// Disconnect all peers
 		sm.mu.Lock()
 		for addr, peer := range sm.peers {
@@ -431,13 +343,14 @@ func (sm *SyncManager) ConnectToPeer(addr string) {
 		}
 
 		// Connect to peer
-		conn, err := sm.peerManager.ConnectToPeer(addr)
+		sm.peerManager.AddrManager().Attempt(addr)
+		conn, err := sm.dialPeer(addr)
 		if err != nil {
 			fmt.Printf("Failed to connect to peer %s: %v\n", addr, err)
 			return
 		}
 
-		peer := NewPeer(conn, addr, false) // false = outbound
+		peer := NewPeer(conn, addr, false, sm.peerManager.params.Net) // false = outbound
 
 		sm.mu.Lock()
 		sm.peers[addr] = peer
@@ -448,6 +361,7 @@ func (sm *SyncManager) ConnectToPeer(addr string) {
 		fmt.Println("New peer connected")
 		fmt.Printf("  Address:   %s\n", addr)
 		fmt.Printf("  Direction: Outbound\n")
+		fmt.Printf("  Transport: %s\n", peer.transport)
 		fmt.Printf("  Peers:     %d/%d outbound\n", currentOutbound, MaxOutboundPeers)
 		fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 
@@ -462,6 +376,7 @@ func (sm *SyncManager) ConnectToPeer(addr string) {
 			sm.mu.Unlock()
 			return
 		}
+		sm.peerManager.AddrManager().Good(addr)
 
 		// Start message handler
 		go sm.handlePeerMessages(peer)
@@ -473,9 +388,44 @@ func (sm *SyncManager) ConnectToPeer(addr string) {
 
 // IsSyncing returns whether the node is currently syncing.
 func (sm *SyncManager) IsSyncing() bool {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-	return sm.syncInProgress
+	return sm.downloader.isSyncing()
+}
+
+// SyncProgress returns the height of the best validated header, whether
+// initial block download is under way, and the fraction of headers whose
+// blocks have been connected.
+func (sm *SyncManager) SyncProgress() (int32, bool, float64) {
+	headers, syncing := sm.downloader.progress()
+	progress := 1.0
+	if headers > 0 {
+		progress = float64(sm.blockchain.Height()) / float64(headers)
+	}
+	return headers, syncing, progress
+}
+
+// blockDownloadLoop drives block download timeouts and retries, and
+// expires compact blocks waiting on missing transactions.
+func (sm *SyncManager) blockDownloadLoop() {
+	ticker := time.NewTicker(blockDownloadTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.stopChan:
+			return
+		case now := <-ticker.C:
+			sm.sendAll(sm.downloader.tick(now))
+			sm.expireCompactBlocks(now)
+		}
+	}
+}
+
+// sendAll sends messages queued by the block downloader. Each is sent from
+// its own goroutine so a peer's handler never waits on another peer.
+func (sm *SyncManager) sendAll(out []outgoingMessage) {
+	for _, msg := range out {
+		msg.peer.QueueMessage(msg.msgType, msg.payload)
+	}
 }
 
 // peerMaintenanceLoop performs periodic peer maintenance tasks.
@@ -580,20 +530,33 @@ func (sm *SyncManager) canAcceptPeer(addr string, inbound bool) bool {
 func (sm *SyncManager) Start() error {
 	sm.running = true
 
+	// Reconnect to the anchors saved at shutdown before anyone else, so a
+	// restart does not hand all outbound slots to addresses from the table
+	for _, addr := range sm.peerManager.AddrManager().TakeAnchors() {
+		fmt.Printf("[ADDR] Reconnecting to anchor %s\n", addr)
+		go sm.connectAndSync(addr)
+	}
+
 	// Discover peers
 	peerAddrs := sm.peerManager.DiscoverPeers()
-	if len(peerAddrs) == 0 {
+	newCount, triedCount := sm.peerManager.AddrManager().Counts()
+	if newCount+triedCount == 0 {
 		fmt.Println("No peers discovered, running in solo mode")
 		return nil
 	}
 
-	// Connect to peers
-	for _, addr := range peerAddrs {
+	// Manually added seeds are always connected; the rest of the outbound
+	// slots are filled from the address manager
+	for _, addr := range sm.peerManager.peers {
 		go sm.connectAndSync(addr)
 	}
+	fmt.Printf("[ADDR] %d discovered, %d new and %d tried addresses known\n", len(peerAddrs), newCount, triedCount)
+	sm.fillOutbound()
 
 	// Start periodic peer reconnection
 	go sm.peerReconnectionLoop()
+	go sm.addrManagerLoop()
+	go sm.dandelionLoop()
 
 	return nil
 }
@@ -622,38 +585,56 @@ func (sm *SyncManager) StartListener(addr string) error {
 			continue
 		}
 
-		peer := NewPeer(conn, conn.RemoteAddr().String(), true) // true = inbound
-
+		// Reserve the slot, then negotiate the transport off the accept loop
 		sm.mu.Lock()
-		sm.peers[conn.RemoteAddr().String()] = peer
 		sm.inboundCount++
-		currentInbound := sm.inboundCount
 		sm.mu.Unlock()
 
-		fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
-		fmt.Println("[PEER] NEW INBOUND PEER CONNECTED")
-		fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
-		fmt.Printf("  Address:   %s\n", conn.RemoteAddr().String())
-		fmt.Printf("  Direction: Inbound\n")
-		fmt.Printf("  Peers:     %d/%d inbound\n", currentInbound, MaxInboundPeers)
-		fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+		go func(raw net.Conn) {
+			addr := raw.RemoteAddr().String()
+			conn, err := sm.acceptTransport(raw)
+			if err != nil {
+				fmt.Printf("[P2P] Rejecting inbound connection from %s: %v\n", addr, err)
+				raw.Close()
+				sm.mu.Lock()
+				sm.inboundCount--
+				sm.mu.Unlock()
+				return
+			}
+
+			peer := NewPeer(conn, addr, true, sm.peerManager.params.Net) // true = inbound
+
+			sm.mu.Lock()
+			sm.peers[addr] = peer
+			currentInbound := sm.inboundCount
+			sm.mu.Unlock()
 
-		// Perform handshake for inbound connections
-		go func() {
+			fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+			fmt.Println("[PEER] NEW INBOUND PEER CONNECTED")
+			fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+			fmt.Printf("  Address:   %s\n", addr)
+			fmt.Printf("  Direction: Inbound\n")
+			fmt.Printf("  Transport: %s\n", peer.transport)
+			fmt.Printf("  Peers:     %d/%d inbound\n", currentInbound, MaxInboundPeers)
+			fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+			// Perform handshake for inbound connections
 			if err := sm.performHandshake(peer); err != nil {
-				fmt.Printf("❌ Handshake failed with inbound peer %s: %v\n", conn.RemoteAddr().String(), err)
+				fmt.Printf("❌ Handshake failed with inbound peer %s: %v\n", addr, err)
 				peer.Disconnect()
 				// Clean up failed connection
 				sm.mu.Lock()
-				delete(sm.peers, conn.RemoteAddr().String())
+				delete(sm.peers, addr)
 				sm.inboundCount--
 				sm.mu.Unlock()
 				return
 			}
 
-			// Start handling messages from this peer
+			// Sync from the peer if it is ahead, then handle its messages
+			sm.negotiateCompactBlocks(peer)
+			sm.requestHeaderSync(peer)
 			sm.handlePeerMessages(peer)
-		}()
+		}(conn)
 	}
 }
 
@@ -666,13 +647,14 @@ func (sm *SyncManager) connectAndSync(addr string) {
 	}
 
 	// Connect to peer
-	conn, err := sm.peerManager.ConnectToPeer(addr)
+	sm.peerManager.AddrManager().Attempt(addr)
+	conn, err := sm.dialPeer(addr)
 	if err != nil {
 		fmt.Printf("Failed to connect to peer %s: %v\n", addr, err)
 		return
 	}
 
-	peer := NewPeer(conn, addr, false) // false = outbound
+	peer := NewPeer(conn, addr, false, sm.peerManager.params.Net) // false = outbound
 
 	sm.mu.Lock()
 	sm.peers[addr] = peer
@@ -685,6 +667,7 @@ func (sm *SyncManager) connectAndSync(addr string) {
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Printf("  Address:   %s\n", addr)
 	fmt.Printf("  Direction: Outbound\n")
+	fmt.Printf("  Transport: %s\n", peer.transport)
 	fmt.Printf("  Peers:     %d/%d outbound\n", currentOutbound, MaxOutboundPeers)
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 
@@ -699,20 +682,15 @@ func (sm *SyncManager) connectAndSync(addr string) {
 		sm.mu.Unlock()
 		return
 	}
+	sm.peerManager.AddrManager().Good(addr)
 
 	// Send sendheaders to enable headers-first relay
 	if err := peer.SendMessage(MsgTypeSendHeaders, &SendHeadersMessage{}); err != nil {
 		fmt.Printf("Failed to send sendheaders to %s: %v\n", addr, err)
 	}
 
-	// Send sendcmpct to negotiate compact block relay (version 1)
-	sendCmpctMsg := map[string]interface{}{
-		"version":  1,
-		"announce": true,
-	}
-	if err := peer.SendMessage(MsgTypeSendCmpct, sendCmpctMsg); err != nil {
-		fmt.Printf("Failed to send sendcmpct to %s: %v\n", addr, err)
-	}
+	// Negotiate compact block relay
+	sm.negotiateCompactBlocks(peer)
 
 	// Start message handler
 	go sm.handlePeerMessages(peer)
@@ -731,9 +709,10 @@ func (sm *SyncManager) performHandshake(peer *Peer) error {
 	}
 
 	version := &VersionMessage{
-		Version:   1,
+		Version:   ProtocolVersion,
 		Height:    sm.blockchain.Height(),
 		Timestamp: time.Now().Unix(),
+		Services:  sm.services,
 		UserAgent: "Obsidian/2.0.0",
 	}
 
@@ -778,11 +757,8 @@ func (sm *SyncManager) performHandshake(peer *Peer) error {
 			return
 		}
 
-		// Decode peer version with fresh decoder to avoid gob type conflicts
-		buf := bytes.NewBuffer(msg.Payload)
-		decoder := gob.NewDecoder(buf)
 		peerVersion := &VersionMessage{}
-		if err := decoder.Decode(peerVersion); err != nil {
+		if err := peer.decodePayload(msg, peerVersion); err != nil {
 			peer.AdjustScore(ScoreProtocolViolation)
 			logrus.Debugf("Failed to decode version from %s: %v", peer.addr, err)
 			recvErrCh <- fmt.Errorf("failed to decode version: %v", err)
@@ -834,6 +810,7 @@ func (sm *SyncManager) performHandshake(peer *Peer) error {
 
 	peer.mu.Lock()
 	peer.version = peerVersion
+	peer.protocolVersion = negotiateVersion(peerVersion.Version)
 	peer.mu.Unlock()
 
 	// Now exchange verack messages (also bidirectional)
@@ -895,11 +872,21 @@ func (sm *SyncManager) performHandshake(peer *Peer) error {
 	return nil
 }
 
+// negotiateVersion returns the protocol version used with a peer that
+// speaks up to version
+func negotiateVersion(version uint32) uint32 {
+	if version < ProtocolVersion {
+		return version
+	}
+	return ProtocolVersion
+}
+
 // validatePeerVersion validates the peer's version message
 func (sm *SyncManager) validatePeerVersion(version *VersionMessage) error {
 	// Check version compatibility
-	if version.Version < 1 || version.Version > 1 {
-		return fmt.Errorf("unsupported protocol version: %d", version.Version)
+	// Newer peers step down to our version; older ones are refused
+	if version.Version < MinProtocolVersion {
+		return fmt.Errorf("unsupported protocol version: %d (minimum: %d)", version.Version, MinProtocolVersion)
 	}
 
 	// Check timestamp (not too far in future or past)
@@ -938,7 +925,7 @@ func (sm *SyncManager) handlePeerMessages(peer *Peer) {
 		for range pingTicker.C {
 			if peer.IsConnected() && !peer.IsBanned() {
 				// Send ping to keep connection alive
-				if err := peer.SendMessage(MsgTypePing, nil); err != nil {
+				if err := peer.SendMessage(MsgTypePing, &PingMessage{Nonce: rand.Uint64()}); err != nil {
 					fmt.Printf("Failed to send ping to %s: %v\n", peer.addr, err)
 					return
 				}
@@ -994,6 +981,10 @@ func (sm *SyncManager) handlePeerMessages(peer *Peer) {
 		peer.lastSeen = time.Now()
 	}
 
+	// Hand its block requests to other peers
+	sm.sendAll(sm.downloader.removePeer(peer))
+	sm.compact.removePeer(peer)
+
 	// Remove peer from active list
 	sm.mu.Lock()
 	delete(sm.peers, peer.addr)
@@ -1052,16 +1043,19 @@ func (sm *SyncManager) handleMessage(peer *Peer, msg *P2PMessage) error {
 		return sm.handleGetData(peer, msg)
 	case MsgTypeTx:
 		return sm.handleTx(peer, msg)
+	case MsgTypeDandelionTx:
+		return sm.handleDandelionTx(peer, msg)
 	case MsgTypePing:
 		// Respond to ping with pong
-		if err := peer.SendMessage(MsgTypePong, nil); err != nil {
-			peer.AdjustScore(ScoreTimeout)
-			return fmt.Errorf("failed to send pong: %v", err)
+		ping := &PingMessage{}
+		if err := peer.decodePayload(msg, ping); err != nil {
+			return err
 		}
+		peer.queueReply(MsgTypePong, &PongMessage{Nonce: ping.Nonce})
 		return nil
 	case MsgTypePong:
 		// Pong received, connection is alive
-		return nil
+		return peer.decodePayload(msg, &PongMessage{})
 	case MsgTypeGetAddr:
 		return sm.handleGetAddr(peer)
 	case MsgTypeAddr:
@@ -1074,8 +1068,36 @@ func (sm *SyncManager) handleMessage(peer *Peer, msg *P2PMessage) error {
 		return sm.handleSendHeaders(peer, msg)
 	case MsgTypeNotFound:
 		return sm.handleNotFound(peer, msg)
+	case MsgTypeSendCmpct:
+		return sm.handleSendCmpct(peer, msg)
+	case MsgTypeCompactBlock:
+		return sm.handleCompactBlock(peer, msg)
+	case MsgTypeGetBlockTxn:
+		return sm.handleGetBlockTxn(peer, msg)
+	case MsgTypeBlockTxn:
+		return sm.handleBlockTxn(peer, msg)
 	case MsgTypeMemPool:
 		return sm.handleMemPool(peer, msg)
+	case MsgTypeFilterLoad:
+		return sm.handleFilterLoad(peer, msg)
+	case MsgTypeFilterAdd:
+		return sm.handleFilterAdd(peer, msg)
+	case MsgTypeFilterClear:
+		return sm.handleFilterClear(peer, msg)
+	case MsgTypeMerkleBlock:
+		// We do not request filtered blocks
+		peer.AdjustScore(ScoreMisbehavior)
+		return fmt.Errorf("unrequested merkleblock")
+	case MsgTypeGetCFilters:
+		return sm.handleGetCFilters(peer, msg)
+	case MsgTypeGetCFHeaders:
+		return sm.handleGetCFHeaders(peer, msg)
+	case MsgTypeGetCFCheckpt:
+		return sm.handleGetCFCheckpt(peer, msg)
+	case MsgTypeCFilter, MsgTypeCFHeaders, MsgTypeCFCheckpt:
+		// We do not request compact filters
+		peer.AdjustScore(ScoreMisbehavior)
+		return fmt.Errorf("unrequested %s", msg.Type)
 	case MsgTypeVersion:
 		// Version messages should be handled during handshake, penalize if received here
 		peer.AdjustScore(ScoreProtocolViolation)
@@ -1091,84 +1113,55 @@ func (sm *SyncManager) handleMessage(peer *Peer, msg *P2PMessage) error {
 	}
 }
 
-// requestHeaderSync requests headers from a peer starting from our best block.
-func (sm *SyncManager) requestHeaderSync(peer *Peer) error {
-	bestBlock, err := sm.blockchain.BestBlock()
-	if err != nil {
-		return fmt.Errorf("failed to get best block: %v", err)
-	}
-
-	getHeaders := &GetHeadersMessage{
-		StartHash: bestBlock.BlockHash(),
-		StopHash:  wire.Hash{}, // Zero hash means get all
+// requestHeaderSync registers a peer with the block downloader, which
+// starts a headers-first sync from it if it claims a longer chain.
+func (sm *SyncManager) requestHeaderSync(peer *Peer) {
+	var height int32
+	if peer.version != nil {
+		height = peer.version.Height
 	}
-
-	return peer.SendMessage(MsgTypeGetHeaders, getHeaders)
+	sm.sendAll(sm.downloader.addPeer(peer, height))
 }
 
-// handleGetHeaders responds to a getheaders request.
+// handleGetHeaders responds to a getheaders request with the main chain
+// headers following the first locator hash we know.
 func (sm *SyncManager) handleGetHeaders(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	req := &GetHeadersMessage{}
-	if err := decoder.Decode(req); err != nil {
-		return fmt.Errorf("failed to decode getheaders: %v", err)
+	if err := peer.decodePayload(msg, req); err != nil {
+		return err
 	}
 
-	// Get headers starting from the requested hash
-	// For now, we'll just send our best block header
-	bestBlock, err := sm.blockchain.BestBlock()
+	headers, err := sm.blockchain.LocateHeaders(req.Locator, req.StopHash, MaxHeadersPerMessage)
 	if err != nil {
 		return err
 	}
 
-	headers := &HeadersMessage{
-		Headers: []*wire.BlockHeader{&bestBlock.Header},
-	}
-
-	return peer.SendMessage(MsgTypeHeaders, headers)
+	peer.queueReply(MsgTypeHeaders, &HeadersMessage{Headers: headers})
+	return nil
 }
 
-// handleHeaders processes received headers.
+// handleHeaders passes received headers to the block downloader.
 func (sm *SyncManager) handleHeaders(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	headers := &HeadersMessage{}
-	if err := decoder.Decode(headers); err != nil {
-		return fmt.Errorf("failed to decode headers: %v", err)
+	if err := peer.decodePayload(msg, headers); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received %d headers from %s\n", len(headers.Headers), peer.addr)
-
-	// Request blocks for each header we don't have
-	var hashesToRequest []wire.Hash
 	for _, header := range headers.Headers {
-		blockHash := header.BlockHash()
-
-		// Check if we already have this block
-		if _, err := sm.blockchain.GetBlock(blockHash[:]); err != nil {
-			hashesToRequest = append(hashesToRequest, blockHash)
-		}
-	}
-
-	if len(hashesToRequest) > 0 {
-		getData := &GetDataMessage{
-			Type:   "block",
-			Hashes: hashesToRequest,
-		}
-		return peer.SendMessage(MsgTypeGetData, getData)
+		peer.addKnownInventory(header.BlockHash())
 	}
 
-	return nil
+	out, err := sm.downloader.handleHeaders(peer, headers.Headers)
+	sm.sendAll(out)
+	return err
 }
 
 // handleGetBlocks responds to a getblocks request.
 func (sm *SyncManager) handleGetBlocks(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	req := &GetBlocksMessage{}
-	if err := decoder.Decode(req); err != nil {
-		return fmt.Errorf("failed to decode getblocks: %v", err)
+	if err := peer.decodePayload(msg, req); err != nil {
+		return err
 	}
 
 	// Send inventory of blocks we have
@@ -1182,7 +1175,8 @@ func (sm *SyncManager) handleGetBlocks(peer *Peer, msg *P2PMessage) error {
 		Hashes: []wire.Hash{bestBlock.BlockHash()},
 	}
 
-	return peer.SendMessage(MsgTypeInv, inv)
+	peer.queueReply(MsgTypeInv, inv)
+	return nil
 }
 
 // handleBlock processes a received block.
@@ -1193,12 +1187,23 @@ func (sm *SyncManager) handleBlock(peer *Peer, msg *P2PMessage) error {
 		return fmt.Errorf("block message too small: %d bytes", len(msg.Payload))
 	}
 
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
-	block := &wire.MsgBlock{}
-	if err := decoder.Decode(block); err != nil {
+	blockMsg := &BlockMessage{}
+	if err := peer.decodePayload(msg, blockMsg); err != nil {
 		peer.AdjustScore(ScoreProtocolViolation)
-		return fmt.Errorf("failed to decode block: %v", err)
+		return err
+	}
+	block := blockMsg.Block
+	peer.addKnownInventory(block.BlockHash())
+
+	// Blocks requested by the block downloader are connected in order
+	if taken, connected, err := sm.downloader.handleBlock(peer, block); taken {
+		if !sm.downloader.isSyncing() {
+			for _, b := range connected {
+				sm.announceBlock(b, peer.addr)
+			}
+		}
+		sm.sendAll(sm.downloader.nextRequests())
+		return err
 	}
 
 	blockHash := block.BlockHash()
@@ -1224,21 +1229,51 @@ func (sm *SyncManager) handleBlock(peer *Peer, msg *P2PMessage) error {
 		return fmt.Errorf("block contains no transactions")
 	}
 
+	// A block that does not extend our tip needs its headers first
+	bestBlock, err := sm.blockchain.BestBlock()
+	if err != nil {
+		return fmt.Errorf("failed to get best block: %v", err)
+	}
+	if block.Header.PrevBlock != bestBlock.BlockHash() {
+		sm.mu.Lock()
+		delete(sm.knownBlocks, blockHash)
+		sm.mu.Unlock()
+		out, err := sm.downloader.handleHeaders(peer, []*wire.BlockHeader{&block.Header})
+		sm.sendAll(out)
+		return err
+	}
+
+	if err := sm.connectNewBlock(peer, block, len(msg.Payload)); err != nil {
+		peer.AdjustScore(ScoreInvalidBlock)
+		return err
+	}
+	return nil
+}
+
+// connectNewBlock processes a new block extending our tip, received whole
+// or reconstructed from a compact block, and relays it. The peer that
+// delivered it first becomes a high-bandwidth compact block peer. Callers
+// decide whether a rejected block is the peer's fault.
+func (sm *SyncManager) connectNewBlock(peer *Peer, block *wire.MsgBlock, blockSize int) error {
+	blockHash := block.BlockHash()
+
 	// Check block size against our limits
-	blockSize := len(msg.Payload)
 	maxBlockSize := 3200000 // 3.2MB, should match chaincfg.BlockMaxSize
 	if blockSize > maxBlockSize {
-		peer.AdjustScore(ScoreInvalidBlock)
 		return fmt.Errorf("block too large: %d bytes (max: %d)", blockSize, maxBlockSize)
 	}
 
 	// Process block
 	if err := sm.blockchain.ProcessBlock(block, sm.pow); err != nil {
-		peer.AdjustScore(ScoreInvalidBlock)
 		fmt.Printf("❌ Invalid block from %s: %v\n", peer.addr, err)
 		return fmt.Errorf("failed to process block: %v", err)
 	}
 
+	// A partial compact block for it is no longer needed
+	sm.compact.mu.Lock()
+	delete(sm.compact.pending, blockHash)
+	sm.compact.mu.Unlock()
+
 	// Reward peer for valid block
 	peer.AdjustScore(ScoreValidBlock)
 	currentHeight := sm.blockchain.Height()
@@ -1256,7 +1291,10 @@ func (sm *SyncManager) handleBlock(peer *Peer, msg *P2PMessage) error {
 
 	// Announce to other peers
 	sm.announceBlock(block, peer.addr)
+	sm.sendAll(sm.compact.promote(peer))
+	sm.mu.RLock()
 	peerCount := len(sm.peers) - 1 // Exclude source peer
+	sm.mu.RUnlock()
 	if peerCount > 0 {
 		fmt.Printf("[BROADCAST] Block relayed to %d other peer(s)\n", peerCount)
 	}
@@ -1266,14 +1304,13 @@ func (sm *SyncManager) handleBlock(peer *Peer, msg *P2PMessage) error {
 
 // handleInv processes an inventory announcement.
 func (sm *SyncManager) handleInv(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	inv := &InvMessage{}
-	if err := decoder.Decode(inv); err != nil {
-		return fmt.Errorf("failed to decode inv: %v", err)
+	if err := peer.decodePayload(msg, inv); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received inventory of %d %ss from %s\n", len(inv.Hashes), inv.Type, peer.addr)
+	peer.addKnownInventory(inv.Hashes...)
 
 	// Request items we don't have
 	var hashesToRequest []wire.Hash
@@ -1293,11 +1330,16 @@ func (sm *SyncManager) handleInv(peer *Peer, msg *P2PMessage) error {
 	}
 
 	if len(hashesToRequest) > 0 {
+		// New blocks are fetched as compact blocks from peers relaying them
+		dataType := inv.Type
+		if dataType == "block" && peer.compactVersion() != 0 && !sm.downloader.isSyncing() {
+			dataType = "cmpctblock"
+		}
 		getData := &GetDataMessage{
-			Type:   inv.Type,
+			Type:   dataType,
 			Hashes: hashesToRequest,
 		}
-		return peer.SendMessage(MsgTypeGetData, getData)
+		peer.queueReply(MsgTypeGetData, getData)
 	}
 
 	return nil
@@ -1305,11 +1347,9 @@ func (sm *SyncManager) handleInv(peer *Peer, msg *P2PMessage) error {
 
 // handleGetData responds to a getdata request.
 func (sm *SyncManager) handleGetData(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	req := &GetDataMessage{}
-	if err := decoder.Decode(req); err != nil {
-		return fmt.Errorf("failed to decode getdata: %v", err)
+	if err := peer.decodePayload(msg, req); err != nil {
+		return err
 	}
 
 	mempool := sm.blockchain.Mempool()
@@ -1322,9 +1362,21 @@ func (sm *SyncManager) handleGetData(peer *Peer, msg *P2PMessage) error {
 				notFound = append(notFound, hash)
 				continue
 			}
-			if err := peer.SendMessage(MsgTypeBlock, block); err != nil {
-				return err
+			peer.queueReply(MsgTypeBlock, &BlockMessage{Block: block})
+		} else if req.Type == "merkleblock" {
+			block, err := sm.blockchain.GetBlock(hash[:])
+			if err != nil {
+				notFound = append(notFound, hash)
+				continue
+			}
+			sm.sendMerkleBlock(peer, block)
+		} else if req.Type == "cmpctblock" {
+			block, err := sm.blockchain.GetBlock(hash[:])
+			if err != nil {
+				notFound = append(notFound, hash)
+				continue
 			}
+			peer.queueReply(MsgTypeCompactBlock, newCompactBlock(block))
 		} else if req.Type == "tx" {
 			// Get transaction from mempool
 			tx, err := mempool.GetTransaction(hash)
@@ -1332,9 +1384,7 @@ func (sm *SyncManager) handleGetData(peer *Peer, msg *P2PMessage) error {
 				notFound = append(notFound, hash)
 				continue
 			}
-			if err := peer.SendMessage(MsgTypeTx, tx); err != nil {
-				return err
-			}
+			peer.queueReply(MsgTypeTx, &TxMessage{Tx: tx})
 		}
 	}
 
@@ -1344,9 +1394,7 @@ func (sm *SyncManager) handleGetData(peer *Peer, msg *P2PMessage) error {
 			Type:   req.Type,
 			Hashes: notFound,
 		}
-		if err := peer.SendMessage(MsgTypeNotFound, notFoundMsg); err != nil {
-			return err
-		}
+		peer.queueReply(MsgTypeNotFound, notFoundMsg)
 	}
 
 	return nil
@@ -1354,37 +1402,38 @@ func (sm *SyncManager) handleGetData(peer *Peer, msg *P2PMessage) error {
 
 // handleTx processes a received transaction.
 func (sm *SyncManager) handleTx(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
-	tx := &wire.MsgTx{}
-	if err := decoder.Decode(tx); err != nil {
+	txMsg := &TxMessage{}
+	if err := peer.decodePayload(msg, txMsg); err != nil {
 		peer.AdjustScore(ScoreProtocolViolation)
-		return fmt.Errorf("failed to decode tx: %v", err)
+		return err
 	}
+	tx := txMsg.Tx
 
 	txHash := tx.TxHash()
 	fmt.Printf("Received transaction %s from %s\n", txHash.String(), peer.addr)
+	peer.addKnownInventory(txHash)
 
 	// Mark as known
 	sm.mu.Lock()
 	sm.knownTxs[txHash] = true
 	sm.mu.Unlock()
 
-	// Add to mempool
-	mempool := sm.blockchain.Mempool()
-	currentHeight := sm.blockchain.Height()
-
-	// Calculate fee (inputs - outputs)
-	// For now, we'll use 0 fee as we don't have UTXO lookup in sync context
-	// In production, you'd need to look up input values
-	fee := int64(0)
+	// A transaction we already have is not the peer's fault
+	if sm.blockchain.Mempool().HasTransaction(txHash) {
+		return nil
+	}
 
-	if err := mempool.AddTransaction(tx, currentHeight, fee); err != nil {
-		fmt.Printf("Failed to add transaction to mempool: %v\n", err)
+	// Validate against the chain, signatures and fee included, and add it
+	// to the mempool
+	if _, err := sm.blockchain.AcceptTransaction(tx); err != nil {
+		fmt.Printf("Rejected transaction %s: %v\n", txHash.String(), err)
 		peer.AdjustScore(ScoreInvalidTx)
 		return nil // Don't fail on invalid tx, just log it
 	}
 
+	// A stem transaction of ours came back fluffed
+	sm.dandelion.clearEmbargo(txHash)
+
 	// Reward peer for valid transaction
 	peer.AdjustScore(ScoreValidTx)
 	fmt.Printf("Transaction %s added to mempool (peer score: %d)\n", txHash.String(), peer.GetScore())
@@ -1397,52 +1446,34 @@ func (sm *SyncManager) handleTx(peer *Peer, msg *P2PMessage) error {
 
 // handleGetAddr responds to a getaddr request.
 func (sm *SyncManager) handleGetAddr(peer *Peer) error {
-	sm.mu.RLock()
-	addrs := make([]string, 0, len(sm.peers))
-	for addr := range sm.peers {
-		addrs = append(addrs, addr)
-	}
-	sm.mu.RUnlock()
-
 	addrMsg := &AddrMessage{
-		Addresses: addrs,
+		Addresses: sm.peerManager.AddrManager().GetAddresses(),
 	}
 
-	return peer.SendMessage(MsgTypeAddr, addrMsg)
+	peer.queueReply(MsgTypeAddr, addrMsg)
+	return nil
 }
 
 // handleAddr processes received peer addresses.
 func (sm *SyncManager) handleAddr(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	addrMsg := &AddrMessage{}
-	if err := decoder.Decode(addrMsg); err != nil {
-		return fmt.Errorf("failed to decode addr: %v", err)
+	if err := peer.decodePayload(msg, addrMsg); err != nil {
+		return err
 	}
 
-	fmt.Printf("Received %d peer addresses from %s\n", len(addrMsg.Addresses), peer.addr)
-
-	// Connect to new peers
-	for _, addr := range addrMsg.Addresses {
-		sm.mu.RLock()
-		_, exists := sm.peers[addr]
-		sm.mu.RUnlock()
-
-		if !exists && addr != peer.addr {
-			go sm.connectAndSync(addr)
-		}
-	}
+	// Addresses go to the new table rather than being connected to, so a
+	// peer cannot steer our outbound connections
+	added := sm.peerManager.AddrManager().AddAddresses(addrMsg.Addresses, peer.addr)
+	fmt.Printf("Received %d peer addresses from %s, %d new\n", len(addrMsg.Addresses), peer.addr, added)
 
 	return nil
 }
 
 // handleReject processes a reject message.
 func (sm *SyncManager) handleReject(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	rejectMsg := &RejectMessage{}
-	if err := decoder.Decode(rejectMsg); err != nil {
-		return fmt.Errorf("failed to decode reject: %v", err)
+	if err := peer.decodePayload(msg, rejectMsg); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received reject from %s: message=%s, code=%s, reason=%s\n",
@@ -1458,11 +1489,9 @@ func (sm *SyncManager) handleReject(peer *Peer, msg *P2PMessage) error {
 
 // handleFeeFilter processes a feefilter message.
 func (sm *SyncManager) handleFeeFilter(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	feeFilterMsg := &FeeFilterMessage{}
-	if err := decoder.Decode(feeFilterMsg); err != nil {
-		return fmt.Errorf("failed to decode feefilter: %v", err)
+	if err := peer.decodePayload(msg, feeFilterMsg); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received feefilter from %s: fee rate=%d sat/kB\n", peer.addr, feeFilterMsg.FeeRate)
@@ -1477,46 +1506,65 @@ func (sm *SyncManager) handleFeeFilter(peer *Peer, msg *P2PMessage) error {
 
 // handleSendHeaders processes a sendheaders message.
 func (sm *SyncManager) handleSendHeaders(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	sendHeadersMsg := &SendHeadersMessage{}
-	if err := decoder.Decode(sendHeadersMsg); err != nil {
-		return fmt.Errorf("failed to decode sendheaders: %v", err)
+	if err := peer.decodePayload(msg, sendHeadersMsg); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received sendheaders from %s\n", peer.addr)
 
-	// Enable headers-first mode for this peer (not implemented yet)
-	// In a full implementation, you'd send headers instead of inv for new blocks
+	// Announce new blocks to this peer with headers instead of inv
+	peer.mu.Lock()
+	peer.sendHeaders = true
+	peer.mu.Unlock()
 
 	return nil
 }
 
+// handleSendCmpct processes a sendcmpct message.
+func (sm *SyncManager) handleSendCmpct(peer *Peer, msg *P2PMessage) error {
+	sendCmpctMsg := &SendCmpctMessage{}
+	if err := peer.decodePayload(msg, sendCmpctMsg); err != nil {
+		return err
+	}
+
+	fmt.Printf("Received sendcmpct from %s: version=%d, announce=%v\n", peer.addr, sendCmpctMsg.Version, sendCmpctMsg.Announce)
+
+	// Versions we do not speak are ignored; the peer gets full blocks
+	if sendCmpctMsg.Version != CompactBlockVersion {
+		return nil
+	}
+
+	peer.mu.Lock()
+	peer.cmpctVersion = sendCmpctMsg.Version
+	peer.cmpctAnnounce = sendCmpctMsg.Announce
+	peer.mu.Unlock()
+	return nil
+}
+
 // handleNotFound processes a notfound message.
 func (sm *SyncManager) handleNotFound(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	notFoundMsg := &NotFoundMessage{}
-	if err := decoder.Decode(notFoundMsg); err != nil {
-		return fmt.Errorf("failed to decode notfound: %v", err)
+	if err := peer.decodePayload(msg, notFoundMsg); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received notfound from %s: %d %ss not found\n",
 		peer.addr, len(notFoundMsg.Hashes), notFoundMsg.Type)
 
-	// Mark items as not found (not implemented yet)
-	// In a full implementation, you'd remove from request queue
+	// Ask other peers for blocks this one could not serve
+	if notFoundMsg.Type == "block" {
+		sm.sendAll(sm.downloader.handleNotFound(peer, notFoundMsg.Hashes))
+	}
 
 	return nil
 }
 
 // handleMemPool processes a mempool message.
 func (sm *SyncManager) handleMemPool(peer *Peer, msg *P2PMessage) error {
-	buf := bytes.NewBuffer(msg.Payload)
-	decoder := gob.NewDecoder(buf)
 	memPoolMsg := &MemPoolMessage{}
-	if err := decoder.Decode(memPoolMsg); err != nil {
-		return fmt.Errorf("failed to decode mempool: %v", err)
+	if err := peer.decodePayload(msg, memPoolMsg); err != nil {
+		return err
 	}
 
 	fmt.Printf("Received mempool request from %s\n", peer.addr)
@@ -1525,10 +1573,13 @@ func (sm *SyncManager) handleMemPool(peer *Peer, msg *P2PMessage) error {
 	mempool := sm.blockchain.Mempool()
 	transactions := mempool.GetTransactions()
 
-	// Send inventory of all transactions in mempool
+	// Send inventory of all transactions in mempool the peer's filter
+	// matches
 	hashes := make([]wire.Hash, 0, len(transactions))
 	for _, tx := range transactions {
-		hashes = append(hashes, tx.TxHash())
+		if peer.relaysTx(tx) {
+			hashes = append(hashes, tx.TxHash())
+		}
 	}
 
 	inv := &InvMessage{
@@ -1536,10 +1587,14 @@ func (sm *SyncManager) handleMemPool(peer *Peer, msg *P2PMessage) error {
 		Hashes: hashes,
 	}
 
-	return peer.SendMessage(MsgTypeInv, inv)
+	peer.queueReply(MsgTypeInv, inv)
+	return nil
 }
 
-// announceBlock announces a new block to all peers except the source.
+// announceBlock announces a new block to all peers except the source and
+// those that already know it. High-bandwidth compact block peers are sent
+// the compact block itself and peers that sent sendheaders its header.
+// Blocks are announced at once rather than trickled.
 func (sm *SyncManager) announceBlock(block *wire.MsgBlock, excludeAddr string) {
 	blockHash := block.BlockHash()
 
@@ -1547,32 +1602,40 @@ func (sm *SyncManager) announceBlock(block *wire.MsgBlock, excludeAddr string) {
 		Type:   "block",
 		Hashes: []wire.Hash{blockHash},
 	}
+	headers := &HeadersMessage{Headers: []*wire.BlockHeader{&block.Header}}
+	cmpct := newCompactBlock(block)
 
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
 	for addr, peer := range sm.peers {
-		if addr != excludeAddr && peer.IsConnected() {
-			go peer.SendMessage(MsgTypeInv, inv)
+		if addr == excludeAddr || !peer.IsConnected() || peer.knowsInventory(blockHash) {
+			continue
+		}
+		peer.addKnownInventory(blockHash)
+		switch {
+		case peer.wantsCompactBlocks():
+			peer.QueueMessage(MsgTypeCompactBlock, cmpct)
+		case peer.wantsHeaders():
+			peer.QueueMessage(MsgTypeHeaders, headers)
+		default:
+			peer.QueueMessage(MsgTypeInv, inv)
 		}
 	}
 }
 
-// announceTx announces a new transaction to all peers except the source.
+// announceTx queues a new transaction for the next inventory trickle to
+// all peers except the source and those that already know it. SPV peers
+// only hear of transactions matching their bloom filter.
 func (sm *SyncManager) announceTx(tx *wire.MsgTx, excludeAddr string) {
 	txHash := tx.TxHash()
 
-	inv := &InvMessage{
-		Type:   "tx",
-		Hashes: []wire.Hash{txHash},
-	}
-
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
 	for addr, peer := range sm.peers {
-		if addr != excludeAddr && peer.IsConnected() {
-			go peer.SendMessage(MsgTypeInv, inv)
+		if addr != excludeAddr && peer.IsConnected() && !peer.knowsInventory(txHash) && peer.relaysTx(tx) {
+			peer.queueTx(txHash)
 		}
 	}
 }
@@ -1604,6 +1667,11 @@ type PeerInfo struct {
 	MessageCount int
 	Banned       bool
 	FeeFilter    int64
+	Services     ServiceFlag
+	BloomFilter  bool   // Peer loaded an SPV filter
+	Transport    string // TransportV1 or TransportV2
+	PeerKey      string // Hex identity key proven over v2, empty if none
+	Trusted      bool   // PeerKey is one of our trusted keys
 }
 
 // GetPeerInfo returns information about all connected peers.
@@ -1622,9 +1690,14 @@ func (sm *SyncManager) GetPeerInfo() []PeerInfo {
 			MessageCount: peer.messageCount,
 			Banned:       peer.IsBanned(),
 			FeeFilter:    peer.feeFilter,
+			BloomFilter:  peer.filter != nil,
+			Transport:    peer.transport,
+			PeerKey:      hex.EncodeToString(peer.peerKey),
+			Trusted:      peer.trusted,
 		}
 		if peer.version != nil {
 			peerInfo.Height = peer.version.Height
+			peerInfo.Services = peer.version.Services
 		}
 		peer.mu.RUnlock()
 		info = append(info, peerInfo)
@@ -1717,14 +1790,14 @@ func (sm *SyncManager) scheduleReconnection(addr string, attempt int) {
 }
 
 // sendReject sends a reject message to a peer.
-func (sm *SyncManager) sendReject(peer *Peer, message, ccode, reason string, data []byte) error {
+func (sm *SyncManager) sendReject(peer *Peer, message, ccode, reason string, data []byte) {
 	rejectMsg := &RejectMessage{
 		Message: message,
 		CCode:   ccode,
 		Reason:  reason,
 		Data:    data,
 	}
-	return peer.SendMessage(MsgTypeReject, rejectMsg)
+	peer.queueReply(MsgTypeReject, rejectMsg)
 }
 
 // getDisconnectReason returns a human-readable reason for disconnection
@@ -0,0 +1,634 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Transports reported for connected peers
+const (
+	TransportV1 = "v1" // Plaintext framing
+	TransportV2 = "v2" // Encrypted and authenticated packets
+)
+
+const (
+	// V2HandshakeTimeout bounds the key exchange of a v2 connection
+	V2HandshakeTimeout = 10 * time.Second
+
+	// V2RekeyInterval is the number of packets sent in each direction
+	// between rekeys
+	V2RekeyInterval = 224
+
+	// IdentityKeyFileName holds the node's static identity key, relative
+	// to DATA_DIR
+	IdentityKeyFileName = "p2pkey"
+
+	// V1RetryInterval is how long an address that answered v2 as a v1
+	// node is dialed with v1 directly before v2 is tried again
+	V1RetryInterval = 24 * time.Hour
+
+	v2KeySize          = 32
+	v2LengthSize       = 3                                  // Encrypted length prefix of a packet
+	v2MaxContents      = MaxMessageSize + MessageHeaderSize // Largest packet contents
+	v2AuthVersion      = 1
+	v2AuthSize         = 1 + ed25519.PublicKeySize + ed25519.SignatureSize
+	v1PrefixSize       = 16 // Magic and command bytes every v1 connection opens with
+	v2SharedSecret     = "obsidian_v2_shared_secret"
+	v2AuthContext      = "obsidian_v2_auth"
+	v2ChallengeContext = "obsidian_v2_challenge"
+)
+
+// errV2Unsupported reports a peer that dropped the v2 handshake as a v1 node
+// would, so the connection may be retried in plaintext. errV1Reply is the
+// case where the peer answered with a v1 message, which is remembered.
+var (
+	errV2Unsupported = errors.New("peer does not support the v2 transport")
+	errV1Reply       = fmt.Errorf("%w: answered as a v1 node", errV2Unsupported)
+)
+
+// TransportConfig controls the encrypted v2 transport. Outbound connections
+// try v2 first and fall back to v1 for peers that do not support it; inbound
+// connections are accepted either way.
+//
+// Identity keys are only exchanged with peers that already know them. An
+// initiator with trusted keys challenges the responder to prove one of
+// them, naming them only by hashes bound to the session; the responder
+// proves its key only if it was asked for. The initiator proves its own key
+// only once the responder has proven a trusted one. Without trusted keys no
+// identity is sent, so the persistent key can't be used to track a node.
+type TransportConfig struct {
+	V2          bool                // Offer and accept v2 connections
+	Identity    ed25519.PrivateKey  // Static key proven to peers that trust it
+	TrustedKeys []ed25519.PublicKey // Identity keys of trusted peers
+	TrustedOnly bool                // Refuse peers that do not prove a trusted key
+}
+
+// isTrusted reports whether key is one of the trusted keys.
+func (cfg *TransportConfig) isTrusted(key ed25519.PublicKey) bool {
+	for _, trusted := range cfg.TrustedKeys {
+		if trusted.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// v2Cipher encrypts or decrypts the packets of one direction. Each packet's
+// 3-byte length is encrypted with a ChaCha20 stream under the length key
+// and its contents sealed with ChaCha20-Poly1305 under the packet key, with
+// the encrypted length as associated data. Both keys are replaced every
+// V2RekeyInterval packets, so a key compromise exposes little traffic.
+type v2Cipher struct {
+	lengthKey [v2KeySize]byte
+	packetKey [v2KeySize]byte
+	aead      cipher.AEAD
+	counter   uint32 // Packets since the last rekey
+	epoch     uint64 // Rekeys so far
+}
+
+// newV2Cipher returns a cipher starting from the given keys
+func newV2Cipher(lengthKey, packetKey []byte) *v2Cipher {
+	c := &v2Cipher{}
+	copy(c.lengthKey[:], lengthKey)
+	copy(c.packetKey[:], packetKey)
+	c.aead, _ = chacha20poly1305.New(c.packetKey[:])
+	return c
+}
+
+// nonce returns the nonce of the next packet: the packet counter followed
+// by the rekey epoch
+func (c *v2Cipher) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint32(nonce[:4], c.counter)
+	binary.LittleEndian.PutUint64(nonce[4:], c.epoch)
+	return nonce
+}
+
+// cryptLength encrypts or decrypts the length prefix of the next packet
+func (c *v2Cipher) cryptLength(dst, src []byte) {
+	stream, _ := chacha20.NewUnauthenticatedCipher(c.lengthKey[:], c.nonce())
+	stream.XORKeyStream(dst, src)
+}
+
+// seal returns the next packet carrying contents
+func (c *v2Cipher) seal(contents []byte) []byte {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(contents)))
+	var encLength [v2LengthSize]byte
+	c.cryptLength(encLength[:], length[:v2LengthSize])
+
+	packet := make([]byte, v2LengthSize, v2LengthSize+len(contents)+chacha20poly1305.Overhead)
+	copy(packet, encLength[:])
+	packet = c.aead.Seal(packet, c.nonce(), contents, encLength[:])
+	c.advance()
+	return packet
+}
+
+// open authenticates and decrypts the contents of the next packet
+func (c *v2Cipher) open(encLength, ciphertext []byte) ([]byte, error) {
+	contents, err := c.aead.Open(ciphertext[:0], c.nonce(), ciphertext, encLength)
+	if err != nil {
+		return nil, fmt.Errorf("v2 packet failed authentication")
+	}
+	c.advance()
+	return contents, nil
+}
+
+// advance moves to the next packet, rekeying at the end of each interval
+func (c *v2Cipher) advance() {
+	c.counter++
+	if c.counter < V2RekeyInterval {
+		return
+	}
+	c.counter = 0
+	c.epoch++
+	c.lengthKey = v2Rekey(c.lengthKey, "length")
+	c.packetKey = v2Rekey(c.packetKey, "packet")
+	c.aead, _ = chacha20poly1305.New(c.packetKey[:])
+}
+
+// v2Rekey derives the key replacing key. The old key cannot be recovered
+// from the new one.
+func v2Rekey(key [v2KeySize]byte, label string) [v2KeySize]byte {
+	var next [v2KeySize]byte
+	io.ReadFull(hkdf.Expand(sha256.New, key[:], []byte("obsidian_v2_rekey_"+label)), next[:])
+	return next
+}
+
+// v2Conn is a connection speaking the v2 transport. Every Write is sent as
+// encrypted packets and Read returns the decrypted stream, so messages are
+// framed exactly as on a v1 connection.
+type v2Conn struct {
+	net.Conn
+	send      *v2Cipher
+	recv      *v2Cipher
+	sessionID [v2KeySize]byte
+	peerKey   ed25519.PublicKey // Identity the peer proved in the handshake
+	trusted   bool              // peerKey is one of our trusted keys
+
+	readMu  sync.Mutex
+	pending []byte // Decrypted bytes not read yet
+	writeMu sync.Mutex
+}
+
+// newV2Conn derives the session keys of a completed key exchange. Each
+// direction has its own length and packet keys; the session ID binds the
+// identity signatures to this connection.
+func newV2Conn(conn net.Conn, shared, initiatorPub, responderPub []byte, magic uint32, initiator bool) *v2Conn {
+	salt := []byte(v2SharedSecret)
+	salt = binary.LittleEndian.AppendUint32(salt, magic)
+	secret := append(append(append([]byte(nil), shared...), initiatorPub...), responderPub...)
+
+	keys := make([]byte, 5*v2KeySize)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, nil), keys)
+
+	initiatorCipher := newV2Cipher(keys[0:32], keys[32:64])
+	responderCipher := newV2Cipher(keys[64:96], keys[96:128])
+	c := &v2Conn{Conn: conn}
+	copy(c.sessionID[:], keys[128:160])
+	if initiator {
+		c.send, c.recv = initiatorCipher, responderCipher
+	} else {
+		c.send, c.recv = responderCipher, initiatorCipher
+	}
+	return c
+}
+
+// Read reads decrypted bytes, receiving packets as needed.
+func (c *v2Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		contents, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = contents
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write encrypts b and sends it as one or more packets.
+func (c *v2Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > v2MaxContents {
+			chunk = chunk[:v2MaxContents]
+		}
+		if _, err := c.Conn.Write(c.send.seal(chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// readPacket receives and decrypts one packet
+func (c *v2Conn) readPacket() ([]byte, error) {
+	var encLength [v2LengthSize]byte
+	if _, err := io.ReadFull(c.Conn, encLength[:]); err != nil {
+		return nil, err
+	}
+	var length [4]byte
+	c.recv.cryptLength(length[:v2LengthSize], encLength[:])
+	size := binary.LittleEndian.Uint32(length[:])
+	if size > v2MaxContents {
+		return nil, fmt.Errorf("v2 packet too large: %d bytes (max: %d)", size, v2MaxContents)
+	}
+
+	ciphertext := make([]byte, int(size)+chacha20poly1305.Overhead)
+	if _, err := io.ReadFull(c.Conn, ciphertext); err != nil {
+		return nil, err
+	}
+	return c.recv.open(encLength[:], ciphertext)
+}
+
+// authMessage returns what a side signs to prove its identity key
+func (c *v2Conn) authMessage(initiator bool) []byte {
+	role := byte(1)
+	if initiator {
+		role = 0
+	}
+	msg := append([]byte(v2AuthContext), role)
+	return append(msg, c.sessionID[:]...)
+}
+
+// challengeHash names key in a challenge. It is bound to the session, so
+// it only tells a peer that already knows key which key is asked for.
+func (c *v2Conn) challengeHash(key ed25519.PublicKey) []byte {
+	h := sha256.New()
+	h.Write([]byte(v2ChallengeContext))
+	h.Write(c.sessionID[:])
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// sendChallenge asks the peer to prove one of keys. With no keys it asks
+// for nothing.
+func (c *v2Conn) sendChallenge(keys []ed25519.PublicKey) error {
+	packet := make([]byte, 0, 1+len(keys)*sha256.Size)
+	packet = append(packet, v2AuthVersion)
+	for _, key := range keys {
+		packet = append(packet, c.challengeHash(key)...)
+	}
+	_, err := c.Write(packet)
+	return err
+}
+
+// recvChallenge reports whether the peer asked us to prove identity.
+func (c *v2Conn) recvChallenge(identity ed25519.PrivateKey) (bool, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return false, err
+	}
+	if len(packet) == 0 || packet[0] != v2AuthVersion || (len(packet)-1)%sha256.Size != 0 {
+		return false, fmt.Errorf("malformed v2 challenge packet")
+	}
+	if identity == nil {
+		return false, nil
+	}
+	ours := c.challengeHash(identity.Public().(ed25519.PublicKey))
+	for hash := packet[1:]; len(hash) > 0; hash = hash[sha256.Size:] {
+		if bytes.Equal(hash[:sha256.Size], ours) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sendAuth sends our identity key and its signature over the session, or
+// an empty proof if identity is nil.
+func (c *v2Conn) sendAuth(identity ed25519.PrivateKey, initiator bool) error {
+	packet := make([]byte, 0, v2AuthSize)
+	packet = append(packet, v2AuthVersion)
+	if identity != nil {
+		packet = append(packet, identity.Public().(ed25519.PublicKey)...)
+		packet = append(packet, ed25519.Sign(identity, c.authMessage(initiator))...)
+	}
+	_, err := c.Write(packet)
+	return err
+}
+
+// recvAuth checks the peer's identity key and signature, if it sent one,
+// refusing peers without a trusted key if only trusted peers are allowed.
+func (c *v2Conn) recvAuth(cfg *TransportConfig, initiator bool) error {
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(packet) == 1 && packet[0] == v2AuthVersion {
+		if cfg.TrustedOnly {
+			return fmt.Errorf("peer did not prove a trusted key")
+		}
+		return nil
+	}
+	if len(packet) != v2AuthSize || packet[0] != v2AuthVersion {
+		return fmt.Errorf("malformed v2 authentication packet")
+	}
+	key := ed25519.PublicKey(append([]byte(nil), packet[1:1+ed25519.PublicKeySize]...))
+	if !ed25519.Verify(key, c.authMessage(initiator), packet[1+ed25519.PublicKeySize:]) {
+		return fmt.Errorf("invalid v2 identity signature")
+	}
+
+	c.peerKey = key
+	c.trusted = cfg.isTrusted(key)
+	if cfg.TrustedOnly && !c.trusted {
+		return fmt.Errorf("peer key %x is not trusted", []byte(key))
+	}
+	return nil
+}
+
+// v1Prefix returns the first bytes of any v1 connection: the network magic
+// and the version command of the first message.
+func v1Prefix(magic uint32) []byte {
+	prefix := make([]byte, v1PrefixSize)
+	binary.LittleEndian.PutUint32(prefix, magic)
+	copy(prefix[4:], MsgTypeVersion)
+	return prefix
+}
+
+// v2EphemeralKey returns a fresh X25519 key pair. Public keys that look like
+// the start of a v1 connection are skipped so the responder can tell the
+// transports apart.
+func v2EphemeralKey(magic uint32) ([]byte, []byte, error) {
+	prefix := v1Prefix(magic)
+	for {
+		priv := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(priv); err != nil {
+			return nil, nil, err
+		}
+		pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(pub[:v1PrefixSize], prefix) {
+			return priv, pub, nil
+		}
+	}
+}
+
+// v2Initiate runs the initiator side of the v2 handshake: exchange
+// ephemeral keys, derive the session keys, then challenge the responder for
+// a trusted key and prove ours if it proved one. It returns errV1Reply if
+// the peer answers as a v1 node and errV2Unsupported if it drops the
+// connection.
+func v2Initiate(conn net.Conn, magic uint32, cfg *TransportConfig) (*v2Conn, error) {
+	conn.SetDeadline(time.Now().Add(V2HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	priv, pub, err := v2EphemeralKey(magic)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(pub); err != nil {
+		return nil, err
+	}
+
+	// A v1 node either drops the connection on seeing our key or sends
+	// its own version message
+	theirs := make([]byte, curve25519.PointSize)
+	n, err := io.ReadFull(conn, theirs)
+	if n >= v1PrefixSize && bytes.Equal(theirs[:v1PrefixSize], v1Prefix(magic)) {
+		return nil, errV1Reply
+	}
+	if n == 0 {
+		return nil, errV2Unsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := curve25519.X25519(priv, theirs)
+	if err != nil {
+		return nil, err
+	}
+	c := newV2Conn(conn, shared, pub, theirs, magic, true)
+	if err := c.sendChallenge(cfg.TrustedKeys); err != nil {
+		return nil, err
+	}
+	if err := c.recvAuth(cfg, false); err != nil {
+		return nil, err
+	}
+	var identity ed25519.PrivateKey
+	if c.trusted {
+		identity = cfg.Identity
+	}
+	if err := c.sendAuth(identity, true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// v2Accept runs the responder side of the v2 handshake. A peer opening with
+// a v1 message gets a plaintext connection that replays the bytes read.
+func v2Accept(conn net.Conn, magic uint32, cfg *TransportConfig) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(V2HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	theirs := make([]byte, curve25519.PointSize)
+	if _, err := io.ReadFull(conn, theirs[:v1PrefixSize]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(theirs[:v1PrefixSize], v1Prefix(magic)) {
+		if cfg.TrustedOnly {
+			return nil, fmt.Errorf("v1 peer cannot prove a trusted key")
+		}
+		return &prefixConn{Conn: conn, prefix: theirs[:v1PrefixSize]}, nil
+	}
+	if _, err := io.ReadFull(conn, theirs[v1PrefixSize:]); err != nil {
+		return nil, err
+	}
+
+	priv, pub, err := v2EphemeralKey(magic)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(priv, theirs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(pub); err != nil {
+		return nil, err
+	}
+	c := newV2Conn(conn, shared, theirs, pub, magic, false)
+	challenged, err := c.recvChallenge(cfg.Identity)
+	if err != nil {
+		return nil, err
+	}
+	var identity ed25519.PrivateKey
+	if challenged {
+		identity = cfg.Identity
+	}
+	if err := c.sendAuth(identity, false); err != nil {
+		return nil, err
+	}
+	if err := c.recvAuth(cfg, true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// prefixConn replays bytes already read from a connection before reading
+// from it again
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// defaultTransport enables v2 with a fresh identity, used until
+// SetTransport supplies a persistent one
+func defaultTransport() TransportConfig {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	return TransportConfig{V2: true, Identity: identity}
+}
+
+// SetTransport configures the transport of new connections. A config
+// without an identity keeps the current one.
+func (sm *SyncManager) SetTransport(cfg TransportConfig) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if cfg.Identity == nil {
+		cfg.Identity = sm.transport.Identity
+	}
+	sm.transport = cfg
+}
+
+// dialPeer connects to addr over the v2 transport, reconnecting with v1 if
+// the peer does not support it. Peers that answered v2 with a v1 message
+// are dialed with v1 directly for V1RetryInterval. Only a v1 answer or a
+// dropped connection causes a fallback: a v2 handshake failing later is an
+// error, so it cannot be used to downgrade the connection.
+func (sm *SyncManager) dialPeer(addr string) (net.Conn, error) {
+	sm.mu.RLock()
+	cfg := sm.transport
+	v1Only := time.Now().Before(sm.v1Only[addr])
+	sm.mu.RUnlock()
+
+	if cfg.TrustedOnly && (!cfg.V2 || v1Only) {
+		return nil, fmt.Errorf("%s cannot prove a trusted key without the v2 transport", addr)
+	}
+	conn, err := sm.peerManager.ConnectToPeer(addr)
+	if err != nil || !cfg.V2 || v1Only {
+		return conn, err
+	}
+
+	v2, err := v2Initiate(conn, sm.peerManager.params.Net, &cfg)
+	if err == nil {
+		return v2, nil
+	}
+	conn.Close()
+	sm.peerManager.DisconnectPeer(addr)
+	if !errors.Is(err, errV2Unsupported) || cfg.TrustedOnly {
+		return nil, fmt.Errorf("v2 handshake failed: %v", err)
+	}
+
+	fmt.Printf("[P2P] %s does not support the v2 transport, reconnecting with v1\n", addr)
+	if errors.Is(err, errV1Reply) {
+		sm.mu.Lock()
+		sm.v1Only[addr] = time.Now().Add(V1RetryInterval)
+		sm.mu.Unlock()
+	}
+	return sm.peerManager.ConnectToPeer(addr)
+}
+
+// acceptTransport negotiates the transport of an inbound connection.
+func (sm *SyncManager) acceptTransport(conn net.Conn) (net.Conn, error) {
+	sm.mu.RLock()
+	cfg := sm.transport
+	sm.mu.RUnlock()
+
+	if !cfg.V2 {
+		if cfg.TrustedOnly {
+			return nil, fmt.Errorf("cannot prove a trusted key without the v2 transport")
+		}
+		return conn, nil
+	}
+	return v2Accept(conn, sm.peerManager.params.Net, &cfg)
+}
+
+// IdentityKeyPath returns the path of the identity key file.
+func IdentityKeyPath() string {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, IdentityKeyFileName)
+}
+
+// LoadIdentityKey reads the node's identity key from path, creating and
+// saving a new one if the file does not exist.
+func LoadIdentityKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write identity key: %v", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %v", err)
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity key in %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseTrustedKeys parses a comma-separated list of hex identity keys.
+func ParseTrustedKeys(list string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, err := hex.DecodeString(field)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key %q", field)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
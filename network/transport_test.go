@@ -0,0 +1,297 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"obsidian-core/chaincfg"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTransport(t *testing.T) TransportConfig {
+	t.Helper()
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	return TransportConfig{V2: true, Identity: identity}
+}
+
+// v2Handshake connects an initiator and a responder over a pipe.
+func v2Handshake(t *testing.T, initCfg, respCfg TransportConfig) (*v2Conn, net.Conn, error, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := v2Accept(server, testMagic, &respCfg)
+		if err != nil {
+			server.Close()
+		}
+		accepted <- result{conn, err}
+	}()
+	initiated, initErr := v2Initiate(client, testMagic, &initCfg)
+	if initErr != nil {
+		client.Close()
+	}
+	res := <-accepted
+	return initiated, res.conn, initErr, res.err
+}
+
+// trustEachOther makes a and b trust each other's identity keys
+func trustEachOther(a, b *TransportConfig) {
+	a.TrustedKeys = append(a.TrustedKeys, b.Identity.Public().(ed25519.PublicKey))
+	b.TrustedKeys = append(b.TrustedKeys, a.Identity.Public().(ed25519.PublicKey))
+}
+
+func TestV2TransportRoundTrip(t *testing.T) {
+	initCfg, respCfg := newTestTransport(t), newTestTransport(t)
+	trustEachOther(&initCfg, &respCfg)
+	initiator, accepted, err1, err2 := v2Handshake(t, initCfg, respCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake failed: %v / %v", err1, err2)
+	}
+	responder, ok := accepted.(*v2Conn)
+	if !ok {
+		t.Fatalf("responder got %T, want *v2Conn", accepted)
+	}
+	if !initiator.peerKey.Equal(respCfg.Identity.Public()) || !responder.peerKey.Equal(initCfg.Identity.Public()) {
+		t.Fatalf("peers did not learn each other's identity keys")
+	}
+	if initiator.sessionID != responder.sessionID {
+		t.Fatalf("session IDs differ")
+	}
+
+	// Send enough messages to rekey several times
+	const count = 3*V2RekeyInterval + 5
+	go func() {
+		for i := 0; i < count; i++ {
+			framed, _ := EncodeMessage(testMagic, MsgTypePing, &PingMessage{Nonce: uint64(i)}, ProtocolVersion)
+			if _, err := initiator.Write(framed); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < count; i++ {
+		msg, err := ReadMessage(responder, testMagic)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		ping := &PingMessage{}
+		if err := ping.Decode(bytes.NewReader(msg.Payload), ProtocolVersion); err != nil || ping.Nonce != uint64(i) {
+			t.Fatalf("message %d decoded as %+v (%v)", i, ping, err)
+		}
+	}
+	// The challenge and authentication packets came first
+	if responder.recv.epoch != 3 || responder.recv.counter != 7 {
+		t.Errorf("receiver at epoch %d packet %d, want epoch 3 packet 7", responder.recv.epoch, responder.recv.counter)
+	}
+
+	go responder.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(initiator, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("reply = %q, %v", reply, err)
+	}
+}
+
+func TestV2PacketTampering(t *testing.T) {
+	key := make([]byte, 32)
+	sender, receiver := newV2Cipher(key, key), newV2Cipher(key, key)
+
+	packet := sender.seal([]byte("block announcement"))
+	packet[len(packet)-1] ^= 1
+	if _, err := receiver.open(packet[:v2LengthSize], packet[v2LengthSize:]); err == nil {
+		t.Fatalf("tampered packet was accepted")
+	}
+}
+
+func TestV2AcceptV1Peer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		framed, _ := EncodeMessage(testMagic, MsgTypeVersion, &VersionMessage{Version: ProtocolVersion, Height: 7}, ProtocolVersion)
+		client.Write(framed)
+	}()
+
+	cfg := newTestTransport(t)
+	conn, err := v2Accept(server, testMagic, &cfg)
+	if err != nil {
+		t.Fatalf("v2Accept failed: %v", err)
+	}
+	if _, ok := conn.(*v2Conn); ok {
+		t.Fatalf("v1 peer was given a v2 connection")
+	}
+	msg, err := ReadMessage(conn, testMagic)
+	if err != nil || msg.Type != MsgTypeVersion {
+		t.Fatalf("ReadMessage = %v, %v; want the replayed version message", msg, err)
+	}
+	if NewPeer(conn, "v1", true, testMagic).transport != TransportV1 {
+		t.Errorf("peer transport is not v1")
+	}
+
+	// Peers that cannot prove a key are refused when only trusted ones are allowed
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	go client2.Write(v1Prefix(testMagic))
+	cfg.TrustedOnly = true
+	if _, err := v2Accept(server2, testMagic, &cfg); err == nil {
+		t.Fatalf("v1 peer accepted with TrustedOnly")
+	}
+}
+
+func TestV2TrustedKeys(t *testing.T) {
+	initCfg, respCfg := newTestTransport(t), newTestTransport(t)
+	trustEachOther(&initCfg, &respCfg)
+	respCfg.TrustedOnly = true
+
+	initiator, accepted, err1, err2 := v2Handshake(t, initCfg, respCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake with trusted key failed: %v / %v", err1, err2)
+	}
+	if !initiator.trusted || !accepted.(*v2Conn).trusted {
+		t.Errorf("trusted keys not marked as trusted")
+	}
+
+	// A stranger that knows the responder's key proves its own, which the
+	// responder does not trust; one that doesn't proves nothing
+	stranger := newTestTransport(t)
+	if _, _, _, err := v2Handshake(t, stranger, respCfg); err == nil {
+		t.Fatalf("peer without a key accepted with TrustedOnly")
+	}
+	stranger.TrustedKeys = []ed25519.PublicKey{respCfg.Identity.Public().(ed25519.PublicKey)}
+	if _, _, _, err := v2Handshake(t, stranger, respCfg); err == nil {
+		t.Fatalf("untrusted key accepted with TrustedOnly")
+	}
+}
+
+func TestV2IdentityPrivacy(t *testing.T) {
+	// Without trusted keys no identity is sent
+	initCfg, respCfg := newTestTransport(t), newTestTransport(t)
+	initiator, accepted, err1, err2 := v2Handshake(t, initCfg, respCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake failed: %v / %v", err1, err2)
+	}
+	if initiator.peerKey != nil || accepted.(*v2Conn).peerKey != nil {
+		t.Fatalf("identity keys sent without trusted keys")
+	}
+
+	// A responder asked for another key does not reveal its own, and the
+	// initiator does not reveal its key to it either
+	initCfg.TrustedKeys = []ed25519.PublicKey{newTestTransport(t).Identity.Public().(ed25519.PublicKey)}
+	respCfg.TrustedKeys = []ed25519.PublicKey{initCfg.Identity.Public().(ed25519.PublicKey)}
+	initiator, accepted, err1, err2 = v2Handshake(t, initCfg, respCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake failed: %v / %v", err1, err2)
+	}
+	if initiator.peerKey != nil || accepted.(*v2Conn).peerKey != nil {
+		t.Errorf("identity keys sent to a peer that did not prove a trusted key")
+	}
+
+	// Requiring a trusted peer, the initiator refuses the responder
+	initCfg.TrustedOnly = true
+	if _, _, err, _ := v2Handshake(t, initCfg, respCfg); err == nil {
+		t.Errorf("responder without a trusted key accepted with TrustedOnly")
+	}
+}
+
+// listenV1 runs a v1 node that reports the type of the first message of
+// each connection. One that replies sends its version message first;
+// otherwise it drops connections whose first message has the wrong magic.
+func listenV1(t *testing.T, reply bool) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if reply {
+				framed, _ := EncodeMessage(testMagic, MsgTypeVersion, &VersionMessage{Version: ProtocolVersion}, ProtocolVersion)
+				conn.Write(framed)
+			}
+			msg, err := ReadMessage(conn, testMagic)
+			if err == nil {
+				received <- msg.Type
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestDialPeerFallsBackToV1(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	params := chaincfg.MainNetParams
+	params.Net = testMagic
+	sm := &SyncManager{
+		peerManager: NewPeerManager(&params, nil),
+		transport:   newTestTransport(t),
+		v1Only:      make(map[string]time.Time),
+	}
+
+	for _, reply := range []bool{false, true} {
+		addr, received := listenV1(t, reply)
+		conn, err := sm.dialPeer(addr)
+		if err != nil {
+			t.Fatalf("dialPeer failed: %v", err)
+		}
+		defer conn.Close()
+		if _, ok := conn.(*v2Conn); ok {
+			t.Fatalf("got a v2 connection to a v1 node")
+		}
+
+		// Only a v1 answer is remembered, and only for a while
+		until, remembered := sm.v1Only[addr]
+		if remembered != reply {
+			t.Errorf("address remembered as v1 only: %v, want %v", remembered, reply)
+		}
+		if reply && until.After(time.Now().Add(V1RetryInterval)) {
+			t.Errorf("v1 mark lasts until %v, longer than %v", until, V1RetryInterval)
+		}
+
+		framed, _ := EncodeMessage(testMagic, MsgTypeVersion, &VersionMessage{Version: ProtocolVersion}, ProtocolVersion)
+		conn.Write(framed)
+		if got := <-received; got != MsgTypeVersion {
+			t.Errorf("v1 node received %s, want version", got)
+		}
+	}
+}
+
+func TestLoadIdentityKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), IdentityKeyFileName)
+	key, err := LoadIdentityKey(path)
+	if err != nil {
+		t.Fatalf("LoadIdentityKey failed: %v", err)
+	}
+	again, err := LoadIdentityKey(path)
+	if err != nil || !key.Equal(again) {
+		t.Fatalf("identity key not persisted: %v", err)
+	}
+
+	keys, err := ParseTrustedKeys(" " + hex.EncodeToString(key.Public().(ed25519.PublicKey)) + ",")
+	if err != nil || len(keys) != 1 || !keys[0].Equal(key.Public()) {
+		t.Fatalf("ParseTrustedKeys = %v, %v", keys, err)
+	}
+	if _, err := ParseTrustedKeys("abcd"); err == nil {
+		t.Errorf("short key accepted")
+	}
+}
@@ -3,7 +3,10 @@ package rpcserver
 import (
 	"encoding/hex"
 	"fmt"
+	"obsidian-core/blockchain"
+	"obsidian-core/chaincfg"
 	"obsidian-core/crypto"
+	"obsidian-core/network"
 	"obsidian-core/smartcontract"
 	"obsidian-core/wire"
 	"strings"
@@ -65,6 +68,43 @@ func (s *Server) getBlock(params []interface{}) (interface{}, error) {
 	return blockInfo, nil
 }
 
+// getBlockFilter returns the compact filter of a block and its filter
+// header. Only the "basic" filter type is indexed.
+func (s *Server) getBlockFilter(params []interface{}) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, fmt.Errorf("missing block hash parameter")
+	}
+	hashStr, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid block hash parameter")
+	}
+	hash, err := wire.NewHashFromStr(hashStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash format: %v", err)
+	}
+	if len(params) > 1 {
+		if filterType, ok := params[1].(string); !ok || filterType != "basic" {
+			return nil, fmt.Errorf("unknown filter type")
+		}
+	}
+	if !s.chain.FilterIndexEnabled() {
+		return nil, fmt.Errorf("compact filter index is not enabled")
+	}
+
+	filter, err := s.chain.BlockFilter(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("filter not found: %v", err)
+	}
+	header, err := s.chain.FilterHeader(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("filter header not found: %v", err)
+	}
+	return map[string]string{
+		"filter": hex.EncodeToString(filter),
+		"header": header.String(),
+	}, nil
+}
+
 // getBlockchainInfo returns general blockchain information.
 func (s *Server) getBlockchainInfo(params []interface{}) (interface{}, error) {
 	block, err := s.chain.BestBlock()
@@ -74,12 +114,21 @@ func (s *Server) getBlockchainInfo(params []interface{}) (interface{}, error) {
 
 	hash := block.BlockHash()
 	info := BlockchainInfo{
-		Chain:         s.chain.Params().Name,
-		Blocks:        s.chain.Height(),
-		BestBlockHash: hash.String(),
-		Difficulty:    block.Header.Bits,
-		MaxMoney:      s.chain.Params().MaxMoney,
-		InitialSupply: s.chain.Params().InitialSupply,
+		Chain:                s.chain.Params().Name,
+		Blocks:               s.chain.Height(),
+		Headers:              s.chain.Height(),
+		BestBlockHash:        hash.String(),
+		Difficulty:           block.Header.Bits,
+		VerificationProgress: 1,
+		MaxMoney:             s.chain.Params().MaxMoney,
+		InitialSupply:        s.chain.Params().InitialSupply,
+	}
+
+	// Headers-first sync knows the best header before its blocks arrive
+	if sm, ok := s.syncManager.(interface {
+		SyncProgress() (int32, bool, float64)
+	}); ok {
+		info.Headers, info.InitialBlockDownload, info.VerificationProgress = sm.SyncProgress()
 	}
 
 	return info, nil
@@ -200,8 +249,8 @@ func (s *Server) sendtoaddress(params []interface{}) (interface{}, error) {
 	amount := int64(amountFloat * 100000000) // Convert to satoshis
 
 	// Detect address types
-	fromType := crypto.GetAddressType(fromAddress)
-	toType := crypto.GetAddressType(toAddress)
+	fromType := blockchain.AddressType(fromAddress)
+	toType := blockchain.AddressType(toAddress)
 
 	if fromType == crypto.AddressTypeUnknown {
 		return nil, fmt.Errorf("invalid from_address format")
@@ -210,41 +259,35 @@ func (s *Server) sendtoaddress(params []interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("invalid to_address format")
 	}
 
-	var txid string
-	var err error
-	var txType string
+	// The builder handles all four flows: t->t, t->z, z->z and z->t
+	builder, err := s.newTxBuilder(fromAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.AddOutput(toAddress, amount, nil); err != nil {
+		return nil, fmt.Errorf("invalid output: %v", err)
+	}
 
-	// Route based on address types
-	if fromType == crypto.AddressTypeTransparent && toType == crypto.AddressTypeTransparent {
-		// Transparent to Transparent: normal transaction
-		txid, err = s.wallet.SendToAddress(fromAddress, toAddress, amount)
+	tx, err := s.submitTransaction(builder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send transaction: %v", err)
+	}
+
+	var txType string
+	switch {
+	case fromType == crypto.AddressTypeTransparent && toType == crypto.AddressTypeTransparent:
 		txType = "transparent"
-	} else if fromType == crypto.AddressTypeTransparent && toType == crypto.AddressTypeShielded {
-		// Transparent to Shielded: auto-shield
-		txid, err = s.autoShield(fromAddress, toAddress, amount)
+	case fromType == crypto.AddressTypeTransparent:
 		txType = "shield"
-	} else if fromType == crypto.AddressTypeShielded && toType == crypto.AddressTypeTransparent {
-		// Shielded to Transparent: auto-unshield
-		txid, err = s.autoUnshield(fromAddress, toAddress, amount)
+	case toType == crypto.AddressTypeTransparent:
 		txType = "unshield"
-	} else {
-		// Shielded to Shielded: shielded transaction
-		recipients := []ShieldedRecipient{
-			{
-				Address: toAddress,
-				Amount:  amount,
-			},
-		}
-		txid, err = s.wallet.SendShielded(fromAddress, recipients)
+	default:
 		txType = "shielded"
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to send transaction: %v", err)
-	}
-
+	txHash := tx.TxHash()
 	result := map[string]interface{}{
-		"txid":        txid,
+		"txid":        txHash.String(),
 		"from":        fromAddress,
 		"to":          toAddress,
 		"amount":      amount,
@@ -255,84 +298,57 @@ func (s *Server) sendtoaddress(params []interface{}) (interface{}, error) {
 	return result, nil
 }
 
-// autoShield automatically shields funds from transparent to shielded address
-func (s *Server) autoShield(fromTransparent, toShielded string, amount int64) (string, error) {
-	// Create shielded note
-	note := &wire.Note{
-		Value:     amount,
-		Recipient: []byte(toShielded),
-		Rcm:       make([]byte, 32),
-		Memo:      make([]byte, 512),
-	}
+// newTxBuilder returns a transaction builder funded by a wallet address
+func (s *Server) newTxBuilder(fromAddress string) (*blockchain.ShieldedTxBuilder, error) {
+	builder := blockchain.NewShieldedTxBuilder(s.chain)
 
-	// Create shield transaction
-	tx := &wire.MsgTx{
-		Version:  1,
-		TxIn:     []*wire.TxIn{},
-		TxOut:    []*wire.TxOut{},
-		LockTime: 0,
+	switch blockchain.AddressType(fromAddress) {
+	case crypto.AddressTypeTransparent:
+		key, err := s.wallet.GetPrivateKey(fromAddress)
+		if err != nil {
+			return nil, err
+		}
+		builder.AddTransparentSource(key)
+	case crypto.AddressTypeShielded:
+		key, err := s.wallet.GetSpendingKey(fromAddress)
+		if err != nil {
+			return nil, err
+		}
+		builder.AddShieldedSource(key)
+	default:
+		return nil, fmt.Errorf("invalid from_address format")
 	}
 
-	// Add transparent input (simplified)
-	tx.TxIn = append(tx.TxIn, &wire.TxIn{
-		PreviousOutPoint: wire.OutPoint{},
-		SignatureScript:  []byte(fromTransparent),
-		Sequence:         0xffffffff,
-	})
-
-	// Add shielded output
-	shieldedOutput := &wire.ShieldedOutput{
-		Cv:            make([]byte, 32),
-		Cmu:           make([]byte, 32),
-		EphemeralKey:  make([]byte, 32),
-		EncCiphertext: make([]byte, 580),
-		OutCiphertext: make([]byte, 80),
-		Proof:         make([]byte, 192),
-		Memo:          note.Memo,
-		TokenID:       wire.Hash{},
-		TokenAmount:   0,
-	}
-	tx.ShieldedOutputs = append(tx.ShieldedOutputs, shieldedOutput)
-
-	// Calculate transaction hash
-	txHash := tx.TxHash()
-
-	return txHash.String(), nil
+	return builder, nil
 }
 
-// autoUnshield automatically unshields funds from shielded to transparent address
-func (s *Server) autoUnshield(fromShielded, toTransparent string, amount int64) (string, error) {
-	// Create unshield transaction
-	tx := &wire.MsgTx{
-		Version:  1,
-		TxIn:     []*wire.TxIn{},
-		TxOut:    []*wire.TxOut{},
-		LockTime: 0,
+// submitTransaction builds a transaction, adds it to the mempool and relays
+// it to peers
+func (s *Server) submitTransaction(builder *blockchain.ShieldedTxBuilder) (*wire.MsgTx, error) {
+	tx, err := builder.Build()
+	if err != nil {
+		return nil, err
 	}
 
-	// Add shielded input (spend from shielded pool)
-	shieldedSpend := &wire.ShieldedSpend{
-		Cv:           make([]byte, 32),
-		Anchor:       make([]byte, 32),
-		Nullifier:    make([]byte, 32),
-		Rk:           make([]byte, 32),
-		Proof:        make([]byte, 192),
-		SpendAuthSig: make([]byte, 64),
-		TokenID:      wire.Hash{},
-		TokenAmount:  0,
+	// Relay through the Dandelion stem so the transaction cannot be traced
+	// back to this node
+	if sm, ok := s.syncManager.(interface{ SubmitTransaction(*wire.MsgTx) error }); ok {
+		err = sm.SubmitTransaction(tx)
+	} else {
+		_, err = s.chain.AcceptTransaction(tx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transaction rejected: %v", err)
 	}
-	tx.ShieldedSpends = append(tx.ShieldedSpends, shieldedSpend)
-
-	// Add transparent output
-	tx.TxOut = append(tx.TxOut, &wire.TxOut{
-		Value:    amount,
-		PkScript: []byte(toTransparent),
-	})
 
-	// Calculate transaction hash
-	txHash := tx.TxHash()
+	// Keep the secrets needed to later disclose the shielded outputs
+	if keys := builder.DisclosureKeys(); keys != nil {
+		if err := s.wallet.StoreDisclosureKeys(tx.TxHash(), keys); err != nil {
+			fmt.Printf("Warning: disclosure keys of %s not saved: %v\n", tx.TxHash(), err)
+		}
+	}
 
-	return txHash.String(), nil
+	return tx, nil
 }
 
 // getTransactionDescription returns a human-readable description of the transaction type
@@ -428,7 +444,7 @@ func (s *Server) z_getbalance(params []interface{}) (interface{}, error) {
 // z_sendmany sends funds from a z-address to multiple recipients (transparent or shielded).
 func (s *Server) z_sendmany(params []interface{}) (interface{}, error) {
 	if len(params) < 2 {
-		return nil, fmt.Errorf("missing parameters: z_sendmany <from_address> <amounts> [memo]")
+		return nil, fmt.Errorf("missing parameters: z_sendmany <from_address> <amounts> [memo] [fee]")
 	}
 
 	fromAddress, ok := params[0].(string)
@@ -447,6 +463,20 @@ func (s *Server) z_sendmany(params []interface{}) (interface{}, error) {
 		memo, _ = params[2].(string)
 	}
 
+	builder, err := s.newTxBuilder(fromAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional fee in OBS
+	if len(params) > 3 {
+		feeFloat, ok := params[3].(float64)
+		if !ok || feeFloat < 0 {
+			return nil, fmt.Errorf("invalid fee parameter")
+		}
+		builder.SetFee(int64(feeFloat * 100000000))
+	}
+
 	// Parse recipients
 	recipients := make([]ShieldedRecipient, 0, len(amounts))
 	for _, amt := range amounts {
@@ -459,25 +489,31 @@ func (s *Server) z_sendmany(params []interface{}) (interface{}, error) {
 		amount, _ := amtMap["amount"].(float64)
 		recipientMemo, _ := amtMap["memo"].(string)
 
-		if recipientMemo == "" {
+		// The default memo only applies to shielded recipients
+		if recipientMemo == "" && wire.IsShieldedAddress(address) {
 			recipientMemo = memo
 		}
 
-		recipients = append(recipients, ShieldedRecipient{
+		recipient := ShieldedRecipient{
 			Address: address,
 			Amount:  int64(amount * 100000000), // Convert to satoshis
 			Memo:    recipientMemo,
-		})
+		}
+		if err := builder.AddOutput(recipient.Address, recipient.Amount, []byte(recipient.Memo)); err != nil {
+			return nil, fmt.Errorf("invalid recipient %s: %v", address, err)
+		}
+		recipients = append(recipients, recipient)
 	}
 
-	// Create and send shielded transaction
-	txid, err := s.wallet.SendShielded(fromAddress, recipients)
+	// Create and send the transaction
+	tx, err := s.submitTransaction(builder)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send transaction: %v", err)
 	}
 
+	txHash := tx.TxHash()
 	result := map[string]interface{}{
-		"txid":       txid,
+		"txid":       txHash.String(),
 		"from":       fromAddress,
 		"recipients": len(recipients),
 	}
@@ -568,21 +604,155 @@ func (s *Server) z_shieldcoinbase(params []interface{}) (interface{}, error) {
 	if !ok {
 		return nil, fmt.Errorf("invalid z-address parameter")
 	}
+	if !wire.IsShieldedAddress(toAddress) {
+		return nil, fmt.Errorf("destination must be a shielded address")
+	}
+
+	// Optional source address, "*" for every wallet address
+	fromAddress := "*"
+	if len(params) > 1 {
+		fromAddress, ok = params[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid from_address parameter")
+		}
+	}
+
+	fromAddresses := []string{fromAddress}
+	if fromAddress == "*" {
+		fromAddresses = s.wallet.ListAddresses()
+	}
+
+	builder := blockchain.NewShieldedTxBuilder(s.chain)
+	builder.SetCoinbaseOnly(true)
+	for _, address := range fromAddresses {
+		key, err := s.wallet.GetPrivateKey(address)
+		if err != nil {
+			return nil, err
+		}
+		builder.AddTransparentSource(key)
+	}
+
+	// Optional fee in OBS
+	if len(params) > 2 {
+		feeFloat, ok := params[2].(float64)
+		if !ok || feeFloat < 0 {
+			return nil, fmt.Errorf("invalid fee parameter")
+		}
+		builder.SetFee(int64(feeFloat * 100000000))
+	}
 
 	// Shield all transparent coinbase funds
-	txid, err := s.wallet.ShieldCoinbase(toAddress)
+	if err := builder.SweepTo(toAddress, nil); err != nil {
+		return nil, err
+	}
+	tx, err := s.submitTransaction(builder)
 	if err != nil {
 		return nil, fmt.Errorf("failed to shield coinbase: %v", err)
 	}
 
+	txHash := tx.TxHash()
 	result := map[string]interface{}{
-		"txid":         txid,
-		"shielding_to": toAddress,
+		"txid":            txHash.String(),
+		"shielding_to":    toAddress,
+		"shielding_utxos": len(tx.TxIn),
+		"shielding_value": -tx.ValueBalance,
 	}
 
 	return result, nil
 }
 
+// z_getpaymentdisclosure creates a payment disclosure for a shielded output
+// of a transaction sent by the wallet.
+func (s *Server) z_getpaymentdisclosure(params []interface{}) (interface{}, error) {
+	if len(params) < 2 {
+		return nil, fmt.Errorf("insufficient parameters: need txid, output index")
+	}
+
+	txid, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid txid parameter")
+	}
+	txHash, err := wire.NewHashFromStr(txid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid txid: %v", err)
+	}
+
+	indexFloat, ok := params[1].(float64)
+	if !ok || indexFloat < 0 {
+		return nil, fmt.Errorf("invalid output index parameter")
+	}
+	index := uint32(indexFloat)
+
+	// Optional message bound into the disclosure
+	message := ""
+	if len(params) > 2 {
+		message, _ = params[2].(string)
+	}
+
+	tx, _, err := s.chain.FindTransaction(*txHash)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.wallet.GetDisclosureKeys(*txHash)
+	if err != nil {
+		return nil, err
+	}
+	if int(index) >= len(keys.Ocks) {
+		return nil, fmt.Errorf("output index %d out of range", index)
+	}
+
+	pd, err := wire.NewPaymentDisclosure(tx, index, keys.Ocks[index], keys.Bsk, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payment disclosure: %v", err)
+	}
+
+	return pd.String(), nil
+}
+
+// z_validatepaymentdisclosure checks a payment disclosure against the chain.
+func (s *Server) z_validatepaymentdisclosure(params []interface{}) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, fmt.Errorf("missing payment disclosure parameter")
+	}
+
+	encoded, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid payment disclosure parameter")
+	}
+	pd, err := wire.ParsePaymentDisclosure(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{
+		"txid":   pd.TxHash.String(),
+		"output": pd.OutputIndex,
+		"valid":  false,
+	}
+
+	tx, height, err := s.chain.FindTransaction(pd.TxHash)
+	if err != nil {
+		result["error"] = err.Error()
+		return result, nil
+	}
+
+	payment, err := pd.Verify(tx)
+	if err != nil {
+		result["error"] = err.Error()
+		return result, nil
+	}
+
+	result["valid"] = true
+	result["confirmed"] = height >= 0
+	result["address"] = payment.Address.String()
+	result["value"] = float64(payment.Value) / 100000000
+	result["valueZat"] = payment.Value
+	result["memo"] = hex.EncodeToString(payment.Memo)
+	result["message"] = payment.Message
+
+	return result, nil
+}
+
 // getpoolinfo returns mining pool statistics
 func (s *Server) getpoolinfo(params []interface{}, wallet interface{}) (interface{}, error) {
 	if s.pool == nil {
@@ -850,7 +1020,7 @@ func (s *Server) shieldtoken(params []interface{}) (interface{}, error) {
 	// Add to mempool (simplified)
 	fmt.Printf("Token shielded transaction created: %s\n", tx.TxHash().String())
 
-	isShielding := strings.HasPrefix(toAddress, "zobs")
+	isShielding := wire.IsShieldedAddress(toAddress)
 	action := "shielding"
 	if !isShielding {
 		action = "unshielding"
@@ -1033,6 +1203,17 @@ func (s *Server) getPeerInfo(params []interface{}) (interface{}, error) {
 	return sm.GetPeerInfo(), nil
 }
 
+// getCompactBlockInfo returns compact block relay statistics
+func (s *Server) getCompactBlockInfo(params []interface{}) (interface{}, error) {
+	sm, ok := s.syncManager.(interface {
+		CompactBlockStats() network.CompactBlockStats
+	})
+	if !ok {
+		return network.CompactBlockStats{}, nil
+	}
+	return sm.CompactBlockStats(), nil
+}
+
 // getConnectionCount returns the number of connections
 func (s *Server) getConnectionCount(params []interface{}) (interface{}, error) {
 	if s.syncManager == nil {
@@ -1232,7 +1413,7 @@ func (s *Server) shield(params []interface{}) (interface{}, error) {
 	if !crypto.IsTransparentAddress(fromAddress) {
 		return nil, fmt.Errorf("from_address must be a transparent address (obs)")
 	}
-	if !crypto.IsShieldedAddress(toShieldedAddress) {
+	if !wire.IsShieldedAddress(toShieldedAddress) {
 		return nil, fmt.Errorf("to_shielded_address must be a shielded address (zobs)")
 	}
 
@@ -1258,7 +1439,7 @@ func (s *Server) unshield(params []interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("invalid to_address parameter")
 	}
 
-	if !crypto.IsShieldedAddress(fromShieldedAddress) {
+	if !wire.IsShieldedAddress(fromShieldedAddress) {
 		return nil, fmt.Errorf("from_shielded_address must be a shielded address (zobs)")
 	}
 	if !crypto.IsTransparentAddress(toAddress) {
@@ -1269,10 +1450,16 @@ func (s *Server) unshield(params []interface{}) (interface{}, error) {
 	return s.sendtoaddress(params)
 }
 
-// deploycontract deploys a smart contract
+// defaultContractGas is the execution gas given to contract transactions
+// that do not set a gas limit, on top of their intrinsic gas
+const defaultContractGas = 1000000
+
+// deploycontract deploys a smart contract from a transparent address. The
+// code is OCL source, compiled here, or hex-encoded bytecode. The contract
+// address is derived from the deployer and its deployment count.
 func (s *Server) deploycontract(params []interface{}) (interface{}, error) {
-	if len(params) < 1 {
-		return nil, fmt.Errorf("insufficient parameters: need contract_code")
+	if len(params) < 2 {
+		return nil, fmt.Errorf("insufficient parameters: need contract_code, from_address, [gas_limit], [gas_price]")
 	}
 
 	contractCode, ok := params[0].(string)
@@ -1280,47 +1467,179 @@ func (s *Server) deploycontract(params []interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("invalid contract_code parameter")
 	}
 
-	// Parse and compile contract
-	lexer := smartcontract.NewLexer(contractCode)
-	tokens, err := lexer.Tokenize()
+	fromAddress, ok := params[1].(string)
+	if !ok || !crypto.IsTransparentAddress(fromAddress) {
+		return nil, fmt.Errorf("from_address must be a transparent address (obs)")
+	}
+
+	// Source is analyzed before compiling; errors reject the deployment
+	// and warnings are returned with the result
+	var warnings []string
+	bytecode, err := hex.DecodeString(contractCode)
+	if err != nil || !smartcontract.IsBytecode(bytecode) {
+		diagnostics, err := blockchain.CheckContractSource(contractCode)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range diagnostics {
+			warnings = append(warnings, d.String())
+		}
+		if bytecode, err = blockchain.CompileContractBytecode(contractCode); err != nil {
+			return nil, err
+		}
+	}
+	contract, err := smartcontract.DecodeBytecode(bytecode)
 	if err != nil {
-		return nil, fmt.Errorf("lexer error: %v", err)
+		return nil, err
+	}
+	if err := smartcontract.VerifyBytecode(contract); err != nil {
+		return nil, fmt.Errorf("bytecode verification failed: %v", err)
 	}
 
-	parser := smartcontract.NewParser(tokens)
-	ast, err := parser.Parse()
+	// Default gas: intrinsic gas of the deployment plus execution headroom
+	skeleton := wire.NewMsgTx(wire.TxVersion)
+	skeleton.TxType = wire.TxTypeSmartContractDeploy
+	skeleton.Memo = bytecode
+	gasLimit, gasPrice, err := contractGasParams(params, 2, skeleton.CalculateIntrinsicGas()+defaultContractGas)
 	if err != nil {
-		return nil, fmt.Errorf("parser error: %v", err)
+		return nil, err
 	}
 
-	compiler := smartcontract.NewCompiler()
-	bytecode := compiler.Compile(ast)
+	builder, err := s.newTxBuilder(fromAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.SetContractPayload(wire.TxTypeSmartContractDeploy, bytecode, gasLimit, gasPrice); err != nil {
+		return nil, err
+	}
 
-	// Create deployment transaction
-	tx := wire.NewMsgTx(1)
-	tx.TxType = wire.TxTypeSmartContractDeploy
-	tx.Memo = []byte(contractCode) // Store code in memo
+	address, err := s.chain.NextContractAddress(fromAddress)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.submitTransaction(builder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deploy contract: %v", err)
+	}
 
-	// Add to mempool (simplified)
-	fmt.Printf("Smart contract deployment transaction created: %s\n", tx.TxHash().String())
+	functions := make([]string, 0, len(contract.Functions))
+	for _, fn := range contract.ABI() {
+		functions = append(functions, fn.Name)
+	}
+
+	result := map[string]interface{}{
+		"txid":      tx.TxHash().String(),
+		"action":    "deploy",
+		"address":   address,
+		"deployer":  fromAddress,
+		"functions": functions,
+		"gas_limit": gasLimit,
+		"gas_price": gasPrice,
+	}
+	if len(warnings) > 0 {
+		result["warnings"] = warnings
+	}
+	return result, nil
+}
+
+// contractGasParams reads the optional gas_limit and gas_price parameters
+// at params[index] and params[index+1]
+func contractGasParams(params []interface{}, index int, defaultLimit uint64) (uint64, int64, error) {
+	gasLimit := defaultLimit
+	if len(params) > index {
+		limit, ok := params[index].(float64)
+		if !ok || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid gas_limit parameter")
+		}
+		gasLimit = uint64(limit)
+	}
+	gasPrice := int64(1)
+	if len(params) > index+1 {
+		price, ok := params[index+1].(float64)
+		if !ok || price <= 0 {
+			return 0, 0, fmt.Errorf("invalid gas_price parameter")
+		}
+		gasPrice = int64(price)
+	}
+	return gasLimit, gasPrice, nil
+}
+
+// loadContract returns the deployed contract at address and its bytecode
+func (s *Server) loadContract(params []interface{}) (*smartcontract.ContractRecord, *smartcontract.CompiledContract, error) {
+	if len(params) < 1 {
+		return nil, nil, fmt.Errorf("insufficient parameters: need contract_address")
+	}
+	address, ok := params[0].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid contract_address parameter")
+	}
+
+	record, err := s.chain.GetContract(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	contract, err := record.Contract()
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, contract, nil
+}
+
+// getcontractinfo returns the deployment details and ABI of a contract
+func (s *Server) getcontractinfo(params []interface{}) (interface{}, error) {
+	record, _, err := s.loadContract(params)
+	if err != nil {
+		return nil, err
+	}
+
+	abi := make([]map[string]interface{}, 0, len(record.ABI))
+	for _, fn := range record.ABI {
+		params := fn.Params
+		if params == nil {
+			params = []string{}
+		}
+		abi = append(abi, map[string]interface{}{
+			"name":   fn.Name,
+			"params": params,
+		})
+	}
 
 	return map[string]interface{}{
-		"txid":     tx.TxHash().String(),
-		"action":   "deploy",
-		"code":     contractCode,
-		"bytecode": fmt.Sprintf("%v", bytecode), // Simplified
+		"address":   record.Address,
+		"deployer":  record.Deployer,
+		"nonce":     record.Nonce,
+		"txid":      record.TxHash.String(),
+		"height":    record.Height,
+		"abi":       abi,
+		"code_size": len(record.Code),
+	}, nil
+}
+
+// getcontractcode returns the bytecode of a contract and its disassembly
+func (s *Server) getcontractcode(params []interface{}) (interface{}, error) {
+	record, contract, err := s.loadContract(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"address":      record.Address,
+		"version":      smartcontract.BytecodeVersion,
+		"bytecode":     hex.EncodeToString(record.Code),
+		"instructions": contract.Disassemble(),
 	}, nil
 }
 
-// callcontract calls a smart contract function
+// callcontract runs a function of a deployed contract against the current
+// state without creating a transaction
 func (s *Server) callcontract(params []interface{}) (interface{}, error) {
 	if len(params) < 2 {
 		return nil, fmt.Errorf("insufficient parameters: need contract_address, function_name, [args...]")
 	}
 
-	contractAddress, ok := params[0].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid contract_address parameter")
+	record, _, err := s.loadContract(params)
+	if err != nil {
+		return nil, err
 	}
 
 	functionName, ok := params[1].(string)
@@ -1328,19 +1647,440 @@ func (s *Server) callcontract(params []interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("invalid function_name parameter")
 	}
 
-	// Simplified: assume bytecode is stored somewhere
-	// In real implementation, retrieve contract bytecode from storage
+	// Remaining parameters are the typed function arguments
+	args := make([]smartcontract.Value, 0, len(params)-2)
+	for i, param := range params[2:] {
+		arg, err := smartcontract.ValueFromInterface(param)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %d: %v", i, err)
+		}
+		args = append(args, arg)
+	}
 
-	// Mock execution
-	result := "contract executed successfully"
+	sim, err := s.chain.SimulateContract(&smartcontract.CallData{
+		Contract: record.Address,
+		Function: functionName,
+		Args:     args,
+	}, "", 0, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if sim.Status != blockchain.ContractStatusSuccess {
+		return nil, fmt.Errorf("contract execution failed: %s", sim.Error)
+	}
 
 	return map[string]interface{}{
-		"contract": contractAddress,
+		"contract": record.Address,
 		"function": functionName,
-		"result":   result,
+		"result":   sim.Result.Interface(),
+		"gas_used": sim.GasUsed,
+		"logs":     logsJSON(sim.Logs),
 	}, nil
 }
 
+// contractCallParams reads the contract_address, function_name and optional
+// args array parameters shared by the simulation methods
+func (s *Server) contractCallParams(params []interface{}) (*smartcontract.CallData, error) {
+	if len(params) < 2 {
+		return nil, fmt.Errorf("insufficient parameters: need contract_address, function_name, [args]")
+	}
+	record, _, err := s.loadContract(params)
+	if err != nil {
+		return nil, err
+	}
+	functionName, ok := params[1].(string)
+	if !ok || functionName == "" {
+		return nil, fmt.Errorf("invalid function_name parameter")
+	}
+
+	call := &smartcontract.CallData{Contract: record.Address, Function: functionName}
+	if len(params) > 2 && params[2] != nil {
+		argParams, ok := params[2].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid args parameter: must be an array")
+		}
+		for i, param := range argParams {
+			arg, err := smartcontract.ValueFromInterface(param)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument %d: %v", i, err)
+			}
+			call.Args = append(call.Args, arg)
+		}
+	}
+	return call, nil
+}
+
+// simulatecontract runs a contract call against the state at the tip, or at
+// an optional block height, without sending a transaction. It reports what
+// the call would return, the gas it would use, the storage it would change,
+// the events it would emit and the value it would transfer. An optional
+// from_address and value set msg.sender and msg.value.
+func (s *Server) simulatecontract(params []interface{}) (interface{}, error) {
+	call, err := s.contractCallParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	height := int32(-1)
+	if len(params) > 3 && params[3] != nil {
+		h, ok := params[3].(float64)
+		if !ok || h < 0 {
+			return nil, fmt.Errorf("invalid height parameter")
+		}
+		height = int32(h)
+	}
+	gasLimit := uint64(0)
+	if len(params) > 4 {
+		limit, ok := params[4].(float64)
+		if !ok || limit <= 0 {
+			return nil, fmt.Errorf("invalid gas_limit parameter")
+		}
+		gasLimit = uint64(limit)
+	}
+	sender, value, err := contractMsgParams(params, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	sim, err := s.chain.SimulateContract(call, sender, value, height, gasLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]map[string]interface{}, 0, len(sim.Diffs))
+	for _, diff := range sim.Diffs {
+		diffs = append(diffs, map[string]interface{}{
+			"contract": diff.Contract,
+			"key":      diff.Key,
+			"before":   diff.Before.Interface(),
+			"after":    diff.After.Interface(),
+		})
+	}
+
+	result := map[string]interface{}{
+		"contract":     sim.Contract,
+		"function":     sim.Function,
+		"height":       sim.Height,
+		"status":       sim.Status.String(),
+		"result":       sim.Result.Interface(),
+		"gas_used":     sim.GasUsed,
+		"gas_required": sim.GasRequired,
+		"storage":      diffs,
+		"logs":         logsJSON(sim.Logs),
+		"transfers":    transfersJSON(sim.Transfers),
+	}
+	if sim.Status != blockchain.ContractStatusSuccess {
+		result["result"] = nil
+		result["error"] = sim.Error
+	}
+	return result, nil
+}
+
+// estimategas returns the gas limit a call transaction needs. With a
+// from_address, the funding inputs and outputs the wallet would add are
+// included; otherwise the estimate covers the call data and execution only.
+func (s *Server) estimategas(params []interface{}) (interface{}, error) {
+	call, err := s.contractCallParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	fromAddress, value, err := contractMsgParams(params, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	gas, err := s.chain.EstimateGas(call, fromAddress, value)
+	if err != nil {
+		return nil, err
+	}
+	if fromAddress != "" {
+		if gas, err = s.fundedCallGas(call, gas, fromAddress, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"contract":  call.Contract,
+		"function":  call.Function,
+		"gas_limit": gas,
+	}, nil
+}
+
+// contractMsgParams reads the optional from_address and value (OBS)
+// parameters at index and index+1
+func contractMsgParams(params []interface{}, index int) (string, int64, error) {
+	from := ""
+	if len(params) > index && params[index] != nil {
+		address, ok := params[index].(string)
+		if !ok || !crypto.IsTransparentAddress(address) {
+			return "", 0, fmt.Errorf("from_address must be a transparent address (obs)")
+		}
+		from = address
+	}
+	value := int64(0)
+	if len(params) > index+1 {
+		valueFloat, ok := params[index+1].(float64)
+		if !ok || valueFloat < 0 {
+			return "", 0, fmt.Errorf("invalid value parameter")
+		}
+		value = int64(valueFloat * 100000000) // Convert to satoshis
+	}
+	return from, value, nil
+}
+
+// fundedCallGas adds to a call's estimated gas the intrinsic gas of the
+// inputs and outputs that fund it from fromAddress
+func (s *Server) fundedCallGas(call *smartcontract.CallData, gas uint64, fromAddress string, value int64) (uint64, error) {
+	callData, err := smartcontract.EncodeCallData(call)
+	if err != nil {
+		return 0, err
+	}
+	skeleton := wire.NewMsgTx(wire.TxVersion)
+	skeleton.TxType = wire.TxTypeSmartContractCall
+	skeleton.Memo = callData
+
+	builder, err := s.newTxBuilder(fromAddress)
+	if err != nil {
+		return 0, err
+	}
+	if err := builder.SetContractPayload(wire.TxTypeSmartContractCall, callData, gas, 1); err != nil {
+		return 0, err
+	}
+	if value > 0 {
+		if err := builder.AddOutput(call.Contract, value, nil); err != nil {
+			return 0, err
+		}
+	}
+	tx, err := builder.Build()
+	if err != nil {
+		return 0, err
+	}
+	return gas + tx.CalculateIntrinsicGas() - skeleton.CalculateIntrinsicGas(), nil
+}
+
+// invokecontract sends a transaction calling a contract function, with OBS
+// optionally attached. The call runs when the transaction is mined; its
+// outcome is reported by gettransactionreceipt.
+func (s *Server) invokecontract(params []interface{}) (interface{}, error) {
+	if len(params) < 4 {
+		return nil, fmt.Errorf("insufficient parameters: need contract_address, function_name, args, from_address, [value], [gas_limit], [gas_price]")
+	}
+
+	record, _, err := s.loadContract(params)
+	if err != nil {
+		return nil, err
+	}
+	functionName, ok := params[1].(string)
+	if !ok || functionName == "" {
+		return nil, fmt.Errorf("invalid function_name parameter")
+	}
+	argParams, ok := params[2].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid args parameter: must be an array")
+	}
+	fromAddress, ok := params[3].(string)
+	if !ok || !crypto.IsTransparentAddress(fromAddress) {
+		return nil, fmt.Errorf("from_address must be a transparent address (obs)")
+	}
+
+	args := make([]smartcontract.Value, 0, len(argParams))
+	for i, param := range argParams {
+		arg, err := smartcontract.ValueFromInterface(param)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %d: %v", i, err)
+		}
+		args = append(args, arg)
+	}
+
+	value := int64(0)
+	if len(params) > 4 {
+		valueFloat, ok := params[4].(float64)
+		if !ok || valueFloat < 0 {
+			return nil, fmt.Errorf("invalid value parameter")
+		}
+		value = int64(valueFloat * 100000000) // Convert to satoshis
+	}
+
+	callData, err := smartcontract.EncodeCallData(&smartcontract.CallData{
+		Contract: record.Address,
+		Function: functionName,
+		Args:     args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	skeleton := wire.NewMsgTx(wire.TxVersion)
+	skeleton.TxType = wire.TxTypeSmartContractCall
+	skeleton.Memo = callData
+	gasLimit, gasPrice, err := contractGasParams(params, 5, skeleton.CalculateIntrinsicGas()+defaultContractGas)
+	if err != nil {
+		return nil, err
+	}
+
+	builder, err := s.newTxBuilder(fromAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.SetContractPayload(wire.TxTypeSmartContractCall, callData, gasLimit, gasPrice); err != nil {
+		return nil, err
+	}
+	if value > 0 {
+		if err := builder.AddOutput(record.Address, value, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.submitTransaction(builder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call contract: %v", err)
+	}
+
+	return map[string]interface{}{
+		"txid":      tx.TxHash().String(),
+		"action":    "call",
+		"contract":  record.Address,
+		"function":  functionName,
+		"caller":    fromAddress,
+		"value":     value,
+		"gas_limit": gasLimit,
+		"gas_price": gasPrice,
+	}, nil
+}
+
+// gettransactionreceipt returns the outcome of a mined contract transaction
+func (s *Server) gettransactionreceipt(params []interface{}) (interface{}, error) {
+	if len(params) < 1 {
+		return nil, fmt.Errorf("insufficient parameters: need txid")
+	}
+	txid, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid txid parameter")
+	}
+	txHash, err := wire.NewHashFromStr(txid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid txid: %v", err)
+	}
+
+	exec, err := s.chain.GetContractExecution(*txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := map[string]interface{}{
+		"txid":      exec.TxHash.String(),
+		"height":    exec.Height,
+		"contract":  exec.Contract,
+		"sender":    exec.Sender,
+		"function":  exec.Function,
+		"value":     exec.Value,
+		"status":    exec.Status.String(),
+		"gas_limit": exec.GasLimit,
+		"gas_used":  exec.GasUsed,
+		"result":    exec.Result.Interface(),
+		"logs":      logsJSON(exec.Logs),
+		"transfers": transfersJSON(exec.Transfers),
+	}
+	if len(exec.Payouts) > 0 {
+		payouts := make([]map[string]interface{}, 0, len(exec.Payouts))
+		for _, payout := range exec.Payouts {
+			payouts = append(payouts, map[string]interface{}{
+				"vout":   payout.Index,
+				"amount": float64(payout.Value) / 100000000,
+			})
+		}
+		receipt["payouts"] = payouts
+	}
+	if exec.Status != blockchain.ContractStatusSuccess {
+		receipt["result"] = nil
+		receipt["error"] = exec.Error
+	}
+	return receipt, nil
+}
+
+// getlogs returns the events emitted by mined contract transactions, filtered
+// by contract and topic. Empty filters match everything; the height range
+// defaults to the whole chain.
+func (s *Server) getlogs(params []interface{}) (interface{}, error) {
+	filter := &blockchain.LogFilter{}
+	if len(params) > 0 {
+		contract, ok := params[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid contract_address parameter")
+		}
+		filter.Contract = contract
+	}
+	if len(params) > 1 {
+		topic, ok := params[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid topic parameter")
+		}
+		filter.Topic = topic
+	}
+	if len(params) > 2 {
+		from, ok := params[2].(float64)
+		if !ok || from < 0 {
+			return nil, fmt.Errorf("invalid from_height parameter")
+		}
+		filter.FromHeight = int32(from)
+	}
+	if len(params) > 3 {
+		to, ok := params[3].(float64)
+		if !ok || to < 0 {
+			return nil, fmt.Errorf("invalid to_height parameter")
+		}
+		filter.ToHeight = int32(to)
+	}
+
+	logs, err := s.chain.FilterLogs(filter)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0, len(logs))
+	for _, log := range logs {
+		result = append(result, logJSON(log))
+	}
+	return result, nil
+}
+
+// transfersJSON formats the transfers of an execution for RPC responses.
+// OBS amounts are in OBS; token amounts in token units.
+func transfersJSON(transfers []smartcontract.Transfer) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(transfers))
+	for _, transfer := range transfers {
+		entry := map[string]interface{}{"to": transfer.To}
+		if transfer.Token == "" {
+			entry["amount"] = float64(transfer.Amount) / 100000000
+		} else {
+			entry["token"] = transfer.Token
+			entry["amount"] = transfer.Amount
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// logsJSON formats the logs of an execution for RPC responses
+func logsJSON(logs []blockchain.ContractLog) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(logs))
+	for i := range logs {
+		result = append(result, logJSON(&logs[i]))
+	}
+	return result
+}
+
+// logJSON formats a contract log for RPC responses
+func logJSON(log *blockchain.ContractLog) map[string]interface{} {
+	return map[string]interface{}{
+		"txid":     log.TxHash.String(),
+		"height":   log.Height,
+		"index":    log.Index,
+		"contract": log.Contract,
+		"topic":    log.Topic,
+		"data":     log.Data.Interface(),
+	}
+}
+
 // createHDWallet creates an HD wallet from BIP39 seed phrase
 func (s *Server) createHDWallet(params []interface{}) (interface{}, error) {
 	if len(params) < 1 {
@@ -1401,7 +2141,7 @@ func (s *Server) burnOBS(params []interface{}) (interface{}, error) {
 	}
 
 	// Create burn transaction (send to unspendable address)
-	burnAddress := "obsBURNXXXXXXXXXXXXXXXXXXXXXXXXXXXXX" // Provably unspendable
+	burnAddress := chaincfg.BurnAddress // Provably unspendable
 
 	tx := &wire.MsgTx{
 		Version:  1,
@@ -1469,3 +2209,87 @@ func (s *Server) getCirculatingSupply(params []interface{}) (interface{}, error)
 		"supply_percentage":           float64(circulatingSupply) / float64(maxSupply) * 100,
 	}, nil
 }
+
+// getShieldedSupply returns the per-block history of value entering and
+// leaving the shielded pool
+// Params: [from_height (optional), to_height (optional)]
+func (s *Server) getShieldedSupply(params []interface{}) (interface{}, error) {
+	fromHeight := int32(0)
+	toHeight := s.chain.Height()
+
+	if len(params) > 0 {
+		heightFloat, ok := params[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid from_height parameter")
+		}
+		fromHeight = int32(heightFloat)
+	}
+	if len(params) > 1 {
+		heightFloat, ok := params[1].(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid to_height parameter")
+		}
+		toHeight = int32(heightFloat)
+	}
+
+	pool := s.chain.ShieldedPool()
+	history := pool.GetSupplyHistory(fromHeight, toHeight)
+
+	blocks := make([]map[string]interface{}, 0, len(history))
+	for _, delta := range history {
+		blocks = append(blocks, map[string]interface{}{
+			"height":                  delta.Height,
+			"hash":                    delta.Hash.String(),
+			"shielded_satoshis":       delta.Shielded,
+			"unshielded_satoshis":     delta.Unshielded,
+			"net_satoshis":            delta.Net,
+			"total_shielded_satoshis": delta.TotalShielded,
+		})
+	}
+
+	totalShielded := pool.GetTotalShieldedValue()
+
+	return map[string]interface{}{
+		"height":                  s.chain.Height(),
+		"total_shielded_satoshis": totalShielded,
+		"total_shielded_obs":      float64(totalShielded) / 100000000,
+		"blocks":                  blocks,
+	}, nil
+}
+
+// verifyChain verifies chain consistency
+// Params: [mode (optional, "supply" to audit the monetary supply)]
+func (s *Server) verifyChain(params []interface{}) (interface{}, error) {
+	mode := "supply"
+	if len(params) > 0 {
+		modeStr, ok := params[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid mode parameter")
+		}
+		mode = strings.TrimPrefix(modeStr, "--")
+	}
+
+	switch mode {
+	case "supply":
+		audit, err := s.chain.VerifySupply()
+		if err != nil {
+			return nil, fmt.Errorf("supply audit failed: %v", err)
+		}
+
+		return map[string]interface{}{
+			"mode":                      mode,
+			"height":                    audit.Height,
+			"valid":                     audit.Valid,
+			"transparent_satoshis":      audit.TransparentValue,
+			"shielded_satoshis":         audit.ShieldedValue,
+			"shielded_history_satoshis": audit.ShieldedHistorySum,
+			"burned_satoshis":           audit.BurnedValue,
+			"total_satoshis":            audit.TotalValue,
+			"expected_max_satoshis":     audit.ExpectedMaxSupply,
+			"max_money_satoshis":        audit.MaxMoney,
+			"discrepancies":             audit.Discrepancies,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown verifychain mode: %s", mode)
+	}
+}
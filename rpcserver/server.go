@@ -1,13 +1,21 @@
 package rpcserver
 
 import (
+	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"obsidian-core/blockchain"
+	"obsidian-core/crypto"
 	"obsidian-core/mining"
+	"obsidian-core/network"
+	"obsidian-core/wire"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,20 +29,21 @@ type Wallet interface {
 	// Transparent operations
 	GetNewAddress() (string, error)
 	GetBalance(address string) (int64, error)
-	SendToAddress(from, to string, amount int64) (string, error)
 	ListAddresses() []string
+	GetPrivateKey(address string) (*ecdsa.PrivateKey, error)
 
 	// Shielded operations
 	NewShieldedAddress() (string, error)
 	ListShieldedAddresses() []string
 	GetShieldedBalance(address string) (int64, error)
-	SendShielded(from string, recipients []ShieldedRecipient) (string, error)
+	GetSpendingKey(address string) (*wire.ShieldedSpendingKey, error)
 	ListReceivedShielded(address string) ([]ShieldedTxInfo, error)
 	GetTransparentBalance() int64
 	GetTotalShieldedBalance() int64
 	ExportViewingKey(address string) (string, error)
 	ImportViewingKey(key string) error
-	ShieldCoinbase(toAddress string) (string, error)
+	StoreDisclosureKeys(txHash wire.Hash, keys *blockchain.PaymentDisclosureKeys) error
+	GetDisclosureKeys(txHash wire.Hash) (*blockchain.PaymentDisclosureKeys, error)
 
 	// Multisig operations
 	CreateMultiSigAddress(nRequired int, publicKeys []string) (*MultiSigInfo, error)
@@ -47,42 +56,200 @@ type Wallet interface {
 	GetMiningAddress() (string, error)
 }
 
-// SimpleWallet is a simple implementation of Wallet interface
+// DisclosureKeysFileName is the file under DATA_DIR holding the payment
+// disclosure keys of transactions sent by the wallet
+const DisclosureKeysFileName = "disclosure_keys.json"
+
+// SimpleWallet is a simple implementation of Wallet interface.
+// It keeps transparent and shielded keys in memory. Payment disclosure
+// keys are also written to DisclosureKeysFileName so they survive restarts.
 type SimpleWallet struct {
 	hdWallet      *HDWalletInfo
 	miningAddress string
+
+	mu           sync.RWMutex
+	keys         map[string]*ecdsa.PrivateKey         // transparent address -> key
+	spendingKeys map[string]*wire.ShieldedSpendingKey // z-address -> spending key
+
+	disclosureKeys map[wire.Hash]*blockchain.PaymentDisclosureKeys // txid -> disclosure keys
+	disclosurePath string
+}
+
+// NewSimpleWallet creates an empty in-memory wallet and loads the payment
+// disclosure keys saved by earlier runs
+func NewSimpleWallet() *SimpleWallet {
+	w := &SimpleWallet{
+		keys:         make(map[string]*ecdsa.PrivateKey),
+		spendingKeys: make(map[string]*wire.ShieldedSpendingKey),
+
+		disclosureKeys: make(map[wire.Hash]*blockchain.PaymentDisclosureKeys),
+		disclosurePath: disclosureKeysFilePath(),
+	}
+	if err := w.loadDisclosureKeys(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	return w
+}
+
+// disclosureKeysFilePath returns the disclosure keys file under DATA_DIR
+func disclosureKeysFilePath() string {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return filepath.Join(dataDir, DisclosureKeysFileName)
+}
+
+// loadDisclosureKeys reads the disclosure keys file. A missing file leaves
+// the wallet without disclosure keys.
+func (w *SimpleWallet) loadDisclosureKeys() error {
+	data, err := os.ReadFile(w.disclosurePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read disclosure keys file: %v", err)
+	}
+	var file map[string]*blockchain.PaymentDisclosureKeys
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid disclosure keys file: %v", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for txid, keys := range file {
+		txHash, err := wire.NewHashFromStr(txid)
+		if err != nil || keys == nil {
+			return fmt.Errorf("invalid disclosure keys for transaction %s", txid)
+		}
+		w.disclosureKeys[*txHash] = keys
+	}
+	return nil
+}
+
+// saveDisclosureKeys writes every disclosure key held by the wallet to its
+// file. The caller must hold w.mu.
+func (w *SimpleWallet) saveDisclosureKeys() error {
+	file := make(map[string]*blockchain.PaymentDisclosureKeys, len(w.disclosureKeys))
+	for txHash, keys := range w.disclosureKeys {
+		file[txHash.String()] = keys
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp := w.disclosurePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write disclosure keys file: %v", err)
+	}
+	return os.Rename(tmp, w.disclosurePath)
 }
 
 func (w *SimpleWallet) GetNewAddress() (string, error) {
-	return "Obs_demo_address_" + fmt.Sprintf("%d", 12345), nil
+	privateKey, publicKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return "", err
+	}
+	address := crypto.KeyToAddress(publicKey)
+
+	w.mu.Lock()
+	w.keys[address] = privateKey
+	w.mu.Unlock()
+
+	return address, nil
 }
 
 func (w *SimpleWallet) GetBalance(address string) (int64, error) {
 	return 0, nil
 }
 
-func (w *SimpleWallet) SendToAddress(from, to string, amount int64) (string, error) {
-	return "demo_txid_" + from + "_to_" + to, nil
+func (w *SimpleWallet) ListAddresses() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	addresses := make([]string, 0, len(w.keys))
+	for address := range w.keys {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
 }
 
-func (w *SimpleWallet) ListAddresses() []string {
-	return []string{}
+// GetPrivateKey returns the key of a transparent address held by the wallet
+func (w *SimpleWallet) GetPrivateKey(address string) (*ecdsa.PrivateKey, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	key, ok := w.keys[address]
+	if !ok {
+		return nil, fmt.Errorf("address %s not found in wallet", address)
+	}
+	return key, nil
 }
 
 func (w *SimpleWallet) NewShieldedAddress() (string, error) {
-	return "zobs_demo_address_" + fmt.Sprintf("%d", 12345), nil
+	key, err := wire.GenerateShieldedSpendingKey()
+	if err != nil {
+		return "", err
+	}
+	address := key.Address().String()
+
+	w.mu.Lock()
+	w.spendingKeys[address] = key
+	w.mu.Unlock()
+
+	return address, nil
 }
 
 func (w *SimpleWallet) ListShieldedAddresses() []string {
-	return []string{}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	addresses := make([]string, 0, len(w.spendingKeys))
+	for address := range w.spendingKeys {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
 }
 
 func (w *SimpleWallet) GetShieldedBalance(address string) (int64, error) {
 	return 0, nil
 }
 
-func (w *SimpleWallet) SendShielded(from string, recipients []ShieldedRecipient) (string, error) {
-	return "demo_txid_" + from, nil
+// GetSpendingKey returns the spending key of a z-address held by the wallet
+func (w *SimpleWallet) GetSpendingKey(address string) (*wire.ShieldedSpendingKey, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	key, ok := w.spendingKeys[address]
+	if !ok {
+		return nil, fmt.Errorf("z-address %s not found in wallet", address)
+	}
+	return key, nil
+}
+
+// StoreDisclosureKeys remembers the payment disclosure keys of a sent
+// transaction and saves them to the disclosure keys file
+func (w *SimpleWallet) StoreDisclosureKeys(txHash wire.Hash, keys *blockchain.PaymentDisclosureKeys) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.disclosureKeys[txHash] = keys
+	return w.saveDisclosureKeys()
+}
+
+// GetDisclosureKeys returns the payment disclosure keys of a transaction
+// sent by the wallet
+func (w *SimpleWallet) GetDisclosureKeys(txHash wire.Hash) (*blockchain.PaymentDisclosureKeys, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	keys, ok := w.disclosureKeys[txHash]
+	if !ok {
+		return nil, fmt.Errorf("no payment disclosure keys for transaction %s", txHash)
+	}
+	return keys, nil
 }
 
 func (w *SimpleWallet) ListReceivedShielded(address string) ([]ShieldedTxInfo, error) {
@@ -105,10 +272,6 @@ func (w *SimpleWallet) ImportViewingKey(key string) error {
 	return nil
 }
 
-func (w *SimpleWallet) ShieldCoinbase(toAddress string) (string, error) {
-	return "demo_shield_txid", nil
-}
-
 func (w *SimpleWallet) CreateMultiSigAddress(nRequired int, publicKeys []string) (*MultiSigInfo, error) {
 	// Demo implementation
 	redeemScript := fmt.Sprintf("multisig_%d_of_%d", nRequired, len(publicKeys))
@@ -221,8 +384,8 @@ func NewServer(chain *blockchain.BlockChain, miner *mining.CPUMiner, syncManager
 	return &Server{
 		chain:         chain,
 		miner:         miner,
-		pool:          nil,             // Pool is optional
-		wallet:        &SimpleWallet{}, // Use simple wallet for now
+		pool:          nil,               // Pool is optional
+		wallet:        NewSimpleWallet(), // Use simple wallet for now
 		syncManager:   syncManager,
 		addr:          addr,
 		requestCounts: make(map[string]int),
@@ -278,7 +441,18 @@ func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	jsonStr := `{"peers":` + strconv.Itoa(peerCount) + `,"height":` + strconv.Itoa(int(s.chain.Height())) + `}`
+	jsonStr := `{"peers":` + strconv.Itoa(peerCount) + `,"height":` + strconv.Itoa(int(s.chain.Height()))
+
+	// Compact block reconstruction, which dominates block propagation time
+	if sm, ok := s.syncManager.(interface {
+		CompactBlockStats() network.CompactBlockStats
+	}); ok {
+		stats := sm.CompactBlockStats()
+		jsonStr += `,"compactblocks":` + strconv.FormatUint(stats.Received, 10) +
+			`,"compactblockhitrate":` + strconv.FormatFloat(stats.HitRate, 'f', 4, 64) +
+			`,"compactblockfallbacks":` + strconv.FormatUint(stats.Fallbacks, 10)
+	}
+	jsonStr += `}`
 	w.Write([]byte(jsonStr))
 }
 
@@ -361,6 +535,8 @@ func (s *Server) handleMethod(req *JSONRPCRequest) (interface{}, error) {
 		return s.getBestBlockHash(req.Params)
 	case "getblock":
 		return s.getBlock(req.Params)
+	case "getblockfilter":
+		return s.getBlockFilter(req.Params)
 	case "getblockchaininfo":
 		return s.getBlockchainInfo(req.Params)
 	case "getmininginfo":
@@ -409,6 +585,10 @@ func (s *Server) handleMethod(req *JSONRPCRequest) (interface{}, error) {
 		return s.z_importviewingkey(req.Params)
 	case "z_shieldcoinbase":
 		return s.z_shieldcoinbase(req.Params)
+	case "z_getpaymentdisclosure":
+		return s.z_getpaymentdisclosure(req.Params)
+	case "z_validatepaymentdisclosure":
+		return s.z_validatepaymentdisclosure(req.Params)
 	case "shield":
 		return s.shield(req.Params)
 	case "unshield":
@@ -417,6 +597,20 @@ func (s *Server) handleMethod(req *JSONRPCRequest) (interface{}, error) {
 		return s.deploycontract(req.Params)
 	case "callcontract":
 		return s.callcontract(req.Params)
+	case "simulatecontract":
+		return s.simulatecontract(req.Params)
+	case "estimategas":
+		return s.estimategas(req.Params)
+	case "invokecontract":
+		return s.invokecontract(req.Params)
+	case "gettransactionreceipt":
+		return s.gettransactionreceipt(req.Params)
+	case "getlogs":
+		return s.getlogs(req.Params)
+	case "getcontractinfo":
+		return s.getcontractinfo(req.Params)
+	case "getcontractcode":
+		return s.getcontractcode(req.Params)
 
 	// Mining Pool
 	case "getpoolinfo":
@@ -455,6 +649,14 @@ func (s *Server) handleMethod(req *JSONRPCRequest) (interface{}, error) {
 		return s.getTotalBurned(req.Params)
 	case "getcirculatingsupply":
 		return s.getCirculatingSupply(req.Params)
+	case "getshieldedsupply":
+		return s.getShieldedSupply(req.Params)
+	case "verifychain":
+		return s.verifyChain(req.Params)
+
+	// Network methods
+	case "getcompactblockinfo":
+		return s.getCompactBlockInfo(req.Params)
 
 	default:
 		return nil, fmt.Errorf("method not found: %s", req.Method)
@@ -38,12 +38,15 @@ type BlockInfo struct {
 
 // BlockchainInfo represents blockchain information.
 type BlockchainInfo struct {
-	Chain         string `json:"chain"`
-	Blocks        int32  `json:"blocks"`
-	BestBlockHash string `json:"bestblockhash"`
-	Difficulty    uint32 `json:"difficulty"`
-	MaxMoney      int64  `json:"maxmoney"`
-	InitialSupply int64  `json:"initialsupply"`
+	Chain                string  `json:"chain"`
+	Blocks               int32   `json:"blocks"`
+	Headers              int32   `json:"headers"`
+	BestBlockHash        string  `json:"bestblockhash"`
+	Difficulty           uint32  `json:"difficulty"`
+	VerificationProgress float64 `json:"verificationprogress"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
+	MaxMoney             int64   `json:"maxmoney"`
+	InitialSupply        int64   `json:"initialsupply"`
 }
 
 // MiningInfo represents mining information.
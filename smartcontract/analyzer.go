@@ -0,0 +1,780 @@
+// Static analysis of OCL programs, run between parsing and compilation:
+// name resolution, type inference, arity checks and control flow warnings
+package smartcontract
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity is how serious a diagnostic is
+type Severity int
+
+const (
+	// SeverityError marks a program that would fail to compile or fail
+	// at runtime whenever the code runs
+	SeverityError Severity = iota
+
+	// SeverityWarning marks code that is likely a mistake
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found in a program
+type Diagnostic struct {
+	Pos      Pos
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Message)
+}
+
+// AnalysisError reports the error diagnostics of a program
+type AnalysisError struct {
+	Errors []Diagnostic
+}
+
+func (e *AnalysisError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, d := range e.Errors {
+		messages[i] = fmt.Sprintf("%s: %s", d.Pos, d.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Check analyzes program and returns its diagnostics, with an
+// *AnalysisError if any of them are errors
+func Check(program *Program) ([]Diagnostic, error) {
+	diagnostics := Analyze(program)
+	var errors []Diagnostic
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			errors = append(errors, d)
+		}
+	}
+	if len(errors) > 0 {
+		return diagnostics, &AnalysisError{Errors: errors}
+	}
+	return diagnostics, nil
+}
+
+// Analyze checks program without running it and returns its diagnostics
+// ordered by position.
+//
+// Variables are resolved per function, without regard to statement order:
+// a name is defined if the function assigns it anywhere, or if top-level
+// code does. Types are only checked where they are known; storage reads,
+// parameters and call results may hold anything.
+func Analyze(program *Program) []Diagnostic {
+	a := &analyzer{functions: make(map[string]*FunctionDecl)}
+	top := topLevel(program.Statements)
+
+	inspect(program, func(node Node) bool {
+		fn, ok := node.(*FunctionDecl)
+		if !ok {
+			return true
+		}
+		if _, exists := a.functions[fn.Name]; exists {
+			a.errorf(fn.Pos, "function %s redeclared", fn.Name)
+		} else {
+			a.functions[fn.Name] = fn
+		}
+		return true
+	})
+
+	globals := a.newScope(top, nil, nil)
+	a.block(top, globals)
+
+	for _, fn := range a.functionList() {
+		seen := make(map[string]bool)
+		for _, param := range fn.Parameters {
+			if seen[param] {
+				a.errorf(fn.Pos, "duplicate parameter %s in %s()", param, fn.Name)
+			}
+			seen[param] = true
+		}
+		a.block(fn.Body, a.newScope(fn.Body, params(fn), globals))
+	}
+
+	sort.SliceStable(a.diagnostics, func(i, j int) bool {
+		pi, pj := a.diagnostics[i].Pos, a.diagnostics[j].Pos
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Column < pj.Column
+	})
+	return a.diagnostics
+}
+
+type analyzer struct {
+	functions   map[string]*FunctionDecl
+	diagnostics []Diagnostic
+	quiet       bool // Set while inferring types, which reports nothing
+}
+
+func (a *analyzer) errorf(pos Pos, format string, args ...interface{}) {
+	if !a.quiet {
+		a.diagnostics = append(a.diagnostics, Diagnostic{Pos: pos, Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (a *analyzer) warnf(pos Pos, format string, args ...interface{}) {
+	if !a.quiet {
+		a.diagnostics = append(a.diagnostics, Diagnostic{Pos: pos, Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// functionList returns the declared functions in source order
+func (a *analyzer) functionList() []*FunctionDecl {
+	list := make([]*FunctionDecl, 0, len(a.functions))
+	for _, fn := range a.functions {
+		list = append(list, fn)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		pi, pj := list[i].Pos, list[j].Pos
+		return pi.Line < pj.Line || (pi.Line == pj.Line && pi.Column < pj.Column)
+	})
+	return list
+}
+
+// params returns the parameters a function is called with, without self
+func params(fn *FunctionDecl) []string {
+	if len(fn.Parameters) > 0 && fn.Parameters[0] == "self" {
+		return fn.Parameters[1:]
+	}
+	return fn.Parameters
+}
+
+// topLevel returns the statements run by the constructor. Contract bodies
+// run as top-level code.
+func topLevel(statements []Node) []Node {
+	var top []Node
+	for _, stmt := range statements {
+		if contract, ok := stmt.(*ContractDecl); ok {
+			top = append(top, topLevel(contract.Statements)...)
+		} else {
+			top = append(top, stmt)
+		}
+	}
+	return top
+}
+
+// staticType is the type of an expression, if it is known before execution
+type staticType struct {
+	known bool
+	vt    ValueType
+}
+
+var anyType = staticType{}
+
+func typeOf(vt ValueType) staticType {
+	return staticType{known: true, vt: vt}
+}
+
+// is reports whether the type is known to be vt
+func (t staticType) is(vt ValueType) bool {
+	return t.known && t.vt == vt
+}
+
+// isNot reports whether the type is known to be none of vts
+func (t staticType) isNot(vts ...ValueType) bool {
+	if !t.known {
+		return false
+	}
+	for _, vt := range vts {
+		if t.vt == vt {
+			return false
+		}
+	}
+	return true
+}
+
+func (t staticType) String() string {
+	if !t.known {
+		return "any"
+	}
+	return t.vt.String()
+}
+
+// scope holds the variables of top-level code or of one function call
+type scope struct {
+	vars   map[string]staticType
+	parent *scope // Globals, for functions
+}
+
+// lookup returns the type of a variable. A function local may instead be
+// read as the global of the same name until it is assigned.
+func (s *scope) lookup(name string) (staticType, bool) {
+	t, ok := s.vars[name]
+	if s.parent != nil {
+		if global, isGlobal := s.parent.vars[name]; isGlobal {
+			if ok && t != global {
+				return anyType, true
+			}
+			return global, true
+		}
+	}
+	return t, ok
+}
+
+// newScope returns the scope of body, inferring the type of each variable
+// from every assignment to it
+func (a *analyzer) newScope(body []Node, params []string, parent *scope) *scope {
+	s := &scope{vars: make(map[string]staticType), parent: parent}
+	for _, param := range params {
+		s.vars[param] = anyType
+	}
+
+	type assignment struct {
+		name  string
+		value Node
+	}
+	var assignments []assignment
+	for _, stmt := range body {
+		inspect(stmt, func(node Node) bool {
+			switch n := node.(type) {
+			case *FunctionDecl:
+				return false
+			case *ForStmt:
+				s.vars[n.Variable] = typeOf(ValueInt)
+			case *AssignStmt:
+				if ident, ok := n.Target.(*Identifier); ok {
+					assignments = append(assignments, assignment{ident.Name, n.Value})
+				}
+			}
+			return true
+		})
+	}
+
+	// Types only widen to any, so this settles within a few passes. A
+	// variable read before any of its assignments is typed reads as any.
+	a.quiet = true
+	defer func() { a.quiet = false }()
+	for changed := true; changed; {
+		changed = false
+		for _, assign := range assignments {
+			t := a.expr(assign.value, s)
+			if old, ok := s.vars[assign.name]; !ok {
+				s.vars[assign.name] = t
+				changed = true
+			} else if old != t && old != anyType {
+				s.vars[assign.name] = anyType
+				changed = true
+			}
+		}
+	}
+	for _, assign := range assignments {
+		if _, ok := s.vars[assign.name]; !ok {
+			s.vars[assign.name] = anyType
+		}
+	}
+	return s
+}
+
+// block checks a list of statements and warns about the first statement
+// that cannot be reached
+func (a *analyzer) block(body []Node, s *scope) {
+	terminated, reported := false, false
+	for _, stmt := range body {
+		if _, ok := stmt.(*FunctionDecl); ok {
+			// Declarations are hoisted, wherever they appear
+			continue
+		}
+		if terminated && !reported {
+			a.warnf(stmt.Position(), "unreachable code")
+			reported = true
+		}
+		a.stmt(stmt, s)
+		if terminates(stmt) {
+			terminated = true
+		}
+	}
+}
+
+// terminates reports whether control never continues past stmt
+func terminates(stmt Node) bool {
+	switch n := stmt.(type) {
+	case *ReturnStmt:
+		return true
+	case *IfStmt:
+		return len(n.ElseBody) > 0 && blockTerminates(n.ThenBody) && blockTerminates(n.ElseBody)
+	case *WhileStmt:
+		// There is no break, so only a return leaves while True
+		return isTrue(n.Condition)
+	default:
+		return false
+	}
+}
+
+func blockTerminates(body []Node) bool {
+	for _, stmt := range body {
+		if terminates(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrue reports whether node is the literal True
+func isTrue(node Node) bool {
+	b, ok := node.(*BoolLiteral)
+	return ok && b.Value
+}
+
+func (a *analyzer) stmt(node Node, s *scope) {
+	switch n := node.(type) {
+	case *ContractDecl:
+		a.block(n.Statements, s)
+	case *IfStmt:
+		a.condition(n.Condition, s)
+		a.block(n.ThenBody, s)
+		a.block(n.ElseBody, s)
+	case *WhileStmt:
+		a.condition(n.Condition, s)
+		a.loop(n)
+		a.block(n.Body, s)
+	case *ForStmt:
+		a.forRange(n, s)
+		a.block(n.Body, s)
+	case *AssignStmt:
+		a.expr(n.Value, s)
+		a.assignTarget(n, s)
+	case *ReturnStmt:
+		if n.Value != nil {
+			a.expr(n.Value, s)
+		}
+	case *ExprStmt:
+		a.expr(n.Expression, s)
+	}
+}
+
+// condition checks the condition of an if or while statement
+func (a *analyzer) condition(node Node, s *scope) {
+	if t := a.expr(node, s); t.isNot(ValueBool) {
+		a.warnf(node.Position(), "condition has type %s and is never true; only True is truthy", t)
+	}
+}
+
+// loop warns about while loops that can only end by running out of gas
+func (a *analyzer) loop(n *WhileStmt) {
+	if containsReturn(n.Body) {
+		return
+	}
+	if isTrue(n.Condition) {
+		a.warnf(n.Pos, "while True loop without return runs until it is out of gas")
+		return
+	}
+
+	// The condition can change if the body assigns one of its variables,
+	// or writes storage it reads. Calls are assumed to change anything.
+	names, readsStorage, calls := conditionInputs(n.Condition)
+	if calls {
+		return
+	}
+	writesStorage := false
+	for _, stmt := range n.Body {
+		stop := false
+		inspect(stmt, func(node Node) bool {
+			switch node := node.(type) {
+			case *FunctionDecl:
+				return false
+			case *CallExpr:
+				writesStorage = true
+			case *ForStmt:
+				stop = stop || names[node.Variable]
+			case *AssignStmt:
+				if root, ok := assignedVariable(node.Target); ok {
+					stop = stop || names[root]
+				} else {
+					writesStorage = true
+				}
+			}
+			return true
+		})
+		if stop {
+			return
+		}
+	}
+	if readsStorage && writesStorage {
+		return
+	}
+	a.warnf(n.Pos, "loop condition %s is not changed by the loop body", n.Condition)
+}
+
+// conditionInputs returns the variables a condition reads, and whether it
+// reads storage or calls a function
+func conditionInputs(cond Node) (names map[string]bool, readsStorage, calls bool) {
+	names = make(map[string]bool)
+	inspect(cond, func(node Node) bool {
+		switch n := node.(type) {
+		case *CallExpr:
+			calls = true
+		case *AttributeExpr:
+			if isSelf(n.Object) {
+				readsStorage = true
+			}
+			// msg and block fields do not change during a call
+			return false
+		case *Identifier:
+			names[n.Name] = true
+		}
+		return true
+	})
+	return names, readsStorage, calls
+}
+
+// assignedVariable returns the variable an assignment target modifies, if
+// it is not storage
+func assignedVariable(target Node) (string, bool) {
+	switch t := target.(type) {
+	case *Identifier:
+		return t.Name, true
+	case *IndexExpr:
+		if isSelf(t.Object) {
+			return "", false
+		}
+		return assignedVariable(t.Object)
+	default:
+		return "", false
+	}
+}
+
+func containsReturn(body []Node) bool {
+	found := false
+	for _, stmt := range body {
+		inspect(stmt, func(node Node) bool {
+			switch node.(type) {
+			case *FunctionDecl:
+				return false
+			case *ReturnStmt:
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// forRange checks a for loop, which must iterate over range()
+func (a *analyzer) forRange(n *ForStmt, s *scope) {
+	call, ok := n.Iterable.(*CallExpr)
+	if ok {
+		fn, isIdent := call.Function.(*Identifier)
+		ok = isIdent && fn.Name == "range"
+	}
+	if !ok {
+		a.errorf(n.Iterable.Position(), "for loops only support range(), got %s", n.Iterable)
+		a.expr(n.Iterable, s)
+		return
+	}
+
+	if len(call.Arguments) < 1 || len(call.Arguments) > 3 {
+		a.errorf(call.Pos, "range() takes 1 to 3 arguments, got %d", len(call.Arguments))
+	}
+	if len(call.Arguments) == 3 {
+		if step, ok := constantInt(call.Arguments[2]); !ok || step == 0 {
+			a.errorf(call.Arguments[2].Position(), "range() step must be a non-zero integer constant")
+		}
+	}
+	for _, arg := range call.Arguments {
+		if t := a.expr(arg, s); t.isNot(ValueInt) {
+			a.errorf(arg.Position(), "range() arguments must be int, got %s", t)
+		}
+	}
+}
+
+// assignTarget checks the target of an assignment
+func (a *analyzer) assignTarget(n *AssignStmt, s *scope) {
+	switch target := n.Target.(type) {
+	case *Identifier:
+		if target.Name == "self" {
+			a.errorf(target.Pos, "cannot assign to self")
+		}
+	case *AttributeExpr:
+		if !isSelf(target.Object) {
+			a.errorf(target.Pos, "cannot assign to %s: attributes are only supported on self", target)
+		}
+	case *IndexExpr:
+		if _, ok := storageMap(target.Object); ok {
+			a.expr(target.Index, s)
+			return
+		}
+		if readsStorage(target.Object) {
+			a.errorf(target.Pos, "cannot assign to %s: values read from storage are copies", target)
+			return
+		}
+		container := a.expr(target.Object, s)
+		a.expr(target.Index, s)
+		if container.isNot(ValueList, ValueDict) {
+			a.errorf(target.Pos, "%s does not support item assignment", container)
+		}
+	default:
+		a.errorf(n.Target.Position(), "cannot assign to %s", n.Target)
+	}
+}
+
+// expr checks an expression and returns its type
+func (a *analyzer) expr(node Node, s *scope) staticType {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		return typeOf(ValueInt)
+	case *StringLiteral:
+		return typeOf(ValueStr)
+	case *BoolLiteral:
+		return typeOf(ValueBool)
+	case *NoneLiteral:
+		return typeOf(ValueNone)
+	case *ListLiteral:
+		for _, elem := range n.Elements {
+			a.expr(elem, s)
+		}
+		return typeOf(ValueList)
+	case *DictLiteral:
+		for i := range n.Keys {
+			if t := a.expr(n.Keys[i], s); t.isNot(ValueInt, ValueStr) {
+				a.errorf(n.Keys[i].Position(), "dict keys must be int or str, got %s", t)
+			}
+			a.expr(n.Values[i], s)
+		}
+		return typeOf(ValueDict)
+	case *Identifier:
+		if n.Name == "self" {
+			return anyType
+		}
+		t, ok := s.lookup(n.Name)
+		if !ok {
+			if _, isFunction := a.functions[n.Name]; isFunction {
+				a.errorf(n.Pos, "function %s used as a value; call it as %s()", n.Name, n.Name)
+			} else {
+				a.errorf(n.Pos, "undefined variable: %s", n.Name)
+			}
+			return anyType
+		}
+		return t
+	case *BinaryExpr:
+		return a.binary(n, s)
+	case *UnaryExpr:
+		t := a.expr(n.Right, s)
+		if n.Op == "not" {
+			return typeOf(ValueBool)
+		}
+		if t.isNot(ValueInt) {
+			a.errorf(n.Pos, "invalid operand for unary -: %s", t)
+		}
+		return typeOf(ValueInt)
+	case *CallExpr:
+		return a.call(n, s)
+	case *AttributeExpr:
+		if name, ok := envField(n); ok {
+			if !IsEnvField(name) {
+				a.errorf(n.Pos, "unknown environment field %s", name)
+				return anyType
+			}
+			if name == "msg.sender" {
+				return typeOf(ValueStr)
+			}
+			return typeOf(ValueInt)
+		}
+		if !isSelf(n.Object) {
+			a.errorf(n.Pos, "cannot access %s: attributes are only supported on self", n)
+			a.expr(n.Object, s)
+		}
+		return anyType
+	case *IndexExpr:
+		if _, ok := storageMap(n.Object); ok {
+			a.expr(n.Index, s)
+			return anyType
+		}
+		container := a.expr(n.Object, s)
+		index := a.expr(n.Index, s)
+		switch {
+		case container.isNot(ValueList, ValueDict, ValueStr):
+			a.errorf(n.Pos, "%s is not subscriptable", container)
+		case (container.is(ValueList) || container.is(ValueStr)) && index.isNot(ValueInt):
+			a.errorf(n.Index.Position(), "%s indices must be int, got %s", container, index)
+		case container.is(ValueDict) && index.isNot(ValueInt, ValueStr):
+			a.errorf(n.Index.Position(), "dict keys must be int or str, got %s", index)
+		}
+		if container.is(ValueStr) {
+			return typeOf(ValueStr)
+		}
+		return anyType
+	default:
+		return anyType
+	}
+}
+
+// binary checks a binary expression, whose operands are evaluated
+// left to right
+func (a *analyzer) binary(n *BinaryExpr, s *scope) staticType {
+	left := a.expr(n.Left, s)
+	right := a.expr(n.Right, s)
+
+	switch n.Op {
+	case "and", "or", "==", "!=":
+		return typeOf(ValueBool)
+	case "<", ">", "<=", ">=":
+		if left.isNot(ValueInt) || right.isNot(ValueInt) {
+			a.errorf(n.Pos, "invalid operands for %s: %s and %s", n.Op, left, right)
+		}
+		return typeOf(ValueBool)
+	case "+":
+		// int + int or str + str
+		switch {
+		case left.isNot(ValueInt, ValueStr) || right.isNot(ValueInt, ValueStr),
+			left.known && right.known && left != right:
+			a.errorf(n.Pos, "invalid operands for +: %s and %s", left, right)
+			return anyType
+		case left.known:
+			return left
+		default:
+			return right
+		}
+	default:
+		if left.isNot(ValueInt) || right.isNot(ValueInt) {
+			a.errorf(n.Pos, "invalid operands for %s: %s and %s", n.Op, left, right)
+		}
+		if divisor, ok := constantInt(n.Right); ok && divisor == 0 && (n.Op == "/" || n.Op == "%") {
+			a.errorf(n.Pos, "%s by zero", map[string]string{"/": "division", "%": "modulo"}[n.Op])
+		}
+		return typeOf(ValueInt)
+	}
+}
+
+// call checks a call to a builtin or to a contract function
+func (a *analyzer) call(n *CallExpr, s *scope) staticType {
+	args := make([]staticType, len(n.Arguments))
+	for i, arg := range n.Arguments {
+		args[i] = a.expr(arg, s)
+	}
+	arity := func(name string, min, max int) bool {
+		if len(args) >= min && len(args) <= max {
+			return true
+		}
+		if min == max {
+			a.errorf(n.Pos, "%s() takes %d arguments, got %d", name, min, len(args))
+		} else {
+			a.errorf(n.Pos, "%s() takes %d or %d arguments, got %d", name, min, max, len(args))
+		}
+		return false
+	}
+	argType := func(i int, what string, vts ...ValueType) {
+		if i < len(args) && args[i].isNot(vts...) {
+			a.errorf(n.Arguments[i].Position(), "%s must be %s, got %s", what, vts[0], args[i])
+		}
+	}
+
+	var name string
+	switch fn := n.Function.(type) {
+	case *Identifier:
+		switch fn.Name {
+		case "len":
+			if arity("len", 1, 1) && args[0].isNot(ValueList, ValueDict, ValueStr) {
+				a.errorf(n.Arguments[0].Position(), "%s has no len()", args[0])
+			}
+			return typeOf(ValueInt)
+		case "range":
+			a.errorf(n.Pos, "range() is only supported in for loops")
+			return anyType
+		case "emit":
+			arity("emit", 1, 2)
+			argType(0, "emit() topic", ValueStr)
+			return typeOf(ValueNone)
+		case "balance_of":
+			// balance_of(self) is the contract's own balance
+			arity("balance_of", 1, 2)
+			if len(args) > 0 && !isSelf(n.Arguments[0]) {
+				argType(0, "balance_of() address", ValueStr)
+			}
+			argType(1, "token ID", ValueStr)
+			return typeOf(ValueInt)
+		case "transfer":
+			arity("transfer", 2, 2)
+			argType(0, "transfer recipient", ValueStr)
+			argType(1, "transfer amount", ValueInt)
+			return typeOf(ValueNone)
+		case "token_transfer":
+			arity("token_transfer", 3, 3)
+			argType(0, "token ID", ValueStr)
+			argType(1, "transfer recipient", ValueStr)
+			argType(2, "transfer amount", ValueInt)
+			return typeOf(ValueNone)
+		}
+		name = fn.Name
+	case *AttributeExpr:
+		if isSelf(fn.Object) {
+			name = fn.Attribute
+		}
+	}
+	if name == "" {
+		a.errorf(n.Pos, "cannot call %s", n.Function)
+		return anyType
+	}
+
+	decl, ok := a.functions[name]
+	if !ok {
+		a.errorf(n.Pos, "undefined function: %s", name)
+		return anyType
+	}
+	if want := len(params(decl)); want != len(args) {
+		a.errorf(n.Pos, "%s() takes %d arguments, got %d", name, want, len(args))
+	}
+	return anyType
+}
+
+// inspect calls f for node and, while f returns true, for its descendants
+// in source order
+func inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	var children []Node
+	switch n := node.(type) {
+	case *Program:
+		children = n.Statements
+	case *ContractDecl:
+		children = n.Statements
+	case *FunctionDecl:
+		children = n.Body
+	case *IfStmt:
+		children = append(append([]Node{n.Condition}, n.ThenBody...), n.ElseBody...)
+	case *WhileStmt:
+		children = append([]Node{n.Condition}, n.Body...)
+	case *ForStmt:
+		children = append([]Node{n.Iterable}, n.Body...)
+	case *AssignStmt:
+		children = []Node{n.Target, n.Value}
+	case *ReturnStmt:
+		children = []Node{n.Value}
+	case *ExprStmt:
+		children = []Node{n.Expression}
+	case *BinaryExpr:
+		children = []Node{n.Left, n.Right}
+	case *UnaryExpr:
+		children = []Node{n.Right}
+	case *CallExpr:
+		children = append([]Node{n.Function}, n.Arguments...)
+	case *AttributeExpr:
+		children = []Node{n.Object}
+	case *IndexExpr:
+		children = []Node{n.Object, n.Index}
+	case *ListLiteral:
+		children = n.Elements
+	case *DictLiteral:
+		for i := range n.Keys {
+			children = append(children, n.Keys[i], n.Values[i])
+		}
+	}
+	for _, child := range children {
+		inspect(child, f)
+	}
+}
@@ -0,0 +1,133 @@
+package smartcontract
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func analyzeSource(t *testing.T, source string) []Diagnostic {
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer error: %v", err)
+	}
+	ast, err := NewParser(tokens).Parse()
+	if err != nil {
+		t.Fatalf("Parser error: %v", err)
+	}
+	return Analyze(ast)
+}
+
+func TestAnalyzeCleanContract(t *testing.T) {
+	source := `self.owner = msg.sender
+limit = 10
+
+def deposit(self, note):
+    if self.balances[msg.sender] == None:
+        self.balances[msg.sender] = 0
+    self.balances[msg.sender] = self.balances[msg.sender] + msg.value
+    emit("Deposit", {"from": msg.sender, "note": note})
+    return total(msg.sender)
+
+def total(who):
+    return self.balances[who]
+
+def sum(n):
+    acc = 0
+    for i in range(n):
+        acc = acc + i
+    while acc > limit:
+        acc = acc - limit
+    items = [1, 2]
+    items[0] = acc
+    return items[0] + len("ab")
+
+def withdraw(to, amount):
+    if balance_of(self) < amount:
+        return False
+    transfer(to, amount)
+    return True
+`
+	for _, d := range analyzeSource(t, source) {
+		t.Errorf("Unexpected diagnostic %s", d)
+	}
+}
+
+func TestAnalyzeDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"undefined variable", "def f():\n    return y + 1\n", "2:12: error: undefined variable: y"},
+		{"undefined function", "def f():\n    return g()\n", "2:12: error: undefined function: g"},
+		{"arity", "def f(self, a):\n    return a\n\ndef g():\n    return self.f(1, 2)\n", "5:12: error: f() takes 1 arguments, got 2"},
+		{"builtin arity", "x = len()\n", "1:5: error: len() takes 1 arguments, got 0"},
+		{"redeclared", "def f():\n    pass\n\ndef f():\n    pass\n", "4:1: error: function f redeclared"},
+		{"duplicate parameter", "def f(a, a):\n    pass\n", "1:1: error: duplicate parameter a in f()"},
+		{"add mismatch", "x = 1\ny = \"a\"\nz = x + y\n", "3:7: error: invalid operands for +: int and str"},
+		{"compare str", "x = \"a\" < 1\n", "1:9: error: invalid operands for <: str and int"},
+		{"unary minus", "x = -\"a\"\n", "1:5: error: invalid operand for unary -: str"},
+		{"division by zero", "def f(a):\n    return a / 0\n", "2:14: error: division by zero"},
+		{"len of int", "x = len(5)\n", "1:9: error: int has no len()"},
+		{"index int", "x = 5\ny = x[0]\n", "2:5: error: int is not subscriptable"},
+		{"emit topic", "emit(1)\n", "1:6: error: emit() topic must be str, got int"},
+		{"transfer amount", "def pay(to):\n    transfer(to, \"all\")\n", "2:18: error: transfer amount must be int, got str"},
+		{"env field", "x = msg.origin\n", "1:5: error: unknown environment field msg.origin"},
+		{"attribute", "x = [1]\ny = x.length\n", "2:5: error: cannot access x.length: attributes are only supported on self"},
+		{"storage copy", "self.items[0][1] = 2\n", "1:1: error: cannot assign to self.items[0][1]: values read from storage are copies"},
+		{"for range", "for i in [1, 2]:\n    pass\n", "1:10: error: for loops only support range()"},
+		{"range step", "for i in range(0, 10, 0):\n    pass\n", "1:23: error: range() step must be a non-zero integer constant"},
+		{"range outside for", "x = range(3)\n", "1:5: error: range() is only supported in for loops"},
+		{"function as value", "def f():\n    pass\n\nx = f\n", "4:5: error: function f used as a value; call it as f()"},
+		{"inconsistent type", "def f(a):\n    x = 1\n    if a:\n        x = \"s\"\n    return x + 1\n", ""},
+		{"unreachable after return", "def f():\n    return 1\n    x = 2\n", "3:5: warning: unreachable code"},
+		{"unreachable after if", "def f(a):\n    if a:\n        return 1\n    else:\n        return 2\n    return 3\n", "6:5: warning: unreachable code"},
+		{"int condition", "x = 1\nif x:\n    pass\n", "2:4: warning: condition has type int and is never true; only True is truthy"},
+		{"while true", "while True:\n    x = 1\n", "1:1: warning: while True loop without return runs until it is out of gas"},
+		{"condition changed in body", "def f(n):\n    i = 0\n    while i < n:\n        n = n\n        self.x = i\n", ""},
+		{"constant loop", "def f(n):\n    i = 0\n    total = 0\n    while i < n:\n        total = total + 1\n", "4:5: warning: loop condition (i < n) is not changed by the loop body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics := analyzeSource(t, tt.source)
+			if tt.want == "" {
+				for _, d := range diagnostics {
+					t.Errorf("Unexpected diagnostic %s", d)
+				}
+				return
+			}
+			found := false
+			for _, d := range diagnostics {
+				found = found || strings.HasPrefix(d.String(), tt.want)
+			}
+			if !found {
+				t.Errorf("Expected %q, got %v", tt.want, diagnostics)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tokens, err := NewLexer("def f():\n    return 1\n    return x\n").Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer error: %v", err)
+	}
+	ast, err := NewParser(tokens).Parse()
+	if err != nil {
+		t.Fatalf("Parser error: %v", err)
+	}
+
+	diagnostics, err := Check(ast)
+	var analysisErr *AnalysisError
+	if !errors.As(err, &analysisErr) {
+		t.Fatalf("Expected AnalysisError, got %v", err)
+	}
+	if len(analysisErr.Errors) != 1 || analysisErr.Error() != "3:12: undefined variable: x" {
+		t.Errorf("Unexpected errors %v", analysisErr.Errors)
+	}
+	if len(diagnostics) != 2 || diagnostics[0].Severity != SeverityWarning {
+		t.Errorf("Expected the unreachable code warning first, got %v", diagnostics)
+	}
+}
@@ -0,0 +1,621 @@
+// Binary bytecode format for compiled contracts
+package smartcontract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// BytecodeVersion is the bytecode format version produced by EncodeBytecode
+const BytecodeVersion byte = 1
+
+// MaxStackDepth is the deepest operand stack a function may build, as
+// checked by VerifyBytecode
+const MaxStackDepth = 1024
+
+// bytecodeMagic starts every encoded contract. The leading zero byte keeps
+// bytecode from being mistaken for source text.
+var bytecodeMagic = []byte{0x00, 'o', 'b', 'c'}
+
+// Constant pool entry tags
+const (
+	constInt byte = 1
+	constStr byte = 2
+)
+
+// operandKind is the type of an instruction's argument
+type operandKind int
+
+const (
+	operandNone   operandKind = iota
+	operandInt                // int64, from the constant pool
+	operandString             // string, from the constant pool
+	operandBool               // bool, one byte
+	operandTarget             // int instruction index
+	operandCount              // int element count
+	operandCall               // CallTarget: name from the constant pool, argc
+)
+
+// opcodeInfo describes the encoding of each valid opcode
+var opcodeInfo = map[OpCode]struct {
+	name    string
+	operand operandKind
+}{
+	OpPushInt:     {"PUSH_INT", operandInt},
+	OpPushStr:     {"PUSH_STR", operandString},
+	OpPushBool:    {"PUSH_BOOL", operandBool},
+	OpPushNone:    {"PUSH_NONE", operandNone},
+	OpLoadVar:     {"LOAD_VAR", operandString},
+	OpStoreVar:    {"STORE_VAR", operandString},
+	OpAdd:         {"ADD", operandNone},
+	OpSub:         {"SUB", operandNone},
+	OpMul:         {"MUL", operandNone},
+	OpDiv:         {"DIV", operandNone},
+	OpEq:          {"EQ", operandNone},
+	OpNe:          {"NE", operandNone},
+	OpLt:          {"LT", operandNone},
+	OpGt:          {"GT", operandNone},
+	OpLe:          {"LE", operandNone},
+	OpGe:          {"GE", operandNone},
+	OpCall:        {"CALL", operandCall},
+	OpReturn:      {"RETURN", operandNone},
+	OpJump:        {"JUMP", operandTarget},
+	OpJumpIfFalse: {"JUMP_IF_FALSE", operandTarget},
+	OpGetAttr:     {"GET_ATTR", operandString},
+	OpSetAttr:     {"SET_ATTR", operandString},
+	OpPop:         {"POP", operandNone},
+	OpNot:         {"NOT", operandNone},
+	OpMod:         {"MOD", operandNone},
+	OpBuildList:   {"BUILD_LIST", operandCount},
+	OpBuildDict:   {"BUILD_DICT", operandCount},
+	OpGetIndex:    {"GET_INDEX", operandNone},
+	OpSetIndex:    {"SET_INDEX", operandNone},
+	OpLen:         {"LEN", operandNone},
+	OpGetMapItem:  {"GET_MAP_ITEM", operandString},
+	OpSetMapItem:  {"SET_MAP_ITEM", operandString},
+	OpEmit:        {"EMIT", operandNone},
+	OpLoadEnv:     {"LOAD_ENV", operandString},
+	OpBalance:     {"BALANCE", operandNone},
+	OpTransfer:    {"TRANSFER", operandNone},
+}
+
+// String returns the opcode's mnemonic
+func (op OpCode) String() string {
+	if info, ok := opcodeInfo[op]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("OP_%d", int(op))
+}
+
+// String formats the instruction for disassembly
+func (inst Instruction) String() string {
+	switch arg := inst.Arg.(type) {
+	case nil:
+		return inst.Op.String()
+	case string:
+		return fmt.Sprintf("%s %q", inst.Op, arg)
+	case CallTarget:
+		return fmt.Sprintf("%s %s/%d", inst.Op, arg.Name, arg.Argc)
+	default:
+		return fmt.Sprintf("%s %v", inst.Op, arg)
+	}
+}
+
+// Disassemble lists the contract's instructions, one per line, marking
+// function entry points
+func (c *CompiledContract) Disassemble() []string {
+	entries := make(map[int][]string)
+	for _, fn := range c.Functions {
+		entries[fn.Entry] = append(entries[fn.Entry], fn.Name)
+	}
+
+	lines := make([]string, 0, len(c.Code)+len(c.Functions))
+	for pc, inst := range c.Code {
+		names := entries[pc]
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s(%s):", name, strings.Join(c.Functions[name].Params, ", ")))
+		}
+		lines = append(lines, fmt.Sprintf("%04d %s", pc, inst))
+	}
+	return lines
+}
+
+// IsBytecode reports whether data starts with the bytecode magic
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, bytecodeMagic)
+}
+
+// constantPool interns the ints and strings referenced by instructions
+type constantPool struct {
+	buf     bytes.Buffer
+	count   int
+	ints    map[int64]int
+	strings map[string]int
+}
+
+func (p *constantPool) intConst(v int64) uint64 {
+	if i, ok := p.ints[v]; ok {
+		return uint64(i)
+	}
+	p.buf.WriteByte(constInt)
+	p.buf.Write(binary.AppendVarint(nil, v))
+	p.ints[v] = p.count
+	p.count++
+	return uint64(p.count - 1)
+}
+
+func (p *constantPool) strConst(s string) uint64 {
+	if i, ok := p.strings[s]; ok {
+		return uint64(i)
+	}
+	p.buf.WriteByte(constStr)
+	p.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	p.buf.WriteString(s)
+	p.strings[s] = p.count
+	p.count++
+	return uint64(p.count - 1)
+}
+
+// EncodeBytecode serializes a compiled contract:
+//
+//	magic     4 bytes, 0x00 "obc"
+//	version   1 byte
+//	constants uvarint count, then per entry a tag byte and an int (varint)
+//	          or a string (uvarint length and bytes)
+//	functions uvarint count, then per function, sorted by name: name
+//	          constant, entry, uvarint param count and param constants
+//	code      uvarint count, then per instruction an opcode byte and its
+//	          operand
+//
+// Constants and operands other than bools are uvarints.
+func EncodeBytecode(c *CompiledContract) ([]byte, error) {
+	pool := &constantPool{ints: make(map[int64]int), strings: make(map[string]int)}
+
+	var code []byte
+	code = binary.AppendUvarint(code, uint64(len(c.Code)))
+	for pc, inst := range c.Code {
+		info, ok := opcodeInfo[inst.Op]
+		if !ok {
+			return nil, fmt.Errorf("instruction %d: unknown opcode %d", pc, inst.Op)
+		}
+		if err := checkOperand(info.operand, inst.Arg); err != nil {
+			return nil, fmt.Errorf("instruction %d: %s %v", pc, inst.Op, err)
+		}
+		code = append(code, byte(inst.Op))
+
+		switch info.operand {
+		case operandInt:
+			code = binary.AppendUvarint(code, pool.intConst(inst.Arg.(int64)))
+		case operandString:
+			code = binary.AppendUvarint(code, pool.strConst(inst.Arg.(string)))
+		case operandBool:
+			if inst.Arg.(bool) {
+				code = append(code, 1)
+			} else {
+				code = append(code, 0)
+			}
+		case operandTarget, operandCount:
+			code = binary.AppendUvarint(code, uint64(inst.Arg.(int)))
+		case operandCall:
+			target := inst.Arg.(CallTarget)
+			code = binary.AppendUvarint(code, pool.strConst(target.Name))
+			code = binary.AppendUvarint(code, uint64(target.Argc))
+		}
+	}
+
+	names := make([]string, 0, len(c.Functions))
+	for name := range c.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var functions []byte
+	functions = binary.AppendUvarint(functions, uint64(len(names)))
+	for _, name := range names {
+		fn := c.Functions[name]
+		if fn.Entry < 0 {
+			return nil, fmt.Errorf("function %s has negative entry %d", name, fn.Entry)
+		}
+		functions = binary.AppendUvarint(functions, pool.strConst(name))
+		functions = binary.AppendUvarint(functions, uint64(fn.Entry))
+		functions = binary.AppendUvarint(functions, uint64(len(fn.Params)))
+		for _, param := range fn.Params {
+			functions = binary.AppendUvarint(functions, pool.strConst(param))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(bytecodeMagic)
+	buf.WriteByte(BytecodeVersion)
+	buf.Write(binary.AppendUvarint(nil, uint64(pool.count)))
+	buf.Write(pool.buf.Bytes())
+	buf.Write(functions)
+	buf.Write(code)
+	return buf.Bytes(), nil
+}
+
+// checkOperand checks that arg has the Go type the operand kind requires
+func checkOperand(kind operandKind, arg interface{}) error {
+	ok := false
+	switch kind {
+	case operandNone:
+		ok = arg == nil
+	case operandInt:
+		_, ok = arg.(int64)
+	case operandString:
+		_, ok = arg.(string)
+	case operandBool:
+		_, ok = arg.(bool)
+	case operandTarget, operandCount:
+		var n int
+		n, ok = arg.(int)
+		ok = ok && n >= 0
+	case operandCall:
+		var target CallTarget
+		target, ok = arg.(CallTarget)
+		ok = ok && target.Argc >= 0
+	}
+	if !ok {
+		return fmt.Errorf("has invalid operand %v", arg)
+	}
+	return nil
+}
+
+// bytecodeReader reads the fields of encoded bytecode
+type bytecodeReader struct {
+	r         *bytes.Reader
+	constants []interface{}
+}
+
+func (br *bytecodeReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		return 0, fmt.Errorf("truncated bytecode")
+	}
+	return v, nil
+}
+
+// count reads a length prefix. Every counted item takes at least one byte,
+// so a count larger than the remaining input is malformed.
+func (br *bytecodeReader) count() (int, error) {
+	n, err := br.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(br.r.Len()) {
+		return 0, fmt.Errorf("count %d exceeds remaining %d bytes", n, br.r.Len())
+	}
+	return int(n), nil
+}
+
+// operand reads a non-negative int operand
+func (br *bytecodeReader) operand() (int, error) {
+	n, err := br.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("operand %d out of range", n)
+	}
+	return int(n), nil
+}
+
+func (br *bytecodeReader) constant() (interface{}, error) {
+	i, err := br.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if i >= uint64(len(br.constants)) {
+		return nil, fmt.Errorf("constant %d out of range", i)
+	}
+	return br.constants[i], nil
+}
+
+func (br *bytecodeReader) stringConst() (string, error) {
+	c, err := br.constant()
+	if err != nil {
+		return "", err
+	}
+	s, ok := c.(string)
+	if !ok {
+		return "", fmt.Errorf("constant %v is not a string", c)
+	}
+	return s, nil
+}
+
+func (br *bytecodeReader) intConst() (int64, error) {
+	c, err := br.constant()
+	if err != nil {
+		return 0, err
+	}
+	v, ok := c.(int64)
+	if !ok {
+		return 0, fmt.Errorf("constant %q is not an int", c)
+	}
+	return v, nil
+}
+
+// DecodeBytecode parses bytecode produced by EncodeBytecode. It checks the
+// encoding only; use VerifyBytecode before executing untrusted code.
+func DecodeBytecode(data []byte) (*CompiledContract, error) {
+	if !IsBytecode(data) {
+		return nil, fmt.Errorf("invalid bytecode: bad magic")
+	}
+	if len(data) <= len(bytecodeMagic) {
+		return nil, fmt.Errorf("invalid bytecode: truncated bytecode")
+	}
+	if version := data[len(bytecodeMagic)]; version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d", version)
+	}
+
+	br := &bytecodeReader{r: bytes.NewReader(data[len(bytecodeMagic)+1:])}
+	contract, err := br.decode()
+	if err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %v", err)
+	}
+	return contract, nil
+}
+
+func (br *bytecodeReader) decode() (*CompiledContract, error) {
+	n, err := br.count()
+	if err != nil {
+		return nil, err
+	}
+	br.constants = make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		tag, err := br.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("truncated bytecode")
+		}
+		switch tag {
+		case constInt:
+			v, err := binary.ReadVarint(br.r)
+			if err != nil {
+				return nil, fmt.Errorf("truncated bytecode")
+			}
+			br.constants = append(br.constants, v)
+		case constStr:
+			size, err := br.count()
+			if err != nil {
+				return nil, err
+			}
+			s := make([]byte, size)
+			br.r.Read(s)
+			br.constants = append(br.constants, string(s))
+		default:
+			return nil, fmt.Errorf("unknown constant tag %d", tag)
+		}
+	}
+
+	n, err = br.count()
+	if err != nil {
+		return nil, err
+	}
+	functions := make(map[string]*Function, n)
+	for i := 0; i < n; i++ {
+		name, err := br.stringConst()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := functions[name]; ok {
+			return nil, fmt.Errorf("function %s defined twice", name)
+		}
+		entry, err := br.operand()
+		if err != nil {
+			return nil, err
+		}
+		nparams, err := br.count()
+		if err != nil {
+			return nil, err
+		}
+		params := make([]string, nparams)
+		for j := range params {
+			if params[j], err = br.stringConst(); err != nil {
+				return nil, err
+			}
+		}
+		functions[name] = &Function{Name: name, Entry: entry, Params: params}
+	}
+
+	n, err = br.count()
+	if err != nil {
+		return nil, err
+	}
+	code := make([]Instruction, n)
+	for pc := range code {
+		op, err := br.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("truncated bytecode")
+		}
+		inst := Instruction{Op: OpCode(op)}
+		info, ok := opcodeInfo[inst.Op]
+		if !ok {
+			return nil, fmt.Errorf("instruction %d: unknown opcode %d", pc, op)
+		}
+
+		switch info.operand {
+		case operandInt:
+			inst.Arg, err = br.intConst()
+		case operandString:
+			inst.Arg, err = br.stringConst()
+		case operandBool:
+			var b byte
+			if b, err = br.r.ReadByte(); err != nil {
+				err = fmt.Errorf("truncated bytecode")
+			} else if b > 1 {
+				err = fmt.Errorf("invalid bool %d", b)
+			}
+			inst.Arg = b == 1
+		case operandTarget, operandCount:
+			inst.Arg, err = br.operand()
+		case operandCall:
+			var target CallTarget
+			if target.Name, err = br.stringConst(); err == nil {
+				target.Argc, err = br.operand()
+			}
+			inst.Arg = target
+		}
+		if err != nil {
+			return nil, fmt.Errorf("instruction %d: %v", pc, err)
+		}
+		code[pc] = inst
+	}
+
+	if br.r.Len() > 0 {
+		return nil, fmt.Errorf("%d trailing bytes", br.r.Len())
+	}
+	return &CompiledContract{Code: code, Functions: functions}, nil
+}
+
+// stackEffect returns how many operands an instruction pops and pushes
+func stackEffect(inst Instruction) (pops, pushes int) {
+	switch inst.Op {
+	case OpPushInt, OpPushStr, OpPushBool, OpPushNone, OpLoadVar, OpLoadEnv:
+		return 0, 1
+	case OpStoreVar, OpPop, OpJumpIfFalse, OpReturn:
+		return 1, 0
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpEq, OpNe, OpLt, OpGt, OpLe, OpGe, OpGetIndex, OpEmit, OpBalance:
+		return 2, 1
+	case OpNot, OpLen, OpGetAttr, OpGetMapItem:
+		return 1, 1
+	case OpSetAttr, OpSetMapItem:
+		return 2, 0
+	case OpSetIndex:
+		return 3, 0
+	case OpTransfer:
+		return 3, 1
+	case OpCall:
+		return inst.Arg.(CallTarget).Argc, 1
+	case OpBuildList:
+		return inst.Arg.(int), 1
+	case OpBuildDict:
+		return 2 * inst.Arg.(int), 1
+	default:
+		return 0, 0
+	}
+}
+
+// VerifyBytecode checks that a contract is safe to execute: every opcode is
+// valid with a well-typed operand, jumps and function entries land inside
+// the code, calls name a defined function with the right number of
+// arguments, and every reachable instruction sees the same stack depth on
+// all paths, never popping below its frame or growing past MaxStackDepth.
+func VerifyBytecode(c *CompiledContract) error {
+	n := len(c.Code)
+	for pc, inst := range c.Code {
+		info, ok := opcodeInfo[inst.Op]
+		if !ok {
+			return fmt.Errorf("instruction %d: unknown opcode %d", pc, inst.Op)
+		}
+		if err := checkOperand(info.operand, inst.Arg); err != nil {
+			return fmt.Errorf("instruction %d: %s %v", pc, inst.Op, err)
+		}
+
+		switch info.operand {
+		case operandTarget:
+			// Jumping to the end finishes execution
+			if target := inst.Arg.(int); target > n {
+				return fmt.Errorf("instruction %d: jump target %d outside code", pc, target)
+			}
+		case operandCount:
+			if count := inst.Arg.(int); count > MaxStackDepth {
+				return fmt.Errorf("instruction %d: %s count %d exceeds stack limit", pc, inst.Op, count)
+			}
+		case operandString:
+			if name := inst.Arg.(string); inst.Op == OpLoadEnv && !IsEnvField(name) {
+				return fmt.Errorf("instruction %d: unknown environment field %s", pc, name)
+			}
+		case operandCall:
+			target := inst.Arg.(CallTarget)
+			fn, ok := c.Functions[target.Name]
+			if !ok {
+				return fmt.Errorf("instruction %d: call to undefined function %s", pc, target.Name)
+			}
+			if target.Argc != len(fn.Params) {
+				return fmt.Errorf("instruction %d: %s() takes %d arguments, got %d", pc, target.Name, len(fn.Params), target.Argc)
+			}
+		}
+	}
+
+	entries := make([]int, 0, len(c.Functions)+1)
+	if n > 0 {
+		entries = append(entries, 0)
+	}
+	for name, fn := range c.Functions {
+		if fn.Name != name {
+			return fmt.Errorf("function %s recorded as %s", name, fn.Name)
+		}
+		if fn.Entry < 0 || fn.Entry >= n {
+			return fmt.Errorf("function %s entry %d outside code", name, fn.Entry)
+		}
+		seen := make(map[string]bool, len(fn.Params))
+		for _, param := range fn.Params {
+			if seen[param] {
+				return fmt.Errorf("function %s has duplicate parameter %s", name, param)
+			}
+			seen[param] = true
+		}
+		entries = append(entries, fn.Entry)
+	}
+
+	// Each frame starts with an empty stack, so depths are frame-relative
+	depths := make([]int, n)
+	for i := range depths {
+		depths[i] = -1
+	}
+	var work []int
+	reach := func(from, pc, depth int) error {
+		if pc == n {
+			return nil
+		}
+		if depths[pc] == -1 {
+			depths[pc] = depth
+			work = append(work, pc)
+		} else if depths[pc] != depth {
+			return fmt.Errorf("instruction %d: stack depth %d, reached from %d with depth %d", pc, depths[pc], from, depth)
+		}
+		return nil
+	}
+	for _, entry := range entries {
+		if err := reach(-1, entry, 0); err != nil {
+			return err
+		}
+	}
+
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		inst := c.Code[pc]
+
+		pops, pushes := stackEffect(inst)
+		if depths[pc] < pops {
+			return fmt.Errorf("instruction %d: %s stack underflow", pc, inst.Op)
+		}
+		depth := depths[pc] - pops + pushes
+		if depth > MaxStackDepth {
+			return fmt.Errorf("instruction %d: stack depth exceeds %d", pc, MaxStackDepth)
+		}
+
+		var err error
+		switch inst.Op {
+		case OpReturn:
+		case OpJump:
+			err = reach(pc, inst.Arg.(int), depth)
+		case OpJumpIfFalse:
+			if err = reach(pc, pc+1, depth); err == nil {
+				err = reach(pc, inst.Arg.(int), depth)
+			}
+		default:
+			err = reach(pc, pc+1, depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package smartcontract
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	source := `total = 0
+names = {"a": 1, "b": -2}
+
+def fib(n):
+    if n < 2:
+        return n
+    return fib(n - 1) + fib(n - 2)
+
+def sum_to(n):
+    s = 0
+    for i in range(n):
+        if i % 2 == 0 and not i == 4:
+            s = s + i
+    self.totals[n] = s
+    return [s, len(names), True]
+`
+	contract := compileSource(t, source)
+	if err := VerifyBytecode(contract); err != nil {
+		t.Fatalf("Compiler output failed verification: %v", err)
+	}
+
+	code, err := EncodeBytecode(contract)
+	if err != nil {
+		t.Fatalf("EncodeBytecode failed: %v", err)
+	}
+	if !IsBytecode(code) || code[len(bytecodeMagic)] != BytecodeVersion {
+		t.Fatalf("Missing header: %x", code[:5])
+	}
+
+	decoded, err := DecodeBytecode(code)
+	if err != nil {
+		t.Fatalf("DecodeBytecode failed: %v", err)
+	}
+	if err := VerifyBytecode(decoded); err != nil {
+		t.Fatalf("Decoded bytecode failed verification: %v", err)
+	}
+	if len(decoded.Code) != len(contract.Code) {
+		t.Fatalf("Decoded %d instructions, want %d", len(decoded.Code), len(contract.Code))
+	}
+	for pc := range contract.Code {
+		if decoded.Code[pc] != contract.Code[pc] {
+			t.Fatalf("Instruction %d = %s, want %s", pc, decoded.Code[pc], contract.Code[pc])
+		}
+	}
+
+	// Encoding is deterministic despite the function map
+	again, _ := EncodeBytecode(decoded)
+	if !bytes.Equal(again, code) {
+		t.Error("Re-encoding decoded bytecode changed it")
+	}
+
+	vm := NewContractVM(decoded)
+	if _, err := vm.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if got, err := vm.Call("fib", []Value{{Type: ValueInt, Int: 10}}); err != nil || got.Int != 55 {
+		t.Errorf("fib(10) = %v (%v), want 55", got.Int, err)
+	}
+
+	if listing := strings.Join(decoded.Disassemble(), "\n"); !strings.Contains(listing, "fib(n):") || !strings.Contains(listing, `SET_MAP_ITEM "totals"`) {
+		t.Errorf("Unexpected disassembly:\n%s", listing)
+	}
+}
+
+func TestDecodeBytecodeMalformed(t *testing.T) {
+	code, err := EncodeBytecode(compileSource(t, "def f(x):\n    return x + 1\n"))
+	if err != nil {
+		t.Fatalf("EncodeBytecode failed: %v", err)
+	}
+
+	badVersion := append([]byte(nil), code...)
+	badVersion[len(bytecodeMagic)] = BytecodeVersion + 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"source text", []byte("def f(x):\n    return x\n")},
+		{"header only", code[:len(bytecodeMagic)]},
+		{"bad version", badVersion},
+		{"truncated", code[:len(code)-1]},
+		{"trailing bytes", append(append([]byte(nil), code...), 0)},
+	}
+	for _, test := range tests {
+		if _, err := DecodeBytecode(test.data); err == nil {
+			t.Errorf("%s: expected decode error", test.name)
+		}
+	}
+
+	// Every prefix is rejected without panicking
+	for i := range code {
+		if _, err := DecodeBytecode(code[:i]); err == nil {
+			t.Errorf("Prefix of %d bytes decoded", i)
+		}
+	}
+}
+
+func TestVerifyBytecode(t *testing.T) {
+	fn := map[string]*Function{"f": {Name: "f", Entry: 0, Params: []string{"x"}}}
+
+	tests := []struct {
+		name      string
+		code      []Instruction
+		functions map[string]*Function
+		want      string
+	}{
+		{
+			"unknown opcode",
+			[]Instruction{{Op: OpCode(200)}},
+			nil, "unknown opcode",
+		},
+		{
+			"bad operand",
+			[]Instruction{{Op: OpPushInt, Arg: "1"}},
+			nil, "invalid operand",
+		},
+		{
+			"jump outside code",
+			[]Instruction{{Op: OpJump, Arg: 5}},
+			nil, "jump target",
+		},
+		{
+			"underflow",
+			[]Instruction{{Op: OpPushInt, Arg: int64(1)}, {Op: OpAdd}},
+			nil, "underflow",
+		},
+		{
+			// The loop pushes one value per iteration
+			"inconsistent depth",
+			[]Instruction{{Op: OpPushInt, Arg: int64(1)}, {Op: OpJump, Arg: 0}},
+			nil, "stack depth",
+		},
+		{
+			// A function may not pop its caller's operands
+			"underflow into caller",
+			[]Instruction{{Op: OpPop}, {Op: OpPushNone}, {Op: OpReturn}},
+			fn, "underflow",
+		},
+		{
+			"undefined function",
+			[]Instruction{{Op: OpCall, Arg: CallTarget{Name: "g"}}, {Op: OpReturn}},
+			nil, "undefined function",
+		},
+		{
+			"wrong argument count",
+			[]Instruction{{Op: OpLoadVar, Arg: "x"}, {Op: OpReturn}, {Op: OpCall, Arg: CallTarget{Name: "f", Argc: 0}}},
+			fn, "takes 1 arguments",
+		},
+		{
+			"entry outside code",
+			[]Instruction{{Op: OpPushNone}, {Op: OpReturn}},
+			map[string]*Function{"f": {Name: "f", Entry: 2}},
+			"entry",
+		},
+	}
+	for _, test := range tests {
+		err := VerifyBytecode(&CompiledContract{Code: test.code, Functions: test.functions})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want error containing %q", test.name, err, test.want)
+		}
+	}
+
+	// Too deep a stack is rejected
+	deep := make([]Instruction, MaxStackDepth+1)
+	for i := range deep {
+		deep[i] = Instruction{Op: OpPushNone}
+	}
+	if err := VerifyBytecode(&CompiledContract{Code: deep}); err == nil {
+		t.Error("Expected stack depth limit error")
+	}
+}
@@ -0,0 +1,64 @@
+// Call data carried by contract call transactions
+package smartcontract
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// CallData names the contract function a call transaction invokes
+type CallData struct {
+	Contract string
+	Function string
+	Args     []Value
+}
+
+// EncodeCallData serializes call data as the length-prefixed contract and
+// function names followed by the arguments encoded as a list
+func EncodeCallData(call *CallData) ([]byte, error) {
+	args, err := encodeValue(Value{Type: ValueList, List: call.Args})
+	if err != nil {
+		return nil, fmt.Errorf("invalid call arguments: %v", err)
+	}
+
+	var data []byte
+	data = binary.AppendUvarint(data, uint64(len(call.Contract)))
+	data = append(data, call.Contract...)
+	data = binary.AppendUvarint(data, uint64(len(call.Function)))
+	data = append(data, call.Function...)
+	return append(data, args...), nil
+}
+
+// DecodeCallData parses call data produced by EncodeCallData
+func DecodeCallData(data []byte) (*CallData, error) {
+	contract, rest, err := readCallString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid call data: %v", err)
+	}
+	function, rest, err := readCallString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid call data: %v", err)
+	}
+	if function == "" {
+		return nil, fmt.Errorf("invalid call data: missing function name")
+	}
+
+	args, err := decodeValue(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid call data: %v", err)
+	}
+	if args.Type != ValueList {
+		return nil, fmt.Errorf("invalid call data: arguments are %s, not list", args.Type)
+	}
+	return &CallData{Contract: contract, Function: function, Args: args.List}, nil
+}
+
+// readCallString reads a length-prefixed string
+func readCallString(data []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return "", nil, fmt.Errorf("truncated string")
+	}
+	end := size + int(n)
+	return string(data[size:end]), data[end:], nil
+}
@@ -0,0 +1,233 @@
+// List and dict values for OCL
+package smartcontract
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// DictKey is a dict key. Only ints and strings can be keys.
+type DictKey struct {
+	Type ValueType
+	Int  int64
+	Str  string
+}
+
+// Value returns the key as a VM value
+func (k DictKey) Value() Value {
+	if k.Type == ValueStr {
+		return Value{Type: ValueStr, Str: k.Str}
+	}
+	return Value{Type: ValueInt, Int: k.Int}
+}
+
+// String formats the key as it appears in source
+func (k DictKey) String() string {
+	if k.Type == ValueStr {
+		return strconv.Quote(k.Str)
+	}
+	return strconv.FormatInt(k.Int, 10)
+}
+
+// dictKey converts a value to a dict key
+func dictKey(v Value) (DictKey, error) {
+	switch v.Type {
+	case ValueInt:
+		return DictKey{Type: ValueInt, Int: v.Int}, nil
+	case ValueStr:
+		return DictKey{Type: ValueStr, Str: v.Str}, nil
+	default:
+		return DictKey{}, fmt.Errorf("unhashable key type %s", v.Type)
+	}
+}
+
+// sortedKeys returns the keys of a dict in a deterministic order: ints
+// before strings, each ascending
+func sortedKeys(dict map[DictKey]Value) []DictKey {
+	keys := make([]DictKey, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		if keys[i].Type == ValueInt {
+			return keys[i].Int < keys[j].Int
+		}
+		return keys[i].Str < keys[j].Str
+	})
+	return keys
+}
+
+// MaxValueDepth limits how deeply lists and dicts may be nested in a value
+// that is copied, stored or emitted
+const MaxValueDepth = 32
+
+var errValueTooDeep = fmt.Errorf("lists and dicts nested more than %d deep", MaxValueDepth)
+
+// copyValue returns a deep copy of v, so the copy shares no elements
+func copyValue(v Value) (Value, error) {
+	return copyValueDepth(v, 0)
+}
+
+// copyValueDepth copies v, which is nested in depth lists and dicts
+func copyValueDepth(v Value, depth int) (Value, error) {
+	if v.Type != ValueList && v.Type != ValueDict {
+		return v, nil
+	}
+	if depth >= MaxValueDepth {
+		return Value{}, errValueTooDeep
+	}
+
+	if v.Type == ValueList {
+		list := make([]Value, len(v.List))
+		for i, elem := range v.List {
+			var err error
+			if list[i], err = copyValueDepth(elem, depth+1); err != nil {
+				return Value{}, err
+			}
+		}
+		v.List = list
+		return v, nil
+	}
+	dict := make(map[DictKey]Value, len(v.Dict))
+	for key, elem := range v.Dict {
+		var err error
+		if dict[key], err = copyValueDepth(elem, depth+1); err != nil {
+			return Value{}, err
+		}
+	}
+	v.Dict = dict
+	return v, nil
+}
+
+// valuesEqual compares values structurally
+func valuesEqual(a, b Value) bool {
+	if a.Type != b.Type {
+		return false
+	}
+
+	switch a.Type {
+	case ValueInt:
+		return a.Int == b.Int
+	case ValueStr:
+		return a.Str == b.Str
+	case ValueBool:
+		return a.Bool == b.Bool
+	case ValueNone:
+		return true
+	case ValueList:
+		if len(a.List) != len(b.List) {
+			return false
+		}
+		for i := range a.List {
+			if !valuesEqual(a.List[i], b.List[i]) {
+				return false
+			}
+		}
+		return true
+	case ValueDict:
+		if len(a.Dict) != len(b.Dict) {
+			return false
+		}
+		for key, av := range a.Dict {
+			bv, ok := b.Dict[key]
+			if !ok || !valuesEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// listIndex resolves a possibly negative index into a list of length n
+func listIndex(index Value, n int) (int, error) {
+	if index.Type != ValueInt {
+		return 0, fmt.Errorf("list index must be int, not %s", index.Type)
+	}
+	i := index.Int
+	if i < 0 {
+		i += int64(n)
+	}
+	if i < 0 || i >= int64(n) {
+		return 0, fmt.Errorf("list index %d out of range", index.Int)
+	}
+	return int(i), nil
+}
+
+// getIndex returns container[index]
+func getIndex(container, index Value) (Value, error) {
+	switch container.Type {
+	case ValueList:
+		i, err := listIndex(index, len(container.List))
+		if err != nil {
+			return Value{}, err
+		}
+		return container.List[i], nil
+	case ValueDict:
+		key, err := dictKey(index)
+		if err != nil {
+			return Value{}, err
+		}
+		val, ok := container.Dict[key]
+		if !ok {
+			return Value{}, fmt.Errorf("key %s not found", key)
+		}
+		return val, nil
+	case ValueStr:
+		i, err := listIndex(index, len(container.Str))
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Type: ValueStr, Str: container.Str[i : i+1]}, nil
+	default:
+		return Value{}, fmt.Errorf("%s is not subscriptable", container.Type)
+	}
+}
+
+// setIndex performs container[index] = val in place. It reports whether a
+// new dict entry was created.
+func setIndex(container, index, val Value) (bool, error) {
+	switch container.Type {
+	case ValueList:
+		i, err := listIndex(index, len(container.List))
+		if err != nil {
+			return false, err
+		}
+		container.List[i] = val
+		return false, nil
+	case ValueDict:
+		key, err := dictKey(index)
+		if err != nil {
+			return false, err
+		}
+		_, existed := container.Dict[key]
+		container.Dict[key] = val
+		return !existed, nil
+	default:
+		return false, fmt.Errorf("%s does not support item assignment", container.Type)
+	}
+}
+
+// valueLen returns len(v)
+func valueLen(v Value) (int64, error) {
+	switch v.Type {
+	case ValueList:
+		return int64(len(v.List)), nil
+	case ValueDict:
+		return int64(len(v.Dict)), nil
+	case ValueStr:
+		return int64(len(v.Str)), nil
+	default:
+		return 0, fmt.Errorf("%s has no len()", v.Type)
+	}
+}
+
+// mapSlot is the storage key of entry key of the storage map field
+func mapSlot(field string, key DictKey) string {
+	return fmt.Sprintf("%s[%s]", field, key)
+}
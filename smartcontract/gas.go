@@ -0,0 +1,167 @@
+// Gas metering for OCL contract execution
+package smartcontract
+
+import (
+	"errors"
+	"obsidian-core/wire"
+)
+
+// ErrOutOfGas is returned when execution exceeds its gas limit. All state
+// changes made by the execution are reverted.
+var ErrOutOfGas = errors.New("out of gas")
+
+// DefaultGasLimit is the execution gas limit of a VM that was not given one
+const DefaultGasLimit uint64 = 10000000
+
+// Gas costs of VM operations
+const (
+	GasQuickStep   uint64 = 2  // Constants, pops and jumps
+	GasFastestStep uint64 = 3  // Variable access, addition, comparison
+	GasFastStep    uint64 = 5  // Multiplication and division
+	GasAttrAccess  uint64 = 50 // Attribute lookups
+	GasCallBase    uint64 = 40 // Entering a function
+	GasCallArg     uint64 = 3  // Per argument passed
+
+	// Memory: per 32-byte word of stack, locals and string data
+	GasMemoryWord = wire.GasMemory
+
+	// Events: a base cost plus the bytes of the topic and encoded data
+	GasLog     uint64 = 375
+	GasLogByte uint64 = 8
+
+	// Balances and transfers out of the contract
+	GasBalance  uint64 = 400
+	GasTransfer uint64 = 9000
+
+	// Storage
+	GasStorageLoad        uint64 = 200
+	GasStorageLoadWord    uint64 = 25                      // Per word of a loaded value beyond the first
+	GasStorageSet         uint64 = wire.GasContractStorage // Empty slot to non-empty
+	GasStorageUpdate      uint64 = 5000                    // Changing or deleting a slot
+	GasStorageClearRefund uint64 = 15000                   // Refunded for deleting a slot
+
+	// MaxRefundQuotient caps refunds at gas used / MaxRefundQuotient
+	MaxRefundQuotient uint64 = 2
+)
+
+// opcodeGas is the static cost of each opcode. Dynamic costs such as memory
+// growth and storage are charged separately.
+var opcodeGas = map[OpCode]uint64{
+	OpPushInt:     GasQuickStep,
+	OpPushStr:     GasQuickStep,
+	OpPushBool:    GasQuickStep,
+	OpPushNone:    GasQuickStep,
+	OpPop:         GasQuickStep,
+	OpLoadVar:     GasFastestStep,
+	OpStoreVar:    GasFastestStep,
+	OpAdd:         GasFastestStep,
+	OpSub:         GasFastestStep,
+	OpMul:         GasFastStep,
+	OpDiv:         GasFastStep,
+	OpEq:          GasFastestStep,
+	OpNe:          GasFastestStep,
+	OpLt:          GasFastestStep,
+	OpGt:          GasFastestStep,
+	OpLe:          GasFastestStep,
+	OpGe:          GasFastestStep,
+	OpCall:        GasCallBase,
+	OpReturn:      GasQuickStep,
+	OpJump:        GasQuickStep,
+	OpJumpIfFalse: GasQuickStep,
+	OpGetAttr:     GasAttrAccess,
+	OpSetAttr:     GasAttrAccess,
+	OpNot:         GasFastestStep,
+	OpMod:         GasFastStep,
+	OpBuildList:   GasFastestStep,
+	OpBuildDict:   GasFastestStep,
+	OpGetIndex:    GasFastestStep,
+	OpSetIndex:    GasFastestStep,
+	OpLen:         GasQuickStep,
+	OpGetMapItem:  GasAttrAccess,
+	OpSetMapItem:  GasAttrAccess,
+	OpEmit:        GasLog,
+	OpLoadEnv:     GasQuickStep,
+	OpBalance:     GasBalance,
+	OpTransfer:    GasTransfer,
+}
+
+// OpcodeGas returns the static gas cost of an opcode
+func OpcodeGas(op OpCode) uint64 {
+	if cost, ok := opcodeGas[op]; ok {
+		return cost
+	}
+	return GasFastestStep
+}
+
+// memoryWords returns the number of 32-byte words needed for size bytes
+func memoryWords(size int) uint64 {
+	return uint64(size+31) / 32
+}
+
+// GasMeter tracks the gas consumed by an execution
+type GasMeter struct {
+	limit  uint64
+	used   uint64
+	refund uint64
+}
+
+// NewGasMeter creates a meter allowing limit gas
+func NewGasMeter(limit uint64) *GasMeter {
+	return &GasMeter{limit: limit}
+}
+
+// Consume charges amount gas. Running out consumes the whole limit.
+func (g *GasMeter) Consume(amount uint64) error {
+	if amount > g.limit-g.used {
+		g.used = g.limit
+		return ErrOutOfGas
+	}
+	g.used += amount
+	return nil
+}
+
+// AddRefund credits gas to be refunded when execution succeeds
+func (g *GasMeter) AddRefund(amount uint64) {
+	g.refund += amount
+}
+
+// ChargeStorageWrite charges for writing a storage slot. Creating a slot
+// costs GasStorageSet, changing one GasStorageUpdate, and deleting one
+// earns a refund.
+func (g *GasMeter) ChargeStorageWrite(existed, deleting bool) error {
+	switch {
+	case !existed && !deleting:
+		return g.Consume(GasStorageSet)
+	case existed && deleting:
+		if err := g.Consume(GasStorageUpdate); err != nil {
+			return err
+		}
+		g.AddRefund(GasStorageClearRefund)
+		return nil
+	default:
+		return g.Consume(GasStorageUpdate)
+	}
+}
+
+// Limit returns the gas limit
+func (g *GasMeter) Limit() uint64 {
+	return g.limit
+}
+
+// Used returns the gas consumed so far, before refunds
+func (g *GasMeter) Used() uint64 {
+	return g.used
+}
+
+// Remaining returns the gas left
+func (g *GasMeter) Remaining() uint64 {
+	return g.limit - g.used
+}
+
+// Refund returns the refund earned, capped at used / MaxRefundQuotient
+func (g *GasMeter) Refund() uint64 {
+	if max := g.used / MaxRefundQuotient; g.refund > max {
+		return max
+	}
+	return g.refund
+}
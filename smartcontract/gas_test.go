@@ -0,0 +1,171 @@
+package smartcontract
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOutOfGas(t *testing.T) {
+	source := `
+counter = 0
+
+def spin(n):
+    counter = n
+    return spin(n + 1)
+
+def bump():
+    return counter + 1
+`
+	contract := compileSource(t, source)
+
+	vm := NewContractVM(contract)
+	vm.SetGasLimit(1000)
+	if _, err := vm.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	used := vm.GasUsed()
+	if used == 0 {
+		t.Fatal("Execution consumed no gas")
+	}
+
+	// Recursion stops at the gas limit before the call depth limit
+	vm.SetGasLimit(500)
+	_, err := vm.Call("spin", []Value{{Type: ValueInt, Int: 0}})
+	if !errors.Is(err, ErrOutOfGas) {
+		t.Fatalf("Expected out of gas, got %v", err)
+	}
+	if vm.GasUsed() != 500 {
+		t.Errorf("Out of gas consumed %d, want the whole limit", vm.GasUsed())
+	}
+
+	// Globals written before running out are reverted
+	if got := vm.vars["counter"]; got.Int != 0 {
+		t.Errorf("counter = %d after revert, want 0", got.Int)
+	}
+	vm.SetGasLimit(1000)
+	if _, err := vm.Call("bump", nil); err != nil {
+		t.Errorf("VM unusable after out of gas: %v", err)
+	}
+}
+
+func TestGasDeterministic(t *testing.T) {
+	source := `
+def fact(n):
+    if n <= 1:
+        return 1
+    else:
+        return n * fact(n - 1)
+`
+	contract := compileSource(t, source)
+
+	var gas []uint64
+	for i := 0; i < 2; i++ {
+		vm := NewContractVM(contract)
+		if _, err := vm.Call("fact", []Value{{Type: ValueInt, Int: 12}}); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		gas = append(gas, vm.GasUsed())
+	}
+	if gas[0] != gas[1] {
+		t.Errorf("Gas differs between runs: %d vs %d", gas[0], gas[1])
+	}
+}
+
+func TestGasMeterStorageRefund(t *testing.T) {
+	meter := NewGasMeter(100000)
+	meter.Consume(10000)
+
+	// Create then delete a slot
+	if err := meter.ChargeStorageWrite(false, false); err != nil {
+		t.Fatalf("ChargeStorageWrite failed: %v", err)
+	}
+	if err := meter.ChargeStorageWrite(true, true); err != nil {
+		t.Fatalf("ChargeStorageWrite failed: %v", err)
+	}
+	if used := meter.Used(); used != 10000+GasStorageSet+GasStorageUpdate {
+		t.Errorf("Used = %d, want %d", used, 10000+GasStorageSet+GasStorageUpdate)
+	}
+	if refund := meter.Refund(); refund != GasStorageClearRefund {
+		t.Errorf("Refund = %d, want %d", refund, GasStorageClearRefund)
+	}
+
+	// The refund is capped at half the gas used
+	small := NewGasMeter(100000)
+	small.Consume(GasStorageUpdate)
+	small.AddRefund(GasStorageClearRefund)
+	if refund := small.Refund(); refund != GasStorageUpdate/MaxRefundQuotient {
+		t.Errorf("Refund = %d, want capped %d", refund, GasStorageUpdate/MaxRefundQuotient)
+	}
+
+	if err := NewGasMeter(GasStorageSet-1).ChargeStorageWrite(false, false); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("Expected out of gas, got %v", err)
+	}
+}
+
+func TestInfiniteLoopOutOfGas(t *testing.T) {
+	vm := NewContractVM(compileSource(t, "def spin():\n    while True:\n        pass\n"))
+	vm.SetGasLimit(10000)
+	if _, err := vm.Call("spin", nil); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("Expected out of gas, got %v", err)
+	}
+}
+
+func TestStorageLoadGas(t *testing.T) {
+	source := `
+def put(s):
+    self.x = s
+
+def get():
+    return self.x
+`
+	contract := compileSource(t, source)
+	ws := NewWriteSet(nil)
+	loadGas := func(s string) uint64 {
+		vm := NewContractVM(contract)
+		vm.SetStorage(ws, "store")
+		if _, err := vm.Call("put", []Value{{Type: ValueStr, Str: s}}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+		vm = NewContractVM(contract)
+		vm.SetStorage(ws, "store")
+		if _, err := vm.Call("get", nil); err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		return vm.GasUsed()
+	}
+
+	// Loading a value pays for every word beyond the first: the large one
+	// encodes to 101 words
+	small, large := loadGas("x"), loadGas(strings.Repeat("x", 32*100))
+	if want := small + 100*GasStorageLoadWord; large < want {
+		t.Errorf("loading 100 words cost %d, want at least %d", large, want)
+	}
+}
+
+func TestCompareGas(t *testing.T) {
+	source := `
+def same(n):
+    d = {}
+    i = 0
+    while i < n:
+        d[i] = i
+        i = i + 1
+    return d == d
+`
+	contract := compileSource(t, source)
+	compareGas := func(n int64) uint64 {
+		vm := NewContractVM(contract)
+		if _, err := vm.Call("same", []Value{{Type: ValueInt, Int: n}}); err != nil {
+			t.Fatalf("same(%d) failed: %v", n, err)
+		}
+		return vm.GasUsed()
+	}
+
+	// Comparing a dict with itself walks both sides, so the extra 100
+	// entries cost at least their words twice over
+	small, large := compareGas(1), compareGas(101)
+	if want := small + 2*memoryWords(100*26)*GasMemoryWord; large < want {
+		t.Errorf("comparing 100 more entries cost %d, want at least %d", large, want)
+	}
+}
@@ -0,0 +1,152 @@
+// Chain state exposed to contracts: the calling transaction, the block and
+// the OBS and token balances contracts can read and spend
+package smartcontract
+
+import "fmt"
+
+// Environment fields readable as msg.<field> and block.<field>
+var envFields = map[string]bool{
+	"msg.sender":      true, // Address that signed the transaction
+	"msg.value":       true, // OBS attached to the call, in satoshis
+	"block.height":    true, // Height of the block being connected
+	"block.timestamp": true, // Timestamp of that block, in Unix seconds
+}
+
+// IsEnvField reports whether name, such as "msg.sender", is an environment
+// field
+func IsEnvField(name string) bool {
+	return envFields[name]
+}
+
+// Ledger is the chain state behind balance_of() and transfer()
+type Ledger interface {
+	// Balance returns the OBS held by address, in satoshis
+	Balance(address string) (int64, error)
+
+	// TokenBalance returns the amount of token, a hex token ID, held by
+	// address
+	TokenBalance(token, address string) (int64, error)
+
+	// CheckTransfer reports whether a transfer could be settled
+	CheckTransfer(transfer *Transfer) error
+}
+
+// Context is the transaction and block a contract runs in
+type Context struct {
+	Sender    string
+	Value     int64
+	Height    int32
+	Timestamp int64
+	Ledger    Ledger // nil gives every address a zero balance
+}
+
+// Transfer moves OBS, or a token if Token is set, out of a contract. The VM
+// only records transfers; the chain settles them if execution succeeds.
+type Transfer struct {
+	To     string
+	Token  string // Hex token ID; empty for OBS
+	Amount int64
+}
+
+// env returns the value of an environment field
+func (vm *VM) env(name string) (Value, error) {
+	switch name {
+	case "msg.sender":
+		return Value{Type: ValueStr, Str: vm.ctx.Sender}, nil
+	case "msg.value":
+		return Value{Type: ValueInt, Int: vm.ctx.Value}, nil
+	case "block.height":
+		return Value{Type: ValueInt, Int: int64(vm.ctx.Height)}, nil
+	case "block.timestamp":
+		return Value{Type: ValueInt, Int: vm.ctx.Timestamp}, nil
+	default:
+		return Value{}, fmt.Errorf("unknown environment field %s", name)
+	}
+}
+
+// balance returns what address holds of token, counting the transfers
+// recorded so far. A None address is the contract itself.
+func (vm *VM) balance(address, token Value) (int64, error) {
+	if address.Type == ValueNone {
+		address = Value{Type: ValueStr, Str: vm.contract}
+	}
+	if address.Type != ValueStr || address.Str == "" {
+		return 0, fmt.Errorf("balance_of() address must be a non-empty str")
+	}
+	tokenID, err := transferToken(token)
+	if err != nil {
+		return 0, err
+	}
+
+	balance := int64(0)
+	if vm.ctx.Ledger != nil {
+		if tokenID == "" {
+			balance, err = vm.ctx.Ledger.Balance(address.Str)
+		} else {
+			balance, err = vm.ctx.Ledger.TokenBalance(tokenID, address.Str)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, transfer := range vm.transfers {
+		if transfer.Token != tokenID {
+			continue
+		}
+		if transfer.To == address.Str {
+			balance += transfer.Amount
+		}
+		if vm.contract == address.Str {
+			balance -= transfer.Amount
+		}
+	}
+	return balance, nil
+}
+
+// transfer records a transfer out of the contract after checking that the
+// contract can cover it
+func (vm *VM) transfer(token, to, amount Value) error {
+	tokenID, err := transferToken(token)
+	if err != nil {
+		return err
+	}
+	if to.Type != ValueStr || to.Str == "" {
+		return fmt.Errorf("transfer recipient must be a non-empty str")
+	}
+	if amount.Type != ValueInt || amount.Int <= 0 {
+		return fmt.Errorf("transfer amount must be a positive int")
+	}
+	if to.Str == vm.contract {
+		return fmt.Errorf("contract cannot transfer to itself")
+	}
+
+	t := Transfer{To: to.Str, Token: tokenID, Amount: amount.Int}
+	if vm.ctx.Ledger != nil {
+		if err := vm.ctx.Ledger.CheckTransfer(&t); err != nil {
+			return err
+		}
+	}
+	available, err := vm.balance(Value{Type: ValueNone}, token)
+	if err != nil {
+		return err
+	}
+	if available < t.Amount {
+		return fmt.Errorf("insufficient contract balance: has %d, need %d", available, t.Amount)
+	}
+
+	vm.transfers = append(vm.transfers, t)
+	return nil
+}
+
+// transferToken returns the token ID named by v; None is OBS
+func transferToken(v Value) (string, error) {
+	switch {
+	case v.Type == ValueNone:
+		return "", nil
+	case v.Type == ValueStr && v.Str != "":
+		return v.Str, nil
+	default:
+		return "", fmt.Errorf("token ID must be a non-empty str")
+	}
+}
@@ -25,12 +25,17 @@ const (
 	TokenFalse
 	TokenNone
 	TokenPass
+	TokenIn
+	TokenAnd
+	TokenOr
+	TokenNot
 
 	// Operators
 	TokenPlus
 	TokenMinus
 	TokenMultiply
 	TokenDivide
+	TokenModulo
 	TokenEqual
 	TokenNotEqual
 	TokenLess
@@ -62,18 +67,26 @@ const (
 
 // Token represents a lexical token
 type Token struct {
-	Type  TokenType
-	Value string
-	Line  int
+	Type   TokenType
+	Value  string
+	Line   int
+	Column int // 1-based byte offset within the line
+}
+
+// Pos returns the position of the token
+func (t Token) Pos() Pos {
+	return Pos{Line: t.Line, Column: t.Column}
 }
 
 // Lexer tokenizes OCL source code
 type Lexer struct {
-	input  string
-	pos    int
-	line   int
-	indent []int
-	tokens []Token
+	input     string
+	pos       int
+	line      int
+	lineStart int // Offset of the current line
+	indent    []int
+	depth     int // Open brackets; newlines inside them are ignored
+	tokens    []Token
 }
 
 // NewLexer creates a new lexer
@@ -89,14 +102,27 @@ func NewLexer(input string) *Lexer {
 
 // Tokenize converts source code to tokens
 func (l *Lexer) Tokenize() ([]Token, error) {
+	atLineStart := true
 	for l.pos < len(l.input) {
+		// Tokens take the column where scanning started
+		first, column := len(l.tokens), l.column()
+		if atLineStart {
+			if err := l.handleIndent(); err != nil {
+				return nil, err
+			}
+			l.setColumns(first, l.column())
+			atLineStart = false
+			continue
+		}
+
 		char := l.input[l.pos]
 
 		switch {
-		case char == ' ':
-			l.handleIndent()
+		case char == ' ' || char == '\t' || char == '\r':
+			l.pos++
 		case char == '\n':
 			l.handleNewline()
+			atLineStart = l.depth == 0
 		case char == '#':
 			l.skipComment()
 		case isLetter(char) || char == '_':
@@ -107,27 +133,96 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 			l.readString()
 		default:
 			if token := l.readOperator(); token.Type != TokenEOF {
+				switch token.Type {
+				case TokenLParen, TokenLBracket, TokenLBrace:
+					l.depth++
+				case TokenRParen, TokenRBracket, TokenRBrace:
+					if l.depth > 0 {
+						l.depth--
+					}
+				}
 				l.tokens = append(l.tokens, token)
 			} else {
-				return nil, fmt.Errorf("unexpected character: %c", char)
+				return nil, fmt.Errorf("%d:%d: unexpected character: %c", l.line, column, char)
 			}
 		}
+		l.setColumns(first, column)
+	}
+
+	// Terminate the last line and close any open blocks
+	first := len(l.tokens)
+	if n := len(l.tokens); n > 0 && l.tokens[n-1].Type != TokenNewline {
+		l.tokens = append(l.tokens, Token{Type: TokenNewline, Line: l.line})
+	}
+	for len(l.indent) > 1 {
+		l.indent = l.indent[:len(l.indent)-1]
+		l.tokens = append(l.tokens, Token{Type: TokenDedent, Line: l.line})
 	}
 
 	l.tokens = append(l.tokens, Token{Type: TokenEOF, Line: l.line})
+	l.setColumns(first, l.column())
 	return l.tokens, nil
 }
 
+// column returns the 1-based column of the current position
+func (l *Lexer) column() int {
+	return l.pos - l.lineStart + 1
+}
+
+// setColumns sets the column of the tokens from index first on
+func (l *Lexer) setColumns(first, column int) {
+	for i := first; i < len(l.tokens); i++ {
+		l.tokens[i].Column = column
+	}
+}
+
 // Helper functions for lexer
-func (l *Lexer) handleIndent() {
-	// Simplified indent handling
-	l.pos++
+
+// handleIndent measures the indentation of a new line and emits INDENT or
+// DEDENT tokens when it changes. Blank and comment-only lines are ignored.
+func (l *Lexer) handleIndent() error {
+	width := 0
+	for ; l.pos < len(l.input); l.pos++ {
+		if c := l.input[l.pos]; c == ' ' {
+			width++
+		} else if c == '\t' {
+			width += 4
+		} else {
+			break
+		}
+	}
+	if l.pos >= len(l.input) {
+		return nil
+	}
+	switch l.input[l.pos] {
+	case '\n', '\r', '#':
+		return nil
+	}
+
+	current := l.indent[len(l.indent)-1]
+	if width > current {
+		l.indent = append(l.indent, width)
+		l.tokens = append(l.tokens, Token{Type: TokenIndent, Line: l.line})
+		return nil
+	}
+	for width < l.indent[len(l.indent)-1] {
+		l.indent = l.indent[:len(l.indent)-1]
+		l.tokens = append(l.tokens, Token{Type: TokenDedent, Line: l.line})
+	}
+	if width != l.indent[len(l.indent)-1] {
+		return fmt.Errorf("%d:%d: unindent does not match any outer indentation level", l.line, l.column())
+	}
+	return nil
 }
 
 func (l *Lexer) handleNewline() {
+	// Only the first newline after a statement is significant
+	if n := len(l.tokens); l.depth == 0 && n > 0 && l.tokens[n-1].Type != TokenNewline {
+		l.tokens = append(l.tokens, Token{Type: TokenNewline, Line: l.line})
+	}
 	l.line++
 	l.pos++
-	l.tokens = append(l.tokens, Token{Type: TokenNewline, Line: l.line})
+	l.lineStart = l.pos
 }
 
 func (l *Lexer) skipComment() {
@@ -171,6 +266,14 @@ func (l *Lexer) readIdentifier() {
 		tokenType = TokenNone
 	case "pass":
 		tokenType = TokenPass
+	case "in":
+		tokenType = TokenIn
+	case "and":
+		tokenType = TokenAnd
+	case "or":
+		tokenType = TokenOr
+	case "not":
+		tokenType = TokenNot
 	default:
 		tokenType = TokenIdentifier
 	}
@@ -217,6 +320,8 @@ func (l *Lexer) readOperator() Token {
 		return Token{Type: TokenMultiply, Value: "*", Line: l.line}
 	case '/':
 		return Token{Type: TokenDivide, Value: "/", Line: l.line}
+	case '%':
+		return Token{Type: TokenModulo, Value: "%", Line: l.line}
 	case '=':
 		if l.pos < len(l.input) && l.input[l.pos] == '=' {
 			l.pos++
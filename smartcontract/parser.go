@@ -9,9 +9,26 @@ import (
 // AST Node types
 type Node interface {
 	String() string
+	Position() Pos
+}
+
+// Pos is a position in the source, as line:column
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Position returns the position; nodes embed Pos to implement Node
+func (p Pos) Position() Pos {
+	return p
 }
 
 type Program struct {
+	Pos
 	Statements []Node
 }
 
@@ -24,6 +41,7 @@ func (p *Program) String() string {
 }
 
 type ContractDecl struct {
+	Pos
 	Name       string
 	Statements []Node
 }
@@ -37,6 +55,7 @@ func (c *ContractDecl) String() string {
 }
 
 type FunctionDecl struct {
+	Pos
 	Name       string
 	Parameters []string
 	Body       []Node
@@ -58,6 +77,7 @@ func (f *FunctionDecl) String() string {
 }
 
 type IfStmt struct {
+	Pos
 	Condition Node
 	ThenBody  []Node
 	ElseBody  []Node
@@ -77,7 +97,39 @@ func (i *IfStmt) String() string {
 	return result
 }
 
+type WhileStmt struct {
+	Pos
+	Condition Node
+	Body      []Node
+}
+
+func (w *WhileStmt) String() string {
+	result := fmt.Sprintf("while %s:\n", w.Condition.String())
+	for _, stmt := range w.Body {
+		result += "    " + stmt.String() + "\n"
+	}
+	return result
+}
+
+// ForStmt is a loop over range(stop), range(start, stop) or
+// range(start, stop, step)
+type ForStmt struct {
+	Pos
+	Variable string
+	Iterable Node
+	Body     []Node
+}
+
+func (f *ForStmt) String() string {
+	result := fmt.Sprintf("for %s in %s:\n", f.Variable, f.Iterable.String())
+	for _, stmt := range f.Body {
+		result += "    " + stmt.String() + "\n"
+	}
+	return result
+}
+
 type AssignStmt struct {
+	Pos
 	Target Node
 	Value  Node
 }
@@ -87,6 +139,7 @@ func (a *AssignStmt) String() string {
 }
 
 type ReturnStmt struct {
+	Pos
 	Value Node
 }
 
@@ -97,13 +150,16 @@ func (r *ReturnStmt) String() string {
 	return fmt.Sprintf("return %s", r.Value.String())
 }
 
-type PassStmt struct{}
+type PassStmt struct {
+	Pos
+}
 
 func (p *PassStmt) String() string {
 	return "pass"
 }
 
 type ExprStmt struct {
+	Pos
 	Expression Node
 }
 
@@ -112,6 +168,7 @@ func (e *ExprStmt) String() string {
 }
 
 type BinaryExpr struct {
+	Pos
 	Left  Node
 	Op    string
 	Right Node
@@ -122,6 +179,7 @@ func (b *BinaryExpr) String() string {
 }
 
 type UnaryExpr struct {
+	Pos
 	Op    string
 	Right Node
 }
@@ -131,6 +189,7 @@ func (u *UnaryExpr) String() string {
 }
 
 type CallExpr struct {
+	Pos
 	Function  Node
 	Arguments []Node
 }
@@ -147,6 +206,7 @@ func (c *CallExpr) String() string {
 }
 
 type AttributeExpr struct {
+	Pos
 	Object    Node
 	Attribute string
 }
@@ -155,7 +215,51 @@ func (a *AttributeExpr) String() string {
 	return fmt.Sprintf("%s.%s", a.Object.String(), a.Attribute)
 }
 
+type IndexExpr struct {
+	Pos
+	Object Node
+	Index  Node
+}
+
+func (i *IndexExpr) String() string {
+	return fmt.Sprintf("%s[%s]", i.Object.String(), i.Index.String())
+}
+
+type ListLiteral struct {
+	Pos
+	Elements []Node
+}
+
+func (l *ListLiteral) String() string {
+	elements := ""
+	for i, element := range l.Elements {
+		if i > 0 {
+			elements += ", "
+		}
+		elements += element.String()
+	}
+	return "[" + elements + "]"
+}
+
+type DictLiteral struct {
+	Pos
+	Keys   []Node
+	Values []Node
+}
+
+func (d *DictLiteral) String() string {
+	entries := ""
+	for i := range d.Keys {
+		if i > 0 {
+			entries += ", "
+		}
+		entries += d.Keys[i].String() + ": " + d.Values[i].String()
+	}
+	return "{" + entries + "}"
+}
+
 type Identifier struct {
+	Pos
 	Name string
 }
 
@@ -164,6 +268,7 @@ func (i *Identifier) String() string {
 }
 
 type NumberLiteral struct {
+	Pos
 	Value int64
 }
 
@@ -172,6 +277,7 @@ func (n *NumberLiteral) String() string {
 }
 
 type StringLiteral struct {
+	Pos
 	Value string
 }
 
@@ -179,7 +285,16 @@ func (s *StringLiteral) String() string {
 	return fmt.Sprintf("\"%s\"", s.Value)
 }
 
+type NoneLiteral struct {
+	Pos
+}
+
+func (n *NoneLiteral) String() string {
+	return "None"
+}
+
 type BoolLiteral struct {
+	Pos
 	Value bool
 }
 
@@ -204,9 +319,16 @@ func NewParser(tokens []Token) *Parser {
 	}
 }
 
-func (p *Parser) Parse() (*Program, error) {
+func (p *Parser) Parse() (program *Program, err error) {
+	// expect panics on unexpected tokens; report them as parse errors
+	defer func() {
+		if r := recover(); r != nil {
+			program, err = nil, fmt.Errorf("%s: %v", p.current.Pos(), r)
+		}
+	}()
+
 	p.advance()
-	program := &Program{}
+	program = &Program{}
 
 	for p.current.Type != TokenEOF {
 		stmt, err := p.parseStatement()
@@ -227,12 +349,17 @@ func (p *Parser) parseStatement() (Node, error) {
 		return p.parseFunctionDecl()
 	case TokenIf:
 		return p.parseIfStmt()
+	case TokenWhile:
+		return p.parseWhileStmt()
+	case TokenFor:
+		return p.parseForStmt()
 	case TokenReturn:
 		return p.parseReturnStmt()
 	case TokenPass:
+		pos := p.current.Pos()
 		p.expect(TokenPass)
 		p.expect(TokenNewline)
-		return &PassStmt{}, nil
+		return &PassStmt{Pos: pos}, nil
 	case TokenIdentifier:
 		// Could be assignment or expression statement
 		if p.peek().Type == TokenAssign {
@@ -244,12 +371,23 @@ func (p *Parser) parseStatement() (Node, error) {
 		if err != nil {
 			return nil, err
 		}
+		// Attribute targets such as self.x = 1
+		if p.current.Type == TokenAssign {
+			p.expect(TokenAssign)
+			value, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			p.expect(TokenNewline)
+			return &AssignStmt{Pos: expr.Position(), Target: expr, Value: value}, nil
+		}
 		p.expect(TokenNewline)
-		return &ExprStmt{Expression: expr}, nil
+		return &ExprStmt{Pos: expr.Position(), Expression: expr}, nil
 	}
 }
 
 func (p *Parser) parseContractDecl() (Node, error) {
+	pos := p.current.Pos()
 	p.expect(TokenContract)
 	name := p.current.Value
 	p.expect(TokenIdentifier)
@@ -267,10 +405,11 @@ func (p *Parser) parseContractDecl() (Node, error) {
 	}
 	p.expect(TokenDedent)
 
-	return &ContractDecl{Name: name, Statements: statements}, nil
+	return &ContractDecl{Pos: pos, Name: name, Statements: statements}, nil
 }
 
 func (p *Parser) parseFunctionDecl() (Node, error) {
+	pos := p.current.Pos()
 	p.expect(TokenDef)
 	name := p.current.Value
 	p.expect(TokenIdentifier)
@@ -278,13 +417,19 @@ func (p *Parser) parseFunctionDecl() (Node, error) {
 
 	parameters := []string{}
 	if p.current.Type != TokenRParen {
-		param := p.current.Value
-		p.expect(TokenIdentifier)
-		parameters = append(parameters, param)
+		// Methods take self as their first parameter
+		if p.current.Type == TokenSelf {
+			p.expect(TokenSelf)
+			parameters = append(parameters, "self")
+		} else {
+			param := p.current.Value
+			p.expect(TokenIdentifier)
+			parameters = append(parameters, param)
+		}
 
 		for p.current.Type == TokenComma {
 			p.expect(TokenComma)
-			param = p.current.Value
+			param := p.current.Value
 			p.expect(TokenIdentifier)
 			parameters = append(parameters, param)
 		}
@@ -304,47 +449,94 @@ func (p *Parser) parseFunctionDecl() (Node, error) {
 	}
 	p.expect(TokenDedent)
 
-	return &FunctionDecl{Name: name, Parameters: parameters, Body: body}, nil
+	return &FunctionDecl{Pos: pos, Name: name, Parameters: parameters, Body: body}, nil
 }
 
 func (p *Parser) parseIfStmt() (Node, error) {
-	p.expect(TokenIf)
+	// elif chains parse as nested if statements in the else branch
+	pos := p.current.Pos()
+	if p.current.Type == TokenElif {
+		p.expect(TokenElif)
+	} else {
+		p.expect(TokenIf)
+	}
 	condition, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
 	p.expect(TokenColon)
-	p.expect(TokenNewline)
+	thenBody, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
 
-	thenBody := []Node{}
-	p.expect(TokenIndent)
-	for p.current.Type != TokenDedent && p.current.Type != TokenEOF && p.current.Type != TokenElse {
-		stmt, err := p.parseStatement()
+	var elseBody []Node
+	switch p.current.Type {
+	case TokenElif:
+		elif, err := p.parseIfStmt()
 		if err != nil {
 			return nil, err
 		}
-		thenBody = append(thenBody, stmt)
-	}
-
-	var elseBody []Node
-	if p.current.Type == TokenElse {
+		elseBody = []Node{elif}
+	case TokenElse:
 		p.expect(TokenElse)
 		p.expect(TokenColon)
-		p.expect(TokenNewline)
-		p.expect(TokenIndent)
-		for p.current.Type != TokenDedent && p.current.Type != TokenEOF {
-			stmt, err := p.parseStatement()
-			if err != nil {
-				return nil, err
-			}
-			elseBody = append(elseBody, stmt)
+		elseBody, err = p.parseBlock()
+		if err != nil {
+			return nil, err
 		}
-		p.expect(TokenDedent)
-	} else {
-		p.expect(TokenDedent)
 	}
 
-	return &IfStmt{Condition: condition, ThenBody: thenBody, ElseBody: elseBody}, nil
+	return &IfStmt{Pos: pos, Condition: condition, ThenBody: thenBody, ElseBody: elseBody}, nil
+}
+
+func (p *Parser) parseWhileStmt() (Node, error) {
+	pos := p.current.Pos()
+	p.expect(TokenWhile)
+	condition, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	p.expect(TokenColon)
+	body, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &WhileStmt{Pos: pos, Condition: condition, Body: body}, nil
+}
+
+func (p *Parser) parseForStmt() (Node, error) {
+	pos := p.current.Pos()
+	p.expect(TokenFor)
+	variable := p.current.Value
+	p.expect(TokenIdentifier)
+	p.expect(TokenIn)
+	iterable, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	p.expect(TokenColon)
+	body, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &ForStmt{Pos: pos, Variable: variable, Iterable: iterable, Body: body}, nil
+}
+
+// parseBlock parses an indented block following a colon
+func (p *Parser) parseBlock() ([]Node, error) {
+	p.expect(TokenNewline)
+	p.expect(TokenIndent)
+	body := []Node{}
+	for p.current.Type != TokenDedent && p.current.Type != TokenEOF {
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmt)
+	}
+	p.expect(TokenDedent)
+	return body, nil
 }
 
 func (p *Parser) parseAssignStmt() (Node, error) {
@@ -358,10 +550,11 @@ func (p *Parser) parseAssignStmt() (Node, error) {
 		return nil, err
 	}
 	p.expect(TokenNewline)
-	return &AssignStmt{Target: target, Value: value}, nil
+	return &AssignStmt{Pos: target.Position(), Target: target, Value: value}, nil
 }
 
 func (p *Parser) parseReturnStmt() (Node, error) {
+	pos := p.current.Pos()
 	p.expect(TokenReturn)
 	var value Node
 	if p.current.Type != TokenNewline {
@@ -372,7 +565,7 @@ func (p *Parser) parseReturnStmt() (Node, error) {
 		}
 	}
 	p.expect(TokenNewline)
-	return &ReturnStmt{Value: value}, nil
+	return &ReturnStmt{Pos: pos, Value: value}, nil
 }
 
 func (p *Parser) parseExpression() (Node, error) {
@@ -391,60 +584,99 @@ func (p *Parser) parseBinaryExpr(precedence int) (Node, error) {
 			break
 		}
 
+		pos := p.current.Pos()
 		p.advance()
 		right, err := p.parseBinaryExpr(p.getPrecedence(op))
 		if err != nil {
 			return nil, err
 		}
 
-		left = &BinaryExpr{Left: left, Op: op, Right: right}
+		left = &BinaryExpr{Pos: pos, Left: left, Op: op, Right: right}
 	}
 
 	return left, nil
 }
 
 func (p *Parser) parseUnaryExpr() (Node, error) {
-	if p.current.Type == TokenMinus {
+	pos := p.current.Pos()
+	switch p.current.Type {
+	case TokenMinus:
 		p.expect(TokenMinus)
 		right, err := p.parseUnaryExpr()
 		if err != nil {
 			return nil, err
 		}
-		return &UnaryExpr{Op: "-", Right: right}, nil
+		return &UnaryExpr{Pos: pos, Op: "-", Right: right}, nil
+	case TokenNot:
+		// not binds more loosely than comparisons
+		p.expect(TokenNot)
+		right, err := p.parseBinaryExpr(p.getPrecedence("not"))
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Pos: pos, Op: "not", Right: right}, nil
 	}
 
-	return p.parsePrimaryExpr()
+	return p.parsePostfixExpr()
 }
 
-func (p *Parser) parsePrimaryExpr() (Node, error) {
-	switch p.current.Type {
-	case TokenIdentifier:
-		name := p.current.Value
-		p.expect(TokenIdentifier)
-		if p.current.Type == TokenDot {
+// parsePostfixExpr parses attribute access, calls and indexing
+func (p *Parser) parsePostfixExpr() (Node, error) {
+	expr, err := p.parsePrimaryExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch p.current.Type {
+		case TokenDot:
 			p.expect(TokenDot)
 			attr := p.current.Value
 			p.expect(TokenIdentifier)
-			return &AttributeExpr{Object: &Identifier{Name: name}, Attribute: attr}, nil
-		}
-		if p.current.Type == TokenLParen {
-			return p.parseCallExpr(&Identifier{Name: name})
+			expr = &AttributeExpr{Pos: expr.Position(), Object: expr, Attribute: attr}
+		case TokenLParen:
+			expr, err = p.parseCallExpr(expr)
+			if err != nil {
+				return nil, err
+			}
+		case TokenLBracket:
+			p.expect(TokenLBracket)
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			p.expect(TokenRBracket)
+			expr = &IndexExpr{Pos: expr.Position(), Object: expr, Index: index}
+		default:
+			return expr, nil
 		}
-		return &Identifier{Name: name}, nil
+	}
+}
+
+func (p *Parser) parsePrimaryExpr() (Node, error) {
+	pos := p.current.Pos()
+	switch p.current.Type {
+	case TokenIdentifier, TokenSelf:
+		name := p.current.Value
+		p.advance()
+		return &Identifier{Pos: pos, Name: name}, nil
 	case TokenNumber:
 		value, _ := strconv.ParseInt(p.current.Value, 10, 64)
 		p.expect(TokenNumber)
-		return &NumberLiteral{Value: value}, nil
+		return &NumberLiteral{Pos: pos, Value: value}, nil
 	case TokenString:
 		value := p.current.Value
 		p.expect(TokenString)
-		return &StringLiteral{Value: value}, nil
+		return &StringLiteral{Pos: pos, Value: value}, nil
 	case TokenTrue:
 		p.expect(TokenTrue)
-		return &BoolLiteral{Value: true}, nil
+		return &BoolLiteral{Pos: pos, Value: true}, nil
 	case TokenFalse:
 		p.expect(TokenFalse)
-		return &BoolLiteral{Value: false}, nil
+		return &BoolLiteral{Pos: pos, Value: false}, nil
+	case TokenNone:
+		p.expect(TokenNone)
+		return &NoneLiteral{Pos: pos}, nil
 	case TokenLParen:
 		p.expect(TokenLParen)
 		expr, err := p.parseExpression()
@@ -453,9 +685,56 @@ func (p *Parser) parsePrimaryExpr() (Node, error) {
 		}
 		p.expect(TokenRParen)
 		return expr, nil
+	case TokenLBracket:
+		return p.parseListLiteral()
+	case TokenLBrace:
+		return p.parseDictLiteral()
 	default:
-		return nil, fmt.Errorf("unexpected token: %v", p.current)
+		return nil, fmt.Errorf("%s: unexpected token: %v", pos, p.current)
+	}
+}
+
+func (p *Parser) parseListLiteral() (Node, error) {
+	pos := p.current.Pos()
+	p.expect(TokenLBracket)
+	elements := []Node{}
+	for p.current.Type != TokenRBracket {
+		element, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		if p.current.Type != TokenComma {
+			break
+		}
+		p.expect(TokenComma)
+	}
+	p.expect(TokenRBracket)
+	return &ListLiteral{Pos: pos, Elements: elements}, nil
+}
+
+func (p *Parser) parseDictLiteral() (Node, error) {
+	dict := &DictLiteral{Pos: p.current.Pos()}
+	p.expect(TokenLBrace)
+	for p.current.Type != TokenRBrace {
+		key, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		p.expect(TokenColon)
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		dict.Keys = append(dict.Keys, key)
+		dict.Values = append(dict.Values, value)
+		if p.current.Type != TokenComma {
+			break
+		}
+		p.expect(TokenComma)
 	}
+	p.expect(TokenRBrace)
+	return dict, nil
 }
 
 func (p *Parser) parseCallExpr(function Node) (Node, error) {
@@ -478,7 +757,7 @@ func (p *Parser) parseCallExpr(function Node) (Node, error) {
 		}
 	}
 	p.expect(TokenRParen)
-	return &CallExpr{Function: function, Arguments: arguments}, nil
+	return &CallExpr{Pos: function.Position(), Function: function, Arguments: arguments}, nil
 }
 
 func (p *Parser) getBinaryOp() string {
@@ -491,6 +770,8 @@ func (p *Parser) getBinaryOp() string {
 		return "*"
 	case TokenDivide:
 		return "/"
+	case TokenModulo:
+		return "%"
 	case TokenEqual:
 		return "=="
 	case TokenNotEqual:
@@ -503,6 +784,10 @@ func (p *Parser) getBinaryOp() string {
 		return "<="
 	case TokenGreaterEqual:
 		return ">="
+	case TokenAnd:
+		return "and"
+	case TokenOr:
+		return "or"
 	default:
 		return ""
 	}
@@ -510,7 +795,7 @@ func (p *Parser) getBinaryOp() string {
 
 func (p *Parser) getPrecedence(op string) int {
 	switch op {
-	case "*", "/":
+	case "*", "/", "%":
 		return 7
 	case "+", "-":
 		return 6
@@ -518,6 +803,12 @@ func (p *Parser) getPrecedence(op string) int {
 		return 5
 	case "==", "!=":
 		return 4
+	case "not":
+		return 3
+	case "and":
+		return 2
+	case "or":
+		return 1
 	default:
 		return 0
 	}
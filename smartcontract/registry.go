@@ -0,0 +1,40 @@
+// Deployed contract records
+package smartcontract
+
+import (
+	"obsidian-core/wire"
+	"sort"
+)
+
+// FunctionABI describes a callable contract function
+type FunctionABI struct {
+	Name   string
+	Params []string
+}
+
+// ContractRecord is a deployed contract as stored by the chain
+type ContractRecord struct {
+	Address  string
+	Deployer string
+	Nonce    uint64
+	TxHash   wire.Hash
+	Height   int32
+	Code     []byte // Verified bytecode, as deployed
+	ABI      []FunctionABI
+}
+
+// ABI returns the contract's functions sorted by name
+func (c *CompiledContract) ABI() []FunctionABI {
+	abi := make([]FunctionABI, 0, len(c.Functions))
+	for _, fn := range c.Functions {
+		abi = append(abi, FunctionABI{Name: fn.Name, Params: append([]string(nil), fn.Params...)})
+	}
+	sort.Slice(abi, func(i, j int) bool { return abi[i].Name < abi[j].Name })
+	return abi
+}
+
+// Contract decodes the record's bytecode, which was verified when the
+// contract was deployed
+func (r *ContractRecord) Contract() (*CompiledContract, error) {
+	return DecodeBytecode(r.Code)
+}
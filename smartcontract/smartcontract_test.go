@@ -1,6 +1,8 @@
 package smartcontract
 
 import (
+	"encoding/binary"
+	"strings"
 	"testing"
 )
 
@@ -63,3 +65,415 @@ func TestVM(t *testing.T) {
 		t.Errorf("Expected 8, got %v", result)
 	}
 }
+
+// compileSource lexes, parses and compiles OCL source
+func compileSource(t *testing.T, source string) *CompiledContract {
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer error: %v", err)
+	}
+	ast, err := NewParser(tokens).Parse()
+	if err != nil {
+		t.Fatalf("Parser error: %v", err)
+	}
+	contract, err := NewCompiler().CompileContract(ast)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	return contract
+}
+
+func TestFunctionCalls(t *testing.T) {
+	source := `
+contract Math:
+    base = 10
+
+    def add(self, a, b):
+        return a + b
+
+    def offset(self, x):
+        # Locals shadow globals and do not leak
+        tmp = x + base
+        return tmp
+
+    def fact(self, n):
+        if n <= 1:
+            return 1
+        else:
+            return n * self.fact(n - 1)
+
+    def noop(self):
+        pass
+`
+	contract := compileSource(t, source)
+	vm := NewContractVM(contract)
+	if _, err := vm.Execute(); err != nil {
+		t.Fatalf("Top-level execution failed: %v", err)
+	}
+
+	tests := []struct {
+		function string
+		args     []Value
+		want     Value
+	}{
+		{"add", []Value{{Type: ValueInt, Int: 2}, {Type: ValueInt, Int: 3}}, Value{Type: ValueInt, Int: 5}},
+		{"add", []Value{{Type: ValueStr, Str: "ob"}, {Type: ValueStr, Str: "s"}}, Value{Type: ValueStr, Str: "obs"}},
+		{"offset", []Value{{Type: ValueInt, Int: 5}}, Value{Type: ValueInt, Int: 15}},
+		{"fact", []Value{{Type: ValueInt, Int: 10}}, Value{Type: ValueInt, Int: 3628800}},
+		{"noop", nil, Value{Type: ValueNone}},
+	}
+	for _, test := range tests {
+		got, err := vm.Call(test.function, test.args)
+		if err != nil {
+			t.Errorf("%s failed: %v", test.function, err)
+			continue
+		}
+		if !valuesEqual(got, test.want) {
+			t.Errorf("%s = %+v, want %+v", test.function, got, test.want)
+		}
+	}
+
+	if _, ok := vm.vars["tmp"]; ok {
+		t.Error("Local variable leaked into globals")
+	}
+	if _, err := vm.Call("add", []Value{{Type: ValueInt, Int: 1}}); err == nil {
+		t.Error("Expected arity error")
+	}
+	if _, err := vm.Call("missing", nil); err == nil {
+		t.Error("Expected undefined function error")
+	}
+}
+
+func TestCallDepthLimit(t *testing.T) {
+	source := `
+def forever(n):
+    return forever(n + 1)
+`
+	vm := NewContractVM(compileSource(t, source))
+	_, err := vm.Call("forever", []Value{{Type: ValueInt, Int: 0}})
+	if err == nil || !strings.Contains(err.Error(), "maximum call depth") {
+		t.Errorf("Expected call depth error, got %v", err)
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	tokens, err := NewLexer("def broken(:\n    pass\n").Tokenize()
+	if err != nil {
+		t.Fatalf("Lexer error: %v", err)
+	}
+	if _, err := NewParser(tokens).Parse(); err == nil {
+		t.Error("Expected parse error")
+	}
+
+	if _, err := NewLexer("if x:\n        a = 1\n    b = 2\n").Tokenize(); err == nil {
+		t.Error("Expected inconsistent indentation error")
+	}
+}
+
+func TestLoopsAndCollections(t *testing.T) {
+	source := `
+def sum_range(n):
+    total = 0
+    for i in range(n):
+        total = total + i
+    return total
+
+def countdown():
+    steps = [0, 0, 0]
+    for i in range(3, 0, -1):
+        steps[3 - i] = i
+    return steps
+
+def collatz(n):
+    steps = 0
+    while n != 1:
+        if n % 2 == 0:
+            n = n / 2
+        elif n % 3 == 0 and not n == 3:
+            n = n / 3
+        else:
+            n = 3 * n + 1
+        steps = steps + 1
+    return steps
+
+def lookup(key):
+    table = {"a": 1, "b": [2, 3]}
+    table["c"] = len(table)
+    if key == "b" or key == "x":
+        return table["b"][-1]
+    return table[key]
+`
+	vm := NewContractVM(compileSource(t, source))
+
+	tests := []struct {
+		function string
+		args     []Value
+		want     Value
+	}{
+		{"sum_range", []Value{{Type: ValueInt, Int: 5}}, Value{Type: ValueInt, Int: 10}},
+		{"countdown", nil, Value{Type: ValueList, List: []Value{{Type: ValueInt, Int: 3}, {Type: ValueInt, Int: 2}, {Type: ValueInt, Int: 1}}}},
+		{"collatz", []Value{{Type: ValueInt, Int: 6}}, Value{Type: ValueInt, Int: 8}},
+		{"lookup", []Value{{Type: ValueStr, Str: "b"}}, Value{Type: ValueInt, Int: 3}},
+		{"lookup", []Value{{Type: ValueStr, Str: "c"}}, Value{Type: ValueInt, Int: 2}},
+	}
+	for _, test := range tests {
+		got, err := vm.Call(test.function, test.args)
+		if err != nil {
+			t.Errorf("%s failed: %v", test.function, err)
+			continue
+		}
+		if !valuesEqual(got, test.want) {
+			t.Errorf("%s = %+v, want %+v", test.function, got, test.want)
+		}
+	}
+
+	if _, err := vm.Call("lookup", []Value{{Type: ValueStr, Str: "z"}}); err == nil {
+		t.Error("Expected missing key error")
+	}
+}
+
+func TestNestedCollections(t *testing.T) {
+	source := `
+def nest():
+    l = [1]
+    l[0] = l
+    self.x = l
+    return self.x
+
+def deep(n):
+    l = []
+    for i in range(n):
+        l = [l]
+    self.x = l
+`
+	vm := NewContractVM(compileSource(t, source))
+	vm.SetStorage(NewWriteSet(nil), "nest")
+
+	// A list stored in itself holds a copy, not a cycle
+	got, err := vm.Call("nest", nil)
+	if err != nil {
+		t.Fatalf("nest failed: %v", err)
+	}
+	want := Value{Type: ValueList, List: []Value{{Type: ValueList, List: []Value{{Type: ValueInt, Int: 1}}}}}
+	if !valuesEqual(got, want) {
+		t.Errorf("nest = %+v, want %+v", got, want)
+	}
+
+	if _, err := vm.Call("deep", []Value{{Type: ValueInt, Int: MaxValueDepth - 1}}); err != nil {
+		t.Errorf("deep(%d) failed: %v", MaxValueDepth-1, err)
+	}
+	if _, err := vm.Call("deep", []Value{{Type: ValueInt, Int: MaxValueDepth + 1}}); err == nil {
+		t.Errorf("deep(%d) succeeded", MaxValueDepth+1)
+	}
+
+	// Encodings nested too deeply are rejected
+	data := []byte{byte(ValueInt), 0, 0, 0, 0, 0, 0, 0, 0}
+	for i := 0; i <= MaxValueDepth; i++ {
+		elem := binary.BigEndian.AppendUint32([]byte{byte(ValueList), 0, 0, 0, 1}, uint32(len(data)))
+		data = append(elem, data...)
+	}
+	if _, err := decodeValue(data); err == nil {
+		t.Error("decodeValue accepted a value nested too deeply")
+	}
+}
+
+func TestStorageMaps(t *testing.T) {
+	source := `
+def mint(to, amount):
+    self.balances[to] = amount
+
+def transfer(src, dst, amount):
+    if self.balances[src] == None or self.balances[src] < amount:
+        return False
+    if self.balances[dst] == None:
+        self.balances[dst] = 0
+    self.balances[src] = self.balances[src] - amount
+    self.balances[dst] = self.balances[dst] + amount
+    return True
+`
+	vm := NewContractVM(compileSource(t, source))
+	ws := NewWriteSet(nil)
+	vm.SetStorage(ws, "token")
+
+	str := func(s string) Value { return Value{Type: ValueStr, Str: s} }
+	num := func(n int64) Value { return Value{Type: ValueInt, Int: n} }
+	if _, err := vm.Call("mint", []Value{str("alice"), num(100)}); err != nil {
+		t.Fatalf("mint failed: %v", err)
+	}
+	if ok, err := vm.Call("transfer", []Value{str("alice"), str("bob"), num(30)}); err != nil || !ok.Bool {
+		t.Fatalf("transfer = %+v, %v", ok, err)
+	}
+	if ok, _ := vm.Call("transfer", []Value{str("bob"), str("carol"), num(31)}); ok.Bool {
+		t.Error("Overdraft succeeded")
+	}
+
+	// Each entry is its own slot
+	for holder, want := range map[string]int64{"alice": 70, "bob": 30} {
+		got, ok, _ := ws.Get("token", mapSlot("balances", DictKey{Type: ValueStr, Str: holder}))
+		if !ok || got.Int != want {
+			t.Errorf("balances[%s] = %+v, want %d", holder, got, want)
+		}
+	}
+
+	// Collections survive the storage encoding
+	dict := Value{Type: ValueDict, Dict: map[DictKey]Value{
+		{Type: ValueStr, Str: "k"}: {Type: ValueList, List: []Value{num(1), str("x")}},
+		{Type: ValueInt, Int: 7}:   {Type: ValueBool, Bool: true},
+	}}
+	encoded, err := encodeValue(dict)
+	if err != nil {
+		t.Fatalf("encodeValue failed: %v", err)
+	}
+	if size, _ := encodedSize(dict); size != len(encoded) {
+		t.Errorf("encodedSize = %d, want %d", size, len(encoded))
+	}
+	decoded, err := decodeValue(encoded)
+	if err != nil || !valuesEqual(decoded, dict) {
+		t.Errorf("decodeValue = %+v, %v", decoded, err)
+	}
+}
+
+func TestEmitEvents(t *testing.T) {
+	source := `
+def pay(to, amount):
+    emit("Paid", {"to": to, "amount": amount})
+    emit("Done")
+    return amount
+
+def fail():
+    emit("Lost")
+    return missing
+`
+	vm := NewContractVM(compileSource(t, source))
+	vm.SetStorage(NewWriteSet(nil), "shop")
+
+	if _, err := vm.Call("pay", []Value{{Type: ValueStr, Str: "bob"}, {Type: ValueInt, Int: 5}}); err != nil {
+		t.Fatalf("pay failed: %v", err)
+	}
+	logs := vm.Logs()
+	if len(logs) != 2 || logs[0].Topic != "Paid" || logs[0].Contract != "shop" || logs[1].Data.Type != ValueNone {
+		t.Fatalf("Unexpected logs %+v", logs)
+	}
+	if amount := logs[0].Data.Dict[DictKey{Type: ValueStr, Str: "amount"}]; amount.Int != 5 {
+		t.Errorf("Logged amount = %+v, want 5", amount)
+	}
+
+	// A failed execution drops its events
+	if _, err := vm.Call("fail", nil); err == nil {
+		t.Fatal("Expected fail() to fail")
+	}
+	if len(vm.Logs()) != 2 {
+		t.Errorf("Failed call left %d logs, want 2", len(vm.Logs()))
+	}
+
+	tokens, _ := NewLexer("def f():\n    emit()\n").Tokenize()
+	ast, _ := NewParser(tokens).Parse()
+	if _, err := NewCompiler().CompileContract(ast); err == nil {
+		t.Error("Expected emit() without a topic to be rejected")
+	}
+}
+
+func TestCallDataRoundTrip(t *testing.T) {
+	call := &CallData{
+		Contract: "obcContract",
+		Function: "transfer",
+		Args:     []Value{{Type: ValueStr, Str: "bob"}, {Type: ValueInt, Int: -3}, {Type: ValueList}},
+	}
+	data, err := EncodeCallData(call)
+	if err != nil {
+		t.Fatalf("EncodeCallData failed: %v", err)
+	}
+
+	decoded, err := DecodeCallData(data)
+	if err != nil {
+		t.Fatalf("DecodeCallData failed: %v", err)
+	}
+	if decoded.Contract != call.Contract || decoded.Function != call.Function ||
+		!valuesEqual(Value{Type: ValueList, List: decoded.Args}, Value{Type: ValueList, List: call.Args}) {
+		t.Errorf("Decoded %+v, want %+v", decoded, call)
+	}
+
+	for i := range data {
+		if _, err := DecodeCallData(data[:i]); err == nil {
+			t.Errorf("Prefix of %d bytes decoded", i)
+		}
+	}
+}
+
+// testLedger holds balances in memory; token balances are keyed by
+// token + ":" + address
+type testLedger map[string]int64
+
+func (l testLedger) Balance(address string) (int64, error) { return l[address], nil }
+
+func (l testLedger) TokenBalance(token, address string) (int64, error) {
+	return l[token+":"+address], nil
+}
+
+func (l testLedger) CheckTransfer(transfer *Transfer) error { return nil }
+
+func TestContractTransfers(t *testing.T) {
+	source := `
+def withdraw(amount):
+    transfer(msg.sender, amount)
+    return balance_of(self)
+
+def pay_token(token, to, amount):
+    token_transfer(token, to, amount)
+    return balance_of(to, token)
+
+def pay_then_fail(amount):
+    transfer(msg.sender, amount)
+    return missing
+
+def info():
+    return [msg.sender, msg.value, block.height, block.timestamp]
+`
+	vm := NewContractVM(compileSource(t, source))
+	vm.SetStorage(NewWriteSet(nil), "escrow")
+	vm.SetContext(&Context{
+		Sender:    "alice",
+		Value:     7,
+		Height:    12,
+		Timestamp: 1700000000,
+		Ledger:    testLedger{"escrow": 100, "tok:escrow": 50},
+	})
+	num := func(n int64) Value { return Value{Type: ValueInt, Int: n} }
+	str := func(s string) Value { return Value{Type: ValueStr, Str: s} }
+
+	info, err := vm.Call("info", nil)
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if got := info.List; got[0].Str != "alice" || got[1].Int != 7 || got[2].Int != 12 || got[3].Int != 1700000000 {
+		t.Errorf("info() = %+v", got)
+	}
+
+	// Balances reflect the transfers recorded so far
+	if balance, err := vm.Call("withdraw", []Value{num(30)}); err != nil || balance.Int != 70 {
+		t.Fatalf("withdraw = %+v, %v", balance, err)
+	}
+	if balance, err := vm.Call("pay_token", []Value{str("tok"), str("bob"), num(20)}); err != nil || balance.Int != 20 {
+		t.Fatalf("pay_token = %+v, %v", balance, err)
+	}
+	if _, err := vm.Call("withdraw", []Value{num(71)}); err == nil {
+		t.Error("Overdraft succeeded")
+	}
+
+	// A failed execution drops its transfers
+	if _, err := vm.Call("pay_then_fail", []Value{num(10)}); err == nil {
+		t.Fatal("Expected pay_then_fail() to fail")
+	}
+	want := []Transfer{{To: "alice", Amount: 30}, {To: "bob", Token: "tok", Amount: 20}}
+	if got := vm.Transfers(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Transfers = %+v, want %+v", got, want)
+	}
+
+	for _, source := range []string{"def f():\n    return msg.gas\n", "def f():\n    transfer(1)\n"} {
+		tokens, _ := NewLexer(source).Tokenize()
+		ast, _ := NewParser(tokens).Parse()
+		if _, err := NewCompiler().CompileContract(ast); err == nil {
+			t.Errorf("Expected %q to be rejected", source)
+		}
+	}
+}
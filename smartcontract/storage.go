@@ -2,9 +2,30 @@
 package smartcontract
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"obsidian-core/database"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// contractsBucket maps "<contract>_<key>" -> encoded value
+	contractsBucket = []byte("contracts")
+
+	// contractUndoBucket maps block hash -> the storage changes made by the
+	// block, so they can be undone on disconnect
+	contractUndoBucket = []byte("contractundo")
+
+	// contractCodeBucket maps contract address -> ContractRecord
+	contractCodeBucket = []byte("contractcode")
+
+	// deployNonceBucket maps deployer address -> number of deployments
+	deployNonceBucket = []byte("contractnonces")
 )
 
 // ContractStorage manages persistent storage for contracts
@@ -49,3 +70,573 @@ func (cs *ContractStorage) Delete(contractAddr, key string) error {
 	storageKey := []byte(fmt.Sprintf("%s_%s", contractAddr, key))
 	return cs.db.Delete(bucket, storageKey)
 }
+
+// LoadValue retrieves a VM value for a contract. The bool reports whether
+// the key exists.
+func (cs *ContractStorage) LoadValue(contractAddr, key string) (Value, bool, error) {
+	var value Value
+	var found bool
+	err := cs.db.DB().View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(contractsBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get(storageKey(contractAddr, key))
+		if data == nil {
+			return nil
+		}
+
+		var err error
+		value, err = decodeValue(data)
+		found = err == nil
+		return err
+	})
+	return value, found, err
+}
+
+// HasValue reports whether a contract has a value stored under key
+func (cs *ContractStorage) HasValue(contractAddr, key string) (bool, error) {
+	var found bool
+	err := cs.db.DB().View(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket(contractsBucket); bucket != nil {
+			found = bucket.Get(storageKey(contractAddr, key)) != nil
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Commit atomically applies a write set and returns the changes needed to
+// undo it
+func (cs *ContractStorage) Commit(ws *WriteSet) ([]StorageChange, error) {
+	var undo []StorageChange
+	err := cs.db.DB().Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(contractsBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, slot := range ws.Slots() {
+			key := storageKey(slot.Contract, slot.Key)
+			change := StorageChange{Contract: slot.Contract, Key: slot.Key}
+			if prev := bucket.Get(key); prev != nil {
+				change.Prev = append([]byte(nil), prev...)
+			}
+			undo = append(undo, change)
+
+			value := ws.writes[slot]
+			if value == nil {
+				err = bucket.Delete(key)
+			} else {
+				var data []byte
+				if data, err = encodeValue(*value); err != nil {
+					return fmt.Errorf("storage write %s: %v", key, err)
+				}
+				err = bucket.Put(key, data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// SaveBlockUndo records the storage changes made by a block
+func (cs *ContractStorage) SaveBlockUndo(blockHash []byte, undo []StorageChange) error {
+	if len(undo) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(undo); err != nil {
+		return err
+	}
+	return cs.db.Put(contractUndoBucket, blockHash, buf.Bytes())
+}
+
+// BlockUndo returns the storage changes made by a block
+func (cs *ContractStorage) BlockUndo(blockHash []byte) ([]StorageChange, error) {
+	var undo []StorageChange
+	err := cs.db.DB().View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(contractUndoBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get(blockHash)
+		if data == nil {
+			return nil
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid contract undo data: %v", err)
+	}
+	return undo, nil
+}
+
+// DisconnectBlock undoes the storage changes made by a block
+func (cs *ContractStorage) DisconnectBlock(blockHash []byte) error {
+	return cs.db.DB().Update(func(tx *bbolt.Tx) error {
+		index := tx.Bucket(contractUndoBucket)
+		if index == nil {
+			return nil // No block ever changed storage
+		}
+		data := index.Get(blockHash)
+		if data == nil {
+			return nil // Block made no storage changes
+		}
+
+		var undo []StorageChange
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo); err != nil {
+			return fmt.Errorf("invalid contract undo data: %v", err)
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists(contractsBucket)
+		if err != nil {
+			return err
+		}
+		if err := revertChanges(bucket, undo); err != nil {
+			return err
+		}
+		return index.Delete(blockHash)
+	})
+}
+
+// SaveContract stores a deployed contract
+func (cs *ContractStorage) SaveContract(record *ContractRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+	return cs.db.Put(contractCodeBucket, []byte(record.Address), buf.Bytes())
+}
+
+// LoadContract returns the deployed contract at address
+func (cs *ContractStorage) LoadContract(address string) (*ContractRecord, error) {
+	var record *ContractRecord
+	err := cs.db.DB().View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(contractCodeBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(address))
+		if data == nil {
+			return nil
+		}
+
+		record = &ContractRecord{}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid contract record: %v", err)
+	}
+	if record == nil {
+		return nil, fmt.Errorf("contract %s not found", address)
+	}
+	return record, nil
+}
+
+// DeleteContract removes a deployed contract
+func (cs *ContractStorage) DeleteContract(address string) error {
+	return cs.db.DB().Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(contractCodeBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(address))
+	})
+}
+
+// DeployNonce returns the number of contracts deployer has deployed
+func (cs *ContractStorage) DeployNonce(deployer string) (uint64, error) {
+	var nonce uint64
+	err := cs.db.DB().View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deployNonceBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(deployer))
+		if data == nil {
+			return nil
+		}
+		if len(data) != 8 {
+			return fmt.Errorf("invalid deploy nonce for %s", deployer)
+		}
+		nonce = binary.BigEndian.Uint64(data)
+		return nil
+	})
+	return nonce, err
+}
+
+// SetDeployNonce sets the number of contracts deployer has deployed
+func (cs *ContractStorage) SetDeployNonce(deployer string, nonce uint64) error {
+	if nonce == 0 {
+		return cs.db.DB().Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket(deployNonceBucket)
+			if bucket == nil {
+				return nil
+			}
+			return bucket.Delete([]byte(deployer))
+		})
+	}
+	return cs.db.Put(deployNonceBucket, []byte(deployer), binary.BigEndian.AppendUint64(nil, nonce))
+}
+
+// revertChanges restores previous values in reverse order
+func revertChanges(bucket *bbolt.Bucket, undo []StorageChange) error {
+	for i := len(undo) - 1; i >= 0; i-- {
+		change := undo[i]
+		key := storageKey(change.Contract, change.Key)
+
+		var err error
+		if change.Prev == nil {
+			err = bucket.Delete(key)
+		} else {
+			err = bucket.Put(key, change.Prev)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storageKey(contractAddr, key string) []byte {
+	return []byte(fmt.Sprintf("%s_%s", contractAddr, key))
+}
+
+// StorageSlot identifies one storage key of a contract
+type StorageSlot struct {
+	Contract string
+	Key      string
+}
+
+// StorageChange records the value a slot had before a commit. Prev is the
+// encoded value, or nil if the slot did not exist.
+type StorageChange struct {
+	Contract string
+	Key      string
+	Prev     []byte
+}
+
+// WriteSet buffers the storage writes of one transaction. Reads see the
+// buffered writes first and fall back to the parent write set, if any, and
+// then to the committed storage.
+type WriteSet struct {
+	storage *ContractStorage // nil for a throwaway, in-memory state
+	parent  *WriteSet
+	writes  map[StorageSlot]*Value
+}
+
+// NewWriteSet creates an empty write set on top of storage, which may be nil
+func NewWriteSet(storage *ContractStorage) *WriteSet {
+	return &WriteSet{
+		storage: storage,
+		writes:  make(map[StorageSlot]*Value),
+	}
+}
+
+// Child creates an empty write set layered on ws. Writes to the child do not
+// affect ws.
+func (ws *WriteSet) Child() *WriteSet {
+	return &WriteSet{
+		storage: ws.storage,
+		parent:  ws,
+		writes:  make(map[StorageSlot]*Value),
+	}
+}
+
+// Get returns the current value of a slot
+func (ws *WriteSet) Get(contractAddr, key string) (Value, bool, error) {
+	if value, ok := ws.writes[StorageSlot{contractAddr, key}]; ok {
+		if value == nil {
+			return Value{}, false, nil
+		}
+		copied, err := copyValue(*value)
+		if err != nil {
+			return Value{}, false, err
+		}
+		return copied, true, nil
+	}
+	if ws.parent != nil {
+		return ws.parent.Get(contractAddr, key)
+	}
+	if ws.storage == nil {
+		return Value{}, false, nil
+	}
+	return ws.storage.LoadValue(contractAddr, key)
+}
+
+// Has reports whether a slot holds a value, without loading it
+func (ws *WriteSet) Has(contractAddr, key string) (bool, error) {
+	if value, ok := ws.writes[StorageSlot{contractAddr, key}]; ok {
+		return value != nil, nil
+	}
+	if ws.parent != nil {
+		return ws.parent.Has(contractAddr, key)
+	}
+	if ws.storage == nil {
+		return false, nil
+	}
+	return ws.storage.HasValue(contractAddr, key)
+}
+
+// Set buffers a write. Setting None deletes the slot. Lists and dicts are
+// copied, so later changes to value are not stored.
+func (ws *WriteSet) Set(contractAddr, key string, value Value) error {
+	slot := StorageSlot{contractAddr, key}
+	if value.Type == ValueNone {
+		ws.writes[slot] = nil
+		return nil
+	}
+	value, err := copyValue(value)
+	if err != nil {
+		return err
+	}
+	ws.writes[slot] = &value
+	return nil
+}
+
+// Revert buffers the previous values recorded by changes, newest first, so
+// the write set shows storage as it was before they were committed
+func (ws *WriteSet) Revert(changes []StorageChange) error {
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		slot := StorageSlot{change.Contract, change.Key}
+		if change.Prev == nil {
+			ws.writes[slot] = nil
+			continue
+		}
+		value, err := decodeValue(change.Prev)
+		if err != nil {
+			return fmt.Errorf("invalid undo value for %s: %v", storageKey(change.Contract, change.Key), err)
+		}
+		ws.writes[slot] = &value
+	}
+	return nil
+}
+
+// Slots returns the written slots in a deterministic order
+func (ws *WriteSet) Slots() []StorageSlot {
+	slots := make([]StorageSlot, 0, len(ws.writes))
+	for slot := range ws.writes {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].Contract != slots[j].Contract {
+			return slots[i].Contract < slots[j].Contract
+		}
+		return slots[i].Key < slots[j].Key
+	})
+	return slots
+}
+
+// Len returns the number of written slots
+func (ws *WriteSet) Len() int {
+	return len(ws.writes)
+}
+
+// snapshot copies the buffered writes
+func (ws *WriteSet) snapshot() map[StorageSlot]*Value {
+	writes := make(map[StorageSlot]*Value, len(ws.writes))
+	for slot, value := range ws.writes {
+		writes[slot] = value
+	}
+	return writes
+}
+
+// encodeValue serializes a value as a type byte followed by its payload.
+// Elements of lists and dicts are length-prefixed; dict entries are sorted
+// so equal dicts encode identically.
+func encodeValue(v Value) ([]byte, error) {
+	return encodeValueDepth(v, 0)
+}
+
+// encodeValueDepth encodes v, which is nested in depth lists and dicts
+func encodeValueDepth(v Value, depth int) ([]byte, error) {
+	switch v.Type {
+	case ValueInt:
+		data := make([]byte, 9)
+		data[0] = byte(ValueInt)
+		binary.BigEndian.PutUint64(data[1:], uint64(v.Int))
+		return data, nil
+	case ValueStr:
+		return append([]byte{byte(ValueStr)}, v.Str...), nil
+	case ValueBool:
+		if v.Bool {
+			return []byte{byte(ValueBool), 1}, nil
+		}
+		return []byte{byte(ValueBool), 0}, nil
+	case ValueList:
+		if depth >= MaxValueDepth {
+			return nil, errValueTooDeep
+		}
+		data := binary.BigEndian.AppendUint32([]byte{byte(ValueList)}, uint32(len(v.List)))
+		for _, elem := range v.List {
+			var err error
+			if data, err = appendElement(data, elem, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	case ValueDict:
+		if depth >= MaxValueDepth {
+			return nil, errValueTooDeep
+		}
+		data := binary.BigEndian.AppendUint32([]byte{byte(ValueDict)}, uint32(len(v.Dict)))
+		for _, key := range sortedKeys(v.Dict) {
+			var err error
+			if data, err = appendElement(data, key.Value(), depth+1); err != nil {
+				return nil, err
+			}
+			if data, err = appendElement(data, v.Dict[key], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	default:
+		return []byte{byte(ValueNone)}, nil
+	}
+}
+
+// appendElement appends a length-prefixed encoded value
+func appendElement(data []byte, v Value, depth int) ([]byte, error) {
+	elem, err := encodeValueDepth(v, depth)
+	if err != nil {
+		return nil, err
+	}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(elem)))
+	return append(data, elem...), nil
+}
+
+// encodedSize returns the length of the encoding of v without building it
+func encodedSize(v Value) (int, error) {
+	return encodedSizeDepth(v, 0)
+}
+
+// encodedSizeDepth sizes v, which is nested in depth lists and dicts
+func encodedSizeDepth(v Value, depth int) (int, error) {
+	switch v.Type {
+	case ValueInt:
+		return 9, nil
+	case ValueStr:
+		return 1 + len(v.Str), nil
+	case ValueBool:
+		return 2, nil
+	case ValueList, ValueDict:
+		if depth >= MaxValueDepth {
+			return 0, errValueTooDeep
+		}
+		size := 5
+		add := func(elem Value) error {
+			n, err := encodedSizeDepth(elem, depth+1)
+			size += 4 + n
+			return err
+		}
+		for _, elem := range v.List {
+			if err := add(elem); err != nil {
+				return 0, err
+			}
+		}
+		for key, elem := range v.Dict {
+			if err := add(key.Value()); err != nil {
+				return 0, err
+			}
+			if err := add(elem); err != nil {
+				return 0, err
+			}
+		}
+		return size, nil
+	default:
+		return 1, nil
+	}
+}
+
+// decodeValue parses a value produced by encodeValue
+func decodeValue(data []byte) (Value, error) {
+	return decodeValueDepth(data, 0)
+}
+
+// decodeValueDepth decodes a value nested in depth lists and dicts
+func decodeValueDepth(data []byte, depth int) (Value, error) {
+	if len(data) == 0 {
+		return Value{}, fmt.Errorf("empty storage value")
+	}
+
+	switch ValueType(data[0]) {
+	case ValueInt:
+		if len(data) != 9 {
+			return Value{}, fmt.Errorf("invalid int storage value")
+		}
+		return Value{Type: ValueInt, Int: int64(binary.BigEndian.Uint64(data[1:]))}, nil
+	case ValueStr:
+		return Value{Type: ValueStr, Str: string(data[1:])}, nil
+	case ValueBool:
+		if len(data) != 2 {
+			return Value{}, fmt.Errorf("invalid bool storage value")
+		}
+		return Value{Type: ValueBool, Bool: data[1] == 1}, nil
+	case ValueNone:
+		return Value{Type: ValueNone}, nil
+	case ValueList, ValueDict:
+		if depth >= MaxValueDepth {
+			return Value{}, errValueTooDeep
+		}
+		if len(data) < 5 {
+			return Value{}, fmt.Errorf("invalid %s storage value", ValueType(data[0]))
+		}
+		n := binary.BigEndian.Uint32(data[1:5])
+		rest := data[5:]
+		// Every element takes at least five bytes
+		if uint64(n) > uint64(len(rest))/5 {
+			return Value{}, fmt.Errorf("invalid %s storage value", ValueType(data[0]))
+		}
+
+		if ValueType(data[0]) == ValueList {
+			list := make([]Value, n)
+			for i := range list {
+				var err error
+				if list[i], rest, err = readElement(rest, depth+1); err != nil {
+					return Value{}, err
+				}
+			}
+			return Value{Type: ValueList, List: list}, nil
+		}
+
+		dict := make(map[DictKey]Value, n)
+		for i := uint32(0); i < n; i++ {
+			keyVal, next, err := readElement(rest, depth+1)
+			if err != nil {
+				return Value{}, err
+			}
+			key, err := dictKey(keyVal)
+			if err != nil {
+				return Value{}, err
+			}
+			if dict[key], rest, err = readElement(next, depth+1); err != nil {
+				return Value{}, err
+			}
+		}
+		return Value{Type: ValueDict, Dict: dict}, nil
+	default:
+		return Value{}, fmt.Errorf("unknown storage value type %d", data[0])
+	}
+}
+
+// readElement reads a length-prefixed value and returns the remaining data
+func readElement(data []byte, depth int) (Value, []byte, error) {
+	if len(data) < 4 {
+		return Value{}, nil, fmt.Errorf("truncated storage value")
+	}
+	size := binary.BigEndian.Uint32(data)
+	if uint64(size) > uint64(len(data)-4) {
+		return Value{}, nil, fmt.Errorf("truncated storage value")
+	}
+	v, err := decodeValueDepth(data[4:4+size], depth)
+	return v, data[4+size:], err
+}
@@ -3,6 +3,8 @@ package smartcontract
 
 import (
 	"fmt"
+	"math"
+	"sort"
 )
 
 // Value types
@@ -13,21 +15,169 @@ const (
 	ValueStr
 	ValueBool
 	ValueNone
+	ValueList
+	ValueDict
 )
 
+// String returns the type name used in error messages
+func (t ValueType) String() string {
+	switch t {
+	case ValueInt:
+		return "int"
+	case ValueStr:
+		return "str"
+	case ValueBool:
+		return "bool"
+	case ValueNone:
+		return "None"
+	case ValueList:
+		return "list"
+	case ValueDict:
+		return "dict"
+	default:
+		return "unknown"
+	}
+}
+
+// Value is a VM value. Lists and dicts are references: copies of a value
+// share its elements. Values placed in a list or dict are copied, so
+// containers never share elements or contain themselves.
 type Value struct {
 	Type ValueType
 	Int  int64
 	Str  string
 	Bool bool
+	List []Value
+	Dict map[DictKey]Value
+}
+
+// ValueFromInterface converts a JSON-decoded argument to a VM value.
+// Numbers must be integral.
+func ValueFromInterface(v interface{}) (Value, error) {
+	switch x := v.(type) {
+	case nil:
+		return Value{Type: ValueNone}, nil
+	case bool:
+		return Value{Type: ValueBool, Bool: x}, nil
+	case string:
+		return Value{Type: ValueStr, Str: x}, nil
+	case int64:
+		return Value{Type: ValueInt, Int: x}, nil
+	case int:
+		return Value{Type: ValueInt, Int: int64(x)}, nil
+	case float64:
+		if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+			return Value{}, fmt.Errorf("%v is not an integer", x)
+		}
+		return Value{Type: ValueInt, Int: int64(x)}, nil
+	case []interface{}:
+		list := make([]Value, len(x))
+		for i, elem := range x {
+			val, err := ValueFromInterface(elem)
+			if err != nil {
+				return Value{}, err
+			}
+			list[i] = val
+		}
+		return Value{Type: ValueList, List: list}, nil
+	case map[string]interface{}:
+		dict := make(map[DictKey]Value, len(x))
+		for key, elem := range x {
+			val, err := ValueFromInterface(elem)
+			if err != nil {
+				return Value{}, err
+			}
+			dict[DictKey{Type: ValueStr, Str: key}] = val
+		}
+		return Value{Type: ValueDict, Dict: dict}, nil
+	default:
+		return Value{}, fmt.Errorf("unsupported argument type %T", v)
+	}
+}
+
+// Interface converts a value to its Go representation
+func (v Value) Interface() interface{} {
+	switch v.Type {
+	case ValueInt:
+		return v.Int
+	case ValueStr:
+		return v.Str
+	case ValueBool:
+		return v.Bool
+	case ValueList:
+		list := make([]interface{}, len(v.List))
+		for i, elem := range v.List {
+			list[i] = elem.Interface()
+		}
+		return list
+	case ValueDict:
+		// JSON object keys are strings
+		dict := make(map[string]interface{}, len(v.Dict))
+		for key, elem := range v.Dict {
+			if key.Type == ValueStr {
+				dict[key.Str] = elem.Interface()
+			} else {
+				dict[key.String()] = elem.Interface()
+			}
+		}
+		return dict
+	default:
+		return nil
+	}
+}
+
+// MaxCallDepth limits nested function calls, including recursion
+const MaxCallDepth = 64
+
+// Frame is the activation record of a function call
+type Frame struct {
+	function  string
+	returnPC  int              // Instruction to resume at in the caller
+	stackBase int              // Operand stack height when the call started
+	locals    map[string]Value // Arguments and local variables
+}
+
+// Function is the entry point of a compiled contract function
+type Function struct {
+	Name   string
+	Entry  int
+	Params []string // Parameter names, excluding self
+}
+
+// CallTarget is the argument of OpCall
+type CallTarget struct {
+	Name string
+	Argc int
+}
+
+// Log is an event emitted by a contract
+type Log struct {
+	Contract string
+	Topic    string
+	Data     Value
+}
+
+// CompiledContract is a compiled program together with its function table
+type CompiledContract struct {
+	Code      []Instruction
+	Functions map[string]*Function
 }
 
 // VM
 type VM struct {
-	stack   []Value
-	program []Instruction
-	pc      int
-	vars    map[string]Value
+	stack     []Value
+	program   []Instruction
+	pc        int
+	vars      map[string]Value // Globals set by top-level code
+	frames    []*Frame
+	functions map[string]*Function
+	gas       *GasMeter
+	peakStack int        // Highest stack depth paid for
+	storage   *WriteSet  // Backs self.<field>
+	contract  string     // Address whose storage self refers to
+	logs      []Log      // Events emitted so far
+	ctx       *Context   // Transaction and block being executed
+	transfers []Transfer // Transfers out of the contract so far
 }
 
 // Instruction types
@@ -56,6 +206,20 @@ const (
 	OpJumpIfFalse
 	OpGetAttr
 	OpSetAttr
+	OpPop
+	OpNot
+	OpMod
+	OpBuildList  // Arg: element count
+	OpBuildDict  // Arg: entry count; keys and values alternate
+	OpGetIndex   // container, index -> value
+	OpSetIndex   // value, container, index ->
+	OpLen        // value -> len(value)
+	OpGetMapItem // key -> self.<Arg>[key]
+	OpSetMapItem // value, key ->
+	OpEmit       // topic, data -> None
+	OpLoadEnv    // Arg: field such as "msg.sender"
+	OpBalance    // address, token -> balance; None token is OBS
+	OpTransfer   // token, to, amount -> None
 )
 
 type Instruction struct {
@@ -66,19 +230,254 @@ type Instruction struct {
 // NewVM creates a new VM
 func NewVM(program []Instruction) *VM {
 	return &VM{
-		stack:   []Value{},
-		program: program,
-		pc:      0,
-		vars:    make(map[string]Value),
+		stack:     []Value{},
+		program:   program,
+		pc:        0,
+		vars:      make(map[string]Value),
+		functions: make(map[string]*Function),
+		gas:       NewGasMeter(DefaultGasLimit),
+		storage:   NewWriteSet(nil),
+		ctx:       &Context{},
 	}
 }
 
+// SetStorage makes self.<field> read and write contract's slots through ws.
+// Writes stay buffered in ws until the caller commits it.
+func (vm *VM) SetStorage(ws *WriteSet, contract string) {
+	vm.storage = ws
+	vm.contract = contract
+}
+
+// Storage returns the write set backing self.<field>
+func (vm *VM) Storage() *WriteSet {
+	return vm.storage
+}
+
+// Logs returns the events emitted by successful executions
+func (vm *VM) Logs() []Log {
+	return vm.logs
+}
+
+// SetContext sets the transaction and block seen through msg, block,
+// balance_of() and transfer()
+func (vm *VM) SetContext(ctx *Context) {
+	vm.ctx = ctx
+}
+
+// Transfers returns the transfers recorded by successful executions
+func (vm *VM) Transfers() []Transfer {
+	return vm.transfers
+}
+
+// DiscardEffects drops the events and transfers recorded so far
+func (vm *VM) DiscardEffects() {
+	vm.logs = nil
+	vm.transfers = nil
+}
+
+// SetGasLimit resets the gas meter with a new limit
+func (vm *VM) SetGasLimit(limit uint64) {
+	vm.gas = NewGasMeter(limit)
+	vm.peakStack = 0
+}
+
+// GasUsed returns the gas consumed so far, less any refund earned
+func (vm *VM) GasUsed() uint64 {
+	return vm.gas.Used() - vm.gas.Refund()
+}
+
+// GasMeter returns the VM's gas meter
+func (vm *VM) GasMeter() *GasMeter {
+	return vm.gas
+}
+
+// NewContractVM creates a VM for a compiled contract, whose functions can be
+// invoked with Call
+func NewContractVM(contract *CompiledContract) *VM {
+	vm := NewVM(contract.Code)
+	for name, fn := range contract.Functions {
+		vm.functions[name] = fn
+	}
+	return vm
+}
+
 // Execute runs the program
 func (vm *VM) Execute() (Value, error) {
+	vm.pc = 0
+	vm.frames = []*Frame{{function: "<main>", returnPC: -1, locals: vm.vars}}
+	return vm.execute()
+}
+
+// Call invokes the named function with args and returns its result. Globals
+// set by a previous Execute remain visible to the function.
+func (vm *VM) Call(name string, args []Value) (Value, error) {
+	fn, ok := vm.functions[name]
+	if !ok {
+		return Value{}, fmt.Errorf("undefined function: %s", name)
+	}
+	if len(args) != len(fn.Params) {
+		return Value{}, fmt.Errorf("%s() takes %d arguments, got %d", name, len(fn.Params), len(args))
+	}
+
+	locals := make(map[string]Value, len(args))
+	for i, param := range fn.Params {
+		locals[param] = args[i]
+	}
+
+	vm.stack = vm.stack[:0]
+	vm.pc = fn.Entry
+	vm.frames = []*Frame{{function: name, returnPC: -1, locals: locals}}
+	return vm.execute()
+}
+
+// execute runs from the current instruction. On failure, including running
+// out of gas, changes to globals and storage are reverted, emitted events
+// and transfers are dropped and refunds are forfeited.
+func (vm *VM) execute() (Value, error) {
+	snapshot := make(map[string]Value, len(vm.vars))
+	for name, val := range vm.vars {
+		snapshot[name] = val
+	}
+	writes := vm.storage.snapshot()
+	logs := len(vm.logs)
+	transfers := len(vm.transfers)
+
+	result, err := vm.run()
+	if err != nil {
+		vm.vars = snapshot
+		vm.storage.writes = writes
+		vm.logs = vm.logs[:logs]
+		vm.transfers = vm.transfers[:transfers]
+		vm.stack = vm.stack[:0]
+		vm.gas.refund = 0
+		return Value{}, err
+	}
+	return result, nil
+}
+
+// loadStorage reads a storage slot of the contract. Missing slots are None.
+func (vm *VM) loadStorage(key string) (Value, error) {
+	if err := vm.gas.Consume(GasStorageLoad); err != nil {
+		return Value{}, err
+	}
+	val, ok, err := vm.storage.Get(vm.contract, key)
+	if err != nil {
+		return Value{}, fmt.Errorf("storage read %s: %v", key, err)
+	}
+	if !ok {
+		return Value{Type: ValueNone}, nil
+	}
+
+	// Values wider than a word pay for reading the extra words
+	size, err := encodedSize(val)
+	if err != nil {
+		return Value{}, fmt.Errorf("storage read %s: %v", key, err)
+	}
+	if words := memoryWords(size); words > 1 {
+		if err := vm.gas.Consume((words - 1) * GasStorageLoadWord); err != nil {
+			return Value{}, err
+		}
+	}
+	return val, nil
+}
+
+// storeStorage buffers a write to a storage slot. Storing None deletes the
+// slot.
+func (vm *VM) storeStorage(key string, val Value) error {
+	existed, err := vm.storage.Has(vm.contract, key)
+	if err != nil {
+		return fmt.Errorf("storage read %s: %v", key, err)
+	}
+	deleting := val.Type == ValueNone
+	if !existed && deleting {
+		return nil // Nothing to delete
+	}
+	if err := vm.gas.ChargeStorageWrite(existed, deleting); err != nil {
+		return err
+	}
+
+	// Values wider than a word pay for the extra words
+	size, err := encodedSize(val)
+	if err != nil {
+		return err
+	}
+	if words := memoryWords(size); words > 1 {
+		if err := vm.gas.Consume((words - 1) * GasMemoryWord); err != nil {
+			return err
+		}
+	}
+	return vm.storage.Set(vm.contract, key, val)
+}
+
+// ownValue copies a value being placed in a list or dict, charging for the
+// words copied. Containers never share elements, so a list or dict cannot
+// end up inside itself.
+func (vm *VM) ownValue(val Value) (Value, error) {
+	if val.Type != ValueList && val.Type != ValueDict {
+		return val, nil
+	}
+	size, err := encodedSize(val)
+	if err != nil {
+		return Value{}, err
+	}
+	if err := vm.gas.Consume(memoryWords(size) * GasMemoryWord); err != nil {
+		return Value{}, err
+	}
+	return copyValue(val)
+}
+
+// chargeCompare charges for comparing two values. Comparing lists and dicts
+// walks both, so they pay for their words the way copies do.
+func (vm *VM) chargeCompare(a, b Value) error {
+	var words uint64
+	for _, val := range []Value{a, b} {
+		if val.Type != ValueList && val.Type != ValueDict {
+			continue
+		}
+		size, err := encodedSize(val)
+		if err != nil {
+			return err
+		}
+		words += memoryWords(size)
+	}
+	return vm.gas.Consume(words * GasMemoryWord)
+}
+
+// chargeMemory charges for stack growth beyond the highest depth paid for
+func (vm *VM) chargeMemory() error {
+	if len(vm.stack) <= vm.peakStack {
+		return nil
+	}
+	words := uint64(len(vm.stack) - vm.peakStack)
+	vm.peakStack = len(vm.stack)
+	return vm.gas.Consume(words * GasMemoryWord)
+}
+
+// Functions returns the names of the functions the VM can call
+func (vm *VM) Functions() []string {
+	names := make([]string, 0, len(vm.functions))
+	for name := range vm.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// frame returns the currently executing frame
+func (vm *VM) frame() *Frame {
+	return vm.frames[len(vm.frames)-1]
+}
+
+// run executes instructions until the outermost frame returns
+func (vm *VM) run() (Value, error) {
 	for vm.pc < len(vm.program) {
 		inst := vm.program[vm.pc]
 		vm.pc++
 
+		if err := vm.gas.Consume(OpcodeGas(inst.Op)); err != nil {
+			return Value{}, err
+		}
+
 		switch inst.Op {
 		case OpPushInt:
 			val, _ := inst.Arg.(int64)
@@ -92,8 +491,12 @@ func (vm *VM) Execute() (Value, error) {
 		case OpPushNone:
 			vm.stack = append(vm.stack, Value{Type: ValueNone})
 		case OpLoadVar:
+			// Locals shadow globals
 			name, _ := inst.Arg.(string)
-			val, ok := vm.vars[name]
+			val, ok := vm.frame().locals[name]
+			if !ok {
+				val, ok = vm.vars[name]
+			}
 			if !ok {
 				return Value{}, fmt.Errorf("undefined variable: %s", name)
 			}
@@ -105,7 +508,20 @@ func (vm *VM) Execute() (Value, error) {
 			}
 			val := vm.stack[len(vm.stack)-1]
 			vm.stack = vm.stack[:len(vm.stack)-1]
-			vm.vars[name] = val
+
+			// New variables take memory
+			locals := vm.frame().locals
+			if _, ok := locals[name]; !ok {
+				if err := vm.gas.Consume(GasMemoryWord); err != nil {
+					return Value{}, err
+				}
+			}
+			locals[name] = val
+		case OpPop:
+			if len(vm.stack) == 0 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			vm.stack = vm.stack[:len(vm.stack)-1]
 		case OpAdd:
 			if len(vm.stack) < 2 {
 				return Value{}, fmt.Errorf("stack underflow")
@@ -117,6 +533,10 @@ func (vm *VM) Execute() (Value, error) {
 			if a.Type == ValueInt && b.Type == ValueInt {
 				vm.stack = append(vm.stack, Value{Type: ValueInt, Int: a.Int + b.Int})
 			} else if a.Type == ValueStr && b.Type == ValueStr {
+				// Pay for the result before building it
+				if err := vm.gas.Consume(memoryWords(len(a.Str)+len(b.Str)) * GasMemoryWord); err != nil {
+					return Value{}, err
+				}
 				vm.stack = append(vm.stack, Value{Type: ValueStr, Str: a.Str + b.Str})
 			} else {
 				return Value{}, fmt.Errorf("invalid operands for +")
@@ -160,6 +580,26 @@ func (vm *VM) Execute() (Value, error) {
 			} else {
 				return Value{}, fmt.Errorf("invalid operands for /")
 			}
+		case OpMod:
+			if len(vm.stack) < 2 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			b := vm.stack[len(vm.stack)-1]
+			a := vm.stack[len(vm.stack)-2]
+			vm.stack = vm.stack[:len(vm.stack)-2]
+
+			if a.Type == ValueInt && b.Type == ValueInt && b.Int != 0 {
+				vm.stack = append(vm.stack, Value{Type: ValueInt, Int: a.Int % b.Int})
+			} else {
+				return Value{}, fmt.Errorf("invalid operands for %%")
+			}
+		case OpNot:
+			// Only True is truthy, as for conditional jumps
+			if len(vm.stack) == 0 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			a := vm.stack[len(vm.stack)-1]
+			vm.stack[len(vm.stack)-1] = Value{Type: ValueBool, Bool: a.Type != ValueBool || !a.Bool}
 		case OpEq:
 			if len(vm.stack) < 2 {
 				return Value{}, fmt.Errorf("stack underflow")
@@ -168,20 +608,10 @@ func (vm *VM) Execute() (Value, error) {
 			a := vm.stack[len(vm.stack)-2]
 			vm.stack = vm.stack[:len(vm.stack)-2]
 
-			result := false
-			if a.Type == b.Type {
-				switch a.Type {
-				case ValueInt:
-					result = a.Int == b.Int
-				case ValueStr:
-					result = a.Str == b.Str
-				case ValueBool:
-					result = a.Bool == b.Bool
-				case ValueNone:
-					result = true
-				}
+			if err := vm.chargeCompare(a, b); err != nil {
+				return Value{}, err
 			}
-			vm.stack = append(vm.stack, Value{Type: ValueBool, Bool: result})
+			vm.stack = append(vm.stack, Value{Type: ValueBool, Bool: valuesEqual(a, b)})
 		case OpNe:
 			if len(vm.stack) < 2 {
 				return Value{}, fmt.Errorf("stack underflow")
@@ -190,20 +620,10 @@ func (vm *VM) Execute() (Value, error) {
 			a := vm.stack[len(vm.stack)-2]
 			vm.stack = vm.stack[:len(vm.stack)-2]
 
-			result := true
-			if a.Type == b.Type {
-				switch a.Type {
-				case ValueInt:
-					result = a.Int != b.Int
-				case ValueStr:
-					result = a.Str != b.Str
-				case ValueBool:
-					result = a.Bool != b.Bool
-				case ValueNone:
-					result = false
-				}
+			if err := vm.chargeCompare(a, b); err != nil {
+				return Value{}, err
 			}
-			vm.stack = append(vm.stack, Value{Type: ValueBool, Bool: result})
+			vm.stack = append(vm.stack, Value{Type: ValueBool, Bool: !valuesEqual(a, b)})
 		case OpLt:
 			if len(vm.stack) < 2 {
 				return Value{}, fmt.Errorf("stack underflow")
@@ -257,14 +677,53 @@ func (vm *VM) Execute() (Value, error) {
 				return Value{}, fmt.Errorf("invalid operands for >=")
 			}
 		case OpCall:
-			// Simplified: assume no arguments for now
-			// In real implementation, handle function calls
-			return Value{}, fmt.Errorf("function calls not implemented")
+			target, _ := inst.Arg.(CallTarget)
+			fn, ok := vm.functions[target.Name]
+			if !ok {
+				return Value{}, fmt.Errorf("undefined function: %s", target.Name)
+			}
+			if target.Argc != len(fn.Params) {
+				return Value{}, fmt.Errorf("%s() takes %d arguments, got %d", target.Name, len(fn.Params), target.Argc)
+			}
+			if len(vm.stack) < target.Argc {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			if len(vm.frames) >= MaxCallDepth {
+				return Value{}, fmt.Errorf("maximum call depth %d exceeded in %s", MaxCallDepth, target.Name)
+			}
+			if err := vm.gas.Consume(uint64(target.Argc) * GasCallArg); err != nil {
+				return Value{}, err
+			}
+
+			// Arguments were pushed left to right
+			base := len(vm.stack) - target.Argc
+			locals := make(map[string]Value, target.Argc)
+			for i, param := range fn.Params {
+				locals[param] = vm.stack[base+i]
+			}
+			vm.stack = vm.stack[:base]
+
+			vm.frames = append(vm.frames, &Frame{
+				function:  target.Name,
+				returnPC:  vm.pc,
+				stackBase: base,
+				locals:    locals,
+			})
+			vm.pc = fn.Entry
 		case OpReturn:
-			if len(vm.stack) == 0 {
-				return Value{Type: ValueNone}, nil
+			result := Value{Type: ValueNone}
+			if len(vm.stack) > 0 {
+				result = vm.stack[len(vm.stack)-1]
 			}
-			return vm.stack[len(vm.stack)-1], nil
+
+			// Returning from the outermost frame ends execution
+			frame := vm.frame()
+			if len(vm.frames) == 1 {
+				return result, nil
+			}
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.stack = append(vm.stack[:frame.stackBase], result)
+			vm.pc = frame.returnPC
 		case OpJump:
 			addr, _ := inst.Arg.(int)
 			vm.pc = addr
@@ -278,26 +737,211 @@ func (vm *VM) Execute() (Value, error) {
 				addr, _ := inst.Arg.(int)
 				vm.pc = addr
 			}
+		case OpBuildList:
+			n, _ := inst.Arg.(int)
+			if len(vm.stack) < n {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			if err := vm.gas.Consume(uint64(n) * GasMemoryWord); err != nil {
+				return Value{}, err
+			}
+			list := make([]Value, n)
+			for i, elem := range vm.stack[len(vm.stack)-n:] {
+				var err error
+				if list[i], err = vm.ownValue(elem); err != nil {
+					return Value{}, err
+				}
+			}
+			vm.stack = vm.stack[:len(vm.stack)-n]
+			vm.stack = append(vm.stack, Value{Type: ValueList, List: list})
+		case OpBuildDict:
+			n, _ := inst.Arg.(int)
+			if len(vm.stack) < 2*n {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			if err := vm.gas.Consume(uint64(n) * GasMemoryWord); err != nil {
+				return Value{}, err
+			}
+			entries := vm.stack[len(vm.stack)-2*n:]
+			dict := make(map[DictKey]Value, n)
+			for i := 0; i < n; i++ {
+				key, err := dictKey(entries[2*i])
+				if err != nil {
+					return Value{}, err
+				}
+				if dict[key], err = vm.ownValue(entries[2*i+1]); err != nil {
+					return Value{}, err
+				}
+			}
+			vm.stack = vm.stack[:len(vm.stack)-2*n]
+			vm.stack = append(vm.stack, Value{Type: ValueDict, Dict: dict})
+		case OpGetIndex:
+			if len(vm.stack) < 2 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			index := vm.stack[len(vm.stack)-1]
+			container := vm.stack[len(vm.stack)-2]
+			vm.stack = vm.stack[:len(vm.stack)-2]
+
+			val, err := getIndex(container, index)
+			if err != nil {
+				return Value{}, err
+			}
+			vm.stack = append(vm.stack, val)
+		case OpSetIndex:
+			if len(vm.stack) < 3 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			index := vm.stack[len(vm.stack)-1]
+			container := vm.stack[len(vm.stack)-2]
+			val := vm.stack[len(vm.stack)-3]
+			vm.stack = vm.stack[:len(vm.stack)-3]
+
+			val, err := vm.ownValue(val)
+			if err != nil {
+				return Value{}, err
+			}
+			added, err := setIndex(container, index, val)
+			if err != nil {
+				return Value{}, err
+			}
+			// New dict entries take memory
+			if added {
+				if err := vm.gas.Consume(GasMemoryWord); err != nil {
+					return Value{}, err
+				}
+			}
+		case OpLen:
+			if len(vm.stack) == 0 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			n, err := valueLen(vm.stack[len(vm.stack)-1])
+			if err != nil {
+				return Value{}, err
+			}
+			vm.stack[len(vm.stack)-1] = Value{Type: ValueInt, Int: n}
+		case OpGetMapItem:
+			// self.<field>[key] reads one storage slot; missing entries are None
+			field, _ := inst.Arg.(string)
+			if len(vm.stack) == 0 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			key, err := dictKey(vm.stack[len(vm.stack)-1])
+			if err != nil {
+				return Value{}, err
+			}
+			vm.stack = vm.stack[:len(vm.stack)-1]
+
+			val, err := vm.loadStorage(mapSlot(field, key))
+			if err != nil {
+				return Value{}, err
+			}
+			vm.stack = append(vm.stack, val)
+		case OpSetMapItem:
+			field, _ := inst.Arg.(string)
+			if len(vm.stack) < 2 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			key, err := dictKey(vm.stack[len(vm.stack)-1])
+			if err != nil {
+				return Value{}, err
+			}
+			val := vm.stack[len(vm.stack)-2]
+			vm.stack = vm.stack[:len(vm.stack)-2]
+
+			if err := vm.storeStorage(mapSlot(field, key), val); err != nil {
+				return Value{}, err
+			}
+		case OpEmit:
+			// Events are kept only if the whole execution succeeds
+			if len(vm.stack) < 2 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			topic := vm.stack[len(vm.stack)-2]
+			data := vm.stack[len(vm.stack)-1]
+			vm.stack = vm.stack[:len(vm.stack)-2]
+
+			if topic.Type != ValueStr || topic.Str == "" {
+				return Value{}, fmt.Errorf("emit() topic must be a non-empty str")
+			}
+			size, err := encodedSize(data)
+			if err != nil {
+				return Value{}, err
+			}
+			if err := vm.gas.Consume(uint64(len(topic.Str)+size) * GasLogByte); err != nil {
+				return Value{}, err
+			}
+			if data, err = copyValue(data); err != nil {
+				return Value{}, err
+			}
+			vm.logs = append(vm.logs, Log{Contract: vm.contract, Topic: topic.Str, Data: data})
+			vm.stack = append(vm.stack, Value{Type: ValueNone})
+		case OpLoadEnv:
+			name, _ := inst.Arg.(string)
+			val, err := vm.env(name)
+			if err != nil {
+				return Value{}, err
+			}
+			vm.stack = append(vm.stack, val)
+		case OpBalance:
+			if len(vm.stack) < 2 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			address := vm.stack[len(vm.stack)-2]
+			token := vm.stack[len(vm.stack)-1]
+			vm.stack = vm.stack[:len(vm.stack)-2]
+
+			balance, err := vm.balance(address, token)
+			if err != nil {
+				return Value{}, err
+			}
+			vm.stack = append(vm.stack, Value{Type: ValueInt, Int: balance})
+		case OpTransfer:
+			// Transfers are settled only if the whole execution succeeds
+			if len(vm.stack) < 3 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			token := vm.stack[len(vm.stack)-3]
+			to := vm.stack[len(vm.stack)-2]
+			amount := vm.stack[len(vm.stack)-1]
+			vm.stack = vm.stack[:len(vm.stack)-3]
+
+			if err := vm.transfer(token, to, amount); err != nil {
+				return Value{}, err
+			}
+			vm.stack = append(vm.stack, Value{Type: ValueNone})
 		case OpGetAttr:
-			// Simplified attribute access
+			// self.<field> reads contract storage; missing fields are None
 			attr, _ := inst.Arg.(string)
 			if len(vm.stack) == 0 {
 				return Value{}, fmt.Errorf("stack underflow")
 			}
 			vm.stack = vm.stack[:len(vm.stack)-1] // Pop object
 
-			// Handle special attributes like self.balance
-			if attr == "balance" {
-				vm.stack = append(vm.stack, Value{Type: ValueInt, Int: 1000}) // Mock balance
-			} else {
-				return Value{}, fmt.Errorf("attribute not found: %s", attr)
+			val, err := vm.loadStorage(attr)
+			if err != nil {
+				return Value{}, err
 			}
+			vm.stack = append(vm.stack, val)
 		case OpSetAttr:
-			// Simplified
-			return Value{}, fmt.Errorf("attribute assignment not implemented")
+			// self.<field> = value buffers a storage write; None deletes
+			attr, _ := inst.Arg.(string)
+			if len(vm.stack) < 2 {
+				return Value{}, fmt.Errorf("stack underflow")
+			}
+			val := vm.stack[len(vm.stack)-2]
+			vm.stack = vm.stack[:len(vm.stack)-2] // Pop value and object
+
+			if err := vm.storeStorage(attr, val); err != nil {
+				return Value{}, err
+			}
 		default:
 			return Value{}, fmt.Errorf("unknown opcode: %d", inst.Op)
 		}
+
+		if err := vm.chargeMemory(); err != nil {
+			return Value{}, err
+		}
 	}
 
 	return Value{Type: ValueNone}, nil
@@ -305,18 +949,69 @@ func (vm *VM) Execute() (Value, error) {
 
 // Compiler to generate bytecode from AST
 type Compiler struct {
-	program []Instruction
+	program   []Instruction
+	functions map[string]*Function
+	pending   []*FunctionDecl // Function bodies to emit after top-level code
+	errors    []error
+	loops     int // Numbers the hidden variables of for loops
 }
 
 func NewCompiler() *Compiler {
 	return &Compiler{
-		program: []Instruction{},
+		program:   []Instruction{},
+		functions: make(map[string]*Function),
 	}
 }
 
 func (c *Compiler) Compile(node Node) []Instruction {
+	contract, _ := c.CompileContract(node)
+	if contract == nil {
+		return c.program
+	}
+	return contract.Code
+}
+
+// CompileContract compiles a program into top-level code followed by one
+// entry point per function
+func (c *Compiler) CompileContract(node Node) (*CompiledContract, error) {
 	c.compileNode(node)
-	return c.program
+
+	// Top-level code must not fall through into function bodies
+	if len(c.pending) > 0 {
+		c.program = append(c.program, Instruction{Op: OpPushNone})
+		c.program = append(c.program, Instruction{Op: OpReturn})
+	}
+
+	// Bodies may declare nested functions, which are hoisted
+	for i := 0; i < len(c.pending); i++ {
+		c.compileFunction(c.pending[i])
+	}
+
+	if len(c.errors) > 0 {
+		return nil, c.errors[0]
+	}
+	return &CompiledContract{Code: c.program, Functions: c.functions}, nil
+}
+
+// compileFunction emits a function body and records its entry point
+func (c *Compiler) compileFunction(fn *FunctionDecl) {
+	params := fn.Parameters
+	if len(params) > 0 && params[0] == "self" {
+		params = params[1:]
+	}
+
+	c.functions[fn.Name] = &Function{
+		Name:   fn.Name,
+		Entry:  len(c.program),
+		Params: params,
+	}
+	for _, stmt := range fn.Body {
+		c.compileNode(stmt)
+	}
+
+	// Implicit return None
+	c.program = append(c.program, Instruction{Op: OpPushNone})
+	c.program = append(c.program, Instruction{Op: OpReturn})
 }
 
 func (c *Compiler) compileNode(node Node) {
@@ -330,7 +1025,13 @@ func (c *Compiler) compileNode(node Node) {
 			c.compileNode(stmt)
 		}
 	case *FunctionDecl:
-		// Skip for now
+		for _, pending := range c.pending {
+			if pending.Name == n.Name {
+				c.errors = append(c.errors, fmt.Errorf("function %s redeclared", n.Name))
+				return
+			}
+		}
+		c.pending = append(c.pending, n)
 	case *IfStmt:
 		c.compileNode(n.Condition)
 		falseJump := len(c.program)
@@ -347,10 +1048,46 @@ func (c *Compiler) compileNode(node Node) {
 			}
 		}
 		c.program[endJump].Arg = len(c.program)
+	case *WhileStmt:
+		loop := len(c.program)
+		c.compileNode(n.Condition)
+		exitJump := len(c.program)
+		c.program = append(c.program, Instruction{Op: OpJumpIfFalse, Arg: 0})
+		for _, stmt := range n.Body {
+			c.compileNode(stmt)
+		}
+		c.program = append(c.program, Instruction{Op: OpJump, Arg: loop})
+		c.program[exitJump].Arg = len(c.program)
+	case *ForStmt:
+		c.compileFor(n)
 	case *AssignStmt:
 		c.compileNode(n.Value)
-		if ident, ok := n.Target.(*Identifier); ok {
-			c.program = append(c.program, Instruction{Op: OpStoreVar, Arg: ident.Name})
+		switch target := n.Target.(type) {
+		case *Identifier:
+			c.program = append(c.program, Instruction{Op: OpStoreVar, Arg: target.Name})
+		case *AttributeExpr:
+			if !isSelf(target.Object) {
+				c.errors = append(c.errors, fmt.Errorf("cannot assign to %s: attributes are only supported on self", target))
+				return
+			}
+			c.compileNode(target.Object)
+			c.program = append(c.program, Instruction{Op: OpSetAttr, Arg: target.Attribute})
+		case *IndexExpr:
+			// self.<field>[key] = value writes one storage map entry
+			if field, ok := storageMap(target.Object); ok {
+				c.compileNode(target.Index)
+				c.program = append(c.program, Instruction{Op: OpSetMapItem, Arg: field})
+				return
+			}
+			if readsStorage(target.Object) {
+				c.errors = append(c.errors, fmt.Errorf("cannot assign to %s: values read from storage are copies", target))
+				return
+			}
+			c.compileNode(target.Object)
+			c.compileNode(target.Index)
+			c.program = append(c.program, Instruction{Op: OpSetIndex})
+		default:
+			c.errors = append(c.errors, fmt.Errorf("cannot assign to %s", n.Target))
 		}
 	case *PassStmt:
 		// Do nothing
@@ -363,8 +1100,12 @@ func (c *Compiler) compileNode(node Node) {
 		c.program = append(c.program, Instruction{Op: OpReturn})
 	case *ExprStmt:
 		c.compileNode(n.Expression)
-		// Pop result if not used
+		c.program = append(c.program, Instruction{Op: OpPop})
 	case *BinaryExpr:
+		if n.Op == "and" || n.Op == "or" {
+			c.compileLogical(n)
+			return
+		}
 		c.compileNode(n.Left)
 		c.compileNode(n.Right)
 		switch n.Op {
@@ -376,6 +1117,8 @@ func (c *Compiler) compileNode(node Node) {
 			c.program = append(c.program, Instruction{Op: OpMul})
 		case "/":
 			c.program = append(c.program, Instruction{Op: OpDiv})
+		case "%":
+			c.program = append(c.program, Instruction{Op: OpMod})
 		case "==":
 			c.program = append(c.program, Instruction{Op: OpEq})
 		case "!=":
@@ -391,17 +1134,138 @@ func (c *Compiler) compileNode(node Node) {
 		}
 	case *UnaryExpr:
 		c.compileNode(n.Right)
-		if n.Op == "-" {
+		switch n.Op {
+		case "-":
 			c.program = append(c.program, Instruction{Op: OpPushInt, Arg: int64(-1)})
 			c.program = append(c.program, Instruction{Op: OpMul})
+		case "not":
+			c.program = append(c.program, Instruction{Op: OpNot})
 		}
 	case *CallExpr:
-		// Simplified
-		c.program = append(c.program, Instruction{Op: OpCall})
+		// Functions are called by name, either directly or as self.name()
+		var name string
+		switch fn := n.Function.(type) {
+		case *Identifier:
+			switch fn.Name {
+			case "len":
+				if len(n.Arguments) != 1 {
+					c.errors = append(c.errors, fmt.Errorf("len() takes exactly one argument"))
+					return
+				}
+				c.compileNode(n.Arguments[0])
+				c.program = append(c.program, Instruction{Op: OpLen})
+				return
+			case "range":
+				c.errors = append(c.errors, fmt.Errorf("range() is only supported in for loops"))
+				return
+			case "emit":
+				// emit(topic[, data]) records an event
+				if len(n.Arguments) < 1 || len(n.Arguments) > 2 {
+					c.errors = append(c.errors, fmt.Errorf("emit() takes 1 or 2 arguments, got %d", len(n.Arguments)))
+					return
+				}
+				c.compileNode(n.Arguments[0])
+				if len(n.Arguments) == 2 {
+					c.compileNode(n.Arguments[1])
+				} else {
+					c.program = append(c.program, Instruction{Op: OpPushNone})
+				}
+				c.program = append(c.program, Instruction{Op: OpEmit})
+				return
+			case "balance_of":
+				// balance_of(address[, token_id]); balance_of(self) is the
+				// contract's own balance
+				if len(n.Arguments) < 1 || len(n.Arguments) > 2 {
+					c.errors = append(c.errors, fmt.Errorf("balance_of() takes 1 or 2 arguments, got %d", len(n.Arguments)))
+					return
+				}
+				c.compileNode(n.Arguments[0])
+				if len(n.Arguments) == 2 {
+					c.compileNode(n.Arguments[1])
+				} else {
+					c.program = append(c.program, Instruction{Op: OpPushNone})
+				}
+				c.program = append(c.program, Instruction{Op: OpBalance})
+				return
+			case "transfer":
+				// transfer(to, amount) sends OBS from the contract
+				if len(n.Arguments) != 2 {
+					c.errors = append(c.errors, fmt.Errorf("transfer() takes 2 arguments, got %d", len(n.Arguments)))
+					return
+				}
+				c.program = append(c.program, Instruction{Op: OpPushNone})
+				c.compileNode(n.Arguments[0])
+				c.compileNode(n.Arguments[1])
+				c.program = append(c.program, Instruction{Op: OpTransfer})
+				return
+			case "token_transfer":
+				// token_transfer(token_id, to, amount) sends a token
+				if len(n.Arguments) != 3 {
+					c.errors = append(c.errors, fmt.Errorf("token_transfer() takes 3 arguments, got %d", len(n.Arguments)))
+					return
+				}
+				for _, arg := range n.Arguments {
+					c.compileNode(arg)
+				}
+				c.program = append(c.program, Instruction{Op: OpTransfer})
+				return
+			}
+			name = fn.Name
+		case *AttributeExpr:
+			if obj, ok := fn.Object.(*Identifier); ok && obj.Name == "self" {
+				name = fn.Attribute
+			}
+		}
+		if name == "" {
+			c.errors = append(c.errors, fmt.Errorf("cannot call %s", n.Function))
+			return
+		}
+
+		for _, arg := range n.Arguments {
+			c.compileNode(arg)
+		}
+		c.program = append(c.program, Instruction{Op: OpCall, Arg: CallTarget{Name: name, Argc: len(n.Arguments)}})
 	case *AttributeExpr:
+		if name, ok := envField(n); ok {
+			if !IsEnvField(name) {
+				c.errors = append(c.errors, fmt.Errorf("unknown environment field %s", name))
+				return
+			}
+			c.program = append(c.program, Instruction{Op: OpLoadEnv, Arg: name})
+			return
+		}
+		if !isSelf(n.Object) {
+			c.errors = append(c.errors, fmt.Errorf("cannot access %s: attributes are only supported on self", n))
+			return
+		}
 		c.compileNode(n.Object)
 		c.program = append(c.program, Instruction{Op: OpGetAttr, Arg: n.Attribute})
+	case *IndexExpr:
+		if field, ok := storageMap(n.Object); ok {
+			c.compileNode(n.Index)
+			c.program = append(c.program, Instruction{Op: OpGetMapItem, Arg: field})
+			return
+		}
+		c.compileNode(n.Object)
+		c.compileNode(n.Index)
+		c.program = append(c.program, Instruction{Op: OpGetIndex})
+	case *ListLiteral:
+		for _, elem := range n.Elements {
+			c.compileNode(elem)
+		}
+		c.program = append(c.program, Instruction{Op: OpBuildList, Arg: len(n.Elements)})
+	case *DictLiteral:
+		for i := range n.Keys {
+			c.compileNode(n.Keys[i])
+			c.compileNode(n.Values[i])
+		}
+		c.program = append(c.program, Instruction{Op: OpBuildDict, Arg: len(n.Keys)})
 	case *Identifier:
+		// self is the contract instance, resolved by the attribute opcodes
+		if n.Name == "self" {
+			c.program = append(c.program, Instruction{Op: OpPushNone})
+			return
+		}
 		c.program = append(c.program, Instruction{Op: OpLoadVar, Arg: n.Name})
 	case *NumberLiteral:
 		c.program = append(c.program, Instruction{Op: OpPushInt, Arg: n.Value})
@@ -409,5 +1273,156 @@ func (c *Compiler) compileNode(node Node) {
 		c.program = append(c.program, Instruction{Op: OpPushStr, Arg: n.Value})
 	case *BoolLiteral:
 		c.program = append(c.program, Instruction{Op: OpPushBool, Arg: n.Value})
+	case *NoneLiteral:
+		c.program = append(c.program, Instruction{Op: OpPushNone})
+	}
+}
+
+// compileLogical emits short-circuit and/or. The result is always a bool.
+func (c *Compiler) compileLogical(n *BinaryExpr) {
+	c.compileNode(n.Left)
+	if n.Op == "or" {
+		// A true left operand short-circuits to True
+		c.program = append(c.program, Instruction{Op: OpNot})
+	}
+	shortJump := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpJumpIfFalse, Arg: 0})
+	c.compileNode(n.Right)
+	falseJump := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpJumpIfFalse, Arg: 0})
+
+	trueTarget := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpPushBool, Arg: true})
+	endJump := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpJump, Arg: 0})
+	falseTarget := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpPushBool, Arg: false})
+	c.program[endJump].Arg = len(c.program)
+
+	c.program[falseJump].Arg = falseTarget
+	if n.Op == "and" {
+		c.program[shortJump].Arg = falseTarget
+	} else {
+		c.program[shortJump].Arg = trueTarget
+	}
+}
+
+// compileFor emits a range loop as a counted while loop. The counter and
+// bound live in hidden variables, so the body may reassign the loop variable
+// without affecting iteration.
+func (c *Compiler) compileFor(n *ForStmt) {
+	call, ok := n.Iterable.(*CallExpr)
+	if ok {
+		fn, isIdent := call.Function.(*Identifier)
+		ok = isIdent && fn.Name == "range"
+	}
+	if !ok {
+		c.errors = append(c.errors, fmt.Errorf("for loops only support range(), got %s", n.Iterable))
+		return
+	}
+
+	var start, stop Node = &NumberLiteral{Value: 0}, nil
+	step := int64(1)
+	switch len(call.Arguments) {
+	case 1:
+		stop = call.Arguments[0]
+	case 2, 3:
+		start, stop = call.Arguments[0], call.Arguments[1]
+		if len(call.Arguments) == 3 {
+			// The step decides the loop condition, so it must be constant
+			var ok bool
+			if step, ok = constantInt(call.Arguments[2]); !ok || step == 0 {
+				c.errors = append(c.errors, fmt.Errorf("range() step must be a non-zero integer constant"))
+				return
+			}
+		}
+	default:
+		c.errors = append(c.errors, fmt.Errorf("range() takes 1 to 3 arguments, got %d", len(call.Arguments)))
+		return
+	}
+
+	counter := fmt.Sprintf("$for%d", c.loops)
+	bound := fmt.Sprintf("$for%d_stop", c.loops)
+	c.loops++
+
+	c.compileNode(start)
+	c.program = append(c.program, Instruction{Op: OpStoreVar, Arg: counter})
+	c.compileNode(stop)
+	c.program = append(c.program, Instruction{Op: OpStoreVar, Arg: bound})
+
+	loop := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpLoadVar, Arg: counter})
+	c.program = append(c.program, Instruction{Op: OpLoadVar, Arg: bound})
+	if step > 0 {
+		c.program = append(c.program, Instruction{Op: OpLt})
+	} else {
+		c.program = append(c.program, Instruction{Op: OpGt})
+	}
+	exitJump := len(c.program)
+	c.program = append(c.program, Instruction{Op: OpJumpIfFalse, Arg: 0})
+
+	c.program = append(c.program, Instruction{Op: OpLoadVar, Arg: counter})
+	c.program = append(c.program, Instruction{Op: OpStoreVar, Arg: n.Variable})
+	for _, stmt := range n.Body {
+		c.compileNode(stmt)
+	}
+
+	c.program = append(c.program, Instruction{Op: OpLoadVar, Arg: counter})
+	c.program = append(c.program, Instruction{Op: OpPushInt, Arg: step})
+	c.program = append(c.program, Instruction{Op: OpAdd})
+	c.program = append(c.program, Instruction{Op: OpStoreVar, Arg: counter})
+	c.program = append(c.program, Instruction{Op: OpJump, Arg: loop})
+	c.program[exitJump].Arg = len(c.program)
+}
+
+// constantInt evaluates an integer literal, possibly negated
+func constantInt(node Node) (int64, bool) {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		return n.Value, true
+	case *UnaryExpr:
+		if n.Op == "-" {
+			v, ok := constantInt(n.Right)
+			return -v, ok
+		}
+	}
+	return 0, false
+}
+
+// isSelf reports whether node is the self identifier
+func isSelf(node Node) bool {
+	ident, ok := node.(*Identifier)
+	return ok && ident.Name == "self"
+}
+
+// envField reports whether node is msg.<field> or block.<field> and returns
+// its full name
+func envField(node *AttributeExpr) (string, bool) {
+	ident, ok := node.Object.(*Identifier)
+	if !ok || (ident.Name != "msg" && ident.Name != "block") {
+		return "", false
+	}
+	return ident.Name + "." + node.Attribute, true
+}
+
+// storageMap reports whether node is self.<field> used as a storage map,
+// whose entries each occupy their own storage slot
+func storageMap(node Node) (string, bool) {
+	attr, ok := node.(*AttributeExpr)
+	if !ok || !isSelf(attr.Object) {
+		return "", false
+	}
+	return attr.Attribute, true
+}
+
+// readsStorage reports whether node evaluates to a value loaded from storage
+func readsStorage(node Node) bool {
+	switch n := node.(type) {
+	case *AttributeExpr:
+		return isSelf(n.Object)
+	case *IndexExpr:
+		return readsStorage(n.Object)
+	default:
+		return false
 	}
 }
@@ -0,0 +1,93 @@
+package tor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS5 constants for Tor's RESOLVE extension
+const (
+	socks5Version    = 0x05
+	socks5NoAuth     = 0x00
+	socks5CmdResolve = 0xf0 // Tor extension: resolve a name without connecting
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+)
+
+// Resolve looks up host through the Tor proxy using the SOCKS5 RESOLVE
+// extension, so the query does not leak outside Tor. Tor answers with a
+// single address.
+func (c *Client) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.config.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Tor proxy: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	ip, err := socks5Resolve(conn, host)
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{ip}, nil
+}
+
+// socks5Resolve performs a RESOLVE request for host over a fresh SOCKS5
+// connection.
+func socks5Resolve(rw io.ReadWriter, host string) (net.IP, error) {
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("invalid host name %q", host)
+	}
+
+	if _, err := rw.Write([]byte{socks5Version, 1, socks5NoAuth}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version || reply[1] != socks5NoAuth {
+		return nil, fmt.Errorf("SOCKS5 proxy refused authentication method")
+	}
+
+	req := []byte{socks5Version, socks5CmdResolve, 0, socks5AtypDomain, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, 0, 0) // Port, unused
+	if _, err := rw.Write(req); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(rw, head); err != nil {
+		return nil, err
+	}
+	if head[0] != socks5Version {
+		return nil, fmt.Errorf("invalid SOCKS5 reply version %d", head[0])
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("SOCKS5 resolve of %s failed with code %d", host, head[1])
+	}
+
+	var ip net.IP
+	switch head[3] {
+	case socks5AtypIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socks5AtypIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS5 address type %d", head[3])
+	}
+	if _, err := io.ReadFull(rw, ip); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rw, make([]byte, 2)); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
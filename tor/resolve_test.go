@@ -0,0 +1,57 @@
+package tor
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeProxy answers one SOCKS5 RESOLVE request with reply and returns the
+// host that was asked for
+func fakeProxy(t *testing.T, conn net.Conn, reply []byte) <-chan string {
+	hosts := make(chan string, 1)
+	go func() {
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{socks5Version, socks5NoAuth})
+
+		head := make([]byte, 5)
+		io.ReadFull(conn, head)
+		if head[1] != socks5CmdResolve || head[3] != socks5AtypDomain {
+			t.Errorf("Unexpected request %x", head)
+		}
+		host := make([]byte, int(head[4])+2)
+		io.ReadFull(conn, host)
+		hosts <- string(host[:head[4]])
+		conn.Write(reply)
+	}()
+	return hosts
+}
+
+func TestSOCKS5Resolve(t *testing.T) {
+	client, server := net.Pipe()
+	hosts := fakeProxy(t, server, []byte{socks5Version, 0, 0, socks5AtypIPv4, 10, 1, 2, 3, 0, 0})
+	ip, err := socks5Resolve(client, "seed.example.com")
+	if err != nil {
+		t.Fatalf("socks5Resolve failed: %v", err)
+	}
+	if !ip.Equal(net.IPv4(10, 1, 2, 3)) || <-hosts != "seed.example.com" {
+		t.Errorf("Resolved to %s", ip)
+	}
+
+	client, server = net.Pipe()
+	v6 := net.ParseIP("2001:db8::1")
+	fakeProxy(t, server, append(append([]byte{socks5Version, 0, 0, socks5AtypIPv6}, v6...), 0, 0))
+	if ip, err := socks5Resolve(client, "seed.example.com"); err != nil || !bytes.Equal(ip, v6) {
+		t.Errorf("IPv6 resolve = %s, %v", ip, err)
+	}
+
+	// Tor reports unresolvable names with a general failure
+	client, server = net.Pipe()
+	fakeProxy(t, server, []byte{socks5Version, 4, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	if _, err := socks5Resolve(client, "missing.example.com"); err == nil {
+		t.Error("Accepted a failed resolve")
+	}
+}
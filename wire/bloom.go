@@ -2,6 +2,9 @@ package wire
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"math"
 )
 
@@ -20,6 +23,10 @@ const (
 	// MaxHashFuncs is the maximum number of hash functions
 	MaxHashFuncs = 50
 
+	// MaxFilterAddDataSize is the maximum size of an element added to a
+	// loaded filter
+	MaxFilterAddDataSize = 520
+
 	// BloomUpdateNone indicates no auto-update
 	BloomUpdateNone = 0
 
@@ -64,8 +71,43 @@ func NewBloomFilter(numElements uint32, falsePositiveRate float64, tweak uint32,
 	}
 }
 
+// LoadBloomFilter creates the bloom filter a peer sent in a filterload
+// message, checking it against the size limits.
+func LoadBloomFilter(msg *FilterLoadMsg) (*BloomFilter, error) {
+	if len(msg.Filter) > MaxBloomFilterSize {
+		return nil, fmt.Errorf("bloom filter of %d bytes exceeds %d", len(msg.Filter), MaxBloomFilterSize)
+	}
+	if msg.HashFuncs > MaxHashFuncs {
+		return nil, fmt.Errorf("bloom filter uses %d hash functions, max %d", msg.HashFuncs, MaxHashFuncs)
+	}
+	if msg.Flags > BloomUpdateP2PKOnly {
+		return nil, fmt.Errorf("unknown bloom filter flags %d", msg.Flags)
+	}
+
+	return &BloomFilter{
+		filter:   append([]byte(nil), msg.Filter...),
+		hashFunc: msg.HashFuncs,
+		tweak:    msg.Tweak,
+		flags:    msg.Flags,
+	}, nil
+}
+
+// MsgFilterLoad returns the filterload message that loads this filter on a
+// peer.
+func (bf *BloomFilter) MsgFilterLoad() *FilterLoadMsg {
+	return &FilterLoadMsg{
+		Filter:    append([]byte(nil), bf.filter...),
+		HashFuncs: bf.hashFunc,
+		Tweak:     bf.tweak,
+		Flags:     bf.flags,
+	}
+}
+
 // Add adds data to the bloom filter.
 func (bf *BloomFilter) Add(data []byte) {
+	if len(bf.filter) == 0 {
+		return
+	}
 	for i := uint32(0); i < bf.hashFunc; i++ {
 		hash := bf.hash(i, data)
 		index := hash % uint32(len(bf.filter)*8)
@@ -73,9 +115,17 @@ func (bf *BloomFilter) Add(data []byte) {
 	}
 }
 
+// AddOutPoint adds an outpoint, so that transactions spending it match.
+func (bf *BloomFilter) AddOutPoint(op OutPoint) {
+	bf.Add(outPointKey(op))
+}
+
 // Contains checks if data might be in the filter.
 // Returns true if possibly in set, false if definitely not in set.
 func (bf *BloomFilter) Contains(data []byte) bool {
+	if len(bf.filter) == 0 {
+		return false
+	}
 	for i := uint32(0); i < bf.hashFunc; i++ {
 		hash := bf.hash(i, data)
 		index := hash % uint32(len(bf.filter)*8)
@@ -111,35 +161,68 @@ func (bf *BloomFilter) hash(hashIndex uint32, data []byte) uint32 {
 		uint32(hashResult[3])<<24
 }
 
+// outPointKey is the filter element for an outpoint: its transaction hash
+// followed by its little-endian output index
+func outPointKey(op OutPoint) []byte {
+	key := make([]byte, HashSize+4)
+	copy(key, op.Hash[:])
+	binary.LittleEndian.PutUint32(key[HashSize:], op.Index)
+	return key
+}
+
+// payToPubKeyHash returns the public key hash of a P2PKH script, or nil
+func payToPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == 0x76 && script[1] == 0xa9 &&
+		script[2] == 0x14 && script[23] == 0x88 && script[24] == 0xac {
+		return script[3:23]
+	}
+	return nil
+}
+
 // Matches checks if a transaction matches the bloom filter.
 func (bf *BloomFilter) MatchesTx(tx *MsgTx) bool {
+	return bf.matchTx(tx, false)
+}
+
+// MatchTxAndUpdate checks if a transaction matches the bloom filter and,
+// as the filter's flags allow, adds the outpoints of matched outputs so
+// that transactions spending them match too.
+func (bf *BloomFilter) MatchTxAndUpdate(tx *MsgTx) bool {
+	return bf.matchTx(tx, true)
+}
+
+func (bf *BloomFilter) matchTx(tx *MsgTx, update bool) bool {
 	// Check transaction hash
 	txHash := tx.TxHash()
-	if bf.Contains(txHash[:]) {
-		return true
-	}
+	matched := bf.Contains(txHash[:])
 
-	// Check outputs
-	for _, out := range tx.TxOut {
-		// Check if output script matches
-		if bf.Contains(out.PkScript) {
+	// Check outputs, matching P2PKH scripts on their public key hash too
+	for i, out := range tx.TxOut {
+		pubKeyHash := payToPubKeyHash(out.PkScript)
+		if !bf.Contains(out.PkScript) && (pubKeyHash == nil || !bf.Contains(pubKeyHash)) {
+			continue
+		}
+		matched = true
+		if !update {
 			return true
 		}
-
-		// Check if output script contains any data that matches
-		// (simplified - real implementation would parse script)
+		if bf.flags == BloomUpdateAll || (bf.flags == BloomUpdateP2PKOnly && pubKeyHash != nil) {
+			bf.AddOutPoint(OutPoint{Hash: txHash, Index: uint32(i)})
+		}
+	}
+	if matched {
+		return true
 	}
 
 	// Check inputs
 	for _, in := range tx.TxIn {
 		// Check previous outpoint
-		outpointData := append(in.PreviousOutPoint.Hash[:], byte(in.PreviousOutPoint.Index))
-		if bf.Contains(outpointData) {
+		if bf.Contains(outPointKey(in.PreviousOutPoint)) {
 			return true
 		}
 
 		// Check signature script
-		if bf.Contains(in.SignatureScript) {
+		if len(in.SignatureScript) > 0 && bf.Contains(in.SignatureScript) {
 			return true
 		}
 	}
@@ -147,16 +230,19 @@ func (bf *BloomFilter) MatchesTx(tx *MsgTx) bool {
 	return false
 }
 
-// MerkleBlock represents a filtered block for SPV clients.
+// MerkleBlock represents a filtered block for SPV clients: the header and
+// a partial merkle tree proving which transactions it contains (BIP 37).
 type MerkleBlock struct {
 	Header       BlockHeader
 	TxCount      uint32
 	Hashes       []Hash
-	Flags        []byte
-	Transactions []*MsgTx // Matched transactions
+	Flags        []byte   // Traversal bits, least significant first
+	Transactions []*MsgTx // Matched transactions, relayed separately
 }
 
 // NewMerkleBlock creates a merkle block from a full block and bloom filter.
+// The filter is updated with the outputs of matched transactions, as for
+// relayed transactions.
 func NewMerkleBlock(block *MsgBlock, filter *BloomFilter) *MerkleBlock {
 	mb := &MerkleBlock{
 		Header:       block.Header,
@@ -172,7 +258,7 @@ func NewMerkleBlock(block *MsgBlock, filter *BloomFilter) *MerkleBlock {
 
 	for i, tx := range block.Transactions {
 		hashes[i] = tx.TxHash()
-		if filter.MatchesTx(tx) {
+		if filter.MatchTxAndUpdate(tx) {
 			matches[i] = true
 			mb.Transactions = append(mb.Transactions, tx)
 		}
@@ -184,18 +270,205 @@ func NewMerkleBlock(block *MsgBlock, filter *BloomFilter) *MerkleBlock {
 	return mb
 }
 
-// buildPartialTree builds a partial merkle tree for SPV proof.
+// CalcMerkleRoot returns the merkle root of transaction hashes, duplicating
+// the last hash of odd levels.
+func CalcMerkleRoot(hashes []Hash) Hash {
+	if len(hashes) == 0 {
+		return Hash{}
+	}
+	level := append([]Hash(nil), hashes...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]Hash, len(level)/2)
+		for i := range next {
+			next[i] = merkleParent(level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// BlockMerkleRoot returns the merkle root of the block's transactions.
+func BlockMerkleRoot(block *MsgBlock) Hash {
+	hashes := make([]Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.TxHash()
+	}
+	return CalcMerkleRoot(hashes)
+}
+
+func merkleParent(left, right Hash) Hash {
+	var buf [2 * HashSize]byte
+	copy(buf[:HashSize], left[:])
+	copy(buf[HashSize:], right[:])
+	return DoubleHashH(buf[:])
+}
+
+// treeWidth returns the number of nodes at a height of the merkle tree
+// over n transactions, height 0 being the leaves
+func treeWidth(n uint32, height uint) uint32 {
+	return (n + (1 << height) - 1) >> height
+}
+
+// treeHeight returns the height of the root of the merkle tree over n
+// transactions
+func treeHeight(n uint32) uint {
+	height := uint(0)
+	for treeWidth(n, height) > 1 {
+		height++
+	}
+	return height
+}
+
+// nodeHash computes the hash of a node of the full merkle tree
+func nodeHash(hashes []Hash, height uint, pos uint32) Hash {
+	if height == 0 {
+		return hashes[pos]
+	}
+	left := nodeHash(hashes, height-1, pos*2)
+	right := left
+	if pos*2+1 < treeWidth(uint32(len(hashes)), height-1) {
+		right = nodeHash(hashes, height-1, pos*2+1)
+	}
+	return merkleParent(left, right)
+}
+
+// buildPartialTree builds a partial merkle tree for SPV proof. Nodes are
+// visited depth first; each gets a flag bit telling whether a match lies
+// beneath it, and subtrees without matches are replaced by their hash.
 func (mb *MerkleBlock) buildPartialTree(hashes []Hash, matches []bool) {
-	// Simplified implementation - real version would build proper merkle tree
-	// For now, just include all hashes of matched transactions
-	for i, match := range matches {
-		if match {
-			mb.Hashes = append(mb.Hashes, hashes[i])
-			mb.Flags = append(mb.Flags, 1)
-		} else {
-			mb.Flags = append(mb.Flags, 0)
+	if len(hashes) == 0 {
+		return
+	}
+	var bits []bool
+	var traverse func(height uint, pos uint32)
+	traverse = func(height uint, pos uint32) {
+		parentOfMatch := false
+		for p := pos << height; p < (pos+1)<<height && p < uint32(len(hashes)); p++ {
+			parentOfMatch = parentOfMatch || matches[p]
+		}
+		bits = append(bits, parentOfMatch)
+		if height == 0 || !parentOfMatch {
+			mb.Hashes = append(mb.Hashes, nodeHash(hashes, height, pos))
+			return
 		}
+		traverse(height-1, pos*2)
+		if pos*2+1 < treeWidth(uint32(len(hashes)), height-1) {
+			traverse(height-1, pos*2+1)
+		}
+	}
+	traverse(treeHeight(uint32(len(hashes))), 0)
+
+	mb.Flags = make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			mb.Flags[i/8] |= 1 << (i % 8)
+		}
+	}
+}
+
+// ExtractMatches walks the partial merkle tree, returning the merkle root
+// it commits to and the hashes of the matched transactions. An SPV client
+// compares the root against the block header.
+func (mb *MerkleBlock) ExtractMatches() (Hash, []Hash, error) {
+	if mb.TxCount == 0 {
+		return Hash{}, nil, fmt.Errorf("merkle block has no transactions")
+	}
+	if len(mb.Hashes) > int(mb.TxCount) {
+		return Hash{}, nil, fmt.Errorf("merkle block has %d hashes for %d transactions", len(mb.Hashes), mb.TxCount)
+	}
+
+	var bitsUsed, hashesUsed int
+	var matches []Hash
+	var traverse func(height uint, pos uint32) (Hash, error)
+	traverse = func(height uint, pos uint32) (Hash, error) {
+		if bitsUsed >= len(mb.Flags)*8 {
+			return Hash{}, fmt.Errorf("merkle block flags exhausted")
+		}
+		parentOfMatch := mb.Flags[bitsUsed/8]&(1<<(bitsUsed%8)) != 0
+		bitsUsed++
+
+		if height == 0 || !parentOfMatch {
+			if hashesUsed >= len(mb.Hashes) {
+				return Hash{}, fmt.Errorf("merkle block hashes exhausted")
+			}
+			hash := mb.Hashes[hashesUsed]
+			hashesUsed++
+			if height == 0 && parentOfMatch {
+				matches = append(matches, hash)
+			}
+			return hash, nil
+		}
+
+		left, err := traverse(height-1, pos*2)
+		if err != nil {
+			return Hash{}, err
+		}
+		right := left
+		if pos*2+1 < treeWidth(mb.TxCount, height-1) {
+			if right, err = traverse(height-1, pos*2+1); err != nil {
+				return Hash{}, err
+			}
+			// Identical siblings would let a proof claim extra transactions
+			if right == left {
+				return Hash{}, fmt.Errorf("merkle block has duplicate sibling hashes")
+			}
+		}
+		return merkleParent(left, right), nil
+	}
+
+	root, err := traverse(treeHeight(mb.TxCount), 0)
+	if err != nil {
+		return Hash{}, nil, err
+	}
+	if hashesUsed != len(mb.Hashes) || (bitsUsed+7)/8 != len(mb.Flags) {
+		return Hash{}, nil, fmt.Errorf("merkle block has unused hashes or flags")
 	}
+	return root, matches, nil
+}
+
+// Serialize writes the merkle block without its transactions, which are
+// relayed as separate tx messages.
+func (mb *MerkleBlock) Serialize(w io.Writer) error {
+	if err := mb.Header.Serialize(w); err != nil {
+		return err
+	}
+	if err := writeElements(w, mb.TxCount); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, uint64(len(mb.Hashes))); err != nil {
+		return err
+	}
+	for _, hash := range mb.Hashes {
+		if _, err := w.Write(hash[:]); err != nil {
+			return err
+		}
+	}
+	return WriteVarBytes(w, mb.Flags)
+}
+
+// Deserialize reads a merkle block written by Serialize
+func (mb *MerkleBlock) Deserialize(r io.Reader) error {
+	if err := mb.Header.Deserialize(r); err != nil {
+		return err
+	}
+	if err := readElements(r, &mb.TxCount); err != nil {
+		return err
+	}
+	count, err := ReadCount(r, maxBlockTxs, "merkle hash")
+	if err != nil {
+		return err
+	}
+	mb.Hashes = make([]Hash, count)
+	for i := range mb.Hashes {
+		if _, err := io.ReadFull(r, mb.Hashes[i][:]); err != nil {
+			return err
+		}
+	}
+	mb.Flags, err = ReadVarBytes(r, maxBlockTxs/4+1, "merkle flags")
+	return err
 }
 
 // FilterLoad message for loading a bloom filter on a peer.
@@ -206,10 +479,39 @@ type FilterLoadMsg struct {
 	Flags     uint8
 }
 
+// Serialize writes the filter followed by its parameters
+func (msg *FilterLoadMsg) Serialize(w io.Writer) error {
+	if err := WriteVarBytes(w, msg.Filter); err != nil {
+		return err
+	}
+	return writeElements(w, msg.HashFuncs, msg.Tweak, msg.Flags)
+}
+
+// Deserialize reads a filterload written by Serialize
+func (msg *FilterLoadMsg) Deserialize(r io.Reader) error {
+	var err error
+	if msg.Filter, err = ReadVarBytes(r, MaxBloomFilterSize, "bloom filter"); err != nil {
+		return err
+	}
+	return readElements(r, &msg.HashFuncs, &msg.Tweak, &msg.Flags)
+}
+
 // FilterAdd message for adding data to a bloom filter.
 type FilterAddMsg struct {
 	Data []byte
 }
 
+// Serialize writes the element to add
+func (msg *FilterAddMsg) Serialize(w io.Writer) error {
+	return WriteVarBytes(w, msg.Data)
+}
+
+// Deserialize reads a filteradd written by Serialize
+func (msg *FilterAddMsg) Deserialize(r io.Reader) error {
+	var err error
+	msg.Data, err = ReadVarBytes(r, MaxFilterAddDataSize, "filteradd data")
+	return err
+}
+
 // FilterClear message for clearing a bloom filter.
 type FilterClearMsg struct{}
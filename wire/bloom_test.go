@@ -0,0 +1,103 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMerkleBlockProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 16} {
+		block := compactTestBlock(n - 1)
+		root := BlockMerkleRoot(block)
+
+		// Match the last transaction through its outpoint
+		filter := NewBloomFilter(10, 0.0001, 0, BloomUpdateNone)
+		last := block.Transactions[n-1]
+		if n > 1 {
+			filter.AddOutPoint(last.TxIn[0].PreviousOutPoint)
+		} else {
+			hash := last.TxHash()
+			filter.Add(hash[:])
+		}
+
+		mb := NewMerkleBlock(block, filter)
+		var buf bytes.Buffer
+		if err := mb.Serialize(&buf); err != nil {
+			t.Fatalf("Serialize failed: %v", err)
+		}
+		decoded := &MerkleBlock{}
+		if err := decoded.Deserialize(&buf); err != nil {
+			t.Fatalf("Deserialize failed: %v", err)
+		}
+
+		gotRoot, matches, err := decoded.ExtractMatches()
+		if err != nil {
+			t.Fatalf("%d txs: ExtractMatches failed: %v", n, err)
+		}
+		if gotRoot != root {
+			t.Errorf("%d txs: proof commits to the wrong merkle root", n)
+		}
+		if len(matches) != 1 || matches[0] != last.TxHash() {
+			t.Errorf("%d txs: expected the last transaction to match, got %d matches", n, len(matches))
+		}
+		if len(mb.Transactions) != 1 {
+			t.Errorf("%d txs: expected 1 matched transaction, got %d", n, len(mb.Transactions))
+		}
+	}
+
+	// A tampered proof is rejected or commits to another root
+	block := compactTestBlock(4)
+	filter := NewBloomFilter(10, 0.0001, 0, BloomUpdateNone)
+	hash := block.Transactions[2].TxHash()
+	filter.Add(hash[:])
+	mb := NewMerkleBlock(block, filter)
+	mb.Hashes[0][0] ^= 1
+	if root, _, err := mb.ExtractMatches(); err == nil && root == BlockMerkleRoot(block) {
+		t.Error("Tampered proof still commits to the block's merkle root")
+	}
+	mb.Hashes = append(mb.Hashes, Hash{})
+	if _, _, err := mb.ExtractMatches(); err == nil {
+		t.Error("Accepted a proof with unused hashes")
+	}
+}
+
+func TestBloomFilterUpdate(t *testing.T) {
+	pubKeyHash := bytes.Repeat([]byte{0x11}, 20)
+	script := append([]byte{0x76, 0xa9, 0x14}, append(pubKeyHash, 0x88, 0xac)...)
+	funding := NewMsgTx(TxVersion)
+	funding.AddTxIn(&TxIn{PreviousOutPoint: OutPoint{Hash: Hash{9}}, Sequence: 0xffffffff})
+	funding.AddTxOut(&TxOut{Value: 500, PkScript: script})
+	spend := NewMsgTx(TxVersion)
+	spend.AddTxIn(&TxIn{PreviousOutPoint: OutPoint{Hash: funding.TxHash(), Index: 0}, Sequence: 0xffffffff})
+	spend.AddTxOut(&TxOut{Value: 400, PkScript: []byte("obs1elsewhere")})
+
+	for _, tt := range []struct {
+		flags         uint8
+		matchesSpends bool
+	}{
+		{BloomUpdateNone, false},
+		{BloomUpdateAll, true},
+		{BloomUpdateP2PKOnly, true},
+	} {
+		filter := NewBloomFilter(10, 0.0001, 5, tt.flags)
+		filter.Add(pubKeyHash)
+		if !filter.MatchTxAndUpdate(funding) {
+			t.Fatalf("flags %d: payment to the public key hash did not match", tt.flags)
+		}
+		if got := filter.MatchesTx(spend); got != tt.matchesSpends {
+			t.Errorf("flags %d: spend matched = %v, expected %v", tt.flags, got, tt.matchesSpends)
+		}
+	}
+
+	// Filters from peers are bounded
+	if _, err := LoadBloomFilter(&FilterLoadMsg{Filter: make([]byte, MaxBloomFilterSize+1), HashFuncs: 1}); err == nil {
+		t.Error("Loaded an oversized filter")
+	}
+	if _, err := LoadBloomFilter(&FilterLoadMsg{Filter: []byte{1}, HashFuncs: MaxHashFuncs + 1}); err == nil {
+		t.Error("Loaded a filter with too many hash functions")
+	}
+	empty, err := LoadBloomFilter(&FilterLoadMsg{})
+	if err != nil || empty.MatchesTx(funding) {
+		t.Errorf("Empty filter = %v; expected it to match nothing", err)
+	}
+}
@@ -15,6 +15,7 @@ var (
 	ErrValueBalance      = errors.New("value balance does not match")
 	ErrInvalidCommitment = errors.New("invalid note commitment")
 	ErrShieldedAddress   = errors.New("invalid shielded address")
+	ErrBindingSig        = errors.New("invalid binding signature")
 )
 
 // HashSize of array used to store hashes.  See Hash.
@@ -42,7 +43,19 @@ func NewHashFromStr(hash string) (*Hash, error) {
 		return nil, fmt.Errorf("hash string too long")
 	}
 
-	// TODO: Implement proper decoding
+	// Hex decoding requires an even number of characters
+	if len(hash)%2 != 0 {
+		hash = "0" + hash
+	}
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Un-reverse the decoded bytes, padding missing high bytes with zeros
+	for i, b := range decoded {
+		ret[len(decoded)-1-i] = b
+	}
 	return ret, nil
 }
 
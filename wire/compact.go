@@ -2,10 +2,16 @@ package wire
 
 import (
 	"bytes"
-	"encoding/gob"
 	"fmt"
+	"io"
 )
 
+// ShortIDSize is the number of bytes of a short transaction ID on the wire.
+const ShortIDSize = 6
+
+// maxBlockTxs bounds the transaction count of a block read off the wire
+const maxBlockTxs = MaxSerializeSize / minTxSize
+
 // CompactBlock represents a compact block (BIP 152 style).
 // Instead of full transactions, it sends short transaction IDs.
 type CompactBlock struct {
@@ -73,63 +79,185 @@ func computeShortID(txHash Hash, nonce uint64) uint64 {
 	return shortID
 }
 
+// TxCount returns the number of transactions in the block.
+func (cb *CompactBlock) TxCount() int {
+	return len(cb.ShortIDs) + len(cb.PrefilledTxs)
+}
+
+// shortIDsByIndex maps each block index without a prefilled transaction to
+// its short ID, checking that prefilled indices are in range and unique.
+func (cb *CompactBlock) shortIDsByIndex() (map[int]uint64, error) {
+	prefilled := make(map[int]bool, len(cb.PrefilledTxs))
+	for _, pf := range cb.PrefilledTxs {
+		if pf.Index < 0 || pf.Index >= cb.TxCount() {
+			return nil, fmt.Errorf("prefilled transaction index %d out of range", pf.Index)
+		}
+		if prefilled[pf.Index] || pf.Tx == nil {
+			return nil, fmt.Errorf("invalid prefilled transaction at index %d", pf.Index)
+		}
+		prefilled[pf.Index] = true
+	}
+
+	shortIDs := make(map[int]uint64, len(cb.ShortIDs))
+	next := 0
+	for i := 0; i < cb.TxCount(); i++ {
+		if !prefilled[i] {
+			shortIDs[i] = cb.ShortIDs[next]
+			next++
+		}
+	}
+	return shortIDs, nil
+}
+
 // ReconstructBlock attempts to reconstruct a full block from a compact block.
-// Returns the full block and a list of missing transaction indices.
+// Returns the full block and a list of missing transaction indices, whose
+// entries in the block are nil until filled by FillMissing. A short ID
+// matching more than one mempool transaction counts as missing.
 func (cb *CompactBlock) ReconstructBlock(mempool map[Hash]*MsgTx) (*MsgBlock, []int, error) {
-	block := NewMsgBlock(&cb.Header)
-	missing := make([]int, 0)
+	shortIDs, err := cb.shortIDsByIndex()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Build transaction index from mempool
+	// Build transaction index from mempool, dropping colliding short IDs
 	mempoolShortIDs := make(map[uint64]*MsgTx)
 	for txHash, tx := range mempool {
 		shortID := computeShortID(txHash, cb.Nonce)
+		if _, exists := mempoolShortIDs[shortID]; exists {
+			mempoolShortIDs[shortID] = nil
+			continue
+		}
 		mempoolShortIDs[shortID] = tx
 	}
 
-	// Track prefilled transaction indices
-	prefilledMap := make(map[int]*MsgTx)
+	block := NewMsgBlock(&cb.Header)
+	block.Transactions = make([]*MsgTx, cb.TxCount())
 	for _, pf := range cb.PrefilledTxs {
-		prefilledMap[pf.Index] = pf.Tx
+		block.Transactions[pf.Index] = pf.Tx
 	}
 
-	// Reconstruct transactions
-	currentTxIndex := 0
-	shortIDIndex := 0
-
-	for currentTxIndex < len(cb.ShortIDs)+len(cb.PrefilledTxs) {
-		// Check if this index has a prefilled transaction
-		if prefilledTx, exists := prefilledMap[currentTxIndex]; exists {
-			block.AddTransaction(prefilledTx)
+	missing := make([]int, 0)
+	for i := range block.Transactions {
+		shortID, ok := shortIDs[i]
+		if !ok {
+			continue
+		}
+		if tx := mempoolShortIDs[shortID]; tx != nil {
+			block.Transactions[i] = tx
 		} else {
-			// Look up short ID in mempool
-			if shortIDIndex >= len(cb.ShortIDs) {
-				return nil, nil, fmt.Errorf("short ID index out of bounds")
-			}
+			// Missing transaction - request it
+			missing = append(missing, i)
+		}
+	}
+
+	return block, missing, nil
+}
 
-			shortID := cb.ShortIDs[shortIDIndex]
-			shortIDIndex++
+// FillMissing places transactions fetched for the missing indices into a
+// block returned by ReconstructBlock, checking each against its short ID.
+func (cb *CompactBlock) FillMissing(block *MsgBlock, missing []int, txs []*MsgTx) error {
+	if len(txs) != len(missing) {
+		return fmt.Errorf("expected %d transactions, got %d", len(missing), len(txs))
+	}
+	shortIDs, err := cb.shortIDsByIndex()
+	if err != nil {
+		return err
+	}
 
-			if tx, exists := mempoolShortIDs[shortID]; exists {
-				block.AddTransaction(tx)
-			} else {
-				// Missing transaction - request it
-				missing = append(missing, currentTxIndex)
-				// Add placeholder nil (will be replaced)
-				block.AddTransaction(&MsgTx{})
-			}
+	for i, index := range missing {
+		shortID, ok := shortIDs[index]
+		if !ok || txs[i] == nil || computeShortID(txs[i].TxHash(), cb.Nonce) != shortID {
+			return fmt.Errorf("transaction for index %d does not match its short ID", index)
 		}
+		block.Transactions[index] = txs[i]
+	}
+	return nil
+}
 
-		currentTxIndex++
+// Serialize writes the compact block in the binary format of the P2P
+// protocol. Short IDs take 6 bytes each.
+func (cb *CompactBlock) Serialize(w io.Writer) error {
+	if err := cb.Header.Serialize(w); err != nil {
+		return err
+	}
+	if err := writeElements(w, cb.Nonce); err != nil {
+		return err
 	}
 
-	return block, missing, nil
+	if err := WriteVarInt(w, uint64(len(cb.ShortIDs))); err != nil {
+		return err
+	}
+	var buf [8]byte
+	for _, shortID := range cb.ShortIDs {
+		for i := 0; i < ShortIDSize; i++ {
+			buf[i] = byte(shortID >> (i * 8))
+		}
+		if _, err := w.Write(buf[:ShortIDSize]); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteVarInt(w, uint64(len(cb.PrefilledTxs))); err != nil {
+		return err
+	}
+	for _, pf := range cb.PrefilledTxs {
+		if err := WriteVarInt(w, uint64(pf.Index)); err != nil {
+			return err
+		}
+		if err := pf.Tx.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads a compact block written by Serialize
+func (cb *CompactBlock) Deserialize(r io.Reader) error {
+	if err := cb.Header.Deserialize(r); err != nil {
+		return err
+	}
+	if err := readElements(r, &cb.Nonce); err != nil {
+		return err
+	}
+
+	count, err := ReadCount(r, maxBlockTxs, "short ID")
+	if err != nil {
+		return err
+	}
+	cb.ShortIDs = make([]uint64, count)
+	var buf [8]byte
+	for i := range cb.ShortIDs {
+		if _, err := io.ReadFull(r, buf[:ShortIDSize]); err != nil {
+			return err
+		}
+		for j := 0; j < ShortIDSize; j++ {
+			cb.ShortIDs[i] |= uint64(buf[j]) << (j * 8)
+		}
+	}
+
+	count, err = ReadCount(r, maxBlockTxs, "prefilled transaction")
+	if err != nil {
+		return err
+	}
+	cb.PrefilledTxs = make([]PrefilledTransaction, count)
+	for i := range cb.PrefilledTxs {
+		index, err := ReadCount(r, maxBlockTxs, "prefilled index")
+		if err != nil {
+			return err
+		}
+		tx := &MsgTx{}
+		if err := tx.Deserialize(r); err != nil {
+			return err
+		}
+		cb.PrefilledTxs[i] = PrefilledTransaction{Index: int(index), Tx: tx}
+	}
+	return nil
 }
 
 // Encode encodes the compact block.
 func (cb *CompactBlock) Encode() ([]byte, error) {
 	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	if err := encoder.Encode(cb); err != nil {
+	if err := cb.Serialize(&buf); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -137,10 +265,8 @@ func (cb *CompactBlock) Encode() ([]byte, error) {
 
 // DecodeCompactBlock decodes a compact block.
 func DecodeCompactBlock(data []byte) (*CompactBlock, error) {
-	buf := bytes.NewBuffer(data)
-	decoder := gob.NewDecoder(buf)
 	cb := &CompactBlock{}
-	if err := decoder.Decode(cb); err != nil {
+	if err := cb.Deserialize(bytes.NewReader(data)); err != nil {
 		return nil, err
 	}
 	return cb, nil
@@ -152,8 +278,80 @@ type BlockTxRequest struct {
 	Indices   []int // Indices of missing transactions
 }
 
+// Serialize writes the request as the block hash and a list of indices
+func (req *BlockTxRequest) Serialize(w io.Writer) error {
+	if _, err := w.Write(req.BlockHash[:]); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, uint64(len(req.Indices))); err != nil {
+		return err
+	}
+	for _, index := range req.Indices {
+		if err := WriteVarInt(w, uint64(index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads a request written by Serialize
+func (req *BlockTxRequest) Deserialize(r io.Reader) error {
+	if _, err := io.ReadFull(r, req.BlockHash[:]); err != nil {
+		return err
+	}
+	count, err := ReadCount(r, maxBlockTxs, "index")
+	if err != nil {
+		return err
+	}
+	req.Indices = make([]int, count)
+	for i := range req.Indices {
+		index, err := ReadCount(r, maxBlockTxs, "transaction index")
+		if err != nil {
+			return err
+		}
+		req.Indices[i] = int(index)
+	}
+	return nil
+}
+
 // BlockTxResponse contains the requested transactions.
 type BlockTxResponse struct {
 	BlockHash    Hash
 	Transactions []*MsgTx
 }
+
+// Serialize writes the response as the block hash and the transactions
+func (resp *BlockTxResponse) Serialize(w io.Writer) error {
+	if _, err := w.Write(resp.BlockHash[:]); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, uint64(len(resp.Transactions))); err != nil {
+		return err
+	}
+	for _, tx := range resp.Transactions {
+		if err := tx.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads a response written by Serialize
+func (resp *BlockTxResponse) Deserialize(r io.Reader) error {
+	if _, err := io.ReadFull(r, resp.BlockHash[:]); err != nil {
+		return err
+	}
+	count, err := ReadCount(r, maxBlockTxs, "transaction")
+	if err != nil {
+		return err
+	}
+	resp.Transactions = make([]*MsgTx, count)
+	for i := range resp.Transactions {
+		tx := &MsgTx{}
+		if err := tx.Deserialize(r); err != nil {
+			return err
+		}
+		resp.Transactions[i] = tx
+	}
+	return nil
+}
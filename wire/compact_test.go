@@ -0,0 +1,107 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// compactTestBlock returns a block with a coinbase and n spends
+func compactTestBlock(n int) *MsgBlock {
+	block := NewMsgBlock(&BlockHeader{Version: BlockVersion, PrevBlock: Hash{0xaa}, Bits: 0x1d00ffff})
+	block.AddTransaction(NewCoinbaseTx(1, 5000, "obs1miner"))
+	for i := 0; i < n; i++ {
+		tx := NewMsgTx(TxVersion)
+		tx.AddTxIn(&TxIn{PreviousOutPoint: OutPoint{Hash: Hash{byte(i + 1)}}, Sequence: 0xffffffff})
+		tx.AddTxOut(&TxOut{Value: int64(100 + i), PkScript: []byte("obs1recipient")})
+		block.AddTransaction(tx)
+	}
+	return block
+}
+
+func TestCompactBlockRoundTrip(t *testing.T) {
+	block := compactTestBlock(3)
+	cb := NewCompactBlock(block, 0x0123456789abcdef)
+
+	encoded, err := cb.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := DecodeCompactBlock(encoded)
+	if err != nil {
+		t.Fatalf("DecodeCompactBlock failed: %v", err)
+	}
+	if decoded.Header.BlockHash() != block.BlockHash() || decoded.Nonce != cb.Nonce {
+		t.Error("Header or nonce changed in round trip")
+	}
+	if len(decoded.ShortIDs) != 3 || len(decoded.PrefilledTxs) != 1 {
+		t.Fatalf("Decoded %d short IDs and %d prefilled transactions", len(decoded.ShortIDs), len(decoded.PrefilledTxs))
+	}
+	for i, id := range decoded.ShortIDs {
+		if id != cb.ShortIDs[i] || id>>(8*ShortIDSize) != 0 {
+			t.Errorf("Short ID %d = %x, expected %x", i, id, cb.ShortIDs[i])
+		}
+	}
+
+	req := &BlockTxRequest{BlockHash: block.BlockHash(), Indices: []int{1, 300}}
+	var buf bytes.Buffer
+	if err := req.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize request failed: %v", err)
+	}
+	decodedReq := &BlockTxRequest{}
+	if err := decodedReq.Deserialize(&buf); err != nil || decodedReq.Indices[1] != 300 {
+		t.Errorf("Request round trip = %v, %v", decodedReq.Indices, err)
+	}
+
+	resp := &BlockTxResponse{BlockHash: block.BlockHash(), Transactions: block.Transactions[1:]}
+	buf.Reset()
+	if err := resp.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize response failed: %v", err)
+	}
+	decodedResp := &BlockTxResponse{}
+	if err := decodedResp.Deserialize(&buf); err != nil || len(decodedResp.Transactions) != 3 {
+		t.Fatalf("Response round trip = %d transactions, %v", len(decodedResp.Transactions), err)
+	}
+	if decodedResp.Transactions[2].TxHash() != block.Transactions[3].TxHash() {
+		t.Error("Response transaction changed in round trip")
+	}
+}
+
+func TestReconstructBlock(t *testing.T) {
+	block := compactTestBlock(4)
+	cb := NewCompactBlock(block, 7)
+
+	// The mempool holds all but the third transaction
+	mempool := make(map[Hash]*MsgTx)
+	for i, tx := range block.Transactions[1:] {
+		if i != 2 {
+			mempool[tx.TxHash()] = tx
+		}
+	}
+	rebuilt, missing, err := cb.ReconstructBlock(mempool)
+	if err != nil {
+		t.Fatalf("ReconstructBlock failed: %v", err)
+	}
+	if len(missing) != 1 || missing[0] != 3 || rebuilt.Transactions[3] != nil {
+		t.Fatalf("Expected index 3 missing, got %v", missing)
+	}
+
+	// A transaction that does not match the short ID is refused
+	if err := cb.FillMissing(rebuilt, missing, []*MsgTx{block.Transactions[1]}); err == nil {
+		t.Error("FillMissing accepted the wrong transaction")
+	}
+	if err := cb.FillMissing(rebuilt, missing, []*MsgTx{block.Transactions[3]}); err != nil {
+		t.Fatalf("FillMissing failed: %v", err)
+	}
+	for i, tx := range rebuilt.Transactions {
+		if tx.TxHash() != block.Transactions[i].TxHash() {
+			t.Errorf("Transaction %d differs from the original", i)
+		}
+	}
+
+	// Out of range prefilled indices are rejected
+	bad := *cb
+	bad.PrefilledTxs = []PrefilledTransaction{{Index: 5, Tx: block.Transactions[0]}}
+	if _, _, err := bad.ReconstructBlock(mempool); err == nil {
+		t.Error("Accepted a prefilled index past the end of the block")
+	}
+}
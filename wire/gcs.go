@@ -0,0 +1,296 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// GCSFilterP is the Golomb-Rice parameter of basic block filters
+	GCSFilterP = 19
+
+	// GCSFilterM is the inverse false positive rate of basic block filters
+	GCSFilterM = 784931
+
+	// GCSFilterKeySize is the size of the SipHash key of a block filter
+	GCSFilterKeySize = 16
+
+	// MaxGCSFilterSize bounds a serialized block filter
+	MaxGCSFilterSize = MaxSerializeSize
+)
+
+// GCSFilter is a Golomb-coded set as used by BIP158 block filters. Elements
+// are hashed into [0, N*M), sorted, and the differences Golomb-Rice coded.
+type GCSFilter struct {
+	n    uint32
+	data []byte
+}
+
+// BuildGCSFilter returns a filter of the distinct elements keyed by key.
+// Empty elements are ignored.
+func BuildGCSFilter(key [GCSFilterKeySize]byte, elements [][]byte) *GCSFilter {
+	seen := make(map[string]bool, len(elements))
+	var distinct [][]byte
+	for _, e := range elements {
+		if len(e) == 0 || seen[string(e)] {
+			continue
+		}
+		seen[string(e)] = true
+		distinct = append(distinct, e)
+	}
+
+	n := uint32(len(distinct))
+	values := hashedSetValues(key, n, distinct)
+
+	var w bitWriter
+	var last uint64
+	for _, v := range values {
+		delta := v - last
+		last = v
+		for q := delta >> GCSFilterP; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, GCSFilterP)
+	}
+	return &GCSFilter{n: n, data: w.bytes}
+}
+
+// ParseGCSFilter decodes a filter serialized with Bytes.
+func ParseGCSFilter(b []byte) (*GCSFilter, error) {
+	r := bytes.NewReader(b)
+	n, err := ReadVarInt(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+	if n > MaxGCSFilterSize {
+		return nil, fmt.Errorf("filter element count %d too large", n)
+	}
+	return &GCSFilter{n: uint32(n), data: b[len(b)-r.Len():]}, nil
+}
+
+// N returns the number of elements in the filter.
+func (f *GCSFilter) N() uint32 {
+	return f.n
+}
+
+// Bytes returns the serialized filter: the element count followed by the
+// Golomb-Rice coded values.
+func (f *GCSFilter) Bytes() []byte {
+	var buf bytes.Buffer
+	WriteVarInt(&buf, uint64(f.n))
+	buf.Write(f.data)
+	return buf.Bytes()
+}
+
+// Hash returns the double SHA-256 of the serialized filter.
+func (f *GCSFilter) Hash() Hash {
+	return DoubleHashH(f.Bytes())
+}
+
+// Match reports whether element may be in the filter.
+func (f *GCSFilter) Match(key [GCSFilterKeySize]byte, element []byte) bool {
+	return f.MatchAny(key, [][]byte{element})
+}
+
+// MatchAny reports whether any of the elements may be in the filter.
+func (f *GCSFilter) MatchAny(key [GCSFilterKeySize]byte, elements [][]byte) bool {
+	if f.n == 0 || len(elements) == 0 {
+		return false
+	}
+	targets := hashedSetValues(key, f.n, elements)
+
+	r := bitReader{data: f.data}
+	var value uint64
+	for i := uint32(0); i < f.n; i++ {
+		delta, ok := r.readGolomb()
+		if !ok {
+			return false
+		}
+		value += delta
+		for len(targets) > 0 && targets[0] < value {
+			targets = targets[1:]
+		}
+		if len(targets) == 0 {
+			return false
+		}
+		if targets[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hashedSetValues maps elements into [0, n*M) and returns them sorted
+func hashedSetValues(key [GCSFilterKeySize]byte, n uint32, elements [][]byte) []uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	modulus := uint64(n) * GCSFilterM
+	values := make([]uint64, len(elements))
+	for i, e := range elements {
+		values[i], _ = bits.Mul64(sipHash24(k0, k1, e), modulus)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+// BlockFilterKey returns the SipHash key of a block's filter, the first
+// bytes of its hash.
+func BlockFilterKey(blockHash Hash) [GCSFilterKeySize]byte {
+	var key [GCSFilterKeySize]byte
+	copy(key[:], blockHash[:])
+	return key
+}
+
+// BasicFilterElements returns the elements committed to by a block's basic
+// filter: every non-empty output script and every outpoint spent by a
+// non-coinbase input. Spends are committed as outpoints rather than the
+// scripts they spend so filters can be built from blocks alone.
+func BasicFilterElements(block *MsgBlock) [][]byte {
+	var elements [][]byte
+	for i, tx := range block.Transactions {
+		if i > 0 {
+			for _, in := range tx.TxIn {
+				elements = append(elements, outPointKey(in.PreviousOutPoint))
+			}
+		}
+		for _, out := range tx.TxOut {
+			if len(out.PkScript) > 0 {
+				elements = append(elements, out.PkScript)
+			}
+		}
+	}
+	return elements
+}
+
+// BuildBasicFilter returns the basic filter of a block.
+func BuildBasicFilter(block *MsgBlock) *GCSFilter {
+	return BuildGCSFilter(BlockFilterKey(block.BlockHash()), BasicFilterElements(block))
+}
+
+// FilterHeader chains a filter hash onto the previous block's filter header.
+func FilterHeader(filterHash, prevHeader Hash) Hash {
+	var buf [2 * HashSize]byte
+	copy(buf[:HashSize], filterHash[:])
+	copy(buf[HashSize:], prevHeader[:])
+	return DoubleHashH(buf[:])
+}
+
+// bitWriter appends bits most significant first
+type bitWriter struct {
+	bytes []byte
+	used  uint8 // bits used in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 {
+		w.bytes = append(w.bytes, 0)
+		w.used = 8
+	}
+	w.used--
+	if bit {
+		w.bytes[len(w.bytes)-1] |= 1 << w.used
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v>>uint(i)&1 == 1)
+	}
+}
+
+// bitReader reads bits most significant first
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (bool, bool) {
+	if r.pos >= 8*len(r.data) {
+		return false, false
+	}
+	bit := r.data[r.pos/8]>>(7-uint(r.pos%8))&1 == 1
+	r.pos++
+	return bit, true
+}
+
+// readGolomb reads one Golomb-Rice coded value
+func (r *bitReader) readGolomb() (uint64, bool) {
+	var q uint64
+	for {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+	var rem uint64
+	for i := 0; i < GCSFilterP; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		rem <<= 1
+		if bit {
+			rem |= 1
+		}
+	}
+	return q<<GCSFilterP | rem, true
+}
+
+// sipHash24 returns the SipHash-2-4 of data under the key (k0, k1)
+func sipHash24(k0, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(data)
+	for len(data) >= 8 {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		data = data[8:]
+	}
+
+	var tail [8]byte
+	copy(tail[:], data)
+	tail[7] = byte(length)
+	m := binary.LittleEndian.Uint64(tail[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,92 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSipHash24(t *testing.T) {
+	// Reference vector from the SipHash paper: key 00..0f, message 00..0e
+	var key [16]byte
+	msg := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	got := sipHash24(binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:]), msg)
+	if got != 0xa129ca6149be45e5 {
+		t.Errorf("sipHash24 = %x, expected a129ca6149be45e5", got)
+	}
+}
+
+func TestGCSFilterMatch(t *testing.T) {
+	key := BlockFilterKey(Hash{1, 2, 3})
+	var elements [][]byte
+	for i := 0; i < 200; i++ {
+		elements = append(elements, []byte{byte(i), byte(i >> 8), 0xee})
+	}
+	filter := BuildGCSFilter(key, append(elements, elements[0], nil))
+	if filter.N() != 200 {
+		t.Fatalf("Filter has %d elements, expected 200 distinct", filter.N())
+	}
+
+	parsed, err := ParseGCSFilter(filter.Bytes())
+	if err != nil {
+		t.Fatalf("ParseGCSFilter failed: %v", err)
+	}
+	if parsed.Hash() != filter.Hash() {
+		t.Error("Filter changed in round trip")
+	}
+	for _, e := range elements {
+		if !parsed.Match(key, e) {
+			t.Fatalf("Element %x not matched", e)
+		}
+	}
+
+	// Outsiders match at roughly the 1/M false positive rate
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if parsed.Match(key, []byte{byte(i), byte(i >> 8), 0xff}) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 1 {
+		t.Errorf("%d false positives in 1000 queries", falsePositives)
+	}
+	if !parsed.MatchAny(key, [][]byte{[]byte("absent"), elements[150]}) {
+		t.Error("MatchAny missed a member")
+	}
+
+	// A different key hashes elements elsewhere
+	if BuildGCSFilter(BlockFilterKey(Hash{9}), elements).Hash() == filter.Hash() {
+		t.Error("Filters with different keys are identical")
+	}
+	if empty := BuildGCSFilter(key, nil); !bytes.Equal(empty.Bytes(), []byte{0}) || empty.Match(key, elements[0]) {
+		t.Error("Empty filter should serialize to a zero count and match nothing")
+	}
+}
+
+func TestBasicFilter(t *testing.T) {
+	block := compactTestBlock(3)
+	filter := BuildBasicFilter(block)
+	key := BlockFilterKey(block.BlockHash())
+
+	spent := block.Transactions[2].TxIn[0].PreviousOutPoint
+	if !filter.Match(key, outPointKey(spent)) {
+		t.Error("Spent outpoint not matched")
+	}
+	if !filter.Match(key, []byte("obs1recipient")) {
+		t.Error("Output script not matched")
+	}
+	if filter.Match(key, outPointKey(OutPoint{Hash: Hash{0x77}})) {
+		t.Error("Unspent outpoint matched")
+	}
+
+	prev := Hash{5}
+	if FilterHeader(filter.Hash(), prev) == FilterHeader(filter.Hash(), Hash{}) {
+		t.Error("Filter header does not commit to the previous header")
+	}
+}
@@ -139,10 +139,10 @@ type MsgTx struct {
 	// Zcash/Obsidian specific fields
 	TxType          TxType            // Transaction type
 	ExpiryHeight    uint32            // Block height after which tx expires
-	ValueBalance    int64             // Net value balance (shielded - transparent)
+	ValueBalance    int64             // Net value leaving the shielded pool (spends - outputs)
 	ShieldedSpends  []*ShieldedSpend  // Shielded inputs
 	ShieldedOutputs []*ShieldedOutput // Shielded outputs
-	BindingSig      []byte            // Binding signature (proves value balance)
+	BindingSig      []byte            // Binding signature over ShieldedSigHash (proves value balance)
 
 	// Transparent transaction memo (optional, for t-addr txs)
 	Memo []byte // Up to 512 bytes (encrypted in shielded txs)
@@ -184,47 +184,6 @@ func NewShieldedTx(version int32) *MsgTx {
 	return tx
 }
 
-// NewShieldTx creates a shield transaction (transparent to shielded)
-func NewShieldTx(fromAddress, toShieldedAddress string, amount int64) *MsgTx {
-	tx := NewMsgTx(1)
-	tx.TxType = TxTypeMixed // Mixed for shield/unshield
-
-	// Add transparent input (simplified)
-	tx.AddTxIn(&TxIn{
-		PreviousOutPoint: OutPoint{Hash: Hash{}, Index: 0},
-		SignatureScript:  []byte(fromAddress), // Simplified
-	})
-
-	// Add shielded output (simplified)
-	shieldedOutput := &ShieldedOutput{
-		TokenAmount: amount,
-		// Note: In real implementation, create proper commitments and proofs
-	}
-	tx.AddShieldedOutput(shieldedOutput)
-
-	return tx
-}
-
-// NewUnshieldTx creates an unshield transaction (shielded to transparent)
-func NewUnshieldTx(fromShieldedAddress, toAddress string, amount int64) *MsgTx {
-	tx := NewMsgTx(1)
-	tx.TxType = TxTypeMixed // Mixed for shield/unshield
-
-	// Add shielded spend
-	shieldedSpend := &ShieldedSpend{
-		// Note: In real implementation, add proper nullifier and proof
-	}
-	tx.AddShieldedSpend(shieldedSpend)
-
-	// Add transparent output
-	tx.AddTxOut(&TxOut{
-		Value:    amount,
-		PkScript: []byte(toAddress), // Simplified
-	})
-
-	return tx
-}
-
 // AddShieldedSpend adds a shielded input to the transaction
 func (msg *MsgTx) AddShieldedSpend(spend *ShieldedSpend) {
 	msg.ShieldedSpends = append(msg.ShieldedSpends, spend)
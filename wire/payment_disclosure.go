@@ -0,0 +1,261 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Payment disclosure constants
+const (
+	PaymentDisclosureVersion = 1
+	PaymentDisclosurePrefix  = "zpd:"
+	MaxDisclosureMessageSize = 512
+
+	paymentDisclosureDomain = "Obsidian_PaymentDisclosure"
+	paymentDisclosureNonce  = "Obsidian_PaymentDisclosureNonce"
+)
+
+// PaymentDisclosure proves that a shielded output of a transaction paid a
+// note to an address. It reveals the note plaintext and the outgoing cipher
+// key of that one output, and is signed with the transaction's binding key
+// so only the creator of the transaction can produce it.
+type PaymentDisclosure struct {
+	Version     uint8
+	TxHash      Hash
+	OutputIndex uint32
+	Ock         []byte // Outgoing cipher key of the output (32 bytes)
+	Note        *Note  // Note plaintext
+	Message     string // Free-form message bound by the signature
+	Signature   []byte // Schnorr signature by bsk over Hash()
+}
+
+// DisclosedPayment is the payment proven by a valid disclosure
+type DisclosedPayment struct {
+	TxHash      Hash
+	OutputIndex uint32
+	Address     *ShieldedAddress
+	Value       int64
+	Memo        []byte
+	Message     string
+}
+
+// NewPaymentDisclosure creates and signs a disclosure for output index of
+// tx. ock is the output's outgoing cipher key and bsk the binding signing
+// key the transaction was built with.
+func NewPaymentDisclosure(tx *MsgTx, index uint32, ock, bsk []byte, message string) (*PaymentDisclosure, error) {
+	if int(index) >= len(tx.ShieldedOutputs) {
+		return nil, fmt.Errorf("output index %d out of range", index)
+	}
+	if len(message) > MaxDisclosureMessageSize {
+		return nil, fmt.Errorf("message exceeds %d bytes", MaxDisclosureMessageSize)
+	}
+
+	output := tx.ShieldedOutputs[index]
+	pkd, esk, err := DecryptOutgoingWithOck(ock, output.OutCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt outgoing ciphertext: %v", err)
+	}
+	note, err := DecryptNoteWithEsk(esk, pkd, output.EphemeralKey, output.EncCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt note: %v", err)
+	}
+	note.TokenID = output.TokenID
+
+	x, err := parseScalar(bsk)
+	if err != nil {
+		return nil, err
+	}
+	bvk, err := tx.bindingVerificationKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// The key must be the one behind the transaction's binding signature
+	var derived btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(x, &derived)
+	if !bytes.Equal(pointBytes(&derived), pointBytes(bvk)) {
+		return nil, fmt.Errorf("binding key does not match transaction")
+	}
+
+	pd := &PaymentDisclosure{
+		Version:     PaymentDisclosureVersion,
+		TxHash:      tx.TxHash(),
+		OutputIndex: index,
+		Ock:         ock,
+		Note:        note,
+		Message:     message,
+	}
+
+	pd.Signature, err = schnorrSign(x, bvk, paymentDisclosureDomain, paymentDisclosureNonce, pd.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	return pd, nil
+}
+
+// Hash returns the hash signed by the disclosure (everything but the
+// signature)
+func (pd *PaymentDisclosure) Hash() Hash {
+	var buf bytes.Buffer
+	buf.WriteString(paymentDisclosureDomain)
+	pd.writePayload(&buf)
+	return DoubleHashH(buf.Bytes())
+}
+
+// Verify checks the disclosure against the transaction it refers to and
+// returns the disclosed payment
+func (pd *PaymentDisclosure) Verify(tx *MsgTx) (*DisclosedPayment, error) {
+	if pd.Version != PaymentDisclosureVersion {
+		return nil, fmt.Errorf("unsupported payment disclosure version %d", pd.Version)
+	}
+	if tx.TxHash() != pd.TxHash {
+		return nil, fmt.Errorf("transaction does not match disclosure")
+	}
+	if int(pd.OutputIndex) >= len(tx.ShieldedOutputs) {
+		return nil, fmt.Errorf("output index %d out of range", pd.OutputIndex)
+	}
+	if pd.Note == nil {
+		return nil, fmt.Errorf("disclosure has no note")
+	}
+
+	// Signed by the creator of the transaction
+	bvk, err := tx.bindingVerificationKey()
+	if err != nil {
+		return nil, err
+	}
+	if !schnorrVerify(bvk, pd.Signature, paymentDisclosureDomain, pd.Hash()) {
+		return nil, fmt.Errorf("invalid disclosure signature")
+	}
+
+	// The revealed note opens the on-chain commitment. Notes hold the token
+	// of the output they were sent in.
+	output := tx.ShieldedOutputs[pd.OutputIndex]
+	pd.Note.TokenID = output.TokenID
+	if !bytes.Equal(pd.Note.Commit().Cm, output.Cmu) {
+		return nil, fmt.Errorf("note does not match output commitment")
+	}
+
+	// The outgoing cipher key recovers the recipient and ephemeral secret,
+	// and the ephemeral secret must reproduce the on-chain ephemeral key
+	pkd, esk, err := DecryptOutgoingWithOck(pd.Ock, output.OutCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("outgoing cipher key does not decrypt output: %v", err)
+	}
+	eskScalar, err := parseScalar(esk)
+	if err != nil {
+		return nil, err
+	}
+	var epk btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(eskScalar, &epk)
+	if !bytes.Equal(pointBytes(&epk), output.EphemeralKey) {
+		return nil, fmt.Errorf("ephemeral key mismatch")
+	}
+
+	// The note encrypted to the recipient is the revealed note
+	note, err := DecryptNoteWithEsk(esk, pkd, output.EphemeralKey, output.EncCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt note: %v", err)
+	}
+	note.TokenID = output.TokenID
+	if !bytes.Equal(note.Commit().Cm, output.Cmu) {
+		return nil, fmt.Errorf("encrypted note does not match output commitment")
+	}
+
+	return &DisclosedPayment{
+		TxHash:      pd.TxHash,
+		OutputIndex: pd.OutputIndex,
+		Address: &ShieldedAddress{
+			Prefix:     ShieldedAddressPrefix,
+			PublicKey:  note.Recipient,
+			ViewingKey: pkd,
+		},
+		Value:   note.Value,
+		Memo:    note.Memo,
+		Message: pd.Message,
+	}, nil
+}
+
+// String encodes the disclosure as "zpd:" followed by hex
+func (pd *PaymentDisclosure) String() string {
+	var buf bytes.Buffer
+	pd.writePayload(&buf)
+	buf.Write(pd.Signature)
+	return PaymentDisclosurePrefix + hex.EncodeToString(buf.Bytes())
+}
+
+// ParsePaymentDisclosure decodes a disclosure produced by String
+func ParsePaymentDisclosure(s string) (*PaymentDisclosure, error) {
+	if !strings.HasPrefix(s, PaymentDisclosurePrefix) {
+		return nil, fmt.Errorf("payment disclosure must start with %q", PaymentDisclosurePrefix)
+	}
+	data, err := hex.DecodeString(strings.TrimPrefix(s, PaymentDisclosurePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment disclosure encoding: %v", err)
+	}
+
+	// version(1) + txhash(32) + index(4) + ock(32) + note(8+32+32+512) + msglen(2) + sig
+	const fixedSize = 1 + 32 + 4 + 32 + 8 + 32 + 32 + 512 + 2
+	if len(data) < fixedSize+BindingSigSize {
+		return nil, fmt.Errorf("payment disclosure too short")
+	}
+
+	pd := &PaymentDisclosure{Note: &Note{}}
+	r := bytes.NewReader(data)
+	pd.Version, _ = r.ReadByte()
+	r.Read(pd.TxHash[:])
+	binary.Read(r, binary.LittleEndian, &pd.OutputIndex)
+	pd.Ock = make([]byte, 32)
+	r.Read(pd.Ock)
+	binary.Read(r, binary.LittleEndian, &pd.Note.Value)
+	pd.Note.Recipient = make([]byte, 32)
+	r.Read(pd.Note.Recipient)
+	pd.Note.Rcm = make([]byte, 32)
+	r.Read(pd.Note.Rcm)
+	pd.Note.Memo = make([]byte, 512)
+	r.Read(pd.Note.Memo)
+
+	var msgLen uint16
+	binary.Read(r, binary.LittleEndian, &msgLen)
+	if int(msgLen) > MaxDisclosureMessageSize || r.Len() != int(msgLen)+BindingSigSize {
+		return nil, fmt.Errorf("invalid payment disclosure length")
+	}
+	message := make([]byte, msgLen)
+	r.Read(message)
+	pd.Message = string(message)
+
+	pd.Signature = make([]byte, BindingSigSize)
+	r.Read(pd.Signature)
+
+	return pd, nil
+}
+
+// writePayload serializes every field except the signature
+func (pd *PaymentDisclosure) writePayload(buf *bytes.Buffer) {
+	buf.WriteByte(pd.Version)
+	buf.Write(pd.TxHash[:])
+	binary.Write(buf, binary.LittleEndian, pd.OutputIndex)
+	buf.Write(fixedBytes(pd.Ock, 32))
+	if pd.Note != nil {
+		binary.Write(buf, binary.LittleEndian, pd.Note.Value)
+		buf.Write(fixedBytes(pd.Note.Recipient, 32))
+		buf.Write(fixedBytes(pd.Note.Rcm, 32))
+		buf.Write(fixedBytes(pd.Note.Memo, 512))
+	} else {
+		buf.Write(make([]byte, 8+32+32+512))
+	}
+	binary.Write(buf, binary.LittleEndian, uint16(len(pd.Message)))
+	buf.WriteString(pd.Message)
+}
+
+// fixedBytes returns b padded or truncated to size bytes
+func fixedBytes(b []byte, size int) []byte {
+	out := make([]byte, size)
+	copy(out, b)
+	return out
+}
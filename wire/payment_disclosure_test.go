@@ -0,0 +1,117 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newDisclosureTestTx returns a shielding transaction with one output paying
+// value to addr, along with its binding key and the output's cipher key
+func newDisclosureTestTx(t *testing.T, addr *ShieldedAddress, value int64, memo []byte) (*MsgTx, []byte, []byte) {
+	note, err := CreateNote(value, addr.PublicKey, memo)
+	if err != nil {
+		t.Fatalf("CreateNote failed: %v", err)
+	}
+	enc, err := EncryptNoteToAddress(note, addr)
+	if err != nil {
+		t.Fatalf("EncryptNoteToAddress failed: %v", err)
+	}
+	rcv := note.ValueCommitTrapdoor()
+	cv := note.ValueCommitment()
+
+	ovk, _ := GenerateValueCommitTrapdoor()
+	cmu := note.Commit().Cm
+	outCiphertext, err := EncryptOutgoing(ovk, cv, cmu, enc.EphemeralKey, addr.ViewingKey, enc.Esk)
+	if err != nil {
+		t.Fatalf("EncryptOutgoing failed: %v", err)
+	}
+
+	tx := NewShieldedTx(TxVersion)
+	tx.AddShieldedOutput(&ShieldedOutput{
+		Cv:            cv,
+		Cmu:           cmu,
+		EphemeralKey:  enc.EphemeralKey,
+		EncCiphertext: enc.EncCiphertext,
+		OutCiphertext: outCiphertext,
+	})
+	tx.ValueBalance = -value
+
+	bsk, err := DeriveBindingKey(nil, [][]byte{rcv})
+	if err != nil {
+		t.Fatalf("DeriveBindingKey failed: %v", err)
+	}
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("SignBinding failed: %v", err)
+	}
+
+	return tx, bsk, OutgoingCipherKey(ovk, cv, cmu, enc.EphemeralKey)
+}
+
+func TestPaymentDisclosureRoundTrip(t *testing.T) {
+	recipient, _ := GenerateShieldedSpendingKey()
+	addr := recipient.Address()
+	tx, bsk, ock := newDisclosureTestTx(t, addr, 250000, []byte("invoice 42"))
+
+	pd, err := NewPaymentDisclosure(tx, 0, ock, bsk, "paid in full")
+	if err != nil {
+		t.Fatalf("NewPaymentDisclosure failed: %v", err)
+	}
+
+	parsed, err := ParsePaymentDisclosure(pd.String())
+	if err != nil {
+		t.Fatalf("ParsePaymentDisclosure failed: %v", err)
+	}
+
+	payment, err := parsed.Verify(tx)
+	if err != nil {
+		t.Fatalf("Valid disclosure rejected: %v", err)
+	}
+	if payment.Value != 250000 || payment.Message != "paid in full" {
+		t.Errorf("Disclosed value/message = %d/%q", payment.Value, payment.Message)
+	}
+	if payment.Address.String() != addr.String() {
+		t.Errorf("Disclosed address = %s, want %s", payment.Address, addr)
+	}
+	if !bytes.HasPrefix(payment.Memo, []byte("invoice 42")) {
+		t.Errorf("Disclosed memo = %q", payment.Memo[:10])
+	}
+}
+
+func TestPaymentDisclosureRejectsTampering(t *testing.T) {
+	recipient, _ := GenerateShieldedSpendingKey()
+	tx, bsk, ock := newDisclosureTestTx(t, recipient.Address(), 250000, nil)
+
+	// Only the holder of the binding key can disclose
+	otherTx, otherBsk, _ := newDisclosureTestTx(t, recipient.Address(), 1000, nil)
+	if _, err := NewPaymentDisclosure(tx, 0, ock, otherBsk, ""); err == nil {
+		t.Error("Disclosure created with the wrong binding key")
+	}
+
+	pd, err := NewPaymentDisclosure(tx, 0, ock, bsk, "")
+	if err != nil {
+		t.Fatalf("NewPaymentDisclosure failed: %v", err)
+	}
+
+	// A changed value breaks the signature
+	pd.Note.Value++
+	if _, err := pd.Verify(tx); err == nil {
+		t.Error("Disclosure with changed value accepted")
+	}
+	pd.Note.Value--
+
+	// A changed message breaks the signature
+	pd.Message = "forged"
+	if _, err := pd.Verify(tx); err == nil {
+		t.Error("Disclosure with changed message accepted")
+	}
+	pd.Message = ""
+
+	// The disclosure is bound to its transaction
+	if _, err := pd.Verify(otherTx); err == nil {
+		t.Error("Disclosure verified against another transaction")
+	}
+
+	if _, err := pd.Verify(tx); err != nil {
+		t.Errorf("Untampered disclosure rejected: %v", err)
+	}
+}
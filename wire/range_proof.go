@@ -0,0 +1,162 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Range proof constants
+const (
+	ValueRangeBits    = 64                         // Proven values lie in [0, 2^64)
+	rangeBitProofSize = ValueCommitmentSize + 3*32 // C_i || e0 || s0 || s1
+	RangeProofSize    = ValueRangeBits * rangeBitProofSize
+	rangeProofDomain  = "Obsidian_RangeProof"
+)
+
+// Range proofs
+//
+// A range proof shows that a value commitment cv = v*V_t + rcv*G holds a v
+// in [0, 2^64) without revealing it. The value is split into bits and each
+// bit gets its own commitment C_i = b_i*2^i*V_t + r_i*G, with the r_i
+// summing to rcv so that the C_i sum to cv. A two-key ring signature over
+// {C_i, C_i - 2^i*V_t} then proves each C_i commits to 0 or 2^i, since the
+// prover knows the discrete log to G of exactly one of the two.
+
+// proveRange creates a range proof for cv = value*V_t + rcv*G
+func proveRange(value uint64, rcv *btcec.ModNScalar, tokenID Hash, cv []byte) ([]byte, error) {
+	proof := make([]byte, 0, RangeProofSize)
+
+	step := *valueBase(tokenID) // 2^i * V_t
+	var sum btcec.ModNScalar
+	for i := 0; i < ValueRangeBits; i++ {
+		// The last bit's blinding makes the bit commitments sum to cv
+		var r btcec.ModNScalar
+		if i == ValueRangeBits-1 {
+			r.NegateVal(&sum).Add(rcv)
+		} else {
+			random, err := randomScalar()
+			if err != nil {
+				return nil, err
+			}
+			r = *random
+			sum.Add(&r)
+		}
+
+		bit := int(value >> i & 1)
+		var c btcec.JacobianPoint
+		btcec.ScalarBaseMultNonConst(&r, &c)
+		if bit == 1 {
+			c = addPoints(&c, &step)
+		}
+		shifted := addPoints(&c, negatePoint(&step))
+		cBytes := pointBytes(&c)
+
+		sig, err := ringSign(rangeMessage(cv, i, cBytes), [2]*btcec.JacobianPoint{&c, &shifted}, bit, &r)
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, cBytes...)
+		proof = append(proof, sig...)
+
+		step = addPoints(&step, &step)
+	}
+
+	return proof, nil
+}
+
+// verifyRange checks a range proof made by proveRange for cv
+func verifyRange(proof []byte, tokenID Hash, cv []byte) bool {
+	if len(proof) != RangeProofSize {
+		return false
+	}
+
+	step := *valueBase(tokenID)
+	var sum btcec.JacobianPoint
+	for i := 0; i < ValueRangeBits; i++ {
+		bitProof := proof[i*rangeBitProofSize : (i+1)*rangeBitProofSize]
+		cBytes := bitProof[:ValueCommitmentSize]
+		c, err := parsePoint(cBytes)
+		if err != nil {
+			return false
+		}
+		shifted := addPoints(c, negatePoint(&step))
+
+		if !ringVerify(rangeMessage(cv, i, cBytes), [2]*btcec.JacobianPoint{c, &shifted}, bitProof[ValueCommitmentSize:]) {
+			return false
+		}
+		sum = addPoints(&sum, c)
+		step = addPoints(&step, &step)
+	}
+
+	// The bit commitments must add up to the value commitment
+	return bytes.Equal(pointBytes(&sum), cv)
+}
+
+// rangeMessage is the message signed by the ring signature of bit i
+func rangeMessage(cv []byte, i int, c []byte) []byte {
+	msg := append([]byte(rangeProofDomain), cv...)
+	msg = append(msg, byte(i))
+	return append(msg, c...)
+}
+
+// ringSign creates a ring signature e0 || s0 || s1 over msg by the holder of
+// the discrete log x of keys[j]
+func ringSign(msg []byte, keys [2]*btcec.JacobianPoint, j int, x *btcec.ModNScalar) ([]byte, error) {
+	k, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	other, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the ring at the known key and close it there
+	var e, s [2]*btcec.ModNScalar
+	var rj btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(k, &rj)
+	e[1-j] = ringChallenge(msg, &rj)
+	s[1-j] = other
+	e[j] = ringChallenge(msg, ringCommitment(s[1-j], e[1-j], keys[1-j]))
+	s[j] = new(btcec.ModNScalar).Mul2(e[j], x).Add(k)
+
+	e0, s0, s1 := e[0].Bytes(), s[0].Bytes(), s[1].Bytes()
+	sig := append(e0[:], s0[:]...)
+	return append(sig, s1[:]...), nil
+}
+
+// ringVerify checks a ring signature made by ringSign
+func ringVerify(msg []byte, keys [2]*btcec.JacobianPoint, sig []byte) bool {
+	if len(sig) != 3*32 {
+		return false
+	}
+	var e0, s0, s1 btcec.ModNScalar
+	if e0.SetByteSlice(sig[:32]) || s0.SetByteSlice(sig[32:64]) || s1.SetByteSlice(sig[64:]) {
+		return false
+	}
+
+	e1 := ringChallenge(msg, ringCommitment(&s0, &e0, keys[0]))
+	return ringChallenge(msg, ringCommitment(&s1, e1, keys[1])).Equals(&e0)
+}
+
+// ringCommitment returns s*G - e*P
+func ringCommitment(s, e *btcec.ModNScalar, p *btcec.JacobianPoint) *btcec.JacobianPoint {
+	var sg, ep btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(s, &sg)
+	btcec.ScalarMultNonConst(e, p, &ep)
+	r := addPoints(&sg, negatePoint(&ep))
+	return &r
+}
+
+// ringChallenge hashes msg and a ring commitment into a challenge scalar
+func ringChallenge(msg []byte, r *btcec.JacobianPoint) *btcec.ModNScalar {
+	h := sha256.New()
+	h.Write(msg)
+	h.Write(pointBytes(r))
+
+	var e btcec.ModNScalar
+	e.SetByteSlice(h.Sum(nil))
+	return &e
+}
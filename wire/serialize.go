@@ -0,0 +1,397 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxSerializeSize bounds the lengths and counts read while decoding, so a
+// malformed message cannot make the decoder allocate more than this
+const MaxSerializeSize = 10 * 1024 * 1024
+
+// writeElements writes fixed-size values in little-endian order
+func writeElements(w io.Writer, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := binary.Write(w, binary.LittleEndian, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readElements reads fixed-size values written by writeElements
+func readElements(r io.Reader, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := binary.Read(r, binary.LittleEndian, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteVarInt writes v as a Bitcoin CompactSize integer
+func WriteVarInt(w io.Writer, v uint64) error {
+	switch {
+	case v < 0xfd:
+		return writeElements(w, uint8(v))
+	case v <= 0xffff:
+		return writeElements(w, uint8(0xfd), uint16(v))
+	case v <= 0xffffffff:
+		return writeElements(w, uint8(0xfe), uint32(v))
+	default:
+		return writeElements(w, uint8(0xff), v)
+	}
+}
+
+// ReadVarInt reads a CompactSize integer. Values not in their shortest
+// encoding are rejected, so every value has one encoding.
+func ReadVarInt(r io.Reader) (uint64, error) {
+	var prefix uint8
+	if err := readElements(r, &prefix); err != nil {
+		return 0, err
+	}
+
+	var v, min uint64
+	switch prefix {
+	case 0xfd:
+		var x uint16
+		if err := readElements(r, &x); err != nil {
+			return 0, err
+		}
+		v, min = uint64(x), 0xfd
+	case 0xfe:
+		var x uint32
+		if err := readElements(r, &x); err != nil {
+			return 0, err
+		}
+		v, min = uint64(x), 0x10000
+	case 0xff:
+		if err := readElements(r, &v); err != nil {
+			return 0, err
+		}
+		min = 0x100000000
+	default:
+		return uint64(prefix), nil
+	}
+	if v < min {
+		return 0, fmt.Errorf("non-canonical varint %d", v)
+	}
+	return v, nil
+}
+
+// ReadCount reads a CompactSize element count of at most max
+func ReadCount(r io.Reader, max uint64, field string) (uint64, error) {
+	count, err := ReadVarInt(r)
+	if err != nil {
+		return 0, err
+	}
+	if count > max {
+		return 0, fmt.Errorf("%s count %d exceeds maximum %d", field, count, max)
+	}
+	return count, nil
+}
+
+// WriteVarBytes writes b prefixed by its length
+func WriteVarBytes(w io.Writer, b []byte) error {
+	if err := WriteVarInt(w, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadVarBytes reads a length-prefixed byte slice of at most max bytes.
+// An empty slice reads as nil.
+func ReadVarBytes(r io.Reader, max uint64, field string) ([]byte, error) {
+	n, err := ReadCount(r, max, field)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteVarString writes s prefixed by its length
+func WriteVarString(w io.Writer, s string) error {
+	return WriteVarBytes(w, []byte(s))
+}
+
+// ReadVarString reads a length-prefixed string of at most max bytes
+func ReadVarString(r io.Reader, max uint64, field string) (string, error) {
+	b, err := ReadVarBytes(r, max, field)
+	return string(b), err
+}
+
+// Minimum encoded sizes, which bound element counts
+const (
+	minTxInSize           = 32 + 4 + 1 + 4
+	minTxOutSize          = 8 + 1
+	minShieldedSpendSize  = 6 + 32 + 8
+	minShieldedOutputSize = 7 + 32 + 8
+	minTxSize             = 4 + 1 + 1 + 4 + 1 + 4 + 8 + 1 + 1 + 1 + 1 + 8 + 8 + 8
+)
+
+// Serialize writes the transaction in the binary format of the P2P
+// protocol. Every field is encoded, including the shielded components.
+func (msg *MsgTx) Serialize(w io.Writer) error {
+	if err := writeElements(w, msg.Version); err != nil {
+		return err
+	}
+
+	if err := WriteVarInt(w, uint64(len(msg.TxIn))); err != nil {
+		return err
+	}
+	for _, in := range msg.TxIn {
+		if err := writeElements(w, in.PreviousOutPoint.Hash, in.PreviousOutPoint.Index); err != nil {
+			return err
+		}
+		if err := WriteVarBytes(w, in.SignatureScript); err != nil {
+			return err
+		}
+		if err := writeElements(w, in.Sequence); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteVarInt(w, uint64(len(msg.TxOut))); err != nil {
+		return err
+	}
+	for _, out := range msg.TxOut {
+		if err := writeElements(w, out.Value); err != nil {
+			return err
+		}
+		if err := WriteVarBytes(w, out.PkScript); err != nil {
+			return err
+		}
+	}
+
+	if err := writeElements(w, msg.LockTime, uint8(msg.TxType), msg.ExpiryHeight, msg.ValueBalance); err != nil {
+		return err
+	}
+
+	if err := WriteVarInt(w, uint64(len(msg.ShieldedSpends))); err != nil {
+		return err
+	}
+	for _, spend := range msg.ShieldedSpends {
+		for _, field := range [][]byte{spend.Cv, spend.Anchor, spend.Nullifier, spend.Rk, spend.Proof, spend.SpendAuthSig} {
+			if err := WriteVarBytes(w, field); err != nil {
+				return err
+			}
+		}
+		if err := writeElements(w, spend.TokenID, spend.TokenAmount); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteVarInt(w, uint64(len(msg.ShieldedOutputs))); err != nil {
+		return err
+	}
+	for _, output := range msg.ShieldedOutputs {
+		for _, field := range [][]byte{output.Cv, output.Cmu, output.EphemeralKey, output.EncCiphertext, output.OutCiphertext, output.Proof, output.Memo} {
+			if err := WriteVarBytes(w, field); err != nil {
+				return err
+			}
+		}
+		if err := writeElements(w, output.TokenID, output.TokenAmount); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteVarBytes(w, msg.BindingSig); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(w, msg.Memo); err != nil {
+		return err
+	}
+	return writeElements(w, msg.GasLimit, msg.GasPrice, msg.GasUsed)
+}
+
+// Deserialize reads a transaction written by Serialize
+func (msg *MsgTx) Deserialize(r io.Reader) error {
+	if err := readElements(r, &msg.Version); err != nil {
+		return err
+	}
+
+	count, err := ReadCount(r, MaxSerializeSize/minTxInSize, "input")
+	if err != nil {
+		return err
+	}
+	msg.TxIn = make([]*TxIn, count)
+	for i := range msg.TxIn {
+		in := &TxIn{}
+		if err := readElements(r, &in.PreviousOutPoint.Hash, &in.PreviousOutPoint.Index); err != nil {
+			return err
+		}
+		if in.SignatureScript, err = ReadVarBytes(r, MaxSerializeSize, "signature script"); err != nil {
+			return err
+		}
+		if err := readElements(r, &in.Sequence); err != nil {
+			return err
+		}
+		msg.TxIn[i] = in
+	}
+
+	if count, err = ReadCount(r, MaxSerializeSize/minTxOutSize, "output"); err != nil {
+		return err
+	}
+	msg.TxOut = make([]*TxOut, count)
+	for i := range msg.TxOut {
+		out := &TxOut{}
+		if err := readElements(r, &out.Value); err != nil {
+			return err
+		}
+		if out.PkScript, err = ReadVarBytes(r, MaxSerializeSize, "pk script"); err != nil {
+			return err
+		}
+		msg.TxOut[i] = out
+	}
+
+	var txType uint8
+	if err := readElements(r, &msg.LockTime, &txType, &msg.ExpiryHeight, &msg.ValueBalance); err != nil {
+		return err
+	}
+	msg.TxType = TxType(txType)
+
+	if count, err = ReadCount(r, MaxSerializeSize/minShieldedSpendSize, "shielded spend"); err != nil {
+		return err
+	}
+	msg.ShieldedSpends = make([]*ShieldedSpend, count)
+	for i := range msg.ShieldedSpends {
+		spend := &ShieldedSpend{}
+		for _, field := range []*[]byte{&spend.Cv, &spend.Anchor, &spend.Nullifier, &spend.Rk, &spend.Proof, &spend.SpendAuthSig} {
+			if *field, err = ReadVarBytes(r, MaxSerializeSize, "shielded spend field"); err != nil {
+				return err
+			}
+		}
+		if err := readElements(r, &spend.TokenID, &spend.TokenAmount); err != nil {
+			return err
+		}
+		msg.ShieldedSpends[i] = spend
+	}
+
+	if count, err = ReadCount(r, MaxSerializeSize/minShieldedOutputSize, "shielded output"); err != nil {
+		return err
+	}
+	msg.ShieldedOutputs = make([]*ShieldedOutput, count)
+	for i := range msg.ShieldedOutputs {
+		output := &ShieldedOutput{}
+		for _, field := range []*[]byte{&output.Cv, &output.Cmu, &output.EphemeralKey, &output.EncCiphertext, &output.OutCiphertext, &output.Proof, &output.Memo} {
+			if *field, err = ReadVarBytes(r, MaxSerializeSize, "shielded output field"); err != nil {
+				return err
+			}
+		}
+		if err := readElements(r, &output.TokenID, &output.TokenAmount); err != nil {
+			return err
+		}
+		msg.ShieldedOutputs[i] = output
+	}
+
+	if msg.BindingSig, err = ReadVarBytes(r, MaxSerializeSize, "binding signature"); err != nil {
+		return err
+	}
+	if msg.Memo, err = ReadVarBytes(r, MaxSerializeSize, "memo"); err != nil {
+		return err
+	}
+	return readElements(r, &msg.GasLimit, &msg.GasPrice, &msg.GasUsed)
+}
+
+// Serialize writes the block header in the binary format of the P2P
+// protocol. The timestamp is written in its time.Time binary form, which
+// keeps the zone offset and nanoseconds the block hash commits to.
+func (h *BlockHeader) Serialize(w io.Writer) error {
+	timestamp, err := h.Timestamp.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := writeElements(w, h.Version, h.PrevBlock, h.MerkleRoot); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(w, timestamp); err != nil {
+		return err
+	}
+	if err := writeElements(w, h.Bits, h.Nonce); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(w, h.DarkMatterSolution); err != nil {
+		return err
+	}
+	return writeElements(w, h.GasLimit, h.GasUsed)
+}
+
+// Deserialize reads a block header written by Serialize
+func (h *BlockHeader) Deserialize(r io.Reader) error {
+	if err := readElements(r, &h.Version, &h.PrevBlock, &h.MerkleRoot); err != nil {
+		return err
+	}
+	timestamp, err := ReadVarBytes(r, 32, "timestamp")
+	if err != nil {
+		return err
+	}
+	h.Timestamp = time.Time{}
+	if err := h.Timestamp.UnmarshalBinary(timestamp); err != nil {
+		return fmt.Errorf("invalid timestamp: %v", err)
+	}
+	if err := readElements(r, &h.Bits, &h.Nonce); err != nil {
+		return err
+	}
+	if h.DarkMatterSolution, err = ReadVarBytes(r, MaxSerializeSize, "solution"); err != nil {
+		return err
+	}
+	return readElements(r, &h.GasLimit, &h.GasUsed)
+}
+
+// Serialize writes the block header followed by its transactions
+func (msg *MsgBlock) Serialize(w io.Writer) error {
+	if err := msg.Header.Serialize(w); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, uint64(len(msg.Transactions))); err != nil {
+		return err
+	}
+	for _, tx := range msg.Transactions {
+		if err := tx.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads a block written by Serialize
+func (msg *MsgBlock) Deserialize(r io.Reader) error {
+	if err := msg.Header.Deserialize(r); err != nil {
+		return err
+	}
+	count, err := ReadCount(r, MaxSerializeSize/minTxSize, "transaction")
+	if err != nil {
+		return err
+	}
+	msg.Transactions = make([]*MsgTx, count)
+	for i := range msg.Transactions {
+		tx := &MsgTx{}
+		if err := tx.Deserialize(r); err != nil {
+			return err
+		}
+		msg.Transactions[i] = tx
+	}
+	return nil
+}
+
+// byteCounter is a writer that only counts the bytes written to it
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// SerializeSize returns the number of bytes Serialize writes for the block
+func (msg *MsgBlock) SerializeSize() int {
+	var size byteCounter
+	msg.Serialize(&size)
+	return int(size)
+}
@@ -0,0 +1,81 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestVarIntRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 0xfc, 0xfd, 0xffff, 0x10000, 0xffffffff, 0x100000000, ^uint64(0)} {
+		var buf bytes.Buffer
+		if err := WriteVarInt(&buf, v); err != nil {
+			t.Fatalf("WriteVarInt(%d) failed: %v", v, err)
+		}
+		got, err := ReadVarInt(&buf)
+		if err != nil || got != v {
+			t.Errorf("ReadVarInt = %d, %v; expected %d", got, err, v)
+		}
+	}
+
+	// 0xfc fits in one byte, so its three-byte form is not canonical
+	if _, err := ReadVarInt(bytes.NewReader([]byte{0xfd, 0xfc, 0x00})); err == nil {
+		t.Error("Accepted non-canonical varint")
+	}
+}
+
+func TestBlockSerializeRoundTrip(t *testing.T) {
+	tx := NewMsgTx(TxVersion)
+	tx.TxType = TxTypeSmartContractCall
+	tx.AddTxIn(&TxIn{PreviousOutPoint: OutPoint{Hash: Hash{1}, Index: 2}, SignatureScript: []byte{3, 4}, Sequence: 5})
+	tx.AddTxOut(&TxOut{Value: 600, PkScript: []byte("obs1recipient")})
+	tx.AddShieldedOutput(&ShieldedOutput{Cv: []byte{7}, Cmu: []byte{8}, Memo: []byte("memo"), TokenID: Hash{9}, TokenAmount: 10})
+	tx.Memo = []byte{0xca, 0x11}
+	tx.GasLimit, tx.GasPrice = 50000, 2
+
+	block := NewMsgBlock(&BlockHeader{
+		Version:            BlockVersion,
+		PrevBlock:          Hash{0xaa},
+		MerkleRoot:         Hash{0xbb},
+		Timestamp:          time.Unix(1700000000, 123456789).In(time.FixedZone("", 3600)),
+		Bits:               0x1d00ffff,
+		Nonce:              42,
+		DarkMatterSolution: []byte{1, 2, 3},
+		GasLimit:           8000000,
+	})
+	block.AddTransaction(NewCoinbaseTx(7, 5000, "obs1miner"))
+	block.AddTransaction(tx)
+
+	var buf bytes.Buffer
+	if err := block.Serialize(&buf); err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+	encoded := append([]byte(nil), buf.Bytes()...)
+
+	decoded := &MsgBlock{}
+	if err := decoded.Deserialize(&buf); err != nil {
+		t.Fatalf("Deserialize failed: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left unread", buf.Len())
+	}
+	if decoded.BlockHash() != block.BlockHash() {
+		t.Error("Block hash changed in round trip")
+	}
+	if decoded.Transactions[1].TxHash() != tx.TxHash() {
+		t.Error("Transaction hash changed in round trip")
+	}
+
+	var again bytes.Buffer
+	if err := decoded.Serialize(&again); err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+	if !bytes.Equal(again.Bytes(), encoded) {
+		t.Error("Re-encoding the decoded block gave different bytes")
+	}
+
+	// Truncated input fails rather than decoding a partial block
+	if err := (&MsgBlock{}).Deserialize(bytes.NewReader(encoded[:len(encoded)-1])); err == nil {
+		t.Error("Decoded truncated block")
+	}
+}
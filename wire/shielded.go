@@ -1,13 +1,16 @@
 package wire
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcutil/base58"
 )
 
@@ -18,6 +21,8 @@ const (
 	NullifierSize         = 32     // Nullifier size in bytes
 	CommitmentSize        = 32     // Note commitment size
 	ProofSize             = 192    // Simplified proof size (real zk-SNARK is larger)
+	noteTagSize           = 32     // Hash of the recipient and rcm
+	OutputProofSize       = noteTagSize + RangeProofSize
 )
 
 // ShieldedAddress represents a shielded (z-address) in Obsidian
@@ -33,6 +38,7 @@ type Note struct {
 	Recipient []byte // Recipient public key
 	Rcm       []byte // Randomness for commitment
 	Memo      []byte // 512 bytes memo
+	TokenID   Hash   // Token of the value, from the output (zero hash for OB)
 }
 
 // NoteCommitment represents a commitment to a note
@@ -104,6 +110,12 @@ func ParseShieldedAddress(address string) (*ShieldedAddress, error) {
 	}, nil
 }
 
+// IsShieldedAddress reports whether address is a valid shielded address
+func IsShieldedAddress(address string) bool {
+	_, err := ParseShieldedAddress(address)
+	return err == nil
+}
+
 // CreateNote creates a new shielded note
 func CreateNote(value int64, recipient []byte, memo []byte) (*Note, error) {
 	if len(memo) > 512 {
@@ -128,26 +140,63 @@ func CreateNote(value int64, recipient []byte, memo []byte) (*Note, error) {
 	}, nil
 }
 
-// Commit creates a commitment to the note
+// Commit creates a commitment to the note: hash(cv || tag) where cv is the
+// note's value commitment and tag hashes the recipient and rcm. The value
+// held by the commitment is therefore the one committed to by the output's
+// Cv.
 func (n *Note) Commit() *NoteCommitment {
-	// Simplified commitment: hash(value || recipient || rcm)
-	h := sha256.New()
+	return &NoteCommitment{
+		Cm: noteCommitment(n.ValueCommitment(), n.tag()),
+	}
+}
 
-	// Write value (8 bytes, little-endian)
-	valueBytes := make([]byte, 8)
-	for i := 0; i < 8; i++ {
-		valueBytes[i] = byte(n.Value >> (i * 8))
+// ValueCommitTrapdoor returns the note's value commitment trapdoor (rcv),
+// derived from rcm so that the recipient can recompute the commitment
+func (n *Note) ValueCommitTrapdoor() []byte {
+	b := n.rcv().Bytes()
+	return b[:]
+}
+
+// ValueCommitment returns the commitment to the note's value that its
+// output carries as Cv
+func (n *Note) ValueCommitment() []byte {
+	var valuePart, blindPart, cv btcec.JacobianPoint
+	btcec.ScalarMultNonConst(int64Scalar(n.Value), valueBase(n.TokenID), &valuePart)
+	btcec.ScalarBaseMultNonConst(n.rcv(), &blindPart)
+	btcec.AddNonConst(&valuePart, &blindPart, &cv)
+	return pointBytes(&cv)
+}
+
+// rcv hashes rcm into a non-zero scalar
+func (n *Note) rcv() *btcec.ModNScalar {
+	var s btcec.ModNScalar
+	for counter := uint32(0); ; counter++ {
+		h := sha256.New()
+		h.Write([]byte(noteRcvDomain))
+		h.Write(n.Rcm)
+		binary.Write(h, binary.LittleEndian, counter)
+		if overflow := s.SetByteSlice(h.Sum(nil)); !overflow && !s.IsZero() {
+			return &s
+		}
 	}
+}
 
-	h.Write(valueBytes)
+// tag hashes the recipient and rcm of the note
+func (n *Note) tag() []byte {
+	h := sha256.New()
+	h.Write([]byte(noteTagDomain))
 	h.Write(n.Recipient)
 	h.Write(n.Rcm)
+	return h.Sum(nil)
+}
 
-	cm := h.Sum(nil)
-
-	return &NoteCommitment{
-		Cm: cm,
-	}
+// noteCommitment hashes a value commitment and note tag into a commitment
+func noteCommitment(cv, tag []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(noteCommitDomain))
+	h.Write(cv)
+	h.Write(tag)
+	return h.Sum(nil)
 }
 
 // ComputeNullifier computes a nullifier for the note
@@ -347,6 +396,36 @@ func VerifyProof(proof []byte, commitment []byte, nullifier []byte) bool {
 	return true
 }
 
+// GenerateOutputProof creates the proof of a shielded output carrying note:
+// the note tag followed by a range proof of the note's value commitment.
+func GenerateOutputProof(note *Note) ([]byte, error) {
+	if note.Value < 0 {
+		return nil, fmt.Errorf("cannot prove negative value")
+	}
+
+	rangeProof, err := proveRange(uint64(note.Value), note.rcv(), note.TokenID, note.ValueCommitment())
+	if err != nil {
+		return nil, err
+	}
+	return append(note.tag(), rangeProof...), nil
+}
+
+// VerifyOutputProof verifies the proof of a shielded output. The note
+// commitment must hash the output's value commitment, tying the note's
+// value to Cv, and Cv must hold a value in [0, 2^64) of the output's token.
+func VerifyOutputProof(output *ShieldedOutput) bool {
+	if len(output.Proof) != OutputProofSize || len(output.Cmu) != CommitmentSize ||
+		len(output.Cv) != ValueCommitmentSize {
+		return false
+	}
+
+	tag := output.Proof[:noteTagSize]
+	if !bytes.Equal(noteCommitment(output.Cv, tag), output.Cmu) {
+		return false
+	}
+	return verifyRange(output.Proof[noteTagSize:], output.TokenID, output.Cv)
+}
+
 // DeriveSharedSecret derives a shared secret for encryption
 func DeriveSharedSecret(recipientPublicKey []byte, senderPrivateKey []byte) []byte {
 	// Simplified ECDH (in production, use proper curve25519 or secp256k1)
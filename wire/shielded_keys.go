@@ -0,0 +1,354 @@
+package wire
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Shielded key constants
+const (
+	SpendingKeySize  = 32 // Spending key seed
+	SpendAuthSigSize = 65 // Schnorr signature: R (33 bytes) || s (32 bytes)
+	EphemeralKeySize = 33 // Compressed secp256k1 point
+)
+
+// Domain separators for shielded key derivation and note encryption
+const (
+	askDomain          = "Obsidian_ask"
+	nskDomain          = "Obsidian_nsk"
+	ivkDomain          = "Obsidian_ivk"
+	ovkDomain          = "Obsidian_ovk"
+	spendAuthSigDomain = "Obsidian_SpendAuthSig"
+	spendAuthNonce     = "Obsidian_SpendAuthNonce"
+	noteKDFDomain      = "Obsidian_NoteKDF"
+	outKDFDomain       = "Obsidian_OutKDF"
+)
+
+// ShieldedSpendingKey is the secret from which every key of a z-address is
+// derived:
+//
+//	ask  spend authorizing key, ak = ask*G signs spends (re-randomized as rk)
+//	nsk  nullifier key, derives the nullifier of notes owned by the key
+//	ivk  incoming viewing key, pk_d = ivk*G is the address transmission key
+//	ovk  outgoing viewing key, recovers notes sent from the key
+type ShieldedSpendingKey struct {
+	Sk []byte // 32 bytes
+}
+
+// GenerateShieldedSpendingKey creates a new random spending key
+func GenerateShieldedSpendingKey() (*ShieldedSpendingKey, error) {
+	sk := make([]byte, SpendingKeySize)
+	if _, err := rand.Read(sk); err != nil {
+		return nil, err
+	}
+	return &ShieldedSpendingKey{Sk: sk}, nil
+}
+
+// NewShieldedSpendingKey wraps an existing 32-byte spending key
+func NewShieldedSpendingKey(sk []byte) (*ShieldedSpendingKey, error) {
+	if len(sk) != SpendingKeySize {
+		return nil, fmt.Errorf("invalid spending key length: %d", len(sk))
+	}
+	return &ShieldedSpendingKey{Sk: append([]byte(nil), sk...)}, nil
+}
+
+// deriveScalar hashes the spending key under a domain into a non-zero scalar
+func (k *ShieldedSpendingKey) deriveScalar(domain string) *btcec.ModNScalar {
+	var s btcec.ModNScalar
+	for counter := uint32(0); ; counter++ {
+		h := sha256.New()
+		h.Write([]byte(domain))
+		h.Write(k.Sk)
+		binary.Write(h, binary.LittleEndian, counter)
+		if overflow := s.SetByteSlice(h.Sum(nil)); !overflow && !s.IsZero() {
+			return &s
+		}
+	}
+}
+
+// AuthorizingKey returns ak = ask*G as a compressed point
+func (k *ShieldedSpendingKey) AuthorizingKey() []byte {
+	var ak btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(k.deriveScalar(askDomain), &ak)
+	return pointBytes(&ak)
+}
+
+// NullifierKey returns nsk, the secret used to derive nullifiers
+func (k *ShieldedSpendingKey) NullifierKey() []byte {
+	b := k.deriveScalar(nskDomain).Bytes()
+	return b[:]
+}
+
+// IncomingViewingKey returns ivk, which decrypts notes sent to the address
+func (k *ShieldedSpendingKey) IncomingViewingKey() []byte {
+	b := k.deriveScalar(ivkDomain).Bytes()
+	return b[:]
+}
+
+// OutgoingViewingKey returns ovk, which recovers notes sent by the key
+func (k *ShieldedSpendingKey) OutgoingViewingKey() []byte {
+	b := k.deriveScalar(ovkDomain).Bytes()
+	return b[:]
+}
+
+// Address returns the z-address of the key. PublicKey is the x coordinate of
+// ak (the note recipient tag) and ViewingKey is the x coordinate of the
+// transmission key pk_d = ivk*G.
+func (k *ShieldedSpendingKey) Address() *ShieldedAddress {
+	var pkd btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(k.deriveScalar(ivkDomain), &pkd)
+
+	return &ShieldedAddress{
+		Prefix:     ShieldedAddressPrefix,
+		PublicKey:  k.AuthorizingKey()[1:],
+		ViewingKey: pointBytes(&pkd)[1:],
+	}
+}
+
+// OwnsNote reports whether a decrypted note is addressed to this key
+func (k *ShieldedSpendingKey) OwnsNote(note *Note) bool {
+	recipient := k.AuthorizingKey()[1:]
+	if len(note.Recipient) != len(recipient) {
+		return false
+	}
+	for i := range recipient {
+		if note.Recipient[i] != recipient[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NoteEncryption holds the encrypted form of a note for a shielded output
+type NoteEncryption struct {
+	EphemeralKey  []byte // epk = esk*G
+	EncCiphertext []byte // Note encrypted to the recipient
+	Esk           []byte // Ephemeral secret, needed for OutCiphertext
+}
+
+// EncryptNoteToAddress encrypts a note so that only the holder of the
+// address's incoming viewing key can decrypt it. The shared secret is the
+// ECDH of a fresh ephemeral key with the transmission key pk_d.
+func EncryptNoteToAddress(note *Note, addr *ShieldedAddress) (*NoteEncryption, error) {
+	pkd, err := liftX(addr.ViewingKey)
+	if err != nil {
+		return nil, ErrShieldedAddress
+	}
+
+	esk, err := GenerateValueCommitTrapdoor()
+	if err != nil {
+		return nil, err
+	}
+	eskScalar, _ := parseScalar(esk)
+
+	var epk btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(eskScalar, &epk)
+	epkBytes := pointBytes(&epk)
+
+	key := noteKey(ecdhX(eskScalar, pkd), epkBytes)
+	ciphertext, err := EncryptNote(note, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NoteEncryption{
+		EphemeralKey:  epkBytes,
+		EncCiphertext: ciphertext,
+		Esk:           esk,
+	}, nil
+}
+
+// TryDecryptNote attempts to decrypt an output's note with an incoming
+// viewing key. It fails if the note was not sent to the key.
+func TryDecryptNote(ivk, epk, encCiphertext []byte) (*Note, error) {
+	ivkScalar, err := parseScalar(ivk)
+	if err != nil {
+		return nil, err
+	}
+	epkPoint, err := parsePoint(epk)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecryptNote(encCiphertext, noteKey(ecdhX(ivkScalar, epkPoint), epk))
+}
+
+// DecryptNoteWithEsk decrypts an output's note from the sender side using
+// the ephemeral secret and the recipient's transmission key.
+func DecryptNoteWithEsk(esk, pkd, epk, encCiphertext []byte) (*Note, error) {
+	eskScalar, err := parseScalar(esk)
+	if err != nil {
+		return nil, err
+	}
+	pkdPoint, err := liftX(pkd)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecryptNote(encCiphertext, noteKey(ecdhX(eskScalar, pkdPoint), epk))
+}
+
+// EncryptOutgoing encrypts pk_d || esk under the sender's outgoing viewing
+// key so the sender can later recover the note it created.
+func EncryptOutgoing(ovk, cv, cmu, epk, pkd, esk []byte) ([]byte, error) {
+	gcm, err := newGCM(OutgoingCipherKey(ovk, cv, cmu, epk))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	plaintext := append(append([]byte(nil), pkd...), esk...)
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// DecryptOutgoing recovers pk_d and esk from an OutCiphertext
+func DecryptOutgoing(ovk, cv, cmu, epk, outCiphertext []byte) (pkd, esk []byte, err error) {
+	return DecryptOutgoingWithOck(OutgoingCipherKey(ovk, cv, cmu, epk), outCiphertext)
+}
+
+// DecryptOutgoingWithOck recovers pk_d and esk from an OutCiphertext using
+// the outgoing cipher key of that single output. Revealing ock discloses
+// one output without revealing ovk.
+func DecryptOutgoingWithOck(ock, outCiphertext []byte) (pkd, esk []byte, err error) {
+	gcm, err := newGCM(ock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(outCiphertext) < nonceSize {
+		return nil, nil, fmt.Errorf("ciphertext too short")
+	}
+
+	plaintext, err := gcm.Open(nil, outCiphertext[:nonceSize], outCiphertext[nonceSize:], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) != 64 {
+		return nil, nil, fmt.Errorf("invalid outgoing plaintext length")
+	}
+
+	return plaintext[:32], plaintext[32:], nil
+}
+
+// GenerateSpendAuthRandomizer returns a random scalar alpha used to
+// re-randomize ak into the per-spend key rk
+func GenerateSpendAuthRandomizer() ([]byte, error) {
+	return GenerateValueCommitTrapdoor()
+}
+
+// RandomizedKey returns rk = ak + alpha*G for the spending key
+func (k *ShieldedSpendingKey) RandomizedKey(alpha []byte) ([]byte, error) {
+	a, err := parseScalar(alpha)
+	if err != nil {
+		return nil, err
+	}
+	rsk := new(btcec.ModNScalar).Add2(k.deriveScalar(askDomain), a)
+
+	var rk btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(rsk, &rk)
+	return pointBytes(&rk), nil
+}
+
+// SignSpendAuth signs the shielded sighash for the spend at index with the
+// re-randomized key rsk = ask + alpha. The spend's Rk must already be set.
+func (msg *MsgTx) SignSpendAuth(index int, key *ShieldedSpendingKey, alpha []byte) error {
+	if index < 0 || index >= len(msg.ShieldedSpends) {
+		return fmt.Errorf("spend index %d out of range", index)
+	}
+
+	a, err := parseScalar(alpha)
+	if err != nil {
+		return err
+	}
+	rsk := new(btcec.ModNScalar).Add2(key.deriveScalar(askDomain), a)
+
+	var rk btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(rsk, &rk)
+
+	sig, err := schnorrSign(rsk, &rk, spendAuthSigDomain, spendAuthNonce, msg.ShieldedSigHash())
+	if err != nil {
+		return err
+	}
+
+	msg.ShieldedSpends[index].SpendAuthSig = sig
+	return nil
+}
+
+// VerifySpendAuthSigs checks that every shielded spend is authorized by the
+// holder of the key behind its randomized key Rk
+func (msg *MsgTx) VerifySpendAuthSigs() error {
+	if len(msg.ShieldedSpends) == 0 {
+		return nil
+	}
+
+	sigHash := msg.ShieldedSigHash()
+	for i, spend := range msg.ShieldedSpends {
+		rk, err := parsePoint(spend.Rk)
+		if err != nil {
+			return fmt.Errorf("spend %d: invalid randomized key", i)
+		}
+		if !schnorrVerify(rk, spend.SpendAuthSig, spendAuthSigDomain, sigHash) {
+			return fmt.Errorf("spend %d: invalid spend authorization signature", i)
+		}
+	}
+
+	return nil
+}
+
+// liftX returns the curve point with the given x coordinate and even y
+func liftX(x []byte) (*btcec.JacobianPoint, error) {
+	if len(x) != 32 {
+		return nil, fmt.Errorf("invalid x coordinate length: %d", len(x))
+	}
+	return parsePoint(append([]byte{0x02}, x...))
+}
+
+// ecdhX returns the x coordinate of secret*point. Only x is used so that
+// the shared secret does not depend on the sign of y lost by liftX.
+func ecdhX(secret *btcec.ModNScalar, point *btcec.JacobianPoint) []byte {
+	var shared btcec.JacobianPoint
+	btcec.ScalarMultNonConst(secret, point, &shared)
+	return pointBytes(&shared)[1:]
+}
+
+// noteKey derives the note encryption key from the ECDH secret
+func noteKey(sharedX, epk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(noteKDFDomain))
+	h.Write(sharedX)
+	h.Write(epk)
+	return h.Sum(nil)
+}
+
+// OutgoingCipherKey derives the outgoing cipher key (ock) of an output from
+// the sender's ovk and the output's public fields
+func OutgoingCipherKey(ovk, cv, cmu, epk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(outKDFDomain))
+	h.Write(ovk)
+	h.Write(cv)
+	h.Write(cmu)
+	h.Write(epk)
+	return h.Sum(nil)
+}
+
+// newGCM creates an AES-256-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
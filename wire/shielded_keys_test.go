@@ -0,0 +1,101 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNoteEncryptionRoundTrip(t *testing.T) {
+	recipient, err := GenerateShieldedSpendingKey()
+	if err != nil {
+		t.Fatalf("GenerateShieldedSpendingKey failed: %v", err)
+	}
+	other, _ := GenerateShieldedSpendingKey()
+	addr := recipient.Address()
+
+	// The address must survive encoding
+	parsed, err := ParseShieldedAddress(addr.String())
+	if err != nil {
+		t.Fatalf("ParseShieldedAddress failed: %v", err)
+	}
+	if !bytes.Equal(parsed.ViewingKey, addr.ViewingKey) || !bytes.Equal(parsed.PublicKey, addr.PublicKey) {
+		t.Fatal("Address keys changed after round trip")
+	}
+
+	note, _ := CreateNote(12345, addr.PublicKey, []byte("memo"))
+	enc, err := EncryptNoteToAddress(note, parsed)
+	if err != nil {
+		t.Fatalf("EncryptNoteToAddress failed: %v", err)
+	}
+
+	decrypted, err := TryDecryptNote(recipient.IncomingViewingKey(), enc.EphemeralKey, enc.EncCiphertext)
+	if err != nil {
+		t.Fatalf("Recipient failed to decrypt note: %v", err)
+	}
+	if decrypted.Value != note.Value || !bytes.Equal(decrypted.Rcm, note.Rcm) || !recipient.OwnsNote(decrypted) {
+		t.Error("Decrypted note does not match")
+	}
+
+	if _, err := TryDecryptNote(other.IncomingViewingKey(), enc.EphemeralKey, enc.EncCiphertext); err == nil {
+		t.Error("Note decrypted with the wrong viewing key")
+	}
+
+	// The sender recovers the note through its outgoing viewing key
+	sender, _ := GenerateShieldedSpendingKey()
+	cv := bytes.Repeat([]byte{0x02}, ValueCommitmentSize)
+	cmu := note.Commit().Cm
+	out, err := EncryptOutgoing(sender.OutgoingViewingKey(), cv, cmu, enc.EphemeralKey, addr.ViewingKey, enc.Esk)
+	if err != nil {
+		t.Fatalf("EncryptOutgoing failed: %v", err)
+	}
+
+	pkd, esk, err := DecryptOutgoing(sender.OutgoingViewingKey(), cv, cmu, enc.EphemeralKey, out)
+	if err != nil {
+		t.Fatalf("DecryptOutgoing failed: %v", err)
+	}
+	recovered, err := DecryptNoteWithEsk(esk, pkd, enc.EphemeralKey, enc.EncCiphertext)
+	if err != nil {
+		t.Fatalf("DecryptNoteWithEsk failed: %v", err)
+	}
+	if recovered.Value != note.Value {
+		t.Errorf("Recovered value = %d, want %d", recovered.Value, note.Value)
+	}
+}
+
+func TestSpendAuthSig(t *testing.T) {
+	key, _ := GenerateShieldedSpendingKey()
+	alpha, _ := GenerateSpendAuthRandomizer()
+	rk, err := key.RandomizedKey(alpha)
+	if err != nil {
+		t.Fatalf("RandomizedKey failed: %v", err)
+	}
+	if bytes.Equal(rk, key.AuthorizingKey()) {
+		t.Error("Randomized key equals the authorizing key")
+	}
+
+	tx := NewShieldedTx(TxVersion)
+	tx.AddShieldedSpend(&ShieldedSpend{Rk: rk, Nullifier: bytes.Repeat([]byte{1}, NullifierSize)})
+
+	if err := tx.VerifySpendAuthSigs(); err == nil {
+		t.Error("Unsigned spend accepted")
+	}
+
+	if err := tx.SignSpendAuth(0, key, alpha); err != nil {
+		t.Fatalf("SignSpendAuth failed: %v", err)
+	}
+	if err := tx.VerifySpendAuthSigs(); err != nil {
+		t.Errorf("Valid spend authorization rejected: %v", err)
+	}
+
+	// Signing with another key or changing the transaction must fail
+	tx.ShieldedSpends[0].Nullifier[0] ^= 0xff
+	if err := tx.VerifySpendAuthSigs(); err == nil {
+		t.Error("Spend authorization survived sighash change")
+	}
+
+	other, _ := GenerateShieldedSpendingKey()
+	tx.SignSpendAuth(0, other, alpha)
+	if err := tx.VerifySpendAuthSigs(); err == nil {
+		t.Error("Spend authorized by the wrong key")
+	}
+}
@@ -66,6 +66,16 @@ func TestParseShieldedAddress(t *testing.T) {
 	if !bytes.Equal(addr2.ViewingKey, addr1.ViewingKey) {
 		t.Error("Viewing key mismatch")
 	}
+
+	// Only well-formed addresses are recognized
+	if !IsShieldedAddress(addrStr) {
+		t.Error("Generated address not recognized as shielded")
+	}
+	for _, bad := range []string{"", "obs1abc", addrStr[:len(addrStr)-1], "zobs" + addrStr} {
+		if IsShieldedAddress(bad) {
+			t.Errorf("%q recognized as shielded", bad)
+		}
+	}
 }
 
 func TestCreateNote(t *testing.T) {
@@ -232,6 +242,76 @@ func TestVerifyProof(t *testing.T) {
 	}
 }
 
+// newProvenOutput returns an output carrying note with a valid output proof
+func newProvenOutput(t *testing.T, note *Note) *ShieldedOutput {
+	t.Helper()
+
+	proof, err := GenerateOutputProof(note)
+	if err != nil {
+		t.Fatalf("Failed to generate output proof: %v", err)
+	}
+	return &ShieldedOutput{
+		Cv:      note.ValueCommitment(),
+		Cmu:     note.Commit().Cm,
+		Proof:   proof,
+		TokenID: note.TokenID,
+	}
+}
+
+func TestOutputProof(t *testing.T) {
+	note, err := CreateNote(1000, make([]byte, 32), nil)
+	if err != nil {
+		t.Fatalf("Failed to create note: %v", err)
+	}
+	note.TokenID = Hash{0x42}
+
+	output := newProvenOutput(t, note)
+	if !VerifyOutputProof(output) {
+		t.Fatal("Valid output proof rejected")
+	}
+
+	// The proof is bound to the output's token and value commitment
+	wrongToken := *output
+	wrongToken.TokenID = Hash{}
+	if VerifyOutputProof(&wrongToken) {
+		t.Error("Output proof accepted for another token")
+	}
+	other, _ := CreateNote(1000, make([]byte, 32), nil)
+	other.TokenID = note.TokenID
+	wrongCv := *output
+	wrongCv.Cv = other.ValueCommitment()
+	if VerifyOutputProof(&wrongCv) {
+		t.Error("Output proof accepted for another value commitment")
+	}
+
+	// A note claiming more than the output commits to does not open it
+	inflated := *note
+	inflated.Value = 1000000
+	if bytes.Equal(inflated.Commit().Cm, output.Cmu) {
+		t.Error("Note with a different value opens the commitment")
+	}
+
+	// Negative values wrap around the group order and fail the range proof
+	negative := *note
+	negative.Value = -5
+	if _, err := GenerateOutputProof(&negative); err == nil {
+		t.Error("Proof generated for a negative value")
+	}
+	rangeProof, err := proveRange(uint64(negative.Value), negative.rcv(), negative.TokenID, negative.ValueCommitment())
+	if err != nil {
+		t.Fatalf("Failed to build forged range proof: %v", err)
+	}
+	forged := &ShieldedOutput{
+		Cv:      negative.ValueCommitment(),
+		Cmu:     negative.Commit().Cm,
+		Proof:   append(negative.tag(), rangeProof...),
+		TokenID: negative.TokenID,
+	}
+	if VerifyOutputProof(forged) {
+		t.Error("Output proof accepted for a negative value")
+	}
+}
+
 func TestMemoTooLarge(t *testing.T) {
 	largeMemo := make([]byte, 600) // Larger than 512
 	_, err := CreateNote(100, make([]byte, 32), largeMemo)
@@ -0,0 +1,444 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Value commitment constants
+const (
+	ValueCommitmentSize     = 33 // Compressed secp256k1 point
+	ValueCommitTrapdoorSize = 32 // Commitment randomness (rcv) scalar
+	BindingSigSize          = 65 // Schnorr signature: R (33 bytes) || s (32 bytes)
+)
+
+// Domain separators for the value commitment scheme
+const (
+	valueBaseDomain   = "Obsidian_ValueBase"
+	bindingSigDomain  = "Obsidian_BindingSig"
+	bindingNonceLabel = "Obsidian_BindingNonce"
+	shieldedSigDomain = "Obsidian_ShieldedSigHash"
+	noteRcvDomain     = "Obsidian_NoteRcv"
+	noteTagDomain     = "Obsidian_NoteTag"
+	noteCommitDomain  = "Obsidian_NoteCommit"
+)
+
+// valueBaseCache caches the value base point derived for each token ID
+var valueBaseCache sync.Map // Hash -> *btcec.JacobianPoint
+
+// Pedersen value commitments
+//
+// A value commitment is cv = v*V_t + rcv*G where V_t is the value base of the
+// token t (hashed to the curve, so nobody knows its discrete log relative to
+// G) and rcv is a random trapdoor. Commitments are additively homomorphic:
+//
+//	sum(cv_spends) - sum(cv_outputs) - ValueBalance*V_OB = bsk*G
+//
+// holds exactly when every token balances and the OB surplus of the shielded
+// part equals ValueBalance. The signer proves knowledge of bsk with the
+// binding signature over the transaction sighash.
+
+// ValueBase returns the value base point for a token as a compressed point.
+// The zero hash is the value base for native OB.
+func ValueBase(tokenID Hash) []byte {
+	base := valueBase(tokenID)
+	return pointBytes(base)
+}
+
+// valueBase derives the value base point for a token by try-and-increment
+// hashing to the curve.
+func valueBase(tokenID Hash) *btcec.JacobianPoint {
+	if cached, ok := valueBaseCache.Load(tokenID); ok {
+		return cached.(*btcec.JacobianPoint)
+	}
+
+	var counter uint32
+	var point btcec.JacobianPoint
+	for {
+		h := sha256.New()
+		h.Write([]byte(valueBaseDomain))
+		h.Write(tokenID[:])
+		binary.Write(h, binary.LittleEndian, counter)
+
+		candidate := append([]byte{0x02}, h.Sum(nil)...)
+		if pubKey, err := btcec.ParsePubKey(candidate); err == nil {
+			pubKey.AsJacobian(&point)
+			break
+		}
+		counter++
+	}
+
+	valueBaseCache.Store(tokenID, &point)
+	return &point
+}
+
+// GenerateValueCommitTrapdoor returns a random commitment trapdoor (rcv)
+func GenerateValueCommitTrapdoor() ([]byte, error) {
+	scalar, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	b := scalar.Bytes()
+	return b[:], nil
+}
+
+// CommitValue creates a Pedersen commitment to value of the given token using
+// the trapdoor rcv.
+func CommitValue(value int64, tokenID Hash, rcv []byte) ([]byte, error) {
+	if value < 0 {
+		return nil, fmt.Errorf("cannot commit to negative value")
+	}
+
+	r, err := parseScalar(rcv)
+	if err != nil {
+		return nil, err
+	}
+
+	var valuePart, blindPart, cv btcec.JacobianPoint
+	btcec.ScalarMultNonConst(int64Scalar(value), valueBase(tokenID), &valuePart)
+	btcec.ScalarBaseMultNonConst(r, &blindPart)
+	btcec.AddNonConst(&valuePart, &blindPart, &cv)
+
+	if isInfinity(&cv) {
+		return nil, ErrInvalidCommitment
+	}
+
+	return pointBytes(&cv), nil
+}
+
+// DeriveBindingKey computes the binding signing key bsk from the trapdoors
+// of the spends and outputs: bsk = sum(rcv_spends) - sum(rcv_outputs).
+func DeriveBindingKey(spendTrapdoors, outputTrapdoors [][]byte) ([]byte, error) {
+	var bsk btcec.ModNScalar
+
+	for _, rcv := range spendTrapdoors {
+		r, err := parseScalar(rcv)
+		if err != nil {
+			return nil, err
+		}
+		bsk.Add(r)
+	}
+
+	for _, rcv := range outputTrapdoors {
+		r, err := parseScalar(rcv)
+		if err != nil {
+			return nil, err
+		}
+		bsk.Add(new(btcec.ModNScalar).NegateVal(r))
+	}
+
+	b := bsk.Bytes()
+	return b[:], nil
+}
+
+// ShieldedSigHash returns the hash committed to by the binding signature.
+// It covers every field of the transaction except signature data.
+func (msg *MsgTx) ShieldedSigHash() Hash {
+	var buf bytes.Buffer
+	buf.WriteString(shieldedSigDomain)
+
+	binary.Write(&buf, binary.LittleEndian, msg.Version)
+	buf.WriteByte(byte(msg.TxType))
+
+	binary.Write(&buf, binary.LittleEndian, uint32(len(msg.TxIn)))
+	for _, txIn := range msg.TxIn {
+		buf.Write(txIn.PreviousOutPoint.Hash[:])
+		binary.Write(&buf, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+		binary.Write(&buf, binary.LittleEndian, txIn.Sequence)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, uint32(len(msg.TxOut)))
+	for _, txOut := range msg.TxOut {
+		binary.Write(&buf, binary.LittleEndian, txOut.Value)
+		writeSigHashBytes(&buf, txOut.PkScript)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, msg.LockTime)
+	binary.Write(&buf, binary.LittleEndian, msg.ExpiryHeight)
+	binary.Write(&buf, binary.LittleEndian, msg.ValueBalance)
+
+	binary.Write(&buf, binary.LittleEndian, uint32(len(msg.ShieldedSpends)))
+	for _, spend := range msg.ShieldedSpends {
+		writeSigHashBytes(&buf, spend.Cv)
+		writeSigHashBytes(&buf, spend.Anchor)
+		writeSigHashBytes(&buf, spend.Nullifier)
+		writeSigHashBytes(&buf, spend.Rk)
+		writeSigHashBytes(&buf, spend.Proof)
+		buf.Write(spend.TokenID[:])
+		binary.Write(&buf, binary.LittleEndian, spend.TokenAmount)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, uint32(len(msg.ShieldedOutputs)))
+	for _, output := range msg.ShieldedOutputs {
+		writeSigHashBytes(&buf, output.Cv)
+		writeSigHashBytes(&buf, output.Cmu)
+		writeSigHashBytes(&buf, output.EphemeralKey)
+		writeSigHashBytes(&buf, output.EncCiphertext)
+		writeSigHashBytes(&buf, output.OutCiphertext)
+		writeSigHashBytes(&buf, output.Proof)
+		writeSigHashBytes(&buf, output.Memo)
+		buf.Write(output.TokenID[:])
+		binary.Write(&buf, binary.LittleEndian, output.TokenAmount)
+	}
+
+	writeSigHashBytes(&buf, msg.Memo)
+	binary.Write(&buf, binary.LittleEndian, msg.GasLimit)
+	binary.Write(&buf, binary.LittleEndian, msg.GasPrice)
+
+	return DoubleHashH(buf.Bytes())
+}
+
+// SignBinding signs the transaction sighash with the binding key bsk and
+// stores the result in BindingSig.
+func (msg *MsgTx) SignBinding(bsk []byte) error {
+	x, err := parseScalar(bsk)
+	if err != nil {
+		return err
+	}
+
+	var bvk btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(x, &bvk)
+	if isInfinity(&bvk) {
+		return fmt.Errorf("binding key is zero")
+	}
+
+	sig, err := schnorrSign(x, &bvk, bindingSigDomain, bindingNonceLabel, msg.ShieldedSigHash())
+	if err != nil {
+		return err
+	}
+
+	msg.BindingSig = sig
+	return nil
+}
+
+// VerifyBindingSig checks that the binding signature is valid for the
+// binding verification key implied by the value commitments and
+// ValueBalance. A valid signature proves that spends minus outputs equals
+// ValueBalance for OB and that every other token balances to zero.
+func (msg *MsgTx) VerifyBindingSig() error {
+	if len(msg.ShieldedSpends) == 0 && len(msg.ShieldedOutputs) == 0 {
+		if msg.ValueBalance != 0 {
+			return ErrValueBalance
+		}
+		return nil
+	}
+
+	if len(msg.BindingSig) != BindingSigSize {
+		return ErrBindingSig
+	}
+
+	bvk, err := msg.bindingVerificationKey()
+	if err != nil {
+		return err
+	}
+
+	if !schnorrVerify(bvk, msg.BindingSig, bindingSigDomain, msg.ShieldedSigHash()) {
+		return ErrBindingSig
+	}
+
+	return nil
+}
+
+// bindingVerificationKey computes
+// bvk = sum(cv_spends) - sum(cv_outputs) - ValueBalance*V_OB
+func (msg *MsgTx) bindingVerificationKey() (*btcec.JacobianPoint, error) {
+	var bvk btcec.JacobianPoint
+	for _, spend := range msg.ShieldedSpends {
+		cv, err := parsePoint(spend.Cv)
+		if err != nil {
+			return nil, ErrInvalidCommitment
+		}
+		bvk = addPoints(&bvk, cv)
+	}
+
+	for _, output := range msg.ShieldedOutputs {
+		cv, err := parsePoint(output.Cv)
+		if err != nil {
+			return nil, ErrInvalidCommitment
+		}
+		bvk = addPoints(&bvk, negatePoint(cv))
+	}
+
+	var balancePart btcec.JacobianPoint
+	btcec.ScalarMultNonConst(int64Scalar(msg.ValueBalance), valueBase(Hash{}), &balancePart)
+	bvk = addPoints(&bvk, negatePoint(&balancePart))
+
+	if isInfinity(&bvk) {
+		return nil, ErrBindingSig
+	}
+
+	return &bvk, nil
+}
+
+// schnorrSign signs sigHash with the secret scalar x whose public point is
+// pub. The nonce is derived from the key, message and fresh randomness so
+// that a weak random source alone cannot leak x.
+func schnorrSign(x *btcec.ModNScalar, pub *btcec.JacobianPoint, domain, nonceLabel string, sigHash Hash) ([]byte, error) {
+	entropy := make([]byte, 32)
+	if _, err := rand.Read(entropy); err != nil {
+		return nil, err
+	}
+	xBytes := x.Bytes()
+	nonceHash := sha256.New()
+	nonceHash.Write([]byte(nonceLabel))
+	nonceHash.Write(xBytes[:])
+	nonceHash.Write(sigHash[:])
+	nonceHash.Write(entropy)
+
+	var k btcec.ModNScalar
+	k.SetByteSlice(nonceHash.Sum(nil))
+	if k.IsZero() {
+		return nil, fmt.Errorf("invalid signature nonce")
+	}
+
+	var r btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&k, &r)
+	rBytes := pointBytes(&r)
+
+	e := schnorrChallenge(domain, rBytes, pointBytes(pub), sigHash)
+
+	// s = k + e*x
+	s := new(btcec.ModNScalar).Mul2(e, x).Add(&k)
+	sBytes := s.Bytes()
+
+	return append(rBytes, sBytes[:]...), nil
+}
+
+// schnorrVerify checks a signature R || s made by schnorrSign
+func schnorrVerify(pub *btcec.JacobianPoint, sig []byte, domain string, sigHash Hash) bool {
+	if len(sig) != BindingSigSize {
+		return false
+	}
+
+	r, err := parsePoint(sig[:33])
+	if err != nil {
+		return false
+	}
+	var s btcec.ModNScalar
+	if overflow := s.SetByteSlice(sig[33:]); overflow {
+		return false
+	}
+
+	e := schnorrChallenge(domain, sig[:33], pointBytes(pub), sigHash)
+
+	// Check s*G == R + e*pub
+	var lhs, epub, rhs btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(&s, &lhs)
+	btcec.ScalarMultNonConst(e, pub, &epub)
+	btcec.AddNonConst(r, &epub, &rhs)
+
+	return bytes.Equal(pointBytes(&lhs), pointBytes(&rhs))
+}
+
+// schnorrChallenge computes the Schnorr challenge e = H(R || pub || sighash)
+func schnorrChallenge(domain string, r, pub []byte, sigHash Hash) *btcec.ModNScalar {
+	h := sha256.New()
+	h.Write([]byte(domain))
+	h.Write(r)
+	h.Write(pub)
+	h.Write(sigHash[:])
+
+	var e btcec.ModNScalar
+	e.SetByteSlice(h.Sum(nil))
+	return &e
+}
+
+// writeSigHashBytes writes a length-prefixed byte slice
+func writeSigHashBytes(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+// parseScalar parses a 32-byte big-endian scalar, rejecting overflow and zero
+func parseScalar(b []byte) (*btcec.ModNScalar, error) {
+	if len(b) != ValueCommitTrapdoorSize {
+		return nil, fmt.Errorf("invalid scalar length: %d", len(b))
+	}
+	var s btcec.ModNScalar
+	if overflow := s.SetByteSlice(b); overflow {
+		return nil, fmt.Errorf("scalar overflows group order")
+	}
+	return &s, nil
+}
+
+// randomScalar returns a uniformly random non-zero scalar
+func randomScalar() (*btcec.ModNScalar, error) {
+	var s btcec.ModNScalar
+	buf := make([]byte, 32)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to read randomness: %v", err)
+		}
+		if overflow := s.SetByteSlice(buf); !overflow && !s.IsZero() {
+			return &s, nil
+		}
+	}
+}
+
+// int64Scalar converts a signed value into a scalar mod n
+func int64Scalar(v int64) *btcec.ModNScalar {
+	var s btcec.ModNScalar
+	var buf [32]byte
+	if v >= 0 {
+		binary.BigEndian.PutUint64(buf[24:], uint64(v))
+		s.SetBytes(&buf)
+		return &s
+	}
+	binary.BigEndian.PutUint64(buf[24:], uint64(-v))
+	s.SetBytes(&buf)
+	return s.Negate()
+}
+
+// parsePoint parses a compressed point into Jacobian form
+func parsePoint(b []byte) (*btcec.JacobianPoint, error) {
+	if len(b) != ValueCommitmentSize {
+		return nil, fmt.Errorf("invalid point length: %d", len(b))
+	}
+	pubKey, err := btcec.ParsePubKey(b)
+	if err != nil {
+		return nil, err
+	}
+	var p btcec.JacobianPoint
+	pubKey.AsJacobian(&p)
+	return &p, nil
+}
+
+// pointBytes serializes a point in compressed form. The point at infinity
+// serializes to 33 zero bytes.
+func pointBytes(p *btcec.JacobianPoint) []byte {
+	if isInfinity(p) {
+		return make([]byte, ValueCommitmentSize)
+	}
+	affine := *p
+	affine.ToAffine()
+	return btcec.NewPublicKey(&affine.X, &affine.Y).SerializeCompressed()
+}
+
+// addPoints returns a + b
+func addPoints(a, b *btcec.JacobianPoint) btcec.JacobianPoint {
+	var sum btcec.JacobianPoint
+	btcec.AddNonConst(a, b, &sum)
+	return sum
+}
+
+// negatePoint returns -p
+func negatePoint(p *btcec.JacobianPoint) *btcec.JacobianPoint {
+	neg := *p
+	if isInfinity(p) {
+		return &neg
+	}
+	neg.ToAffine()
+	neg.Y.Negate(1).Normalize()
+	return &neg
+}
+
+// isInfinity reports whether p is the point at infinity
+func isInfinity(p *btcec.JacobianPoint) bool {
+	return (p.X.IsZero() && p.Y.IsZero()) || p.Z.IsZero()
+}
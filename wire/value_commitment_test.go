@@ -0,0 +1,157 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// buildBalancedTx creates a shielded transaction whose value commitments
+// balance against valueBalance, returning it together with its binding key.
+func buildBalancedTx(t *testing.T, spendValues, outputValues []int64, tokenID Hash, valueBalance int64) (*MsgTx, []byte) {
+	t.Helper()
+
+	tx := NewShieldedTx(TxVersion)
+	tx.ValueBalance = valueBalance
+
+	var spendRcvs, outputRcvs [][]byte
+	for _, v := range spendValues {
+		rcv, err := GenerateValueCommitTrapdoor()
+		if err != nil {
+			t.Fatalf("Failed to generate trapdoor: %v", err)
+		}
+		cv, err := CommitValue(v, tokenID, rcv)
+		if err != nil {
+			t.Fatalf("Failed to commit value: %v", err)
+		}
+		spendRcvs = append(spendRcvs, rcv)
+		tx.AddShieldedSpend(&ShieldedSpend{Cv: cv, TokenID: tokenID})
+	}
+
+	for _, v := range outputValues {
+		rcv, err := GenerateValueCommitTrapdoor()
+		if err != nil {
+			t.Fatalf("Failed to generate trapdoor: %v", err)
+		}
+		cv, err := CommitValue(v, tokenID, rcv)
+		if err != nil {
+			t.Fatalf("Failed to commit value: %v", err)
+		}
+		outputRcvs = append(outputRcvs, rcv)
+		tx.AddShieldedOutput(&ShieldedOutput{Cv: cv, TokenID: tokenID})
+	}
+
+	bsk, err := DeriveBindingKey(spendRcvs, outputRcvs)
+	if err != nil {
+		t.Fatalf("Failed to derive binding key: %v", err)
+	}
+
+	return tx, bsk
+}
+
+func TestValueBaseDistinctPerToken(t *testing.T) {
+	obBase := ValueBase(Hash{})
+	tokenBase := ValueBase(Hash{0x01})
+
+	if len(obBase) != ValueCommitmentSize {
+		t.Errorf("Expected value base length %d, got %d", ValueCommitmentSize, len(obBase))
+	}
+
+	if bytes.Equal(obBase, tokenBase) {
+		t.Error("Value bases for different tokens must differ")
+	}
+
+	if !bytes.Equal(obBase, ValueBase(Hash{})) {
+		t.Error("Value base derivation must be deterministic")
+	}
+}
+
+func TestBindingSigBalanced(t *testing.T) {
+	// Spend 10 OB, send 7 to a shielded output, 3 leave the pool
+	tx, bsk := buildBalancedTx(t, []int64{10}, []int64{7}, Hash{}, 3)
+
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("Failed to sign binding: %v", err)
+	}
+
+	if err := tx.VerifyBindingSig(); err != nil {
+		t.Errorf("Valid binding signature rejected: %v", err)
+	}
+}
+
+func TestBindingSigShieldingNegativeBalance(t *testing.T) {
+	// Shield 5 OB from the transparent pool into a new note
+	tx, bsk := buildBalancedTx(t, nil, []int64{5}, Hash{}, -5)
+
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("Failed to sign binding: %v", err)
+	}
+
+	if err := tx.VerifyBindingSig(); err != nil {
+		t.Errorf("Valid shielding binding signature rejected: %v", err)
+	}
+}
+
+func TestBindingSigRejectsInflation(t *testing.T) {
+	// Spend 10 OB but claim only 1 left the pool while creating 7
+	tx, bsk := buildBalancedTx(t, []int64{10}, []int64{7}, Hash{}, 1)
+
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("Failed to sign binding: %v", err)
+	}
+
+	if err := tx.VerifyBindingSig(); err != ErrBindingSig {
+		t.Errorf("Expected ErrBindingSig for unbalanced transaction, got %v", err)
+	}
+}
+
+func TestBindingSigTokenMustBalance(t *testing.T) {
+	tokenID := Hash{0xaa}
+
+	// Tokens balance on their own; ValueBalance only covers OB
+	tx, bsk := buildBalancedTx(t, []int64{50}, []int64{20, 30}, tokenID, 0)
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("Failed to sign binding: %v", err)
+	}
+	if err := tx.VerifyBindingSig(); err != nil {
+		t.Errorf("Balanced token transaction rejected: %v", err)
+	}
+
+	// Token surplus cannot be declared as OB value balance
+	tx, bsk = buildBalancedTx(t, []int64{50}, []int64{20}, tokenID, 30)
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("Failed to sign binding: %v", err)
+	}
+	if err := tx.VerifyBindingSig(); err != ErrBindingSig {
+		t.Errorf("Expected ErrBindingSig for token surplus, got %v", err)
+	}
+}
+
+func TestBindingSigCoversSigHash(t *testing.T) {
+	tx, bsk := buildBalancedTx(t, []int64{10}, []int64{10}, Hash{}, 0)
+	tx.AddTxOut(&TxOut{Value: 1, PkScript: []byte("addr")})
+
+	if err := tx.SignBinding(bsk); err != nil {
+		t.Fatalf("Failed to sign binding: %v", err)
+	}
+
+	// Tampering with any signed field invalidates the signature
+	tx.TxOut[0].Value = 2
+	if err := tx.VerifyBindingSig(); err != ErrBindingSig {
+		t.Errorf("Expected ErrBindingSig after tampering, got %v", err)
+	}
+}
+
+func TestBindingSigMissing(t *testing.T) {
+	tx, _ := buildBalancedTx(t, []int64{10}, []int64{10}, Hash{}, 0)
+
+	if err := tx.VerifyBindingSig(); err != ErrBindingSig {
+		t.Errorf("Expected ErrBindingSig for missing signature, got %v", err)
+	}
+
+	// A purely transparent transaction may not claim a value balance
+	transparent := NewMsgTx(TxVersion)
+	transparent.ValueBalance = 5
+	if err := transparent.VerifyBindingSig(); err != ErrValueBalance {
+		t.Errorf("Expected ErrValueBalance, got %v", err)
+	}
+}